@@ -0,0 +1,283 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//////// ACCESS CONTROL
+
+const ownerUser = "owner"
+
+const (
+	opRead   = "read"
+	opWrite  = "write"
+	opDelete = "delete"
+)
+
+// Grants a user, or the members of a group, some operations on
+// everything under a path prefix.
+type aclRule struct {
+	User   string   `json:"user"`
+	Group  string   `json:"group"`
+	Prefix string   `json:"prefix"`
+	Allow  []string `json:"allow"`
+}
+
+type contextKey string
+
+const userContextKey = contextKey("user")
+
+func secureEquals(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(*&a), []byte(*&b)) == 1
+}
+
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(*&auth, "Bearer ") {
+		return strings.TrimPrefix(*&auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Identifies the user behind a request from the credentials of the schemes
+// in use, its URL or request signature, or its session cookie.
+func authenticate(r *http.Request) (user string, ok bool) {
+	user, ok = checkCredentials(requestCredentials(*&r))
+	if ok {
+		return
+	}
+	if user, ok = signedUser(*&r); ok {
+		return
+	}
+	if user, ok = renderUser(*&r); ok {
+		return
+	}
+	if user, ok = signedRequestUser(*&r); ok {
+		return
+	}
+	return sessionUser(*&r)
+}
+
+// Finds the user owning some credentials, as recognized by the first
+// scheme in use accepting them.
+func checkCredentials(c credentials) (user string, ok bool) {
+	for _, p := range activeAuth() {
+		if user, ok = p.check(*&c); ok {
+			return
+		}
+	}
+	return "", false
+}
+
+func withUser(r *http.Request, user string) *http.Request {
+	if c, ok := r.Context().Value(clientStatsContextKey).(*clientCall); ok {
+		c.user = user
+	}
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, *&user))
+}
+
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey).(string)
+	return user
+}
+
+func isUnderPrefix(p string, prefix string) bool {
+	return prefix == "." || p == prefix || strings.HasPrefix(*&p, prefix+"/")
+}
+
+func allowed(user string, p string, op string) bool {
+	if user == ownerUser {
+		return true
+	}
+	if dir, ok := tenantDir(*&user); ok && isUnderPrefix(*&p, *&dir) {
+		return true
+	}
+	groups := userGroups(*&user)
+	for _, rule := range cloudConfig.ACL {
+		member := rule.User != "" && rule.User == user || rule.Group != "" && sliceContains(*&groups, rule.Group)
+		if !member || !sliceContains(rule.Allow, *&op) {
+			continue
+		}
+		prefix, ok := uriToPath(rule.Prefix)
+		if ok && isUnderPrefix(*&p, *&prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Path of a URI given in the body of a request, if the user of the request
+// may perform the operation on it.
+func bodyPath(r *http.Request, uri string, op string) (p string, ok bool) {
+	p, ok = uriToPath(*&uri)
+	if !ok || authEnabled() && !allowed(requestUser(*&r), *&p, *&op) {
+		return "", false
+	}
+	return
+}
+
+func methodOperation(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return opRead
+	case "DELETE":
+		return opDelete
+	}
+	return opWrite
+}
+
+// Routes taking their target from the "path" parameter of the query
+// rather than from the URL.
+var queryPathRoutes = []string{renderPath, tailPath, statsPath, snapshotsPath, cachePath, watcherPath}
+
+// URI targeted by a request: the rest of the URL after the API prefix,
+// the "path" parameter of the query based APIs, or the whole URL for the
+// static file server. Handlers and the ACL both read it from here, so
+// that they agree on the target.
+func requestUri(r *http.Request) string {
+	rest := strings.TrimPrefix(r.URL.Path, "/")
+	_, pattern := http.DefaultServeMux.Handler(*&r)
+	if sliceContains(queryPathRoutes, *&pattern) {
+		if q := r.URL.Query().Get("path"); q != "" {
+			return q
+		}
+		return "."
+	}
+	if pattern == "/" {
+		return rest
+	}
+	if i := strings.Index(*&rest, "/"); i >= 0 {
+		return rest[i+1:]
+	}
+	return "."
+}
+
+// Path targeted by a request, refused when internal.
+func requestPath(r *http.Request) (p string, ok bool) {
+	return uriToPath(requestUri(*&r))
+}
+
+// Checks every path and operation involved in a request against the ACL.
+func authorize(user string, r *http.Request) bool {
+	p, ok := requestPath(r)
+	op := methodOperation(r.Method)
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, blocksPath) {
+		// Posting a signature only reads the file
+		op = opRead
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, pairPath) {
+		// Pairing shares for reading
+		op = opRead
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, rewritePath) {
+		// Rewriting only reads the document
+		op = opRead
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, exportPath) {
+		// Generating an export only reads the directory
+		op = opRead
+	}
+	if !ok || !allowed(*&user, *&p, *&op) {
+		return false
+	}
+	if source := r.Header.Get("sourceURI"); source != "" {
+		s, ok := uriToPath(*&source)
+		if !ok || !allowed(*&user, *&s, opRead) {
+			return false
+		}
+		if r.Header.Get("delete-source") == "true" || r.Header.Get("operation") == "move" {
+			return allowed(*&user, *&s, opDelete)
+		}
+	}
+	if dest := r.Header.Get("destination"); dest != "" {
+		d, ok := uriToPath(*&dest)
+		if !ok || !allowed(*&user, *&d, opWrite) {
+			return false
+		}
+	}
+	return true
+}
+
+//////// MIDDLEWARES
+
+func aclMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if requireSigningFlag && cleartextCredentials(*&r) {
+			w.Header().Set("WWW-Authenticate", signedRequestScheme+` realm="`+APP_NAME+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user, ok := authenticate(r)
+		if strings.HasPrefix(r.URL.Path, sharedPath) || r.URL.Path == inboxPath && r.Method == "POST" {
+			// Share links are their own credentials, and the inbox open
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, statusPath) || strings.HasPrefix(r.URL.Path, authPath) {
+			// Open to everyone, telling users their root when they are known
+			if ok {
+				r = withUser(*&r, *&user)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+APP_NAME+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := ensureTenant(*&user); err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Events, jobs, shares and the inbox are filtered by user instead of
+		// being refused
+		filtered := strings.HasPrefix(r.URL.Path, eventsPath) || strings.HasPrefix(r.URL.Path, jobsPath) ||
+			strings.HasPrefix(r.URL.Path, sharesPath) || strings.HasPrefix(r.URL.Path, inboxPath) ||
+			strings.HasPrefix(r.URL.Path, snapshotsPath) || strings.HasPrefix(r.URL.Path, versionsPath) || strings.HasPrefix(r.URL.Path, schedulePath) ||
+			strings.HasPrefix(r.URL.Path, retentionPath) || strings.HasPrefix(r.URL.Path, connectorsPath) ||
+			strings.HasPrefix(r.URL.Path, statsPath) || strings.HasPrefix(r.URL.Path, debugPath) ||
+			strings.HasPrefix(r.URL.Path, statPath) || strings.HasPrefix(r.URL.Path, keysPath) ||
+			strings.HasPrefix(r.URL.Path, exportsPath)
+		if !keyPermits(*&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !filtered && isHiddenPath(requestUri(*&r)) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !filtered && !authorize(*&user, *&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, withUser(*&r, *&user))
+	})
+}
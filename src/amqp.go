@@ -0,0 +1,311 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// AMQP
+
+// Client of AMQP 0-9-1 limited to publishing on a single channel, enough
+// for RabbitMQ and its kin. Messages are marked persistent.
+
+const (
+	amqpMethodFrame    = 1
+	amqpHeaderFrame    = 2
+	amqpBodyFrame      = 3
+	amqpHeartbeatFrame = 8
+	amqpFrameEnd       = 0xce
+)
+
+// Class and method identifiers
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicPublish      = 60<<16 | 40
+)
+
+const amqpBasicClass = 60
+const amqpChannel = 1
+
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+type amqpConnection struct {
+	mutex    sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	frameMax int
+	exchange string
+	broken   chan struct{}
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpLongString(s string) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(*&b, uint32(len(s)))
+	return append(*&b, s...)
+}
+
+func amqpMethod(method int, args ...[]byte) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(*&b, uint32(*&method))
+	for _, a := range args {
+		b = append(*&b, a...)
+	}
+	return b
+}
+
+func (a *amqpConnection) writeFrame(kind byte, channel uint16, payload []byte) (err error) {
+	frame := make([]byte, 7, 8+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:], *&channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(payload)))
+	frame = append(append(*&frame, payload...), amqpFrameEnd)
+	a.conn.SetWriteDeadline(time.Now().Add(brokerTimeout))
+	_, err = a.conn.Write(*&frame)
+	return
+}
+
+func (a *amqpConnection) readFrame() (f amqpFrame, err error) {
+	header := make([]byte, 7)
+	_, err = io.ReadFull(a.reader, *&header)
+	if err != nil {
+		return
+	}
+	f.kind = header[0]
+	f.channel = binary.BigEndian.Uint16(header[1:])
+	f.payload = make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	_, err = io.ReadFull(a.reader, f.payload)
+	if err != nil {
+		return
+	}
+	if f.payload[len(f.payload)-1] != amqpFrameEnd {
+		return f, errors.New("amqp: malformed frame")
+	}
+	f.payload = f.payload[:len(f.payload)-1]
+	return
+}
+
+// Waits for a given method during the handshake, skipping heartbeats.
+func (a *amqpConnection) expect(method int) (args []byte, err error) {
+	for {
+		f, err := a.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if f.kind != amqpMethodFrame || len(f.payload) < 4 {
+			continue
+		}
+		got := int(binary.BigEndian.Uint32(f.payload))
+		if got == method {
+			return f.payload[4:], nil
+		}
+		if got == amqpConnectionClose || got == amqpChannelClose {
+			return nil, amqpCloseError(f.payload[4:])
+		}
+		return nil, fmt.Errorf("amqp: unexpected method %d.%d", got>>16, got&0xffff)
+	}
+}
+
+func amqpCloseError(args []byte) error {
+	if len(args) < 3 || len(args) < 3+int(args[2]) {
+		return errors.New("amqp: closed by the broker")
+	}
+	return fmt.Errorf("amqp: closed by the broker: %d %s", binary.BigEndian.Uint16(args), args[3:3+args[2]])
+}
+
+func dialAMQP(u *url.URL, b *bridgeConfig) (c brokerConnection, err error) {
+	conn, err := dialBroker(*&u, "5672", "5671")
+	if err != nil {
+		return
+	}
+	a := &amqpConnection{conn: conn, reader: bufio.NewReader(*&conn), exchange: b.Exchange, broken: make(chan struct{})}
+	err = a.handshake(*&u)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go a.drain()
+	return a, nil
+}
+
+func (a *amqpConnection) handshake(u *url.URL) (err error) {
+	a.conn.SetDeadline(time.Now().Add(brokerTimeout))
+	defer a.conn.SetDeadline(time.Time{})
+	_, err = a.conn.Write([]byte("AMQP\x00\x00\x09\x01"))
+	if err != nil {
+		return
+	}
+	_, err = a.expect(amqpConnectionStart)
+	if err != nil {
+		return
+	}
+	user, password := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	err = a.writeFrame(amqpMethodFrame, 0, amqpMethod(amqpConnectionStartOk,
+		[]byte{0, 0, 0, 0}, // Empty client properties
+		amqpShortString("PLAIN"),
+		amqpLongString("\x00"+user+"\x00"+password),
+		amqpShortString("en_US")))
+	if err != nil {
+		return
+	}
+	tune, err := a.expect(amqpConnectionTune)
+	if err != nil {
+		return
+	}
+	if len(tune) < 8 {
+		return errors.New("amqp: malformed tune")
+	}
+	a.frameMax = int(binary.BigEndian.Uint32(tune[2:]))
+	if a.frameMax == 0 || a.frameMax > 1<<17 {
+		a.frameMax = 1 << 17
+	}
+	// Heartbeats are declined, the connection is checked by publishing
+	tuneOk := make([]byte, 8)
+	copy(*&tuneOk, tune[:2])
+	binary.BigEndian.PutUint32(tuneOk[2:], uint32(a.frameMax))
+	err = a.writeFrame(amqpMethodFrame, 0, amqpMethod(amqpConnectionTuneOk, *&tuneOk))
+	if err != nil {
+		return
+	}
+	vhost := strings.TrimPrefix(u.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	err = a.writeFrame(amqpMethodFrame, 0, amqpMethod(amqpConnectionOpen, amqpShortString(*&vhost), amqpShortString(""), []byte{0}))
+	if err != nil {
+		return
+	}
+	_, err = a.expect(amqpConnectionOpenOk)
+	if err != nil {
+		return
+	}
+	err = a.writeFrame(amqpMethodFrame, amqpChannel, amqpMethod(amqpChannelOpen, amqpShortString("")))
+	if err != nil {
+		return
+	}
+	_, err = a.expect(amqpChannelOpenOk)
+	return
+}
+
+// Watches what the broker sends once connected, acknowledging it closing
+// the connection or the channel, after which publishing fails.
+func (a *amqpConnection) drain() {
+	defer close(a.broken)
+	for {
+		f, err := a.readFrame()
+		if err != nil {
+			return
+		}
+		if f.kind != amqpMethodFrame || len(f.payload) < 4 {
+			continue
+		}
+		switch int(binary.BigEndian.Uint32(f.payload)) {
+		case amqpConnectionClose:
+			log.Println(amqpCloseError(f.payload[4:]))
+			a.mutex.Lock()
+			a.writeFrame(amqpMethodFrame, 0, amqpMethod(amqpConnectionCloseOk))
+			a.mutex.Unlock()
+			return
+		case amqpChannelClose:
+			log.Println(amqpCloseError(f.payload[4:]))
+			a.mutex.Lock()
+			a.writeFrame(amqpMethodFrame, amqpChannel, amqpMethod(amqpChannelCloseOk))
+			a.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (a *amqpConnection) publish(topic string, payload []byte) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-a.broken:
+		return errors.New("amqp: connection closed")
+	default:
+	}
+	err = a.writeFrame(amqpMethodFrame, amqpChannel, amqpMethod(amqpBasicPublish,
+		[]byte{0, 0}, amqpShortString(a.exchange), amqpShortString(*&topic), []byte{0}))
+	if err != nil {
+		return
+	}
+	// Content type and persistent delivery mode
+	header := make([]byte, 14)
+	binary.BigEndian.PutUint16(*&header, amqpBasicClass)
+	binary.BigEndian.PutUint64(header[4:], uint64(len(payload)))
+	binary.BigEndian.PutUint16(header[12:], 0x8000|0x1000)
+	header = append(append(*&header, amqpShortString("application/json")...), 2)
+	err = a.writeFrame(amqpHeaderFrame, amqpChannel, *&header)
+	if err != nil {
+		return
+	}
+	for max := a.frameMax - 8; len(payload) > 0; {
+		n := len(payload)
+		if n > max {
+			n = max
+		}
+		err = a.writeFrame(amqpBodyFrame, amqpChannel, payload[:n])
+		if err != nil {
+			return
+		}
+		payload = payload[n:]
+	}
+	return
+}
+
+func (a *amqpConnection) close() error {
+	a.mutex.Lock()
+	a.writeFrame(amqpMethodFrame, 0, amqpMethod(amqpConnectionClose, []byte{0, 200}, amqpShortString(""), []byte{0, 0, 0, 0}))
+	a.mutex.Unlock()
+	return a.conn.Close()
+}
@@ -0,0 +1,114 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////// API VERSIONS
+
+// Clients may ask for a version of the API with the x-ninja-api-version
+// header, so that breaking changes can be made for the clients asking for
+// them while others keep the behavior they were written for. Clients not
+// asking get the first version.
+
+const apiVersionHeader = "x-ninja-api-version"
+const apiVersionContextKey = contextKey("api-version")
+
+// Version 2 lists directories in a compact JSON form.
+var apiVersions = []int{1, 2}
+
+// Version of the API a request was made for.
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionContextKey).(int); ok {
+		return v
+	}
+	return apiVersions[0]
+}
+
+// Optional features of this cloud, as set up.
+func capabilities() (list []string) {
+	list = []string{"events", "jobs", "palette", "inspect", "drafts", "autosave", "revisions", "shares", "signed-urls", "sessions", "block-deltas", "pairing", "batch-stat", "batch-existence", "tail", "encryption", "trash", "background-deletes", "duplicate", "merge", "api-keys", "signed-requests", "permission-repair", "portable-names", "url-rewriting", "save-page", "cache-policies", "virtual-hosts", "export", "date-formats", "localization", "case-only-renames", "disk-space-checks", "copy-reports", "mirror", "sync-conflicts", "versions", "client-stats", "trashed-listings", "resumable-exports", "upload-progress", "watcher-control", "soft-restart"}
+	if oidcEnabled() {
+		list = append(list, "oidc")
+	}
+	if tenantsFlag {
+		list = append(list, "tenants")
+	}
+	if inboxFlag {
+		list = append(list, "inbox")
+	}
+	if snapshots != nil {
+		list = append(list, "snapshots")
+	}
+	if len(cloudConfig.Devices) > 0 {
+		list = append(list, "devices")
+	}
+	if clipboardFlag {
+		list = append(list, "clipboard")
+	}
+	if backendFlag == "disk" && overlayFlag == "" {
+		list = append(list, "desktop")
+	}
+	if chromeFlag != "" {
+		list = append(list, "render")
+	}
+	if ffmpegFlag != "" {
+		list = append(list, "transcode")
+	}
+	if _, ok := findGit(); ok {
+		list = append(list, "git-import")
+	}
+	sort.Strings(list)
+	return
+}
+
+//////// MIDDLEWARES
+
+func apiVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested := r.Header.Get(apiVersionHeader)
+		if requested == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(*&requested))
+		supported := false
+		for _, s := range apiVersions {
+			supported = supported || s == v
+		}
+		if err != nil || !supported {
+			writeCORSHeaders(w)
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":        "unsupported API version",
+				"message":      errorMessage(*&r, "unsupported-api-version"),
+				"api-versions": apiVersions,
+			})
+			return
+		}
+		w.Header().Set(apiVersionHeader, strconv.Itoa(*&v))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionContextKey, *&v)))
+	})
+}
@@ -0,0 +1,436 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// PROJECT ARCHIVES
+
+// Projects put away into a compressed archive, out of the listings, and
+// brought back as they were, settings included. Manifests are kept in
+// the metadata store, the list of files in the archives themselves. Files
+// of encrypted projects are archived sealed, with the parameters of their
+// project, and restored as they were archived.
+
+const archivesDir = hiddenPrefix + "archives"
+const archivesBucket = "archives"
+
+var errArchiveKey = errors.New("project was encrypted or decrypted since it was archived")
+
+type archiveManifest struct {
+	Uri      string          `json:"uri"`
+	Archived string          `json:"archived"`
+	Files    int             `json:"files"`
+	Size     string          `json:"size"`
+	Stored   string          `json:"stored"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+}
+
+type archivedFile struct {
+	Uri          string `json:"uri"`
+	Size         string `json:"size"`
+	ModifiedDate string `json:"modifiedDate"`
+}
+
+func archiveFile(p string) string {
+	return filepath.Join(archivesDir, metadataKey(*&p)+".zip")
+}
+
+func loadArchive(p string) (m archiveManifest, ok bool) {
+	v, ok := metadata.get(archivesBucket, metadataKey(*&p))
+	if !ok || json.Unmarshal([]byte(*&v), &m) != nil {
+		return m, false
+	}
+	return m, true
+}
+
+func listArchives() (list []archiveManifest) {
+	list = []archiveManifest{}
+	for _, key := range metadata.keys(archivesBucket, ".") {
+		if m, ok := loadArchive(*&key); ok {
+			m.Settings = nil
+			list = append(list, m)
+		}
+	}
+	return
+}
+
+// Reads an archive as it is stored, the files it holds being sealed already
+// when their project is encrypted.
+func openZip(p string) (z *zip.Reader, closer io.Closer, err error) {
+	info, err := rawStorage().stat(*&p)
+	if err != nil {
+		return
+	}
+	f, err := rawStorage().open(*&p)
+	if err != nil {
+		return
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		content, err := ioutil.ReadAll(*&f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		ra = bytes.NewReader(*&content)
+	}
+	z, err = zip.NewReader(*&ra, info.Size())
+	if err != nil {
+		f.Close()
+		return
+	}
+	return z, f, nil
+}
+
+// Files of an archived project, from the central directory of its archive.
+func archivedFiles(p string) (files []archivedFile, err error) {
+	z, closer, err := openZip(archiveFile(*&p))
+	if err != nil {
+		return
+	}
+	defer closer.Close()
+	files = []archivedFile{}
+	for _, f := range z.File {
+		if isHiddenPath(f.Name) {
+			continue
+		}
+		files = append(files, archivedFile{pathToUri(filepath.FromSlash(f.Name)), strconv.FormatUint(f.UncompressedSize64, 10), milliseconds(f.Modified)})
+	}
+	return
+}
+
+// Compresses a project into an archive, then removes it.
+func archiveProject(ctx context.Context, j *job, p string) (err error) {
+	var files []string
+	var size int64
+	err = walk(*&p, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !storedInArchives(*&info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, fp)
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	// Parts of encrypted projects are kept with the parameters sealing them
+	params := filepath.Join(encryptionProject(*&p), encryptionFile)
+	if _, serr := rawStorage().stat(*&params); serr == nil && !sliceContains(*&files, *&params) {
+		files = append(*&files, *&params)
+	}
+	name := archiveFile(*&p)
+	err = createDir(filepath.Dir(*&name))
+	if err != nil {
+		return
+	}
+	tmp := name + ".tmp"
+	f, err := rawStorage().create(*&tmp, 0666)
+	if err != nil {
+		return
+	}
+	zw := zip.NewWriter(*&f)
+	for i, fp := range files {
+		err = ioPause(*&ctx)
+		if err != nil {
+			break
+		}
+		err = addToZip(*&zw, *&fp)
+		if err != nil {
+			break
+		}
+		j.setProgress(float64(i+1) / float64(len(*&files)+1))
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = rawStorage().rename(*&tmp, *&name)
+	}
+	if err != nil {
+		removeFile(*&tmp)
+		return
+	}
+	stored, err := rawStorage().stat(*&name)
+	if err != nil {
+		return
+	}
+	m := archiveManifest{
+		Uri:      pathToUri(*&p),
+		Archived: milliseconds(time.Now()),
+		Files:    len(*&files),
+		Size:     strconv.FormatInt(*&size, 10),
+		Stored:   strconv.FormatInt(stored.Size(), 10),
+	}
+	if settings, ok := metadata.get(settingsBucket, metadataKey(*&p)); ok {
+		m.Settings = json.RawMessage(*&settings)
+	}
+	jm, err := json.Marshal(*&m)
+	if err != nil {
+		return
+	}
+	metadata.put(archivesBucket, metadataKey(*&p), string(*&jm))
+	snapshotBefore("archive")
+	err = removeDir(*&p)
+	if err != nil {
+		return
+	}
+	forgetMetadata(*&p)
+	return
+}
+
+// Extracts an archived project where it was, then drops the archive.
+func unarchiveProject(p string, m archiveManifest) (err error) {
+	z, closer, err := openZip(archiveFile(*&p))
+	if err != nil {
+		return
+	}
+	err = extractStored(*&z, archiveFile(*&p))
+	closer.Close()
+	if err != nil {
+		return
+	}
+	err = createDir(*&p)
+	if err != nil {
+		return
+	}
+	if len(m.Settings) > 0 {
+		err = writeSettings(*&p, m.Settings)
+		if err != nil {
+			return
+		}
+	}
+	metadata.delete(archivesBucket, metadataKey(*&p))
+	err = removeFile(archiveFile(*&p))
+	return
+}
+
+// Reads a file of an archive.
+func readZipFile(f *zip.File) (content []byte, err error) {
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(*&rc)
+}
+
+// Writes the files of an archive as they were stored, sealed ones included,
+// restoring the parameters of encrypted projects unless they changed since.
+func extractStored(z *zip.Reader, archive string) (err error) {
+	var files []*zip.File
+	var paths []string
+	for _, f := range z.File {
+		name := filepath.Base(filepath.FromSlash(f.Name))
+		if isHiddenPath(f.Name) && name != encryptionFile || f.FileInfo().IsDir() {
+			continue
+		}
+		p, ok := uriToPath(strings.TrimSuffix(f.Name, name))
+		if !ok {
+			return fmt.Errorf("%s: invalid path %s", archive, f.Name)
+		}
+		files = append(*&files, *&f)
+		paths = append(*&paths, filepath.Join(*&p, *&name))
+	}
+	// Files are only restored into projects sealed as they were when they
+	// were archived, whole projects being restored with their parameters
+	archived := make(map[string][]byte)
+	restored := make([]bool, len(*&files))
+	for i, f := range files {
+		project := encryptionProject(paths[i])
+		if _, seen := archived[project]; !seen {
+			archived[project] = nil
+		}
+		restored[i] = true
+		if paths[i] != filepath.Join(*&project, encryptionFile) {
+			continue
+		}
+		archived[project], err = readZipFile(*&f)
+		if err != nil {
+			return
+		}
+		_, serr := rawStorage().stat(*&project)
+		restored[i] = serr != nil
+	}
+	for project, params := range archived {
+		if _, serr := rawStorage().stat(*&project); serr != nil {
+			continue
+		}
+		var current []byte
+		if pf, oerr := rawStorage().open(filepath.Join(*&project, encryptionFile)); oerr == nil {
+			current, err = ioutil.ReadAll(*&pf)
+			pf.Close()
+			if err != nil {
+				return
+			}
+		}
+		if !bytes.Equal(*&current, *&params) {
+			return errArchiveKey
+		}
+	}
+
+	for i, f := range files {
+		if !restored[i] {
+			continue
+		}
+		content, err := readZipFile(*&f)
+		if err != nil {
+			return err
+		}
+		err = createDir(filepath.Dir(paths[i]))
+		if err != nil {
+			return err
+		}
+		w, err := rawStorage().create(paths[i], 0777)
+		if err != nil {
+			return err
+		}
+		err = writeAndClose(*&w, *&content)
+		if err != nil {
+			return err
+		}
+	}
+	// Told apart again from what was just written
+	if e, ok := encryptedFsys(); ok {
+		for _, p := range paths {
+			e.forget(encryptionProject(*&p))
+		}
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Archives API
+
+// Archive a project, list archives, read a manifest, restore or drop one
+func archivesHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[archivesPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if p == "." {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, listArchives())
+		return
+	}
+	m, archived := loadArchive(*&p)
+
+	switch r.Method {
+	case "GET":
+		// Manifest of an archived project, with its files
+		if !archived {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		files, err := archivedFiles(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"manifest": m, "files": files})
+		return
+	case "POST":
+		// Archive a project
+		if archived {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		info, err := properties(*&p)
+		if err != nil || !info.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j := startJob(r, "archive", pathToUri(*&p), func(ctx context.Context, j *job) (string, error) {
+			j.setState(jobRunning)
+			return pathToUri(*&p), archiveProject(*&ctx, *&j, *&p)
+		})
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *&j)
+		return
+	case "PUT":
+		// Restore an archived project
+		if !archived {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if exist(*&p) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		j := startJob(r, "unarchive", pathToUri(*&p), func(ctx context.Context, j *job) (string, error) {
+			j.setState(jobRunning)
+			return pathToUri(*&p), unarchiveProject(*&p, *&m)
+		})
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *&j)
+		return
+	case "DELETE":
+		// Drop an archive for good
+		if !archived {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		err := removeFile(archiveFile(*&p))
+		if err != nil && !os.IsNotExist(*&err) {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		metadata.delete(archivesBucket, metadataKey(*&p))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
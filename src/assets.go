@@ -0,0 +1,267 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////// EMBEDDED ASSETS
+
+// Templates, web UI, MIME map and license shipped inside the binary. Any
+// file of the -assets directory takes precedence over its embedded copy.
+//
+//go:embed all:assets
+var embeddedAssets embed.FS
+
+const templatesDir = "templates"
+const uiDir = "ui"
+
+var errTemplateNotFound = errors.New("template not found")
+
+// Layers a user directory over the embedded assets.
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.upper != nil {
+		f, err := o.upper.Open(*&name)
+		if err == nil {
+			return f, nil
+		}
+	}
+	return o.lower.Open(*&name)
+}
+
+func (o overlayFS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	seen := make(map[string]bool)
+	if o.upper != nil {
+		upper, err := fs.ReadDir(o.upper, *&name)
+		if err == nil {
+			for _, e := range upper {
+				seen[e.Name()] = true
+				entries = append(*&entries, *&e)
+			}
+		}
+	}
+	lower, err := fs.ReadDir(o.lower, *&name)
+	if err != nil && len(*&entries) == 0 {
+		return nil, err
+	}
+	for _, e := range lower {
+		if !seen[e.Name()] {
+			entries = append(*&entries, *&e)
+		}
+	}
+	sort.Slice(*&entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func assets() fs.FS {
+	lower, _ := fs.Sub(embeddedAssets, "assets")
+	o := overlayFS{lower: lower}
+	if assetsDirFlag != "" {
+		o.upper = os.DirFS(assetsDirFlag)
+	}
+	return o
+}
+
+func assetsSub(dir string) fs.FS {
+	sub, _ := fs.Sub(assets(), *&dir)
+	return sub
+}
+
+// Writes the embedded assets into a directory so that they can be
+// customized and then used with -assets.
+func extractAssets(dest string) error {
+	return fs.WalkDir(embeddedAssets, "assets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(*&dest, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(*&p, "assets"), "/")))
+		if d.IsDir() {
+			return os.MkdirAll(*&target, 0777)
+		}
+		if _, err := os.Stat(*&target); err == nil {
+			// Never overwrite user customizations
+			return nil
+		}
+		content, err := embeddedAssets.ReadFile(*&p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*&target, *&content, 0666)
+	})
+}
+
+//// MIME types
+
+func registerMimeTypes() {
+	f, err := assets().Open("mime.types")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(*&f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(*&line, "#") {
+			continue
+		}
+		fields := strings.SplitN(*&line, "\t", 2)
+		if len(*&fields) != 2 {
+			continue
+		}
+		err := mime.AddExtensionType(fields[0], strings.TrimSpace(fields[1]))
+		if err != nil {
+			log.Println(*&err)
+		}
+	}
+}
+
+//// License
+
+func printLicense() {
+	f, err := assets().Open("LICENSE")
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	defer f.Close()
+	io.Copy(os.Stdout, *&f)
+}
+
+//// Project templates
+
+func listTemplates() (names []string, err error) {
+	names = []string{}
+	entries, err := fs.ReadDir(assets(), templatesDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(*&names, e.Name())
+		}
+	}
+	return
+}
+
+// Creates a new project directory from a template.
+func instantiateTemplate(name string, dest string) (err error) {
+	if name == "" || strings.ContainsAny(*&name, "/\\") || name == "." || name == ".." {
+		return errTemplateNotFound
+	}
+	template := assetsSub(path.Join(templatesDir, *&name))
+	if _, err := fs.Stat(*&template, "."); err != nil {
+		return errTemplateNotFound
+	}
+	if exist(*&dest) {
+		return os.ErrExist
+	}
+	return fs.WalkDir(*&template, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(*&dest, filepath.FromSlash(*&p))
+		if d.IsDir() {
+			return createDir(*&target)
+		}
+		if d.Name() == ".keep" {
+			// Placeholder for empty directories
+			return nil
+		}
+		content, err := fs.ReadFile(*&template, *&p)
+		if err != nil {
+			return err
+		}
+		return saveFile(*&target, *&content)
+	})
+}
+
+//////// REQUEST HANDLERS
+
+//// Templates API
+
+// List the project templates, or create a project from one of them
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	switch r.Method {
+	case "GET":
+		names, err := listTemplates()
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&names)
+		return
+	case "POST":
+		dest, ok := uriToPath(r.Header.Get("destination"))
+		if !ok || dest == "." {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err := instantiateTemplate(r.URL.Path[templatesPathLen:], *&dest)
+		if err == errTemplateNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == os.ErrExist {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+//// Web UI
+
+func uiHandler() http.Handler {
+	files := http.StripPrefix(uiPath, http.FileServer(http.FS(assetsSub(uiDir))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == uiPath+uiMessagesFile {
+			uiMessagesHandler(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
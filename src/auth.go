@@ -0,0 +1,191 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+//////// AUTHENTICATION PROVIDERS
+
+// Each scheme tells who the credentials of a request belong to. The "auth"
+// configuration entry lists those accepted, in order, and defaults to all
+// the configured ones. "none" turns authentication off altogether.
+// Session cookies and signed URLs stand for a previous authentication, and
+// are accepted by whichever scheme issued them.
+
+type authProvider interface {
+	// Whether the scheme has what it needs to recognize anyone
+	configured() bool
+	// Finds the user owning some credentials
+	check(c credentials) (user string, ok bool)
+}
+
+// Credentials of a request, or posted to the login route.
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+var authProviders = map[string]authProvider{
+	"token": tokenAuth{},
+	"basic": basicAuth{},
+	"oidc":  oidcAuth{},
+	"none":  noAuth{},
+}
+
+var defaultAuth = []string{"token", "basic", "oidc"}
+
+func requestCredentials(r *http.Request) (c credentials) {
+	c.Name, c.Password, _ = r.BasicAuth()
+	c.Token = requestToken(*&r)
+	return
+}
+
+// Providers in use, in the order they are tried.
+func activeAuth() (providers []authProvider) {
+	names := cloudConfig.Auth
+	if len(names) == 0 {
+		names = defaultAuth
+	}
+	for _, n := range names {
+		if p := authProviders[n]; p.configured() {
+			providers = append(providers, p)
+		}
+	}
+	return
+}
+
+func authEnabled() bool {
+	return len(activeAuth()) > 0
+}
+
+// Validates the chosen schemes against the settings they rely on.
+func checkAuth() (err error) {
+	listed := make(map[string]bool)
+	for _, n := range cloudConfig.Auth {
+		if _, ok := authProviders[n]; !ok {
+			return errors.New("unknown authentication scheme " + n)
+		}
+		listed[n] = true
+	}
+	if len(listed) == 0 {
+		return
+	}
+	if listed["none"] && len(listed) > 1 {
+		return errors.New("authentication scheme none excludes the others")
+	}
+	if oidcEnabled() && !listed["oidc"] {
+		return errors.New("OpenID Connect is configured but not among the authentication schemes")
+	}
+	for n := range listed {
+		if n != "none" && !authProviders[n].configured() {
+			logWarn("Authentication scheme", n, "is not configured and accepts no one")
+		}
+	}
+	if tokenFlag != "" && !listed["token"] {
+		logWarn("The owner token is not among the authentication schemes and will be refused")
+	}
+	return
+}
+
+//// Providers
+
+// Bearer tokens, in a header or the "token" parameter: the owner token,
+// those of configured users and the API keys they issued.
+type tokenAuth struct{}
+
+func (tokenAuth) configured() bool {
+	if tokenFlag != "" {
+		return true
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (tokenAuth) check(c credentials) (user string, ok bool) {
+	if c.Token == "" {
+		return
+	}
+	if tokenFlag != "" && secureEquals(c.Token, tokenFlag) {
+		return ownerUser, true
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Token != "" && secureEquals(c.Token, u.Token) {
+			return u.Name, true
+		}
+	}
+	if k, found := findKey(c.Token); found {
+		return k.User, true
+	}
+	return
+}
+
+// Names and passwords of configured users.
+type basicAuth struct{}
+
+func (basicAuth) configured() bool {
+	for _, u := range cloudConfig.Users {
+		if u.Password != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (basicAuth) check(c credentials) (user string, ok bool) {
+	if c.Name == "" {
+		return
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Password != "" && c.Name == u.Name && secureEquals(c.Password, u.Password) {
+			return u.Name, true
+		}
+	}
+	return
+}
+
+// Logins through an OpenID Connect provider, which end in a session.
+type oidcAuth struct{}
+
+func (oidcAuth) configured() bool {
+	return oidcEnabled()
+}
+
+func (oidcAuth) check(c credentials) (user string, ok bool) {
+	return
+}
+
+// Nobody is authenticated, and so everyone is let in.
+type noAuth struct{}
+
+func (noAuth) configured() bool {
+	return false
+}
+
+func (noAuth) check(c credentials) (user string, ok bool) {
+	return
+}
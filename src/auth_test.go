@@ -0,0 +1,359 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func basicHeader(name string, password string) map[string]string {
+	return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))}
+}
+
+func bearerHeader(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func testCredentials(t *testing.T, p authProvider, accepted map[credentials]string, refused []credentials) {
+	t.Helper()
+	for c, want := range accepted {
+		if user, ok := p.check(*&c); !ok || user != want {
+			t.Errorf("%+v: got %q %v, want %q", c, user, ok, want)
+		}
+	}
+	for _, c := range refused {
+		if user, ok := p.check(*&c); ok {
+			t.Errorf("%+v: accepted as %q", c, user)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	newTestCloud(t)
+	if (tokenAuth{}).configured() {
+		t.Error("configured without tokens")
+	}
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	cloudConfig.Users = []configUser{{Name: "alice", Token: "alice-token"}, {Name: "bob", Password: "bob-password"}}
+
+	testCredentials(t, tokenAuth{}, map[credentials]string{
+		{Token: "owner-token"}: ownerUser,
+		{Token: "alice-token"}: "alice",
+	}, []credentials{
+		{},
+		{Token: "wrong"},
+		{Token: "owner-token-"},
+		{Name: "bob", Password: "bob-password"},
+	})
+}
+
+func TestBasicAuth(t *testing.T) {
+	newTestCloud(t)
+	cloudConfig.Users = []configUser{{Name: "alice", Token: "alice-token"}}
+	if (basicAuth{}).configured() {
+		t.Error("configured without passwords")
+	}
+	cloudConfig.Users = append(cloudConfig.Users, configUser{Name: "bob", Password: "bob-password"})
+
+	testCredentials(t, basicAuth{}, map[credentials]string{
+		{Name: "bob", Password: "bob-password"}: "bob",
+	}, []credentials{
+		{},
+		{Name: "bob", Password: "wrong"},
+		{Name: "bob"},
+		{Name: "alice"},
+		{Name: "carol", Password: "bob-password"},
+		{Token: "alice-token"},
+	})
+}
+
+func TestOIDCAuth(t *testing.T) {
+	newTestCloud(t)
+	if (oidcAuth{}).configured() {
+		t.Error("configured without a provider")
+	}
+	cloudConfig.OIDC = &oidcConfig{Issuer: "https://issuer.invalid", ClientId: "ninja"}
+	if !(oidcAuth{}).configured() {
+		t.Error("not configured with a provider")
+	}
+	// Logins only end in a session, never in credentials
+	testCredentials(t, oidcAuth{}, nil, []credentials{
+		{},
+		{Token: "anything"},
+		{Name: "alice", Password: "anything"},
+	})
+
+	withCookie := func(value string) *http.Request {
+		r := httptest.NewRequest("GET", "/directory/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		return r
+	}
+	session := newSession("alice@example.com", time.Now().Add(time.Hour))
+	if user, ok := authenticate(withCookie(*&session)); !ok || user != "alice@example.com" {
+		t.Errorf("session: %q %v", user, ok)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(ownerUser)) + session[strings.Index(session, "."):]
+	if user, ok := authenticate(withCookie(*&forged)); ok {
+		t.Errorf("forged session accepted as %q", user)
+	}
+	expired := newSession("alice@example.com", time.Now().Add(-time.Minute))
+	if user, ok := authenticate(withCookie(*&expired)); ok {
+		t.Errorf("expired session accepted as %q", user)
+	}
+}
+
+// ID token signed with an RSA key, as a provider would.
+func signedIDToken(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCTokens(t *testing.T) {
+	newTestCloud(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJSON(w, http.StatusOK, map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+				"jwks_uri":               issuer + "/keys",
+			})
+		case "/keys":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+	cloudConfig.OIDC = &oidcConfig{Issuer: issuer, ClientId: "ninja"}
+	oidcDiscovery.provider, oidcDiscovery.keys, oidcDiscovery.keysFetched = nil, nil, time.Time{}
+	defer func() { oidcDiscovery.provider, oidcDiscovery.keys, oidcDiscovery.keysFetched = nil, nil, time.Time{} }()
+	if err := checkOIDC(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := discoverProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{
+		"iss":            issuer,
+		"aud":            "ninja",
+		"exp":            float64(time.Now().Add(time.Hour).Unix()),
+		"nonce":          "n",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+	verified, err := verifyIDToken(p, signedIDToken(key, "k1", claims))
+	if err != nil || checkClaims(verified, "n") != nil || verified["email"] != "alice@example.com" {
+		t.Errorf("signed token: %v %v", verified, err)
+	}
+	if _, err := verifyIDToken(p, signedIDToken(other, "k1", claims)); err == nil {
+		t.Error("token signed with another key accepted")
+	}
+	token := signedIDToken(key, "k1", claims)
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]interface{}{"iss": issuer, "aud": "ninja", "email": "owner@example.com"})
+	if _, err := verifyIDToken(p, parts[0]+"."+base64.RawURLEncoding.EncodeToString(forged)+"."+parts[2]); err == nil {
+		t.Error("altered token accepted")
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	if _, err := verifyIDToken(p, unsigned); err == nil {
+		t.Error("unsigned token accepted")
+	}
+
+	// Addresses must be verified to name users
+	claims["email_verified"] = false
+	if checkClaims(claims, "n") == nil {
+		t.Error("unverified address accepted")
+	}
+	delete(claims, "email_verified")
+	if checkClaims(claims, "n") == nil {
+		t.Error("address without verification accepted")
+	}
+	cloudConfig.OIDC.UserClaim = "sub"
+	if err := checkClaims(claims, "n"); err != nil {
+		t.Errorf("other claim: %v", err)
+	}
+
+	// Providers are only reached over TLS, unless local
+	for endpoint, secure := range map[string]bool{
+		"https://issuer.example":     true,
+		"http://127.0.0.1:8080":      true,
+		"http://localhost:8080/keys": true,
+		"http://[::1]/":              true,
+		"http://issuer.example":      false,
+		"http://10.0.0.1":            false,
+		"issuer.example":             false,
+	} {
+		if secureEndpoint(endpoint) != secure {
+			t.Errorf("%s: secure %v, want %v", endpoint, !secure, secure)
+		}
+	}
+	cloudConfig.OIDC = &oidcConfig{Issuer: "http://issuer.example", ClientId: "ninja"}
+	if checkOIDC() == nil {
+		t.Error("cleartext issuer accepted")
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	newTestCloud(t)
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	cloudConfig.Users = []configUser{{Name: "bob", Password: "bob-password"}}
+	cloudConfig.Auth = []string{"none"}
+
+	testCredentials(t, noAuth{}, nil, []credentials{
+		{},
+		{Token: "owner-token"},
+		{Name: "bob", Password: "bob-password"},
+	})
+	if authEnabled() {
+		t.Error("enabled")
+	}
+	cloudConfig.Auth = []string{"none", "token"}
+	if checkAuth() == nil {
+		t.Error("none accepted along other schemes")
+	}
+	cloudConfig.Auth = []string{"token", "unknown"}
+	if checkAuth() == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	cloudConfig.Users = []configUser{{Name: "bob", Password: "bob-password"}}
+	cloudConfig.ACL = []aclRule{{User: "bob", Prefix: "Z:/Ninja/p", Allow: []string{opRead}}}
+
+	w := serveTest(h, testRequest{"GET", "/directory/Ninja/", nil, ""})
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("anonymous: %d %v", w.Code, w.Header())
+	}
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", "/directory/Ninja/", bearerHeader("owner-token"), ""}, http.StatusOK},
+		{testRequest{"GET", "/directory/Ninja/?token=owner-token", nil, ""}, http.StatusOK},
+		{testRequest{"GET", "/directory/Ninja/", bearerHeader("wrong"), ""}, http.StatusUnauthorized},
+		{testRequest{"GET", "/directory/Ninja/p/", basicHeader("bob", "bob-password"), ""}, http.StatusOK},
+		{testRequest{"GET", "/directory/Ninja/", basicHeader("bob", "bob-password"), ""}, http.StatusForbidden},
+		{testRequest{"POST", "/file/Ninja/p/a.txt", basicHeader("bob", "bob-password"), "a"}, http.StatusForbidden},
+		{testRequest{"GET", "/directory/Ninja/p/", basicHeader("bob", "wrong"), ""}, http.StatusUnauthorized},
+		// Open routes
+		{testRequest{"GET", "/cloudstatus/", nil, ""}, http.StatusOK},
+		{testRequest{"OPTIONS", "/directory/Ninja/", nil, ""}, http.StatusOK},
+	})
+
+	// Logging in trades the credentials for a session
+	w = serveTest(h, testRequest{"POST", "/auth/login", map[string]string{"Content-Type": "application/json"}, `{"name": "bob", "password": "wrong"}`})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: %d", w.Code)
+	}
+	w = serveTest(h, testRequest{"POST", "/auth/login", map[string]string{"Content-Type": "application/json"}, `{"name": "bob", "password": "bob-password"}`})
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 {
+		t.Fatalf("login: %d %v", w.Code, cookies)
+	}
+	r := httptest.NewRequest("GET", "/directory/Ninja/p/", nil)
+	r.AddCookie(cookies[0])
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("session: %d", rec.Code)
+	}
+
+	// Only the listed schemes are accepted
+	cloudConfig.Auth = []string{"token"}
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", "/directory/Ninja/", bearerHeader("owner-token"), ""}, http.StatusOK},
+		{testRequest{"GET", "/directory/Ninja/p/", basicHeader("bob", "bob-password"), ""}, http.StatusUnauthorized},
+	})
+	cloudConfig.Auth = []string{"basic"}
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", "/directory/Ninja/", bearerHeader("owner-token"), ""}, http.StatusUnauthorized},
+		{testRequest{"GET", "/directory/Ninja/p/", basicHeader("bob", "bob-password"), ""}, http.StatusOK},
+	})
+	cloudConfig.Auth = []string{"none"}
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", "/directory/Ninja/", nil, ""}, http.StatusOK},
+		{testRequest{"POST", "/file/Ninja/p/a.txt", nil, "a"}, http.StatusCreated},
+	})
+}
+
+func TestQueryPathAuthorized(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	createDir("secret")
+	saveFile("p/a.txt", []byte("a"))
+	saveFile("secret/s.txt", []byte("secret"))
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	cloudConfig.Users = []configUser{{Name: "bob", Password: "bob-password"}}
+	cloudConfig.ACL = []aclRule{{User: "bob", Prefix: "Z:/Ninja/p", Allow: []string{opRead, opWrite, opDelete}}}
+
+	// The path parameter does not stand for the target of the other APIs
+	bob := basicHeader("bob", "bob-password")
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", "/file/Ninja/secret/s.txt?path=Z:/Ninja/p", bob, ""}, http.StatusForbidden},
+		{testRequest{"DELETE", "/file/Ninja/secret/s.txt?path=Z:/Ninja/p", bob, ""}, http.StatusForbidden},
+		{testRequest{"GET", "/directory/Ninja/secret/?path=Z:/Ninja/p", bob, ""}, http.StatusForbidden},
+		{testRequest{"GET", "/secret/s.txt?path=Z:/Ninja/p", bob, ""}, http.StatusForbidden},
+		{testRequest{"GET", "/file/Ninja/p/a.txt?path=Z:/Ninja/secret", bob, ""}, http.StatusOK},
+		// Whereas the query based APIs act on it
+		{testRequest{"GET", "/tail?path=Z:/Ninja/secret/s.txt", bob, ""}, http.StatusForbidden},
+		// Past the ACL, a directory cannot be followed
+		{testRequest{"GET", "/tail?path=Z:/Ninja/p", bob, ""}, http.StatusBadRequest},
+	})
+	mustExist(t, "secret/s.txt", true)
+}
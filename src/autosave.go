@@ -0,0 +1,106 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//////// AUTOSAVE
+
+// Rolling shadow copies of the files written since the previous tick.
+var autosaves = revisionStore{hiddenPrefix + "autosave", 10}
+
+var autosaveMutex sync.Mutex
+var autosaveDirty = make(map[string]bool)
+
+// Marks a file as written, so that a shadow copy is taken at the next tick.
+func autosaveTouch(p string) {
+	autosaveMutex.Lock()
+	autosaveDirty[p] = true
+	autosaveMutex.Unlock()
+}
+
+func autosaveTick() {
+	autosaveMutex.Lock()
+	dirty := autosaveDirty
+	autosaveDirty = make(map[string]bool)
+	autosaveMutex.Unlock()
+	release, err := acquireIO(backgroundContext)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	defer release()
+	for p := range dirty {
+		if err := ioPause(backgroundContext); err != nil {
+			log.Println(*&err)
+			return
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			// Removed or moved away since
+			continue
+		}
+		_, err = autosaves.save(*&p, *&content)
+		if err != nil {
+			log.Println(*&err)
+		}
+	}
+}
+
+func startAutosave(interval time.Duration) {
+	go func() {
+		for range time.Tick(*&interval) {
+			autosaveTick()
+		}
+	}()
+}
+
+//////// REQUEST HANDLERS
+
+//// Autosave API
+
+func autosaveHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[autosavePathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id := r.URL.Query().Get("shadow")
+
+	switch r.Method {
+	case "GET":
+		// List the shadow copies of a document, or read one of them
+		revisionsGet(w, autosaves, *&p, *&id)
+		return
+	case "POST":
+		// Restore a shadow copy over its document
+		if revisionsRestore(w, autosaves, *&p, *&id) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
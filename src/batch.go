@@ -0,0 +1,93 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+//////// BATCHED REQUESTS
+
+// Opening a project, the editor asks for the details of every file it
+// references. The stat route answers for a whole list of URIs at once,
+// null standing for the files which are missing or out of reach, or only
+// tells which exist with the check-existence-only header.
+
+const batchMaxSize = 1 << 20
+const batchMaxUris = 10000
+
+func readUriList(w http.ResponseWriter, r *http.Request) (uris []string, ok bool) {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, batchMaxSize)).Decode(&uris)
+	if err != nil || len(*&uris) > batchMaxUris {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	return uris, true
+}
+
+// Path of a URI of the list, if the user of the request may read it.
+func batchPath(r *http.Request, uri string) (p string, ok bool) {
+	return bodyPath(*&r, *&uri, opRead)
+}
+
+//////// REQUEST HANDLERS
+
+//// Stat API
+
+// Give the details of a list of files, or whether they exist
+func statHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	uris, ok := readUriList(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("check-existence-only") == "true" {
+		found := make(map[string]bool, len(*&uris))
+		for _, uri := range uris {
+			p, ok := batchPath(*&r, *&uri)
+			found[uri] = ok && exist(*&p)
+		}
+		writeJSON(w, http.StatusOK, *&found)
+		return
+	}
+	infos := make(map[string]map[string]string, len(*&uris))
+	for _, uri := range uris {
+		infos[uri] = nil
+		p, ok := batchPath(*&r, *&uri)
+		if !ok {
+			continue
+		}
+		info, err := fileInfo(*&p)
+		if err != nil && !os.IsNotExist(*&err) {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		infos[uri] = info
+	}
+	writeJSON(w, http.StatusOK, *&infos)
+}
@@ -0,0 +1,296 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// BENCHMARK
+
+// Load test run with the bench subcommand against a running instance, or
+// against the handlers of an in-process one over memory storage, mixing
+// listings, reads and writes in a directory of its own to report their
+// throughput and latencies.
+
+var benchOperations = []string{"list", "read", "write"}
+
+type benchOptions struct {
+	url         string
+	token       string
+	duration    time.Duration
+	concurrency int
+	mix         map[string]int
+	files       int
+	size        int64
+}
+
+type benchResult struct {
+	latencies []time.Duration
+	errors    int
+}
+
+type benchRun struct {
+	options benchOptions
+	client  *http.Client
+	dir     string
+	content []byte
+	mutex   sync.Mutex
+	results map[string]*benchResult
+}
+
+// Parses weights such as list=4,read=4,write=2.
+func parseBenchMix(s string) (mix map[string]int, err error) {
+	mix = make(map[string]int)
+	total := 0
+	for _, part := range strings.Split(*&s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(*&part), "=", 2)
+		if len(kv) != 2 || !sliceContains(benchOperations, kv[0]) {
+			return nil, errors.New("invalid mix entry: " + part)
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, errors.New("invalid weight: " + part)
+		}
+		mix[kv[0]] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("no operation in the mix")
+	}
+	return
+}
+
+func (b *benchRun) request(method string, route string, body []byte) (err error) {
+	req, err := http.NewRequest(*&method, b.options.url+route, bytes.NewReader(*&body))
+	if err != nil {
+		return
+	}
+	if b.options.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.options.token)
+	}
+	resp, err := b.client.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return errors.New(method + " " + route + ": " + resp.Status)
+	}
+	return
+}
+
+func (b *benchRun) file(i int) string {
+	return filePath + b.dir + "/file-" + strconv.Itoa(*&i) + ".txt"
+}
+
+func (b *benchRun) setup() (err error) {
+	err = b.request("POST", dirPath+b.dir, nil)
+	if err != nil {
+		return
+	}
+	for i := 0; i < b.options.files; i++ {
+		err = b.request("POST", b.file(*&i), b.content)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (b *benchRun) operate(op string, random *rand.Rand) error {
+	switch op {
+	case "list":
+		return b.request("GET", dirPath+b.dir, nil)
+	case "read":
+		return b.request("GET", b.file(random.Intn(b.options.files)), nil)
+	}
+	return b.request("PUT", b.file(random.Intn(b.options.files)), b.content)
+}
+
+// Runs operations drawn from the mix until the deadline.
+func (b *benchRun) worker(seed int64, deadline time.Time, wg *sync.WaitGroup) {
+	defer wg.Done()
+	random := rand.New(rand.NewSource(*&seed))
+	var ops []string
+	for _, op := range benchOperations {
+		for i := 0; i < b.options.mix[op]; i++ {
+			ops = append(ops, op)
+		}
+	}
+	for time.Now().Before(*&deadline) {
+		op := ops[random.Intn(len(*&ops))]
+		start := time.Now()
+		err := b.operate(*&op, *&random)
+		elapsed := time.Since(*&start)
+		b.mutex.Lock()
+		r := b.results[op]
+		if err != nil {
+			r.errors++
+		} else {
+			r.latencies = append(r.latencies, elapsed)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(*&sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(*&sorted)-1))]
+}
+
+func (b *benchRun) report(elapsed time.Duration) {
+	fmt.Printf("%-6s %8s %7s %9s %9s %9s %9s %9s\n", "op", "count", "errors", "req/s", "p50", "p90", "p99", "max")
+	total := 0
+	for _, op := range benchOperations {
+		r := b.results[op]
+		if b.options.mix[op] == 0 {
+			continue
+		}
+		l := r.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		total += len(*&l)
+		fmt.Printf("%-6s %8d %7d %9.1f %9s %9s %9s %9s\n", op, len(*&l), r.errors,
+			float64(len(*&l))/elapsed.Seconds(), percentile(*&l, 0.5).Round(time.Microsecond),
+			percentile(*&l, 0.9).Round(time.Microsecond), percentile(*&l, 0.99).Round(time.Microsecond),
+			percentile(*&l, 1).Round(time.Microsecond))
+	}
+	fmt.Printf("%d requests in %s, %.1f req/s\n", total, elapsed.Round(time.Millisecond), float64(*&total)/elapsed.Seconds())
+}
+
+func runBench(o benchOptions) (err error) {
+	b := &benchRun{
+		options: o,
+		client:  &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: o.concurrency}},
+		dir:     "ninja-bench-" + randomString(6),
+		content: bytes.Repeat([]byte("x"), int(o.size)),
+		results: make(map[string]*benchResult),
+	}
+	for _, op := range benchOperations {
+		b.results[op] = &benchResult{}
+	}
+	err = b.setup()
+	defer b.request("DELETE", dirPath+b.dir, nil)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Benchmarking %s for %s with %d workers, %d files of %s\n", o.url, o.duration, o.concurrency, o.files, formatByteSize(o.size))
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(o.duration)
+	for i := 0; i < o.concurrency; i++ {
+		wg.Add(1)
+		go b.worker(start.UnixNano()+int64(*&i), *&deadline, &wg)
+	}
+	wg.Wait()
+	b.report(time.Since(*&start))
+	return
+}
+
+// Serves the handlers over memory storage on a loopback port, returning
+// its URL.
+func startInProcessCloud() (u string, err error) {
+	err = useStorage(newMemStorage())
+	if err != nil {
+		return
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	go http.Serve(*&listener, cloudHandler())
+	return "http://" + listener.Addr().String(), nil
+}
+
+// Entry point of the bench subcommand.
+func benchCommand(args []string) error {
+	var o benchOptions
+	var mix, size string
+	var inProcess bool
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.StringVar(&o.url, "url", "http://localhost:58080", "URL of the instance to benchmark.")
+	flags.StringVar(&o.token, "token", "", "Access token to authenticate with.")
+	flags.BoolVar(&inProcess, "in-process", false, "Benchmark the handlers of an in-process instance over memory storage instead.")
+	flags.DurationVar(&o.duration, "duration", 10*time.Second, "Duration of the run.")
+	flags.IntVar(&o.concurrency, "concurrency", 8, "Concurrent workers.")
+	flags.StringVar(&mix, "mix", "list=2,read=6,write=2", "Weights of the operations.")
+	flags.IntVar(&o.files, "files", 50, "Files read and written.")
+	flags.StringVar(&size, "size", "4K", "Size of the files.")
+	hashes := flags.Bool("hashes", false, "Measure the hash algorithms instead, over the given file or -size of random data, 256M by default.")
+	flags.Parse(*&args)
+
+	var err error
+	if *hashes {
+		if flags.NArg() > 0 {
+			f, err := os.Open(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return benchHashes(*&f, 0)
+		}
+		n := int64(256 << 20)
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "size" {
+				n, err = parseByteSize(*&size)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return benchHashes(nil, *&n)
+	}
+	o.mix, err = parseBenchMix(*&mix)
+	if err != nil {
+		return err
+	}
+	o.size, err = parseByteSize(*&size)
+	if err != nil {
+		return err
+	}
+	if o.concurrency < 1 || o.files < 1 {
+		return errors.New("concurrency and files have to be positive")
+	}
+	if inProcess {
+		o.url, err = startInProcessCloud()
+		if err != nil {
+			return err
+		}
+	}
+	o.url = strings.TrimRight(o.url, "/")
+	return runBench(*&o)
+}
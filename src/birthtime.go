@@ -0,0 +1,64 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+//////// CREATION DATES
+
+// First seen times of the paths whose creation time the OS can't provide.
+const birthBucket = "birth"
+
+func milliseconds(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Returns the creation time of a file, falling back on the time it was
+// first seen by the cloud, or on its modification time for files which
+// existed before.
+func creationTime(p string, info os.FileInfo) time.Time {
+	if t, ok := osBirthTime(*&info); ok {
+		return t
+	}
+	if metadata == nil {
+		return info.ModTime()
+	}
+	key := metadataKey(*&p)
+	if v, ok := metadata.get(birthBucket, *&key); ok {
+		ms, err := strconv.ParseInt(*&v, 10, 64)
+		if err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	t := info.ModTime()
+	metadata.put(birthBucket, *&key, milliseconds(*&t))
+	return t
+}
+
+func recordCreation(p string) {
+	if metadata != nil {
+		metadata.deleteTree(birthBucket, metadataKey(*&p))
+		metadata.put(birthBucket, metadataKey(*&p), milliseconds(time.Now()))
+	}
+}
@@ -0,0 +1,230 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+//////// BLAKE3
+
+// BLAKE3 with its default 32 bytes output, a cryptographic hash following
+// the portable reference implementation: input split into 1 KiB chunks,
+// the chaining values of which are merged into a binary tree as chunks
+// complete. Without vector instructions it is slower than SHA-256 on
+// processors with SHA extensions; bench -hashes tells which wins here.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+// Message words each round takes, the permutation of the reference
+// implementation applied ahead of time.
+var blake3Schedule = [7][16]uint8{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8},
+	{3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1},
+	{10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6},
+	{12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4},
+	{9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7},
+	{11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13},
+}
+
+func blake3G(a, b, c, d, mx, my uint32) (uint32, uint32, uint32, uint32) {
+	a += b + mx
+	d = bits.RotateLeft32(d^a, -16)
+	c += d
+	b = bits.RotateLeft32(b^c, -12)
+	a += b + my
+	d = bits.RotateLeft32(d^a, -8)
+	c += d
+	b = bits.RotateLeft32(b^c, -7)
+	return a, b, c, d
+}
+
+func blake3Compress(cv [8]uint32, m [16]uint32, counter uint64, blockLen uint32, flags uint32) (s [16]uint32) {
+	copy(s[:8], cv[:])
+	copy(s[8:12], blake3IV[:4])
+	s[12], s[13], s[14], s[15] = uint32(*&counter), uint32(counter>>32), blockLen, flags
+	for i := range blake3Schedule {
+		w := &blake3Schedule[i]
+		s[0], s[4], s[8], s[12] = blake3G(s[0], s[4], s[8], s[12], m[w[0]], m[w[1]])
+		s[1], s[5], s[9], s[13] = blake3G(s[1], s[5], s[9], s[13], m[w[2]], m[w[3]])
+		s[2], s[6], s[10], s[14] = blake3G(s[2], s[6], s[10], s[14], m[w[4]], m[w[5]])
+		s[3], s[7], s[11], s[15] = blake3G(s[3], s[7], s[11], s[15], m[w[6]], m[w[7]])
+		s[0], s[5], s[10], s[15] = blake3G(s[0], s[5], s[10], s[15], m[w[8]], m[w[9]])
+		s[1], s[6], s[11], s[12] = blake3G(s[1], s[6], s[11], s[12], m[w[10]], m[w[11]])
+		s[2], s[7], s[8], s[13] = blake3G(s[2], s[7], s[8], s[13], m[w[12]], m[w[13]])
+		s[3], s[4], s[9], s[14] = blake3G(s[3], s[4], s[9], s[14], m[w[14]], m[w[15]])
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return
+}
+
+func blake3Words(block *[blake3BlockLen]byte) (m [16]uint32) {
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+	return
+}
+
+func blake3First8(s [16]uint32) (cv [8]uint32) {
+	copy(cv[:], s[:8])
+	return
+}
+
+// Last compression of a node, left undone until it is known whether the
+// node is the root.
+type blake3Output struct {
+	cv       [8]uint32
+	m        [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	return blake3First8(blake3Compress(o.cv, o.m, o.counter, o.blockLen, o.flags))
+}
+
+func (o blake3Output) root(b []byte) []byte {
+	s := blake3Compress(o.cv, o.m, 0, o.blockLen, o.flags|blake3Root)
+	for _, w := range s[:8] {
+		b = binary.LittleEndian.AppendUint32(*&b, *&w)
+	}
+	return b
+}
+
+func blake3ParentOutput(left [8]uint32, right [8]uint32) blake3Output {
+	var m [16]uint32
+	copy(m[:8], left[:])
+	copy(m[8:], right[:])
+	return blake3Output{blake3IV, m, 0, blake3BlockLen, blake3Parent}
+}
+
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockLen]byte
+	blockLen   int
+	compressed int
+}
+
+func newBlake3Chunk(counter uint64) blake3Chunk {
+	return blake3Chunk{cv: blake3IV, counter: counter}
+}
+
+func (c *blake3Chunk) len() int {
+	return c.compressed*blake3BlockLen + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.compressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) write(p []byte) {
+	for len(p) > 0 {
+		// The last block is only compressed once more input follows
+		if c.blockLen == blake3BlockLen {
+			c.cv = blake3First8(blake3Compress(c.cv, blake3Words(&c.block), c.counter, blake3BlockLen, c.startFlag()))
+			c.compressed++
+			c.block = [blake3BlockLen]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], *&p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{c.cv, blake3Words(&c.block), c.counter, uint32(c.blockLen), c.startFlag() | blake3ChunkEnd}
+}
+
+type blake3Hash struct {
+	chunk blake3Chunk
+	// Chaining values of the complete subtrees, largest first
+	stack [][8]uint32
+}
+
+func newBlake3() hash.Hash {
+	return &blake3Hash{chunk: newBlake3Chunk(0)}
+}
+
+func (h *blake3Hash) Reset() {
+	h.chunk = newBlake3Chunk(0)
+	h.stack = h.stack[:0]
+}
+
+func (h *blake3Hash) Size() int      { return 32 }
+func (h *blake3Hash) BlockSize() int { return blake3BlockLen }
+
+// Merges the chaining value of a complete chunk with those of the subtrees
+// it completes, as many as trailing zeros in the count of chunks.
+func (h *blake3Hash) pushChunk(cv [8]uint32, total uint64) {
+	for total&1 == 0 {
+		cv = blake3ParentOutput(h.stack[len(h.stack)-1], *&cv).chainingValue()
+		h.stack = h.stack[:len(h.stack)-1]
+		total >>= 1
+	}
+	h.stack = append(h.stack, *&cv)
+}
+
+func (h *blake3Hash) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		if h.chunk.len() == blake3ChunkLen {
+			total := h.chunk.counter + 1
+			h.pushChunk(h.chunk.output().chainingValue(), *&total)
+			h.chunk = newBlake3Chunk(*&total)
+		}
+		take := blake3ChunkLen - h.chunk.len()
+		if take > len(p) {
+			take = len(p)
+		}
+		h.chunk.write(p[:take])
+		p = p[take:]
+	}
+	return
+}
+
+func (h *blake3Hash) Sum(b []byte) []byte {
+	o := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3ParentOutput(h.stack[i], o.chainingValue())
+	}
+	return o.root(*&b)
+}
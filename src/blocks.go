@@ -0,0 +1,494 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//////// BLOCK DELTAS
+
+// Transfers only the parts of large files which changed, the way rsync
+// does: the side holding the old version sends the checksums of its
+// blocks, and the other side answers with the blocks to reuse and the
+// bytes in between. Pushing a change is a PATCH with a delta computed
+// against the signature of the file, fetching one is a POST of the
+// signature of the local copy.
+
+const deltaMediaType = "application/x-ninja-delta"
+const deltaMagic = "NDELTA1\n"
+const deltaMinBlockSize = 512
+const deltaMaxBlockSize = 1 << 20
+const deltaMaxLiteral = 64 << 10
+const deltaMaxSignature = 64 << 20
+
+// Delta operations, each followed by its uvarint arguments.
+const (
+	deltaCopy    = 'C' // first block, block count
+	deltaLiteral = 'L' // length, then as many bytes
+	deltaEnd     = 'E' // then the SHA-256 of the result
+)
+
+var errDeltaFormat = errors.New("malformed delta")
+
+type blockSum struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type blockSignature struct {
+	Revision  string     `json:"revision"`
+	Size      int64      `json:"size"`
+	BlockSize int        `json:"blockSize"`
+	Blocks    []blockSum `json:"blocks"`
+}
+
+// Around the square root of the size, which balances the size of the
+// signature against the amount of data resent around each change.
+func defaultBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(*&size))) &^ 7
+	if bs < 2048 {
+		return 2048
+	} else if bs > 128<<10 {
+		return 128 << 10
+	}
+	return bs
+}
+
+//// Checksums
+
+// Adler-32 like checksum which can be rolled over the data byte by byte.
+func weakSum(block []byte) (a uint32, b uint32) {
+	l := uint32(len(*&block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(*&block)
+	return hex.EncodeToString(sum[:16])
+}
+
+func computeSignature(f io.Reader, blockSize int) (sig blockSignature, err error) {
+	sig = blockSignature{BlockSize: blockSize, Blocks: []blockSum{}}
+	h := revisionHash()
+	block := make([]byte, *&blockSize)
+	for {
+		n, rerr := io.ReadFull(*&f, *&block)
+		if n > 0 {
+			h.Write(block[:n])
+			a, b := weakSum(block[:n])
+			sig.Blocks = append(sig.Blocks, blockSum{a | b<<16, strongSum(block[:n])})
+			sig.Size += int64(*&n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return sig, rerr
+		}
+	}
+	sig.Revision = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+//// Encoding
+
+type deltaEncoder struct {
+	w       *bufio.Writer
+	literal []byte
+	first   int
+	count   int
+}
+
+func newDeltaEncoder(w io.Writer, blockSize int) *deltaEncoder {
+	e := &deltaEncoder{w: bufio.NewWriter(*&w)}
+	e.w.WriteString(deltaMagic)
+	e.uvarint(uint64(*&blockSize))
+	return e
+}
+
+func (e *deltaEncoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.w.Write(buf[:binary.PutUvarint(buf[:], *&v)])
+}
+
+func (e *deltaEncoder) flush() {
+	if e.count > 0 {
+		e.w.WriteByte(deltaCopy)
+		e.uvarint(uint64(e.first))
+		e.uvarint(uint64(e.count))
+		e.count = 0
+	}
+	if len(e.literal) > 0 {
+		e.w.WriteByte(deltaLiteral)
+		e.uvarint(uint64(len(e.literal)))
+		e.w.Write(e.literal)
+		e.literal = e.literal[:0]
+	}
+}
+
+// Consecutive blocks are sent as a single copy.
+func (e *deltaEncoder) copy(block int) {
+	if e.count > 0 && e.first+e.count == block {
+		e.count++
+		return
+	}
+	e.flush()
+	e.first, e.count = block, 1
+}
+
+func (e *deltaEncoder) byte(c byte) {
+	if e.count > 0 {
+		e.flush()
+	}
+	e.literal = append(e.literal, *&c)
+	if len(e.literal) == deltaMaxLiteral {
+		e.flush()
+	}
+}
+
+func (e *deltaEncoder) end(sum []byte) error {
+	e.flush()
+	e.w.WriteByte(deltaEnd)
+	e.w.Write(*&sum)
+	return e.w.Flush()
+}
+
+// Writes the delta turning the file described by the signature into the
+// content of src, reusing the blocks found at any offset.
+func computeDelta(src io.Reader, sig blockSignature, w io.Writer) (err error) {
+	bs := sig.BlockSize
+	index := make(map[uint32][]int)
+	for i, s := range sig.Blocks {
+		index[s.Weak] = append(index[s.Weak], *&i)
+	}
+	blockLen := func(i int) int {
+		if i == len(sig.Blocks)-1 && sig.Size%int64(*&bs) != 0 {
+			return int(sig.Size % int64(*&bs))
+		}
+		return bs
+	}
+	h := sha256.New()
+	src = io.TeeReader(*&src, *&h)
+	e := newDeltaEncoder(*&w, *&bs)
+
+	// The window starts at pos, and the buffer is refilled whenever less
+	// than a block remains after it.
+	buf := make([]byte, 0, bs+256<<10)
+	pos := 0
+	eof := false
+	rolling := false
+	var a, b uint32
+	for {
+		if len(*&buf)-pos < bs && !eof {
+			n := copy(buf[:cap(*&buf)], buf[pos:])
+			buf, pos = buf[:n], 0
+			m, rerr := io.ReadFull(*&src, buf[n:cap(*&buf)])
+			buf = buf[:n+m]
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				eof = true
+			} else if rerr != nil {
+				return rerr
+			}
+		}
+		n := len(*&buf) - pos
+		if n == 0 {
+			break
+		}
+		l := bs
+		if n < bs {
+			l = n
+		}
+		window := buf[pos : pos+l]
+		if !rolling {
+			a, b = weakSum(*&window)
+			rolling = true
+		}
+		matched := false
+		if candidates, ok := index[a|b<<16]; ok {
+			strong := strongSum(*&window)
+			for _, i := range candidates {
+				if blockLen(*&i) == l && sig.Blocks[i].Strong == strong {
+					e.copy(*&i)
+					pos += l
+					rolling = false
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			continue
+		}
+		out := uint32(buf[pos])
+		e.byte(buf[pos])
+		pos++
+		if n > bs {
+			a = (a - out + uint32(buf[pos+bs-1])) & 0xffff
+			b = (b - uint32(*&bs)*out + a) & 0xffff
+		} else {
+			// Past the last full block the window shrinks
+			a = (a - out) & 0xffff
+			b = (b - uint32(*&l)*out) & 0xffff
+		}
+	}
+	return e.end(h.Sum(nil))
+}
+
+//// Decoding
+
+// Rebuilds a file from its previous version and a delta, failing with
+// errPatchConflict when the result is not what the delta was made for.
+func applyDelta(base io.ReaderAt, baseSize int64, delta io.Reader, w io.Writer) (sum []byte, err error) {
+	r := bufio.NewReader(*&delta)
+	magic := make([]byte, len(deltaMagic))
+	_, err = io.ReadFull(*&r, *&magic)
+	if err != nil || string(*&magic) != deltaMagic {
+		return nil, errDeltaFormat
+	}
+	bs, err := binary.ReadUvarint(*&r)
+	if err != nil || bs < deltaMinBlockSize || bs > deltaMaxBlockSize {
+		return nil, errDeltaFormat
+	}
+	blocks := (uint64(*&baseSize) + bs - 1) / bs
+	h := sha256.New()
+	out := io.MultiWriter(*&w, *&h)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, errDeltaFormat
+		}
+		switch op {
+		case deltaCopy:
+			first, err1 := binary.ReadUvarint(*&r)
+			count, err2 := binary.ReadUvarint(*&r)
+			if err1 != nil || err2 != nil || count == 0 {
+				return nil, errDeltaFormat
+			}
+			if first >= blocks || count > blocks-first {
+				// Made against a longer version of the file
+				return nil, errPatchConflict
+			}
+			offset := int64(first * bs)
+			length := int64(count * bs)
+			if offset+length > baseSize {
+				length = baseSize - offset
+			}
+			_, err = io.Copy(*&out, io.NewSectionReader(*&base, *&offset, *&length))
+			if err != nil {
+				return nil, err
+			}
+		case deltaLiteral:
+			n, err := binary.ReadUvarint(*&r)
+			if err != nil || n > deltaMaxLiteral {
+				return nil, errDeltaFormat
+			}
+			_, err = io.CopyN(*&out, *&r, int64(*&n))
+			if err != nil {
+				return nil, errDeltaFormat
+			}
+		case deltaEnd:
+			expected := make([]byte, sha256.Size)
+			_, err = io.ReadFull(*&r, *&expected)
+			if err != nil {
+				return nil, errDeltaFormat
+			}
+			sum = h.Sum(nil)
+			if !bytes.Equal(*&sum, *&expected) {
+				return nil, errPatchConflict
+			}
+			return sum, nil
+		default:
+			return nil, errDeltaFormat
+		}
+	}
+}
+
+// Applies a delta to a file, writing the result next to it before
+// replacing it so that a failed transfer leaves the file untouched.
+func patchFileDelta(p string, base string, delta io.Reader) (revision string, err error) {
+	info, err := properties(*&p)
+	if err != nil {
+		return
+	}
+	current, err := fileRevision(*&p, *&info)
+	if err != nil {
+		return
+	}
+	if base != "" && base != current {
+		return current, errPatchConflict
+	}
+	f, err := fsys.open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		content, err := ioutil.ReadAll(*&f)
+		if err != nil {
+			return "", err
+		}
+		ra = bytes.NewReader(*&content)
+	}
+	tmp := filepath.Join(filepath.Dir(*&p), hiddenPrefix+"delta-"+randomString(8))
+	i, err := beginIntent(intentReplace, "", *&p, *&tmp, "")
+	if err != nil {
+		return
+	}
+	defer i.end()
+	t, err := fsys.create(*&tmp, 0777)
+	if err != nil {
+		return
+	}
+	// The delta carries a SHA-256 sum, revisions may use another hash
+	h := revisionHash()
+	_, err = applyDelta(*&ra, info.Size(), *&delta, io.MultiWriter(*&t, *&h))
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.rename(*&tmp, *&p)
+	}
+	if err != nil {
+		fsys.remove(*&tmp)
+		if err == errPatchConflict {
+			revision = current
+		}
+		return
+	}
+	revision = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Block delta API
+
+// Exchange block signatures and deltas of a file
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[blocksPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		// Signature of the file, to compute a delta against
+		bs := defaultBlockSize(info.Size())
+		if s := r.URL.Query().Get("block-size"); s != "" {
+			bs, err = strconv.Atoi(*&s)
+			if err != nil || bs < deltaMinBlockSize || bs > deltaMaxBlockSize {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		f, err := fsys.open(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		sig, err := computeSignature(*&f, *&bs)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("revision", sig.Revision)
+		writeJSON(w, http.StatusOK, *&sig)
+		return
+	case "POST":
+		// Delta from the file described by the posted signature to this one
+		var sig blockSignature
+		err := json.NewDecoder(http.MaxBytesReader(w, *&r.Body, deltaMaxSignature)).Decode(&sig)
+		if err != nil || sig.BlockSize < deltaMinBlockSize || sig.BlockSize > deltaMaxBlockSize ||
+			int64(len(sig.Blocks)) != (sig.Size+int64(sig.BlockSize)-1)/int64(sig.BlockSize) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f, err := fsys.open(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		if revision, err := fileRevision(*&p, *&info); err == nil {
+			w.Header().Set("revision", *&revision)
+		}
+		w.Header().Set("Content-Type", deltaMediaType)
+		w.WriteHeader(http.StatusOK)
+		err = computeDelta(*&f, *&sig, w)
+		if err != nil {
+			// Too late to report it to the client
+			log.Println(*&err)
+		}
+		return
+	case "PATCH":
+		// Rebuild the file from a delta against its current content
+		revision, err := patchFileDelta(*&p, r.Header.Get("base-revision"), *&r.Body)
+		if err == errPatchConflict {
+			w.Header().Set("revision", *&revision)
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err == errDeltaFormat {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if os.IsNotExist(*&err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		autosaveTouch(*&p)
+		w.Header().Set("revision", *&revision)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
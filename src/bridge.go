@@ -0,0 +1,180 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// EVENT BRIDGE
+
+// Publishes the changes of the journal to message brokers, one JSON
+// message per change, for setups embedding the cloud into automation.
+
+const brokerTimeout = 10 * time.Second
+const bridgesBucket = "bridges"
+const bridgeRetryDelay = 5 * time.Second
+const bridgeMaxRetryDelay = time.Minute
+
+type bridgeConfig struct {
+	eventFilter
+	// mqtt://, mqtts://, amqp:// or amqps://, with credentials if needed
+	Url string `json:"url"`
+	// MQTT topic or AMQP routing key
+	Topic string `json:"topic"`
+	// AMQP exchange, the default one if empty
+	Exchange string `json:"exchange"`
+}
+
+type brokerConnection interface {
+	publish(topic string, payload []byte) error
+	close() error
+}
+
+type brokerDialer func(u *url.URL, b *bridgeConfig) (brokerConnection, error)
+
+var brokerDialers = map[string]brokerDialer{
+	"mqtt":  dialMQTT,
+	"mqtts": dialMQTT,
+	"amqp":  dialAMQP,
+	"amqps": dialAMQP,
+}
+
+// Opens the connection to a broker, with TLS for the secure schemes.
+func dialBroker(u *url.URL, port string, tlsPort string) (conn net.Conn, err error) {
+	secure := strings.HasSuffix(u.Scheme, "s")
+	host := u.Host
+	if u.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(u.Hostname(), *&tlsPort)
+		} else {
+			host = net.JoinHostPort(u.Hostname(), *&port)
+		}
+	}
+	dialer := &net.Dialer{Timeout: brokerTimeout}
+	if secure {
+		return tls.DialWithDialer(*&dialer, "tcp", *&host, &tls.Config{ServerName: u.Hostname()})
+	}
+	return dialer.Dial("tcp", *&host)
+}
+
+// Bridge key in the metadata store, keeping credentials out of it.
+func bridgeKey(u *url.URL, b *bridgeConfig) string {
+	return u.Scheme + "://" + u.Host + "/" + b.Exchange + "/" + b.Topic
+}
+
+// Cursor of the last change delivered, or the latest one for new bridges,
+// which do not replay the older ones.
+func bridgeCursor(key string) int64 {
+	if v, ok := metadata.get(bridgesBucket, *&key); ok {
+		if cursor, err := strconv.ParseInt(*&v, 10, 64); err == nil {
+			return cursor
+		}
+	}
+	return journal.latest()
+}
+
+// Delivers the changes of the journal following the last one delivered,
+// reconnecting with an increasing delay whenever the broker goes away. The
+// journal being kept on disk, what happens while the broker is unreachable
+// is delivered once it is back, even across restarts.
+func runBridge(b *bridgeConfig, dial brokerDialer, u *url.URL) {
+	var conn brokerConnection
+	key := bridgeKey(*&u, *&b)
+	cursor := bridgeCursor(*&key)
+	delay := bridgeRetryDelay
+	offline := false
+	for {
+		changes, latest, ok := journal.wait(*&cursor, time.Minute, nil)
+		if !ok {
+			log.Println("Event bridge to", u.Host, "fell behind the change journal, skipping to", *&latest)
+			cursor = latest
+			metadata.put(bridgesBucket, *&key, strconv.FormatInt(*&cursor, 10))
+			continue
+		}
+		for _, c := range changes {
+			if !b.matches(*&c) {
+				cursor = c.Cursor
+				continue
+			}
+			payload, err := json.Marshal(*&c)
+			if err != nil {
+				log.Println(*&err)
+				cursor = c.Cursor
+				continue
+			}
+			for {
+				if conn == nil {
+					conn, err = dial(*&u, *&b)
+				}
+				if err == nil {
+					err = conn.publish(b.Topic, *&payload)
+					if err == nil {
+						break
+					}
+					conn.close()
+					conn = nil
+				}
+				if !offline {
+					log.Println("Event bridge to", u.Host, "failed, queueing changes:", *&err)
+					offline = true
+				}
+				time.Sleep(*&delay)
+				if delay *= 2; delay > bridgeMaxRetryDelay {
+					delay = bridgeMaxRetryDelay
+				}
+			}
+			if offline {
+				log.Println("Event bridge to", u.Host, "back, delivering the changes queued up to", *&latest)
+				offline = false
+			}
+			delay = bridgeRetryDelay
+			cursor = c.Cursor
+		}
+		metadata.put(bridgesBucket, *&key, strconv.FormatInt(*&cursor, 10))
+	}
+}
+
+func startBridges(bridges []bridgeConfig) (err error) {
+	for i := range bridges {
+		b := &bridges[i]
+		u, err := url.Parse(b.Url)
+		if err != nil {
+			return err
+		}
+		dial, ok := brokerDialers[u.Scheme]
+		if !ok {
+			return errors.New("unsupported event bridge: " + u.Scheme)
+		}
+		if b.Topic == "" {
+			return errors.New("event bridge without topic: " + u.Host)
+		}
+		go runBridge(*&b, *&dial, *&u)
+	}
+	return
+}
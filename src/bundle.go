@@ -0,0 +1,277 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//////// CONFIGURATION BUNDLES
+
+// The setup of a cloud gathered in a single file to carry it to another
+// machine: the configuration file with its users, ACLs and scheduled tasks,
+// the API keys, shares and project settings of the metadata store, the
+// tokens of the linked connectors, and the files of the -assets directory such as custom templates.
+// Bundles hold credentials, so they are sealed with a passphrase like
+// encrypted projects.
+
+const bundleFormat = "ninja-config-bundle"
+const bundleVersion = 1
+const bundlePassphraseEnv = envPrefix + "BUNDLE_PASSPHRASE"
+
+// Buckets of the metadata store holding setup rather than state tied to
+// the files of this machine.
+var bundleBuckets = []string{keysBucket, sharesBucket, settingsBucket, bridgesBucket, groupsBucket}
+
+type configBundle struct {
+	Created  string                       `json:"created"`
+	Version  string                       `json:"version"`
+	Config   json.RawMessage              `json:"config,omitempty"`
+	Metadata map[string]map[string]string `json:"metadata"`
+	// Tokens of the linked connectors, by connector and user
+	Connectors map[string]connectorToken `json:"connectors,omitempty"`
+	// Content of the files of the assets directory, by slash separated path
+	Assets map[string][]byte `json:"assets,omitempty"`
+}
+
+type sealedBundle struct {
+	Format  string           `json:"format"`
+	Version int              `json:"version"`
+	Params  encryptionParams `json:"params"`
+	Nonce   string           `json:"nonce"`
+	Sealed  string           `json:"sealed"`
+}
+
+// Passphrase of a bundle, from the environment or typed in.
+func bundlePassphrase(confirm bool) (passphrase string, err error) {
+	if p, ok := os.LookupEnv(bundlePassphraseEnv); ok {
+		return p, nil
+	}
+	in := bufio.NewReader(os.Stdin)
+	ask := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, *&prompt)
+		line, err := in.ReadString('\n')
+		return strings.TrimRight(*&line, "\r\n"), err
+	}
+	passphrase, err = ask("Bundle passphrase: ")
+	if err != nil {
+		return
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := ask("Again: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("the passphrases differ")
+		}
+	}
+	return
+}
+
+func sealBundle(b configBundle, passphrase string) (content []byte, err error) {
+	plain, err := json.Marshal(*&b)
+	if err != nil {
+		return
+	}
+	salt := make([]byte, 16)
+	rand.Read(*&salt)
+	params := encryptionParams{Salt: base64.StdEncoding.EncodeToString(*&salt), Iterations: encryptionIterations}
+	aead, err := deriveKey(*&passphrase, *&params)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(*&nonce)
+	return json.MarshalIndent(sealedBundle{
+		Format:  bundleFormat,
+		Version: bundleVersion,
+		Params:  params,
+		Nonce:   base64.StdEncoding.EncodeToString(*&nonce),
+		Sealed:  base64.StdEncoding.EncodeToString(aead.Seal(nil, *&nonce, *&plain, []byte(bundleFormat))),
+	}, "", "	")
+}
+
+func openBundle(content []byte, passphrase string) (b configBundle, err error) {
+	var s sealedBundle
+	err = json.Unmarshal(*&content, &s)
+	if err != nil || s.Format != bundleFormat {
+		return b, errors.New("not a configuration bundle")
+	}
+	if s.Version > bundleVersion {
+		return b, errors.New("bundle written by a newer version")
+	}
+	aead, err := deriveKey(*&passphrase, s.Params)
+	if err != nil {
+		return
+	}
+	nonce, err := base64.StdEncoding.DecodeString(s.Nonce)
+	if err != nil {
+		return
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s.Sealed)
+	if err != nil {
+		return
+	}
+	if len(*&nonce) != aead.NonceSize() {
+		return b, errors.New("corrupted bundle")
+	}
+	plain, err := aead.Open(nil, *&nonce, *&sealed, []byte(bundleFormat))
+	if err != nil {
+		return b, errors.New("wrong passphrase or corrupted bundle")
+	}
+	err = json.Unmarshal(*&plain, &b)
+	return
+}
+
+// Gathers the setup of the cloud, the metadata store being open.
+func gatherBundle() (b configBundle, err error) {
+	b = configBundle{Created: milliseconds(time.Now()), Version: APP_VERSION, Metadata: make(map[string]map[string]string)}
+	if configFlag != "" {
+		content, err := ioutil.ReadFile(configFlag)
+		if err != nil {
+			return b, err
+		}
+		if !json.Valid(*&content) {
+			return b, errors.New(configFlag + " is not valid JSON")
+		}
+		b.Config = content
+	}
+	for _, bucket := range bundleBuckets {
+		values := make(map[string]string)
+		for _, k := range metadata.keys(*&bucket, ".") {
+			if v, ok := metadata.get(*&bucket, *&k); ok {
+				values[k] = v
+			}
+		}
+		if len(*&values) > 0 {
+			b.Metadata[bucket] = values
+		}
+	}
+	b.Connectors, err = connectorTokens.all()
+	if err != nil {
+		return
+	}
+	if assetsDirFlag != "" {
+		b.Assets = make(map[string][]byte)
+		err = filepath.WalkDir(assetsDirFlag, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(assetsDirFlag, *&p)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadFile(*&p)
+			b.Assets[filepath.ToSlash(*&rel)] = content
+			return err
+		})
+	}
+	return
+}
+
+// Puts the setup of a bundle in place, the metadata store being open.
+// Existing files are only replaced when forced; entries of the metadata
+// store from the bundle replace those of the same keys.
+func applyBundle(b configBundle, force bool) (err error) {
+	if len(b.Config) > 0 {
+		p := configFlag
+		if p == "" {
+			p = "ninjacloud.json"
+		}
+		if _, err := os.Stat(*&p); err == nil && !force {
+			return errors.New(p + " already exists, use -force to overwrite it")
+		}
+		err = ioutil.WriteFile(*&p, b.Config, 0600)
+		if err != nil {
+			return
+		}
+		fmt.Println("Wrote the configuration to", p+", to use with -config", p)
+	}
+	if len(b.Assets) > 0 {
+		if assetsDirFlag == "" {
+			fmt.Println("Skipped", len(b.Assets), "assets, give -assets to import them")
+		} else {
+			for name, content := range b.Assets {
+				p := filepath.Join(assetsDirFlag, filepath.FromSlash(*&name))
+				if !filepath.IsLocal(filepath.FromSlash(*&name)) {
+					return errors.New("invalid asset path in bundle: " + name)
+				}
+				if _, err := os.Stat(*&p); err == nil && !force {
+					return errors.New(p + " already exists, use -force to overwrite it")
+				}
+				err = os.MkdirAll(filepath.Dir(*&p), 0777)
+				if err == nil {
+					err = ioutil.WriteFile(*&p, *&content, 0644)
+				}
+				if err != nil {
+					return
+				}
+			}
+			fmt.Println("Wrote", len(b.Assets), "assets into", assetsDirFlag)
+		}
+	}
+	tokens := make(map[string]*connectorToken)
+	for k := range b.Connectors {
+		t := b.Connectors[k]
+		tokens[k] = &t
+	}
+	// Bundles made before the tokens had their own file carry them in the
+	// metadata
+	for k, v := range b.Metadata[connectorsBucket] {
+		var t connectorToken
+		if json.Unmarshal([]byte(*&v), &t) == nil {
+			tokens[k] = &t
+		}
+	}
+	if len(*&tokens) > 0 {
+		err = connectorTokens.update(*&tokens)
+		if err != nil {
+			return
+		}
+		fmt.Println("Imported", len(*&tokens), "connector tokens")
+	}
+	entries := 0
+	for bucket, values := range b.Metadata {
+		if !sliceContains(bundleBuckets, *&bucket) {
+			continue
+		}
+		for k, v := range values {
+			metadata.put(*&bucket, *&k, *&v)
+			entries++
+		}
+	}
+	fmt.Println("Imported", *&entries, "entries of the metadata store")
+	return metadata.flush()
+}
@@ -0,0 +1,122 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//////// CACHING POLICIES
+
+// Cache-Control headers of the previewed files, so that previews are cached
+// as the production host of the site would have them: hashed assets kept
+// forever and pages checked every time, say. The first policy matching a
+// file applies, and files no policy matches get no header.
+type cachePolicy struct {
+	// Pattern of the files, such as *.html, matched against their name, or
+	// against their path from the root when it holds slashes
+	Match string `json:"match"`
+	// Header the files are served with, such as no-cache or
+	// public, max-age=31536000, immutable
+	CacheControl string `json:"cacheControl"`
+}
+
+func checkCaching() error {
+	for _, c := range cloudConfig.Caching {
+		if c.Match == "" || c.CacheControl == "" {
+			return errors.New("caching policies need a match and a cacheControl header")
+		}
+		if _, err := path.Match(c.Match, ""); err != nil {
+			return errors.New("invalid caching pattern " + c.Match)
+		}
+	}
+	return nil
+}
+
+// Policy of the file at p, pages of directories being their index.
+func cachePolicyOf(p string) (c cachePolicy, ok bool) {
+	if info, err := properties(*&p); err == nil && info.IsDir() {
+		p = filepath.Join(*&p, "index.html")
+	}
+	p = filepath.ToSlash(*&p)
+	for _, c = range cloudConfig.Caching {
+		subject := path.Base(*&p)
+		if strings.Contains(c.Match, "/") {
+			subject = strings.TrimPrefix(*&p, "./")
+		}
+		if matched, _ := path.Match(c.Match, *&subject); matched {
+			return c, true
+		}
+	}
+	return cachePolicy{}, false
+}
+
+// Sets the header of the responses serving the file when they start.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value   string
+	started bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.started && (status < http.StatusMultipleChoices || status == http.StatusNotModified) {
+		w.Header().Set("Cache-Control", w.value)
+	}
+	w.started = true
+	w.ResponseWriter.WriteHeader(*&status)
+}
+
+func (w *cacheControlWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(*&p)
+}
+
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//////// MIDDLEWARES
+
+// Applies the caching policies to the files located from the URL path.
+func cachingMiddleware(next http.Handler, locate func(urlPath string) (string, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cloudConfig.Caching) == 0 || r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := locate(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, ok := cachePolicyOf(*&p)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: c.CacheControl}, r)
+	})
+}
@@ -0,0 +1,187 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//////// TRAFFIC CAPTURE
+
+// Records every request and its response to a JSON lines file of the
+// capture directory, one per run, to study the exchanges of an editor
+// with the cloud offline. Bodies are cut after -capture-body-limit bytes
+// and credentials are left out.
+
+type capturedBody struct {
+	Body      string `json:"body"`
+	Encoding  string `json:"encoding,omitempty"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+type capturedRequest struct {
+	Method  string              `json:"method"`
+	Url     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	capturedBody
+}
+
+type capturedResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	capturedBody
+}
+
+type captureEntry struct {
+	Time     string           `json:"time"`
+	Id       string           `json:"id"`
+	Duration float64          `json:"duration"`
+	Request  capturedRequest  `json:"request"`
+	Response capturedResponse `json:"response"`
+}
+
+var captureFile = struct {
+	sync.Mutex
+	f *os.File
+}{}
+
+func openCapture(dir string) (err error) {
+	err = os.MkdirAll(*&dir, 0777)
+	if err != nil {
+		return
+	}
+	name := "capture-" + time.Now().Format("20060102-150405") + ".jsonl"
+	captureFile.f, err = os.OpenFile(filepath.Join(*&dir, *&name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	return
+}
+
+func writeCapture(entry captureEntry) {
+	line, err := json.Marshal(*&entry)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	captureFile.Lock()
+	defer captureFile.Unlock()
+	_, err = captureFile.f.Write(append(*&line, '\n'))
+	if err != nil {
+		log.Println(*&err)
+	}
+}
+
+// Text bodies are kept as they are but for secrets, others encoded in base64.
+func captureBody(content []byte, size int64) capturedBody {
+	b := capturedBody{Size: size, Truncated: size > int64(len(*&content))}
+	if utf8.Valid(*&content) {
+		b.Body = redactText(string(*&content))
+	} else {
+		b.Body = base64.StdEncoding.EncodeToString(*&content)
+		b.Encoding = "base64"
+	}
+	return b
+}
+
+// Keeps the beginning of what goes through it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+	size  int64
+}
+
+func (b *limitedBuffer) keep(p []byte) {
+	b.size += int64(len(*&p))
+	if room := b.limit - b.Len(); room > 0 {
+		if len(*&p) > room {
+			p = p[:room]
+		}
+		b.Write(*&p)
+	}
+}
+
+type captureReader struct {
+	io.ReadCloser
+	buffer *limitedBuffer
+}
+
+func (r captureReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(*&p)
+	r.buffer.keep(p[:n])
+	return
+}
+
+type captureWriter struct {
+	*statusRecorder
+	buffer *limitedBuffer
+}
+
+func (w captureWriter) Write(p []byte) (n int, err error) {
+	n, err = w.statusRecorder.Write(*&p)
+	w.buffer.keep(p[:n])
+	return
+}
+
+//////// MIDDLEWARES
+
+func captureMiddleware(next http.Handler) http.Handler {
+	if captureDirFlag == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WebSocket streams are no request and response pair
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requestBody := &limitedBuffer{limit: captureBodyLimitFlag}
+		if r.Body != nil {
+			r.Body = captureReader{r.Body, requestBody}
+		}
+		recorder := captureWriter{&statusRecorder{ResponseWriter: w}, &limitedBuffer{limit: captureBodyLimitFlag}}
+		start := time.Now()
+		next.ServeHTTP(*&recorder, r)
+		writeCapture(captureEntry{
+			Time:     start.UTC().Format(time.RFC3339Nano),
+			Id:       requestId(*&r),
+			Duration: time.Since(*&start).Seconds(),
+			Request: capturedRequest{
+				Method:       r.Method,
+				Url:          redactText(r.URL.RequestURI()),
+				Headers:      redactHeaders(r.Header),
+				capturedBody: captureBody(requestBody.Bytes(), requestBody.size),
+			},
+			Response: capturedResponse{
+				Status:       recorder.code(),
+				Headers:      redactHeaders(recorder.Header()),
+				capturedBody: captureBody(recorder.buffer.Bytes(), recorder.buffer.size),
+			},
+		})
+	})
+}
@@ -0,0 +1,158 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////// CASE CONFLICTS
+
+// Names differing only by case collide on case-insensitive filesystems,
+// and published projects referring to either of them then break once
+// served from a case-sensitive one.
+
+// Returns an existing sibling whose name only differs from p by case.
+// The source of a move or copy is ignored, so that renaming a file to
+// change its case stays possible.
+func caseConflict(p string, source string) (conflict string, found bool) {
+	dir, name := filepath.Split(filepath.Clean(*&p))
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := fsys.readDir(*&dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.Name() != name && strings.EqualFold(e.Name(), *&name) {
+			conflict = filepath.Join(*&dir, e.Name())
+			if s, ok := uriToPath(*&source); ok && source != "" && s == conflict {
+				continue
+			}
+			return conflict, true
+		}
+	}
+	return
+}
+
+// Lists the groups of paths only differing by case found under root.
+func findCaseConflicts(ctx context.Context, root string) (groups [][]string, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		entries, err := fsys.readDir(*&p)
+		if err != nil {
+			return err
+		}
+		names := make(map[string][]string)
+		for _, e := range entries {
+			key := strings.ToLower(e.Name())
+			names[key] = append(names[key], pathToUri(filepath.Join(*&p, e.Name())))
+		}
+		for _, n := range names {
+			if len(*&n) > 1 {
+				groups = append(*&groups, *&n)
+			}
+		}
+		return nil
+	})
+	sort.Slice(*&groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return
+}
+
+//// Case-only renames
+
+// Renaming logo.png to Logo.png is a move onto itself for case-insensitive
+// filesystems, the destination being found existing, and depending on the
+// system the rename then fails or does nothing.
+
+// Whether moving source to dest only changes the case of its name, dest
+// being either free or the source itself.
+func caseOnlyRename(source string, dest string) bool {
+	source, dest = filepath.Clean(*&source), filepath.Clean(*&dest)
+	if source == dest || !strings.EqualFold(*&source, *&dest) {
+		return false
+	}
+	si, err := fsys.stat(*&source)
+	if err != nil {
+		return false
+	}
+	di, err := fsys.stat(*&dest)
+	return os.IsNotExist(*&err) || err == nil && os.SameFile(*&si, *&di)
+}
+
+// Whether copying source to dest, differing only by case, would truncate
+// the source to write it onto itself.
+func caseOnlyCopy(source string, dest string) bool {
+	source, dest = filepath.Clean(*&source), filepath.Clean(*&dest)
+	if source == dest || !strings.EqualFold(*&source, *&dest) {
+		return false
+	}
+	si, err := fsys.stat(*&source)
+	if err != nil {
+		return false
+	}
+	di, err := fsys.stat(*&dest)
+	return err == nil && os.SameFile(*&si, *&di)
+}
+
+// Changes the case of a name through a temporary one, which works alike
+// whatever the filesystem.
+func renameCase(source string, dest string) (err error) {
+	tmp := filepath.Join(filepath.Dir(*&source), hiddenPrefix+"rename-"+randomString(8))
+	i, err := beginIntent(intentRenameCase, *&source, *&dest, *&tmp, "")
+	if err != nil {
+		return
+	}
+	defer i.end()
+	err = fsys.rename(*&source, *&tmp)
+	if err != nil {
+		return
+	}
+	err = fsys.rename(*&tmp, *&dest)
+	if err != nil {
+		// Not leaving the file under the temporary name
+		if rerr := fsys.rename(*&tmp, *&source); rerr != nil {
+			logWarn("Could not rename", *&tmp, "back to", *&source+":", rerr)
+		}
+	}
+	return
+}
+
+func writeCaseConflict(w http.ResponseWriter, r *http.Request, conflict string) {
+	writeJSON(w, http.StatusConflict, map[string]string{
+		"error":    "case-conflict",
+		"message":  errorMessage(*&r, "case-conflict"),
+		"conflict": pathToUri(*&conflict),
+	})
+}
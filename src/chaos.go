@@ -0,0 +1,89 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//////// CHAOS
+
+// Development flags making the cloud unreliable on purpose, so that editor
+// developers can see how their client copes with slow answers, server
+// errors and responses cut off by a dropped connection.
+
+func chaosEnabled() bool {
+	return chaosLatencyFlag > 0 || chaosErrorRateFlag > 0 || chaosPartialRateFlag > 0
+}
+
+// Stops answering halfway through the announced body.
+type partialWriter struct {
+	http.ResponseWriter
+	written int
+	limit   int
+}
+
+func (w *partialWriter) Write(p []byte) (n int, err error) {
+	if w.limit < 0 {
+		// Somewhere in the announced body, or else in its first chunk
+		size := len(*&p)
+		if l, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+			size = l
+		}
+		w.limit = rand.Intn(*&size + 1)
+	}
+	if w.written+len(*&p) >= w.limit {
+		w.ResponseWriter.Write(p[:w.limit-w.written])
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	n, err = w.ResponseWriter.Write(*&p)
+	w.written += n
+	return
+}
+
+//////// MIDDLEWARES
+
+func chaosMiddleware(next http.Handler) http.Handler {
+	if !chaosEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaosLatencyFlag > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(chaosLatencyFlag))))
+		}
+		if rand.Float64() < chaosErrorRateFlag {
+			logDebug("http", "["+requestId(*&r)+"]", "chaos: failing", r.Method, r.URL.RequestURI())
+			codes := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+			w.WriteHeader(codes[rand.Intn(len(*&codes))])
+			return
+		}
+		if r.Header.Get("Upgrade") == "" && rand.Float64() < chaosPartialRateFlag {
+			logDebug("http", "["+requestId(*&r)+"]", "chaos: cutting off", r.Method, r.URL.RequestURI())
+			w = &partialWriter{ResponseWriter: w, limit: -1}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
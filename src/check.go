@@ -0,0 +1,181 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////// PROJECT CHECK
+
+// Walks a project looking for the problems which tend to only show up once
+// it is published or opened on another system.
+
+// Limits of the most restrictive common filesystems, Windows without long
+// path support for the full path.
+const maxNameLength = 255
+const maxPathLength = 259
+
+type checkIssue struct {
+	Kind    string   `json:"kind"`
+	Uri     string   `json:"uri"`
+	Detail  string   `json:"detail,omitempty"`
+	Related []string `json:"related,omitempty"`
+}
+
+type checkReport struct {
+	Project string       `json:"project"`
+	Issues  []checkIssue `json:"issues"`
+}
+
+// Extracts the local references of an HTML document or a stylesheet.
+func assetReferences(ext string, content []byte) (refs []string) {
+	for _, m := range cssUrlRegexp.FindAllSubmatch(*&content, -1) {
+		refs = append(*&refs, string(m[1]))
+	}
+	if ext != ".html" && ext != ".htm" {
+		return
+	}
+	for _, tag := range htmlTagRegexp.FindAllSubmatch(*&content, -1) {
+		for _, a := range htmlAttrRegexp.FindAllSubmatch(tag[3], -1) {
+			name := strings.ToLower(string(a[1]))
+			if name != "src" && name != "href" && name != "poster" {
+				continue
+			}
+			refs = append(*&refs, strings.Trim(string(a[2]), `"'`))
+		}
+	}
+	return
+}
+
+// Resolves a reference against the directory of the document holding it,
+// ignoring external, absolute and in-document ones.
+func resolveReference(dir string, ref string) (p string, ok bool) {
+	ref = strings.TrimSpace(*&ref)
+	if ref == "" || strings.HasPrefix(*&ref, "#") || strings.HasPrefix(*&ref, "/") || strings.Contains(*&ref, "{{") {
+		return "", false
+	}
+	u, err := url.Parse(*&ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	return filepath.Join(*&dir, filepath.FromSlash(u.Path)), true
+}
+
+func checkProject(ctx context.Context, project string) (report checkReport, err error) {
+	report.Project = pathToUri(*&project)
+	report.Issues = []checkIssue{}
+	issue := func(kind string, p string, detail string) {
+		report.Issues = append(report.Issues, checkIssue{Kind: kind, Uri: pathToUri(*&p), Detail: detail})
+	}
+	err = walk(*&project, func(p string, info os.FileInfo, err error) error {
+		if err := ioPause(*&ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			issue("unreadable", *&p, err.Error())
+			return nil
+		}
+		if p != project && strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(info.Name()) > maxNameLength {
+			issue("name-too-long", *&p, "")
+		}
+		if problems := nameProblems(info.Name()); len(*&problems) > 0 && p != project {
+			issue("unportable-name", *&p, strings.Join(*&problems, ", "))
+		}
+		if abs, err := filepath.Abs(*&p); err == nil && len(*&abs) > maxPathLength {
+			issue("path-too-long", *&p, "")
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, err := fsys.stat(*&p); err != nil {
+				issue("broken-symlink", *&p, "")
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			issue("unreadable", *&p, err.Error())
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(*&p))
+		if ext != ".html" && ext != ".htm" && ext != ".css" {
+			return nil
+		}
+		for _, ref := range assetReferences(*&ext, *&content) {
+			target, ok := resolveReference(filepath.Dir(*&p), *&ref)
+			if ok && !exist(*&target) {
+				issue("missing-reference", *&p, *&ref)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	conflicts, err := findCaseConflicts(*&ctx, *&project)
+	for _, c := range conflicts {
+		report.Issues = append(report.Issues, checkIssue{Kind: "case-conflict", Uri: c[0], Related: c[1:]})
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Check API
+
+// Report the integrity problems of a project
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[checkPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	report, err := checkProject(r.Context(), *&p)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&report)
+}
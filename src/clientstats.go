@@ -0,0 +1,153 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//////// CLIENT STATISTICS
+
+// Requests, errors and bytes sent either way by each user and address,
+// telling which script or sync client is hammering a shared cloud. They
+// are kept in memory since the start, for the most recently seen clients.
+
+const clientStatsContextKey = contextKey("client-stats")
+const maxClientStats = 1000
+
+type clientStats struct {
+	User     string `json:"user,omitempty"`
+	IP       string `json:"ip"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	last     time.Time
+}
+
+var clients = struct {
+	sync.Mutex
+	stats map[string]*clientStats
+}{stats: make(map[string]*clientStats)}
+
+// Client of a request in progress, whose user is only known once it is
+// authenticated.
+type clientCall struct {
+	user string
+}
+
+// Counts a request once answered.
+func recordClient(user string, ip string, status int, in int64, out int64) {
+	clients.Lock()
+	defer clients.Unlock()
+	key := user + "@" + ip
+	c, ok := clients.stats[key]
+	now := time.Now()
+	if !ok {
+		if len(clients.stats) >= maxClientStats {
+			evictClientStats()
+		}
+		c = &clientStats{User: user, IP: ip, First: milliseconds(*&now)}
+		clients.stats[key] = c
+	}
+	c.Requests++
+	if status >= 400 {
+		c.Errors++
+	}
+	c.BytesIn += in
+	c.BytesOut += out
+	c.Last, c.last = milliseconds(*&now), now
+}
+
+// Forgets the client seen the longest ago.
+func evictClientStats() {
+	var oldest string
+	for key, c := range clients.stats {
+		if oldest == "" || c.last.Before(clients.stats[oldest].last) {
+			oldest = key
+		}
+	}
+	delete(clients.stats, *&oldest)
+}
+
+// Statistics of the clients, the busiest ones first by the given order:
+// requests, errors, bytes or recent.
+func clientStatistics(order string) (list []clientStats) {
+	clients.Lock()
+	list = make([]clientStats, 0, len(clients.stats))
+	for _, c := range clients.stats {
+		list = append(*&list, *c)
+	}
+	clients.Unlock()
+	sort.Slice(*&list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch order {
+		case "errors":
+			return a.Errors > b.Errors
+		case "bytes":
+			return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+		case "recent":
+			return a.last.After(b.last)
+		}
+		return a.Requests > b.Requests
+	})
+	return
+}
+
+func validClientOrder(order string) bool {
+	return sliceContains([]string{"", "requests", "errors", "bytes", "recent"}, *&order)
+}
+
+// Body counting what is read of it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(*&p)
+	b.n += int64(n)
+	return
+}
+
+//////// MIDDLEWARES
+
+func clientStatsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := &clientCall{}
+		r = r.WithContext(context.WithValue(r.Context(), clientStatsContextKey, *&call))
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			recordClient(call.user, clientIP(*&r), recorder.code(), body.n, int64(recorder.size))
+		}()
+		next.ServeHTTP(*&recorder, r)
+	})
+}
@@ -0,0 +1,219 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//////// CLIPBOARD
+
+// Bridge to the clipboard of the host, for editors to paste images copied
+// from other applications into projects. Disabled unless asked for, and
+// restricted to users with full rights since it reads whatever was copied.
+
+const clipboardMaxSize = 32 << 20
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var errClipboardUnavailable = errors.New("no clipboard tool available")
+var errClipboardEmpty = errors.New("clipboard holds no such content")
+
+// Runs a clipboard tool, feeding it the given input.
+func runClipboardTool(input []byte, name string, args ...string) (out []byte, err error) {
+	p, err := exec.LookPath(*&name)
+	if err != nil {
+		return nil, errClipboardUnavailable
+	}
+	cmd := exec.Command(*&p, args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(*&input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		err = errors.New(name + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// Image of the clipboard written to a temporary file by a tool, for tools
+// which can't write it to their output.
+func readImageThroughFile(run func(p string) error) (png []byte, err error) {
+	f, err := ioutil.TempFile("", "ninja-clipboard-*.png")
+	if err != nil {
+		return
+	}
+	p := f.Name()
+	f.Close()
+	defer os.Remove(*&p)
+	err = run(*&p)
+	if err != nil {
+		return
+	}
+	png, err = ioutil.ReadFile(*&p)
+	if err == nil && !bytes.HasPrefix(*&png, pngSignature) {
+		err = errClipboardEmpty
+	}
+	return
+}
+
+func writeImageThroughFile(png []byte, run func(p string) error) (err error) {
+	f, err := ioutil.TempFile("", "ninja-clipboard-*.png")
+	if err != nil {
+		return
+	}
+	p := f.Name()
+	defer os.Remove(*&p)
+	err = writeAndClose(*&f, *&png)
+	if err != nil {
+		return
+	}
+	return run(*&p)
+}
+
+func writeClipboardError(w http.ResponseWriter, err error) {
+	switch err {
+	case errClipboardUnavailable:
+		w.WriteHeader(http.StatusNotImplemented)
+	case errClipboardEmpty:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Clipboard API
+
+// Read or replace the clipboard of the host, or paste it into a new file
+func clipboardHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if !clipboardFlag {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !isModerator(*&r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[clipboardPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	image := r.URL.Query().Get("type") == "image"
+
+	if p != "." {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// Paste into a new file, an image as PNG
+		if image && filepath.Ext(*&p) == "" {
+			p += ".png"
+		}
+		if exist(*&p) && r.Header.Get("overwrite-destination") != "true" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		var content []byte
+		var err error
+		if image {
+			content, err = readClipboardImage()
+		} else {
+			var text string
+			text, err = readClipboardText()
+			content = []byte(*&text)
+		}
+		if err != nil {
+			writeClipboardError(w, *&err)
+			return
+		}
+		err = saveFile(*&p, *&content)
+		if os.IsNotExist(*&err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordCreation(*&p)
+		writeJSON(w, http.StatusCreated, map[string]string{"uri": pathToUri(*&p)})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if image {
+			png, err := readClipboardImage()
+			if err != nil {
+				writeClipboardError(w, *&err)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(*&png)
+			return
+		}
+		text, err := readClipboardText()
+		if err != nil {
+			writeClipboardError(w, *&err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(*&text))
+		return
+	case "PUT":
+		// Copy text, or a PNG image, to the clipboard
+		content, err := ioutil.ReadAll(http.MaxBytesReader(w, *&r.Body, clipboardMaxSize))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "image/") {
+			if !bytes.HasPrefix(*&content, pngSignature) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			err = writeClipboardImage(*&content)
+		} else {
+			err = writeClipboardText(string(*&content))
+		}
+		if err != nil {
+			writeClipboardError(w, *&err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,61 @@
+//go:build darwin
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// Text through pbcopy and pbpaste, images through AppleScript, which has
+// them as PNG data.
+func readClipboardText() (string, error) {
+	out, err := runClipboardTool(nil, "pbpaste")
+	return string(*&out), err
+}
+
+func writeClipboardText(text string) (err error) {
+	_, err = runClipboardTool([]byte(*&text), "pbcopy")
+	return
+}
+
+func appleScriptString(s string) string {
+	return `"` + strings.Replace(strings.Replace(*&s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func readClipboardImage() ([]byte, error) {
+	return readImageThroughFile(func(p string) error {
+		_, err := runClipboardTool(nil, "osascript",
+			"-e", "set f to open for access POSIX file "+appleScriptString(*&p)+" with write permission",
+			"-e", "try",
+			"-e", "write (the clipboard as «class PNGf») to f",
+			"-e", "end try",
+			"-e", "close access f")
+		return err
+	})
+}
+
+func writeClipboardImage(png []byte) error {
+	return writeImageThroughFile(*&png, func(p string) error {
+		_, err := runClipboardTool(nil, "osascript", "-e", "set the clipboard to (read (POSIX file "+appleScriptString(*&p)+") as «class PNGf»)")
+		return err
+	})
+}
@@ -0,0 +1,73 @@
+//go:build !darwin && !windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+)
+
+// Wayland and X11 have no clipboard of their own, but tools talking to
+// the compositor or the X server: wl-clipboard or xclip.
+func waylandClipboard() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func readClipboardText() (string, error) {
+	var out []byte
+	var err error
+	if waylandClipboard() {
+		out, err = runClipboardTool(nil, "wl-paste", "--no-newline")
+	} else {
+		out, err = runClipboardTool(nil, "xclip", "-selection", "clipboard", "-o")
+	}
+	return string(*&out), err
+}
+
+func writeClipboardText(text string) (err error) {
+	if waylandClipboard() {
+		_, err = runClipboardTool([]byte(*&text), "wl-copy")
+	} else {
+		_, err = runClipboardTool([]byte(*&text), "xclip", "-selection", "clipboard", "-i")
+	}
+	return
+}
+
+func readClipboardImage() (png []byte, err error) {
+	if waylandClipboard() {
+		png, err = runClipboardTool(nil, "wl-paste", "--type", "image/png")
+	} else {
+		png, err = runClipboardTool(nil, "xclip", "-selection", "clipboard", "-t", "image/png", "-o")
+	}
+	if err != nil && err != errClipboardUnavailable || err == nil && len(*&png) == 0 {
+		err = errClipboardEmpty
+	}
+	return
+}
+
+func writeClipboardImage(png []byte) (err error) {
+	if waylandClipboard() {
+		_, err = runClipboardTool(*&png, "wl-copy", "--type", "image/png")
+	} else {
+		_, err = runClipboardTool(*&png, "xclip", "-selection", "clipboard", "-t", "image/png", "-i")
+	}
+	return
+}
@@ -0,0 +1,60 @@
+//go:build windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// Through PowerShell and Windows Forms, whose clipboard needs a single
+// threaded apartment.
+func powerShell(input []byte, script string) ([]byte, error) {
+	return runClipboardTool(*&input, "powershell", "-NoProfile", "-NonInteractive", "-STA", "-Command", *&script)
+}
+
+func powerShellString(s string) string {
+	return "'" + strings.Replace(*&s, "'", "''", -1) + "'"
+}
+
+func readClipboardText() (string, error) {
+	out, err := powerShell(nil, "[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw")
+	return strings.TrimSuffix(string(*&out), "\r\n"), err
+}
+
+func writeClipboardText(text string) (err error) {
+	_, err = powerShell([]byte(*&text), "[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())")
+	return
+}
+
+func readClipboardImage() ([]byte, error) {
+	return readImageThroughFile(func(p string) error {
+		_, err := powerShell(nil, "Add-Type -AssemblyName System.Windows.Forms; $i = [Windows.Forms.Clipboard]::GetImage(); if ($i) { $i.Save("+powerShellString(*&p)+", [Drawing.Imaging.ImageFormat]::Png) }")
+		return err
+	})
+}
+
+func writeClipboardImage(png []byte) error {
+	return writeImageThroughFile(*&png, func(p string) error {
+		_, err := powerShell(nil, "Add-Type -AssemblyName System.Windows.Forms; $i = [Drawing.Image]::FromFile("+powerShellString(*&p)+"); [Windows.Forms.Clipboard]::SetImage($i); $i.Dispose()")
+		return err
+	})
+}
@@ -0,0 +1,418 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////// COMMANDS
+
+// The first argument names the command to run, serve being implied when
+// there is none so that bare flags keep starting the cloud.
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "Start the cloud.", serveCommand},
+		{"version", "", "Print the version number.", versionCommand},
+		{"config", "init|export|import [flags] [file]", "Write a sample configuration file to start from, or carry the setup of a cloud to another machine.", configCommand},
+		{"diagnose", "[flags]", "Check the configuration and environment, taking the flags of serve.", diagnoseCommand},
+		{"publish", "[flags] <project>", "Publish a project into its dist directory.", publishCommand},
+		{"backup", "[flags]", "Archive the projects into the backups directory.", backupCommand},
+		{"sync", "[flags] <directory>", "Bring a copy of the projects in another directory up to date, once, as -mirror keeps doing.", syncCommand},
+		{"fix-permissions", "[flags] <path>", "Give the files and directories under a path the configured modes.", fixPermissionsCommand},
+		{"bench", "[flags]", "Load test a running instance.", benchCommand},
+		{"conformance", "[flags]", "Check that a running instance speaks the cloud protocol.", conformanceCommand},
+		{"help", "[command]", "Describe the commands, or the flags of one.", helpCommand},
+	}
+}
+
+func findCommand(name string) (c command, ok bool) {
+	for _, c = range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Usage: ninjacloud [command] [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run ninjacloud help <command> for the flags of a command.")
+}
+
+// Flag set of a command, printing its usage and sharing the given flags of
+// serve, whose values are bound to the same variables.
+func commandFlags(name string, shared ...string) *flag.FlagSet {
+	c, _ := findCommand(*&name)
+	flags := flag.NewFlagSet(*&name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ninjacloud", name, c.usage)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, c.description)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flags.PrintDefaults()
+	}
+	for _, s := range shared {
+		f := flag.Lookup(*&s)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+	return flags
+}
+
+func runCommand(args []string) {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	c, ok := findCommand(*&name)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command:", name)
+		printCommands()
+		os.Exit(2)
+	}
+	err := c.run(*&args)
+	if err != nil {
+		log.Println(*&err)
+		os.Exit(1)
+	}
+}
+
+//// Commands
+
+func helpCommand(args []string) error {
+	if len(args) == 0 {
+		printCommands()
+		return nil
+	}
+	if args[0] == "serve" || args[0] == "diagnose" {
+		flag.Usage()
+		return nil
+	}
+	c, ok := findCommand(args[0])
+	if !ok || c.name == "help" {
+		return errors.New("unknown command: " + args[0])
+	}
+	return c.run([]string{"-h"})
+}
+
+func versionCommand(args []string) error {
+	commandFlags("version").Parse(*&args)
+	fmt.Println(APP_NAME, APP_VERSION)
+	return nil
+}
+
+func diagnoseCommand(args []string) error {
+	err := flag.CommandLine.Parse(*&args)
+	if err != nil {
+		return err
+	}
+	err = applyProfile()
+	if err != nil {
+		return err
+	}
+	if !diagnose() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Sample configuration, listing the main sections with placeholder values.
+const sampleConfig = `{
+	"users": [
+		{"name": "owner", "token": "%s"},
+		{"name": "designer", "password": "change-me", "groups": ["designers"]}
+	],
+	"acl": [
+		{"group": "designers", "prefix": "/", "allow": ["read", "write"]}
+	],
+	"schedule": [
+		{"name": "nightly", "task": "backup", "cron": "0 3 * * *", "keep": 7}
+	],
+	"retention": {
+		"autosave": {"maxAge": "720h", "maxVersions": 50}
+	},
+	"profiles": {
+		"demo": {"flags": {"root": "demo", "port": "8081"}}
+	}
+}
+`
+
+func configCommand(args []string) error {
+	if len(args) == 0 || !sliceContains([]string{"init", "export", "import"}, args[0]) {
+		commandFlags("config").Usage()
+		os.Exit(2)
+	}
+	if args[0] == "export" {
+		return configExportCommand(args[1:])
+	} else if args[0] == "import" {
+		return configImportCommand(args[1:])
+	}
+	flags := commandFlags("config")
+	force := flags.Bool("force", false, "Overwrite an existing file.")
+	flags.Parse(args[1:])
+	p := "ninjacloud.json"
+	if flags.NArg() > 0 {
+		p = flags.Arg(0)
+	}
+	if _, err := os.Stat(*&p); err == nil && !*force {
+		return errors.New(p + " already exists, use -force to overwrite it")
+	}
+	err := ioutil.WriteFile(*&p, []byte(fmt.Sprintf(sampleConfig, randomString(32))), 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Wrote", p+", to use with -config", p)
+	return nil
+}
+
+// Seals the configuration file, metadata and assets into a bundle.
+func configExportCommand(args []string) error {
+	flags := commandFlags("config", "r", "backend", "overlay", "config", "assets")
+	force := flags.Bool("force", false, "Overwrite an existing bundle.")
+	flags.Parse(*&args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	p := flags.Arg(0)
+	if _, err := os.Stat(*&p); err == nil && !*force {
+		return errors.New(p + " already exists, use -force to overwrite it")
+	}
+	// Before moving into the projects directory
+	p, err := filepath.Abs(*&p)
+	if err != nil {
+		return err
+	}
+	if configFlag != "" {
+		configFlag, err = filepath.Abs(configFlag)
+		if err != nil {
+			return err
+		}
+	}
+	if assetsDirFlag != "" {
+		assetsDirFlag, err = filepath.Abs(assetsDirFlag)
+		if err != nil {
+			return err
+		}
+	}
+	passphrase, err := bundlePassphrase(true)
+	if err != nil {
+		return err
+	}
+	err = openOffline()
+	if err != nil {
+		return err
+	}
+	b, err := gatherBundle()
+	if err != nil {
+		return err
+	}
+	content, err := sealBundle(*&b, *&passphrase)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*&p, *&content, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Exported the setup into", p)
+	return nil
+}
+
+// Puts the content of a bundle in place.
+func configImportCommand(args []string) error {
+	flags := commandFlags("config", "r", "backend", "overlay", "config", "assets")
+	force := flags.Bool("force", false, "Overwrite the existing configuration file and assets.")
+	flags.Parse(*&args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	passphrase, err := bundlePassphrase(false)
+	if err != nil {
+		return err
+	}
+	b, err := openBundle(*&content, *&passphrase)
+	if err != nil {
+		return err
+	}
+	if configFlag != "" {
+		configFlag, err = filepath.Abs(configFlag)
+	} else {
+		configFlag, err = filepath.Abs("ninjacloud.json")
+	}
+	if err != nil {
+		return err
+	}
+	if assetsDirFlag != "" {
+		assetsDirFlag, err = filepath.Abs(assetsDirFlag)
+		if err != nil {
+			return err
+		}
+	}
+	err = openOffline()
+	if err != nil {
+		return err
+	}
+	return applyBundle(*&b, *force)
+}
+
+// Opens the projects and the metadata store for commands working on them
+// directly, which should not run alongside a cloud serving the same root.
+func openOffline() (err error) {
+	_, err = openProjects()
+	if err != nil {
+		return
+	}
+	metadata, err = openStore(metadataFile)
+	return
+}
+
+func publishCommand(args []string) error {
+	flags := commandFlags("publish", "r", "backend", "overlay")
+	steps := flags.String("steps", "", "Comma-separated publish steps to run, all by default.")
+	lossy := flags.Bool("lossy", false, "Allow lossy image optimizations.")
+	quality := flags.Int("quality", defaultJpegQuality, "Quality of re-encoded JPEG images.")
+	flags.Parse(*&args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	err := openOffline()
+	if err != nil {
+		return err
+	}
+	p, ok := uriToPath(flags.Arg(0))
+	if !ok || p == "." {
+		return errors.New("invalid project: " + flags.Arg(0))
+	}
+	if !exist(*&p) {
+		return errors.New("no such project: " + flags.Arg(0))
+	}
+	var s []string
+	if *steps != "" {
+		s = strings.Split(*steps, ",")
+	}
+	opts := publishOptions{optimizeOptions{*lossy, *quality}}
+	report, err := publish(context.Background(), *&p, *&s, *&opts)
+	if err != nil {
+		return err
+	}
+	for _, a := range report.Assets {
+		fmt.Printf("%-16s %s (%s saved)\n", a.Step, a.Uri, formatByteSize(int64(a.Saved)))
+	}
+	fmt.Println("Published to", report.Destination+",", formatByteSize(int64(report.Saved)), "saved")
+	return metadata.flush()
+}
+
+func backupCommand(args []string) error {
+	flags := commandFlags("backup", "r", "backend", "overlay")
+	keep := flags.Int("keep", defaultBackupsKept, "Manual archives to keep.")
+	flags.Parse(*&args)
+	err := openOffline()
+	if err != nil {
+		return err
+	}
+	archive, err := backupTask(context.Background(), &job{}, scheduledTask{Name: "manual", Keep: *keep})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Archived the projects into", archive)
+	return metadata.flush()
+}
+
+func syncCommand(args []string) error {
+	flags := commandFlags("sync", "r", "backend")
+	flags.Parse(*&args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	mirrorFlag = flags.Arg(0)
+	err := checkMirror()
+	if err != nil {
+		return err
+	}
+	err = openOffline()
+	if err != nil {
+		return err
+	}
+	copied, removed, err := mirrorSync(mirrorSource(), ".")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Synchronized %s, copying %d and removing %d files\n", mirrorDir, *&copied, *&removed)
+	if n := conflictCount(); n > 0 {
+		fmt.Println(n, "files edited in the mirror are kept as conflicts, to resolve through", syncConflictsPath)
+	}
+	return metadata.flush()
+}
+
+func fixPermissionsCommand(args []string) error {
+	flags := commandFlags("fix-permissions", "r", "backend", "overlay", "file-mode", "dir-mode")
+	flags.Parse(*&args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	err := openOffline()
+	if err != nil {
+		return err
+	}
+	p, ok := uriToPath(flags.Arg(0))
+	if !ok {
+		return errors.New("invalid path: " + flags.Arg(0))
+	}
+	report, err := repairPermissions(context.Background(), nil, *&p, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Changed %d of %d files and %d directories under %s\n", report.Changed, report.Files, report.Directories, report.Uri)
+	return metadata.flush()
+}
@@ -0,0 +1,146 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// EDITOR COMPATIBILITY
+
+// Editor builds disagree on some details of the protocol. At the first
+// compatibility level, values are brought to the format the handlers
+// expect; at the second, legacy header names and ways of asking for a move
+// are translated too. Level 0 takes requests as they come.
+
+const (
+	compatNone = iota
+	compatFormats
+	compatLegacy
+)
+
+// Headers of a request as the client sent them, which its signature covers
+const sentHeadersContextKey = contextKey("sent-headers")
+
+var booleanHeaders = []string{"recursive", "overwrite-destination", "delete-source", "check-existence-only", "get-file-info", "reserve", "lossy", "sanitize-svg"}
+
+// Names older builds used, and the ones they stand for
+var legacyHeaders = map[string]string{
+	"Source-Uri":    "sourceURI",
+	"Source":        "sourceURI",
+	"Overwrite":     "overwrite-destination",
+	"Return-Format": "return-type",
+}
+
+func normalizeBoolean(v string) string {
+	switch strings.ToLower(strings.TrimSpace(*&v)) {
+	case "true", "1", "yes", "on":
+		return "true"
+	case "false", "0", "no", "off":
+		return "false"
+	}
+	return v
+}
+
+// Dates in the format of HTTP, rather than milliseconds since the epoch.
+func normalizeTimestamp(v string) string {
+	if _, err := strconv.ParseInt(*&v, 10, 64); err == nil || v == "" || v == "false" || v == "none" {
+		return v
+	}
+	t, err := http.ParseTime(*&v)
+	if err != nil {
+		return v
+	}
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Headers of a request before their normalization.
+func sentHeaders(r *http.Request) http.Header {
+	if h, ok := r.Context().Value(sentHeadersContextKey).(http.Header); ok {
+		return h
+	}
+	return r.Header
+}
+
+func normalizeRequest(r *http.Request) {
+	h := r.Header
+	if v := h.Get("operation"); v != "" {
+		h.Set("operation", strings.ToLower(strings.TrimSpace(*&v)))
+	}
+	if compatFlag >= compatLegacy {
+		for legacy, name := range legacyHeaders {
+			if v := h.Get(legacy); v != "" && h.Get(name) == "" {
+				h.Set(name, *&v)
+			}
+		}
+		// Windows builds send backslashes in URIs
+		for _, name := range []string{"sourceURI", "destination"} {
+			if v := h.Get(name); strings.Contains(*&v, `\`) {
+				h.Set(name, strings.Replace(*&v, `\`, "/", -1))
+			}
+		}
+		// Files were moved with the operation header of directories, and
+		// directories with the delete-source header of files
+		if h.Get("sourceURI") != "" && r.Method == "PUT" {
+			switch {
+			case strings.HasPrefix(r.URL.Path, filePath) && h.Get("delete-source") == "" && h.Get("operation") != "":
+				h.Set("delete-source", strconv.FormatBool(h.Get("operation") == "move"))
+			case strings.HasPrefix(r.URL.Path, dirPath) && h.Get("operation") == "" && h.Get("delete-source") != "":
+				if normalizeBoolean(h.Get("delete-source")) == "true" {
+					h.Set("operation", "move")
+				} else {
+					h.Set("operation", "copy")
+				}
+			}
+		}
+	}
+	// Sources are paths under the projects directory, but some builds send
+	// full URIs
+	if v := h.Get("sourceURI"); strings.HasPrefix(*&v, drivePrefix) {
+		if p, ok := uriToPath(*&v); ok {
+			h.Set("sourceURI", *&p)
+		}
+	}
+	for _, name := range booleanHeaders {
+		if v := h.Get(name); v != "" {
+			h.Set(name, normalizeBoolean(*&v))
+		}
+	}
+	if v := h.Get("If-modified-since"); v != "" {
+		h.Set("If-modified-since", normalizeTimestamp(*&v))
+	}
+}
+
+//////// MIDDLEWARES
+
+func compatMiddleware(next http.Handler) http.Handler {
+	if compatFlag <= compatNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), sentHeadersContextKey, r.Header.Clone()))
+		normalizeRequest(*&r)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+//////// CONFIGURATION
+
+type config struct {
+	// Authentication schemes accepted, in order
+	Auth     []string        `json:"auth"`
+	Users    []configUser    `json:"users"`
+	ACL      []aclRule       `json:"acl"`
+	Webhooks []webhook       `json:"webhooks"`
+	Bridges  []bridgeConfig  `json:"bridges"`
+	OIDC     *oidcConfig     `json:"oidc"`
+	Schedule []scheduledTask `json:"schedule"`
+	// Policies of the revision stores, by name
+	Retention map[string]*retentionPolicy `json:"retention"`
+	// Storage services users may import from, by name
+	Connectors map[string]*connectorConfig `json:"connectors"`
+	// Types of the files users may save
+	Uploads *uploadPolicy `json:"uploads"`
+	// Patterns of secrets masked out of logs and captures
+	Redact []string `json:"redact"`
+	// Devices the preview server simulates, by name
+	Devices map[string]*deviceProfile `json:"devices"`
+	// Line endings and whitespace of the text files saved, by extension
+	Text map[string]*textPolicy `json:"text"`
+	// Cache-Control headers of the previewed files, the first matching
+	Caching []cachePolicy `json:"caching"`
+	// Directories previewed at the root of host names, by host name
+	Hosts map[string]string `json:"hosts"`
+	// Named configurations selected with -profile, by name
+	Profiles map[string]json.RawMessage `json:"profiles"`
+}
+
+type configUser struct {
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+	// Space the user may use in multi-tenant mode, such as 500M
+	Quota string `json:"quota"`
+	// Groups the ACL may grant rights to
+	Groups []string `json:"groups"`
+}
+
+var cloudConfig config
+
+func loadConfig(p string) (err error) {
+	f, err := os.Open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = json.NewDecoder(*&f).Decode(&cloudConfig)
+	if err != nil {
+		return
+	}
+	return overlayProfile(*&p)
+}
@@ -0,0 +1,421 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//////// SYNC CONFLICTS
+
+// Copies of files the mirror finds edited on its side, where it would
+// otherwise overwrite or remove them. The version of the mirror is kept in
+// the conflicts directory and the mirror copy is left alone until the
+// conflict is resolved: by keeping the version of the projects, that of the
+// mirror in place of it, or both, the version of the mirror then being
+// saved next to the other. Whether a mirror copy was edited is told from
+// the size and date it had once mirrored, or when it was mirrored before
+// these were recorded, from it being newer than the file of the projects.
+
+const conflictsDir = hiddenPrefix + "conflicts"
+const conflictsBucket = "conflicts"
+const mirroredBucket = "mirrored"
+
+// Largest files a diff is given for
+const maxConflictDiff = 1 << 20
+
+var errUnknownResolution = errors.New("unknown conflict resolution")
+
+type conflictVersion struct {
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+}
+
+type syncConflict struct {
+	Id       string `json:"id"`
+	Uri      string `json:"uri"`
+	Mirror   string `json:"mirror"`
+	Detected string `json:"detected"`
+	// Version of the projects, none when they do not have the file anymore
+	Local  *conflictVersion `json:"local"`
+	Remote conflictVersion  `json:"remote"`
+	Diff   string           `json:"diff,omitempty"`
+}
+
+// Conflict as stored, with the mirror copy it was found for.
+type storedConflict struct {
+	syncConflict
+	Found mirrorRecord `json:"found"`
+}
+
+// Mirror copy of a file as it was last written there, or found.
+type mirrorRecord struct {
+	Mirror   string `json:"mirror"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+func recordOf(info os.FileInfo) mirrorRecord {
+	return mirrorRecord{mirrorDir, info.Size(), info.ModTime().UnixNano()}
+}
+
+func versionOf(info os.FileInfo) *conflictVersion {
+	return &conflictVersion{info.Size(), milliseconds(info.ModTime())}
+}
+
+func rememberMirrored(p string, r mirrorRecord) {
+	j, err := json.Marshal(*&r)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	if v, ok := metadata.get(mirroredBucket, metadataKey(*&p)); !ok || v != string(*&j) {
+		metadata.put(mirroredBucket, metadataKey(*&p), string(*&j))
+	}
+}
+
+// Whether the mirror copy of a file was edited since it was mirrored, the
+// file of the projects being given when there is one.
+func mirrorEdited(p string, copy os.FileInfo, local os.FileInfo) bool {
+	var r mirrorRecord
+	v, ok := metadata.get(mirroredBucket, metadataKey(*&p))
+	if !ok || json.Unmarshal([]byte(*&v), &r) != nil || r.Mirror != mirrorDir {
+		return local == nil || copy.ModTime().After(local.ModTime())
+	}
+	return r != recordOf(*&copy)
+}
+
+func conflictId(p string) string {
+	return keyDigest(metadataKey(*&p))[:16]
+}
+
+func conflictFile(id string) string {
+	return filepath.Join(conflictsDir, *&id)
+}
+
+func loadConflict(id string) (c storedConflict, ok bool) {
+	v, ok := metadata.get(conflictsBucket, *&id)
+	if !ok || json.Unmarshal([]byte(*&v), &c) != nil {
+		return c, false
+	}
+	return c, true
+}
+
+func conflictPending(p string) bool {
+	_, ok := metadata.get(conflictsBucket, conflictId(*&p))
+	return ok
+}
+
+func conflictCount() int {
+	return len(metadata.keys(conflictsBucket, "."))
+}
+
+// Copies a file within the projects as they are on disk.
+func copyStored(source storage, from string, to string) (err error) {
+	sf, err := source.open(*&from)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	err = source.mkdirAll(filepath.Dir(*&to), 0777)
+	if err != nil {
+		return
+	}
+	df, err := source.create(*&to, 0666)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(*&df, *&sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// Keeps the mirror copy of a file found edited there as a conflict with
+// the file of the projects, if any.
+func keepConflict(source storage, p string, local os.FileInfo, copy os.FileInfo) (err error) {
+	id := conflictId(*&p)
+	err = source.mkdirAll(conflictsDir, 0777)
+	if err != nil {
+		return
+	}
+	sf, err := os.Open(mirrorPath(*&p))
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	df, err := source.create(conflictFile(*&id), 0666)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(*&df, *&sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	c := storedConflict{syncConflict{
+		Id:       id,
+		Uri:      pathToUri(*&p),
+		Mirror:   mirrorDir,
+		Detected: milliseconds(time.Now()),
+		Remote:   *versionOf(*&copy),
+	}, recordOf(*&copy)}
+	if local != nil {
+		c.Local = versionOf(*&local)
+	}
+	j, err := json.Marshal(*&c)
+	if err != nil {
+		return
+	}
+	metadata.put(conflictsBucket, *&id, string(*&j))
+	logWarn("Kept the copy of", *&p, "edited in the mirror", mirrorDir, "as a conflict")
+	return
+}
+
+// Name of the mirror version of a file kept next to it, such as
+// "page (conflict 2026-10-16).html".
+func conflictCopyName(source storage, p string, detected time.Time) string {
+	ext := filepath.Ext(*&p)
+	base := strings.TrimSuffix(*&p, *&ext) + " (conflict " + detected.Format("2006-01-02")
+	name := base + ")" + ext
+	for i := 2; ; i++ {
+		if _, err := source.stat(*&name); os.IsNotExist(err) {
+			return name
+		}
+		name = base + " " + strconv.Itoa(*&i) + ")" + ext
+	}
+}
+
+// Resolves a conflict, returning the URIs of the files written into the
+// projects. The mirror copy is then taken as mirrored, for the mirror to
+// bring it in line with the projects.
+func resolveConflict(c storedConflict, action string) (uris []string, err error) {
+	source := mirrorSource()
+	p, ok := uriToPath(c.Uri)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	remote := conflictFile(c.Id)
+	uris = []string{}
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	written := []string{}
+	switch action {
+	case "keep-local":
+	case "keep-remote":
+		written = append(*&written, *&p)
+	case "keep-both":
+		dest := p
+		if c.Local != nil {
+			dest = conflictCopyName(*&source, *&p, parseMilliseconds(c.Detected))
+		}
+		written = append(*&written, *&dest)
+	default:
+		return nil, errUnknownResolution
+	}
+	for _, dest := range written {
+		err = copyStored(*&source, *&remote, *&dest)
+		if err != nil {
+			return
+		}
+		uris = append(*&uris, pathToUri(*&dest))
+	}
+	rememberMirrored(*&p, c.Found)
+	metadata.delete(conflictsBucket, c.Id)
+	err = source.remove(*&remote)
+	if err != nil && !os.IsNotExist(*&err) {
+		log.Println(*&err)
+	}
+	err = nil
+	if mirrorDir == c.Mirror {
+		// Right away rather than at the next change or comparison
+		for _, q := range append(written, p) {
+			copied, removed, err := mirrorUpdate(*&source, *&q)
+			mirrorHealth.count(*&copied, *&removed)
+			if err != nil {
+				log.Println(*&err)
+			}
+		}
+	}
+	return
+}
+
+// Diff from the version of the projects to that of the mirror, for text
+// files of projects which are not encrypted.
+func conflictDiff(c storedConflict) (diff string, ok bool) {
+	p, ok := uriToPath(c.Uri)
+	if e, encrypted := encryptedFsys(); !ok || encrypted && e.sealed(*&p) {
+		return "", false
+	}
+	if c.Remote.Size > maxConflictDiff || c.Local != nil && c.Local.Size > maxConflictDiff {
+		return "", false
+	}
+	source := mirrorSource()
+	var local []byte
+	if c.Local != nil {
+		f, err := source.open(*&p)
+		if err != nil {
+			return "", false
+		}
+		local, err = io.ReadAll(io.LimitReader(*&f, maxConflictDiff+1))
+		f.Close()
+		if err != nil {
+			return "", false
+		}
+	}
+	f, err := source.open(conflictFile(c.Id))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	remote, err := io.ReadAll(io.LimitReader(*&f, maxConflictDiff+1))
+	if err != nil || !isText(*&local) || !isText(*&remote) {
+		return "", false
+	}
+	return unifiedDiff(*&local, *&remote, "local/"+filepath.ToSlash(*&p), "mirror/"+filepath.ToSlash(*&p))
+}
+
+func isText(content []byte) bool {
+	return utf8.Valid(*&content) && !strings.ContainsRune(string(*&content), 0)
+}
+
+//// Mirror removals
+
+// Removes a path from the mirror but for the files edited there, kept as
+// conflicts with the projects not having them anymore.
+func mirrorRemove(source storage, p string) (removed int64, err error) {
+	var dirs []string
+	err = filepath.WalkDir(mirrorPath(*&p), func(mp string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(*&err) && mp == mirrorPath(*&p) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(*&dirs, *&mp)
+			return nil
+		}
+		rel, err := filepath.Rel(*&mirrorDir, *&mp)
+		if err != nil {
+			return err
+		}
+		if conflictPending(*&rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if mirrored(*&rel) && info.Mode().IsRegular() && mirrorEdited(*&rel, *&info, nil) {
+			return keepConflict(*&source, *&rel, nil, *&info)
+		}
+		removed++
+		return os.Remove(*&mp)
+	})
+	// Directories go once empty, those holding conflicts staying
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	metadata.deleteTree(mirroredBucket, metadataKey(*&p))
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Sync conflicts API
+
+// List the conflicts, read one with its diff or the version of the mirror,
+// or resolve one with the "action" parameter
+func syncConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if authEnabled() && requestUser(*&r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	parts := strings.SplitN(r.URL.Path[syncConflictsPathLen:], "/", 2)
+	id := parts[0]
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		list := []syncConflict{}
+		for _, k := range metadata.keys(conflictsBucket, ".") {
+			if c, ok := loadConflict(*&k); ok {
+				list = append(*&list, c.syncConflict)
+			}
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].Uri < list[b].Uri })
+		writeJSON(w, http.StatusOK, *&list)
+		return
+	}
+	c, ok := loadConflict(*&id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		c.Diff, _ = conflictDiff(*&c)
+		writeJSON(w, http.StatusOK, c.syncConflict)
+		return
+	case len(parts) == 2 && parts[1] == "remote" && r.Method == "GET":
+		f, err := mirrorSource().open(conflictFile(*&id))
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, *&f)
+		return
+	case len(parts) == 1 && r.Method == "POST":
+		uris, err := resolveConflict(*&c, r.URL.Query().Get("action"))
+		if err == errUnknownResolution {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"written": *&uris})
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,210 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Cloud on disk in a temporary directory, mirrored into another.
+func newMirroredCloud(t *testing.T) http.Handler {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(*&wd) })
+	h := newTestCloudOver(t, diskStorage{})
+	mirrorDir = t.TempDir()
+	t.Cleanup(func() { mirrorDir = "" })
+	return h
+}
+
+func mirrorNow(t *testing.T) {
+	t.Helper()
+	_, _, err := mirrorSync(mirrorSource(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Edits the mirror copy of a file, dated after its version in the projects.
+func editMirror(t *testing.T, p string, content string) {
+	t.Helper()
+	mp := filepath.Join(mirrorDir, filepath.FromSlash(*&p))
+	err := os.MkdirAll(filepath.Dir(*&mp), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(*&mp, []byte(*&content), 0666)
+	}
+	if err == nil {
+		later := time.Now().Add(time.Hour)
+		err = os.Chtimes(*&mp, *&later, *&later)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mirrorContent(p string) string {
+	content, _ := ioutil.ReadFile(filepath.Join(mirrorDir, filepath.FromSlash(*&p)))
+	return string(*&content)
+}
+
+func listConflicts(t *testing.T, h http.Handler) (list []syncConflict) {
+	t.Helper()
+	w := serveTest(h, testRequest{"GET", syncConflictsPath, nil, ""})
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list: %d %v", w.Code, err)
+	}
+	return
+}
+
+func TestSyncConflictKeepBoth(t *testing.T) {
+	h := newMirroredCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("one\ntwo\n"))
+	mirrorNow(t)
+	if mirrorContent("p/a.txt") != "one\ntwo\n" {
+		t.Fatalf("mirrored: %q", mirrorContent("p/a.txt"))
+	}
+
+	// Edited on both sides
+	editMirror(t, "p/a.txt", "one\nTWO\n")
+	saveFile("p/a.txt", []byte("one\ntwo\nthree\n"))
+	mirrorNow(t)
+	if mirrorContent("p/a.txt") != "one\nTWO\n" {
+		t.Errorf("mirror copy overwritten: %q", mirrorContent("p/a.txt"))
+	}
+	list := listConflicts(t, h)
+	if len(list) != 1 || list[0].Uri != "Z:/Ninja/p/a.txt" || list[0].Local == nil {
+		t.Fatalf("conflicts: %+v", list)
+	}
+	// Left alone until resolved
+	mirrorNow(t)
+	if len(listConflicts(t, h)) != 1 || mirrorContent("p/a.txt") != "one\nTWO\n" {
+		t.Errorf("conflict not kept: %q", mirrorContent("p/a.txt"))
+	}
+
+	w := serveTest(h, testRequest{"GET", syncConflictsPath + list[0].Id, nil, ""})
+	var c syncConflict
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("get: %d %v", w.Code, err)
+	}
+	if patched, err := applyUnifiedDiff([]byte("one\ntwo\nthree\n"), []byte(c.Diff)); err != nil || string(patched) != "one\nTWO\n" {
+		t.Errorf("diff %q: %q %v", c.Diff, patched, err)
+	}
+	if w := serveTest(h, testRequest{"GET", syncConflictsPath + c.Id + "/remote", nil, ""}); w.Body.String() != "one\nTWO\n" {
+		t.Errorf("remote: %q", w.Body.String())
+	}
+
+	expectStatuses(t, h, []step{
+		{testRequest{"POST", syncConflictsPath + c.Id + "?action=keep-neither", nil, ""}, http.StatusBadRequest},
+		{testRequest{"POST", syncConflictsPath + c.Id + "?action=keep-both", nil, ""}, http.StatusOK},
+		{testRequest{"GET", syncConflictsPath + c.Id, nil, ""}, http.StatusNotFound},
+	})
+	kept := "p/a (conflict " + time.Now().Format("2006-01-02") + ").txt"
+	if content, err := readFile(*&kept); err != nil || string(content) != "one\nTWO\n" {
+		t.Errorf("kept: %q %v", content, err)
+	}
+	if content, _ := readFile("p/a.txt"); string(content) != "one\ntwo\nthree\n" {
+		t.Errorf("local: %q", content)
+	}
+	if mirrorContent("p/a.txt") != "one\ntwo\nthree\n" || mirrorContent(*&kept) != "one\nTWO\n" {
+		t.Errorf("mirror: %q %q", mirrorContent("p/a.txt"), mirrorContent(*&kept))
+	}
+	if exist(conflictFile(c.Id)) {
+		t.Error("version of the mirror left behind")
+	}
+}
+
+func TestSyncConflictKeepLocalAndRemote(t *testing.T) {
+	h := newMirroredCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("local"))
+	saveFile("p/gone.txt", []byte("gone"))
+	mirrorNow(t)
+
+	// Created only in the mirror, which would remove it
+	editMirror(t, "p/new.txt", "new")
+	// Removed from the projects, unchanged in the mirror
+	removeFile("p/gone.txt")
+	editMirror(t, "p/a.txt", "remote")
+	mirrorNow(t)
+	if mirrorContent("p/gone.txt") != "" {
+		t.Error("removed file kept in the mirror")
+	}
+	list := listConflicts(t, h)
+	if len(list) != 2 {
+		t.Fatalf("conflicts: %+v", list)
+	}
+	for _, c := range list {
+		action := "keep-local"
+		if strings.HasSuffix(c.Uri, "new.txt") {
+			action = "keep-remote"
+			if c.Local != nil {
+				t.Errorf("local version of a file created in the mirror: %+v", c.Local)
+			}
+		}
+		if w := serveTest(h, testRequest{"POST", syncConflictsPath + c.Id + "?action=" + action, nil, ""}); w.Code != http.StatusOK {
+			t.Errorf("%s %s: %d", action, c.Uri, w.Code)
+		}
+	}
+	if content, _ := readFile("p/new.txt"); string(content) != "new" {
+		t.Errorf("kept remote: %q", content)
+	}
+	if mirrorContent("p/a.txt") != "local" {
+		t.Errorf("kept local: %q", mirrorContent("p/a.txt"))
+	}
+	mirrorNow(t)
+	if len(listConflicts(t, h)) != 0 || mirrorContent("p/new.txt") != "new" {
+		t.Errorf("after resolving: %+v %q", listConflicts(t, h), mirrorContent("p/new.txt"))
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := [][2]string{
+		{"", "a\n"},
+		{"a\n", ""},
+		{"a\nb\nc\n", "a\nc\n"},
+		{"a\nb", "a\nb\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "1\nX\n3\n4\n5\n6\n7\n8\n9\n10\nY\n12\n13\n"},
+	}
+	for _, test := range tests {
+		diff, ok := unifiedDiff([]byte(test[0]), []byte(test[1]), "a", "b")
+		if !ok {
+			t.Fatalf("%q: no diff", test[0])
+		}
+		patched, err := applyUnifiedDiff([]byte(test[0]), []byte(*&diff))
+		if err != nil || string(patched) != test[1] {
+			t.Errorf("%q to %q: %q gives %q %v", test[0], test[1], diff, patched, err)
+		}
+	}
+}
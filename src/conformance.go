@@ -0,0 +1,252 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//////// CONFORMANCE
+
+// Battery of requests run with the conformance subcommand against a running
+// instance, or an in-process one over memory storage, checking the status,
+// headers and body of each response against the golden file of a version
+// of the API. Requests work in a directory of their own, named by {dir} in
+// the steps.
+//
+// Bodies are checked by shape: objects have at least the expected keys,
+// arrays have elements all matching the first expected one, empty strings
+// stand for any string, zeros for any number, and other values have to be
+// equal.
+
+//go:embed conformance/*.json
+var conformanceFiles embed.FS
+
+type conformanceStep struct {
+	Name           string            `json:"name"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	RequestHeaders map[string]string `json:"request-headers"`
+	Body           string            `json:"body"`
+	Status         int               `json:"status"`
+	// Headers the response has, with any value when empty
+	Headers map[string]string `json:"headers"`
+	Json    interface{}       `json:"json"`
+	Text    *string           `json:"text"`
+}
+
+type conformanceSuite struct {
+	Version int               `json:"version"`
+	Steps   []conformanceStep `json:"steps"`
+}
+
+func loadConformanceSuite(version int, golden string) (s conformanceSuite, err error) {
+	var content []byte
+	if golden != "" {
+		content, err = ioutil.ReadFile(*&golden)
+	} else {
+		content, err = conformanceFiles.ReadFile("conformance/" + strconv.Itoa(*&version) + ".json")
+		if err != nil {
+			err = errors.New("no golden file for API version " + strconv.Itoa(*&version))
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(*&content, &s)
+	return
+}
+
+// Tells where a value departs from the expected shape, if it does.
+func shapeMismatch(expected interface{}, actual interface{}, at string) string {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return at + ": expected an object"
+		}
+		for k, v := range e {
+			av, present := a[k]
+			if !present {
+				return at + "." + k + ": missing"
+			}
+			if m := shapeMismatch(*&v, *&av, at+"."+k); m != "" {
+				return m
+			}
+		}
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			return at + ": expected an array"
+		}
+		if len(e) == 0 {
+			return ""
+		}
+		if len(a) == 0 {
+			return at + ": expected elements"
+		}
+		for i, v := range a {
+			if m := shapeMismatch(e[0], *&v, at+"["+strconv.Itoa(*&i)+"]"); m != "" {
+				return m
+			}
+		}
+	case string:
+		a, ok := actual.(string)
+		if !ok {
+			return at + ": expected a string"
+		}
+		if e != "" && e != a {
+			return at + ": expected " + strconv.Quote(*&e) + ", got " + strconv.Quote(*&a)
+		}
+	case float64:
+		a, ok := actual.(float64)
+		if !ok {
+			return at + ": expected a number"
+		}
+		if e != 0 && e != a {
+			return at + ": expected " + fmt.Sprint(*&e) + ", got " + fmt.Sprint(*&a)
+		}
+	default:
+		if !reflect.DeepEqual(*&expected, *&actual) {
+			return at + ": expected " + fmt.Sprint(*&expected) + ", got " + fmt.Sprint(*&actual)
+		}
+	}
+	return ""
+}
+
+// Runs a step, telling what does not conform in its response.
+func runConformanceStep(client *http.Client, u string, token string, version int, dir string, s conformanceStep) (problems []string, err error) {
+	expand := func(v string) string { return strings.Replace(*&v, "{dir}", *&dir, -1) }
+	req, err := http.NewRequest(s.Method, u+expand(s.Path), strings.NewReader(expand(s.Body)))
+	if err != nil {
+		return
+	}
+	for k, v := range s.RequestHeaders {
+		req.Header.Set(*&k, expand(*&v))
+	}
+	req.Header.Set(apiVersionHeader, strconv.Itoa(*&version))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != s.Status {
+		problems = append(problems, "status: expected "+strconv.Itoa(s.Status)+", got "+strconv.Itoa(resp.StatusCode))
+	}
+	for k, v := range s.Headers {
+		got, present := resp.Header[http.CanonicalHeaderKey(*&k)]
+		if !present || v != "" && got[0] != v {
+			problems = append(problems, "header "+k+": expected "+strconv.Quote(*&v)+", got "+strconv.Quote(strings.Join(*&got, ", ")))
+		}
+	}
+	if s.Text != nil && string(*&body) != *s.Text {
+		problems = append(problems, "body: expected "+strconv.Quote(*s.Text)+", got "+strconv.Quote(string(*&body)))
+	}
+	if s.Json != nil {
+		var actual interface{}
+		if json.Unmarshal(*&body, &actual) != nil {
+			problems = append(problems, "body: not JSON")
+		} else if m := shapeMismatch(s.Json, *&actual, "body"); m != "" {
+			problems = append(problems, *&m)
+		}
+	}
+	return
+}
+
+func runConformance(u string, token string, suite conformanceSuite) (failed int, err error) {
+	client := &http.Client{}
+	dir := "ninja-conformance-" + randomString(6)
+	fmt.Printf("Checking %s against API version %d\n", u, suite.Version)
+	for _, s := range suite.Steps {
+		problems, err := runConformanceStep(*&client, *&u, *&token, suite.Version, *&dir, *&s)
+		if err != nil {
+			return failed, err
+		}
+		if len(problems) == 0 {
+			fmt.Println("ok  ", s.Name)
+			continue
+		}
+		failed++
+		fmt.Println("FAIL", s.Name)
+		for _, p := range problems {
+			fmt.Println("     ", p)
+		}
+	}
+	// Leaves nothing behind, whatever the steps did
+	req, _ := http.NewRequest("DELETE", u+dirPath+dir, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if resp, err := client.Do(*&req); err == nil {
+		resp.Body.Close()
+	}
+	fmt.Printf("%d of %d steps conform\n", len(suite.Steps)-failed, len(suite.Steps))
+	return
+}
+
+// Entry point of the conformance subcommand.
+func conformanceCommand(args []string) error {
+	var u, token, golden string
+	var version int
+	var inProcess bool
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	flags.StringVar(&u, "url", "http://localhost:58080", "URL of the instance to check.")
+	flags.StringVar(&token, "token", "", "Access token to authenticate with.")
+	flags.BoolVar(&inProcess, "in-process", false, "Check the handlers of an in-process instance over memory storage instead.")
+	flags.IntVar(&version, "api-version", apiVersions[len(apiVersions)-1], "Version of the API to check.")
+	flags.StringVar(&golden, "golden", "", "Golden file to check against instead of the one shipped for the version.")
+	flags.Parse(*&args)
+
+	suite, err := loadConformanceSuite(*&version, *&golden)
+	if err != nil {
+		return err
+	}
+	if inProcess {
+		u, err = startInProcessCloud()
+		if err != nil {
+			return err
+		}
+	}
+	failed, err := runConformance(strings.TrimRight(*&u, "/"), *&token, *&suite)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
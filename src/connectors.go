@@ -0,0 +1,824 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// STORAGE CONNECTORS
+
+// Accounts of consumer cloud storage services users link to browse and
+// import their files into projects. Google Drive is linked through the
+// OAuth device flow, the user entering a code on a page of Google, and
+// Dropbox, which has no device flow, by pasting back the code its
+// authorization page shows. Tokens are kept per user in a file only the
+// account running the cloud can read, next to the projects directory rather
+// than in it, so that no route, sync or backup of the projects carries them.
+
+// Bucket of the metadata store tokens used to be kept in
+const connectorsBucket = "connectors"
+const connectorTokensFile = hiddenPrefix + "connectors.json"
+const connectorMaxDepth = 16
+
+type connectorConfig struct {
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
+type connectorToken struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	Expires      string `json:"expires"`
+}
+
+type connectorEntry struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Folder   bool   `json:"folder"`
+	Size     int64  `json:"size,omitempty"`
+	Modified string `json:"modified,omitempty"`
+}
+
+// What the user has to do to link an account.
+type linkPrompt struct {
+	VerificationUrl string `json:"verificationUrl"`
+	UserCode        string `json:"userCode,omitempty"`
+	Expires         string `json:"expires"`
+}
+
+type connectorProvider struct {
+	tokenUrl  string
+	startLink func(name string, c *connectorConfig, user string) (linkPrompt, error)
+	// Trades the code pasted by the user, for flows which need one
+	finishLink func(name string, c *connectorConfig, user string, code string) error
+	list       func(ctx context.Context, token string, folder string) ([]connectorEntry, error)
+	download   func(ctx context.Context, token string, id string) (io.ReadCloser, error)
+}
+
+var connectorProviders = map[string]connectorProvider{
+	"gdrive": {
+		tokenUrl:  googleTokenUrl,
+		startLink: googleStartLink,
+		list:      googleList,
+		download:  googleDownload,
+	},
+	"dropbox": {
+		tokenUrl:   dropboxTokenUrl,
+		startLink:  dropboxStartLink,
+		finishLink: dropboxFinishLink,
+		list:       dropboxList,
+		download:   dropboxDownload,
+	},
+}
+
+var googleTokenUrl = "https://oauth2.googleapis.com/token"
+var googleDeviceUrl = "https://oauth2.googleapis.com/device/code"
+var googleFilesUrl = "https://www.googleapis.com/drive/v3/files"
+var dropboxTokenUrl = "https://api.dropboxapi.com/oauth2/token"
+var dropboxAuthorizeUrl = "https://www.dropbox.com/oauth2/authorize"
+var dropboxApiUrl = "https://api.dropboxapi.com/2/files/"
+var dropboxContentUrl = "https://content.dropboxapi.com/2/files/download"
+
+var googleIdRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Links in progress, by connector and user: the state of device flows, or
+// the PKCE verifier of the code to come.
+var pendingLinks = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func checkConnectors() error {
+	for name, c := range cloudConfig.Connectors {
+		if _, ok := connectorProviders[name]; !ok {
+			return fmt.Errorf("unknown connector %q", name)
+		}
+		if c.ClientId == "" {
+			return fmt.Errorf("connector %s needs a client id", name)
+		}
+	}
+	return nil
+}
+
+func connectorKey(name string, user string) string {
+	return name + "/" + user
+}
+
+// Tokens of the linked accounts, by connector and user. Without a path,
+// as with the memory backend, they are only kept in memory.
+type tokenFile struct {
+	mutex  sync.Mutex
+	path   string
+	loaded bool
+	tokens map[string]connectorToken
+}
+
+var connectorTokens = &tokenFile{}
+
+// Where the tokens are written, set by openProjects for the disk backend
+// before it moves into the projects directory.
+func setConnectorTokensPath(p string) {
+	connectorTokens.mutex.Lock()
+	defer connectorTokens.mutex.Unlock()
+	connectorTokens.path = p
+	connectorTokens.loaded = false
+	connectorTokens.tokens = nil
+}
+
+// Called with the file locked.
+func (f *tokenFile) load() (err error) {
+	if f.loaded {
+		return
+	}
+	f.tokens = make(map[string]connectorToken)
+	if f.path != "" {
+		content, err := ioutil.ReadFile(f.path)
+		if os.IsNotExist(*&err) {
+			err = nil
+		} else if err == nil {
+			err = json.Unmarshal(*&content, &f.tokens)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.loaded = true
+	return
+}
+
+// Called with the file locked. Written then renamed, readable by the owner
+// of the process only.
+func (f *tokenFile) save() (err error) {
+	if f.path == "" {
+		return
+	}
+	j, err := json.Marshal(f.tokens)
+	if err != nil {
+		return
+	}
+	tmp := f.path + ".tmp"
+	err = ioutil.WriteFile(*&tmp, *&j, 0600)
+	if err == nil {
+		// WriteFile leaves the mode of a file left behind as it was
+		err = os.Chmod(*&tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(*&tmp, f.path)
+	}
+	return
+}
+
+func (f *tokenFile) get(key string) (t connectorToken, ok bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.load()
+	if err != nil {
+		log.Println(*&err)
+		return t, false
+	}
+	t, ok = f.tokens[key]
+	return
+}
+
+// Sets the tokens of the given keys, removing those given nil.
+func (f *tokenFile) update(tokens map[string]*connectorToken) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.load()
+	if err != nil {
+		return
+	}
+	for k, t := range tokens {
+		if t == nil {
+			delete(f.tokens, *&k)
+		} else {
+			f.tokens[k] = *t
+		}
+	}
+	return f.save()
+}
+
+func (f *tokenFile) all() (tokens map[string]connectorToken, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.load()
+	tokens = make(map[string]connectorToken)
+	for k, t := range f.tokens {
+		tokens[k] = t
+	}
+	return
+}
+
+func saveConnectorToken(name string, user string, t connectorToken) {
+	err := connectorTokens.update(map[string]*connectorToken{connectorKey(*&name, *&user): &t})
+	if err != nil {
+		log.Println(*&err)
+	}
+}
+
+func loadConnectorToken(name string, user string) (t connectorToken, ok bool) {
+	return connectorTokens.get(connectorKey(*&name, *&user))
+}
+
+func forgetConnectorToken(name string, user string) error {
+	return connectorTokens.update(map[string]*connectorToken{connectorKey(*&name, *&user): nil})
+}
+
+// Store migration moving the tokens out of the metadata store, which lies
+// among the projects, into their own file.
+func moveConnectorTokens(s *kvStore) error {
+	tokens := make(map[string]*connectorToken)
+	for k, v := range s.data[connectorsBucket] {
+		var t connectorToken
+		if json.Unmarshal([]byte(*&v), &t) == nil {
+			tokens[k] = &t
+		}
+	}
+	if len(*&tokens) > 0 {
+		err := connectorTokens.update(*&tokens)
+		if err != nil {
+			return err
+		}
+	}
+	delete(s.data, connectorsBucket)
+	return nil
+}
+
+//// OAuth
+
+type oauthResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func postForm(ctx context.Context, u string, form url.Values, v interface{}) (status int, err error) {
+	req, err := http.NewRequestWithContext(*&ctx, "POST", *&u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(*&v)
+	return resp.StatusCode, err
+}
+
+func tokenFromResponse(r oauthResponse, previous connectorToken) connectorToken {
+	t := connectorToken{AccessToken: r.AccessToken, RefreshToken: r.RefreshToken}
+	if t.RefreshToken == "" {
+		// Refreshing doesn't always issue a new refresh token
+		t.RefreshToken = previous.RefreshToken
+	}
+	if r.ExpiresIn > 0 {
+		t.Expires = milliseconds(time.Now().Add(time.Duration(r.ExpiresIn) * time.Second))
+	}
+	return t
+}
+
+// Access token of a linked account, refreshed when about to expire.
+func connectorAccessToken(ctx context.Context, name string, user string) (token string, err error) {
+	t, ok := loadConnectorToken(*&name, *&user)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	if t.Expires == "" || time.Until(parseMilliseconds(t.Expires)) > time.Minute || t.RefreshToken == "" {
+		return t.AccessToken, nil
+	}
+	c := cloudConfig.Connectors[name]
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+		"client_id":     {c.ClientId},
+	}
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	var r oauthResponse
+	status, err := postForm(*&ctx, connectorProviders[name].tokenUrl, *&form, &r)
+	if err != nil {
+		return
+	}
+	if status != http.StatusOK || r.AccessToken == "" {
+		return "", fmt.Errorf("%s: refreshing the token failed: %d %s", name, status, r.Error)
+	}
+	t = tokenFromResponse(*&r, *&t)
+	saveConnectorToken(*&name, *&user, *&t)
+	return t.AccessToken, nil
+}
+
+// Calls an API of a provider, failing on any status but OK.
+func connectorRequest(ctx context.Context, method string, u string, token string, body []byte, header map[string]string) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(*&ctx, *&method, *&u, bytes.NewReader(*&body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for k, v := range header {
+		req.Header.Set(*&k, *&v)
+	}
+	resp, err = http.DefaultClient.Do(*&req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(*&message)))
+	}
+	return
+}
+
+//// Google Drive
+
+// Starts a device flow, then polls for the user's approval in the
+// background.
+func googleStartLink(name string, c *connectorConfig, user string) (prompt linkPrompt, err error) {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		// Among the few scopes the device flow allows
+		scopes = []string{"https://www.googleapis.com/auth/drive.file"}
+	}
+	var device struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationUrl string `json:"verification_url"`
+		ExpiresIn       int64  `json:"expires_in"`
+		Interval        int64  `json:"interval"`
+		Error           string `json:"error"`
+	}
+	status, err := postForm(backgroundContext, googleDeviceUrl, url.Values{"client_id": {c.ClientId}, "scope": {strings.Join(*&scopes, " ")}}, &device)
+	if err != nil {
+		return
+	}
+	if status != http.StatusOK {
+		return prompt, fmt.Errorf("%s: device authorization failed: %d %s", name, status, device.Error)
+	}
+	expires := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	key := connectorKey(*&name, *&user)
+	pendingLinks.Lock()
+	pendingLinks.m[key] = device.DeviceCode
+	pendingLinks.Unlock()
+	go func() {
+		defer func() {
+			pendingLinks.Lock()
+			if pendingLinks.m[key] == device.DeviceCode {
+				delete(pendingLinks.m, key)
+			}
+			pendingLinks.Unlock()
+		}()
+		form := url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code":   {device.DeviceCode},
+			"client_id":     {c.ClientId},
+			"client_secret": {c.ClientSecret},
+		}
+		for time.Now().Before(*&expires) {
+			time.Sleep(*&interval)
+			var r oauthResponse
+			_, err := postForm(backgroundContext, googleTokenUrl, *&form, &r)
+			if err != nil {
+				logWarn("Linking", name, "failed:", err)
+				return
+			}
+			switch r.Error {
+			case "":
+				saveConnectorToken(*&name, *&user, tokenFromResponse(*&r, connectorToken{}))
+				logInfo("Linked", name, "account")
+				return
+			case "authorization_pending":
+			case "slow_down":
+				interval += 5 * time.Second
+			default:
+				logWarn("Linking", name, "failed:", r.Error)
+				return
+			}
+		}
+	}()
+	return linkPrompt{device.VerificationUrl, device.UserCode, milliseconds(*&expires)}, nil
+}
+
+func googleList(ctx context.Context, token string, folder string) (entries []connectorEntry, err error) {
+	if folder == "" {
+		folder = "root"
+	}
+	if !googleIdRegexp.MatchString(*&folder) {
+		return nil, os.ErrInvalid
+	}
+	entries = []connectorEntry{}
+	pageToken := ""
+	for {
+		q := url.Values{
+			"q":        {"'" + folder + "' in parents and trashed = false"},
+			"fields":   {"nextPageToken, files(id, name, mimeType, size, modifiedTime)"},
+			"pageSize": {"1000"},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", *&pageToken)
+		}
+		resp, err := connectorRequest(*&ctx, "GET", googleFilesUrl+"?"+q.Encode(), *&token, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				Id           string    `json:"id"`
+				Name         string    `json:"name"`
+				MimeType     string    `json:"mimeType"`
+				Size         string    `json:"size"`
+				ModifiedTime time.Time `json:"modifiedTime"`
+			} `json:"files"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page.Files {
+			folder := f.MimeType == "application/vnd.google-apps.folder"
+			if !folder && strings.HasPrefix(f.MimeType, "application/vnd.google-apps.") {
+				// Google documents have no content to download
+				continue
+			}
+			size, _ := strconv.ParseInt(f.Size, 10, 64)
+			entries = append(entries, connectorEntry{f.Id, f.Name, folder, size, milliseconds(f.ModifiedTime)})
+		}
+		if page.NextPageToken == "" {
+			return entries, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func googleDownload(ctx context.Context, token string, id string) (io.ReadCloser, error) {
+	if !googleIdRegexp.MatchString(*&id) {
+		return nil, os.ErrInvalid
+	}
+	resp, err := connectorRequest(*&ctx, "GET", googleFilesUrl+"/"+id+"?alt=media", *&token, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//// Dropbox
+
+// Sends the user to the authorization page with a PKCE challenge, the
+// verifier being kept until the user pastes the code back.
+func dropboxStartLink(name string, c *connectorConfig, user string) (prompt linkPrompt, err error) {
+	verifier := randomString(48)
+	challenge := sha256.Sum256([]byte(*&verifier))
+	pendingLinks.Lock()
+	pendingLinks.m[connectorKey(*&name, *&user)] = verifier
+	pendingLinks.Unlock()
+	q := url.Values{
+		"client_id":             {c.ClientId},
+		"response_type":         {"code"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"token_access_type":     {"offline"},
+	}
+	return linkPrompt{VerificationUrl: dropboxAuthorizeUrl + "?" + q.Encode(), Expires: milliseconds(time.Now().Add(time.Hour))}, nil
+}
+
+func dropboxFinishLink(name string, c *connectorConfig, user string, code string) (err error) {
+	key := connectorKey(*&name, *&user)
+	pendingLinks.Lock()
+	verifier, ok := pendingLinks.m[key]
+	delete(pendingLinks.m, key)
+	pendingLinks.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {c.ClientId},
+		"code_verifier": {verifier},
+	}
+	var r oauthResponse
+	status, err := postForm(backgroundContext, dropboxTokenUrl, *&form, &r)
+	if err != nil {
+		return
+	}
+	if status != http.StatusOK || r.AccessToken == "" {
+		return fmt.Errorf("%s: code exchange failed: %d %s", name, status, r.Error)
+	}
+	saveConnectorToken(*&name, *&user, tokenFromResponse(*&r, connectorToken{}))
+	return
+}
+
+func dropboxList(ctx context.Context, token string, folder string) (entries []connectorEntry, err error) {
+	entries = []connectorEntry{}
+	endpoint := "list_folder"
+	body, err := json.Marshal(map[string]interface{}{"path": folder, "limit": 2000})
+	if err != nil {
+		return
+	}
+	for {
+		resp, err := connectorRequest(*&ctx, "POST", dropboxApiUrl+endpoint, *&token, *&body, map[string]string{"Content-Type": "application/json"})
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Entries []struct {
+				Tag            string    `json:".tag"`
+				Id             string    `json:"id"`
+				Name           string    `json:"name"`
+				Size           int64     `json:"size"`
+				ServerModified time.Time `json:"server_modified"`
+			} `json:"entries"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page.Entries {
+			if e.Tag != "file" && e.Tag != "folder" {
+				continue
+			}
+			entry := connectorEntry{Id: e.Id, Name: e.Name, Folder: e.Tag == "folder", Size: e.Size}
+			if !e.ServerModified.IsZero() {
+				entry.Modified = milliseconds(e.ServerModified)
+			}
+			entries = append(entries, entry)
+		}
+		if !page.HasMore {
+			return entries, nil
+		}
+		endpoint = "list_folder/continue"
+		body, err = json.Marshal(map[string]string{"cursor": page.Cursor})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func dropboxDownload(ctx context.Context, token string, id string) (io.ReadCloser, error) {
+	arg, err := json.Marshal(map[string]string{"path": id})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := connectorRequest(*&ctx, "POST", dropboxContentUrl, *&token, nil, map[string]string{"Dropbox-API-Arg": string(*&arg)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//// Import
+
+// Names of imported files, kept from escaping their destination or
+// passing for the cloud's own files.
+func importName(name string) (string, bool) {
+	name = filepath.Base(filepath.Clean("/" + strings.Replace(*&name, "\\", "/", -1)))
+	return name, name != "/" && name != "." && name != ".." && !strings.HasPrefix(*&name, hiddenPrefix)
+}
+
+// Downloads files and folders into a directory, folders with everything
+// under them.
+func importEntries(ctx context.Context, j *job, name string, user string, entries []connectorEntry, dest string, depth int) (count int, err error) {
+	provider := connectorProviders[name]
+	for i, e := range entries {
+		err = ioPause(*&ctx)
+		if err != nil {
+			return
+		}
+		fname, ok := importName(e.Name)
+		if !ok {
+			continue
+		}
+		token, err := connectorAccessToken(*&ctx, *&name, *&user)
+		if err != nil {
+			return count, err
+		}
+		p := filepath.Join(*&dest, *&fname)
+		if e.Folder {
+			if depth >= connectorMaxDepth {
+				continue
+			}
+			children, err := provider.list(*&ctx, *&token, e.Id)
+			if err != nil {
+				return count, err
+			}
+			err = createDir(*&p)
+			if err != nil {
+				return count, err
+			}
+			n, err := importEntries(*&ctx, nil, *&name, *&user, *&children, *&p, depth+1)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		} else {
+			body, err := provider.download(*&ctx, *&token, e.Id)
+			if err != nil {
+				return count, err
+			}
+			f, err := fsys.create(*&p, 0666)
+			if err != nil {
+				body.Close()
+				return count, err
+			}
+			_, err = io.Copy(*&f, *&body)
+			body.Close()
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return count, err
+			}
+			recordCreation(*&p)
+			count++
+		}
+		if j != nil {
+			j.setProgress(float64(i+1) / float64(len(*&entries)))
+		}
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Connectors API
+
+// Link accounts of storage services, browse them and import files
+func connectorsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	user := requestUser(*&r)
+	parts := strings.SplitN(r.URL.Path[connectorsPathLen:], "/", 2)
+	name := parts[0]
+	if name == "" {
+		// Configured connectors, and whether they are linked
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		list := []map[string]interface{}{}
+		for n := range cloudConfig.Connectors {
+			_, linked := loadConnectorToken(*&n, *&user)
+			list = append(list, map[string]interface{}{"name": n, "linked": linked})
+		}
+		writeJSON(w, http.StatusOK, *&list)
+		return
+	}
+	c, ok := cloudConfig.Connectors[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	provider := connectorProviders[name]
+	action := ""
+	if len(*&parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == "DELETE":
+		// Forget the linked account
+		err := forgetConnectorToken(*&name, *&user)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case action == "link" && r.Method == "POST":
+		// Start linking an account, or finish with the code the user got
+		var req struct {
+			Code string `json:"code"`
+		}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(*&r.Body).Decode(&req)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Code != "" && provider.finishLink != nil {
+			err := provider.finishLink(*&name, *&c, *&user, req.Code)
+			if os.IsNotExist(*&err) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		prompt, err := provider.startLink(*&name, *&c, *&user)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, *&prompt)
+		return
+	case action == "files" && r.Method == "GET":
+		// Entries of a folder, given by id, the top one by default
+		token, err := connectorAccessToken(r.Context(), *&name, *&user)
+		if os.IsNotExist(*&err) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		entries, err := provider.list(r.Context(), *&token, r.URL.Query().Get("folder"))
+		if err == os.ErrInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&entries)
+		return
+	case action == "import" && r.Method == "POST":
+		// Import entries listed before into a directory, as a job
+		var req struct {
+			Destination string           `json:"destination"`
+			Entries     []connectorEntry `json:"entries"`
+		}
+		err := json.NewDecoder(*&r.Body).Decode(&req)
+		if err != nil || len(req.Entries) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dest, ok := uriToPath(req.Destination)
+		if !ok || authEnabled() && !allowed(*&user, *&dest, opWrite) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if info, err := properties(*&dest); err != nil || !info.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, linked := loadConnectorToken(*&name, *&user); !linked {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		j := startJob(*&r, "import", *&name, func(ctx context.Context, j *job) (string, error) {
+			j.setState(jobRunning)
+			_, err := importEntries(*&ctx, *&j, *&name, *&user, req.Entries, *&dest, 0)
+			return pathToUri(*&dest), err
+		})
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *&j)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,84 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestConnectorTokensFile(t *testing.T) {
+	newTestCloud(t)
+	p := filepath.Join(t.TempDir(), connectorTokensFile)
+	setConnectorTokensPath(*&p)
+	defer setConnectorTokensPath("")
+
+	saveConnectorToken("gdrive", "alice", connectorToken{AccessToken: "secret-access", RefreshToken: "secret-refresh"})
+	if tok, ok := loadConnectorToken("gdrive", "alice"); !ok || tok.RefreshToken != "secret-refresh" {
+		t.Fatalf("load: %v %+v", ok, tok)
+	}
+	info, err := os.Stat(*&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("mode: %v", info.Mode().Perm())
+	}
+	for _, b := range metadata.keys(connectorsBucket, ".") {
+		t.Errorf("token in the metadata store: %s", b)
+	}
+
+	// Read back from the file
+	setConnectorTokensPath(*&p)
+	if _, ok := loadConnectorToken("gdrive", "alice"); !ok {
+		t.Error("not persisted")
+	}
+	if err := forgetConnectorToken("gdrive", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(*&p)
+	if strings.Contains(string(*&content), "secret") {
+		t.Errorf("forgotten token kept: %s", content)
+	}
+}
+
+func TestConnectorTokensMigrated(t *testing.T) {
+	p := filepath.Join(t.TempDir(), connectorTokensFile)
+	setConnectorTokensPath(*&p)
+	defer setConnectorTokensPath("")
+
+	s := &kvStore{data: map[string]map[string]string{
+		connectorsBucket: {"dropbox/bob": `{"accessToken":"a","refreshToken":"r"}`},
+	}}
+	err := moveConnectorTokens(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.data[connectorsBucket]; ok {
+		t.Errorf("bucket kept: %v", s.data)
+	}
+	if tok, ok := loadConnectorToken("dropbox", "bob"); !ok || tok.RefreshToken != "r" {
+		t.Errorf("migrated: %v %+v", ok, tok)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+//////// COPY REPORTS
+
+// A directory copy failing halfway used to leave an unknown part of the
+// tree behind. Copies asked for through the Directory API carry on past
+// the entries they can't copy and tell which ones were, the partial copy
+// being removed altogether with the rollback-on-error header.
+
+type copyFailure struct {
+	Uri   string `json:"uri"`
+	Error string `json:"error"`
+}
+
+type copyReport struct {
+	Error string `json:"error"`
+	// URIs of the copies made
+	Copied []string `json:"copied"`
+	// Entries of the source which could not be copied
+	Failed     []copyFailure `json:"failed"`
+	RolledBack bool          `json:"rolledBack"`
+}
+
+func newCopyReport() *copyReport {
+	return &copyReport{Error: "partial-copy", Copied: []string{}, Failed: []copyFailure{}}
+}
+
+func (c *copyReport) copied(dest string) {
+	if c != nil {
+		c.Copied = append(c.Copied, pathToUri(*&dest))
+	}
+}
+
+// Records the failure to copy an entry, telling whether the copy can go on.
+func (c *copyReport) failed(source string, err error) bool {
+	if c == nil {
+		return false
+	}
+	var pe *os.PathError
+	if errors.As(*&err, &pe) {
+		// Without the location on disk
+		err = pe.Err
+	}
+	c.Failed = append(c.Failed, copyFailure{pathToUri(*&source), err.Error()})
+	return true
+}
+
+// Answers a copy which failed for some entries, undoing it if asked to.
+func writeCopyReport(w http.ResponseWriter, r *http.Request, report *copyReport, dest string) {
+	if r.Header.Get("rollback-on-error") == "true" {
+		err := removeDir(*&dest)
+		if err != nil {
+			logWarn("Could not roll back the copy to", *&dest+":", err)
+		} else {
+			report.Copied, report.RolledBack = []string{}, true
+		}
+	}
+	writeJSON(w, http.StatusInternalServerError, *&report)
+}
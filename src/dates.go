@@ -0,0 +1,112 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+	// Zones are known even on systems without a database of them
+	_ "time/tzdata"
+)
+
+//////// DATE FORMATS
+
+// Dates are kept as instants, in milliseconds since the epoch, and sent as
+// such by default. Clients can ask for RFC 3339 dates instead with the
+// x-ninja-date-format header, in UTC or in the zone of the
+// x-ninja-time-zone header, such as Europe/Paris, so that they show the
+// right local times without converting them. This applies to listings,
+// change listings and file details. Compact listings always give RFC 3339
+// dates, in the zone asked for if any.
+
+const dateFormatHeader = "x-ninja-date-format"
+const timeZoneHeader = "x-ninja-time-zone"
+const dateFormatContextKey = contextKey("date-format")
+
+const (
+	dateMilliseconds = "milliseconds"
+	dateRFC3339      = "rfc3339"
+)
+
+const isoDateLayout = "2006-01-02T15:04:05.000Z07:00"
+
+type dateFormat struct {
+	rfc3339 bool
+	zone    *time.Location
+}
+
+// Format of the dates of a response, as asked for by the request.
+func requestDateFormat(r *http.Request) dateFormat {
+	if f, ok := r.Context().Value(dateFormatContextKey).(dateFormat); ok {
+		return f
+	}
+	return dateFormat{zone: time.UTC}
+}
+
+// Date in milliseconds in the format asked for.
+func (f dateFormat) format(ms string) string {
+	if !f.rfc3339 {
+		return ms
+	}
+	return f.iso(*&ms)
+}
+
+// RFC 3339 form of a date in milliseconds, empty if unknown.
+func (f dateFormat) iso(ms string) string {
+	if _, err := strconv.ParseInt(*&ms, 10, 64); err != nil {
+		return ""
+	}
+	return parseMilliseconds(*&ms).In(f.zone).Format(isoDateLayout)
+}
+
+func (f dateFormat) element(e *element) {
+	e.CreationDate = f.format(e.CreationDate)
+	e.ModifiedDate = f.format(e.ModifiedDate)
+	e.DeletedDate = f.format(e.DeletedDate)
+}
+
+//////// MIDDLEWARES
+
+func dateFormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, zone := r.Header.Get(dateFormatHeader), r.Header.Get(timeZoneHeader)
+		if format == "" && zone == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f := dateFormat{rfc3339: format == dateRFC3339, zone: time.UTC}
+		var err error
+		if zone != "" {
+			f.zone, err = time.LoadLocation(*&zone)
+		}
+		if err != nil || format != "" && format != dateMilliseconds && format != dateRFC3339 {
+			writeCORSHeaders(w)
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":        "unsupported date format or time zone",
+				"message":      errorMessage(*&r, "unsupported-date-format"),
+				"date-formats": []string{dateMilliseconds, dateRFC3339},
+			})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dateFormatContextKey, *&f)))
+	})
+}
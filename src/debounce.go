@@ -0,0 +1,112 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//////// EVENT COALESCING
+
+// Saving a file often shows up as a storm of changes, from editors writing
+// temporary files or build tools touching outputs several times. Changes
+// are held back until a path stays quiet for the debounce window, then
+// journaled as their net effect.
+
+type pendingChange struct {
+	first change
+	last  change
+	seen  time.Time
+}
+
+type debouncer struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	pending map[string]*pendingChange
+}
+
+var changeDebouncer = &debouncer{pending: make(map[string]*pendingChange)}
+
+// Records a change, journaled right away when there is no debounce window.
+func (d *debouncer) record(event string, kind string, p string) {
+	if d.window <= 0 {
+		journal.append(*&event, *&kind, *&p)
+		return
+	}
+	c := change{Event: event, Type: kind}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if pc, ok := d.pending[p]; ok {
+		pc.last = c
+		pc.seen = time.Now()
+		return
+	}
+	d.pending[p] = &pendingChange{c, c, time.Now()}
+}
+
+// Net effect of a series of changes to a path, nothing if it came and
+// went within the window.
+func coalesce(first change, last change) (changes []change) {
+	switch {
+	case first.Event == "created" && last.Event == "removed":
+		return nil
+	case first.Event == "created":
+		return []change{{Event: "created", Type: last.Type}}
+	case last.Event == "removed":
+		return []change{{Event: "removed", Type: first.Type}}
+	case first.Type != last.Type:
+		return []change{{Event: "removed", Type: first.Type}, {Event: "created", Type: last.Type}}
+	}
+	return []change{{Event: "modified", Type: last.Type}}
+}
+
+// Journals the changes of the paths which stayed quiet long enough.
+func (d *debouncer) flush() {
+	d.mutex.Lock()
+	var quiet []string
+	for p, pc := range d.pending {
+		if time.Since(pc.seen) >= d.window {
+			quiet = append(*&quiet, *&p)
+		}
+	}
+	sort.Strings(*&quiet)
+	var ready [][]change
+	for _, p := range quiet {
+		ready = append(*&ready, coalesce(d.pending[p].first, d.pending[p].last))
+		delete(d.pending, *&p)
+	}
+	d.mutex.Unlock()
+	for i, changes := range ready {
+		for _, c := range changes {
+			journal.append(c.Event, c.Type, quiet[i])
+		}
+	}
+}
+
+func startDebouncer(window time.Duration) {
+	changeDebouncer.window = window
+	go func() {
+		for range time.Tick(*&window / 4) {
+			changeDebouncer.flush()
+		}
+	}()
+}
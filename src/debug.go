@@ -0,0 +1,58 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+)
+
+//////// PROFILING
+
+// The profiles of net/http/pprof and the variables of expvar, which both
+// register themselves under /debug/ when imported. They stay hidden unless
+// enabled, and are only served to the owner since the command line they
+// show holds the owner token.
+
+func init() {
+	expvar.Publish("metrics", expvar.Func(func() interface{} { return metricsSnapshot() }))
+}
+
+//////// MIDDLEWARES
+
+func debugMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, debugPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !profilingFlag {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if authEnabled() && requestUser(*&r) != ownerUser {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
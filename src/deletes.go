@@ -0,0 +1,143 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+//////// RECURSIVE DELETES
+
+// Trees of more than bigDeleteEntries entries are deleted by a background
+// job, after a quick walk counting them so that its progress is known. A
+// canceled delete stops between two entries, what was deleted by then
+// staying deleted.
+
+const bigDeleteEntries = 1000
+
+var errEnoughEntries = errors.New("enough entries")
+
+// Counts the entries of a tree, stopping past a limit when it is positive.
+func countEntries(ctx context.Context, root string, limit int) (n int, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n++
+		if limit > 0 && n > limit {
+			return errEnoughEntries
+		}
+		return nil
+	})
+	if err == errEnoughEntries {
+		err = nil
+	}
+	return
+}
+
+// Deletes a tree depth first, reporting the progress among total entries.
+func removeTree(ctx context.Context, j *job, root string, total int) (err error) {
+	deleted := 0
+	var remove func(p string) error
+	remove = func(p string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := fsys.stat(*&p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			entries, err := fsys.readDir(*&p)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				err = remove(filepath.Join(*&p, e.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = fsys.remove(*&p)
+		if err != nil {
+			return err
+		}
+		deleted++
+		if deleted%100 == 0 && total > 0 {
+			j.setProgress(float64(deleted) / float64(total))
+		}
+		return nil
+	}
+	return remove(*&root)
+}
+
+// Deletes a tree right away when it is small, returning a nil job, or in
+// the background otherwise.
+func deleteTree(r *http.Request, p string, done func()) (j *job, err error) {
+	n, err := countEntries(r.Context(), *&p, bigDeleteEntries)
+	if err != nil {
+		return
+	}
+	if n <= bigDeleteEntries {
+		err = removeDir(*&p)
+		if err == nil {
+			done()
+		}
+		return
+	}
+	started := startJob(*&r, "delete", pathToUri(*&p), func(ctx context.Context, j *job) (string, error) {
+		j.setState(jobRunning)
+		total, err := countEntries(*&ctx, *&p, 0)
+		if err != nil {
+			return "", err
+		}
+		err = removeTree(*&ctx, *&j, *&p, *&total)
+		if err != nil {
+			return "", err
+		}
+		done()
+		return "", nil
+	})
+	return &started, nil
+}
+
+// Answers a delete done right away, failed, or left to a job.
+func writeDeleteOutcome(w http.ResponseWriter, r *http.Request, j *job, err error) {
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if j != nil {
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *j)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
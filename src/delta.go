@@ -0,0 +1,117 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//////// DELTA LISTINGS
+
+type deltaEntry struct {
+	Event string `json:"event"`
+	element
+}
+
+type deltaListing struct {
+	Cursor  int64        `json:"cursor"`
+	Changes []deltaEntry `json:"changes"`
+}
+
+func fileElement(p string, info os.FileInfo) (e element) {
+	e.Type = "file"
+	if info.IsDir() {
+		e.Type = "directory"
+	}
+	e.Name = info.Name()
+	e.Uri = pathToUri(*&p)
+	e.CreationDate = milliseconds(creationTime(*&p, *&info))
+	e.ModifiedDate = milliseconds(info.ModTime())
+	e.Size = strconv.FormatInt(info.Size(), 10)
+	e.Writable = "true" // TODO
+	return
+}
+
+func deltaMatches(e element, filter []string, returnType string) bool {
+	if e.Type == "directory" {
+		return returnType == "all" || returnType == "directories"
+	}
+	if returnType != "all" && returnType != "files" {
+		return false
+	}
+	ext := filepath.Ext(e.Name)
+	if ext != "" {
+		ext = ext[1:]
+	}
+	return cap(*&filter) == 1 || sliceContains(*&filter, *&ext)
+}
+
+// Lists the entries of a directory which were added, modified or removed
+// since a journal cursor, each path appearing once with its net change.
+func listChanges(dir string, cursor int64, recursive bool, filter []string, returnType string) (listing deltaListing, ok bool) {
+	changes, latest, ok := journal.since(*&cursor)
+	listing = deltaListing{latest, []deltaEntry{}}
+	if !ok {
+		return
+	}
+	first := make(map[string]change)
+	last := make(map[string]change)
+	var paths []string
+	for _, c := range changes {
+		p, valid := uriToPath(c.Uri)
+		if !valid || !recursive && filepath.Dir(*&p) != dir || recursive && !isUnderPrefix(*&p, *&dir) || p == dir {
+			continue
+		}
+		if _, seen := first[p]; !seen {
+			first[p] = c
+			paths = append(*&paths, *&p)
+		}
+		last[p] = c
+	}
+	for _, p := range paths {
+		created := first[p].Event == "created"
+		info, err := properties(*&p)
+		if last[p].Event == "removed" || err != nil {
+			if created {
+				// Came and went in between
+				continue
+			}
+			var e element
+			e.Type = last[p].Type
+			e.Name = filepath.Base(*&p)
+			e.Uri = last[p].Uri
+			if deltaMatches(*&e, *&filter, *&returnType) {
+				listing.Changes = append(listing.Changes, deltaEntry{"removed", e})
+			}
+			continue
+		}
+		event := "modified"
+		if created {
+			event = "created"
+		}
+		e := fileElement(*&p, *&info)
+		if deltaMatches(*&e, *&filter, *&returnType) {
+			listing.Changes = append(listing.Changes, deltaEntry{*&event, e})
+		}
+	}
+	return
+}
@@ -0,0 +1,127 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+)
+
+//////// DESKTOP INTEGRATION
+
+// Bridges the editor with the desktop of the host: reveal a path in the
+// file manager, open a file with its default application, or a terminal
+// in a directory. Windows would open on a screen nobody looks at unless
+// the client sits in front of it, so only local clients may ask.
+
+var errDesktopUnavailable = errors.New("no desktop tool available")
+
+var desktopActions = map[string]func(p string, dir bool) error{
+	"reveal":   revealPath,
+	"open":     openPath,
+	"terminal": openTerminal,
+}
+
+// Starts a program without waiting for it, file managers and terminals
+// living as long as the user keeps them open.
+func launch(dir string, name string, args ...string) (err error) {
+	p, err := exec.LookPath(*&name)
+	if err != nil {
+		return errDesktopUnavailable
+	}
+	cmd := exec.Command(*&p, args...)
+	cmd.Dir = dir
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	go cmd.Wait()
+	return
+}
+
+// Launches the first of the given programs found.
+func launchAny(dir string, names []string, args ...string) error {
+	for _, name := range names {
+		err := launch(*&dir, *&name, args...)
+		if err != errDesktopUnavailable {
+			return err
+		}
+	}
+	return errDesktopUnavailable
+}
+
+func isLocalClient(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(*&r))
+	return isUnixRequest(*&r) || ip != nil && ip.IsLoopback()
+}
+
+//////// REQUEST HANDLERS
+
+//// Desktop API
+
+// Reveal, open, or open a terminal at a path on the desktop of the host
+func desktopHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isModerator(*&r) || !isLocalClient(*&r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	action, ok := desktopActions[r.URL.Query().Get("action")]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if backendFlag != "disk" || overlayFlag != "" {
+		// Projects are not files the desktop could open
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[desktopPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	abs, err := filepath.Abs(*&p)
+	if err == nil {
+		err = action(*&abs, info.IsDir())
+	}
+	if err == errDesktopUnavailable {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
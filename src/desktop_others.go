@@ -0,0 +1,60 @@
+//go:build !darwin && !windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Desktop environments agree on xdg-open and on the file manager D-Bus
+// interface, but not on a terminal, which is looked for among the usual
+// ones unless named by $TERMINAL.
+var terminals = []string{"x-terminal-emulator", "gnome-terminal", "konsole", "xfce4-terminal", "alacritty", "kitty", "xterm"}
+
+func revealPath(p string, dir bool) error {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(*&p)}
+	err := launch("", "dbus-send", "--session", "--dest=org.freedesktop.FileManager1", "--type=method_call",
+		"/org/freedesktop/FileManager1", "org.freedesktop.FileManager1.ShowItems",
+		"array:string:"+u.String(), "string:")
+	if err == errDesktopUnavailable {
+		// Without the interface, showing the directory will do
+		err = launch("", "xdg-open", filepath.Dir(*&p))
+	}
+	return err
+}
+
+func openPath(p string, dir bool) error {
+	return launch("", "xdg-open", *&p)
+}
+
+func openTerminal(p string, dir bool) error {
+	if !dir {
+		p = filepath.Dir(*&p)
+	}
+	names := terminals
+	if t := os.Getenv("TERMINAL"); t != "" {
+		names = append([]string{t}, names...)
+	}
+	return launchAny(*&p, *&names)
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"path/filepath"
+)
+
+// Explorer selects items itself, the shell opens files with the
+// application associated with their type.
+func revealPath(p string, dir bool) error {
+	return launch("", "explorer", "/select,"+p)
+}
+
+func openPath(p string, dir bool) error {
+	if dir {
+		return launch("", "explorer", *&p)
+	}
+	return launch("", "rundll32", "url.dll,FileProtocolHandler", *&p)
+}
+
+func openTerminal(p string, dir bool) error {
+	if !dir {
+		p = filepath.Dir(*&p)
+	}
+	err := launch(*&p, "wt", "-d", *&p)
+	if err == errDesktopUnavailable {
+		err = launch(*&p, "cmd", "/c", "start", "cmd")
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// DEVICE SIMULATION
+
+// Compositions previewed as a device would get them: with its viewport,
+// the variants of the assets made for it, and over a network as slow as
+// its own. The profile is picked with the device parameter, remembered in
+// a cookie for the assets the page loads, or by the user agent of the
+// real devices it matches.
+
+const deviceCookie = "ninja_device"
+
+type deviceProfile struct {
+	// User agents the profile applies to, as a regular expression
+	Match string `json:"match"`
+	// Content of the viewport meta tag of pages, such as width=device-width
+	Viewport string `json:"viewport"`
+	// Infix of the variants of assets, "mobile" serving logo.mobile.png
+	// instead of logo.png when there is one
+	Assets string `json:"assets"`
+	// Bandwidth of the simulated network, such as 200K
+	Bandwidth string `json:"bandwidth"`
+	// Delay before every response, such as 300ms
+	Latency string `json:"latency"`
+
+	match   *regexp.Regexp
+	limiter *rateLimiter
+	latency time.Duration
+}
+
+// Names of the profiles, in the order their user agents are matched.
+var deviceNames []string
+
+var viewportMeta = regexp.MustCompile(`(?i)<meta\s[^>]*name\s*=\s*["']?viewport["']?[^>]*>`)
+var headTag = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+
+func checkDevices() (err error) {
+	for name, d := range cloudConfig.Devices {
+		if d.Match != "" {
+			d.match, err = regexp.Compile(d.Match)
+			if err != nil {
+				return fmt.Errorf("device %s: %v", name, err)
+			}
+		}
+		if d.Bandwidth != "" {
+			rate, err := parseByteSize(d.Bandwidth)
+			if err != nil {
+				return fmt.Errorf("device %s: %v", name, err)
+			}
+			// Shared by the requests of the device, like a link
+			d.limiter = newRateLimiter(*&rate)
+		}
+		if d.Latency != "" {
+			d.latency, err = time.ParseDuration(d.Latency)
+			if err != nil {
+				return fmt.Errorf("device %s: %v", name, err)
+			}
+		}
+		deviceNames = append(deviceNames, name)
+	}
+	sort.Strings(deviceNames)
+	return
+}
+
+// Profile a request is served with, if any.
+func requestDevice(r *http.Request) (d *deviceProfile, ok bool) {
+	if name := r.URL.Query().Get("device"); name != "" {
+		d, ok = cloudConfig.Devices[name]
+		return
+	}
+	if c, err := r.Cookie(deviceCookie); err == nil {
+		d, ok = cloudConfig.Devices[c.Value]
+		return
+	}
+	ua := r.UserAgent()
+	for _, name := range deviceNames {
+		d = cloudConfig.Devices[name]
+		if d.match != nil && d.match.MatchString(*&ua) {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Name of the variant of a file for the given assets infix.
+func assetVariant(name string, infix string) string {
+	ext := path.Ext(*&name)
+	return strings.TrimSuffix(*&name, *&ext) + "." + infix + ext
+}
+
+// Replaces the viewport of a page, or adds one at the start of its head.
+func injectViewport(page []byte, viewport string) []byte {
+	tag := []byte(`<meta name="viewport" content="` + html.EscapeString(*&viewport) + `">`)
+	if viewportMeta.Match(*&page) {
+		return viewportMeta.ReplaceAllLiteral(*&page, *&tag)
+	}
+	if loc := headTag.FindIndex(*&page); loc != nil {
+		return append(append(append([]byte{}, page[:loc[1]]...), tag...), page[loc[1]:]...)
+	}
+	return append(*&tag, page...)
+}
+
+// Holds pages back to change their viewport, letting anything else through.
+type viewportWriter struct {
+	http.ResponseWriter
+	viewport string
+	status   int
+	page     *bytes.Buffer
+}
+
+func (w *viewportWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		w.page = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(*&status)
+}
+
+func (w *viewportWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.page != nil {
+		return w.page.Write(*&p)
+	}
+	return w.ResponseWriter.Write(*&p)
+}
+
+func (w *viewportWriter) finish() {
+	if w.page == nil {
+		return
+	}
+	page := injectViewport(w.page.Bytes(), w.viewport)
+	w.Header().Set("Content-Length", strconv.Itoa(len(*&page)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(*&page)
+}
+
+func (w *viewportWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//////// MIDDLEWARES
+
+// Serves previews as the device of the request would get them. Locate maps
+// URL paths to the files they serve, for the variants of assets.
+func deviceMiddleware(next http.Handler, locate func(urlPath string) (string, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cloudConfig.Devices) == 0 || r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d, ok := requestDevice(*&r)
+		if name, set := r.URL.Query()["device"]; set {
+			if !ok && name[0] != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// Remembered for the assets of the page, or forgotten
+			c := &http.Cookie{Name: deviceCookie, Value: name[0], Path: basePathFlag + "/"}
+			if !ok {
+				c.MaxAge = -1
+			}
+			http.SetCookie(w, *&c)
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if d.latency > 0 {
+			timer := time.NewTimer(d.latency)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if d.Assets != "" {
+			variant := assetVariant(r.URL.Path, d.Assets)
+			if p, ok := locate(*&variant); ok && exist(*&p) {
+				r = r.Clone(r.Context())
+				r.URL.Path = variant
+				r.URL.RawPath = ""
+			}
+		}
+		if d.limiter != nil {
+			ctx := context.WithValue(r.Context(), throttleContextKey, d.limiter)
+			r = r.WithContext(*&ctx)
+			w = throttledResponseWriter{w, *&ctx}
+		}
+		if d.Viewport != "" && r.Method == "GET" {
+			vw := &viewportWriter{ResponseWriter: w, viewport: d.Viewport}
+			defer vw.finish()
+			w = vw
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Files of the static file server.
+func staticLocation(urlPath string) (string, bool) {
+	return uriToPath(*&urlPath)
+}
+
+// Files of share links.
+func sharedLocation(urlPath string) (p string, ok bool) {
+	rest := strings.TrimPrefix(*&urlPath, sharedPath)
+	i := strings.Index(*&rest, "/")
+	if i < 0 {
+		return
+	}
+	s, ok := loadShare(rest[:i])
+	if !ok {
+		return
+	}
+	return uriToPath(s.Path + "/" + rest[i+1:])
+}
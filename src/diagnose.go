@@ -0,0 +1,296 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// DIAGNOSTICS
+
+// Checks what commonly keeps the cloud from working on a machine, without
+// starting it, and prints a report to attach to support requests.
+
+const diagnosticSampleSize = 32 << 20
+
+type diagnostics struct {
+	failures int
+	warnings int
+}
+
+func (d *diagnostics) report(level string, subject string, message string) {
+	switch level {
+	case "FAIL":
+		d.failures++
+	case "WARN":
+		d.warnings++
+	}
+	fmt.Printf("%-6s %-12s %s\n", "["+level+"]", subject, message)
+}
+
+func (d *diagnostics) check(subject string, err error, success string) bool {
+	if err != nil {
+		d.report("FAIL", subject, err.Error())
+		return false
+	}
+	d.report("OK", subject, success)
+	return true
+}
+
+// Runs every check, returning whether none failed.
+func diagnose() bool {
+	d := &diagnostics{}
+	fmt.Println(APP_NAME, APP_VERSION, "diagnostics")
+	d.checkConfiguration()
+	root, ok := d.checkRoot()
+	d.checkListener()
+	if ok {
+		d.checkThroughput(*&root)
+		d.checkDiskSpace(*&root)
+		d.checkWatcher(*&root)
+	}
+	d.checkTools()
+	fmt.Printf("%d failure(s), %d warning(s)\n", d.failures, d.warnings)
+	return d.failures == 0
+}
+
+func (d *diagnostics) checkConfiguration() {
+	if configFlag != "" {
+		err := loadConfig(*&configFlag)
+		if !d.check("config", *&err, "loaded "+configFlag) {
+			return
+		}
+		if oidcEnabled() {
+			d.check("oidc", checkOIDC(), "provider "+cloudConfig.OIDC.Issuer)
+		}
+		d.check("auth", checkAuth(), "valid")
+		d.check("uploads", checkUploads(), "valid")
+		d.check("redact", checkRedaction(), "valid")
+		d.check("text", checkTextPolicies(), "valid")
+		d.check("caching", checkCaching(), "valid")
+		d.check("hosts", checkHosts(), "valid")
+	}
+	if tenantsFlag {
+		d.check("tenants", checkTenants(), "valid")
+	}
+	_, err := parseAllowedIPs(*&allowIPsFlag)
+	d.check("allow-ips", *&err, "valid")
+	_, err = parseLibraries(*&libraryFlag)
+	d.check("library", *&err, "valid")
+	_, err = withPriority(context.Background(), *&backgroundPriorityFlag)
+	d.check("priority", *&err, backgroundPriorityFlag)
+	for name, size := range map[string]string{"max-bandwidth": maxBandwidthFlag, "tenant-quota": tenantQuotaFlag} {
+		if size != "" {
+			_, err = parseByteSize(*&size)
+			d.check(*&name, *&err, *&size)
+		}
+	}
+	if diskWarningFlag != "" {
+		diskWarning, err = parseByteSize(*&diskWarningFlag)
+		d.check("disk-warning", *&err, diskWarningFlag)
+	}
+	if diskReserveFlag != "" {
+		diskReserve, err = parseByteSize(*&diskReserveFlag)
+		d.check("disk-reserve", *&err, diskReserveFlag)
+	}
+	if mirrorFlag != "" {
+		d.check("mirror", checkMirror(), mirrorFlag)
+	}
+	d.check("hashes", checkHashes(), "revisions "+revisionHashFlag+", verifications "+verifyHashFlag)
+	if inboxFlag {
+		d.check("inbox", checkInbox(), "valid")
+	}
+	if _, ok := backends[backendFlag]; !ok {
+		d.report("FAIL", "backend", "unknown storage backend "+backendFlag)
+	} else if backendFlag != "disk" {
+		d.report("WARN", "backend", backendFlag+", disk checks are skipped")
+	}
+	if !authEnabled() && interfaceFlag != "" && unixSocketFlag == "" {
+		if err := checkBindSafety(*&interfaceFlag); err != nil {
+			d.report("FAIL", "auth", err.Error())
+		}
+	}
+}
+
+// Checks that the projects directory can be created, written and read.
+func (d *diagnostics) checkRoot() (root string, ok bool) {
+	if backendFlag != "disk" {
+		return
+	}
+	root, err := filepath.Abs(filepath.Join(rootFlag, projectsDir))
+	if err == nil {
+		err = os.MkdirAll(*&root, 0777)
+	}
+	if !d.check("root", *&err, root) {
+		return
+	}
+	probe := filepath.Join(*&root, hiddenPrefix+"diagnostics")
+	err = ioutil.WriteFile(*&probe, []byte(APP_NAME), 0666)
+	if err == nil {
+		var content []byte
+		content, err = ioutil.ReadFile(*&probe)
+		if err == nil && string(*&content) != APP_NAME {
+			err = errors.New("read back different content")
+		}
+		if rerr := os.Remove(*&probe); err == nil {
+			err = rerr
+		}
+	}
+	return root, d.check("permissions", *&err, "root is readable and writable")
+}
+
+// Checks that the cloud could listen where it is told to.
+func (d *diagnostics) checkListener() {
+	if os.Getenv("LISTEN_FDS") != "" {
+		d.report("OK", "listener", "socket activation, LISTEN_FDS="+os.Getenv("LISTEN_FDS"))
+		return
+	}
+	if unixSocketFlag != "" {
+		dir := filepath.Dir(*&unixSocketFlag)
+		_, err := os.Stat(*&dir)
+		d.check("listener", *&err, "unix socket "+unixSocketFlag)
+		return
+	}
+	address := net.JoinHostPort(interfaceFlag, portFlag)
+	l, err := net.Listen("tcp", *&address)
+	if err != nil {
+		d.report("FAIL", "listener", address+" is unavailable: "+err.Error())
+		return
+	}
+	l.Close()
+	d.report("OK", "listener", address+" is available")
+}
+
+// Measures how fast a sample file is written, synced and read back.
+func (d *diagnostics) checkThroughput(root string) {
+	probe := filepath.Join(*&root, hiddenPrefix+"throughput")
+	defer os.Remove(*&probe)
+	sample := make([]byte, diagnosticSampleSize)
+	start := time.Now()
+	f, err := os.Create(*&probe)
+	if err != nil {
+		d.report("FAIL", "throughput", err.Error())
+		return
+	}
+	_, err = f.Write(*&sample)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		d.report("FAIL", "throughput", err.Error())
+		return
+	}
+	written := time.Since(*&start)
+	start = time.Now()
+	_, err = ioutil.ReadFile(*&probe)
+	if err != nil {
+		d.report("FAIL", "throughput", err.Error())
+		return
+	}
+	read := time.Since(*&start)
+	rate := func(t time.Duration) string {
+		return strconv.FormatFloat(float64(diagnosticSampleSize)/(1<<20)/t.Seconds(), 'f', 1, 64) + " MB/s"
+	}
+	d.report("OK", "throughput", "write "+rate(*&written)+", read "+rate(*&read))
+}
+
+func (d *diagnostics) checkDiskSpace(root string) {
+	free, err := diskFree(*&root)
+	if err != nil {
+		d.report("WARN", "disk space", err.Error())
+		return
+	}
+	if diskWarning > 0 && free < diskWarning {
+		d.report("WARN", "disk space", formatByteSize(*&free)+" free, under -disk-warning")
+		return
+	}
+	d.report("OK", "disk space", formatByteSize(*&free)+" free")
+}
+
+// The watcher polls the tree: a scan taking about as long as the interval
+// means changes are always late. Inotify limits are reported for the
+// editors and tools which watch the same tree.
+func (d *diagnostics) checkWatcher(root string) {
+	err := os.Chdir(*&root)
+	if err != nil {
+		d.report("WARN", "watcher", err.Error())
+		return
+	}
+	ioSlots = make(chan struct{})
+	start := time.Now()
+	states, err := scanTree(context.Background(), ".")
+	if err != nil {
+		d.report("WARN", "watcher", err.Error())
+		return
+	}
+	scan := time.Since(*&start)
+	dirs := 0
+	for _, s := range states {
+		if s.Dir {
+			dirs++
+		}
+	}
+	message := strconv.Itoa(len(*&states)) + " entries scanned in " + scan.Round(time.Millisecond).String()
+	switch {
+	case watchIntervalFlag <= 0:
+		d.report("WARN", "watcher", "disabled, "+message)
+	case scan*2 > watchIntervalFlag:
+		d.report("WARN", "watcher", message+", close to -watch-interval "+watchIntervalFlag.String())
+	default:
+		d.report("OK", "watcher", *&message)
+	}
+	content, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(*&content)))
+	if err != nil {
+		return
+	}
+	if dirs > limit {
+		d.report("WARN", "inotify", strconv.Itoa(*&dirs)+" directories exceed max_user_watches "+strconv.Itoa(*&limit))
+	} else {
+		d.report("OK", "inotify", "max_user_watches "+strconv.Itoa(*&limit)+" for "+strconv.Itoa(*&dirs)+" directories")
+	}
+}
+
+// Checks the external programs some features run.
+func (d *diagnostics) checkTools() {
+	for name, tool := range map[string]string{"chrome": chromeFlag, "ffmpeg": ffmpegFlag} {
+		if tool == "" {
+			continue
+		}
+		p, err := exec.LookPath(*&tool)
+		d.check(*&name, *&err, *&p)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// DIRECTORY METADATA
+
+// Asset folders document themselves with a folder.json file giving their
+// title and description, or with a README whose first heading is taken as
+// title and first paragraph as description. Listings give both for every
+// directory, parsed once per version of the file.
+
+var directoryMetadataFiles = []string{"folder.json", "README.md", "readme.md", "README"}
+
+// Longest description given, the rest being cut
+const descriptionMaxLength = 300
+
+type parsedMetadata struct {
+	file        string
+	modTime     time.Time
+	size        int64
+	title       string
+	description string
+}
+
+var metadataFiles = struct {
+	sync.Mutex
+	byDir map[string]parsedMetadata
+}{byDir: make(map[string]parsedMetadata)}
+
+func parseFolderJSON(content []byte) (title string, description string) {
+	var f struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	json.Unmarshal(*&content, &f)
+	return f.Title, f.Description
+}
+
+func parseReadme(content []byte) (title string, description string) {
+	var paragraph []string
+	s := bufio.NewScanner(bytes.NewReader(*&content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case title == "" && len(*&paragraph) == 0 && strings.HasPrefix(*&line, "#"):
+			title = strings.TrimSpace(strings.TrimLeft(*&line, "#"))
+		case line == "" && len(*&paragraph) > 0:
+			return title, strings.Join(*&paragraph, " ")
+		case line != "" && !strings.HasPrefix(*&line, "#"):
+			paragraph = append(*&paragraph, *&line)
+		}
+	}
+	return title, strings.Join(*&paragraph, " ")
+}
+
+// Title and description of a directory, from its metadata file if any.
+func directoryMetadata(dir string) (title string, description string) {
+	for _, name := range directoryMetadataFiles {
+		p := filepath.Join(*&dir, *&name)
+		info, err := properties(*&p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		metadataFiles.Lock()
+		m, ok := metadataFiles.byDir[dir]
+		metadataFiles.Unlock()
+		if ok && m.file == name && m.modTime.Equal(info.ModTime()) && m.size == info.Size() {
+			return m.title, m.description
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			return
+		}
+		if name == "folder.json" {
+			title, description = parseFolderJSON(*&content)
+		} else {
+			title, description = parseReadme(*&content)
+		}
+		if r := []rune(*&description); len(*&r) > descriptionMaxLength {
+			description = strings.TrimSpace(string(r[:descriptionMaxLength])) + "…"
+		}
+		metadataFiles.Lock()
+		metadataFiles.byDir[dir] = parsedMetadata{name, info.ModTime(), info.Size(), title, description}
+		metadataFiles.Unlock()
+		return
+	}
+	return
+}
+
+func evictDirectoryMetadata() {
+	metadataFiles.Lock()
+	defer metadataFiles.Unlock()
+	metadataFiles.byDir = make(map[string]parsedMetadata)
+}
@@ -0,0 +1,125 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+//////// DISK SPACE
+
+// Running out of space halfway through a large upload leaves a truncated
+// file in the project. Such writes are refused upfront when the disk can't
+// take them, and their space may be reserved before writing anything.
+
+// Size from which uploads are checked against the free space.
+const largeWrite = 1 << 20
+
+var diskReserve int64
+
+// Space free on the disk holding a path, or its closest existing parent.
+func freeSpace(p string) (free int64, err error) {
+	dp, ok := diskPath(*&p)
+	if !ok {
+		return 0, os.ErrInvalid
+	}
+	v, err := onDisk("statfs", *&p, func() (interface{}, error) {
+		for dp := dp; ; {
+			free, err := diskFree(*&dp)
+			parent := filepath.Dir(*&dp)
+			if err == nil || parent == dp {
+				return free, err
+			}
+			dp = parent
+		}
+	})
+	free, _ = v.(int64)
+	return
+}
+
+// Whether an error comes from a disk being full.
+func isDiskFull(err error) bool {
+	if errors.Is(*&err, syscall.ENOSPC) {
+		return true
+	}
+	var errno syscall.Errno
+	// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL on Windows
+	return errors.As(*&err, &errno) && runtime.GOOS == "windows" && (errno == 39 || errno == 112)
+}
+
+// Reserves the space of a file about to be written, so that a full disk
+// fails the write before any of it.
+func preallocate(p string, size int64) error {
+	if !preallocateFlag || size < largeWrite {
+		return nil
+	}
+	dp, ok := diskPath(*&p)
+	if !ok {
+		return nil
+	}
+	_, err := onDisk("fallocate", *&p, func() (interface{}, error) {
+		f, err := os.OpenFile(*&dp, os.O_WRONLY, 0)
+		if err != nil {
+			// Reported by the write itself
+			return nil, nil
+		}
+		defer f.Close()
+		return nil, fallocate(*&f, *&size)
+	})
+	return err
+}
+
+func writeInsufficientStorage(w http.ResponseWriter, r *http.Request, needed int64, free int64) {
+	writeJSON(w, http.StatusInsufficientStorage, map[string]interface{}{
+		"error":   "insufficient-storage",
+		"message": errorMessage(*&r, "insufficient-storage"),
+		"needed":  needed,
+		"free":    free,
+	})
+}
+
+//////// MIDDLEWARES
+
+func diskSpaceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" || r.ContentLength < largeWrite {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := requestPath(*&r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		free, err := freeSpace(*&p)
+		if err == nil && free-diskReserve < r.ContentLength {
+			logWarn("Refused writing", r.ContentLength, "bytes to", *&p+", with", *&free, "free on disk")
+			writeCORSHeaders(w)
+			writeInsufficientStorage(w, *&r, r.ContentLength, *&free)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
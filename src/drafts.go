@@ -0,0 +1,161 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+//////// DRAFTS
+
+// Unsaved document states pushed by the editor.
+var drafts = revisionStore{hiddenPrefix + "drafts", 20}
+
+//////// REQUEST HANDLERS
+
+//// Drafts API
+
+func draftsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[draftsPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id := r.URL.Query().Get("draft")
+
+	switch r.Method {
+	case "GET":
+		revisionsGet(w, drafts, *&p, *&id)
+		return
+	case "PUT":
+		// Push the unsaved state of a document
+		if p == "." {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d, err := drafts.save(*&p, *&content)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, *&d)
+		return
+	case "POST":
+		// Restore a draft over its document
+		if !revisionsRestore(w, drafts, *&p, *&id) {
+			return
+		}
+		err := drafts.discard(*&p)
+		if err != nil {
+			log.Println(*&err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "DELETE":
+		// Discard a draft, or all the drafts of a document once it is saved
+		if id != "" {
+			f, ok := drafts.file(*&p, *&id)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			err := removeFile(*&f)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		} else if p == "." {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else {
+			err := drafts.discard(*&p)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// Lists the documents having revisions, the revisions of a document, or
+// returns the content of one of them.
+func revisionsGet(w http.ResponseWriter, s revisionStore, p string, id string) {
+	if p == "." {
+		docs, err := s.documents()
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&docs)
+		return
+	}
+	if id == "" {
+		revisions, err := s.list(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&revisions)
+		return
+	}
+	f, ok := s.file(*&p, *&id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	content, err := readFile(*&f)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(*&content)
+}
+
+func revisionsRestore(w http.ResponseWriter, s revisionStore, p string, id string) (ok bool) {
+	err := s.restore(*&p, *&id)
+	if err == os.ErrNotExist {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//////// PROJECT DUPLICATION
+
+// Projects are duplicated as they are stored, sealed contents and hidden
+// files included, sharing the extents of their files with the original
+// where the filesystem can. Hard links are never used, since saves rewrite
+// files in place. The manifests of the copy are then renamed after it.
+
+// Manifests and the field naming their project
+var projectManifests = []struct {
+	file  string
+	field string
+}{
+	{"folder.json", "title"},
+	{"package.json", "name"},
+}
+
+type duplication struct {
+	Uri    string `json:"uri"`
+	Files  int    `json:"files"`
+	Cloned int    `json:"cloned"`
+}
+
+// Storage holding projects as they are on disk.
+func rawStorage() storage {
+	if e, ok := fsys.(encryptedStorage); ok {
+		return e.storage
+	}
+	return fsys
+}
+
+// Path of a file on disk, when the projects are stored there directly.
+func diskPath(name string) (p string, ok bool) {
+	s := rawStorage()
+	// Through the layers which only watch or cache the calls
+	for unwrapped := false; !unwrapped; {
+		switch l := s.(type) {
+		case networkStorage:
+			s = l.storage
+		case watchedStorage:
+			s = l.storage
+		case tracedStorage:
+			s = l.storage
+		case zipStorage:
+			if l.inArchive(*&name) {
+				return
+			}
+			s = l.storage
+		default:
+			unwrapped = true
+		}
+	}
+	d, ok := s.(diskStorage)
+	if !ok {
+		return
+	}
+	return d.path(*&name), true
+}
+
+// Path of a file on disk, for copies made there directly. Those could take
+// longer than the deadline of the watchdog without hanging, and so the
+// watched storage gives none, copies then going through it.
+func copyDiskPath(name string) (p string, ok bool) {
+	if fsTimeoutFlag > 0 {
+		return
+	}
+	return diskPath(*&name)
+}
+
+// Clones a file on disk, telling whether its extents could be shared.
+func cloneFile(source string, dest string, mode os.FileMode) (shared bool, err error) {
+	sp, ok := copyDiskPath(*&source)
+	if !ok {
+		return false, copyRaw(*&source, *&dest, *&mode)
+	}
+	dp, _ := copyDiskPath(*&dest)
+	// Written behind the back of the metadata cache
+	defer invalidateMetadata(*&dest, false)
+	sf, err := os.Open(*&sp)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(*&dp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, *&mode)
+	if err != nil {
+		return
+	}
+	if reflink(*&sf, *&df) == nil {
+		return true, df.Close()
+	}
+	_, err = io.Copy(*&df, *&sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+func copyRaw(source string, dest string, mode os.FileMode) (err error) {
+	s := rawStorage()
+	sf, err := s.open(*&source)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	df, err := s.createNew(*&dest, *&mode)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(*&df, *&sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+func duplicateProject(ctx context.Context, source string, dest string) (d duplication, err error) {
+	if exist(*&dest) {
+		return d, os.ErrExist
+	}
+	raw := rawStorage()
+	err = walk(*&source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		err = ioPause(*&ctx)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*&source, *&p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(*&dest, *&rel)
+		if info.IsDir() {
+			return raw.mkdirAll(*&target, info.Mode())
+		}
+		shared, err := cloneFile(*&p, *&target, info.Mode())
+		if err != nil {
+			return err
+		}
+		d.Files++
+		if shared {
+			d.Cloned++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	duplicateEncryption(*&source, *&dest)
+	copyMetadata(*&source, *&dest)
+	recordCreation(*&dest)
+	renameManifests(*&dest)
+	d.Uri = pathToUri(*&dest)
+	return
+}
+
+// Names the manifests of a project after it, leaving the rest of them as
+// they were written.
+func renameManifests(project string) {
+	name, _ := json.Marshal(filepath.Base(*&project))
+	for _, m := range projectManifests {
+		p := filepath.Join(*&project, m.file)
+		content, err := readFile(*&p)
+		if err != nil {
+			continue
+		}
+		start, end, ok := jsonFieldValue(*&content, m.field)
+		if !ok {
+			continue
+		}
+		renamed := append(append(append([]byte{}, content[:start]...), *&name...), content[end:]...)
+		err = saveFile(*&p, *&renamed)
+		if err != nil {
+			logWarn("Could not rename the manifest of", project+":", err)
+		}
+	}
+}
+
+// Offsets of the value of a top-level string field of a JSON object.
+func jsonFieldValue(content []byte, field string) (start int, end int, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(*&content))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return
+		}
+		offset := dec.InputOffset()
+		var value json.RawMessage
+		if dec.Decode(&value) != nil {
+			return
+		}
+		if key == field && len(value) > 0 && value[0] == '"' {
+			end = int(dec.InputOffset())
+			// The value follows the colon and any space after the key
+			start = int(offset) + bytes.IndexByte(content[offset:end], '"')
+			return start, end, true
+		}
+	}
+	return
+}
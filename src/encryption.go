@@ -0,0 +1,683 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//////// ENCRYPTION AT REST
+
+// Projects may keep the content of their files encrypted with AES-256-GCM,
+// under a key derived from a passphrase with PBKDF2. Names, sizes and dates
+// stay readable so that listings work while a project is locked, but
+// contents are only read and written once it has been unlocked with its
+// passphrase, which is never stored.
+//
+// Files are sealed in chunks, each nonce made of a random prefix of the file
+// and the index of the chunk, the last one being authenticated as such so
+// that truncations are detected. The revisions kept in the hidden stores
+// at the root, under the path of their project, are sealed too. Backups and
+// archives hold the files of encrypted projects as they are stored, sealed,
+// along with the parameters of their project.
+
+const encryptionFile = hiddenPrefix + "encryption.json"
+const encryptionMagic = "NJE1"
+const encryptionHeaderSize = len(encryptionMagic) + 8
+const encryptionChunkSize = 64 << 10
+const encryptionIterations = 600000
+
+// Sealed in the parameters, telling wrong passphrases apart
+const encryptionCheck = "ninja"
+
+var errProjectLocked = errors.New("project is locked")
+var errNotSealed = errors.New("not an encrypted file")
+
+type encryptionParams struct {
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Check      string `json:"check"`
+}
+
+// Encryption state of the projects looked at, and keys of those unlocked.
+var encryption = struct {
+	sync.Mutex
+	encrypted map[string]bool
+	keys      map[string]cipher.AEAD
+}{encrypted: make(map[string]bool), keys: make(map[string]cipher.AEAD)}
+
+// Project the content of a path belongs to, including the revisions of its
+// documents kept in hidden stores.
+func encryptionProject(name string) string {
+	parts := strings.SplitN(filepath.ToSlash(filepath.Clean(*&name)), "/", 3)
+	if strings.HasPrefix(parts[0], hiddenPrefix) && len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+func deriveKey(passphrase string, params encryptionParams) (aead cipher.AEAD, err error) {
+	salt, err := base64.StdEncoding.DecodeString(params.Salt)
+	if err != nil {
+		return
+	}
+	key, err := pbkdf2.Key(sha256.New, *&passphrase, *&salt, params.Iterations, 32)
+	if err != nil {
+		return
+	}
+	block, err := aes.NewCipher(*&key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(*&block)
+}
+
+//// Storage
+
+// Seals and opens the files of encrypted projects on their way to and from
+// the underlying storage.
+type encryptedStorage struct {
+	storage
+}
+
+func (e encryptedStorage) readParams(project string) (params encryptionParams, err error) {
+	f, err := e.storage.open(filepath.Join(*&project, encryptionFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = json.NewDecoder(*&f).Decode(&params)
+	return
+}
+
+func (e encryptedStorage) isEncrypted(project string) bool {
+	encryption.Lock()
+	encrypted, known := encryption.encrypted[project]
+	encryption.Unlock()
+	if !known {
+		_, err := e.storage.stat(filepath.Join(*&project, encryptionFile))
+		encrypted = err == nil
+		encryption.Lock()
+		encryption.encrypted[project] = encrypted
+		encryption.Unlock()
+	}
+	return encrypted
+}
+
+// Whether the content of a file is sealed.
+func (e encryptedStorage) sealed(name string) bool {
+	return !strings.HasPrefix(filepath.Base(*&name), hiddenPrefix) && e.isEncrypted(encryptionProject(*&name))
+}
+
+// Key of the project of a sealed file.
+func (e encryptedStorage) key(name string) (aead cipher.AEAD, err error) {
+	encryption.Lock()
+	defer encryption.Unlock()
+	aead, ok := encryption.keys[encryptionProject(*&name)]
+	if !ok {
+		err = &os.PathError{Op: "open", Path: name, Err: errProjectLocked}
+	}
+	return
+}
+
+// Forgets what is known about the projects under a path being removed.
+func (e encryptedStorage) forget(name string) {
+	if strings.Contains(filepath.ToSlash(filepath.Clean(*&name)), "/") {
+		return
+	}
+	encryption.Lock()
+	defer encryption.Unlock()
+	delete(encryption.encrypted, filepath.Clean(*&name))
+	delete(encryption.keys, filepath.Clean(*&name))
+}
+
+type plainSizeInfo struct {
+	os.FileInfo
+}
+
+// Size of the content sealed in a file of the given size.
+func (i plainSizeInfo) Size() int64 {
+	body := i.FileInfo.Size() - int64(encryptionHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	sealedChunk := int64(encryptionChunkSize + 16)
+	size := body/sealedChunk*encryptionChunkSize + body%sealedChunk - 16
+	if body%sealedChunk == 0 {
+		size += 16
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size
+}
+
+func (e encryptedStorage) stat(name string) (info os.FileInfo, err error) {
+	info, err = e.storage.stat(*&name)
+	if err == nil && !info.IsDir() && e.sealed(*&name) {
+		info = plainSizeInfo{*&info}
+	}
+	return
+}
+
+func (e encryptedStorage) readDir(name string) (list []os.FileInfo, err error) {
+	list, err = e.storage.readDir(*&name)
+	for i, info := range list {
+		if !info.IsDir() && e.sealed(filepath.Join(*&name, info.Name())) {
+			list[i] = plainSizeInfo{*&info}
+		}
+	}
+	return
+}
+
+func (e encryptedStorage) open(name string) (io.ReadCloser, error) {
+	if !e.sealed(*&name) {
+		return e.storage.open(*&name)
+	}
+	aead, err := e.key(*&name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := e.storage.open(*&name)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{f: f, r: bufio.NewReaderSize(*&f, encryptionChunkSize+16+1), aead: aead}, nil
+}
+
+func (e encryptedStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return e.createWith(*&name, *&perm, e.storage.create)
+}
+
+func (e encryptedStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return e.createWith(*&name, *&perm, e.storage.createNew)
+}
+
+func (e encryptedStorage) createWith(name string, perm os.FileMode, create func(string, os.FileMode) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	if !e.sealed(*&name) {
+		return create(*&name, *&perm)
+	}
+	aead, err := e.key(*&name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := create(*&name, *&perm)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkWriter(*&f, *&aead), nil
+}
+
+func (e encryptedStorage) remove(name string) error {
+	e.forget(*&name)
+	return e.storage.remove(*&name)
+}
+
+func (e encryptedStorage) removeAll(name string) error {
+	e.forget(*&name)
+	return e.storage.removeAll(*&name)
+}
+
+// Moves between projects sealed differently are refused like those across
+// devices, so that files get copied through the layer instead.
+func (e encryptedStorage) rename(source string, dest string) error {
+	from, to := encryptionProject(*&source), encryptionProject(*&dest)
+	if from != to && (e.isEncrypted(*&from) || e.isEncrypted(*&to)) {
+		info, err := e.storage.stat(*&source)
+		if err == nil && !info.IsDir() {
+			return &os.LinkError{Op: "rename", Old: source, New: dest, Err: syscall.EXDEV}
+		}
+		return &os.LinkError{Op: "rename", Old: source, New: dest, Err: os.ErrPermission}
+	}
+	e.forget(*&source)
+	e.forget(*&dest)
+	return e.storage.rename(*&source, *&dest)
+}
+
+//// Sealing
+
+type chunkWriter struct {
+	f      io.WriteCloser
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buffer []byte
+	err    error
+}
+
+func newChunkWriter(f io.WriteCloser, aead cipher.AEAD) *chunkWriter {
+	w := &chunkWriter{f: f, aead: aead, prefix: make([]byte, 8)}
+	rand.Read(w.prefix)
+	_, w.err = f.Write(append([]byte(encryptionMagic), w.prefix...))
+	return w
+}
+
+func chunkNonce(prefix []byte, index uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, *&prefix...), *&index)
+}
+
+// Additional data of the chunks, telling the last one
+var chunkLast, chunkMore = []byte{1}, []byte{0}
+
+func (w *chunkWriter) seal(chunk []byte, last bool) {
+	ad := chunkMore
+	if last {
+		ad = chunkLast
+	}
+	_, w.err = w.f.Write(w.aead.Seal(nil, chunkNonce(w.prefix, w.index), *&chunk, *&ad))
+	w.index++
+}
+
+func (w *chunkWriter) Write(p []byte) (n int, err error) {
+	w.buffer = append(w.buffer, *&p...)
+	// A full chunk is only sealed once more follows, the last one being
+	// sealed on closing
+	for len(w.buffer) > encryptionChunkSize && w.err == nil {
+		w.seal(w.buffer[:encryptionChunkSize], false)
+		w.buffer = w.buffer[encryptionChunkSize:]
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func (w *chunkWriter) Close() error {
+	if w.err == nil {
+		w.seal(w.buffer, true)
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+type chunkReader struct {
+	f       io.Closer
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	index   uint32
+	pending []byte
+	done    bool
+}
+
+func (c *chunkReader) Read(p []byte) (n int, err error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		err = c.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n = copy(*&p, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+func (c *chunkReader) next() (err error) {
+	if c.prefix == nil {
+		header := make([]byte, encryptionHeaderSize)
+		_, err = io.ReadFull(c.r, *&header)
+		if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+			return errNotSealed
+		}
+		c.prefix = header[len(encryptionMagic):]
+	}
+	chunk := make([]byte, encryptionChunkSize+16)
+	n, err := io.ReadFull(c.r, *&chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+		c.done = true
+	} else if err != nil {
+		return
+	} else if _, perr := c.r.Peek(1); perr == io.EOF {
+		c.done = true
+	}
+	ad := chunkMore
+	if c.done {
+		ad = chunkLast
+	}
+	c.pending, err = c.aead.Open(chunk[:0], chunkNonce(c.prefix, c.index), chunk[:n], *&ad)
+	c.index++
+	return
+}
+
+func (c *chunkReader) Close() error {
+	return c.f.Close()
+}
+
+//// Projects
+
+func encryptedFsys() (e encryptedStorage, ok bool) {
+	e, ok = fsys.(encryptedStorage)
+	return
+}
+
+// Whether two files are stored alike, so that one can be copied as it is
+// into the other.
+func sameSealing(a string, b string) bool {
+	e, ok := encryptedFsys()
+	if !ok {
+		return true
+	}
+	sealedA, sealedB := e.sealed(*&a), e.sealed(*&b)
+	return !sealedA && !sealedB || sealedA && sealedB && encryptionProject(*&a) == encryptionProject(*&b)
+}
+
+func projectLocked(p string) bool {
+	e, ok := encryptedFsys()
+	if !ok || !e.sealed(*&p) {
+		return false
+	}
+	_, err := e.key(*&p)
+	return err != nil
+}
+
+func unlockProject(project string, passphrase string) (err error) {
+	e, _ := encryptedFsys()
+	params, err := e.readParams(*&project)
+	if err != nil {
+		return
+	}
+	aead, err := deriveKey(*&passphrase, *&params)
+	if err != nil {
+		return
+	}
+	check, err := base64.StdEncoding.DecodeString(params.Check)
+	if err != nil || len(check) < aead.NonceSize() {
+		return errNotSealed
+	}
+	plain, err := aead.Open(nil, check[:aead.NonceSize()], check[aead.NonceSize():], nil)
+	if err != nil || string(plain) != encryptionCheck {
+		return os.ErrPermission
+	}
+	encryption.Lock()
+	encryption.keys[project] = aead
+	encryption.Unlock()
+	return
+}
+
+func projectUnlocked(project string) bool {
+	encryption.Lock()
+	defer encryption.Unlock()
+	_, ok := encryption.keys[project]
+	return ok
+}
+
+// Lets a copy of a project be read like it, unlocked if it is.
+func duplicateEncryption(source string, dest string) {
+	encryption.Lock()
+	defer encryption.Unlock()
+	delete(encryption.encrypted, *&dest)
+	if key, ok := encryption.keys[source]; ok {
+		encryption.keys[dest] = key
+	}
+}
+
+func lockProject(project string) {
+	encryption.Lock()
+	delete(encryption.keys, *&project)
+	encryption.Unlock()
+}
+
+// Files of a project, and of the revisions of its documents.
+func projectContents(project string) (files []string, err error) {
+	roots := []string{project}
+	for _, s := range []revisionStore{autosaves, drafts} {
+		roots = append(roots, filepath.Join(s.dir, *&project))
+	}
+	for _, root := range roots {
+		err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+			if os.IsNotExist(*&err) && p == root {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !info.IsDir() && !strings.HasPrefix(info.Name(), hiddenPrefix) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Rewrites files sealed with a key into files sealed with another, either
+// nil for plain files, skipping those already rewritten so that interrupted
+// runs can be resumed.
+func resealFiles(files []string, from cipher.AEAD, to cipher.AEAD) (err error) {
+	e, _ := encryptedFsys()
+	for _, p := range files {
+		var f io.ReadCloser
+		f, err = e.storage.open(*&p)
+		if err != nil {
+			return
+		}
+		br := bufio.NewReader(*&f)
+		magic, _ := br.Peek(len(encryptionMagic))
+		if (string(magic) == encryptionMagic) == (to != nil) {
+			// Already resealed by an interrupted run
+			f.Close()
+			continue
+		}
+		var r io.Reader = br
+		if from != nil {
+			r = &chunkReader{f: f, r: br, aead: from}
+		}
+		tmp := filepath.Join(filepath.Dir(*&p), hiddenPrefix+"reseal-"+filepath.Base(*&p))
+		var w io.WriteCloser
+		w, err = e.storage.create(*&tmp, 0777)
+		if err == nil {
+			if to != nil {
+				w = newChunkWriter(*&w, *&to)
+			}
+			_, err = io.Copy(*&w, *&r)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		f.Close()
+		if err == nil {
+			err = e.storage.rename(*&tmp, *&p)
+		}
+		if err != nil {
+			e.storage.remove(*&tmp)
+			return
+		}
+	}
+	return
+}
+
+func encryptProject(project string, passphrase string) (err error) {
+	e, _ := encryptedFsys()
+	if e.isEncrypted(*&project) {
+		// Resumed if interrupted
+		err = unlockProject(*&project, *&passphrase)
+		if err != nil {
+			return
+		}
+		key, _ := e.key(*&project)
+		files, err := projectContents(*&project)
+		if err != nil {
+			return err
+		}
+		return resealFiles(*&files, nil, *&key)
+	}
+	files, err := projectContents(*&project)
+	if err != nil {
+		return
+	}
+	salt := make([]byte, 16)
+	rand.Read(*&salt)
+	params := encryptionParams{Salt: base64.StdEncoding.EncodeToString(*&salt), Iterations: encryptionIterations}
+	aead, err := deriveKey(*&passphrase, *&params)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(*&nonce)
+	params.Check = base64.StdEncoding.EncodeToString(aead.Seal(*&nonce, *&nonce, []byte(encryptionCheck), nil))
+	content, err := json.Marshal(*&params)
+	if err != nil {
+		return
+	}
+	err = saveFile(filepath.Join(*&project, encryptionFile), *&content)
+	if err != nil {
+		return
+	}
+	encryption.Lock()
+	encryption.encrypted[project] = true
+	encryption.keys[project] = aead
+	encryption.Unlock()
+	return resealFiles(*&files, nil, *&aead)
+}
+
+func decryptProject(project string, passphrase string) (err error) {
+	e, _ := encryptedFsys()
+	if !e.isEncrypted(*&project) {
+		return os.ErrNotExist
+	}
+	err = unlockProject(*&project, *&passphrase)
+	if err != nil {
+		return
+	}
+	key, _ := e.key(*&project)
+	files, err := projectContents(*&project)
+	if err != nil {
+		return
+	}
+	err = resealFiles(*&files, *&key, nil)
+	if err != nil {
+		return
+	}
+	lockProject(*&project)
+	encryption.Lock()
+	encryption.encrypted[project] = false
+	encryption.Unlock()
+	return removeFile(filepath.Join(*&project, encryptionFile))
+}
+
+//////// REQUEST HANDLERS
+
+//// Encryption API
+
+// Tell whether a project is encrypted and unlocked, encrypt, decrypt,
+// unlock or lock it
+func encryptionHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[encryptionPathLen:])
+	if !ok || p == "." || strings.Contains(filepath.ToSlash(*&p), "/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	e, ok := encryptedFsys()
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]bool{
+			"encrypted": e.isEncrypted(*&p),
+			"unlocked":  e.isEncrypted(*&p) && projectUnlocked(*&p),
+		})
+		return
+	case "POST":
+		var params struct {
+			Passphrase string `json:"passphrase"`
+			Operation  string `json:"operation"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&params)
+		if err != nil || params.Passphrase == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch params.Operation {
+		case "", "unlock":
+			if !e.isEncrypted(*&p) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			err = unlockProject(*&p, params.Passphrase)
+		case "encrypt":
+			err = encryptProject(*&p, params.Passphrase)
+		case "decrypt":
+			err = decryptProject(*&p, params.Passphrase)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err == os.ErrPermission {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		} else if err == os.ErrExist || err == os.ErrNotExist {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "DELETE":
+		lockProject(*&p)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+func writeProjectLocked(w http.ResponseWriter, r *http.Request, p string) {
+	writeJSON(w, http.StatusLocked, map[string]string{
+		"error":   "project-locked",
+		"message": errorMessage(*&r, "project-locked"),
+		"project": pathToUri(encryptionProject(*&p)),
+	})
+}
@@ -0,0 +1,132 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Contents of the files of an archive, by name.
+func zipContents(t *testing.T, p string) map[string]string {
+	t.Helper()
+	z, closer, err := openZip(*&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	contents := make(map[string]string)
+	for _, f := range z.File {
+		content, err := readZipFile(*&f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(*&content)
+	}
+	return contents
+}
+
+func TestEncryptedArchivesSealed(t *testing.T) {
+	newTestCloudOver(t, encryptedStorage{newMemStorage()})
+	encryption.Lock()
+	encryption.encrypted, encryption.keys = make(map[string]bool), make(map[string]cipher.AEAD)
+	encryption.Unlock()
+	createDir("p/sub")
+	saveFile("p/a.txt", []byte("secret text"))
+	saveFile("p/sub/b.txt", []byte("more secret text"))
+	createDir("plain")
+	saveFile("plain/c.txt", []byte("plain text"))
+	err := encryptProject("p", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := func(contents map[string]string, name string) {
+		t.Helper()
+		content, ok := contents[name]
+		if !ok || !strings.HasPrefix(content, encryptionMagic) || strings.Contains(content, "secret") {
+			t.Errorf("%s: %v %q", name, ok, content)
+		}
+	}
+
+	// Backups hold the sealed files, and the parameters to open them
+	_, err = backupTask(context.Background(), &job{}, scheduledTask{Name: "nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := fsys.readDir(backupsDir)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups: %v %v", backups, err)
+	}
+	contents := zipContents(t, filepath.Join(backupsDir, backups[0].Name()))
+	sealed(contents, "p/a.txt")
+	sealed(contents, "p/sub/b.txt")
+	if _, ok := contents["p/"+encryptionFile]; !ok || contents["plain/c.txt"] != "plain text" {
+		t.Errorf("backup: %v", contents)
+	}
+
+	// So do archives, which restore the project sealed
+	err = archiveProject(context.Background(), &job{}, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents = zipContents(t, archiveFile("p"))
+	sealed(contents, "p/a.txt")
+	m, _ := loadArchive("p")
+	files, err := archivedFiles("p")
+	if err != nil || len(files) != 2 {
+		t.Errorf("archived files: %v %v", files, err)
+	}
+	err = unarchiveProject("p", *&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !projectLocked("p/a.txt") {
+		t.Error("restored project unlocked")
+	}
+	err = unlockProject("p", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustContain(t, "p/a.txt", "secret text")
+
+	// Parts of a project are not restored once it was decrypted
+	err = archiveProject(context.Background(), &job{}, "p/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents = zipContents(t, archiveFile("p/sub"))
+	sealed(contents, "p/sub/b.txt")
+	err = decryptProject("p", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ = loadArchive("p/sub")
+	if err = unarchiveProject("p/sub", *&m); err != errArchiveKey {
+		t.Errorf("restored into a decrypted project: %v", err)
+	}
+	mustExist(t, "p/sub/b.txt", false)
+	if content, _ := readFile("p/a.txt"); !bytes.Equal(content, []byte("secret text")) {
+		t.Errorf("decrypted: %q", content)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+//////// ENVIRONMENT
+
+// Every flag can also be set by an environment variable, handy in
+// containers: NINJA_ followed by its name in capitals, dashes becoming
+// underscores, such as NINJA_MAX_BANDWIDTH. Short flags have long names.
+// The command line takes precedence.
+
+const envPrefix = "NINJA_"
+
+var envFlagNames = map[string]string{
+	"i": "interface",
+	"p": "port",
+	"r": "root",
+	"v": "version",
+}
+
+func envName(flagName string) string {
+	if long, ok := envFlagNames[flagName]; ok {
+		flagName = long
+	}
+	return envPrefix + strings.ToUpper(strings.Replace(*&flagName, "-", "_", -1))
+}
+
+func applyEnvironment() (err error) {
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if e := f.Value.Set(*&value); e != nil {
+			err = errors.New("invalid value of " + envName(f.Name) + ": " + e.Error())
+		}
+	})
+	return
+}
+
+// Tells whether a flag was given, on the command line or in the environment.
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	_, inEnv := os.LookupEnv(envName(*&name))
+	return set || inEnv
+}
+
+//// Logging
+
+// Log lines written as JSON objects, for log collectors.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (n int, err error) {
+	level, message := logLineLevel(strings.TrimRight(string(*&p), "\n"))
+	entry := map[string]string{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"message": message,
+	}
+	if level != "" {
+		entry["level"] = level
+	}
+	line, err := json.Marshal(*&entry)
+	if err != nil {
+		return
+	}
+	_, err = os.Stdout.Write(append(*&line, '\n'))
+	return len(p), err
+}
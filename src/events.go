@@ -0,0 +1,188 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////// CHANGE EVENTS
+
+const defaultPollWait = 30 * time.Second
+const maxPollWait = 60 * time.Second
+
+type eventsMessage struct {
+	Type    string   `json:"type,omitempty"`
+	Cursor  int64    `json:"cursor"`
+	Changes []change `json:"changes"`
+}
+
+// Leaves out the changes the user of a request may not see.
+func visibleChanges(r *http.Request, changes []change) []change {
+	if !authEnabled() {
+		return changes
+	}
+	user := requestUser(r)
+	visible := []change{}
+	for _, c := range changes {
+		if p, ok := uriToPath(c.Uri); ok && allowed(*&user, *&p, opRead) {
+			visible = append(*&visible, *&c)
+		}
+	}
+	return visible
+}
+
+func parseCursor(r *http.Request) (cursor int64, ok bool) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return journal.latest(), true
+	}
+	cursor, err := strconv.ParseInt(*&since, 10, 64)
+	return cursor, err == nil
+}
+
+func eventsSession(r *http.Request, conn *wsConn, cursor int64) {
+	defer conn.close()
+	done := make(chan struct{})
+	go func() {
+		// Only used to notice disconnections
+		defer close(done)
+		for {
+			if _, _, err := conn.readMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// Changes and upload progress are sent from their own goroutines
+	var writeMutex sync.Mutex
+	send := func(v interface{}) error {
+		j, err := json.Marshal(*&v)
+		if err != nil {
+			return err
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return conn.writeMessage(wsText, *&j)
+	}
+	uploads := watchUploads(requestUser(*&r))
+	defer uploads.stop()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case p := <-uploads.ch:
+				if send(*&p) != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		changes, latest, ok := journal.wait(*&cursor, defaultPollWait, *&done)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		m := eventsMessage{"changes", *&latest, visibleChanges(*&r, *&changes)}
+		if !ok {
+			// Missed changes, the client has to rescan
+			m = eventsMessage{"reset", *&latest, []change{}}
+		} else if len(*&changes) == 0 {
+			continue
+		}
+		cursor = latest
+		if send(*&m) != nil {
+			return
+		}
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Events API
+
+// Stream the changes following a cursor (WebSocket), or list them
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	cursor, ok := parseCursor(*&r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Upgrade") != "" {
+		conn, err := wsUpgrade(w, r)
+		if err != nil {
+			log.Println(*&err)
+			return
+		}
+		go eventsSession(*&r, *&conn, *&cursor)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	changes, latest, ok := journal.since(*&cursor)
+	if !ok {
+		writeJSON(w, http.StatusGone, eventsMessage{Cursor: latest, Changes: []change{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, eventsMessage{Cursor: latest, Changes: visibleChanges(*&r, *&changes)})
+}
+
+// Wait for changes following a cursor, for clients which can't use
+// WebSockets
+func eventsPollHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cursor, ok := parseCursor(*&r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wait := defaultPollWait
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.Atoi(*&t)
+		if err != nil || seconds < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(*&seconds) * time.Second
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+	}
+	changes, latest, ok := journal.wait(*&cursor, *&wait, r.Context().Done())
+	if !ok {
+		writeJSON(w, http.StatusGone, eventsMessage{Cursor: latest, Changes: []change{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, eventsMessage{Cursor: latest, Changes: visibleChanges(*&r, *&changes)})
+}
@@ -0,0 +1,171 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+//////// FILE EXCERPTS
+
+// Quick previews of large text and log files: their first or last bytes or
+// lines, asked for with the preview-bytes, preview-lines, tail-bytes or
+// tail-lines header, read without loading the whole file when it can seek.
+
+// Most an excerpt gives, lines being cut there too
+const excerptMaxSize = 4 << 20
+
+// Tails are looked for in the end of files, in windows growing from this
+const excerptWindow = 64 << 10
+
+var excerptHeaders = []string{"preview-bytes", "preview-lines", "tail-bytes", "tail-lines"}
+
+func hasExcerpt(r *http.Request) bool {
+	for _, h := range excerptHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Cuts after the n-th line.
+func firstLines(content []byte, n int) []byte {
+	for i, c := range content {
+		if c == '\n' {
+			n--
+			if n == 0 {
+				return content[:i+1]
+			}
+		}
+	}
+	return content
+}
+
+// Keeps the n last lines, the final line break not starting one, and
+// tells whether there were more.
+func lastLines(content []byte, n int) ([]byte, bool) {
+	end := len(content)
+	if end > 0 && content[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if content[i] == '\n' {
+			n--
+			if n == 0 {
+				return content[i+1:], true
+			}
+		}
+	}
+	return content, false
+}
+
+// Reads the last size bytes of a file, or all of it if it cannot seek.
+func readEnd(f io.ReadCloser, total int64, size int64) (content []byte, whole bool, err error) {
+	s, ok := f.(io.Seeker)
+	if !ok || size >= total {
+		content, err = ioutil.ReadAll(*&f)
+		return content, true, err
+	}
+	_, err = s.Seek(total-size, io.SeekStart)
+	if err != nil {
+		return
+	}
+	content, err = ioutil.ReadAll(io.LimitReader(*&f, *&size))
+	return
+}
+
+func readExcerpt(p string, kind string, n int) (content []byte, total int64, err error) {
+	info, err := properties(*&p)
+	if err != nil {
+		return
+	}
+	total = info.Size()
+	f, err := fsys.open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	switch kind {
+	case "preview-bytes":
+		content, err = ioutil.ReadAll(io.LimitReader(*&f, int64(*&n)))
+	case "preview-lines":
+		content, err = ioutil.ReadAll(io.LimitReader(*&f, excerptMaxSize))
+		content = firstLines(*&content, *&n)
+	case "tail-bytes":
+		content, _, err = readEnd(*&f, *&total, int64(*&n))
+		if len(*&content) > n {
+			content = content[len(*&content)-n:]
+		}
+	case "tail-lines":
+		for window := int64(excerptWindow); ; window *= 2 {
+			if window > excerptMaxSize {
+				window = excerptMaxSize
+			}
+			var whole, found bool
+			content, whole, err = readEnd(*&f, *&total, *&window)
+			if err != nil {
+				return
+			}
+			content, found = lastLines(*&content, *&n)
+			if found || whole || window == excerptMaxSize {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Writes the excerpt a request asks for, with the size of the whole file.
+func serveExcerpt(w http.ResponseWriter, r *http.Request, p string) {
+	var kind string
+	var n int
+	for _, h := range excerptHeaders {
+		if v := r.Header.Get(h); v != "" {
+			var err error
+			n, err = strconv.Atoi(*&v)
+			if err != nil || n < 1 || kind != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			kind = h
+		}
+	}
+	if n > excerptMaxSize {
+		n = excerptMaxSize
+	}
+	content, total, err := readExcerpt(*&p, *&kind, *&n)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("file-size", strconv.FormatInt(*&total, 10))
+	w.Header().Set("Content-Type", http.DetectContentType(*&content))
+	w.Write(*&content)
+}
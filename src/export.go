@@ -0,0 +1,366 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// ARCHIVE EXPORT
+
+// Directories downloaded as a ZIP, tar or gzipped tar archive, generated
+// while it is sent. The format is picked with the format parameter or else
+// the Accept header, ZIP by default. Tar archives keep the permissions and
+// the symbolic links of the files, for deployments to Unix hosts.
+//
+// Incremental archives only hold what changed since a cursor of the change
+// journal, with the files removed since listed in a removedManifest entry,
+// or since a date in milliseconds. Every archive comes with the cursor and
+// the date to ask the next one from.
+
+const (
+	exportZip   = "zip"
+	exportTar   = "tar"
+	exportTarGz = "tar.gz"
+)
+
+const removedManifest = hiddenPrefix + "removed"
+
+var exportTypes = map[string]string{
+	exportZip:   "application/zip",
+	exportTar:   "application/x-tar",
+	exportTarGz: "application/gzip",
+}
+
+// Format asked for, if it is known.
+func exportFormat(r *http.Request) (format string, ok bool) {
+	if format = r.URL.Query().Get("format"); format != "" {
+		if format == "tgz" {
+			format = exportTarGz
+		}
+		_, ok = exportTypes[format]
+		return
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(*&accept, "application/x-tar"):
+		return exportTar, true
+	case strings.Contains(*&accept, "application/gzip"), strings.Contains(*&accept, "application/x-gzip"), strings.Contains(*&accept, "application/x-gtar"):
+		return exportTarGz, true
+	}
+	return exportZip, true
+}
+
+// Writes the entries of an archive one after the other.
+type exportWriter interface {
+	// Adds an entry, link being the target of symbolic links
+	add(name string, info os.FileInfo, link string, content io.Reader) error
+	Close() error
+}
+
+type zipExport struct {
+	zw *zip.Writer
+}
+
+func (e zipExport) add(name string, info os.FileInfo, link string, content io.Reader) error {
+	h, err := zip.FileInfoHeader(*&info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.IsDir() {
+		h.Name += "/"
+	} else if info.Mode().IsRegular() {
+		h.Method = zip.Deflate
+	}
+	w, err := e.zw.CreateHeader(*&h)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	if link != "" {
+		_, err = io.WriteString(*&w, *&link)
+		return err
+	}
+	_, err = io.Copy(*&w, *&content)
+	return err
+}
+
+func (e zipExport) Close() error {
+	return e.zw.Close()
+}
+
+type tarExport struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (e tarExport) add(name string, info os.FileInfo, link string, content io.Reader) error {
+	h, err := tar.FileInfoHeader(*&info, *&link)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.IsDir() {
+		h.Name += "/"
+	}
+	err = e.tw.WriteHeader(*&h)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	// Exactly the size announced by the header
+	_, err = io.CopyN(e.tw, *&content, h.Size)
+	return err
+}
+
+func (e tarExport) Close() error {
+	err := e.tw.Close()
+	if e.gz != nil {
+		if gerr := e.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	return err
+}
+
+func newExportWriter(w io.Writer, format string) exportWriter {
+	switch format {
+	case exportTar:
+		return tarExport{tw: tar.NewWriter(*&w)}
+	case exportTarGz:
+		gz := gzip.NewWriter(*&w)
+		return tarExport{tw: tar.NewWriter(*&gz), gz: gz}
+	}
+	return zipExport{zip.NewWriter(*&w)}
+}
+
+// Target of a symbolic link of the disk backend.
+func exportLink(p string, info os.FileInfo) (link string, err error) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return
+	}
+	if dp, ok := diskPath(*&p); ok {
+		return os.Readlink(*&dp)
+	}
+	return
+}
+
+// Entries of an incremental archive: the paths changed since a cursor, or
+// else the files modified after a date.
+type exportSelection struct {
+	changed map[string]bool
+	removed []string
+	after   time.Time
+}
+
+// Paths of a directory changed since a cursor, unless it is too old.
+func changedSince(dir string, cursor int64) (s *exportSelection, ok bool) {
+	changes, _, ok := journal.since(*&cursor)
+	if !ok {
+		return
+	}
+	s = &exportSelection{changed: make(map[string]bool)}
+	removed := make(map[string]bool)
+	for _, c := range changes {
+		p, valid := uriToPath(c.Uri)
+		if !valid || p == dir || !isUnderPrefix(*&p, *&dir) {
+			continue
+		}
+		s.changed[p] = c.Event != "removed"
+		removed[p] = c.Event == "removed"
+	}
+	for p, gone := range removed {
+		if gone && !exist(*&p) {
+			rel, _ := filepath.Rel(*&dir, *&p)
+			s.removed = append(s.removed, filepath.ToSlash(*&rel))
+		}
+	}
+	sort.Strings(s.removed)
+	return s, true
+}
+
+func (s *exportSelection) keeps(p string, info os.FileInfo) bool {
+	if s == nil {
+		return true
+	}
+	if s.changed != nil {
+		return s.changed[p]
+	}
+	return info.ModTime().After(s.after)
+}
+
+// Streams a directory into an archive, its entries named from the name of
+// the directory, hidden files left out, and only those selected if any.
+func exportDir(ew exportWriter, p string, name string, s *exportSelection) error {
+	err := walk(*&p, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fp != p && strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !s.keeps(*&fp, *&info) {
+			return nil
+		}
+		rel, err := filepath.Rel(*&p, *&fp)
+		if err != nil {
+			return err
+		}
+		entry := filepath.ToSlash(filepath.Join(*&name, *&rel))
+		link, err := exportLink(*&fp, *&info)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return ew.add(*&entry, *&info, *&link, nil)
+		}
+		f, err := fsys.open(*&fp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return ew.add(*&entry, *&info, "", *&f)
+	})
+	if err != nil || s == nil || len(s.removed) == 0 {
+		return err
+	}
+	content := []byte(strings.Join(s.removed, "\n") + "\n")
+	manifest := &memNode{name: removedManifest, mode: 0644, modTime: time.Now(), content: content}
+	return ew.add(path.Join(*&name, removedManifest), *&manifest, "", bytes.NewReader(*&content))
+}
+
+//////// REQUEST HANDLERS
+
+//// Export API
+
+// Export a request asks for, once checked.
+type exportRequest struct {
+	p      string
+	name   string
+	format string
+	s      *exportSelection
+	// Taken before walking, so that the next archive misses nothing
+	cursor   int64
+	exported time.Time
+}
+
+// Reads the export a request asks for, answering it if it cannot be made.
+func readExportRequest(w http.ResponseWriter, r *http.Request) (e exportRequest, ok bool) {
+	e.p, ok = uriToPath(r.URL.Path[exportPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	e.format, ok = exportFormat(*&r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ok = false
+	info, err := properties(e.p)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.name = filepath.Base(e.p)
+	if e.p == "." {
+		e.name = projectsDir
+	}
+	e.cursor, e.exported = journal.latest(), time.Now()
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		n, err := strconv.ParseInt(*&c, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var known bool
+		if e.s, known = changedSince(e.p, *&n); !known {
+			// Too old, the client has to export everything again
+			writeJSON(w, http.StatusGone, map[string]int64{"cursor": e.cursor})
+			return
+		}
+	} else if since := r.URL.Query().Get("since"); since != "" {
+		if _, err := strconv.ParseInt(*&since, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.s = &exportSelection{after: parseMilliseconds(*&since)}
+	}
+	return e, true
+}
+
+func (e exportRequest) fileName() string {
+	return e.name + "." + e.format
+}
+
+// Download a directory as an archive of the format asked for, or generate
+// it in the background to download it from the exports
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := readExportRequest(w, *&r)
+	if !ok {
+		return
+	}
+	if r.Method == "POST" {
+		startExportJob(w, *&r, *&e)
+		return
+	}
+	w.Header().Set("Content-Type", exportTypes[e.format])
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(e.fileName()))
+	w.Header().Set("cursor", strconv.FormatInt(e.cursor, 10))
+	w.Header().Set("exported", milliseconds(e.exported))
+	w.WriteHeader(http.StatusOK)
+	ew := newExportWriter(w, e.format)
+	err := exportDir(*&ew, e.p, e.name, e.s)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		// Too late for an error status, the archive is left unfinished
+		// so that clients can tell it is broken
+		log.Println(*&err)
+	}
+}
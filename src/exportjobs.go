@@ -0,0 +1,261 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//////// RESUMABLE EXPORTS
+
+// Archives of big directories take long enough to generate that downloads
+// get interrupted. Posting to the export route generates the archive in a
+// background job instead, kept in the projects directory for a day, whose
+// result is the route to download it from: a plain file answering range
+// requests, so that interrupted downloads resume where they stopped.
+
+const exportsDir = hiddenPrefix + "exports"
+const exportsBucket = "exports"
+const exportRetention = 24 * time.Hour
+
+type exportArtifact struct {
+	Id       string `json:"id"`
+	Uri      string `json:"uri"`
+	Name     string `json:"name"`
+	Format   string `json:"format"`
+	Size     string `json:"size"`
+	Cursor   int64  `json:"cursor"`
+	Exported string `json:"exported"`
+	Expires  string `json:"expires"`
+	User     string `json:"user,omitempty"`
+}
+
+func (a exportArtifact) path() string {
+	return filepath.Join(exportsDir, a.Id+"."+a.Format)
+}
+
+func (a exportArtifact) expired() bool {
+	return time.Now().After(parseMilliseconds(a.Expires))
+}
+
+func loadExport(id string) (a exportArtifact, ok bool) {
+	j, ok := metadata.get(exportsBucket, *&id)
+	if !ok {
+		return
+	}
+	ok = json.Unmarshal([]byte(*&j), &a) == nil
+	return
+}
+
+func saveExport(a exportArtifact) {
+	j, err := json.Marshal(*&a)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	metadata.put(exportsBucket, a.Id, string(*&j))
+}
+
+func removeExport(a exportArtifact) {
+	if err := removeFile(a.path()); err != nil && !os.IsNotExist(*&err) {
+		log.Println(*&err)
+	}
+	metadata.delete(exportsBucket, a.Id)
+}
+
+// Removes the exports past their expiry.
+func pruneExports() {
+	for _, id := range metadata.keys(exportsBucket, ".") {
+		a, ok := loadExport(*&id)
+		if !ok {
+			metadata.delete(exportsBucket, *&id)
+		} else if a.expired() {
+			removeExport(*&a)
+		}
+	}
+}
+
+// Exports are only shown to the user who asked for them, and to the owner.
+func exportVisible(r *http.Request, a exportArtifact) bool {
+	user := requestUser(*&r)
+	return !authEnabled() || user == ownerUser || a.User == user
+}
+
+// Writer giving up as soon as its context is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (n int, err error) {
+	err = c.ctx.Err()
+	if err != nil {
+		return
+	}
+	return c.w.Write(*&p)
+}
+
+// Generates the archive of an export under a temporary name, then records
+// it once complete.
+func writeExport(ctx context.Context, e exportRequest, a exportArtifact) (err error) {
+	err = createDir(exportsDir)
+	if err != nil {
+		return
+	}
+	p := a.path()
+	tmp := p + ".tmp"
+	i, err := beginIntent(intentReplace, "", *&p, *&tmp, "")
+	if err != nil {
+		return
+	}
+	defer i.end()
+	f, err := fsys.create(*&tmp, 0666)
+	if err != nil {
+		return
+	}
+	ew := newExportWriter(ctxWriter{*&ctx, *&f}, e.format)
+	err = exportDir(*&ew, e.p, e.name, e.s)
+	if err == nil {
+		err = ew.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.rename(*&tmp, *&p)
+	}
+	if err != nil {
+		removeFile(*&tmp)
+		return
+	}
+	info, err := fsys.stat(*&p)
+	if err != nil {
+		return
+	}
+	a.Size = strconv.FormatInt(info.Size(), 10)
+	a.Expires = milliseconds(time.Now().Add(exportRetention))
+	saveExport(*&a)
+	return
+}
+
+func startExportJob(w http.ResponseWriter, r *http.Request, e exportRequest) {
+	pruneExports()
+	a := exportArtifact{
+		Id:       randomString(16),
+		Uri:      pathToUri(e.p),
+		Name:     e.fileName(),
+		Format:   e.format,
+		Cursor:   e.cursor,
+		Exported: milliseconds(e.exported),
+		User:     requestUser(*&r),
+	}
+	j := startJob(*&r, "export", a.Uri, func(ctx context.Context, j *job) (string, error) {
+		j.setState(jobRunning)
+		return exportsPath + a.Id, writeExport(*&ctx, *&e, *&a)
+	})
+	w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+	writeJSON(w, http.StatusAccepted, *&j)
+}
+
+//////// REQUEST HANDLERS
+
+//// Exports API
+
+// List the generated exports, download one, resuming with range requests,
+// or remove it
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	pruneExports()
+	id := r.URL.Path[exportsPathLen:]
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		list := []exportArtifact{}
+		for _, k := range metadata.keys(exportsBucket, ".") {
+			if a, ok := loadExport(*&k); ok && exportVisible(*&r, *&a) {
+				list = append(list, a)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Exported < list[j].Exported })
+		writeJSON(w, http.StatusOK, *&list)
+		return
+	}
+	a, ok := loadExport(*&id)
+	if !ok || !exportVisible(*&r, *&a) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		info, err := fsys.stat(a.path())
+		if os.IsNotExist(*&err) {
+			metadata.delete(exportsBucket, a.Id)
+			w.WriteHeader(http.StatusGone)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f, err := fsys.open(a.path())
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", exportTypes[a.Format])
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(a.Name))
+		w.Header().Set("cursor", strconv.FormatInt(a.Cursor, 10))
+		w.Header().Set("exported", a.Exported)
+		// Lets If-Range tell that the file is the same
+		w.Header().Set("ETag", strconv.Quote(a.Id))
+		if rs, ok := f.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, a.Name, info.ModTime(), *&rs)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			if _, err := io.Copy(w, *&f); err != nil {
+				// Too late to report it to the client
+				log.Println(*&err)
+			}
+		}
+		return
+	case "DELETE":
+		removeExport(*&a)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
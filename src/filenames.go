@@ -0,0 +1,194 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+//////// PORTABLE NAMES
+
+// Names Windows refuses or mangles, although other systems accept them:
+// reserved device names such as CON or LPT1 whatever their extension,
+// names ending with a dot or a space, and characters such as : or ?. With
+// -portable-names set to reject, files and directories cannot be created
+// under such names, and with sanitize they are renamed to portable ones.
+// Only the components of a path which do not exist yet are checked, so
+// that what is already there stays reachable.
+
+const (
+	portableOff      = "off"
+	portableReject   = "reject"
+	portableSanitize = "sanitize"
+)
+
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+const illegalNameChars = `<>:"/\|?*`
+
+type nameReport struct {
+	Name      string   `json:"name"`
+	Problems  []string `json:"problems"`
+	Sanitized string   `json:"sanitized"`
+}
+
+type portabilityReport struct {
+	Uri       string       `json:"uri"`
+	Portable  bool         `json:"portable"`
+	Names     []nameReport `json:"names"`
+	Sanitized string       `json:"sanitized"`
+}
+
+func checkPortableNames() error {
+	switch portableNamesFlag {
+	case portableOff, portableReject, portableSanitize:
+		return nil
+	}
+	return errors.New("invalid portable names mode " + portableNamesFlag + ", expected off, reject or sanitize")
+}
+
+func isReservedName(name string) bool {
+	base := strings.SplitN(*&name, ".", 2)[0]
+	for _, r := range reservedNames {
+		if strings.EqualFold(strings.TrimRight(*&base, " "), *&r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Codes of what makes a name unportable, besides its length.
+func nameProblems(name string) (problems []string) {
+	if isReservedName(*&name) {
+		problems = append(*&problems, "reserved-name")
+	}
+	if strings.HasSuffix(*&name, ".") || strings.HasSuffix(*&name, " ") {
+		problems = append(*&problems, "trailing-dot-or-space")
+	}
+	if strings.IndexFunc(*&name, func(c rune) bool { return c < 0x20 || strings.ContainsRune(illegalNameChars, *&c) }) >= 0 {
+		problems = append(*&problems, "illegal-character")
+	}
+	return
+}
+
+// Closest portable name.
+func sanitizeName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || strings.ContainsRune(illegalNameChars, *&c) {
+			return '_'
+		}
+		return c
+	}, *&name)
+	name = strings.TrimRight(*&name, ". ")
+	if isReservedName(*&name) {
+		name = "_" + name
+	}
+	if len(*&name) > maxNameLength {
+		ext := filepath.Ext(*&name)
+		if len(*&ext) >= maxNameLength {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxNameLength-len(ext)], "") + ext
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// Checks the components of a path which do not exist yet, or all of them.
+func portability(p string, all bool) (report portabilityReport) {
+	report.Uri = pathToUri(*&p)
+	report.Names = []nameReport{}
+	var sanitized []string
+	for dir := filepath.Clean(*&p); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(*&dir) {
+		name := filepath.Base(*&dir)
+		if !all && exist(*&dir) {
+			sanitized = append([]string{dir}, sanitized...)
+			break
+		}
+		clean := name
+		problems := nameProblems(*&name)
+		if len(*&name) > maxNameLength {
+			problems = append(*&problems, "name-too-long")
+		}
+		if len(*&problems) > 0 {
+			clean = sanitizeName(*&name)
+			report.Names = append([]nameReport{{name, problems, clean}}, report.Names...)
+		}
+		sanitized = append([]string{clean}, sanitized...)
+	}
+	report.Portable = len(report.Names) == 0
+	report.Sanitized = pathToUri(filepath.Join(sanitized...))
+	return
+}
+
+// Applies the mode to a path about to be created through an API, returning
+// the path to create and whether it may be. Sanitized paths are told in the
+// Location header.
+func portablePath(w http.ResponseWriter, r *http.Request, api string, p string) (string, bool) {
+	if portableNamesFlag == portableOff {
+		return p, true
+	}
+	report := portability(*&p, false)
+	if report.Portable {
+		return p, true
+	}
+	if portableNamesFlag == portableSanitize {
+		sanitized, ok := uriToPath(report.Sanitized)
+		w.Header().Set("Location", externalUrl(*&r, api+strings.TrimPrefix(report.Sanitized, drivePrefix)))
+		return sanitized, ok
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":     "unportable-name",
+		"message":   errorMessage(*&r, "unportable-name"),
+		"uri":       report.Uri,
+		"names":     report.Names,
+		"sanitized": report.Sanitized,
+	})
+	return p, false
+}
+
+//////// REQUEST HANDLERS
+
+//// Names API
+
+// Tell whether the names of a path are portable, and how they would be
+// sanitized
+func namesHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[namesPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, portability(*&p, r.URL.Query().Get("all") == "true"))
+}
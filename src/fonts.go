@@ -0,0 +1,374 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//////// FONTS
+
+const fontsDir = "fonts"
+
+var errFontNotFound = errors.New("font family not found")
+
+type fontFamily struct {
+	Provider string   `json:"provider"`
+	Family   string   `json:"family"`
+	Category string   `json:"category"`
+	Variants []string `json:"variants"`
+}
+
+type fontFile struct {
+	Variant string
+	Name    string
+	Content []byte
+}
+
+type fontProvider interface {
+	search(ctx context.Context, query string) (families []fontFamily, err error)
+	fetch(ctx context.Context, family string, variants []string) (files []fontFile, err error)
+}
+
+var fontProviders = map[string]fontProvider{
+	"google":       googleFonts{},
+	"fontsquirrel": fontSquirrel{},
+}
+
+//// Google Fonts
+
+const googleFontsApi = "https://www.googleapis.com/webfonts/v1/webfonts?key="
+
+type googleFonts struct{}
+
+type googleFontsList struct {
+	Items []struct {
+		Family   string            `json:"family"`
+		Category string            `json:"category"`
+		Variants []string          `json:"variants"`
+		Files    map[string]string `json:"files"`
+	} `json:"items"`
+}
+
+func (g googleFonts) list(ctx context.Context) (list googleFontsList, err error) {
+	if googleFontsKeyFlag == "" {
+		err = errors.New("no Google Fonts API key configured")
+		return
+	}
+	err = httpGetJSON(*&ctx, googleFontsApi+url.QueryEscape(googleFontsKeyFlag), &list)
+	return
+}
+
+func (g googleFonts) search(ctx context.Context, query string) (families []fontFamily, err error) {
+	list, err := g.list(*&ctx)
+	if err != nil {
+		return
+	}
+	query = strings.ToLower(*&query)
+	for _, i := range list.Items {
+		if strings.Contains(strings.ToLower(i.Family), *&query) {
+			families = append(*&families, fontFamily{"google", i.Family, i.Category, i.Variants})
+		}
+	}
+	return
+}
+
+func (g googleFonts) fetch(ctx context.Context, family string, variants []string) (files []fontFile, err error) {
+	list, err := g.list(*&ctx)
+	if err != nil {
+		return
+	}
+	for _, i := range list.Items {
+		if !strings.EqualFold(i.Family, *&family) {
+			continue
+		}
+		for variant, u := range i.Files {
+			if len(*&variants) > 0 && !sliceContains(*&variants, *&variant) {
+				continue
+			}
+			content, err := httpGet(*&ctx, *&u)
+			if err != nil {
+				return nil, err
+			}
+			name := fontSlug(i.Family) + "-" + variant + path.Ext(*&u)
+			files = append(*&files, fontFile{variant, name, content})
+		}
+		return
+	}
+	err = errFontNotFound
+	return
+}
+
+//// Font Squirrel
+
+const fontSquirrelApi = "https://www.fontsquirrel.com/api/fontlist/all"
+const fontSquirrelDownload = "https://www.fontsquirrel.com/fonts/download/"
+
+type fontSquirrel struct{}
+
+type fontSquirrelFamily struct {
+	Name           string `json:"family_name"`
+	UrlName        string `json:"family_urlname"`
+	Classification string `json:"classification"`
+}
+
+func (f fontSquirrel) list(ctx context.Context) (list []fontSquirrelFamily, err error) {
+	err = httpGetJSON(*&ctx, fontSquirrelApi, &list)
+	return
+}
+
+func (f fontSquirrel) search(ctx context.Context, query string) (families []fontFamily, err error) {
+	list, err := f.list(*&ctx)
+	if err != nil {
+		return
+	}
+	query = strings.ToLower(*&query)
+	for _, i := range list {
+		if strings.Contains(strings.ToLower(i.Name), *&query) {
+			families = append(*&families, fontFamily{"fontsquirrel", i.Name, i.Classification, nil})
+		}
+	}
+	return
+}
+
+func (f fontSquirrel) fetch(ctx context.Context, family string, variants []string) (files []fontFile, err error) {
+	list, err := f.list(*&ctx)
+	if err != nil {
+		return
+	}
+	for _, i := range list {
+		if !strings.EqualFold(i.Name, *&family) {
+			continue
+		}
+		// Font Squirrel only distributes whole families as ZIP archives
+		archive, err := httpGet(*&ctx, fontSquirrelDownload+i.UrlName)
+		if err != nil {
+			return nil, err
+		}
+		z, err := zip.NewReader(bytes.NewReader(*&archive), int64(len(*&archive)))
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range z.File {
+			name := path.Base(zf.Name)
+			if fontFormat(*&name) == "" {
+				continue
+			}
+			variant := strings.ToLower(strings.TrimSuffix(*&name, path.Ext(*&name)))
+			if len(*&variants) > 0 && !sliceContains(*&variants, *&variant) {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := ioutil.ReadAll(*&rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			files = append(*&files, fontFile{variant, name, content})
+		}
+		return files, nil
+	}
+	err = errFontNotFound
+	return
+}
+
+//// @font-face generation
+
+var fontSlugRegexp = regexp.MustCompile("[^A-Za-z0-9]+")
+var fontWeightRegexp = regexp.MustCompile("[1-9]00")
+
+func fontSlug(family string) string {
+	return strings.Trim(fontSlugRegexp.ReplaceAllString(*&family, "-"), "-")
+}
+
+func fontFormat(name string) string {
+	switch strings.ToLower(path.Ext(*&name)) {
+	case ".ttf":
+		return "truetype"
+	case ".otf":
+		return "opentype"
+	case ".woff":
+		return "woff"
+	case ".woff2":
+		return "woff2"
+	case ".eot":
+		return "embedded-opentype"
+	}
+	return ""
+}
+
+// Guesses the CSS weight and style from a variant name such as "700italic"
+// (Google Fonts) or "opensans-bolditalic" (Font Squirrel).
+func fontVariantStyle(variant string) (weight string, style string) {
+	v := strings.ToLower(*&variant)
+	weight, style = "400", "normal"
+	if strings.Contains(*&v, "italic") || strings.Contains(*&v, "oblique") {
+		style = "italic"
+	}
+	names := []struct{ name, weight string }{
+		{"extralight", "200"}, {"semibold", "600"}, {"extrabold", "800"},
+		{"thin", "100"}, {"light", "300"}, {"medium", "500"},
+		{"bold", "700"}, {"black", "900"},
+	}
+	for _, n := range names {
+		if strings.Contains(*&v, n.name) {
+			return n.weight, style
+		}
+	}
+	if m := fontWeightRegexp.FindString(*&v); m != "" {
+		weight = m
+	}
+	return
+}
+
+func fontFaceCSS(family string, files []fontFile) []byte {
+	var css bytes.Buffer
+	for _, f := range files {
+		weight, style := fontVariantStyle(f.Variant)
+		fmt.Fprintf(&css, "@font-face {\n")
+		fmt.Fprintf(&css, "\tfont-family: '%s';\n", family)
+		fmt.Fprintf(&css, "\tsrc: url('%s/%s') format('%s');\n", fontSlug(*&family), f.Name, fontFormat(f.Name))
+		fmt.Fprintf(&css, "\tfont-weight: %s;\n", weight)
+		fmt.Fprintf(&css, "\tfont-style: %s;\n", style)
+		fmt.Fprintf(&css, "}\n\n")
+	}
+	return css.Bytes()
+}
+
+// Downloads the requested variants of a family into <dest>/fonts/<family>/
+// and writes the matching @font-face stylesheet to <dest>/fonts/<family>.css.
+func installFont(ctx context.Context, provider fontProvider, family string, variants []string, dest string) (written []string, err error) {
+	files, err := provider.fetch(*&ctx, *&family, *&variants)
+	if err != nil {
+		return
+	}
+	if len(*&files) == 0 {
+		err = errFontNotFound
+		return
+	}
+	dir := filepath.Join(*&dest, fontsDir, fontSlug(*&family))
+	err = createDir(*&dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		p := filepath.Join(*&dir, f.Name)
+		err = saveFile(*&p, f.Content)
+		if err != nil {
+			return
+		}
+		written = append(*&written, pathToUri(*&p))
+	}
+	css := filepath.Join(*&dest, fontsDir, fontSlug(*&family)+".css")
+	err = saveFile(*&css, fontFaceCSS(*&family, *&files))
+	if err != nil {
+		return
+	}
+	written = append(*&written, pathToUri(*&css))
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Font API
+
+type fontInstallRequest struct {
+	Provider    string   `json:"provider"`
+	Family      string   `json:"family"`
+	Variants    []string `json:"variants"`
+	Destination string   `json:"destination"`
+}
+
+func fontsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+
+	switch r.Method {
+	case "GET":
+		// Search the font catalogues
+		query := r.URL.Query().Get("q")
+		providers := fontProviders
+		if name := r.URL.Query().Get("provider"); name != "" {
+			provider, ok := fontProviders[name]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			providers = map[string]fontProvider{name: provider}
+		}
+		results := []fontFamily{}
+		for name, provider := range providers {
+			families, err := provider.search(r.Context(), *&query)
+			if err != nil {
+				log.Println(name+":", err)
+				continue
+			}
+			results = append(*&results, families...)
+		}
+		writeJSON(w, http.StatusOK, *&results)
+		return
+	case "POST":
+		// Download a font family and its @font-face stylesheet into a project
+		var req fontInstallRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		provider, ok := fontProviders[req.Provider]
+		if !ok || req.Family == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dest, ok := bodyPath(*&r, req.Destination, opWrite)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		written, err := installFont(r.Context(), *&provider, req.Family, req.Variants, *&dest)
+		if err == errFontNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusCreated, *&written)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
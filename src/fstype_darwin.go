@@ -0,0 +1,47 @@
+//go:build darwin
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"syscall"
+)
+
+func cString(s []int8) string {
+	b := make([]byte, 0, len(*&s))
+	for _, c := range s {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(*&c))
+	}
+	return string(*&b)
+}
+
+// Type of the filesystem holding a path, and where it is mounted.
+func fsType(p string) (fstype string, mountpoint string, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(*&p, &st)
+	if err != nil {
+		return
+	}
+	return cString(st.Fstypename[:]), cString(st.Mntonname[:]), nil
+}
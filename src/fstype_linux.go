@@ -0,0 +1,43 @@
+//go:build linux
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"syscall"
+)
+
+// Magic numbers statfs reports for the filesystems snapshots support.
+var fsMagics = map[uint32]string{
+	0x9123683e: "btrfs",
+	0x2fc12fc1: "zfs",
+}
+
+// Type of the filesystem holding a path, and where it is mounted when
+// snapshots have to be mounted to be read, which Linux doesn't need.
+func fsType(p string) (fstype string, mountpoint string, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(*&p, &st)
+	if err != nil {
+		return
+	}
+	return fsMagics[uint32(st.Type)], "", nil
+}
@@ -0,0 +1,225 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//////// GIT IMPORT
+
+// Projects cloned from Git repositories, such as starter kits and shared
+// templates, through the git executable when it is installed. Repositories
+// are cloned into a temporary directory, then copied into the projects.
+
+type gitImport struct {
+	Url     string `json:"url"`
+	Ref     string `json:"ref"`
+	Shallow bool   `json:"shallow"`
+	// Keeps the .git directory, for projects to be committed to later
+	KeepHistory bool `json:"keepHistory"`
+}
+
+var gitSchemes = []string{"https", "http", "git", "ssh"}
+var gitScpRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^-]`)
+var gitProgressRegexp = regexp.MustCompile(`^(Receiving objects|Resolving deltas):\s+(\d+)%`)
+
+func findGit() (p string, ok bool) {
+	name := "git"
+	if gitFlag != "" {
+		name = gitFlag
+	}
+	p, err := exec.LookPath(*&name)
+	return p, err == nil
+}
+
+// Remote repositories only: local paths and file URLs would expose the
+// filesystem of the server.
+func validGitUrl(u string) bool {
+	if gitScpRegexp.MatchString(*&u) {
+		return true
+	}
+	parsed, err := url.Parse(*&u)
+	return err == nil && parsed.Host != "" && sliceContains(gitSchemes, parsed.Scheme)
+}
+
+// Runs git without ever prompting for credentials, and only over the
+// network protocols.
+func gitCommand(ctx context.Context, git string, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(*&ctx, *&git, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+strings.Join(gitSchemes, ":"))
+	return cmd
+}
+
+// Splits the progress git reports, which rewrites lines with carriage returns.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(*&data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(*&data) > 0 {
+		return len(*&data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func gitClone(ctx context.Context, j *job, git string, imp gitImport, dest string) (err error) {
+	tmp, err := ioutil.TempDir("", "ninja-git")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(*&tmp)
+	args := []string{"clone", "--progress"}
+	if imp.Ref != "" {
+		args = append(*&args, "--branch", imp.Ref)
+	}
+	if imp.Shallow {
+		args = append(*&args, "--depth", "1")
+	}
+	clone := filepath.Join(*&tmp, "clone")
+	cmd := gitCommand(*&ctx, *&git, "", append(*&args, "--", imp.Url, clone)...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	j.setState(jobRunning)
+	var lastLines []string
+	s := bufio.NewScanner(*&stderr)
+	s.Split(scanProgressLines)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if m := gitProgressRegexp.FindStringSubmatch(*&line); m != nil {
+			percent, _ := strconv.Atoi(m[2])
+			// Receiving takes most of the time, copying the rest
+			if m[1] == "Receiving objects" {
+				j.setProgress(float64(*&percent) / 100 * 0.8)
+			} else {
+				j.setProgress(0.8 + float64(*&percent)/100*0.1)
+			}
+			continue
+		}
+		if line != "" {
+			lastLines = append(*&lastLines, *&line)
+			if len(lastLines) > 5 {
+				lastLines = lastLines[1:]
+			}
+		}
+	}
+	err = cmd.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Println(strings.Join(*&lastLines, "\n"))
+		return errors.New("git: " + strings.Join(*&lastLines, " "))
+	}
+
+	err = createDir(*&dest)
+	if err != nil {
+		return
+	}
+	err = filepath.Walk(*&clone, func(sp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" && !imp.KeepHistory {
+			return filepath.SkipDir
+		}
+		err = ioPause(*&ctx)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*&clone, *&sp)
+		if err != nil {
+			return err
+		}
+		dp := filepath.Join(*&dest, *&rel)
+		if info.IsDir() {
+			return createDir(*&dp)
+		}
+		if !info.Mode().IsRegular() {
+			// Symbolic links could point outside of the projects
+			return nil
+		}
+		return copyIntoStorage(*&sp, *&dp)
+	})
+	if err != nil {
+		removeDir(*&dest)
+		return
+	}
+	recordCreation(*&dest)
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Git import API
+
+// Clone a Git repository into a new project
+func cloneHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	git, ok := findGit()
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[clonePathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var imp gitImport
+	err := json.NewDecoder(*&r.Body).Decode(&imp)
+	if err != nil || !validGitUrl(imp.Url) || strings.HasPrefix(imp.Ref, "-") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if exist(*&p) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	j := startJob(*&r, "clone", imp.Url, func(ctx context.Context, j *job) (string, error) {
+		return pathToUri(*&p), gitClone(*&ctx, *&j, *&git, *&imp, *&p)
+	})
+	w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+	writeJSON(w, http.StatusAccepted, *&j)
+}
@@ -0,0 +1,126 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+//////// HASH ALGORITHMS
+
+// Content is hashed for two purposes: telling whether it changed, for
+// revisions and block signatures, where a fast non-cryptographic hash does,
+// and checking that copies are intact with -verify-writes, which takes a
+// cryptographic one. Each has its flag; SHA-256 stays the default so that
+// revisions known to clients remain valid. Block deltas keep SHA-256 sums,
+// which are part of their format.
+
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+	// Whether finding collisions is out of reach, and not only unlikely
+	cryptographic bool
+}
+
+var hashAlgorithms = []hashAlgorithm{
+	{"sha256", sha256.New, true},
+	{"blake3", newBlake3, true},
+	{"xxhash", func() hash.Hash { return newXXHash64() }, false},
+}
+
+func findHash(name string) (a hashAlgorithm, ok bool) {
+	for _, a := range hashAlgorithms {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return
+}
+
+func hashNames() (names []string) {
+	for _, a := range hashAlgorithms {
+		names = append(names, a.name)
+	}
+	return
+}
+
+func checkHashes() error {
+	if _, ok := findHash(revisionHashFlag); !ok {
+		return errors.New("unknown revision hash " + revisionHashFlag + ", known: " + strings.Join(hashNames(), ", "))
+	}
+	a, ok := findHash(verifyHashFlag)
+	if !ok {
+		return errors.New("unknown verification hash " + verifyHashFlag + ", known: " + strings.Join(hashNames(), ", "))
+	}
+	if !a.cryptographic {
+		return errors.New(verifyHashFlag + " is not a cryptographic hash, which verifications need")
+	}
+	return nil
+}
+
+// Hash of the revisions, checked at startup.
+func revisionHash() hash.Hash {
+	a, _ := findHash(revisionHashFlag)
+	return a.new()
+}
+
+// Hash of the verifications of written files, checked at startup.
+func verifyHash() hash.Hash {
+	a, _ := findHash(verifyHashFlag)
+	return a.new()
+}
+
+//// Benchmark
+
+// Prints the throughput of every algorithm over the content of a reader,
+// or over random data when it is nil.
+func benchHashes(r io.Reader, size int64) (err error) {
+	var data []byte
+	if r != nil {
+		data, err = io.ReadAll(*&r)
+	} else {
+		data = make([]byte, *&size)
+		_, err = rand.Read(*&data)
+	}
+	if err != nil {
+		return
+	}
+	fmt.Printf("Hashing %s\n", formatByteSize(int64(len(*&data))))
+	for _, a := range hashAlgorithms {
+		h := a.new()
+		started := time.Now()
+		h.Write(*&data)
+		sum := h.Sum(nil)
+		elapsed := time.Since(*&started)
+		kind := "fast"
+		if a.cryptographic {
+			kind = "cryptographic"
+		}
+		fmt.Printf("%-8s %-13s %10.1f MB/s  %x\n", a.name, *&kind, float64(len(*&data))/1e6/elapsed.Seconds(), *&sum)
+	}
+	return
+}
@@ -0,0 +1,147 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//////// LOCALIZATION
+
+// Messages shown to people, by the web UI, the HTML listings and in the
+// errors the editor displays, in the language negotiated with the
+// Accept-Language header. Catalogs are the locales/<language>.json assets,
+// which -assets may override or add to, English being the fallback of
+// every missing message. Errors keep their code in the error field, the
+// translated text coming in the message field.
+
+const localesDir = "locales"
+const defaultLocale = "en"
+const uiMessagesFile = "messages.json"
+
+var catalogs sync.Map
+
+// Languages there are catalogs for.
+func locales() (list []string) {
+	entries, _ := fs.ReadDir(assets(), localesDir)
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && path.Ext(*&name) == ".json" {
+			list = append(*&list, strings.ToLower(strings.TrimSuffix(*&name, ".json")))
+		}
+	}
+	return
+}
+
+func catalog(locale string) map[string]string {
+	if c, ok := catalogs.Load(*&locale); ok {
+		return c.(map[string]string)
+	}
+	c := make(map[string]string)
+	content, err := fs.ReadFile(assets(), path.Join(localesDir, *&locale+".json"))
+	if err == nil {
+		err = json.Unmarshal(*&content, &c)
+	}
+	if err != nil {
+		logWarn("Messages for", *&locale, "unavailable:", err)
+	}
+	catalogs.Store(*&locale, *&c)
+	return c
+}
+
+// Language of the responses to a request, the one the client prefers
+// among those with a catalog.
+func requestLocale(r *http.Request) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(*&part), ";")
+		w := weighted{strings.ToLower(fields[0]), 1}
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(*&f); strings.HasPrefix(*&v, "q=") {
+				w.q, _ = strconv.ParseFloat(v[2:], 64)
+			}
+		}
+		if w.tag != "" && w.tag != "*" && w.q > 0 {
+			tags = append(*&tags, *&w)
+		}
+	}
+	sort.SliceStable(*&tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	available := locales()
+	for _, t := range tags {
+		if sliceContains(*&available, t.tag) {
+			return t.tag
+		}
+		if i := strings.Index(t.tag, "-"); i > 0 && sliceContains(*&available, t.tag[:i]) {
+			return t.tag[:i]
+		}
+	}
+	return defaultLocale
+}
+
+// Message of a key in a language, in English if it is missing.
+func translate(locale string, key string) string {
+	if m, ok := catalog(*&locale)[key]; ok {
+		return m
+	}
+	if m, ok := catalog(defaultLocale)[key]; ok {
+		return m
+	}
+	return key
+}
+
+// Message of a key in the language of a request.
+func localize(r *http.Request, key string) string {
+	return translate(requestLocale(*&r), *&key)
+}
+
+// Text of an error code for people, in the language of a request.
+func errorMessage(r *http.Request, code string) string {
+	return localize(*&r, "error."+code)
+}
+
+//////// REQUEST HANDLERS
+
+//// UI Messages
+
+// Get the messages of the web UI in the language of the request
+func uiMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(*&r)
+	messages := make(map[string]string)
+	for _, c := range []map[string]string{catalog(defaultLocale), catalog(*&locale)} {
+		for k, m := range c {
+			if strings.HasPrefix(*&k, "ui.") {
+				messages[strings.TrimPrefix(*&k, "ui.")] = m
+			}
+		}
+	}
+	w.Header().Set("Content-Language", *&locale)
+	w.Header().Set("Vary", "Accept-Language")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"locale": locale, "messages": messages})
+}
@@ -0,0 +1,78 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//////// IDLE SHUTDOWN
+
+// With -idle-timeout the cloud exits once no request has been made for that
+// long and none is in progress, live event streams included, so that
+// forgotten instances do not run for weeks. Under socket activation the
+// service manager starts it again on the next connection.
+
+var activeRequests int64
+
+// Time of the last request, in nanoseconds
+var lastActivity int64
+
+func markActivity() {
+	atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+}
+
+func startIdleShutdown(timeout time.Duration) {
+	markActivity()
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		for range time.Tick(*&interval) {
+			if atomic.LoadInt64(&activeRequests) > 0 {
+				continue
+			}
+			if time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity))) >= timeout {
+				requestStop("Idle for " + timeout.String())
+				return
+			}
+		}
+	}()
+}
+
+//////// MIDDLEWARES
+
+func idleMiddleware(next http.Handler) http.Handler {
+	if idleTimeoutFlag <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		markActivity()
+		defer func() {
+			markActivity()
+			atomic.AddInt64(&activeRequests, -1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,458 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////// IMAGE OPTIMIZATION
+
+const defaultJpegQuality = 85
+
+type optimizeOptions struct {
+	Lossy   bool
+	Quality int
+}
+
+type assetReport struct {
+	Uri          string `json:"uri"`
+	Step         string `json:"step"`
+	OriginalSize int    `json:"originalSize"`
+	Size         int    `json:"size"`
+	Saved        int    `json:"saved"`
+}
+
+type optimizer func(content []byte, opts optimizeOptions) (optimized []byte, err error)
+
+var imageOptimizers = map[string]optimizer{
+	".png":  optimizePNG,
+	".jpg":  optimizeJPEG,
+	".jpeg": optimizeJPEG,
+	".svg":  optimizeSVG,
+}
+
+//// PNG
+
+func optimizePNG(content []byte, opts optimizeOptions) (optimized []byte, err error) {
+	img, err := png.Decode(bytes.NewReader(*&content))
+	if err != nil {
+		return
+	}
+	if _, ok := img.(*image.Paletted); !ok {
+		if palette, ok := exactPalette(*&img, 256); ok {
+			// Lossless: few enough colors to fit in a palette as they are
+			img = toExactPaletted(*&img, *&palette)
+		} else if opts.Lossy {
+			img = toPaletted(*&img, medianCut(*&img, 256), true)
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	err = enc.Encode(&buf, *&img)
+	optimized = buf.Bytes()
+	return
+}
+
+// Color of a pixel as a palette entry holds it, 8-bit and not premultiplied,
+// if it is kept exactly: 16-bit images and premultiplied translucent pixels
+// are not.
+func exactColor(img image.Image, x int, y int) (c color.NRGBA, ok bool) {
+	switch i := img.(type) {
+	case *image.NRGBA:
+		return i.NRGBAAt(*&x, *&y), true
+	case *image.RGBA:
+		rgba := i.RGBAAt(*&x, *&y)
+		return color.NRGBA{rgba.R, rgba.G, rgba.B, rgba.A}, rgba.A == 255
+	case *image.Gray:
+		g := i.GrayAt(*&x, *&y)
+		return color.NRGBA{g.Y, g.Y, g.Y, 255}, true
+	}
+	return
+}
+
+func exactPalette(img image.Image, max int) (palette color.Palette, ok bool) {
+	seen := make(map[color.NRGBA]bool)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c, exact := exactColor(*&img, *&x, *&y)
+			if !exact {
+				return nil, false
+			}
+			if !seen[c] {
+				if len(*&seen) == max {
+					return nil, false
+				}
+				seen[c] = true
+				palette = append(*&palette, c)
+			}
+		}
+	}
+	return palette, true
+}
+
+// Paletted copy of an image whose colors are all in the palette, indexed
+// as they are rather than matched to the nearest entry, which would mix up
+// colors only differing where they are transparent.
+func toExactPaletted(img image.Image, palette color.Palette) *image.Paletted {
+	index := make(map[color.NRGBA]uint8, len(*&palette))
+	for i, c := range palette {
+		index[c.(color.NRGBA)] = uint8(i)
+	}
+	b := img.Bounds()
+	p := image.NewPaletted(*&b, *&palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c, _ := exactColor(*&img, *&x, *&y)
+			p.SetColorIndex(*&x, *&y, index[c])
+		}
+	}
+	return p
+}
+
+func toPaletted(img image.Image, palette color.Palette, dither bool) *image.Paletted {
+	b := img.Bounds()
+	p := image.NewPaletted(*&b, *&palette)
+	if dither {
+		draw.FloydSteinberg.Draw(*&p, *&b, *&img, b.Min)
+	} else {
+		draw.Draw(*&p, *&b, *&img, b.Min, draw.Src)
+	}
+	return p
+}
+
+// Median cut colour quantization: the colour space box with the widest
+// channel range is split at its median until the palette is full.
+func medianCut(img image.Image, size int) color.Palette {
+	var pixels []color.NRGBA
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			pixels = append(*&pixels, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+		}
+	}
+	channel := func(c color.NRGBA, i int) uint8 {
+		return [4]uint8{c.R, c.G, c.B, c.A}[i]
+	}
+	widest := func(box []color.NRGBA) (ch int, span int) {
+		for i := 0; i < 4; i++ {
+			lo, hi := uint8(255), uint8(0)
+			for _, c := range box {
+				v := channel(*&c, *&i)
+				if v < lo {
+					lo = v
+				}
+				if v > hi {
+					hi = v
+				}
+			}
+			if int(hi)-int(lo) > span {
+				ch, span = i, int(hi)-int(lo)
+			}
+		}
+		return
+	}
+	boxes := [][]color.NRGBA{pixels}
+	for len(*&boxes) < size {
+		best, bestCh, bestSpan := -1, 0, 0
+		for i, box := range boxes {
+			if len(*&box) < 2 {
+				continue
+			}
+			ch, span := widest(*&box)
+			if span > bestSpan {
+				best, bestCh, bestSpan = i, ch, span
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(*&box, func(i, j int) bool {
+			return channel(box[i], bestCh) < channel(box[j], bestCh)
+		})
+		boxes[best] = box[:len(*&box)/2]
+		boxes = append(*&boxes, box[len(*&box)/2:])
+	}
+	var palette color.Palette
+	for _, box := range boxes {
+		if len(*&box) == 0 {
+			continue
+		}
+		var r, g, b, a int
+		for _, c := range box {
+			r, g, b, a = r+int(c.R), g+int(c.G), b+int(c.B), a+int(c.A)
+		}
+		n := len(*&box)
+		palette = append(*&palette, color.NRGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+	}
+	return palette
+}
+
+//// JPEG
+
+func optimizeJPEG(content []byte, opts optimizeOptions) (optimized []byte, err error) {
+	if !opts.Lossy {
+		// Recompressing a JPEG is never lossless
+		return content, nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(*&content))
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, *&img, &jpeg.Options{Quality: opts.Quality})
+	optimized = buf.Bytes()
+	return
+}
+
+//// SVG
+
+var svgCommentRegexp = regexp.MustCompile(`(?s)<!--.*?-->`)
+var svgMetadataRegexp = regexp.MustCompile(`(?s)<metadata[\s>].*?</metadata>`)
+var svgSpaceRegexp = regexp.MustCompile(`\sxml:space\s*=\s*["'](\w+)["']`)
+
+// Elements whose whitespace is rendered
+var svgTextElements = []string{"text", "tspan", "textPath"}
+
+func optimizeSVG(content []byte, opts optimizeOptions) (optimized []byte, err error) {
+	optimized = svgCommentRegexp.ReplaceAll(*&content, nil)
+	optimized = svgMetadataRegexp.ReplaceAll(*&optimized, nil)
+	optimized = collapseSVGSpaces(*&optimized)
+	return
+}
+
+// Drops the whitespace between tags, except in text elements and under
+// xml:space="preserve", where it is rendered. Other text is kept as is.
+func collapseSVGSpaces(content []byte) []byte {
+	var buf bytes.Buffer
+	preserved := []bool{false}
+	for len(content) > 0 {
+		start := bytes.IndexByte(*&content, '<')
+		if start < 0 {
+			start = len(content)
+		}
+		text := content[:start]
+		if preserved[len(preserved)-1] || len(bytes.TrimSpace(*&text)) > 0 {
+			buf.Write(*&text)
+		}
+		content = content[start:]
+		if len(content) == 0 {
+			break
+		}
+
+		if bytes.HasPrefix(*&content, []byte("<![CDATA[")) {
+			end := bytes.Index(*&content, []byte("]]>")) + len("]]>")
+			if end < len("]]>") {
+				end = len(content)
+			}
+			buf.Write(content[:end])
+			content = content[end:]
+			continue
+		}
+		end := svgTagEnd(*&content)
+		tag := content[:end]
+		content = content[end:]
+		buf.Write(collapseSVGTag(*&tag))
+
+		switch {
+		case bytes.HasPrefix(*&tag, []byte("</")):
+			if len(preserved) > 1 {
+				preserved = preserved[:len(preserved)-1]
+			}
+		case bytes.HasPrefix(*&tag, []byte("<?")), bytes.HasPrefix(*&tag, []byte("<!")):
+		case bytes.HasSuffix(*&tag, []byte("/>")):
+		default:
+			keep := preserved[len(preserved)-1]
+			name := strings.TrimLeft(string(tag), "<")
+			if i := strings.IndexAny(*&name, " \t\r\n/>"); i >= 0 {
+				name = name[:i]
+			}
+			if i := strings.LastIndexByte(*&name, ':'); i >= 0 {
+				name = name[i+1:]
+			}
+			if sliceContains(svgTextElements, *&name) {
+				keep = true
+			}
+			if m := svgSpaceRegexp.FindSubmatch(*&tag); m != nil {
+				keep = string(m[1]) == "preserve"
+			}
+			preserved = append(*&preserved, *&keep)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Length of the tag starting the content, whose attribute values may
+// contain '>'.
+func svgTagEnd(content []byte) int {
+	var quote byte
+	for i := 1; i < len(content); i++ {
+		switch c := content[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(content)
+}
+
+// Collapses the whitespace of a tag outside of its attribute values.
+func collapseSVGTag(tag []byte) []byte {
+	var buf bytes.Buffer
+	var quote byte
+	space := false
+	for _, c := range tag {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			space = true
+			continue
+		case c == '"' || c == '\'':
+			quote = c
+		}
+		if space && c != '>' && c != '/' {
+			buf.WriteByte(' ')
+		}
+		space = false
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+//// Files
+
+// Optimizes a single image in place, keeping the original whenever the
+// optimized version would not be smaller.
+func optimizeImage(p string, opts optimizeOptions) (report assetReport, err error) {
+	report.Uri = pathToUri(*&p)
+	report.Step = "optimize-images"
+	content, err := readFile(*&p)
+	if err != nil {
+		return
+	}
+	report.OriginalSize = len(*&content)
+	report.Size = len(*&content)
+	opt, ok := imageOptimizers[strings.ToLower(filepath.Ext(*&p))]
+	if !ok {
+		return
+	}
+	optimized, err := opt(*&content, *&opts)
+	if err != nil {
+		return
+	}
+	if len(*&optimized) >= len(*&content) {
+		return
+	}
+	err = saveFile(*&p, *&optimized)
+	if err != nil {
+		return
+	}
+	report.Size = len(*&optimized)
+	report.Saved = report.OriginalSize - report.Size
+	return
+}
+
+func optimizeImages(ctx context.Context, root string, opts optimizeOptions) (reports []assetReport, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, ok := imageOptimizers[strings.ToLower(filepath.Ext(*&p))]; !ok {
+			return nil
+		}
+		report, err := optimizeImage(*&p, *&opts)
+		if err != nil {
+			// A single undecodable image should not abort the whole run
+			log.Println(*&p, *&err)
+			return nil
+		}
+		reports = append(*&reports, *&report)
+		return nil
+	})
+	return
+}
+
+func optimizeOptionsFromRequest(r *http.Request) (opts optimizeOptions) {
+	opts.Lossy = r.Header.Get("lossy") == "true"
+	opts.Quality = defaultJpegQuality
+	if q, err := strconv.Atoi(r.Header.Get("quality")); err == nil && q > 0 && q <= 100 {
+		opts.Quality = q
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Image optimization API
+
+// Optimize an image, or every image under a directory, in place
+func optimizeHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[optimizePathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !exist(*&p) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	reports, err := optimizeImages(r.Context(), *&p, optimizeOptionsFromRequest(r))
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&reports)
+}
@@ -0,0 +1,117 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestOptimizeSVGSpaces(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{"<svg>\n  <g>\n    <rect width=\"1\"\n          height=\"2\" />\n  </g>\n</svg>\n",
+			`<svg><g><rect width="1" height="2"/></g></svg>`},
+		{"<svg>\n  <text x=\"0\">  two  spaces </text>\n</svg>",
+			`<svg><text x="0">  two  spaces </text></svg>`},
+		{"<svg><text><tspan>a</tspan> <tspan>b</tspan></text></svg>",
+			`<svg><text><tspan>a</tspan> <tspan>b</tspan></text></svg>`},
+		{"<svg>\n<g xml:space=\"preserve\">\n <desc> a  b </desc>\n</g>\n<g> </g>\n</svg>",
+			"<svg><g xml:space=\"preserve\">\n <desc> a  b </desc>\n</g><g></g></svg>"},
+		{"<svg><g xml:space=\"preserve\"><g xml:space=\"default\"> </g> </g></svg>",
+			`<svg><g xml:space="preserve"><g xml:space="default"></g> </g></svg>`},
+		{"<svg>\n<style>\n  a  >  b { fill: red }\n</style>\n<path d=\"M 0  0\"/></svg>",
+			"<svg><style>\n  a  >  b { fill: red }\n</style><path d=\"M 0  0\"/></svg>"},
+		{"<svg>\n<!-- note -->\n<title>a  title</title>\n</svg>",
+			`<svg><title>a  title</title></svg>`},
+	}
+	for _, c := range cases {
+		optimized, err := optimizeSVG([]byte(c.content), optimizeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(optimized) != c.expected {
+			t.Errorf("%q: got %q, want %q", c.content, optimized, c.expected)
+		}
+	}
+}
+
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, *&img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Optimizes a PNG image, decoding the result.
+func optimizeTestPNG(t *testing.T, img image.Image, opts optimizeOptions) image.Image {
+	t.Helper()
+	optimized, err := optimizePNG(encodeTestPNG(t, *&img), *&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(*&optimized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestOptimizePNGLossless(t *testing.T) {
+	// 16-bit colors do not fit into a palette as they are
+	deep := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		deep.SetNRGBA64(i%4, i/4, color.NRGBA64{0x1234, 0x5678, uint16(i % 2), 0xfedc})
+	}
+	optimized := optimizeTestPNG(t, deep, optimizeOptions{})
+	for i := 0; i < 16; i++ {
+		if c := color.NRGBA64Model.Convert(optimized.At(i%4, i/4)); c != deep.At(i%4, i/4) {
+			t.Errorf("16-bit pixel %d: got %v, want %v", i, c, deep.At(i%4, i/4))
+		}
+	}
+	if _, ok := optimizeTestPNG(t, deep, optimizeOptions{Lossy: true}).(*image.Paletted); !ok {
+		t.Error("16-bit image not reduced when lossy")
+	}
+
+	// Translucent colors are kept exactly, even those only differing where
+	// they are transparent
+	alpha := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	colors := []color.NRGBA{{10, 20, 30, 128}, {11, 20, 30, 128}, {200, 0, 0, 0}, {0, 0, 0, 0}}
+	for i, c := range colors {
+		alpha.SetNRGBA(i, 0, c)
+	}
+	optimized = optimizeTestPNG(t, alpha, optimizeOptions{})
+	if _, ok := optimized.(*image.Paletted); !ok {
+		t.Errorf("8-bit image not paletted: %T", optimized)
+	}
+	for i, c := range colors {
+		if got := color.NRGBAModel.Convert(optimized.At(i, 0)); got != c {
+			t.Errorf("translucent pixel %d: got %v, want %v", i, got, c)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// INBOX
+
+// Lets anyone send files to the cloud without having access to it. They
+// are kept in quarantine, away from the projects, until a moderator moves
+// them into a project or rejects them.
+
+const inboxDir = hiddenPrefix + "inbox"
+const inboxBucket = "inbox"
+
+type inboxItem struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	From     string `json:"from,omitempty"`
+	Received string `json:"received"`
+}
+
+var inboxMaxSize, inboxCapacity int64
+
+// Held from the capacity check until the item is recorded, so that uploads
+// received together cannot exceed the capacity between them
+var inboxLock sync.Mutex
+
+func checkInbox() (err error) {
+	inboxMaxSize, err = parseByteSize(*&inboxMaxSizeFlag)
+	if err != nil {
+		return
+	}
+	inboxCapacity, err = parseByteSize(*&inboxCapacityFlag)
+	return
+}
+
+func inboxTypeAllowed(name string) bool {
+	ext := strings.ToLower(filepath.Ext(*&name))
+	for _, t := range strings.Split(inboxTypesFlag, ",") {
+		if strings.TrimSpace(t) == ext && ext != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func inboxItems() (items []inboxItem) {
+	items = []inboxItem{}
+	for _, id := range metadata.keys(inboxBucket, ".") {
+		if item, ok := loadInboxItem(*&id); ok {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func loadInboxItem(id string) (item inboxItem, ok bool) {
+	v, ok := metadata.get(inboxBucket, *&id)
+	if !ok || json.Unmarshal([]byte(*&v), &item) != nil {
+		return item, false
+	}
+	return
+}
+
+func inboxUsed() (used int64) {
+	for _, item := range inboxItems() {
+		used += item.Size
+	}
+	return
+}
+
+func receiveInbox(w http.ResponseWriter, r *http.Request) (item inboxItem, status int) {
+	name := filepath.Base(filepath.FromSlash(r.URL.Query().Get("name")))
+	if name == "." || name == string(filepath.Separator) || strings.HasPrefix(*&name, hiddenPrefix) || !inboxTypeAllowed(*&name) {
+		return item, http.StatusUnsupportedMediaType
+	}
+	if r.ContentLength > inboxMaxSize {
+		return item, http.StatusRequestEntityTooLarge
+	}
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, inboxMaxSize))
+	if err != nil {
+		return item, http.StatusRequestEntityTooLarge
+	}
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+	if inboxUsed()+int64(len(*&content)) > inboxCapacity {
+		return item, http.StatusInsufficientStorage
+	}
+	if !exist(inboxDir) {
+		err = createDir(inboxDir)
+		if err != nil {
+			log.Println(*&err)
+			return item, http.StatusInternalServerError
+		}
+	}
+	item = inboxItem{
+		Id:       randomString(12),
+		Name:     name,
+		Size:     int64(len(*&content)),
+		Type:     http.DetectContentType(*&content),
+		Sender:   r.URL.Query().Get("sender"),
+		From:     clientIP(*&r),
+		Received: milliseconds(time.Now()),
+	}
+	err = writeFile(inboxDir+"/"+item.Id, *&content, false)
+	if err != nil {
+		log.Println(*&err)
+		return item, http.StatusInternalServerError
+	}
+	j, err := json.Marshal(*&item)
+	if err != nil {
+		log.Println(*&err)
+		return item, http.StatusInternalServerError
+	}
+	metadata.put(inboxBucket, item.Id, string(*&j))
+	logInfo("Received", item.Name, "in the inbox from", item.From)
+	return item, http.StatusAccepted
+}
+
+// Moderators may write anywhere in the projects directory.
+func isModerator(r *http.Request) bool {
+	return !authEnabled() || allowed(requestUser(*&r), ".", opWrite)
+}
+
+//////// REQUEST HANDLERS
+
+//// Inbox API
+
+// Receive a file, or list, review, approve and reject quarantined ones
+func inboxHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if !inboxFlag {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := r.URL.Path[inboxPathLen:]
+	if r.Method == "POST" && id == "" {
+		// Send a file, named by the "name" parameter
+		item, status := receiveInbox(w, *&r)
+		if status != http.StatusAccepted {
+			w.WriteHeader(*&status)
+			return
+		}
+		writeJSON(w, *&status, inboxItem{Id: item.Id, Name: item.Name, Size: item.Size, Received: item.Received})
+		return
+	}
+	if !isModerator(*&r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, inboxItems())
+		return
+	}
+	item, ok := loadInboxItem(*&id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := inboxDir + "/" + item.Id
+
+	switch r.Method {
+	case "GET":
+		// Download a file for review, never displayed by the browser
+		content, err := readFile(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(item.Name))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(*&content)
+		return
+	case "PUT":
+		// Approve a file, moving it to the "destination" directory
+		dest, ok := uriToPath(r.Header.Get("destination"))
+		if !ok || r.Header.Get("destination") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if info, err := properties(*&dest); err != nil || !info.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		target := filepath.ToSlash(filepath.Join(*&dest, item.Name))
+		if authEnabled() && !allowed(requestUser(*&r), *&target, opWrite) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if exist(*&target) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		err := moveFile(*&p, *&target)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordCreation(*&target)
+		metadata.delete(inboxBucket, item.Id)
+		w.Header().Set("Location", pathToUri(*&target))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "DELETE":
+		// Reject a file
+		err := removeFile(*&p)
+		if err != nil && !os.IsNotExist(*&err) {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		metadata.delete(inboxBucket, item.Id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,74 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Storage taking its time to write, for requests to overlap.
+type slowStorage struct {
+	storage
+}
+
+func (s slowStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.storage.create(*&name, *&perm)
+}
+
+func (s slowStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.storage.createNew(*&name, *&perm)
+}
+
+func TestInboxCapacity(t *testing.T) {
+	h := newTestCloudOver(t, slowStorage{newMemStorage()})
+	inboxFlag, inboxTypesFlag = true, ".pdf"
+	inboxMaxSize, inboxCapacity = 100, 50
+	defer func() { inboxFlag, inboxTypesFlag, inboxMaxSize, inboxCapacity = false, "", 0, 0 }()
+
+	// Uploads received together still fit in the capacity
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serveTest(h, testRequest{"POST", "/inbox/?name=a.pdf", nil, "0123456789"})
+			mutex.Lock()
+			defer mutex.Unlock()
+			if w.Code == http.StatusAccepted {
+				accepted++
+			} else if w.Code != http.StatusInsufficientStorage {
+				t.Errorf("upload: %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 5 || inboxUsed() != 50 {
+		t.Errorf("accepted %d uploads, using %d bytes", accepted, inboxUsed())
+	}
+}
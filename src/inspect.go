@@ -0,0 +1,530 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+//////// DESIGN FILES INSPECTION
+
+// Read-only parsers for the design formats people drop in their projects,
+// giving the editor their layers, colors and a flattened preview.
+
+type designLayer struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Left    int    `json:"left"`
+	Top     int    `json:"top"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Opacity int    `json:"opacity"`
+	Visible bool   `json:"visible"`
+}
+
+type designColor struct {
+	Name   string    `json:"name"`
+	Group  string    `json:"group,omitempty"`
+	Model  string    `json:"model"`
+	Values []float64 `json:"values"`
+	Hex    string    `json:"hex,omitempty"`
+}
+
+type designInfo struct {
+	Format string        `json:"format"`
+	Width  int           `json:"width,omitempty"`
+	Height int           `json:"height,omitempty"`
+	Layers []designLayer `json:"layers,omitempty"`
+	Colors []designColor `json:"colors,omitempty"`
+}
+
+type inspector struct {
+	inspect func(content []byte) (designInfo, error)
+	// Flattened image as PNG, nil for formats without one
+	preview func(content []byte) ([]byte, error)
+}
+
+var errNoPreview = errors.New("design file has no preview")
+var errUnsupportedDesign = errors.New("unsupported design file variant")
+
+var inspectors = map[string]inspector{
+	".psd":    {inspectPSD, previewPSD},
+	".ase":    {inspectASE, nil},
+	".sketch": {inspectSketch, previewSketch},
+}
+
+func hexColor(r float64, g float64, b float64) string {
+	c := func(v float64) int { return int(math.Floor(math.Max(0, math.Min(1, v))*255 + 0.5)) }
+	return fmt.Sprintf("#%02x%02x%02x", c(r), c(g), c(b))
+}
+
+//// PSD
+
+// Photoshop documents, version 1 only: the large document format changes
+// the size of too many fields to be worth it.
+
+type psdReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *psdReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		r.err = errors.New("psd: truncated file")
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *psdReader) u8() int      { return int(r.bytes(1)[0]) }
+func (r *psdReader) u16() int     { return int(binary.BigEndian.Uint16(r.bytes(2))) }
+func (r *psdReader) i16() int     { return int(int16(binary.BigEndian.Uint16(r.bytes(2)))) }
+func (r *psdReader) u32() int     { return int(binary.BigEndian.Uint32(r.bytes(4))) }
+func (r *psdReader) i32() int     { return int(int32(binary.BigEndian.Uint32(r.bytes(4)))) }
+func (r *psdReader) skip(n int)   { r.bytes(*&n) }
+func (r *psdReader) section() int { n := r.u32(); return r.pos + n }
+
+type psdHeader struct {
+	channels int
+	height   int
+	width    int
+	depth    int
+	mode     int
+}
+
+const psdGrayscale = 1
+const psdRGB = 3
+
+func readPSDHeader(r *psdReader) (h psdHeader, err error) {
+	if string(r.bytes(4)) != "8BPS" {
+		return h, errors.New("psd: not a Photoshop document")
+	}
+	if r.u16() != 1 {
+		return h, errUnsupportedDesign
+	}
+	r.skip(6)
+	h = psdHeader{r.u16(), r.u32(), r.u32(), r.u16(), r.u16()}
+	// Color mode data, then image resources
+	r.pos = r.section()
+	r.pos = r.section()
+	return h, r.err
+}
+
+// Reads the layer records, leaving the reader at the end of the layer and
+// mask information section. The layer count is negative when the first
+// alpha channel of the merged image holds its transparency.
+func readPSDLayers(r *psdReader) (layers []designLayer, mergedAlpha bool, err error) {
+	end := r.section()
+	if end == r.pos {
+		return
+	}
+	infoEnd := r.section()
+	if infoEnd == r.pos {
+		r.pos = end
+		return
+	}
+	count := r.i16()
+	mergedAlpha = count < 0
+	if count < 0 {
+		count = -count
+	}
+	for i := 0; i < count && r.err == nil; i++ {
+		top, left, bottom, right := r.i32(), r.i32(), r.i32(), r.i32()
+		r.skip(r.u16() * 6)
+		r.skip(8)
+		l := designLayer{Kind: "layer", Left: left, Top: top, Width: right - left, Height: bottom - top}
+		l.Opacity = r.u8() * 100 / 255
+		r.u8()
+		l.Visible = r.u8()&0x02 == 0
+		r.u8()
+		extraEnd := r.section()
+		r.pos = r.section()
+		r.pos = r.section()
+		n := r.u8()
+		l.Name = string(r.bytes(*&n))
+		r.skip(3 - n%4)
+		divider := false
+		for r.pos+12 <= extraEnd && r.err == nil {
+			r.skip(4)
+			key := string(r.bytes(4))
+			blockEnd := r.section()
+			switch key {
+			case "luni":
+				// Unicode name, preferred over the legacy one
+				chars := make([]uint16, r.u32())
+				for j := range chars {
+					chars[j] = uint16(r.u16())
+				}
+				l.Name = strings.TrimRight(string(utf16.Decode(*&chars)), "\x00")
+			case "lsct", "lsdk":
+				switch r.u32() {
+				case 1, 2:
+					l.Kind = "group"
+				case 3:
+					divider = true
+				}
+			}
+			r.pos = blockEnd
+		}
+		r.pos = extraEnd
+		if !divider {
+			layers = append(*&layers, *&l)
+		}
+	}
+	// Stored from the bottom up, listed the way layer panels do
+	for i, j := 0, len(layers)-1; i < j; i, j = i+1, j-1 {
+		layers[i], layers[j] = layers[j], layers[i]
+	}
+	r.pos = end
+	err = r.err
+	return
+}
+
+func inspectPSD(content []byte) (info designInfo, err error) {
+	r := &psdReader{data: content}
+	h, err := readPSDHeader(*&r)
+	if err != nil {
+		return
+	}
+	info = designInfo{Format: "psd", Width: h.width, Height: h.height}
+	info.Layers, _, err = readPSDLayers(*&r)
+	return
+}
+
+// Decodes the merged image stored at the end of the document, which
+// Photoshop writes unless compatibility was turned off.
+func previewPSD(content []byte) (out []byte, err error) {
+	r := &psdReader{data: content}
+	h, err := readPSDHeader(*&r)
+	if err != nil {
+		return
+	}
+	_, mergedAlpha, err := readPSDLayers(*&r)
+	if err != nil {
+		return
+	}
+	if h.depth != 8 || (h.mode != psdRGB && h.mode != psdGrayscale) {
+		return nil, errUnsupportedDesign
+	}
+	if r.pos >= len(content) {
+		return nil, errNoPreview
+	}
+	plane := h.width * h.height
+	if plane <= 0 || plane > 1<<28 {
+		return nil, errors.New("psd: bad dimensions")
+	}
+	var pixels []byte
+	switch r.u16() {
+	case 0:
+		pixels = r.bytes(plane * h.channels)
+	case 1:
+		lengths := make([]int, h.height*h.channels)
+		for i := range lengths {
+			lengths[i] = r.u16()
+		}
+		for _, n := range lengths {
+			row, err := unpackBits(r.bytes(*&n))
+			if err != nil {
+				return nil, err
+			}
+			if len(row) != h.width {
+				return nil, errors.New("psd: bad row length")
+			}
+			pixels = append(*&pixels, row...)
+		}
+	default:
+		return nil, errUnsupportedDesign
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	colors := 3
+	if h.mode == psdGrayscale {
+		colors = 1
+	}
+	if h.channels < colors {
+		return nil, errors.New("psd: missing channels")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, h.height))
+	for i := 0; i < plane; i++ {
+		px := img.Pix[i*4 : i*4+4]
+		if colors == 1 {
+			px[0], px[1], px[2] = pixels[i], pixels[i], pixels[i]
+		} else {
+			px[0], px[1], px[2] = pixels[i], pixels[plane+i], pixels[2*plane+i]
+		}
+		px[3] = 255
+		if mergedAlpha && h.channels > colors {
+			px[3] = pixels[colors*plane+i]
+		}
+	}
+	var b bytes.Buffer
+	err = png.Encode(&b, *&img)
+	out = b.Bytes()
+	return
+}
+
+//// ASE
+
+// Adobe swatch exchange files, as exported by most design tools.
+
+const aseGroupStart = 0xc001
+const aseGroupEnd = 0xc002
+const aseColor = 0x0001
+
+func aseString(r *psdReader) string {
+	chars := make([]uint16, r.u16())
+	for i := range chars {
+		chars[i] = uint16(r.u16())
+	}
+	return strings.TrimRight(string(utf16.Decode(*&chars)), "\x00")
+}
+
+func inspectASE(content []byte) (info designInfo, err error) {
+	r := &psdReader{data: content}
+	if string(r.bytes(4)) != "ASEF" {
+		return info, errors.New("ase: not a swatch exchange file")
+	}
+	r.skip(4)
+	info = designInfo{Format: "ase"}
+	group := ""
+	for blocks := r.u32(); blocks > 0 && r.err == nil; blocks-- {
+		typ := r.u16()
+		end := r.section()
+		switch typ {
+		case aseGroupStart:
+			group = aseString(*&r)
+		case aseGroupEnd:
+			group = ""
+		case aseColor:
+			c := designColor{Name: aseString(*&r), Group: group}
+			c.Model = strings.TrimSpace(string(r.bytes(4)))
+			n := map[string]int{"RGB": 3, "CMYK": 4, "LAB": 3, "Gray": 1}[c.Model]
+			for i := 0; i < n; i++ {
+				c.Values = append(c.Values, float64(math.Float32frombits(uint32(r.u32()))))
+			}
+			v := c.Values
+			switch c.Model {
+			case "RGB":
+				c.Hex = hexColor(v[0], v[1], v[2])
+			case "Gray":
+				c.Hex = hexColor(v[0], v[0], v[0])
+			case "CMYK":
+				c.Hex = hexColor((1-v[0])*(1-v[3]), (1-v[1])*(1-v[3]), (1-v[2])*(1-v[3]))
+			}
+			info.Colors = append(info.Colors, *&c)
+		}
+		r.pos = end
+	}
+	err = r.err
+	return
+}
+
+//// Sketch
+
+// Sketch documents are zip archives of JSON files, with a preview image.
+
+func readSketchFile(z *zip.Reader, name string, v interface{}) (err error) {
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		content, err := ioutil.ReadAll(*&rc)
+		if err != nil {
+			return err
+		}
+		if b, ok := v.(*[]byte); ok {
+			*b = content
+			return nil
+		}
+		return json.Unmarshal(*&content, *&v)
+	}
+	return os.ErrNotExist
+}
+
+func inspectSketch(content []byte) (info designInfo, err error) {
+	z, err := zip.NewReader(bytes.NewReader(*&content), int64(len(content)))
+	if err != nil {
+		return
+	}
+	var meta struct {
+		PagesAndArtboards map[string]struct {
+			Name      string `json:"name"`
+			Artboards map[string]struct {
+				Name string `json:"name"`
+			} `json:"artboards"`
+		} `json:"pagesAndArtboards"`
+	}
+	err = readSketchFile(*&z, "meta.json", &meta)
+	if err != nil {
+		return
+	}
+	info = designInfo{Format: "sketch"}
+	// Maps have no order, pages and their artboards are sorted by name
+	pages := make([]string, 0, len(meta.PagesAndArtboards))
+	for id := range meta.PagesAndArtboards {
+		pages = append(pages, id)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return meta.PagesAndArtboards[pages[i]].Name < meta.PagesAndArtboards[pages[j]].Name
+	})
+	for _, id := range pages {
+		page := meta.PagesAndArtboards[id]
+		info.Layers = append(info.Layers, designLayer{Name: page.Name, Kind: "page", Opacity: 100, Visible: true})
+		var artboards []string
+		for _, a := range page.Artboards {
+			artboards = append(artboards, a.Name)
+		}
+		sort.Strings(artboards)
+		for _, a := range artboards {
+			info.Layers = append(info.Layers, designLayer{Name: a, Kind: "artboard", Opacity: 100, Visible: true})
+		}
+	}
+
+	var document struct {
+		Assets struct {
+			ColorAssets []struct {
+				Name  string `json:"name"`
+				Color struct {
+					Red   float64 `json:"red"`
+					Green float64 `json:"green"`
+					Blue  float64 `json:"blue"`
+				} `json:"color"`
+			} `json:"colorAssets"`
+		} `json:"assets"`
+	}
+	err = readSketchFile(*&z, "document.json", &document)
+	if err != nil {
+		return
+	}
+	for _, a := range document.Assets.ColorAssets {
+		c := a.Color
+		info.Colors = append(info.Colors, designColor{
+			Name:   a.Name,
+			Model:  "RGB",
+			Values: []float64{c.Red, c.Green, c.Blue},
+			Hex:    hexColor(c.Red, c.Green, c.Blue),
+		})
+	}
+	return
+}
+
+func previewSketch(content []byte) (out []byte, err error) {
+	z, err := zip.NewReader(bytes.NewReader(*&content), int64(len(content)))
+	if err != nil {
+		return
+	}
+	err = readSketchFile(*&z, "previews/preview.png", &out)
+	if os.IsNotExist(*&err) {
+		err = errNoPreview
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Inspect API
+
+// Describe the layers and colors of a design file, or render its preview
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[inspectPathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	in, ok := inspectors[strings.ToLower(filepath.Ext(*&p))]
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	content, err := readFile(*&p)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("preview") == "true" {
+		if in.preview == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		out, err := in.preview(*&content)
+		if err == errNoPreview {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == errUnsupportedDesign {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(*&out)
+		return
+	}
+
+	info, err := in.inspect(*&content)
+	if err == errUnsupportedDesign {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&info)
+}
@@ -0,0 +1,93 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//////// INSTANCE LOCK
+
+// A lock file in the projects directory keeps two instances from serving
+// the same root, whose watchers would duplicate events and whose saves
+// would race. It names the process and address of the instance holding
+// it, and is taken over once that process is gone.
+
+const lockFile = hiddenPrefix + "lock"
+const lockWriteDelay = 5 * time.Second
+
+type instanceLock struct {
+	Pid     int    `json:"pid"`
+	Address string `json:"address"`
+	Started string `json:"started"`
+}
+
+func readLock() (l instanceLock, err error) {
+	content, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(*&content, &l)
+	return
+}
+
+// Takes the lock of the projects directory, the current one, returning the
+// function releasing it.
+func acquireLock(address string) (release func(), err error) {
+	content, err := json.Marshal(instanceLock{os.Getpid(), *&address, time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return
+	}
+	for {
+		f, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = writeAndClose(*&f, *&content)
+			if err != nil {
+				os.Remove(lockFile)
+				return nil, err
+			}
+			return func() { os.Remove(lockFile) }, nil
+		}
+		if !os.IsExist(*&err) {
+			return nil, err
+		}
+		held, err := readLock()
+		if info, serr := os.Stat(lockFile); err != nil && serr == nil && time.Since(info.ModTime()) < lockWriteDelay {
+			// Just created by another instance, which has yet to fill it in
+			return nil, errors.New("the projects are being locked by another instance")
+		}
+		// A restart replaces the process but keeps its identifier
+		if err == nil && held.Pid != os.Getpid() && processAlive(held.Pid) {
+			return nil, fmt.Errorf("the projects are already served by process %d on %s, stop it first", held.Pid, held.Address)
+		}
+		if err == nil && held.Pid != os.Getpid() {
+			logWarn("Taking over the lock left by process", held.Pid)
+		}
+		err = os.Remove(lockFile)
+		if err != nil && !os.IsNotExist(*&err) {
+			return nil, err
+		}
+	}
+}
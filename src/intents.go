@@ -0,0 +1,205 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//////// INTENT JOURNAL
+
+// Operations made of several steps record what they are about to do in a
+// file of their own before starting, and remove it once done. A crash in
+// between leaves the record behind, and the next start rolls the operation
+// back or completes it, whichever leaves the tree whole: a directory moved
+// across filesystems is either back where it was or entirely moved, never
+// both half there.
+
+const intentsDir = hiddenPrefix + "intents"
+
+const (
+	// Copy then removal of the source, across filesystems
+	intentMove = "move"
+	// Rename through a temporary name
+	intentRenameCase = "rename-case"
+	// File written under a temporary name, then renamed over the original
+	intentReplace = "replace"
+	// Copy of a project into its publish directory, then processed
+	intentPublish = "publish"
+)
+
+const (
+	phaseCopying  = "copying"
+	phaseRemoving = "removing"
+)
+
+type intent struct {
+	Id        string `json:"id"`
+	Operation string `json:"operation"`
+	Source    string `json:"source,omitempty"`
+	Dest      string `json:"dest"`
+	Temp      string `json:"temp,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	Started   string `json:"started"`
+}
+
+func (i *intent) path() string {
+	return filepath.Join(intentsDir, i.Id+".json")
+}
+
+// Records the intent durably, before the operation does anything.
+func (i *intent) save() (err error) {
+	content, err := json.Marshal(*i)
+	if err != nil {
+		return
+	}
+	f, err := fsys.create(i.path(), 0666)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(*&content)
+	if s, ok := f.(syncer); ok && err == nil {
+		err = s.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+func beginIntent(operation string, source string, dest string, temp string, phase string) (i *intent, err error) {
+	err = fsys.mkdirAll(intentsDir, 0777)
+	if err != nil {
+		return
+	}
+	i = &intent{
+		Id:        randomString(12),
+		Operation: operation,
+		Source:    source,
+		Dest:      dest,
+		Temp:      temp,
+		Phase:     phase,
+		Started:   milliseconds(time.Now()),
+	}
+	err = i.save()
+	return
+}
+
+// Records that the operation reached another phase.
+func (i *intent) advance(phase string) error {
+	i.Phase = phase
+	return i.save()
+}
+
+// Forgets the intent, the operation having ended, well or not.
+func (i *intent) end() {
+	if err := fsys.remove(i.path()); err != nil {
+		logWarn("Could not remove the intent record", i.path()+":", err)
+	}
+}
+
+// Moves by copying then removing the source, for moves across filesystems.
+func journaledMove(source string, dest string, copy func() error, remove func() error) (err error) {
+	i, err := beginIntent(intentMove, *&source, *&dest, "", phaseCopying)
+	if err != nil {
+		return
+	}
+	defer i.end()
+	err = copy()
+	if err == nil {
+		err = i.advance(phaseRemoving)
+	}
+	if err == nil {
+		err = remove()
+	}
+	return
+}
+
+// Rolls back or completes an interrupted operation.
+func (i *intent) recover() (err error) {
+	switch i.Operation {
+	case intentMove:
+		if i.Phase == phaseRemoving {
+			// The copy is whole, the source goes
+			logWarn("Completing the interrupted move of", i.Source, "to", i.Dest)
+			return fsys.removeAll(i.Source)
+		}
+		logWarn("Rolling back the interrupted move of", i.Source, "to", i.Dest)
+		return fsys.removeAll(i.Dest)
+	case intentRenameCase:
+		if _, err := fsys.stat(i.Temp); err != nil {
+			return nil
+		}
+		target := i.Dest
+		if exist(*&target) {
+			target = i.Source
+		}
+		logWarn("Completing the interrupted rename of", i.Source, "to", *&target)
+		return fsys.rename(i.Temp, *&target)
+	case intentReplace:
+		if _, err := fsys.stat(i.Temp); err != nil {
+			return nil
+		}
+		logWarn("Rolling back the interrupted save of", i.Dest)
+		return fsys.remove(i.Temp)
+	case intentPublish:
+		logWarn("Removing the interrupted publication", i.Dest)
+		return fsys.removeAll(i.Dest)
+	}
+	logWarn("Unknown interrupted operation", i.Operation, "on", i.Dest)
+	return nil
+}
+
+// Deals with the operations interrupted by the previous run, keeping the
+// records of those which could not be dealt with for the next start.
+func recoverIntents() {
+	entries, err := fsys.readDir(intentsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		p := filepath.Join(intentsDir, entry.Name())
+		content, err := readFile(*&p)
+		if err != nil {
+			log.Println(*&err)
+			continue
+		}
+		var i intent
+		if err = json.Unmarshal(*&content, &i); err != nil {
+			logWarn("Removing the unreadable intent record", *&p)
+			fsys.remove(*&p)
+			continue
+		}
+		err = i.recover()
+		if err != nil && !os.IsNotExist(*&err) {
+			logWarn("Could not recover the interrupted", i.Operation, "of", i.Dest+":", err)
+			continue
+		}
+		fsys.remove(*&p)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////// IO/FS STORAGE
+
+// Serves any io/fs file system, such as the embedded assets or a ZIP
+// archive, through the storage primitives, so that the listings and reads
+// of the cloud work on them as on directories. They are read-only.
+
+const embeddedPrefix = "embedded:"
+
+type fsStorage struct {
+	files fs.FS
+}
+
+// Name of a storage path in io/fs, slash separated and unrooted.
+func fsName(name string) string {
+	return filepath.ToSlash(filepath.Clean(*&name))
+}
+
+func readOnlyError(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+}
+
+func (s fsStorage) stat(name string) (os.FileInfo, error) {
+	return fs.Stat(s.files, fsName(*&name))
+}
+
+func (s fsStorage) readDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(s.files, fsName(*&name))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]os.FileInfo, 0, len(*&entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		list = append(*&list, *&info)
+	}
+	sort.Slice(*&list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (s fsStorage) open(name string) (io.ReadCloser, error) {
+	return s.files.Open(fsName(*&name))
+}
+
+func (s fsStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return nil, readOnlyError("open", *&name)
+}
+
+func (s fsStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if _, err := s.stat(*&name); err == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	return nil, readOnlyError("open", *&name)
+}
+
+func (s fsStorage) mkdirAll(name string, perm os.FileMode) error {
+	if info, err := s.stat(*&name); err == nil && info.IsDir() {
+		return nil
+	}
+	return readOnlyError("mkdir", *&name)
+}
+
+func (s fsStorage) remove(name string) error {
+	return readOnlyError("remove", *&name)
+}
+
+func (s fsStorage) removeAll(name string) error {
+	return readOnlyError("remove", *&name)
+}
+
+func (s fsStorage) rename(source string, dest string) error {
+	return &os.LinkError{Op: "rename", Old: source, New: dest, Err: os.ErrPermission}
+}
+
+func (s fsStorage) chmod(name string, mode os.FileMode) error {
+	return readOnlyError("chmod", *&name)
+}
+
+// Read-only storage of a directory, a ZIP archive, or a directory of the
+// embedded assets given as embedded:templates for instance. Archives stay
+// open for the life of the process.
+func readOnlyBase(p string) (storage, error) {
+	if strings.HasPrefix(*&p, embeddedPrefix) {
+		dir := strings.TrimPrefix(*&p, embeddedPrefix)
+		if _, err := fs.Stat(assets(), *&dir); err != nil {
+			return nil, err
+		}
+		return fsStorage{assetsSub(*&dir)}, nil
+	}
+	base, err := filepath.Abs(*&p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(*&base)) == ".zip" {
+		z, err := zip.OpenReader(*&base)
+		if err != nil {
+			return nil, err
+		}
+		return fsStorage{&z.Reader}, nil
+	}
+	return diskStorage{base}, nil
+}
@@ -0,0 +1,113 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//////// NETWORK SAFETY
+
+var allowedNets []*net.IPNet
+
+// Parses the comma separated list of CIDR blocks (or single addresses) the
+// clients are allowed to connect from.
+func parseAllowedIPs(list string) (nets []*net.IPNet, err error) {
+	for _, s := range strings.Split(*&list, ",") {
+		s = strings.TrimSpace(*&s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(*&s, "/") {
+			ip := net.ParseIP(*&s)
+			if ip == nil {
+				return nil, errors.New("invalid address " + s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(*&s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(*&nets, *&n)
+	}
+	return
+}
+
+func isAllowedIP(ip net.IP) bool {
+	if len(allowedNets) == 0 {
+		return true
+	}
+	for _, n := range allowedNets {
+		if n.Contains(*&ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopbackInterface(host string) bool {
+	if host == "" {
+		// Every interface
+		return false
+	}
+	ips, err := net.LookupIP(*&host)
+	if err != nil || len(*&ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuses to expose the filesystem to the network without authentication.
+func checkBindSafety(host string) error {
+	if isLoopbackInterface(*&host) || authEnabled() || insecureFlag {
+		return nil
+	}
+	return errors.New("refusing to listen on non-loopback interface \"" + host + "\" without authentication, set -token or use -insecure")
+}
+
+//////// MIDDLEWARES
+
+func ipFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Local connections, already restricted by the socket permissions
+		if isUnixRequest(*&r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !isAllowedIP(net.ParseIP(clientIP(*&r))) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,252 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////// BACKGROUND JOBS
+
+// Long operations started by a request and followed by polling, so that
+// neither the browser nor the request timeouts have to wait for them.
+
+const jobRetention = time.Hour
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+type job struct {
+	Id       string  `json:"id"`
+	Kind     string  `json:"kind"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+	Source   string  `json:"source,omitempty"`
+	Result   string  `json:"result,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Started  string  `json:"started"`
+	Finished string  `json:"finished,omitempty"`
+	// Stopped by a soft restart, to be started again by the client
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	user     string
+	cancel   context.CancelFunc
+	finished time.Time
+}
+
+type jobRegistry struct {
+	mutex sync.Mutex
+	next  int
+	jobs  map[string]*job
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*job)}
+
+// Runs a job in the background, detached from the request which started
+// it but carrying its user. The run function returns the URI of the result.
+func startJob(r *http.Request, kind string, source string, run func(ctx context.Context, j *job) (string, error)) job {
+	return startUserJob(requestUser(*&r), *&kind, *&source, *&run)
+}
+
+func startUserJob(user string, kind string, source string, run func(ctx context.Context, j *job) (string, error)) job {
+	ctx, cancel := context.WithCancel(backgroundContext)
+	ctx = context.WithValue(*&ctx, userContextKey, *&user)
+	jobs.mutex.Lock()
+	jobs.prune()
+	jobs.next++
+	j := &job{
+		Id:      strconv.Itoa(jobs.next),
+		Kind:    kind,
+		State:   jobQueued,
+		Source:  source,
+		Started: milliseconds(time.Now()),
+		user:    user,
+		cancel:  cancel,
+	}
+	jobs.jobs[j.Id] = j
+	snapshot := *j
+	jobs.mutex.Unlock()
+
+	go func() {
+		defer cancel()
+		started := time.Now()
+		result, err := run(*&ctx, *&j)
+		jobs.mutex.Lock()
+		defer func() {
+			ended := *j
+			jobs.mutex.Unlock()
+			notifyJob(*&ended, *&started)
+		}()
+		j.finished = time.Now()
+		j.Finished = milliseconds(j.finished)
+		switch {
+		case ctx.Err() == context.Canceled:
+			j.State = jobCanceled
+		case err != nil:
+			j.State = jobFailed
+			j.Error = err.Error()
+		default:
+			j.State = jobDone
+			j.Progress = 1
+			j.Result = result
+		}
+	}()
+	return snapshot
+}
+
+func (j *job) setState(state string) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	j.State = state
+}
+
+func (j *job) setProgress(progress float64) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	j.Progress = progress
+}
+
+// Forgets jobs finished for a while. Called with the registry locked.
+func (reg *jobRegistry) prune() {
+	for id, j := range reg.jobs {
+		if !j.finished.IsZero() && time.Since(j.finished) > jobRetention {
+			delete(reg.jobs, *&id)
+		}
+	}
+}
+
+func (reg *jobRegistry) get(id string) (j job, ok bool) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	found, ok := reg.jobs[id]
+	if ok {
+		j = *found
+	}
+	return
+}
+
+// Jobs are only shown to the user who started them, and to the owner.
+func (reg *jobRegistry) visible(r *http.Request) (list []job) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.prune()
+	list = []job{}
+	user := requestUser(*&r)
+	for _, j := range reg.jobs {
+		if !authEnabled() || user == ownerUser || j.user == user {
+			list = append(*&list, *j)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		x, _ := strconv.Atoi(list[a].Id)
+		y, _ := strconv.Atoi(list[b].Id)
+		return x < y
+	})
+	return
+}
+
+// Waits for the jobs in progress to finish, canceling those still running
+// after the timeout, whose identifiers are returned.
+func (reg *jobRegistry) drain(timeout time.Duration) (interrupted []string) {
+	deadline := time.Now().Add(*&timeout)
+	canceled := make(map[string]bool)
+	for {
+		reg.mutex.Lock()
+		running := 0
+		for id, j := range reg.jobs {
+			if !j.finished.IsZero() {
+				if canceled[id] && j.State == jobCanceled {
+					j.Error = "interrupted by a restart"
+					j.Interrupted = true
+				}
+				continue
+			}
+			running++
+			if time.Now().After(*&deadline) && !canceled[id] {
+				canceled[id] = true
+				j.cancel()
+			}
+		}
+		reg.mutex.Unlock()
+		// Jobs ignoring their cancellation are left behind
+		if running == 0 || time.Now().After(deadline.Add(shutdownTimeout)) {
+			for id := range canceled {
+				interrupted = append(*&interrupted, *&id)
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Jobs API
+
+// List the jobs, read the state of one, or cancel it
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	id := r.URL.Path[jobsPathLen:]
+	list := jobs.visible(*&r)
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&list)
+		return
+	}
+	var found *job
+	for i := range list {
+		if list[i].Id == id {
+			found = &list[i]
+		}
+	}
+	if found == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, *found)
+		return
+	case "DELETE":
+		jobs.mutex.Lock()
+		j := jobs.jobs[id]
+		jobs.mutex.Unlock()
+		if j != nil {
+			j.cancel()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,252 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//////// CHANGE JOURNAL
+
+// Numbered list of the latest changes made to the projects, letting
+// clients ask for what changed since the last change they saw. It is kept
+// on disk along with the last scan of the watcher, so that cursors stay
+// valid across restarts.
+
+const journalSize = 10000
+const journalFile = hiddenPrefix + "journal.json"
+const journalFlushInterval = 5 * time.Second
+
+type change struct {
+	Cursor int64  `json:"cursor"`
+	Event  string `json:"event"`
+	Type   string `json:"type"`
+	Uri    string `json:"uri"`
+	Date   string `json:"date"`
+}
+
+type changeJournal struct {
+	mutex   sync.Mutex
+	changes []change
+	cursor  int64
+	scan    map[string]fileState
+	dirty   bool
+	// Changes dropped to keep the journal within its size since startup
+	dropped int64
+	// Closed and replaced whenever changes are appended
+	changed chan struct{}
+}
+
+type journalContent struct {
+	Cursor   int64                `json:"cursor"`
+	Changes  []change             `json:"changes"`
+	LastScan map[string]fileState `json:"lastScan"`
+}
+
+var journal = &changeJournal{changed: make(chan struct{})}
+
+func (j *changeJournal) append(event string, kind string, p string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.cursor++
+	j.changes = append(j.changes, change{j.cursor, *&event, *&kind, pathToUri(*&p), milliseconds(time.Now())})
+	if len(j.changes) > journalSize {
+		j.dropped += int64(len(j.changes) - journalSize)
+		j.changes = j.changes[len(j.changes)-journalSize:]
+	}
+	j.dirty = true
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *changeJournal) lastScan() map[string]fileState {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.scan
+}
+
+func (j *changeJournal) setLastScan(scan map[string]fileState) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.scan = scan
+	j.dirty = true
+}
+
+func (j *changeJournal) droppedChanges() int64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.dropped
+}
+
+func (j *changeJournal) latest() int64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.cursor
+}
+
+// Returns the changes following a cursor. Fails when some of them were
+// already dropped from the journal, in which case clients have to rescan.
+func (j *changeJournal) since(cursor int64) (changes []change, latest int64, ok bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	changes = []change{}
+	latest = j.cursor
+	if cursor > j.cursor || len(j.changes) > 0 && cursor < j.changes[0].Cursor-1 {
+		return changes, latest, false
+	}
+	for _, c := range j.changes {
+		if c.Cursor > cursor {
+			changes = append(*&changes, *&c)
+		}
+	}
+	return changes, latest, true
+}
+
+// Same as since, waiting for changes to happen up to a timeout or until
+// done is closed when there are none yet.
+func (j *changeJournal) wait(cursor int64, timeout time.Duration, done <-chan struct{}) (changes []change, latest int64, ok bool) {
+	timer := time.NewTimer(*&timeout)
+	defer timer.Stop()
+	for {
+		j.mutex.Lock()
+		changed := j.changed
+		j.mutex.Unlock()
+		changes, latest, ok = j.since(*&cursor)
+		if len(*&changes) > 0 || !ok {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Calls back with every batch of changes appended from now on, for the
+// subsystems forwarding them elsewhere.
+func followJournal(callback func(latest int64, changes []change)) {
+	go func() {
+		cursor := journal.latest()
+		for {
+			changes, latest, ok := journal.wait(*&cursor, time.Minute, nil)
+			if !ok {
+				log.Println("Fell behind the change journal, skipping to", *&latest)
+			}
+			cursor = latest
+			if len(*&changes) > 0 {
+				callback(*&latest, *&changes)
+			}
+		}
+	}()
+}
+
+//// Filters
+
+// Selection of changes by path and event, for the subscribers configured
+// in the config file.
+type eventFilter struct {
+	// Glob of the paths relative to the projects directory, also matching
+	// the content of the directories it matches; everything if empty
+	Pattern string `json:"pattern"`
+	// created, modified or removed; all of them if empty
+	Events []string `json:"events"`
+}
+
+func (f *eventFilter) matches(c change) bool {
+	if len(f.Events) > 0 && !sliceContains(f.Events, c.Event) {
+		return false
+	}
+	if f.Pattern == "" {
+		return true
+	}
+	p, ok := uriToPath(c.Uri)
+	if !ok {
+		return false
+	}
+	for p = filepath.ToSlash(*&p); p != "." && p != "/"; p = path.Dir(*&p) {
+		if ok, _ := path.Match(f.Pattern, *&p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//// Persistence
+
+func loadJournal() (err error) {
+	content, err := readFile(journalFile)
+	if os.IsNotExist(*&err) {
+		err = nil
+	} else if err == nil {
+		var c journalContent
+		err = json.Unmarshal(*&content, &c)
+		if err == nil {
+			journal.mutex.Lock()
+			journal.cursor, journal.changes, journal.scan = c.Cursor, c.Changes, c.LastScan
+			journal.mutex.Unlock()
+		}
+	}
+	if err != nil {
+		return
+	}
+	go func() {
+		for range time.Tick(journalFlushInterval) {
+			err := journal.flush()
+			if err != nil {
+				log.Println(*&err)
+			}
+		}
+	}()
+	return
+}
+
+func (j *changeJournal) flush() (err error) {
+	j.mutex.Lock()
+	if !j.dirty {
+		j.mutex.Unlock()
+		return
+	}
+	content, err := json.Marshal(journalContent{j.cursor, j.changes, j.scan})
+	j.dirty = false
+	j.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	// Write then rename, so that a crash never leaves a truncated journal
+	err = saveFile(journalFile+".tmp", *&content)
+	if err == nil {
+		err = moveFile(journalFile+".tmp", journalFile)
+	}
+	if err != nil {
+		j.mutex.Lock()
+		j.dirty = true
+		j.mutex.Unlock()
+	}
+	return
+}
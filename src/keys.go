@@ -0,0 +1,201 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//////// API KEYS
+
+// Named bearer tokens users issue for their tools and devices, each one
+// limited to some scopes and revocable on its own. They act on behalf of
+// the user who issued them, and are accepted by the token scheme. Only a
+// digest of their secret is kept.
+
+const keysBucket = "keys"
+const keyPrefix = "nk."
+
+// Last use dates are recorded at most this often, sparing the store.
+const keyUseResolution = time.Minute
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+type apiKey struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	User     string   `json:"user"`
+	Scopes   []string `json:"scopes"`
+	Created  string   `json:"created"`
+	LastUsed string   `json:"lastUsed,omitempty"`
+	Digest   string   `json:"digest,omitempty"`
+	// Only returned when issued
+	Key string `json:"key,omitempty"`
+}
+
+func keyDigest(secret string) string {
+	sum := sha256.Sum256([]byte(*&secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadKey(id string) (k apiKey, ok bool) {
+	v, ok := metadata.get(keysBucket, *&id)
+	if !ok || json.Unmarshal([]byte(*&v), &k) != nil {
+		return k, false
+	}
+	return k, true
+}
+
+func saveKey(k apiKey) {
+	j, err := json.Marshal(*&k)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	metadata.put(keysBucket, k.Id, string(*&j))
+}
+
+// Key a token stands for, recording its use.
+func findKey(token string) (k apiKey, ok bool) {
+	if !strings.HasPrefix(*&token, keyPrefix) {
+		return
+	}
+	parts := strings.SplitN(token[len(keyPrefix):], ".", 2)
+	if len(parts) != 2 {
+		return
+	}
+	k, ok = loadKey(parts[0])
+	if !ok || !secureEquals(keyDigest(parts[1]), k.Digest) {
+		return k, false
+	}
+	now := time.Now()
+	if k.LastUsed == "" || now.Sub(parseMilliseconds(k.LastUsed)) >= keyUseResolution {
+		k.LastUsed = milliseconds(*&now)
+		saveKey(*&k)
+	}
+	return
+}
+
+// Keys of a user, or all of them for the owner, without their digest.
+func listKeys(user string) (list []apiKey) {
+	list = []apiKey{}
+	for _, id := range metadata.keys(keysBucket, ".") {
+		k, ok := loadKey(*&id)
+		if ok && (user == ownerUser || k.User == user) {
+			k.Digest = ""
+			list = append(list, k)
+		}
+	}
+	return
+}
+
+func issueKey(user string, name string, scopes []string) (k apiKey) {
+	secret := randomString(24)
+	k = apiKey{
+		Id:      randomString(9),
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Created: milliseconds(time.Now()),
+		Digest:  keyDigest(*&secret),
+	}
+	saveKey(*&k)
+	k.Digest = ""
+	k.Key = keyPrefix + k.Id + "." + secret
+	return
+}
+
+// Scope a request needs: admin for the administration routes, read for
+// reads and write for everything else.
+func requiredScope(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return scopeAdmin
+	}
+	if methodOperation(r.Method) == opRead {
+		return scopeRead
+	}
+	return scopeWrite
+}
+
+// Whether a request made with an API key stays within its scopes.
+func keyPermits(r *http.Request) bool {
+	k, ok := findKey(requestToken(*&r))
+	if !ok {
+		return true
+	}
+	scope := requiredScope(*&r)
+	return sliceContains(k.Scopes, *&scope) || sliceContains(k.Scopes, scopeAdmin)
+}
+
+//////// REQUEST HANDLERS
+
+//// Keys API
+
+// List, issue or revoke the API keys of the user
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	id := r.URL.Path[keysPathLen:]
+	user := requestUser(*&r)
+	if !authEnabled() {
+		user = ownerUser
+	}
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, http.StatusOK, listKeys(*&user))
+		return
+	case r.Method == "POST" && id == "":
+		var params struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Name == "" || len(params.Scopes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, s := range params.Scopes {
+			if s != scopeRead && s != scopeWrite && s != scopeAdmin {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, http.StatusCreated, issueKey(*&user, params.Name, params.Scopes))
+		return
+	case r.Method == "DELETE" && id != "":
+		k, ok := loadKey(*&id)
+		if !ok || user != ownerUser && k.User != user {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		metadata.delete(keysBucket, *&id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
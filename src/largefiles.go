@@ -0,0 +1,94 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+//////// LARGE FILES
+
+// Files above this size are streamed from the storage backend instead of
+// being read into memory first. With the disk backend, they end up being
+// handed to the kernel through sendfile.
+const streamThreshold = 1 << 20
+
+// Revisions of large files, cached along with the size and modification
+// time they were computed for.
+const revisionBucket = "revision"
+
+// Same as contentRevision, without holding the whole file in memory.
+func fileRevision(p string, info os.FileInfo) (revision string, err error) {
+	// Computed again when the algorithm changes
+	stamp := fmt.Sprintf("%d %d %s ", info.Size(), info.ModTime().UnixNano(), revisionHashFlag)
+	key := metadataKey(*&p)
+	if metadata != nil {
+		if v, ok := metadata.get(revisionBucket, *&key); ok && len(*&v) > len(*&stamp) && v[:len(stamp)] == stamp {
+			return v[len(stamp):], nil
+		}
+	}
+	f, err := fsys.open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := revisionHash()
+	_, err = io.Copy(*&h, *&f)
+	if err != nil {
+		return
+	}
+	revision = hex.EncodeToString(h.Sum(nil))
+	if metadata != nil {
+		metadata.put(revisionBucket, *&key, stamp+revision)
+	}
+	return
+}
+
+func serveLargeFile(w http.ResponseWriter, r *http.Request, p string, info os.FileInfo) (err error) {
+	revision, err := fileRevision(*&p, *&info)
+	if err != nil {
+		return
+	}
+	f, err := fsys.open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w.Header().Set("revision", *&revision)
+	if rs, ok := f.(io.ReadSeeker); ok {
+		// Also answers range requests
+		http.ServeContent(w, r, info.Name(), info.ModTime(), *&rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	_, cerr := io.Copy(w, *&f)
+	if cerr != nil {
+		// Too late to report it to the client
+		log.Println(*&cerr)
+	}
+	return
+}
@@ -0,0 +1,266 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//////// ASSET LIBRARIES
+
+// Read-only directories of shared assets, copied into projects on use.
+
+var errLibraryNotFound = errors.New("library not found")
+
+type library struct {
+	name string
+	fs   storage
+}
+
+var libraries []library
+
+func parseLibraries(dirs string) (libs []library, err error) {
+	for _, d := range strings.Split(*&dirs, ",") {
+		d = strings.TrimSpace(*&d)
+		if d == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*&d)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(*&abs)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New(abs + " is not a directory")
+		}
+		libs = append(*&libs, library{filepath.Base(*&abs), diskStorage{abs}})
+	}
+	return
+}
+
+// Splits a library URI into the library and a path inside of it.
+func findLibraryAsset(uri string) (lib library, p string, err error) {
+	uri = strings.Trim(path.Clean("/"+uri), "/")
+	name := uri
+	p = "."
+	if i := strings.Index(*&uri, "/"); i >= 0 {
+		name, p = uri[:i], uri[i+1:]
+	}
+	for _, l := range libraries {
+		if l.name == name {
+			return l, p, nil
+		}
+	}
+	return lib, p, errLibraryNotFound
+}
+
+type libraryEntry struct {
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	Uri          string `json:"uri"`
+	ModifiedDate string `json:"modifiedDate"`
+	Size         string `json:"size"`
+}
+
+func (l library) list(p string) (entries []libraryEntry, err error) {
+	infos, err := l.fs.readDir(*&p)
+	if err != nil {
+		return
+	}
+	entries = []libraryEntry{}
+	for _, i := range infos {
+		if strings.HasPrefix(i.Name(), ".") {
+			continue
+		}
+		t := "file"
+		if i.IsDir() {
+			t = "directory"
+		}
+		uri := basePathFlag + path.Join(libraryPath, l.name, filepath.ToSlash(*&p), i.Name())
+		entries = append(*&entries, libraryEntry{t, i.Name(), uri, milliseconds(i.ModTime()), strconv.FormatInt(i.Size(), 10)})
+	}
+	return
+}
+
+// Copies an asset, or a whole directory of them, into a project.
+func (l library) copyInto(p string, dest string) (err error) {
+	info, err := l.fs.stat(*&p)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		err = createDir(*&dest)
+		if err != nil {
+			return
+		}
+		entries, err := l.fs.readDir(*&p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			err = l.copyInto(filepath.Join(*&p, e.Name()), filepath.Join(*&dest, e.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	f, err := l.fs.open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(*&f)
+	if err != nil {
+		return
+	}
+	err = saveFile(*&dest, *&content)
+	return
+}
+
+// Inserts an asset into the directory of a project, returning where it
+// landed.
+func insertLibraryAsset(lib library, p string, dir string) (dest string, err error) {
+	if p == "." {
+		return "", os.ErrInvalid
+	}
+	info, err := properties(*&dir)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return "", os.ErrInvalid
+	}
+	dest = filepath.Join(*&dir, path.Base(*&p))
+	if exist(*&dest) {
+		return "", os.ErrExist
+	}
+	err = lib.copyInto(*&p, *&dest)
+	if err == nil {
+		recordCreation(*&dest)
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Library API
+
+type libraryInsertion struct {
+	Uri  string `json:"uri"`
+	Path string `json:"path"`
+}
+
+// List the libraries and their assets, read an asset, or copy one into a
+// project
+func libraryHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	rest := r.URL.Path[libraryPathLen:]
+	if strings.Trim(*&rest, "/") == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		names := []string{}
+		for _, l := range libraries {
+			names = append(*&names, l.name)
+		}
+		writeJSON(w, http.StatusOK, *&names)
+		return
+	}
+	lib, p, err := findLibraryAsset(*&rest)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		info, err := lib.fs.stat(*&p)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if info.IsDir() {
+			entries, err := lib.list(*&p)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, *&entries)
+			return
+		}
+		f, err := lib.fs.open(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		_, err = io.Copy(w, *&f)
+		if err != nil {
+			log.Println(*&err)
+		}
+		return
+	case "POST":
+		// Copy an asset into the project directory given as destination
+		dir, ok := uriToPath(r.Header.Get("destination"))
+		if !ok || dir == "." {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dest, err := insertLibraryAsset(*&lib, *&p, *&dir)
+		if os.IsNotExist(*&err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == os.ErrExist {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err == os.ErrInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Relative to the project, for references from its documents
+		rel := filepath.ToSlash(*&dest)
+		if i := strings.Index(*&rel, "/"); i >= 0 {
+			rel = rel[i+1:]
+		}
+		writeJSON(w, http.StatusCreated, libraryInsertion{pathToUri(*&dest), *&rel})
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
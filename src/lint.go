@@ -0,0 +1,343 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//////// LINTING
+
+type diagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Keeps track of line numbers while reporting diagnostics against a
+// document, or against a fragment embedded at some offset in it.
+type linter struct {
+	src         []byte
+	offset      int
+	diagnostics []diagnostic
+}
+
+func (l *linter) report(pos int, severity string, message string) {
+	pos += l.offset
+	line := bytes.Count(l.src[:pos], []byte("\n")) + 1
+	column := pos - bytes.LastIndexByte(l.src[:pos], '\n')
+	l.diagnostics = append(l.diagnostics, diagnostic{line, column, severity, message})
+}
+
+func (l *linter) error(pos int, message string) {
+	l.report(*&pos, "error", *&message)
+}
+
+func (l *linter) warning(pos int, message string) {
+	l.report(*&pos, "warning", *&message)
+}
+
+//// CSS
+
+func lintCSS(l *linter, css []byte) {
+	depth := 0
+	var opened []int
+	declStart := -1
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; c {
+		case '/':
+			if i+1 < len(css) && css[i+1] == '*' {
+				end := bytes.Index(css[i+2:], []byte("*/"))
+				if end < 0 {
+					l.error(*&i, "unterminated comment")
+					return
+				}
+				i += end + 3
+			}
+		case '"', '\'':
+			end := cssStringEnd(*&css, *&i)
+			if end < 0 || css[end] == '\n' {
+				l.error(*&i, "unterminated string")
+				if end < 0 {
+					return
+				}
+			}
+			i = end
+		case '{':
+			if j := bytes.IndexByte(css[i+1:], '}'); j >= 0 && len(bytes.TrimSpace(css[i+1:i+1+j])) == 0 {
+				l.warning(*&i, "empty rule")
+			}
+			depth++
+			opened = append(opened, i)
+			declStart = -1
+		case '}':
+			if depth == 0 {
+				l.error(*&i, "unexpected closing brace")
+				continue
+			}
+			lintDeclaration(l, *&css, *&declStart, *&i)
+			depth--
+			opened = opened[:len(opened)-1]
+			declStart = -1
+		case ';':
+			if depth > 0 {
+				lintDeclaration(l, *&css, *&declStart, *&i)
+			}
+			declStart = -1
+		default:
+			if declStart < 0 && !isSpaceByte(c) {
+				declStart = i
+			}
+		}
+	}
+	for _, pos := range opened {
+		l.error(*&pos, "unclosed block")
+	}
+}
+
+// Position of the quote closing the string opened at start, of the newline
+// ending it unterminated, or -1 when the input ends first. Escaped
+// characters are skipped, escaped newlines continuing the string.
+func cssStringEnd(css []byte, start int) int {
+	for j := start + 1; j < len(css); j++ {
+		switch css[j] {
+		case '\\':
+			j++
+		case css[start], '\n':
+			return j
+		}
+	}
+	return -1
+}
+
+func lintDeclaration(l *linter, css []byte, start int, end int) {
+	if start < 0 || start >= end {
+		return
+	}
+	decl := bytes.TrimSpace(css[start:end])
+	if len(decl) == 0 || decl[0] == '@' {
+		return
+	}
+	colon := bytes.IndexByte(decl, ':')
+	if colon < 0 {
+		l.error(*&start, "declaration is missing a colon: "+string(*&decl))
+		return
+	}
+	if len(bytes.TrimSpace(decl[colon+1:])) == 0 {
+		l.error(*&start, "declaration has no value: "+string(bytes.TrimSpace(decl[:colon])))
+	}
+}
+
+//// HTML
+
+var htmlVoidElements = []string{"area", "base", "br", "col", "embed", "hr", "img", "input", "keygen", "link", "meta", "param", "source", "track", "wbr"}
+var htmlOptionalEndElements = []string{"p", "li", "dt", "dd", "tr", "td", "th", "thead", "tbody", "tfoot", "option", "optgroup", "colgroup", "rt", "rp", "html", "head", "body"}
+var htmlRawTextElements = []string{"script", "style", "textarea", "title"}
+
+var htmlTagRegexp = regexp.MustCompile(`<(/?)([A-Za-z][A-Za-z0-9-]*)((?:[^>"']|"[^"]*"|'[^']*')*?)(/?)>`)
+var htmlAttrRegexp = regexp.MustCompile(`([^\s=/]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+
+type htmlElement struct {
+	name string
+	pos  int
+}
+
+func lintHTML(l *linter, html []byte) {
+	if !bytes.HasPrefix(bytes.ToLower(bytes.TrimSpace(*&html)), []byte("<!doctype")) {
+		l.warning(0, "missing <!DOCTYPE html> declaration")
+	}
+	ids := make(map[string]bool)
+	var stack []htmlElement
+	hasTitle := false
+	i := 0
+	// Next comment, looked up again once passed
+	comment := bytes.Index(*&html, []byte("<!--"))
+	for i < len(html) {
+		if comment >= 0 && comment < i {
+			if comment = bytes.Index(html[i:], []byte("<!--")); comment >= 0 {
+				comment += i
+			}
+		}
+		// Whichever of the next comment and the next tag comes first
+		loc := htmlTagRegexp.FindSubmatchIndex(html[i:])
+		if comment >= 0 && (loc == nil || comment <= i+loc[0]) {
+			i = comment
+			end := bytes.Index(html[i+4:], []byte("-->"))
+			if end < 0 {
+				l.error(*&i, "unterminated comment")
+				return
+			}
+			i += end + 7
+			continue
+		}
+		if loc == nil {
+			break
+		}
+		pos := i + loc[0]
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(string(html[i+loc[4] : i+loc[5]]))
+		attrs := html[i+loc[6] : i+loc[7]]
+		selfClosing := loc[9] > loc[8]
+		i += loc[1]
+
+		if closing {
+			if sliceContains(htmlVoidElements, *&name) {
+				l.error(*&pos, "void element </"+name+"> must not be closed")
+				continue
+			}
+			match := -1
+			for j := len(stack) - 1; j >= 0; j-- {
+				if stack[j].name == name {
+					match = j
+					break
+				}
+			}
+			if match < 0 {
+				l.error(*&pos, "unexpected closing tag </"+name+">")
+				continue
+			}
+			for _, e := range stack[match+1:] {
+				if !sliceContains(htmlOptionalEndElements, e.name) {
+					l.error(e.pos, "<"+e.name+"> is not closed before </"+name+">")
+				}
+			}
+			stack = stack[:match]
+			continue
+		}
+
+		seen := make(map[string]bool)
+		for _, a := range htmlAttrRegexp.FindAllSubmatchIndex(*&attrs, -1) {
+			attr := strings.ToLower(string(attrs[a[2]:a[3]]))
+			if seen[attr] {
+				l.error(*&pos, "duplicate attribute "+attr+" on <"+name+">")
+			}
+			seen[attr] = true
+			if attr == "id" && a[4] >= 0 {
+				id := strings.Trim(string(attrs[a[4]:a[5]]), `"'`)
+				if ids[id] {
+					l.error(*&pos, "duplicate id \""+id+"\"")
+				}
+				ids[id] = true
+			}
+		}
+		if name == "img" && !seen["alt"] {
+			l.warning(*&pos, "<img> is missing an alt attribute")
+		}
+		if name == "title" {
+			hasTitle = true
+		}
+
+		if sliceContains(htmlRawTextElements, *&name) {
+			end := bytes.Index(bytes.ToLower(html[i:]), []byte("</"+name))
+			if end < 0 {
+				l.error(*&pos, "<"+name+"> is not closed")
+				return
+			}
+			if name == "style" {
+				sub := &linter{src: l.src, offset: l.offset + i}
+				lintCSS(*&sub, html[i:i+end])
+				l.diagnostics = append(l.diagnostics, sub.diagnostics...)
+			}
+			i += end
+			if gt := bytes.IndexByte(html[i:], '>'); gt >= 0 {
+				i += gt + 1
+			}
+			continue
+		}
+		if !selfClosing && !sliceContains(htmlVoidElements, *&name) {
+			stack = append(stack, htmlElement{name, pos})
+		}
+	}
+	for _, e := range stack {
+		if !sliceContains(htmlOptionalEndElements, e.name) {
+			l.error(e.pos, "<"+e.name+"> is not closed")
+		}
+	}
+	if !hasTitle && bytes.Contains(bytes.ToLower(*&html), []byte("<head")) {
+		l.warning(0, "document has no <title>")
+	}
+}
+
+var linters = map[string]func(l *linter, src []byte){
+	".html": lintHTML,
+	".htm":  lintHTML,
+	".css":  lintCSS,
+}
+
+func lint(ext string, src []byte) (diagnostics []diagnostic, ok bool) {
+	fn, ok := linters[strings.ToLower(*&ext)]
+	if !ok {
+		return
+	}
+	l := &linter{src: src}
+	fn(*&l, *&src)
+	diagnostics = l.diagnostics
+	if diagnostics == nil {
+		diagnostics = []diagnostic{}
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Lint API
+
+// Validate a stored document (GET) or the unsaved content sent as body (POST)
+func lintHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[lintPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var src []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		if !exist(*&p) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		src, err = readFile(*&p)
+	case "POST":
+		src, err = ioutil.ReadAll(r.Body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	diagnostics, ok := lint(filepath.Ext(*&p), *&src)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&diagnostics)
+}
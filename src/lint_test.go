@@ -0,0 +1,98 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintHTMLComments(t *testing.T) {
+	const head = "<!DOCTYPE html><html><head><title>t</title></head><body>"
+	const foot = "</body></html>"
+	tests := []struct {
+		body   string
+		errors []string
+	}{
+		{"<p>x <!-- <div> --></p>", nil},
+		{"<!-- <div> --><p>x</p>", nil},
+		{"<p>x</p><!-- </p> -->", nil},
+		{"<p>a <!-- one --> b <!-- <span> --></p>", nil},
+		{"<div>x <!-- </div> -->", []string{"<div> is not closed"}},
+		{"<p>x <!-- <div> </p>", []string{"unterminated comment"}},
+		{"<script>if (a <!--b) {}</script><div></div>", nil},
+	}
+	for _, test := range tests {
+		diagnostics, ok := lint(".html", []byte(head+test.body+foot))
+		if !ok {
+			t.Fatal("no HTML linter")
+		}
+		var errors []string
+		for _, d := range diagnostics {
+			if d.Severity == "error" {
+				errors = append(errors, d.Message)
+			}
+		}
+		if len(errors) != len(test.errors) {
+			t.Errorf("%s: %v, want %v", test.body, errors, test.errors)
+			continue
+		}
+		for i, e := range test.errors {
+			if !strings.Contains(errors[i], e) {
+				t.Errorf("%s: %v, want %v", test.body, errors, test.errors)
+			}
+		}
+	}
+}
+
+func TestLintCSSStrings(t *testing.T) {
+	tests := []struct {
+		css    string
+		errors []string
+	}{
+		{`a { content: "a\"b"; color: red; }`, nil},
+		{`a { content: 'it\'s'; }`, nil},
+		{`a { content: "a\\"; color: red; }`, nil},
+		{"a { content: \"a\\\nb\"; }", nil},
+		{`a { content: "a\"; }`, []string{"unterminated string"}},
+		{"a { content: \"a\n; color: red; }", []string{"unterminated string"}},
+	}
+	for _, test := range tests {
+		diagnostics, ok := lint(".css", []byte(test.css))
+		if !ok {
+			t.Fatal("no CSS linter")
+		}
+		var errors []string
+		for _, d := range diagnostics {
+			if d.Severity == "error" {
+				errors = append(errors, d.Message)
+			}
+		}
+		if len(errors) != len(test.errors) {
+			t.Errorf("%q: %v, want %v", test.css, errors, test.errors)
+			continue
+		}
+		for i, e := range test.errors {
+			if !strings.Contains(errors[i], e) {
+				t.Errorf("%q: %v, want %v", test.css, errors, test.errors)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+//////// LISTENERS
+
+// The cloud listens on TCP by default, on a Unix socket for local reverse
+// proxies, or on the socket handed over by systemd or launchd-like socket
+// activation, which takes precedence, as does the one handed over by the
+// previous instance on a soft restart.
+
+// First file descriptor passed by socket activation
+const activatedFd = 3
+
+// Time left to the requests in progress when stopping
+const shutdownTimeout = 10 * time.Second
+
+func activatedListener() (l net.Listener, ok bool, err error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, false, nil
+	}
+	if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n < 1 {
+		return nil, false, nil
+	}
+	f := os.NewFile(activatedFd, "activated-socket")
+	defer f.Close()
+	l, err = net.FileListener(*&f)
+	return l, true, err
+}
+
+// Listens on a Unix socket, replacing the file a previous instance may
+// have left behind unless it is still in use.
+func listenUnix(p string) (l net.Listener, err error) {
+	if _, err := os.Lstat(*&p); err == nil {
+		if c, err := net.Dial("unix", *&p); err == nil {
+			c.Close()
+			return nil, errors.New("socket " + p + " is already in use")
+		}
+		err = os.Remove(*&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err = net.Listen("unix", *&p)
+	if err != nil {
+		return
+	}
+	// Access is controlled by the permissions of the socket file
+	err = os.Chmod(*&p, 0660)
+	return
+}
+
+func listen() (l net.Listener, err error) {
+	l, ok, err := handedOverListener()
+	if ok {
+		return
+	}
+	l, ok, err = activatedListener()
+	if ok {
+		return
+	}
+	if unixSocketFlag != "" {
+		return listenUnix(unixSocketFlag)
+	}
+	err = checkBindSafety(*&interfaceFlag)
+	if err != nil {
+		return
+	}
+	return listenTCP(interfaceFlag, portFlag)
+}
+
+func isUnixRequest(r *http.Request) bool {
+	a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && a.Network() == "unix"
+}
+
+// Reasons for the cloud to stop by itself, such as being idle
+var stopRequests = make(chan string, 1)
+
+func requestStop(reason string) {
+	select {
+	case stopRequests <- reason:
+	default:
+	}
+}
+
+// Serves the cloud on an already open listener, which it closes on return.
+// An interrupt or termination signal, such as the one a container runtime
+// sends to its first process, stops it gracefully, as does requestStop.
+func serve(l net.Listener, handler http.Handler) (err error) {
+	server := newServer(l.Addr().String(), *&handler)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var reason string
+		select {
+		case s, ok := <-signals:
+			if !ok {
+				return
+			}
+			reason = "Received " + s.String()
+		case reason = <-stopRequests:
+		}
+		logInfo(reason + ", shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(*&ctx)
+		if err != nil {
+			log.Println(*&err)
+		}
+	}()
+	err = server.Serve(*&l)
+	if err != http.ErrServerClosed {
+		return
+	}
+	<-stopped
+	return nil
+}
+
+// Writes what is kept in memory before exiting.
+func flushState() {
+	for _, flush := range []func() error{journal.flush, flushAccesses, metadata.flush} {
+		if err := flush(); err != nil {
+			log.Println(*&err)
+		}
+	}
+}
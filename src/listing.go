@@ -0,0 +1,118 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////// HTML LISTINGS
+
+// Browsers asking for a directory get a page listing it instead of JSON,
+// from the listing.html asset, which -assets may override.
+
+const listingTemplate = "listing.html"
+
+type listingEntry struct {
+	Name     string
+	Href     string
+	Dir      bool
+	Deleted  bool
+	Size     string
+	Modified string
+}
+
+type listingPage struct {
+	Lang    string
+	Name    string
+	Uri     string
+	Parent  string
+	Entries []listingEntry
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Link to an element of the cloud through the Files or Directory API.
+func listingHref(uri string, dir bool) string {
+	route := filePath
+	if dir {
+		route = dirPath
+	}
+	return basePathFlag + route + strings.TrimPrefix(*&uri, drivePrefix)
+}
+
+func formatMilliseconds(ms string) string {
+	if _, err := strconv.ParseInt(*&ms, 10, 64); err != nil {
+		return ""
+	}
+	return parseMilliseconds(*&ms).Format("2006-01-02 15:04")
+}
+
+// Renders the listing of the directory at a path, or of the drive when the
+// element has no name.
+func renderListing(w http.ResponseWriter, r *http.Request, p string, dir element) {
+	renderListingLinked(w, *&r, *&p, *&dir, listingHref)
+}
+
+// Same as renderListing, linking elements elsewhere than to the Files and
+// Directory APIs.
+func renderListingLinked(w http.ResponseWriter, r *http.Request, p string, dir element, href func(uri string, dir bool) string) {
+	locale := requestLocale(*&r)
+	t, err := template.New(listingTemplate).Funcs(template.FuncMap{
+		"T": func(key string) string { return translate(*&locale, *&key) },
+	}).ParseFS(assets(), listingTemplate)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	page := listingPage{Lang: locale, Name: dir.Name, Uri: pathToUri(*&p)}
+	switch {
+	case dir.Name == "":
+		page.Name, page.Uri = driveName+":", drivePrefix
+	case p == ".":
+		page.Name, page.Parent = projectsDir, href(drivePrefix, true)
+	default:
+		page.Parent = href(pathToUri(path.Dir(*&p)), true)
+	}
+	for _, c := range dir.Children {
+		e := listingEntry{Name: c.Name, Href: href(c.Uri, c.Type == "directory"), Dir: c.Type == "directory", Deleted: c.Deleted, Modified: formatMilliseconds(c.ModifiedDate)}
+		if size, err := strconv.ParseInt(c.Size, 10, 64); err == nil {
+			e.Size = formatByteSize(*&size)
+		}
+		page.Entries = append(page.Entries, *&e)
+	}
+	// Directories first
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		return page.Entries[i].Dir && !page.Entries[j].Dir
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", *&locale)
+	err = t.Execute(w, *&page)
+	if err != nil {
+		logDebug("http", *&err)
+	}
+}
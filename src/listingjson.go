@@ -0,0 +1,304 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//////// LISTING ENCODING
+
+// Listings of large trees are encoded as they are written, through pooled
+// buffers, instead of marshaled as a whole which took several copies of
+// the tree. The output is the one of json.MarshalIndent with tabs, for the
+// fields clients ask for with the fields header. From version 2 of the API,
+// listings are compact instead: sizes are numbers, writable is a boolean,
+// dates are RFC 3339, and empty fields, children included, are left out.
+
+var listingBuffers = sync.Pool{New: func() interface{} {
+	return bufio.NewWriterSize(nil, 32*1024)
+}}
+
+const hexDigits = "0123456789abcdef"
+
+// Fields of the elements of a listing, all of them when nil. Without
+// children, the entries of the directory are listed without theirs.
+type listingFields map[string]bool
+
+var listingFieldNames = []string{"type", "name", "uri", "creationDate", "modifiedDate", "size", "writable", "title", "description", "deleted", "deletedDate", "trashId", "children"}
+
+// Parses the fields header, such as name,uri,type.
+func parseListingFields(h string) (fields listingFields, ok bool) {
+	if strings.TrimSpace(*&h) == "" {
+		return nil, true
+	}
+	fields = make(listingFields)
+	for _, f := range strings.Split(*&h, ",") {
+		f = strings.TrimSpace(*&f)
+		if !sliceContains(listingFieldNames, *&f) {
+			return nil, false
+		}
+		fields[f] = true
+	}
+	return fields, true
+}
+
+func (f listingFields) has(name string) bool {
+	return f == nil || f[name]
+}
+
+func writeListing(w io.Writer, e *element, fields listingFields, version int, dates dateFormat) error {
+	b := listingBuffers.Get().(*bufio.Writer)
+	b.Reset(*&w)
+	defer func() {
+		b.Reset(nil)
+		listingBuffers.Put(*&b)
+	}()
+	if version >= 2 {
+		encodeCompactElement(*&b, *&e, true, *&fields, *&dates)
+	} else {
+		encodeElement(*&b, *&e, 0, *&fields, *&dates)
+	}
+	return b.Flush()
+}
+
+func writeIndent(b *bufio.Writer, depth int) {
+	for i := 0; i < depth; i++ {
+		b.WriteByte('\t')
+	}
+}
+
+func encodeElement(b *bufio.Writer, e *element, depth int, fields listingFields, dates dateFormat) {
+	b.WriteByte('{')
+	first := true
+	for _, name := range listingFieldNames {
+		// The listed directory always gives its children
+		if !fields.has(*&name) && !(name == "children" && depth == 0) {
+			continue
+		}
+		if name == "title" && e.Title == "" || name == "description" && e.Description == "" {
+			continue
+		}
+		if !e.Deleted && (name == "deleted" || name == "deletedDate" || name == "trashId") {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteByte('\n')
+		writeIndent(*&b, depth+1)
+		b.WriteByte('"')
+		b.WriteString(*&name)
+		b.WriteString(`": `)
+		switch name {
+		case "type":
+			encodeString(*&b, e.Type)
+		case "name":
+			encodeString(*&b, e.Name)
+		case "uri":
+			encodeString(*&b, e.Uri)
+		case "creationDate":
+			encodeString(*&b, dates.format(e.CreationDate))
+		case "modifiedDate":
+			encodeString(*&b, dates.format(e.ModifiedDate))
+		case "size":
+			encodeString(*&b, e.Size)
+		case "writable":
+			encodeString(*&b, e.Writable)
+		case "title":
+			encodeString(*&b, e.Title)
+		case "description":
+			encodeString(*&b, e.Description)
+		case "deleted":
+			b.WriteString("true")
+		case "deletedDate":
+			encodeString(*&b, dates.format(e.DeletedDate))
+		case "trashId":
+			encodeString(*&b, e.TrashId)
+		case "children":
+			encodeChildren(*&b, e.Children, *&depth, *&fields, *&dates)
+		}
+	}
+	b.WriteByte('\n')
+	writeIndent(*&b, *&depth)
+	b.WriteByte('}')
+}
+
+func encodeChildren(b *bufio.Writer, children []element, depth int, fields listingFields, dates dateFormat) {
+	switch {
+	case children == nil:
+		b.WriteString("null")
+	case len(children) == 0:
+		b.WriteString("[]")
+	default:
+		b.WriteString("[\n")
+		for i := range children {
+			if i > 0 {
+				b.WriteString(",\n")
+			}
+			writeIndent(*&b, depth+2)
+			encodeElement(*&b, &children[i], depth+2, *&fields, *&dates)
+		}
+		b.WriteByte('\n')
+		writeIndent(*&b, depth+1)
+		b.WriteByte(']')
+	}
+}
+
+// Quotes a string the way encoding/json does, HTML characters included.
+func encodeString(b *bufio.Writer, s string) {
+	b.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b.WriteString(s[start:i])
+			switch c {
+			case '"', '\\':
+				b.WriteByte('\\')
+				b.WriteByte(*&c)
+			case '\b':
+				b.WriteString(`\b`)
+			case '\f':
+				b.WriteString(`\f`)
+			case '\n':
+				b.WriteString(`\n`)
+			case '\r':
+				b.WriteString(`\r`)
+			case '\t':
+				b.WriteString(`\t`)
+			default:
+				b.WriteString(`\u00`)
+				b.WriteByte(hexDigits[c>>4])
+				b.WriteByte(hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteString(s[start:i])
+			b.WriteString("\ufffd")
+			i += size
+			start = i
+			continue
+		}
+		// Line and paragraph separators, which JavaScript does not allow
+		if r == '\u2028' || r == '\u2029' {
+			b.WriteString(s[start:i])
+			b.WriteString(`\u202`)
+			b.WriteByte(hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b.WriteString(s[start:])
+	b.WriteByte('"')
+}
+
+//// Compact listings
+
+func encodeCompactElement(b *bufio.Writer, e *element, root bool, fields listingFields, dates dateFormat) {
+	b.WriteByte('{')
+	first := true
+	key := func(name string) {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteByte('"')
+		b.WriteString(*&name)
+		b.WriteString(`":`)
+	}
+	text := func(name string, value string) {
+		if value != "" {
+			key(*&name)
+			encodeString(*&b, *&value)
+		}
+	}
+	for _, name := range listingFieldNames {
+		// The listed directory always gives its children
+		if !fields.has(*&name) && !(name == "children" && root) {
+			continue
+		}
+		switch name {
+		case "type":
+			text(*&name, e.Type)
+		case "name":
+			text(*&name, e.Name)
+		case "uri":
+			text(*&name, e.Uri)
+		case "creationDate":
+			text(*&name, dates.iso(e.CreationDate))
+		case "modifiedDate":
+			text(*&name, dates.iso(e.ModifiedDate))
+		case "size":
+			if _, err := strconv.ParseInt(e.Size, 10, 64); err == nil {
+				key(*&name)
+				b.WriteString(e.Size)
+			}
+		case "writable":
+			if e.Writable != "" {
+				key(*&name)
+				b.WriteString(strconv.FormatBool(e.Writable == "true"))
+			}
+		case "title":
+			text(*&name, e.Title)
+		case "description":
+			text(*&name, e.Description)
+		case "deleted":
+			if e.Deleted {
+				key(*&name)
+				b.WriteString("true")
+			}
+		case "deletedDate":
+			text(*&name, dates.iso(e.DeletedDate))
+		case "trashId":
+			text(*&name, e.TrashId)
+		case "children":
+			if len(e.Children) == 0 {
+				continue
+			}
+			key(*&name)
+			b.WriteByte('[')
+			for i := range e.Children {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				encodeCompactElement(*&b, &e.Children[i], false, *&fields, *&dates)
+			}
+			b.WriteByte(']')
+		}
+	}
+	b.WriteByte('}')
+}
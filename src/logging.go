@@ -0,0 +1,265 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//////// LOG LEVELS
+
+// Errors are always logged. Notices are logged at the info level, and
+// details about what subsystems do at the debug and trace levels, only for
+// the modules selected with -log-modules when it is set.
+
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+// Subsystems whose details may be logged separately
+var logModules = []string{"fs", "http", "proxy", "watch"}
+
+var logLevel = levelInfo
+var enabledModules map[string]bool
+
+func parseLogLevel(level string, modules string) (err error) {
+	logLevel = -1
+	for i, name := range logLevelNames {
+		if name == level {
+			logLevel = i
+		}
+	}
+	if logLevel < 0 {
+		return errors.New("unknown log level: " + level)
+	}
+	if modules == "" {
+		return
+	}
+	enabledModules = make(map[string]bool)
+	for _, m := range strings.Split(*&modules, ",") {
+		m = strings.TrimSpace(*&m)
+		if !sliceContains(logModules, *&m) {
+			return errors.New("unknown log module: " + m)
+		}
+		enabledModules[m] = true
+	}
+	return
+}
+
+// Whether messages of a level, and of a module if any, are logged.
+func logging(level int, module string) bool {
+	return level <= logLevel && (module == "" || enabledModules == nil || enabledModules[module])
+}
+
+func logAt(level int, module string, v ...interface{}) {
+	if !logging(*&level, *&module) {
+		return
+	}
+	// Notices read as they always did
+	if level == levelInfo && module == "" {
+		log.Println(v...)
+		return
+	}
+	prefix := "[" + logLevelNames[level] + "]"
+	if module != "" {
+		prefix += " " + module + ":"
+	}
+	log.Println(append([]interface{}{prefix}, v...)...)
+}
+
+func logWarn(v ...interface{}) {
+	logAt(levelWarn, "", v...)
+}
+
+func logInfo(v ...interface{}) {
+	logAt(levelInfo, "", v...)
+}
+
+func logDebug(module string, v ...interface{}) {
+	logAt(levelDebug, *&module, v...)
+}
+
+func logTrace(module string, v ...interface{}) {
+	logAt(levelTrace, *&module, v...)
+}
+
+// Splits the level off a log line, for the JSON log format.
+func logLineLevel(line string) (level string, message string) {
+	for _, name := range logLevelNames {
+		if strings.HasPrefix(*&line, "["+name+"] ") {
+			return name, line[len(name)+3:]
+		}
+	}
+	return "", line
+}
+
+//// Storage
+
+// Logs every storage operation, at the trace level of the fs module.
+type tracedStorage struct {
+	storage
+}
+
+func traceStorage(op string, name string, err error) {
+	if err != nil {
+		logTrace("fs", *&op, *&name, "failed:", *&err)
+	} else {
+		logTrace("fs", *&op, *&name)
+	}
+}
+
+func (t tracedStorage) stat(name string) (info os.FileInfo, err error) {
+	info, err = t.storage.stat(*&name)
+	traceStorage("stat", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) readDir(name string) (list []os.FileInfo, err error) {
+	list, err = t.storage.readDir(*&name)
+	traceStorage("readDir", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) open(name string) (r io.ReadCloser, err error) {
+	r, err = t.storage.open(*&name)
+	traceStorage("open", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) create(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	w, err = t.storage.create(*&name, *&perm)
+	traceStorage("create", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) createNew(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	w, err = t.storage.createNew(*&name, *&perm)
+	traceStorage("createNew", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) mkdirAll(name string, perm os.FileMode) (err error) {
+	err = t.storage.mkdirAll(*&name, *&perm)
+	traceStorage("mkdirAll", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) remove(name string) (err error) {
+	err = t.storage.remove(*&name)
+	traceStorage("remove", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) removeAll(name string) (err error) {
+	err = t.storage.removeAll(*&name)
+	traceStorage("removeAll", *&name, *&err)
+	return
+}
+
+func (t tracedStorage) rename(source string, dest string) (err error) {
+	err = t.storage.rename(*&source, *&dest)
+	traceStorage("rename", source+" -> "+dest, *&err)
+	return
+}
+
+func (t tracedStorage) chmod(name string, mode os.FileMode) (err error) {
+	err = t.storage.chmod(*&name, *&mode)
+	traceStorage("chmod", *&name, *&err)
+	return
+}
+
+//////// MIDDLEWARES
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(*&status)
+}
+
+func (w *statusRecorder) Write(p []byte) (n int, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(*&p)
+	w.size += n
+	return
+}
+
+// Status sent, which is 200 if the handler wrote nothing.
+func (w *statusRecorder) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Keeps WebSocket upgrades working.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Logs requests and their outcome at the debug level of the http module,
+// with their headers at the trace level.
+func logMiddleware(next http.Handler) http.Handler {
+	if !logging(levelDebug, "http") {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if logging(levelTrace, "http") {
+			for name, values := range redactHeaders(r.Header) {
+				logTrace("http", "["+requestId(*&r)+"]", name+":", strings.Join(*&values, ", "))
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(*&recorder, r)
+		logDebug("http", "["+requestId(*&r)+"]", r.Method, r.URL.RequestURI(), recorder.code(), recorder.size, "bytes in", time.Since(*&start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,66 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+//////// LONG PATHS
+
+// Windows refuses paths longer than MAX_PATH unless long paths are enabled
+// system-wide, programs then failing with obscure errors. Files and
+// directories which would end up past the limit are refused with a
+// path-too-long error instead, or, with -long-paths, accessed through \\?\
+// prefixed paths which are not limited.
+
+// Length of the path a file would have on disk, when it is too long to be
+// used.
+func pathTooLong(p string) (length int, tooLong bool) {
+	if longPathsFlag || longPathsEnabled() {
+		return
+	}
+	dp, ok := diskPath(*&p)
+	if !ok {
+		return
+	}
+	if abs, err := filepath.Abs(*&dp); err == nil {
+		dp = abs
+	}
+	return len(*&dp), len(*&dp) > maxPathLength
+}
+
+// Refuses to create a path which would be too long, telling whether it was
+// refused.
+func refuseLongPath(w http.ResponseWriter, r *http.Request, p string) bool {
+	length, tooLong := pathTooLong(*&p)
+	if !tooLong {
+		return false
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":   "path-too-long",
+		"message": errorMessage(*&r, "path-too-long"),
+		"uri":     pathToUri(*&p),
+		"length":  length,
+		"limit":   maxPathLength,
+	})
+	return true
+}
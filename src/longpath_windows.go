@@ -0,0 +1,65 @@
+//go:build windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var longPathsSupport struct {
+	sync.Once
+	enabled bool
+}
+
+// Whether Windows lets programs use paths past MAX_PATH, as set by the
+// LongPathsEnabled policy.
+func longPathsEnabled() bool {
+	longPathsSupport.Do(func() {
+		key, _ := syscall.UTF16PtrFromString(`SYSTEM\CurrentControlSet\Control\FileSystem`)
+		var h syscall.Handle
+		if syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, key, 0, syscall.KEY_READ, &h) != nil {
+			return
+		}
+		defer syscall.RegCloseKey(h)
+		name, _ := syscall.UTF16PtrFromString("LongPathsEnabled")
+		var value, kind uint32
+		size := uint32(unsafe.Sizeof(value))
+		err := syscall.RegQueryValueEx(h, name, nil, &kind, (*byte)(unsafe.Pointer(&value)), &size)
+		longPathsSupport.enabled = err == nil && kind == syscall.REG_DWORD && value != 0
+	})
+	return longPathsSupport.enabled
+}
+
+// Prefixes long absolute paths with \\?\, lifting the MAX_PATH limit.
+func extendedPath(p string) string {
+	if !longPathsFlag || len(*&p) <= maxPathLength || strings.HasPrefix(*&p, `\\?\`) || !filepath.IsAbs(*&p) {
+		return p
+	}
+	if strings.HasPrefix(*&p, `\\`) {
+		return `\\?\UNC\` + p[2:]
+	}
+	return `\\?\` + p
+}
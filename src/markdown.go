@@ -0,0 +1,186 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//////// MARKDOWN
+
+// Converts the common subset of Markdown: headings, paragraphs, lists,
+// block quotes, code blocks, rules, emphasis, code spans, links and images.
+
+var mdHeadingRegexp = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+var mdRuleRegexp = regexp.MustCompile(`^ {0,3}(?:(?:- *){3,}|(?:\* *){3,}|(?:_ *){3,})$`)
+var mdBulletRegexp = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+var mdNumberRegexp = regexp.MustCompile(`^ {0,3}\d+[.)]\s+(.*)$`)
+var mdQuoteRegexp = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+var mdFenceRegexp = regexp.MustCompile("^ {0,3}(```|~~~)\\s*([A-Za-z0-9_+-]*)")
+
+var mdCodeSpanRegexp = regexp.MustCompile("`([^`]+)`")
+var mdImageRegexp = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+&#34;([^&]*?)&#34;)?\)`)
+var mdLinkRegexp = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+&#34;([^&]*?)&#34;)?\)`)
+var mdAutolinkRegexp = regexp.MustCompile(`&lt;((?:https?|mailto):[^&\s]+)&gt;`)
+var mdStrongRegexp = regexp.MustCompile(`(\*\*|__)([^*_]+?)(\*\*|__)`)
+var mdEmRegexp = regexp.MustCompile(`(^|[^\w*])[*_]([^*_\s][^*_]*?)[*_]($|[^\w*])`)
+
+type markdownWriter struct {
+	out       bytes.Buffer
+	paragraph []string
+	list      string
+	quote     []string
+}
+
+// Converts inline markup, once the text is escaped. Code spans are set
+// aside first, so that nothing inside of them gets converted.
+func markdownInline(text string) string {
+	text = html.EscapeString(*&text)
+	var spans []string
+	text = mdCodeSpanRegexp.ReplaceAllStringFunc(*&text, func(m string) string {
+		spans = append(*&spans, "<code>"+m[1:len(m)-1]+"</code>")
+		return "\x00" + strconv.Itoa(len(spans)-1) + "\x00"
+	})
+	text = mdImageRegexp.ReplaceAllString(*&text, `<img src="$2" alt="$1" title="$3">`)
+	text = mdLinkRegexp.ReplaceAllString(*&text, `<a href="$2" title="$3">$1</a>`)
+	text = mdAutolinkRegexp.ReplaceAllString(*&text, `<a href="$1">$1</a>`)
+	text = mdStrongRegexp.ReplaceAllString(*&text, "<strong>$2</strong>")
+	text = mdEmRegexp.ReplaceAllString(*&text, "$1<em>$2</em>$3")
+	text = strings.Replace(*&text, ` title=""`, "", -1)
+	for i, s := range spans {
+		text = strings.Replace(*&text, "\x00"+strconv.Itoa(i)+"\x00", *&s, 1)
+	}
+	return text
+}
+
+func (m *markdownWriter) closeParagraph() {
+	if len(m.paragraph) > 0 {
+		m.out.WriteString("<p>" + markdownInline(strings.Join(m.paragraph, "\n")) + "</p>\n")
+		m.paragraph = nil
+	}
+}
+
+func (m *markdownWriter) closeList() {
+	if m.list != "" {
+		m.out.WriteString("</" + m.list + ">\n")
+		m.list = ""
+	}
+}
+
+func (m *markdownWriter) closeQuote() {
+	if m.quote != nil {
+		inner := markdownToHTML([]byte(strings.Join(m.quote, "\n")))
+		m.out.WriteString("<blockquote>\n")
+		m.out.Write(*&inner)
+		m.out.WriteString("</blockquote>\n")
+		m.quote = nil
+	}
+}
+
+func (m *markdownWriter) closeBlocks() {
+	m.closeParagraph()
+	m.closeList()
+	m.closeQuote()
+}
+
+func (m *markdownWriter) listItem(list string, text string) {
+	m.closeParagraph()
+	m.closeQuote()
+	if m.list != list {
+		m.closeList()
+		m.out.WriteString("<" + list + ">\n")
+		m.list = list
+	}
+	m.out.WriteString("<li>" + markdownInline(*&text) + "</li>\n")
+}
+
+func markdownToHTML(src []byte) []byte {
+	var m markdownWriter
+	lines := strings.Split(strings.Replace(string(*&src), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.Replace(lines[i], "\t", "    ", -1)
+		if fence := mdFenceRegexp.FindStringSubmatch(*&line); fence != nil {
+			m.closeBlocks()
+			class := ""
+			if fence[2] != "" {
+				class = ` class="language-` + fence[2] + `"`
+			}
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence[1]); i++ {
+				code = append(*&code, lines[i])
+			}
+			m.out.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.Join(*&code, "\n")) + "</code></pre>\n")
+			continue
+		}
+		if q := mdQuoteRegexp.FindStringSubmatch(*&line); q != nil {
+			m.closeParagraph()
+			m.closeList()
+			m.quote = append(m.quote, q[1])
+			continue
+		}
+		if m.quote != nil && strings.TrimSpace(*&line) != "" && len(m.paragraph) == 0 {
+			// Lazy continuation of the quote
+			m.quote = append(m.quote, *&line)
+			continue
+		}
+		switch {
+		case strings.TrimSpace(*&line) == "":
+			m.closeBlocks()
+		case strings.HasPrefix(*&line, "    ") && len(m.paragraph) == 0 && m.list == "":
+			m.closeBlocks()
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(*&code, strings.TrimPrefix(strings.Replace(lines[i], "\t", "    ", -1), "    "))
+			}
+			i--
+			for len(*&code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			m.out.WriteString("<pre><code>" + html.EscapeString(strings.Join(*&code, "\n")) + "</code></pre>\n")
+		case mdRuleRegexp.MatchString(*&line):
+			m.closeBlocks()
+			m.out.WriteString("<hr>\n")
+		case mdHeadingRegexp.MatchString(*&line):
+			m.closeBlocks()
+			h := mdHeadingRegexp.FindStringSubmatch(*&line)
+			level := string(rune('0' + len(h[1])))
+			m.out.WriteString("<h" + level + ">" + markdownInline(h[2]) + "</h" + level + ">\n")
+		case mdBulletRegexp.MatchString(*&line):
+			m.listItem("ul", mdBulletRegexp.FindStringSubmatch(*&line)[1])
+		case mdNumberRegexp.MatchString(*&line):
+			m.listItem("ol", mdNumberRegexp.FindStringSubmatch(*&line)[1])
+		default:
+			if m.list != "" && strings.HasPrefix(*&line, " ") {
+				// Continuation of the last list item
+				m.out.Truncate(m.out.Len() - len("</li>\n"))
+				m.out.WriteString("\n" + markdownInline(strings.TrimSpace(*&line)) + "</li>\n")
+				continue
+			}
+			m.closeList()
+			m.paragraph = append(m.paragraph, strings.TrimSpace(*&line))
+		}
+	}
+	m.closeBlocks()
+	return m.out.Bytes()
+}
@@ -0,0 +1,302 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// MEMORY STORAGE
+
+// Keeps the whole tree in RAM, for demos and sandboxes which must leave
+// nothing behind.
+
+var errIsDir = errors.New("is a directory")
+var errNotDir = errors.New("not a directory")
+var errNotEmpty = errors.New("directory not empty")
+
+type memNode struct {
+	name    string
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	content []byte
+}
+
+func (n *memNode) Name() string       { return n.name }
+func (n *memNode) Size() int64        { return int64(len(n.content)) }
+func (n *memNode) Mode() os.FileMode  { return n.mode }
+func (n *memNode) ModTime() time.Time { return n.modTime }
+func (n *memNode) IsDir() bool        { return n.dir }
+func (n *memNode) Sys() interface{}   { return nil }
+
+type memStorage struct {
+	mutex sync.RWMutex
+	nodes map[string]*memNode
+}
+
+func newMemStorage() *memStorage {
+	s := &memStorage{nodes: make(map[string]*memNode)}
+	s.nodes["."] = &memNode{".", true, os.ModeDir | 0777, time.Now(), nil}
+	return s
+}
+
+func memPath(name string) string {
+	return path.Clean(filepath.ToSlash(*&name))
+}
+
+func memError(op string, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Copy of a node, so that callers never see later modifications.
+func (n *memNode) info() os.FileInfo {
+	c := *n
+	c.content = n.content[:len(n.content):len(n.content)]
+	return &c
+}
+
+func (s *memStorage) stat(name string) (os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, ok := s.nodes[memPath(*&name)]
+	if !ok {
+		return nil, memError("stat", *&name, os.ErrNotExist)
+	}
+	return n.info(), nil
+}
+
+func (s *memStorage) readDir(name string) (list []os.FileInfo, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	p := memPath(*&name)
+	n, ok := s.nodes[p]
+	if !ok {
+		return nil, memError("open", *&name, os.ErrNotExist)
+	}
+	if !n.dir {
+		return nil, memError("readdir", *&name, errNotDir)
+	}
+	for k, c := range s.nodes {
+		if k != "." && path.Dir(*&k) == p {
+			list = append(*&list, c.info())
+		}
+	}
+	sort.Slice(*&list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return
+}
+
+func (s *memStorage) open(name string) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, ok := s.nodes[memPath(*&name)]
+	if !ok {
+		return nil, memError("open", *&name, os.ErrNotExist)
+	}
+	if n.dir {
+		return nil, memError("read", *&name, errIsDir)
+	}
+	return memReader{bytes.NewReader(n.content)}, nil
+}
+
+// Must be called with the lock held.
+func (s *memStorage) checkParent(op string, name string) error {
+	parent, ok := s.nodes[path.Dir(memPath(*&name))]
+	if !ok {
+		return memError(*&op, *&name, os.ErrNotExist)
+	}
+	if !parent.dir {
+		return memError(*&op, *&name, errNotDir)
+	}
+	return nil
+}
+
+// Seekable, so that files can be served with range requests.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	s *memStorage
+	n *memNode
+}
+
+func (w memWriter) Write(p []byte) (int, error) {
+	w.s.mutex.Lock()
+	defer w.s.mutex.Unlock()
+	// Never append in place: infos handed out share the old array
+	content := make([]byte, len(w.n.content), len(w.n.content)+len(*&p))
+	copy(*&content, w.n.content)
+	w.n.content = append(*&content, *&p...)
+	w.n.modTime = time.Now()
+	return len(*&p), nil
+}
+
+func (w memWriter) Close() error {
+	return nil
+}
+
+func (s *memStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return s.openWriter(*&name, *&perm, false)
+}
+
+func (s *memStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return s.openWriter(*&name, *&perm, true)
+}
+
+func (s *memStorage) openWriter(name string, perm os.FileMode, exclusive bool) (io.WriteCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p := memPath(*&name)
+	if n, ok := s.nodes[p]; ok {
+		if exclusive {
+			return nil, memError("open", *&name, os.ErrExist)
+		}
+		if n.dir {
+			return nil, memError("open", *&name, errIsDir)
+		}
+		n.content = nil
+		n.modTime = time.Now()
+		return memWriter{s, n}, nil
+	}
+	err := s.checkParent("open", *&name)
+	if err != nil {
+		return nil, err
+	}
+	n := &memNode{path.Base(*&p), false, perm, time.Now(), nil}
+	s.nodes[p] = n
+	return memWriter{s, n}, nil
+}
+
+func (s *memStorage) mkdirAll(name string, perm os.FileMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p := memPath(*&name)
+	var missing []string
+	for ; p != "." && p != "/"; p = path.Dir(*&p) {
+		n, ok := s.nodes[p]
+		if ok && !n.dir {
+			return memError("mkdir", *&name, errNotDir)
+		} else if ok {
+			break
+		}
+		missing = append(*&missing, p)
+	}
+	for _, m := range missing {
+		s.nodes[m] = &memNode{path.Base(*&m), true, os.ModeDir | perm, time.Now(), nil}
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (s *memStorage) hasChildren(p string) bool {
+	for k := range s.nodes {
+		if strings.HasPrefix(*&k, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStorage) remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p := memPath(*&name)
+	if _, ok := s.nodes[p]; !ok {
+		return memError("remove", *&name, os.ErrNotExist)
+	}
+	if s.hasChildren(*&p) {
+		return memError("remove", *&name, errNotEmpty)
+	}
+	delete(s.nodes, p)
+	return nil
+}
+
+func (s *memStorage) removeAll(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p := memPath(*&name)
+	for k := range s.nodes {
+		if k != "." && (k == p || p == "." || strings.HasPrefix(*&k, p+"/")) {
+			delete(s.nodes, k)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) rename(source string, dest string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	from, to := memPath(*&source), memPath(*&dest)
+	n, ok := s.nodes[from]
+	if !ok {
+		return memError("rename", *&source, os.ErrNotExist)
+	}
+	if from == to {
+		return nil
+	}
+	if n.dir && strings.HasPrefix(*&to, from+"/") {
+		return memError("rename", *&source, os.ErrInvalid)
+	}
+	err := s.checkParent("rename", *&dest)
+	if err != nil {
+		return err
+	}
+	if d, ok := s.nodes[to]; ok {
+		if d.dir != n.dir {
+			return memError("rename", *&dest, os.ErrExist)
+		}
+		if d.dir && s.hasChildren(*&to) {
+			return memError("rename", *&dest, errNotEmpty)
+		}
+	}
+	for k, c := range s.nodes {
+		if k == from || strings.HasPrefix(*&k, from+"/") {
+			delete(s.nodes, k)
+			s.nodes[to+strings.TrimPrefix(*&k, *&from)] = c
+		}
+	}
+	n.name = path.Base(*&to)
+	return nil
+}
+
+func (s *memStorage) chmod(name string, mode os.FileMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, ok := s.nodes[memPath(*&name)]
+	if !ok {
+		return memError("chmod", *&name, os.ErrNotExist)
+	}
+	n.mode = n.mode&os.ModeType | mode.Perm()
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+//////// MEMORY LIMIT
+
+// With -max-memory the garbage collector works harder as the heap nears the
+// limit, which gives the predictable footprint a ballast used to, and the
+// caches which can be rebuilt are dropped once the heap is past most of it.
+// Something around twice the size of the metadata store and search indexes
+// leaves room for the requests.
+
+// Share of the limit past which caches are dropped
+const memoryPressure = 0.8
+
+var memoryLimit int64
+
+// Caches dropped under memory pressure, rebuilt on demand.
+var cacheEvictors = []func(){
+	evictUsage,
+	evictDirectoryMetadata,
+	evictMetadataCache,
+}
+
+func startMemoryLimit(limit int64) {
+	memoryLimit = limit
+	debug.SetMemoryLimit(*&limit)
+	go func() {
+		pressed := false
+		for range time.Tick(statusRefreshInterval) {
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			if float64(mem.HeapAlloc) < memoryPressure*float64(*&limit) {
+				pressed = false
+				continue
+			}
+			if !pressed {
+				logWarn("Heap at", formatByteSize(int64(mem.HeapAlloc)), "of the", formatByteSize(*&limit), "limit, dropping caches")
+				pressed = true
+			}
+			for _, evict := range cacheEvictors {
+				evict()
+			}
+			debug.FreeOSMemory()
+		}
+	}()
+}
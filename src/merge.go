@@ -0,0 +1,134 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////// DIRECTORY MERGES
+
+// Copies a tree into a directory which may already exist, merging the
+// directories found on both sides. Files already present at the same path,
+// or a directory there bearing the name of a file, are skipped, overwritten
+// or copied under a free name depending on the conflict policy; files are
+// never overwritten by directories nor the other way around.
+
+const (
+	mergeSkip      = "skip"
+	mergeOverwrite = "overwrite"
+	mergeRename    = "rename"
+)
+
+type mergeReport struct {
+	Copied      int      `json:"copied"`
+	Skipped     []string `json:"skipped"`
+	Overwritten []string `json:"overwritten"`
+	// URIs given to the copies, by URI of their source
+	Renamed map[string]string `json:"renamed"`
+}
+
+func validMergePolicy(policy string) bool {
+	return policy == mergeSkip || policy == mergeOverwrite || policy == mergeRename
+}
+
+// First free name of the form "name (2).ext" next to a path.
+func freeName(p string) string {
+	ext := filepath.Ext(*&p)
+	base := strings.TrimSuffix(*&p, *&ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, *&i, *&ext)
+		if !exist(*&candidate) {
+			return candidate
+		}
+	}
+}
+
+func mergeDir(ctx context.Context, source string, dest string, policy string) (report mergeReport, err error) {
+	report = mergeReport{Skipped: []string{}, Overwritten: []string{}, Renamed: make(map[string]string)}
+	fi, err := fsys.stat(*&source)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		return report, os.ErrInvalid
+	}
+	err = mergeInto(*&ctx, *&source, *&dest, *&fi, *&policy, &report)
+	return
+}
+
+func mergeInto(ctx context.Context, source string, dest string, info os.FileInfo, policy string, report *mergeReport) (err error) {
+	if !exist(*&dest) {
+		err = fsys.mkdirAll(*&dest, info.Mode())
+		if err != nil {
+			return
+		}
+		recordCreation(*&dest)
+	}
+	entries, err := fsys.readDir(*&source)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		err = ioPause(*&ctx)
+		if err != nil {
+			return
+		}
+		sfp := filepath.Join(*&source, entry.Name())
+		dfp := filepath.Join(*&dest, entry.Name())
+		existing, serr := fsys.stat(*&dfp)
+		if os.IsNotExist(*&serr) || serr == nil && existing.IsDir() && entry.IsDir() {
+			if entry.IsDir() {
+				err = mergeInto(*&ctx, *&sfp, *&dfp, *&entry, *&policy, *&report)
+			} else {
+				err = copyFile(*&ctx, *&sfp, *&dfp)
+				report.Copied++
+				recordCreation(*&dfp)
+			}
+		} else if serr != nil {
+			err = serr
+		} else if policy == mergeRename {
+			free := freeName(*&dfp)
+			if entry.IsDir() {
+				err = copyDir(*&ctx, *&sfp, *&free)
+				copyMetadata(*&sfp, *&free)
+			} else {
+				err = copyFile(*&ctx, *&sfp, *&free)
+				report.Copied++
+			}
+			recordCreation(*&free)
+			report.Renamed[pathToUri(*&sfp)] = pathToUri(*&free)
+		} else if policy == mergeOverwrite && !entry.IsDir() && !existing.IsDir() {
+			err = copyFile(*&ctx, *&sfp, *&dfp)
+			report.Copied++
+			report.Overwritten = append(report.Overwritten, pathToUri(*&dfp))
+		} else {
+			report.Skipped = append(report.Skipped, pathToUri(*&sfp))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//////// METRICS
+
+var metricsMutex sync.Mutex
+var metrics = make(map[string]*int64)
+
+func metric(name string) *int64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	m, ok := metrics[name]
+	if !ok {
+		m = new(int64)
+		metrics[name] = m
+	}
+	return m
+}
+
+func incrementMetric(name string) {
+	atomic.AddInt64(metric(*&name), 1)
+}
+
+func metricsSnapshot() map[string]int64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	snapshot := make(map[string]int64, len(metrics))
+	for name, m := range metrics {
+		snapshot[name] = atomic.LoadInt64(*&m)
+	}
+	return snapshot
+}
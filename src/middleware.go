@@ -0,0 +1,92 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+//////// MIDDLEWARE CHAIN
+
+// Layers the requests go through before reaching the routes, outermost
+// first. They are named so that code embedding the cloud can insert its
+// own at a defined place in the order, before the handler is built.
+
+type middleware struct {
+	name string
+	wrap func(next http.Handler) http.Handler
+}
+
+var middlewares = []middleware{
+	{"idle", idleMiddleware},
+	{"virtual-hosts", virtualHostMiddleware},
+	{"base-path", basePathMiddleware},
+	{"request-id", requestIdMiddleware},
+	{"capture", captureMiddleware},
+	{"log", logMiddleware},
+	{"client-stats", clientStatsMiddleware},
+	{"chaos", chaosMiddleware},
+	{"compat", compatMiddleware},
+	{"api-version", apiVersionMiddleware},
+	{"date-format", dateFormatMiddleware},
+	{"recovery", recoveryMiddleware},
+	{"ip-filter", ipFilterMiddleware},
+	{"acl", aclMiddleware},
+	{"quota", quotaMiddleware},
+	{"disk-space", diskSpaceMiddleware},
+	{"usage-warning", usageWarningMiddleware},
+	{"timeout", timeoutMiddleware},
+	{"watchdog", watchdogMiddleware},
+	{"throttle", throttleMiddleware},
+	{"upload-progress", uploadProgressMiddleware},
+	{"priority", priorityMiddleware},
+	{"debug", debugMiddleware},
+}
+
+var errNoMiddleware = errors.New("no such middleware")
+
+// Inserts a layer right outside of the named one, so that it sees the
+// requests before it does, or innermost if before is empty.
+func insertMiddleware(before string, name string, wrap func(next http.Handler) http.Handler) error {
+	i := len(middlewares)
+	if before != "" {
+		i = -1
+		for j, m := range middlewares {
+			if m.name == before {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return errNoMiddleware
+		}
+	}
+	middlewares = append(middlewares[:i], append([]middleware{{*&name, *&wrap}}, middlewares[i:]...)...)
+	return nil
+}
+
+// Wraps a handler into the layers of the chain.
+func chainMiddlewares(h http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i].wrap(*&h)
+	}
+	return h
+}
@@ -0,0 +1,413 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////// MINIFICATION
+
+type sourceMap struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+const vlqChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func writeVLQ(buf *bytes.Buffer, v int) {
+	if v < 0 {
+		v = (-v << 1) | 1
+	} else {
+		v <<= 1
+	}
+	for {
+		digit := v & 31
+		v >>= 5
+		if v > 0 {
+			digit |= 32
+		}
+		buf.WriteByte(vlqChars[digit])
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// Accumulates the minified output along with the source map segments
+// pointing each emitted token back to its position in the original.
+type minifier struct {
+	src        []byte
+	lineStarts []int
+	out        bytes.Buffer
+	genCol     int
+	mappings   bytes.Buffer
+	segments   int
+	prevGenCol int
+	prevLine   int
+	prevCol    int
+}
+
+func newMinifier(src []byte) *minifier {
+	m := &minifier{src: src, lineStarts: []int{0}}
+	for i, c := range src {
+		if c == '\n' {
+			m.lineStarts = append(m.lineStarts, i+1)
+		}
+	}
+	return m
+}
+
+func (m *minifier) position(offset int) (line int, col int) {
+	line = sort.SearchInts(m.lineStarts, offset+1) - 1
+	return line, offset - m.lineStarts[line]
+}
+
+func (m *minifier) last() byte {
+	if m.out.Len() == 0 {
+		return 0
+	}
+	return m.out.Bytes()[m.out.Len()-1]
+}
+
+// Emits a token which starts at the given offset of the source.
+func (m *minifier) token(offset int, tok []byte) {
+	line, col := m.position(*&offset)
+	if m.segments > 0 {
+		m.mappings.WriteByte(',')
+	}
+	writeVLQ(&m.mappings, m.genCol-m.prevGenCol)
+	writeVLQ(&m.mappings, 0)
+	writeVLQ(&m.mappings, line-m.prevLine)
+	writeVLQ(&m.mappings, col-m.prevCol)
+	m.segments++
+	m.prevGenCol, m.prevLine, m.prevCol = m.genCol, line, col
+	m.raw(*&tok)
+}
+
+// Emits generated text without a mapping of its own.
+func (m *minifier) raw(s []byte) {
+	for _, c := range s {
+		m.out.WriteByte(c)
+		if c == '\n' {
+			m.mappings.WriteByte(';')
+			m.genCol, m.prevGenCol, m.segments = 0, 0, 0
+		} else {
+			m.genCol++
+		}
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// Returns the end offset of the string literal starting at i.
+func scanQuoted(src []byte, i int) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+//// JavaScript
+
+var jsRegexpKeywords = []string{"return", "typeof", "instanceof", "in", "of", "new", "delete", "void", "throw", "case", "do", "else", "yield", "await"}
+
+// Conservative JavaScript minifier: strips comments and indentation but
+// keeps line breaks, so automatic semicolon insertion is never affected.
+func minifyJS(src []byte) *minifier {
+	m := newMinifier(src)
+	prevToken := ""
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpaceByte(c) || (c == '/' && i+1 < len(src) && (src[i+1] == '/' || src[i+1] == '*')):
+			newline := false
+			for i < len(src) {
+				if src[i] == '\n' {
+					newline = true
+					i++
+				} else if isSpaceByte(src[i]) {
+					i++
+				} else if src[i] == '/' && i+1 < len(src) && src[i+1] == '/' {
+					for i < len(src) && src[i] != '\n' {
+						i++
+					}
+				} else if src[i] == '/' && i+1 < len(src) && src[i+1] == '*' {
+					end := bytes.Index(src[i+2:], []byte("*/"))
+					if end < 0 {
+						end = len(src) - i - 4
+					}
+					if bytes.IndexByte(src[i:i+end+4], '\n') >= 0 {
+						newline = true
+					}
+					i += end + 4
+				} else {
+					break
+				}
+			}
+			if i >= len(src) || m.out.Len() == 0 {
+				continue
+			}
+			next := src[i]
+			if newline && m.last() != '\n' {
+				m.raw([]byte("\n"))
+			} else if !newline && ((isIdentByte(m.last()) && isIdentByte(*&next)) ||
+				(m.last() == '+' && next == '+') || (m.last() == '-' && next == '-')) {
+				m.raw([]byte(" "))
+			}
+		case c == '"' || c == '\'' || c == '`':
+			end := scanQuoted(*&src, *&i)
+			m.token(*&i, src[i:end])
+			prevToken, i = "\"", end
+		case c == '/' && (prevToken == "" || (!isIdentByte(prevToken[0]) && prevToken != ")" && prevToken != "]" && prevToken != "\"") || sliceContains(jsRegexpKeywords, *&prevToken)):
+			// Regular expression literal
+			end, class := i+1, false
+			for ; end < len(src) && src[end] != '\n'; end++ {
+				if src[end] == '\\' {
+					end++
+				} else if src[end] == '[' {
+					class = true
+				} else if src[end] == ']' {
+					class = false
+				} else if src[end] == '/' && !class {
+					break
+				}
+			}
+			for end++; end < len(src) && isIdentByte(src[end]); end++ {
+			}
+			if end > len(src) {
+				end = len(src)
+			}
+			m.token(*&i, src[i:end])
+			prevToken, i = ")", end
+		case isIdentByte(c):
+			end := i
+			for end < len(src) && (isIdentByte(src[end]) || (src[end] == '.' && src[i] >= '0' && src[i] <= '9')) {
+				end++
+			}
+			m.token(*&i, src[i:end])
+			prevToken, i = string(src[i:end]), end
+		default:
+			m.token(*&i, src[i:i+1])
+			prevToken, i = string(c), i+1
+		}
+	}
+	return m
+}
+
+//// CSS
+
+func minifyCSS(src []byte) *minifier {
+	m := newMinifier(src)
+	semicolon := -1
+	space := false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpaceByte(c):
+			space = true
+			i++
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 4
+			}
+			space = true
+			continue
+		}
+		// Defer semicolons, the last one of a block is useless
+		if semicolon >= 0 && c != '}' {
+			m.token(*&semicolon, []byte(";"))
+		}
+		if c == ';' {
+			semicolon = i
+			space = false
+			i++
+			continue
+		}
+		semicolon = -1
+		if space && m.out.Len() > 0 && !strings.ContainsRune("{};,:>", rune(m.last())) && !strings.ContainsRune("{};,>", rune(c)) {
+			m.raw([]byte(" "))
+		}
+		space = false
+		if c == '"' || c == '\'' {
+			end := scanQuoted(*&src, *&i)
+			m.token(*&i, src[i:end])
+			i = end
+			continue
+		}
+		end := i + 1
+		for isIdentByte(c) && end < len(src) && (isIdentByte(src[end]) || src[end] == '-' || src[end] == '.' || src[end] == '%') {
+			end++
+		}
+		m.token(*&i, src[i:end])
+		i = end
+	}
+	return m
+}
+
+//// Files
+
+var minifiers = map[string]func(src []byte) *minifier{
+	".js":  minifyJS,
+	".css": minifyCSS,
+}
+
+func isMinified(p string) bool {
+	name := strings.ToLower(filepath.Base(*&p))
+	return strings.HasSuffix(*&name, ".min.js") || strings.HasSuffix(*&name, ".min.css")
+}
+
+// Minifies source into dest and writes dest.map next to it. The original
+// content is embedded in the map so it remains debuggable once overwritten.
+func minifyFile(source string, dest string) (report assetReport, err error) {
+	report.Uri = pathToUri(*&dest)
+	report.Step = "minify"
+	ext := strings.ToLower(filepath.Ext(*&source))
+	minify, ok := minifiers[*&ext]
+	if !ok {
+		err = os.ErrInvalid
+		return
+	}
+	src, err := readFile(*&source)
+	if err != nil {
+		return
+	}
+	m := minify(*&src)
+	rel, err := filepath.Rel(filepath.Dir(*&dest), *&source)
+	if err != nil {
+		return
+	}
+	sm := sourceMap{
+		Version:        3,
+		File:           filepath.Base(*&dest),
+		Sources:        []string{filepath.ToSlash(*&rel)},
+		SourcesContent: []string{string(*&src)},
+		Names:          []string{},
+		Mappings:       m.mappings.String(),
+	}
+	j, err := json.Marshal(*&sm)
+	if err != nil {
+		return
+	}
+	err = saveFile(*&dest+".map", *&j)
+	if err != nil {
+		return
+	}
+	mapUrl := filepath.Base(*&dest) + ".map"
+	if ext == ".css" {
+		m.out.WriteString("\n/*# sourceMappingURL=" + mapUrl + " */\n")
+	} else {
+		m.out.WriteString("\n//# sourceMappingURL=" + mapUrl + "\n")
+	}
+	err = saveFile(*&dest, m.out.Bytes())
+	if err != nil {
+		return
+	}
+	report.OriginalSize = len(*&src)
+	report.Size = m.out.Len()
+	report.Saved = report.OriginalSize - report.Size
+	return
+}
+
+// Minifies every script and stylesheet under root, either in place or into
+// .min.js/.min.css siblings.
+func minifyTree(ctx context.Context, root string, inPlace bool) (reports []assetReport, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(*&p))
+		if _, ok := minifiers[*&ext]; info.IsDir() || !ok || isMinified(*&p) {
+			return nil
+		}
+		dest := p
+		if !inPlace {
+			dest = strings.TrimSuffix(*&p, filepath.Ext(*&p)) + ".min" + ext
+		}
+		report, err := minifyFile(*&p, *&dest)
+		if err != nil {
+			return err
+		}
+		reports = append(*&reports, *&report)
+		return nil
+	})
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Minification API
+
+// Minify a script or stylesheet, or every one under a directory
+func minifyHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[minifyPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !exist(*&p) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	reports, err := minifyTree(r.Context(), *&p, false)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&reports)
+}
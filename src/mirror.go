@@ -0,0 +1,338 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// MIRROR
+
+// Keeps a copy of the projects in another local directory, such as on an
+// external drive, with -mirror. The changes of the journal are replayed
+// there as they come, and the whole tree is compared again at startup,
+// every hour and whenever some change could not be replayed, so that the
+// mirror catches up after the drive comes back. Files are copied as they
+// are on disk, encrypted projects staying encrypted. Those edited on the
+// side of the mirror are kept as conflicts rather than overwritten.
+
+const mirrorResyncInterval = time.Hour
+const mirrorRetryDelay = time.Minute
+
+var mirrorDir string
+
+// Held while the mirror is written to
+var mirrorLock sync.Mutex
+
+type mirrorStatus struct {
+	mutex    sync.Mutex
+	cursor   int64
+	synced   time.Time
+	updated  time.Time
+	copied   int64
+	removed  int64
+	failures int64
+	err      error
+}
+
+var mirrorHealth mirrorStatus
+
+func (s *mirrorStatus) count(copied int64, removed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.copied += copied
+	s.removed += removed
+	if copied+removed > 0 {
+		s.updated = time.Now()
+	}
+}
+
+func (s *mirrorStatus) done(cursor int64, full bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+	if err != nil {
+		s.failures++
+		return
+	}
+	s.cursor = cursor
+	if full {
+		s.synced = time.Now()
+	}
+}
+
+func (s *mirrorStatus) report() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	report := map[string]interface{}{"enabled": mirrorDir != ""}
+	if mirrorDir == "" {
+		return report
+	}
+	report["path"] = mirrorDir
+	report["cursor"] = s.cursor
+	report["copied"] = s.copied
+	report["removed"] = s.removed
+	report["failures"] = s.failures
+	report["conflicts"] = conflictCount()
+	report["healthy"] = s.err == nil && !s.synced.IsZero()
+	if !s.synced.IsZero() {
+		report["synced"] = milliseconds(s.synced)
+	}
+	if !s.updated.IsZero() {
+		report["updated"] = milliseconds(s.updated)
+	}
+	if s.err != nil {
+		report["error"] = s.err.Error()
+	}
+	return report
+}
+
+func checkMirror() (err error) {
+	if backendFlag != "disk" {
+		return errors.New("the mirror needs the disk backend")
+	}
+	mirrorDir, err = filepath.Abs(mirrorFlag)
+	if err != nil {
+		return
+	}
+	root, err := filepath.Abs(filepath.Join(rootFlag, projectsDir))
+	if err != nil {
+		return
+	}
+	if filepath.HasPrefix(*&mirrorDir, *&root) || filepath.HasPrefix(*&root, *&mirrorDir) {
+		return errors.New("the mirror and the projects can't be inside one another")
+	}
+	return os.MkdirAll(*&mirrorDir, 0777)
+}
+
+// Projects as on disk, without decrypting them nor opening their archives.
+func mirrorSource() storage {
+	s := rawStorage()
+	if z, ok := s.(zipStorage); ok {
+		return z.storage
+	}
+	return s
+}
+
+// Whether a path is part of what gets mirrored: internal files are left
+// out, but for the encryption parameters of projects.
+func mirrored(p string) bool {
+	name := filepath.Base(*&p)
+	return !strings.HasPrefix(*&name, hiddenPrefix) || name == encryptionFile
+}
+
+func mirrorPath(p string) string {
+	return filepath.Join(*&mirrorDir, *&p)
+}
+
+// Copies a file to the mirror unless it already has it, through a
+// temporary file so that the mirror never holds half of one.
+func mirrorFile(source storage, p string, info os.FileInfo) (copied bool, err error) {
+	dest := mirrorPath(*&p)
+	if di, err := os.Stat(*&dest); err == nil && !di.IsDir() {
+		if di.Size() == info.Size() && di.ModTime().Equal(info.ModTime()) {
+			rememberMirrored(*&p, recordOf(*&di))
+			return false, nil
+		}
+		if conflictPending(*&p) {
+			return false, nil
+		}
+		if mirrorEdited(*&p, *&di, *&info) {
+			return false, keepConflict(*&source, *&p, *&info, *&di)
+		}
+	}
+	sf, err := source.open(*&p)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	err = os.MkdirAll(filepath.Dir(*&dest), 0777)
+	if err != nil {
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(*&dest), hiddenPrefix+"mirror-"+randomString(8))
+	df, err := os.OpenFile(*&tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(*&df, ctxReader{backgroundContext, *&sf})
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(*&tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		// Replacing a directory of the same name
+		if di, serr := os.Stat(*&dest); serr == nil && di.IsDir() {
+			err = os.RemoveAll(*&dest)
+		}
+	}
+	if err == nil {
+		err = os.Rename(*&tmp, *&dest)
+	}
+	if err != nil {
+		os.Remove(*&tmp)
+		return
+	}
+	if di, err := os.Stat(*&dest); err == nil {
+		rememberMirrored(*&p, recordOf(*&di))
+	}
+	return true, nil
+}
+
+// Brings a path of the mirror in line with the projects.
+func mirrorUpdate(source storage, p string) (copied int64, removed int64, err error) {
+	info, err := source.stat(*&p)
+	if os.IsNotExist(*&err) {
+		removed, err = mirrorRemove(*&source, *&p)
+		return 0, removed, err
+	} else if err != nil {
+		return
+	}
+	if info.IsDir() {
+		return mirrorSync(*&source, *&p)
+	}
+	ok, err := mirrorFile(*&source, *&p, *&info)
+	if ok {
+		copied++
+	}
+	return
+}
+
+// Compares a whole directory with the mirror, copying what differs and
+// removing what is gone.
+func mirrorSync(source storage, p string) (copied int64, removed int64, err error) {
+	if di, serr := os.Lstat(mirrorPath(*&p)); serr == nil && !di.IsDir() {
+		err = os.Remove(mirrorPath(*&p))
+		if err != nil {
+			return
+		}
+		removed++
+	}
+	err = os.MkdirAll(mirrorPath(*&p), 0777)
+	if err != nil {
+		return
+	}
+	entries, err := source.readDir(*&p)
+	if os.IsNotExist(*&err) {
+		return 0, removed, nil
+	} else if err != nil {
+		return
+	}
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if err = ioPause(backgroundContext); err != nil {
+			return
+		}
+		child := filepath.Join(*&p, e.Name())
+		if !mirrored(*&child) {
+			continue
+		}
+		names[e.Name()] = true
+		var c, r int64
+		if e.IsDir() {
+			c, r, err = mirrorSync(*&source, *&child)
+		} else if ok, ferr := mirrorFile(*&source, *&child, *&e); ok {
+			c = 1
+		} else {
+			err = ferr
+		}
+		copied, removed = copied+c, removed+r
+		if err != nil {
+			return
+		}
+	}
+	existing, err := os.ReadDir(mirrorPath(*&p))
+	if err != nil {
+		return
+	}
+	for _, e := range existing {
+		if !names[e.Name()] {
+			r, err := mirrorRemove(*&source, filepath.Join(*&p, e.Name()))
+			removed += r
+			if err != nil {
+				return copied, removed, err
+			}
+		}
+	}
+	return
+}
+
+// Replays the changes of the journal on the mirror, going back to a whole
+// comparison when some of them are missed or fail.
+func startMirror() {
+	go func() {
+		source := mirrorSource()
+		resync := true
+		var synced time.Time
+		var cursor int64
+		for {
+			if resync || time.Since(*&synced) > mirrorResyncInterval {
+				latest := journal.latest()
+				start := time.Now()
+				mirrorLock.Lock()
+				copied, removed, err := mirrorSync(*&source, ".")
+				mirrorLock.Unlock()
+				mirrorHealth.count(*&copied, *&removed)
+				mirrorHealth.done(*&latest, true, *&err)
+				if err != nil {
+					logWarn("Could not mirror to", mirrorDir+":", err)
+					time.Sleep(mirrorRetryDelay)
+					continue
+				}
+				logDebug("mirror", "Synchronized in", time.Since(*&start), "copying", *&copied, "and removing", *&removed)
+				resync, synced, cursor = false, start, latest
+			}
+			changes, latest, ok := journal.wait(*&cursor, time.Minute, nil)
+			if !ok {
+				resync = true
+				continue
+			}
+			var err error
+			mirrorLock.Lock()
+			for _, c := range changes {
+				p, ok := uriToPath(c.Uri)
+				if !ok || !mirrored(*&p) {
+					continue
+				}
+				copied, removed, uerr := mirrorUpdate(*&source, *&p)
+				mirrorHealth.count(*&copied, *&removed)
+				if uerr != nil {
+					err = uerr
+				}
+			}
+			mirrorLock.Unlock()
+			mirrorHealth.done(*&latest, false, *&err)
+			if err != nil {
+				logWarn("Could not mirror to", mirrorDir+":", err)
+				resync = true
+				time.Sleep(mirrorRetryDelay)
+			}
+			cursor = latest
+		}
+	}()
+}
@@ -0,0 +1,160 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//// MQTT
+
+// Client of MQTT 3.1.1 limited to publishing, at most once: the change
+// journal stays the reference for clients which cannot miss anything.
+
+const mqttKeepAlive = 60
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xc0
+	mqttDisconnect = 0xe0
+)
+
+type mqttConnection struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	broken chan struct{}
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func mqttPacket(kind byte, body []byte) []byte {
+	packet := []byte{kind}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(*&packet, *&digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(*&packet, body...)
+}
+
+func dialMQTT(u *url.URL, b *bridgeConfig) (c brokerConnection, err error) {
+	conn, err := dialBroker(*&u, "1883", "8883")
+	if err != nil {
+		return
+	}
+	flags := byte(0x02) // Clean session
+	body := append(mqttString("MQTT"), 4, 0, mqttKeepAlive>>8, mqttKeepAlive&0xff)
+	body = append(*&body, mqttString(APP_NAME+"-"+strconv.FormatInt(time.Now().UnixNano(), 36))...)
+	if u.User != nil {
+		flags |= 0x80
+		body = append(*&body, mqttString(u.User.Username())...)
+		if password, ok := u.User.Password(); ok {
+			flags |= 0x40
+			body = append(*&body, mqttString(*&password)...)
+		}
+	}
+	body[7] = flags
+	conn.SetDeadline(time.Now().Add(brokerTimeout))
+	_, err = conn.Write(mqttPacket(mqttConnect, *&body))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	ack := make([]byte, 4)
+	_, err = io.ReadFull(*&conn, *&ack)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if ack[0] != mqttConnack || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused with code %d", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	m := &mqttConnection{conn: conn, broken: make(chan struct{})}
+	go m.drain()
+	go m.keepAlive()
+	return m, nil
+}
+
+// Reads and discards what the broker sends, ping responses only, until
+// the connection goes away.
+func (m *mqttConnection) drain() {
+	io.Copy(ioutil.Discard, bufio.NewReader(m.conn))
+	close(m.broken)
+}
+
+func (m *mqttConnection) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if m.write(mqttPacket(mqttPingreq, nil)) != nil {
+				return
+			}
+		case <-m.broken:
+			return
+		}
+	}
+}
+
+func (m *mqttConnection) write(packet []byte) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	select {
+	case <-m.broken:
+		return errors.New("mqtt: connection closed by the broker")
+	default:
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(brokerTimeout))
+	_, err = m.conn.Write(*&packet)
+	return
+}
+
+func (m *mqttConnection) publish(topic string, payload []byte) error {
+	return m.write(mqttPacket(mqttPublish, append(mqttString(*&topic), payload...)))
+}
+
+func (m *mqttConnection) close() error {
+	m.write(mqttPacket(mqttDisconnect, nil))
+	return m.conn.Close()
+}
@@ -0,0 +1,289 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//////// NETWORK ROOTS
+
+// With -network-root, the projects are assumed to live on an SMB or NFS
+// share, where every call is a round trip: file details and directory
+// listings are cached for -metadata-ttl, the cloud's own changes
+// invalidating them right away and others being noticed once they expire
+// or the cache is dropped through the API, and calls failing with errors
+// such shares return transiently are retried with a growing delay. Scans
+// for changes are also spaced out unless their interval is set.
+
+const networkWatchInterval = 30 * time.Second
+
+var networkRetryDelays = []time.Duration{100 * time.Millisecond, 400 * time.Millisecond, 1600 * time.Millisecond}
+
+type cachedStat struct {
+	info    os.FileInfo
+	err     error
+	expires time.Time
+}
+
+type cachedListing struct {
+	list    []os.FileInfo
+	expires time.Time
+}
+
+var metadataCache = struct {
+	sync.Mutex
+	stats    map[string]cachedStat
+	listings map[string]cachedListing
+	hits     int64
+	misses   int64
+}{stats: make(map[string]cachedStat), listings: make(map[string]cachedListing)}
+
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT, syscall.ESTALE, syscall.ECONNRESET} {
+		if errors.Is(*&err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs a call, again after a delay each time it fails transiently.
+func withRetries(call func() error) (err error) {
+	for _, delay := range networkRetryDelays {
+		err = call()
+		if err == nil || !isTransient(*&err) {
+			return
+		}
+		time.Sleep(*&delay)
+	}
+	return call()
+}
+
+// Drops what is cached about a path, the listing of its directory, and
+// everything under it for trees.
+func invalidateMetadata(name string, tree bool) {
+	name = filepath.Clean(*&name)
+	prefix := name + string(filepath.Separator)
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+	delete(metadataCache.stats, *&name)
+	delete(metadataCache.listings, *&name)
+	delete(metadataCache.listings, filepath.Dir(*&name))
+	if !tree {
+		return
+	}
+	for p := range metadataCache.stats {
+		if strings.HasPrefix(*&p, *&prefix) {
+			delete(metadataCache.stats, *&p)
+		}
+	}
+	for p := range metadataCache.listings {
+		if strings.HasPrefix(*&p, *&prefix) {
+			delete(metadataCache.listings, *&p)
+		}
+	}
+}
+
+func evictMetadataCache() {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+	metadataCache.stats = make(map[string]cachedStat)
+	metadataCache.listings = make(map[string]cachedListing)
+}
+
+func metadataCacheReport() map[string]interface{} {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+	return map[string]interface{}{
+		"ttl-ms":   metadataTTLFlag.Milliseconds(),
+		"stats":    len(metadataCache.stats),
+		"listings": len(metadataCache.listings),
+		"hits":     metadataCache.hits,
+		"misses":   metadataCache.misses,
+	}
+}
+
+//// Storage
+
+type networkStorage struct {
+	storage
+}
+
+func (n networkStorage) stat(name string) (info os.FileInfo, err error) {
+	name = filepath.Clean(*&name)
+	metadataCache.Lock()
+	c, ok := metadataCache.stats[name]
+	if ok && time.Now().Before(c.expires) {
+		metadataCache.hits++
+		metadataCache.Unlock()
+		return c.info, c.err
+	}
+	metadataCache.misses++
+	metadataCache.Unlock()
+	err = withRetries(func() (err error) {
+		info, err = n.storage.stat(*&name)
+		return
+	})
+	// Missing files are remembered too, other failures not
+	if err == nil || os.IsNotExist(*&err) {
+		metadataCache.Lock()
+		metadataCache.stats[name] = cachedStat{info, err, time.Now().Add(metadataTTLFlag)}
+		metadataCache.Unlock()
+	}
+	return
+}
+
+func (n networkStorage) readDir(name string) (list []os.FileInfo, err error) {
+	name = filepath.Clean(*&name)
+	metadataCache.Lock()
+	c, ok := metadataCache.listings[name]
+	if ok && time.Now().Before(c.expires) {
+		metadataCache.hits++
+		metadataCache.Unlock()
+		return append([]os.FileInfo{}, c.list...), nil
+	}
+	metadataCache.misses++
+	metadataCache.Unlock()
+	err = withRetries(func() (err error) {
+		list, err = n.storage.readDir(*&name)
+		return
+	})
+	if err != nil {
+		return
+	}
+	expires := time.Now().Add(metadataTTLFlag)
+	metadataCache.Lock()
+	metadataCache.listings[name] = cachedListing{append([]os.FileInfo{}, list...), expires}
+	// Listings tell the details of their entries as well
+	for _, info := range list {
+		metadataCache.stats[filepath.Join(*&name, info.Name())] = cachedStat{info, nil, expires}
+	}
+	metadataCache.Unlock()
+	return
+}
+
+func (n networkStorage) open(name string) (r io.ReadCloser, err error) {
+	err = withRetries(func() (err error) {
+		r, err = n.storage.open(*&name)
+		return
+	})
+	return
+}
+
+func (n networkStorage) create(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	invalidateMetadata(*&name, false)
+	err = withRetries(func() (err error) {
+		w, err = n.storage.create(*&name, *&perm)
+		return
+	})
+	if err == nil {
+		w = invalidatingWriter{w, name}
+	}
+	return
+}
+
+func (n networkStorage) createNew(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	invalidateMetadata(*&name, false)
+	// Not retried, since a first attempt may have created the file
+	w, err = n.storage.createNew(*&name, *&perm)
+	if err == nil {
+		w = invalidatingWriter{w, name}
+	}
+	return
+}
+
+func (n networkStorage) mkdirAll(name string, perm os.FileMode) error {
+	defer invalidateMetadata(filepath.Dir(*&name), true)
+	return withRetries(func() error { return n.storage.mkdirAll(*&name, *&perm) })
+}
+
+func (n networkStorage) remove(name string) error {
+	defer invalidateMetadata(*&name, true)
+	return n.storage.remove(*&name)
+}
+
+func (n networkStorage) removeAll(name string) error {
+	defer invalidateMetadata(*&name, true)
+	return withRetries(func() error { return n.storage.removeAll(*&name) })
+}
+
+func (n networkStorage) rename(source string, dest string) error {
+	defer invalidateMetadata(*&source, true)
+	defer invalidateMetadata(*&dest, true)
+	return n.storage.rename(*&source, *&dest)
+}
+
+func (n networkStorage) chmod(name string, mode os.FileMode) error {
+	defer invalidateMetadata(*&name, false)
+	return withRetries(func() error { return n.storage.chmod(*&name, *&mode) })
+}
+
+// Forgets the details of a file once written.
+type invalidatingWriter struct {
+	io.WriteCloser
+	name string
+}
+
+func (w invalidatingWriter) Close() error {
+	defer invalidateMetadata(w.name, false)
+	return w.WriteCloser.Close()
+}
+
+//////// REQUEST HANDLERS
+
+//// Cache API
+
+// Drop the cached metadata, all of it or that of a tree, after changes
+// made to the share by others
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if authEnabled() && requestUser(*&r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, metadataCacheReport())
+		return
+	case "DELETE":
+		if q := r.URL.Query().Get("path"); q != "" {
+			p, ok := uriToPath(*&q)
+			if !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			invalidateMetadata(*&p, true)
+		} else {
+			evictMetadataCache()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
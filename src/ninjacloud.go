@@ -20,16 +20,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const APP_NAME = "Ninja Go Local Cloud"
@@ -38,21 +46,200 @@ const APP_VERSION = "0.1"
 var versionFlag bool
 var interfaceFlag string
 var portFlag string
+var unixSocketFlag string
+var basePathFlag string
+var logFormatFlag string
+var tenantsFlag bool
+var tenantQuotaFlag string
+var sessionSecretFlag string
+var quotaWarningFlag float64
+var diskWarningFlag string
+var diskReserveFlag string
+var preallocateFlag bool
+var inboxFlag bool
+var inboxMaxSizeFlag string
+var inboxCapacityFlag string
+var inboxTypesFlag string
+var sessionLifetimeFlag time.Duration
 var rootFlag string
+var googleFontsKeyFlag string
+var chromeFlag string
+var ffmpegFlag string
+var gitFlag string
+var autosaveFlag time.Duration
+var configFlag string
+var profileFlag string
+var tokenFlag string
+var allowIPsFlag string
+var insecureFlag bool
+var headerTimeoutFlag time.Duration
+var readTimeoutFlag time.Duration
+var writeTimeoutFlag time.Duration
+var opTimeoutFlag time.Duration
+var checkUpdateFlag bool
+var diagnoseFlag bool
+var logLevelFlag string
+var logModulesFlag string
+var captureDirFlag string
+var captureBodyLimitFlag int
+var replayFlag string
+var compatFlag int
+var chaosLatencyFlag time.Duration
+var chaosErrorRateFlag float64
+var chaosPartialRateFlag float64
+var snapshotsFlag string
+var snapshotsKeepFlag int
+var clipboardFlag bool
+var notifyFlag time.Duration
+var profilingFlag bool
+var openFlag bool
+var openRouteFlag string
+var portConflictFlag string
+var idleTimeoutFlag time.Duration
+var fsTimeoutFlag time.Duration
+var networkRootFlag bool
+var requireSigningFlag bool
+var verifyWritesFlag bool
+var revisionHashFlag string
+var verifyHashFlag string
+var fileModeFlag string
+var dirModeFlag string
+var portableNamesFlag string
+var longPathsFlag bool
+var browseZipsFlag bool
+var metadataTTLFlag time.Duration
+var maxMemoryFlag string
+var warmUpFlag bool
+var selfTestFlag bool
+var mirrorFlag string
+var updateUrlFlag string
+var updateKeyFlag string
+var assetsDirFlag string
+var extractAssetsFlag string
+var licenseFlag bool
+var backendFlag string
+var seedFlag string
+var overlayFlag string
+var libraryFlag string
+var watchIntervalFlag time.Duration
+var maxBandwidthFlag string
+var backgroundPriorityFlag string
+var ioParallelismFlag int
+var debounceFlag time.Duration
 
 const driveName = "Z"
 const drivePrefix = driveName + ":/"
 
 const projectsDir = "Ninja"
 
+// Files and directories used by the cloud itself, hidden from listings.
+const hiddenPrefix = ".ninja-"
+
 const filePath = "/file/"
 const dirPath = "/directory/"
 const webPath = "/web?url="
 const statusPath = "/cloudstatus/"
+const fontsPath = "/fonts/"
+const optimizePath = "/optimize/"
+const publishPath = "/publish/"
+const packPath = "/pack/"
+const minifyPath = "/minify/"
+const lintPath = "/lint/"
+const renderPath = "/render"
+const settingsPath = "/settings/"
+const draftsPath = "/drafts/"
+const autosavePath = "/autosave/"
+const presencePath = "/presence"
+const updatePath = "/admin/update"
+const cachePath = "/admin/cache"
+const keysPath = "/admin/keys/"
+const watcherPath = "/admin/watcher"
+const restartPath = "/admin/restart"
+const syncConflictsPath = "/sync/conflicts/"
+const templatesPath = "/templates/"
+const uiPath = "/ui/"
+const libraryPath = "/library/"
+const checkPath = "/check/"
+const inspectPath = "/inspect/"
+const palettePath = "/palette/"
+const transcodePath = "/transcode/"
+const jobsPath = "/jobs/"
+const authPath = "/auth/"
+const sharesPath = "/shares/"
+const sharedPath = "/shared/"
+const inboxPath = "/inbox/"
+const signPath = "/sign/"
+const searchPath = "/search/"
+const blocksPath = "/blocks/"
+const snapshotsPath = "/snapshots/"
+const versionsPath = "/versions/"
+const schedulePath = "/schedule/"
+const retentionPath = "/retention/"
+const archivesPath = "/archives/"
+const clonePath = "/clone/"
+const connectorsPath = "/connectors/"
+const clipboardPath = "/clipboard/"
+const desktopPath = "/desktop/"
+const pairPath = "/pair/"
+const statsPath = "/stats/"
+const statPath = "/stat/"
+const tailPath = "/tail"
+const encryptionPath = "/encryption/"
+const trashPath = "/trash/"
+const permissionsPath = "/permissions/"
+const namesPath = "/names/"
+const rewritePath = "/rewrite/"
+const savePagePath = "/savepage/"
+const exportPath = "/export/"
+const exportsPath = "/exports/"
+const debugPath = "/debug/"
+const eventsPath = "/events"
+const eventsPollPath = "/events/poll"
 
 const filePathLen = len(filePath)
 const dirPathLen = len(dirPath)
 const webPathLen = len(webPath)
+const optimizePathLen = len(optimizePath)
+const publishPathLen = len(publishPath)
+const minifyPathLen = len(minifyPath)
+const lintPathLen = len(lintPath)
+const syncConflictsPathLen = len(syncConflictsPath)
+const settingsPathLen = len(settingsPath)
+const draftsPathLen = len(draftsPath)
+const autosavePathLen = len(autosavePath)
+const templatesPathLen = len(templatesPath)
+const libraryPathLen = len(libraryPath)
+const checkPathLen = len(checkPath)
+const inspectPathLen = len(inspectPath)
+const palettePathLen = len(palettePath)
+const transcodePathLen = len(transcodePath)
+const jobsPathLen = len(jobsPath)
+const authPathLen = len(authPath)
+const sharesPathLen = len(sharesPath)
+const sharedPathLen = len(sharedPath)
+const inboxPathLen = len(inboxPath)
+const signPathLen = len(signPath)
+const searchPathLen = len(searchPath)
+const blocksPathLen = len(blocksPath)
+const snapshotsPathLen = len(snapshotsPath)
+const versionsPathLen = len(versionsPath)
+const schedulePathLen = len(schedulePath)
+const archivesPathLen = len(archivesPath)
+const clonePathLen = len(clonePath)
+const connectorsPathLen = len(connectorsPath)
+const clipboardPathLen = len(clipboardPath)
+const desktopPathLen = len(desktopPath)
+const pairPathLen = len(pairPath)
+const statsPathLen = len(statsPath)
+const encryptionPathLen = len(encryptionPath)
+const trashPathLen = len(trashPath)
+const keysPathLen = len(keysPath)
+const permissionsPathLen = len(permissionsPath)
+const namesPathLen = len(namesPath)
+const rewritePathLen = len(rewritePath)
+const savePagePathLen = len(savePagePath)
+const exportPathLen = len(exportPath)
+const exportsPathLen = len(exportsPath)
 
 func sliceContains(s []string, c string) bool {
 	for _, e := range s {
@@ -63,10 +250,120 @@ func sliceContains(s []string, c string) bool {
 	return false
 }
 
+// Converts a cloud URI (or a path relative to the projects directory) into a
+// path relative to the working directory, refusing anything leaving it.
+func uriToPath(uri string) (p string, ok bool) {
+	p = filepath.ToSlash(*&uri)
+	p = strings.TrimPrefix(*&p, drivePrefix)
+	p = strings.TrimPrefix(*&p, "/")
+	if p == projectsDir {
+		p = ""
+	}
+	p = strings.TrimPrefix(*&p, projectsDir+"/")
+	p = filepath.Clean(*&p)
+	if filepath.IsAbs(*&p) || p == ".." || strings.HasPrefix(*&p, "../") || isHiddenPath(*&p) {
+		return "", false
+	}
+	return p, true
+}
+
+// Internal files, such as the metadata store with its tokens, are never
+// reached through the APIs, whatever the directory they are in.
+func isHiddenPath(p string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(*&p), "/") {
+		if strings.HasPrefix(*&part, hiddenPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Path targeted by a request of the Files or Directory APIs: "." for the
+// drive itself and "" for the projects directory.
+func handlerPath(uri string) (p string, ok bool) {
+	if filepath.Clean(*&uri) == "." {
+		return ".", true
+	}
+	p, ok = uriToPath(*&uri)
+	if p == "." {
+		p = ""
+	}
+	return
+}
+
+// Converts a path relative to the working directory into a cloud URI.
+func pathToUri(p string) string {
+	uri := filepath.Clean(drivePrefix + projectsDir + "/" + p)
+	return filepath.ToSlash(*&uri)
+}
+
+func writeCORSHeaders(w http.ResponseWriter) {
+	w.Header().Add("Cache-Control", "no-cache")
+	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, sourceURI, overwrite-destination, check-existence-only, recursive, return-type, operation, delete-source, file-filters, if-modified-since, get-file-info, base-revision, destination, publish-steps, publish-target, lossy, quality, reserve, changes-since, fields, preview-bytes, preview-lines, tail-bytes, tail-lines, max-bandwidth, priority, sanitize-svg, trash, conflict-policy, validate-only, rollback-on-error, include-trashed, range, if-range, upload-id, x-ninja-api-version, x-ninja-date, x-ninja-nonce, x-ninja-content-sha256, x-ninja-date-format, x-ninja-time-zone")
+	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, DELETE, PUT, PATCH")
+	w.Header().Add("Access-Control-Allow-Origin", "*/*")
+	w.Header().Add("Access-Control-Max-Age", "86400")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	j, err := json.MarshalIndent(*&v, "", "	")
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(*&status)
+	w.Write(*&j)
+}
+
+// Fetches a URL, giving up when the context of the originating request ends.
+func httpGet(ctx context.Context, u string) (content []byte, err error) {
+	req, err := http.NewRequestWithContext(*&ctx, "GET", *&u, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", u, resp.Status)
+		return
+	}
+	content, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+func httpGetJSON(ctx context.Context, u string, v interface{}) (err error) {
+	content, err := httpGet(*&ctx, *&u)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(*&content, *&v)
+	return
+}
+
 //////// FILESYSTEM
 
 func properties(path string) (infos os.FileInfo, err error) {
-	infos, err = os.Stat(*&path)
+	infos, err = fsys.stat(*&path)
+	return
+}
+
+// Details the Files API gives about a file.
+func fileInfo(path string) (info map[string]string, err error) {
+	infos, err := properties(*&path)
+	if err != nil {
+		return
+	}
+	info = map[string]string{
+		"creationDate": milliseconds(creationTime(*&path, *&infos)),
+		"modifiedDate": milliseconds(infos.ModTime()),
+		"size":         strconv.FormatInt(infos.Size(), 10),
+		"readOnly":     "false", // TODO
+	}
 	return
 }
 
@@ -85,7 +382,7 @@ func modifiedSince(path string, since string) bool {
 }
 
 func exist(path string) bool {
-	_, err := os.Stat(*&path)
+	_, err := fsys.stat(*&path)
 	if !os.IsNotExist(*&err) {
 		return true
 	}
@@ -99,53 +396,153 @@ func isInRoot(path string) bool {
 //// Files
 
 func writeFile(path string, content []byte, overwrite bool) (err error) {
-	if !overwrite {
-		if exist(*&path) {
-			err = os.ErrExist
-			return
-		}
-	} else {
+	if overwrite {
 		if !exist(*&path) {
 			err = os.ErrNotExist
 			return
 		}
+		err = saveFile(*&path, *&content)
+		return
+	}
+	// Created exclusively, so that concurrent creations can't both succeed
+	f, err := fsys.createNew(*&path, 0777)
+	if os.IsExist(*&err) {
+		err = os.ErrExist
+		return
+	} else if err != nil {
+		return
+	}
+	err = preallocate(*&path, int64(len(*&content)))
+	if err != nil {
+		f.Close()
+		removeFile(*&path)
+		return
+	}
+	err = writeAndClose(*&f, *&content)
+	if err == nil && verifyWritesFlag {
+		err = verifyWrite(*&path, *&content)
+	}
+	return
+}
+
+// Writes a file whether it already exists or not.
+func saveFile(path string, content []byte) (err error) {
+	f, err := fsys.create(*&path, 0777)
+	if err != nil {
+		return
+	}
+	err = preallocate(*&path, int64(len(*&content)))
+	if err != nil {
+		f.Close()
+		return
+	}
+	err = writeAndClose(*&f, *&content)
+	if err == nil && verifyWritesFlag {
+		err = verifyWrite(*&path, *&content)
+	}
+	return
+}
+
+func writeAndClose(f io.WriteCloser, content []byte) (err error) {
+	_, err = f.Write(*&content)
+	if s, ok := f.(syncer); ok && err == nil && verifyWritesFlag {
+		err = s.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	err = ioutil.WriteFile(*&path, *&content, 0777)
 	return
 }
 
 func readFile(path string) (content []byte, err error) {
-	content, err = ioutil.ReadFile(*&path)
+	f, err := fsys.open(*&path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	content, err = ioutil.ReadAll(*&f)
 	return
 }
 
 func removeFile(path string) (err error) {
-	err = os.Remove(*&path)
+	err = fsys.remove(*&path)
 	return
 }
 
 func moveFile(source string, dest string) (err error) {
-	err = os.Rename(*&source, *&dest)
+	if caseOnlyRename(*&source, *&dest) {
+		return renameCase(*&source, *&dest)
+	}
+	err = fsys.rename(*&source, *&dest)
+	if isCrossDevice(*&err) {
+		err = journaledMove(*&source, *&dest, func() error {
+			return copyFile(context.Background(), *&source, *&dest)
+		}, func() error {
+			return fsys.remove(*&source)
+		})
+	}
+	return
+}
+
+// Renames fail between filesystems, such as with a project directory
+// mounted from another disk, where moves have to copy then delete.
+func isCrossDevice(err error) bool {
+	var le *os.LinkError
+	if !errors.As(*&err, &le) {
+		return false
+	}
+	errno, ok := le.Err.(syscall.Errno)
+	// ERROR_NOT_SAME_DEVICE on Windows
+	return ok && (errno == syscall.EXDEV || runtime.GOOS == "windows" && errno == 17)
+}
+
+// Reader giving up as soon as its context is done, and keeping within the
+// bandwidth limits.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (n int, err error) {
+	err = c.ctx.Err()
+	if err != nil {
+		return
+	}
+	n, err = c.r.Read(*&p)
+	if terr := throttle(c.ctx, *&n); terr != nil && err == nil {
+		err = terr
+	}
 	return
 }
 
-func copyFile(source string, dest string) (err error) {
+func copyFile(ctx context.Context, source string, dest string) (err error) {
+	if verifyWritesFlag {
+		defer func() {
+			if err == nil {
+				err = verifyCopy(*&ctx, *&source, *&dest)
+			}
+		}()
+	}
+	// Keeping holes and sharing extents where possible
+	if done, err := copyOnDisk(*&ctx, *&source, *&dest); done {
+		return err
+	}
 	// from https://gist.github.com/2876519
-	sf, err := os.Open(*&source)
+	sf, err := fsys.open(*&source)
 	if err != nil {
 		return err
 	}
 	defer sf.Close()
-	df, err := os.Create(*&dest)
+	df, err := fsys.create(*&dest, 0666)
 	if err != nil {
 		return err
 	}
 	defer df.Close()
-	_, err = io.Copy(*&df, *&sf)
+	_, err = io.Copy(*&df, ctxReader{*&ctx, *&sf})
 	if err == nil {
-		si, err := os.Stat(*&source)
+		si, err := fsys.stat(*&source)
 		if err != nil {
-			err = os.Chmod(*&dest, si.Mode())
+			err = fsys.chmod(*&dest, si.Mode())
 		}
 
 	}
@@ -155,12 +552,12 @@ func copyFile(source string, dest string) (err error) {
 //// Dirs
 
 func createDir(path string) (err error) {
-	err = os.MkdirAll(*&path, 0777)
+	err = fsys.mkdirAll(*&path, 0777)
 	return
 }
 
 func removeDir(path string) (err error) {
-	err = os.RemoveAll(*&path)
+	err = fsys.removeAll(*&path)
 	return
 }
 
@@ -170,110 +567,263 @@ func removeDir(path string) (err error) {
 }*/
 
 func moveDir(source string, dest string) (err error) {
-	err = os.Rename(*&source, *&dest)
+	if caseOnlyRename(*&source, *&dest) {
+		return renameCase(*&source, *&dest)
+	}
+	err = fsys.rename(*&source, *&dest)
+	if isCrossDevice(*&err) {
+		err = journaledMove(*&source, *&dest, func() error {
+			return copyDir(context.Background(), *&source, *&dest)
+		}, func() error {
+			return fsys.removeAll(*&source)
+		})
+	}
 	return
 }
 
-func copyDir(source string, dest string) (err error) {
+func copyDir(ctx context.Context, source string, dest string) (err error) {
+	return copyDirReporting(*&ctx, *&source, *&dest, nil)
+}
+
+// Copies a directory, going on past the entries which fail to copy when
+// given a report to record them in.
+func copyDirReporting(ctx context.Context, source string, dest string, report *copyReport) (err error) {
 	// from https://gist.github.com/2876519
-	fi, err := os.Stat(*&source)
+	fi, err := fsys.stat(*&source)
 	if err != nil {
 		return
 	}
 	if !fi.IsDir() {
 		return os.ErrInvalid
 	}
-	_, err = os.Open(*&dest)
+	_, err = fsys.stat(*&dest)
 	if !os.IsNotExist(*&err) {
 		return os.ErrExist
 	}
-	err = os.MkdirAll(*&dest, fi.Mode())
+	err = fsys.mkdirAll(*&dest, fi.Mode())
 	if err != nil {
 		return
 	}
-	entries, err := ioutil.ReadDir(*&source)
+	report.copied(*&dest)
+	entries, err := fsys.readDir(*&source)
 	for _, entry := range entries {
+		err = ioPause(*&ctx)
+		if err != nil {
+			return
+		}
 		sfp := source + "/" + entry.Name()
 		dfp := dest + "/" + entry.Name()
 		if entry.IsDir() {
-			err = copyDir(*&sfp, *&dfp)
-			if err != nil {
-				return
-			}
+			err = copyDirReporting(*&ctx, *&sfp, *&dfp, *&report)
 		} else {
-			err = copyFile(*&sfp, *&dfp)
-			if err != nil {
-				return
+			err = copyFile(*&ctx, *&sfp, *&dfp)
+			if err == nil {
+				report.copied(*&dfp)
 			}
 		}
+		if err != nil && (ctx.Err() != nil || !report.failed(*&sfp, *&err)) {
+			return
+		}
+		err = nil
 	}
 	return
 }
 
 type element struct {
-	Type         string    `json:"type"`
-	Name         string    `json:"name"`
-	Uri          string    `json:"uri"`
-	CreationDate string    `json:"creationDate"`
-	ModifiedDate string    `json:"modifiedDate"`
-	Size         string    `json:"size"`
-	Writable     string    `json:"writable"`
-	Children     []element `json:"children"`
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	Uri          string `json:"uri"`
+	CreationDate string `json:"creationDate"`
+	ModifiedDate string `json:"modifiedDate"`
+	Size         string `json:"size"`
+	Writable     string `json:"writable"`
+	// From the metadata file of a directory
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Entries of the trash, listed with include-trashed
+	Deleted     bool      `json:"deleted,omitempty"`
+	DeletedDate string    `json:"deletedDate,omitempty"`
+	TrashId     string    `json:"trashId,omitempty"`
+	Children    []element `json:"children"`
+}
+
+// Element describing a directory entry, whose URI is under the given one.
+// Creation dates and the titles of directories, which take lookups, are
+// only given when asked for.
+func newElement(kind string, dirUri string, p string, d os.FileInfo, fields listingFields) (e element) {
+	e = element{
+		Type:         kind,
+		Name:         d.Name(),
+		Uri:          dirUri + "/" + d.Name(),
+		ModifiedDate: milliseconds(d.ModTime()),
+		Size:         strconv.FormatInt(d.Size(), 10),
+		Writable:     "true", // TODO
+	}
+	if fields.has("creationDate") {
+		e.CreationDate = milliseconds(creationTime(*&p, *&d))
+	}
+	if d.IsDir() && (fields.has("title") || fields.has("description")) {
+		e.Title, e.Description = directoryMetadata(*&p)
+	}
+	return
 }
 
-func listDir(path string, recursive bool, filter []string, returnType string) (list []element, err error) {
+func listDir(ctx context.Context, path string, recursive bool, filter []string, returnType string, fields listingFields) (list []element, err error) {
 	returnAll := returnType == "all" || returnType == ""
 	returnFiles := returnType == "files" || returnAll
 	returnDirs := returnType == "directories" || returnAll
-	currentDir, err := ioutil.ReadDir(*&path)
+	currentDir, err := fsys.readDir(*&path)
+	if len(currentDir) > 0 {
+		list = make([]element, 0, len(*&currentDir))
+	}
+	dirUri := filepath.ToSlash(filepath.Clean(drivePrefix + projectsDir + "/" + path))
 	for _, d := range currentDir {
+		err = ioPause(*&ctx)
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(d.Name(), hiddenPrefix) {
+			continue
+		}
 		if d.IsDir() && returnDirs {
-			var e element
-			modTime := strconv.FormatInt(d.ModTime().UnixNano(), 10)
-			modTime = modTime[:len(*&modTime)-6]
-			uri := drivePrefix + projectsDir + "/" + path + "/" + d.Name()
-			uri = filepath.Clean(*&uri)
-			uri = filepath.ToSlash(*&uri)
-			e.Type = "directory"
-			e.Name = d.Name()
-			e.Uri = uri
-			e.CreationDate = modTime // TODO
-			e.ModifiedDate = modTime
-			e.Size = strconv.FormatInt(d.Size(), 10)
-			e.Writable = "true" // TODO
-			if recursive {
-				e.Children, err = listDir(*&uri, *&recursive, *&filter, *&returnType)
-				if err != nil {
-					return
-				}
-			} else {
-				e.Children = nil
-			}
-			list = append(*&list, *&e)
+			list = append(*&list, newElement("directory", *&dirUri, path+"/"+d.Name(), *&d, *&fields))
 		} else if !d.IsDir() && returnFiles {
 			ext := filepath.Ext(d.Name())
 			if ext != "" {
 				ext = ext[1:]
 			}
 			if cap(*&filter) == 1 || sliceContains(*&filter, *&ext) {
-				var e element
-				modTime := strconv.FormatInt(d.ModTime().UnixNano(), 10)
-				modTime = modTime[:len(*&modTime)-6]
-				uri := drivePrefix + projectsDir + "/" + path + "/" + d.Name()
-				uri = filepath.Clean(*&uri)
-				uri = filepath.ToSlash(*&uri)
-				e.Type = "file"
-				e.Name = d.Name()
-				e.Uri = uri
-				e.CreationDate = modTime // TODO
-				e.ModifiedDate = modTime
-				e.Size = strconv.FormatInt(d.Size(), 10)
-				e.Writable = "true" // TODO
-				e.Children = nil
-				list = append(*&list, *&e)
+				list = append(*&list, newElement("file", *&dirUri, path+"/"+d.Name(), *&d, *&fields))
+			}
+		}
+	}
+	if len(*&list) == 0 {
+		// Empty directories are listed as null
+		list = nil
+	}
+	if recursive && fields.has("children") && err == nil {
+		// Subdirectories are listed in parallel
+		err = forEachParallel(len(*&list), func(i int) (err error) {
+			if list[i].Type == "directory" {
+				list[i].Children, err = listDir(*&ctx, path+"/"+list[i].Name, *&recursive, *&filter, *&returnType, *&fields)
 			}
+			return
+		})
+	}
+	return
+}
+
+//// Static files
+
+// File system of the static file server, which neither lists nor serves
+// internal files.
+type visibleFiles struct {
+	http.FileSystem
+}
+
+type visibleFile struct {
+	http.File
+}
+
+func (v visibleFiles) Open(name string) (http.File, error) {
+	if isHiddenPath(*&name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := v.FileSystem.Open(*&name)
+	if err != nil {
+		return nil, err
+	}
+	return visibleFile{f}, nil
+}
+
+func (f visibleFile) Readdir(count int) (list []os.FileInfo, err error) {
+	entries, err := f.File.Readdir(*&count)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), hiddenPrefix) {
+			list = append(*&list, *&e)
+		}
+	}
+	return
+}
+
+// File system of the static file server over the storage backend, so that
+// it serves what the file APIs see.
+type storageFiles struct{}
+
+type storageFile struct {
+	io.ReadSeeker
+	closer  io.Closer
+	name    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (storageFiles) Open(name string) (http.File, error) {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		p = "."
+	}
+	info, err := fsys.stat(*&p)
+	if err != nil {
+		return nil, err
+	}
+	f := &storageFile{name: p, info: info}
+	if info.IsDir() {
+		f.ReadSeeker = bytes.NewReader(nil)
+		return f, nil
+	}
+	r, err := fsys.open(*&p)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		f.ReadSeeker, f.closer = rs, r
+		return f, nil
+	}
+	// Backends which cannot seek are read at once, for range requests
+	defer r.Close()
+	content, err := ioutil.ReadAll(*&r)
+	if err != nil {
+		return nil, err
+	}
+	f.ReadSeeker = bytes.NewReader(*&content)
+	return f, nil
+}
+
+func (f *storageFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+func (f *storageFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *storageFile) Readdir(count int) (list []os.FileInfo, err error) {
+	if !f.info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	if !f.listed {
+		f.entries, err = fsys.readDir(f.name)
+		if err != nil {
+			return nil, err
 		}
+		f.listed = true
+	}
+	if count <= 0 {
+		list, f.entries = f.entries, nil
+		return
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
 	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	list, f.entries = f.entries[:count], f.entries[count:]
 	return
 }
 
@@ -282,21 +832,59 @@ func listDir(path string, recursive bool, filter []string, returnType string) (l
 //// File APIs
 
 func fileHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Cache-Control", "no-cache")
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, sourceURI, overwrite-destination, check-existence-only, recursive, return-type, operation, delete-source, file-filters, if-modified-since, get-file-info")
-	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, DELETE, PUT")
-	w.Header().Add("Access-Control-Allow-Origin", "*/*")
-	w.Header().Add("Access-Control-Max-Age", "86400")
-	p := filepath.Clean(r.URL.Path[filePathLen:])
-	p = filepath.ToSlash(*&p)
-	p = strings.TrimLeft(*&p, driveName+"/"+projectsDir+"/")
-	if filepath.IsAbs(*&p) {
+	writeCORSHeaders(w)
+	if isHiddenPath(r.URL.Path) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, ok := handlerPath(r.URL.Path[filePathLen:])
+	if !ok {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	if projectLocked(*&p) {
+		writeProjectLocked(w, *&r, *&p)
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" && r.Header.Get("sourceURI") != "" {
+		if p, ok = portablePath(w, *&r, filePath, *&p); !ok {
+			return
+		}
+		if refuseLongPath(w, *&r, *&p) {
+			return
+		}
+		if conflict, found := caseConflict(*&p, r.Header.Get("sourceURI")); found {
+			writeCaseConflict(w, *&r, *&conflict)
+			return
+		}
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" {
+		if refusal := refuseUpload(*&p, r.Header.Get("Content-Type"), nil); refusal != nil {
+			writeUploadRefusal(w, *&refusal)
+			return
+		}
+	}
+
 	switch r.Method {
 	case "POST":
+		if r.Header.Get("reserve") == "true" {
+			// Claim a name with an empty file until the first real save
+			err := writeFile(*&p, nil, false)
+			if err == os.ErrExist {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			recordCreation(*&p)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
 		// Create a new file
 		content, err := ioutil.ReadAll(*&r.Body)
 		if err != nil {
@@ -304,16 +892,34 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		if refusal := refuseUpload(*&p, r.Header.Get("Content-Type"), *&content); refusal != nil {
+			writeUploadRefusal(w, *&refusal)
+			return
+		}
+		content, err = importContent(r, *&p, *&content)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		err = writeFile(*&p, *&content, false)
 		if err == os.ErrExist {
 			log.Println(*&err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		} else if isDiskFull(*&err) {
+			log.Println(*&err)
+			free, _ := freeSpace(*&p)
+			writeInsufficientStorage(w, *&r, int64(len(*&content)), *&free)
+			return
 		} else if err != nil {
 			log.Println(*&err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		recordCreation(*&p)
+		if verifyWritesFlag {
+			w.Header().Set("revision", contentRevision(*&content))
+		}
 		w.WriteHeader(http.StatusCreated)
 		return
 	case "PUT":
@@ -326,29 +932,66 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if refusal := refuseUpload(*&p, r.Header.Get("Content-Type"), *&content); refusal != nil {
+				writeUploadRefusal(w, *&refusal)
+				return
+			}
+			content, err = importContent(r, *&p, *&content)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			err = writeFile(*&p, *&content, true)
-			if err == os.ErrNotExist {
+			if os.IsNotExist(*&err) {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusNotFound)
 				return
+			} else if isDiskFull(*&err) {
+				log.Println(*&err)
+				free, _ := freeSpace(*&p)
+				writeInsufficientStorage(w, *&r, int64(len(*&content)), *&free)
+				return
 			} else if err != nil {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			autosaveTouch(*&p)
+			if verifyWritesFlag {
+				w.Header().Set("revision", contentRevision(*&content))
+			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		} else {
-			// Copy, Move of an existing file 
-			if r.Header.Get("overwrite-destination") != "true" {
+			// Copy, Move of an existing file
+			source, ok = uriToPath(*&source)
+			if !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.Header.Get("validate-only") == "true" {
+				operation := "copy"
+				if r.Header.Get("delete-source") == "true" {
+					operation = "move"
+				}
+				replacing := r.Header.Get("overwrite-destination") == "true"
+				writeJSON(w, http.StatusOK, preflight(r.Context(), requestUser(*&r), *&operation, *&source, *&p, *&replacing))
+				return
+			}
+			moving := r.Header.Get("delete-source") == "true"
+			if !moving && caseOnlyCopy(*&source, *&p) {
+				writeCaseConflict(w, *&r, *&source)
+				return
+			}
+			if r.Header.Get("overwrite-destination") != "true" && !(moving && caseOnlyRename(*&source, *&p)) {
 				if exist(*&p) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
 			}
-			if r.Header.Get("delete-source") == "true" {
+			if moving {
 				err := moveFile(*&source, *&p)
-				if err == os.ErrNotExist {
+				if os.IsNotExist(*&err) {
 					log.Println(*&err)
 					w.WriteHeader(http.StatusNotFound)
 					return
@@ -357,9 +1000,10 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				moveMetadata(*&source, *&p)
 			} else {
-				err := copyFile(*&source, *&p)
-				if err == os.ErrNotExist {
+				err := copyFile(r.Context(), *&source, *&p)
+				if os.IsNotExist(*&err) {
 					log.Println(*&err)
 					w.WriteHeader(http.StatusNotFound)
 					return
@@ -368,6 +1012,8 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				copyMetadata(*&source, *&p)
+				recordCreation(*&p)
 			}
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -378,8 +1024,18 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if r.Header.Get("trash") == "true" {
+			id, err := moveToTrash(*&p)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"trashId": *&id})
+			return
+		}
 		err := removeFile(*&p)
-		if err == os.ErrNotExist {
+		if os.IsNotExist(*&err) {
 			log.Println(*&err)
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -388,6 +1044,7 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		forgetMetadata(*&p)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	case "GET":
@@ -411,22 +1068,16 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		} else if getInfo != "" && getInfo != "false" {
-			infos, err := properties(*&p)
+			info, err := fileInfo(*&p)
 			if err != nil {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			modDate := strconv.FormatInt(infos.ModTime().UnixNano(), 10)
-			modDate = modDate[:len(*&modDate)-6]
-			size := strconv.FormatInt(infos.Size(), 10)
-			fileInfo := map[string]string{
-				"creationDate": modDate, // TODO
-				"modifiedDate": modDate,
-				"size":         size,
-				"readOnly":     "false", // TODO
-			}
-			j, err := json.MarshalIndent(*&fileInfo, "", "	")
+			dates := requestDateFormat(*&r)
+			info["creationDate"] = dates.format(info["creationDate"])
+			info["modifiedDate"] = dates.format(info["modifiedDate"])
+			j, err := json.MarshalIndent(*&info, "", "	")
 			if err != nil {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -434,6 +1085,13 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			w.Write(j)
 			return
+		} else if hasExcerpt(*&r) {
+			// The first or last bytes or lines only
+			serveExcerpt(w, r, *&p)
+			return
+		} else if r.URL.Query().Get("preview") == "true" {
+			servePreview(w, r, *&p)
+			return
 		} else {
 			ext := filepath.Ext(*&p)
 			switch ext {
@@ -444,35 +1102,84 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 			case ".json":
 				w.Header().Set("Content-Type", "application/json")
 			}
+			if info, err := properties(*&p); err == nil && info.Size() > streamThreshold {
+				err = serveLargeFile(w, r, *&p, *&info)
+				if err != nil {
+					log.Println(*&err)
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				return
+			}
 			file, err := readFile(*&p)
 			if err != nil {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("revision", contentRevision(*&file))
 			w.WriteHeader(http.StatusOK)
 			w.Write(*&file)
 			return
 		}
-	}
+	case "PATCH":
+		// Apply a diff to an existing file
+		if !exist(*&p) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		patch, err := ioutil.ReadAll(*&r.Body)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		revision, err := patchFile(*&p, r.Header.Get("Content-Type"), r.Header.Get("base-revision"), *&patch)
+		if err == errPatchConflict {
+			w.Header().Set("revision", *&revision)
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err == errPatchFormat {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		autosaveTouch(*&p)
+		w.Header().Set("revision", *&revision)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 }
 
 //// Directory APIs
 
 func dirHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Cache-Control", "no-cache")
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, sourceURI, overwrite-destination, check-existence-only, recursive, return-type, operation, delete-source, file-filters, if-modified-since, get-file-info")
-	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, DELETE, PUT")
-	w.Header().Add("Access-Control-Allow-Origin", "*/*")
-	w.Header().Add("Access-Control-Max-Age", "86400")
-	p := filepath.Clean(r.URL.Path[dirPathLen:])
-	p = filepath.ToSlash(*&p)
-	p = strings.TrimLeft(*&p, driveName+"/"+projectsDir+"/")
-	if filepath.IsAbs(*&p) {
+	writeCORSHeaders(w)
+	if isHiddenPath(r.URL.Path) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, ok := handlerPath(r.URL.Path[dirPathLen:])
+	if !ok {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	if r.Method == "POST" || r.Method == "PUT" && r.Header.Get("sourceURI") != "" {
+		if p, ok = portablePath(w, *&r, dirPath, *&p); !ok {
+			return
+		}
+		if refuseLongPath(w, *&r, *&p) {
+			return
+		}
+		if conflict, found := caseConflict(*&p, r.Header.Get("sourceURI")); found {
+			writeCaseConflict(w, *&r, *&conflict)
+			return
+		}
+	}
+
 	switch r.Method {
 	case "POST":
 		// Create a new directory
@@ -482,6 +1189,7 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		recordCreation(*&p)
 		w.WriteHeader(http.StatusCreated)
 		return
 	case "DELETE":
@@ -490,17 +1198,20 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		err := removeDir(*&p)
-		if err == os.ErrNotExist {
-			log.Println(*&err)
-			w.WriteHeader(http.StatusNotFound)
-			return
-		} else if err != nil {
-			log.Println(*&err)
-			w.WriteHeader(http.StatusInternalServerError)
+		snapshotBefore("delete")
+		if r.Header.Get("trash") == "true" {
+			id, err := moveToTrash(*&p)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"trashId": *&id})
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		// Large trees are deleted by a job
+		j, err := deleteTree(*&r, *&p, func() { forgetMetadata(*&p) })
+		writeDeleteOutcome(w, r, *&j, *&err)
 		return
 	case "GET":
 		// List the contents of an existing directory
@@ -532,6 +1243,37 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 			if returnType == "" {
 				returnType = "all"
 			}
+			// Pages listing a directory show every field
+			fields, ok := parseListingFields(r.Header.Get("fields"))
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if wantsHTML(*&r) {
+				fields = nil
+			}
+			if since := r.Header.Get("changes-since"); since != "" {
+				// Only what changed since a cursor of the change journal
+				cursor, err := strconv.ParseInt(*&since, 10, 64)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if !exist(*&p) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				listing, ok := listChanges(*&p, *&cursor, *&recursive, *&filter, *&returnType)
+				for i := range listing.Changes {
+					requestDateFormat(*&r).element(&listing.Changes[i].element)
+				}
+				if !ok {
+					// Too old, the client has to list everything again
+					writeJSON(w, http.StatusGone, *&listing)
+					return
+				}
+				writeJSON(w, http.StatusOK, *&listing)
+				return
+			}
 			var e element
 			if p == "." {
 				var c []element
@@ -546,8 +1288,8 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 				if p == "" {
 					p = "."
 				}
-				fileInfo, err := listDir(*&p, *&recursive, *&filter, *&returnType)
-				if err == os.ErrNotExist {
+				fileInfo, err := listDir(r.Context(), *&p, *&recursive, *&filter, *&returnType, *&fields)
+				if os.IsNotExist(*&err) {
 					log.Println(*&err)
 					w.WriteHeader(http.StatusNotFound)
 					return
@@ -567,34 +1309,102 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 				e.Type = "directory"
 				e.Name = rootDir.Name()
 				e.Uri = drivePrefix + p
-				e.CreationDate = modTime // TODO
+				e.CreationDate = milliseconds(creationTime(*&p, *&rootDir))
 				e.ModifiedDate = modTime
 				e.Size = strconv.FormatInt(rootDir.Size(), 10)
 				e.Writable = "true" // TODO
+				if fields.has("title") || fields.has("description") {
+					e.Title, e.Description = directoryMetadata(*&p)
+				}
 				e.Children = fileInfo
+				if r.Header.Get("include-trashed") == "true" {
+					// Entries come from anywhere, so only the owner sees them
+					if authEnabled() && requestUser(*&r) != ownerUser {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					listTrashed(&e, *&p, *&recursive, *&filter, *&returnType)
+				}
 			}
 
-			j, err := json.MarshalIndent(*&e, "", "	")
+			if wantsHTML(*&r) {
+				renderListing(w, *&r, *&p, *&e)
+				return
+			}
+			err := writeListing(w, &e, *&fields, apiVersion(*&r), requestDateFormat(*&r))
 			if err != nil {
+				logDebug("listing", *&err)
+			}
+			return
+		}
+	case "PUT":
+		// Copy, Move of an existing directory
+		source, ok := uriToPath(r.Header.Get("sourceURI"))
+		if !ok || source == "." {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		operation := r.Header.Get("operation")
+		if r.Header.Get("validate-only") == "true" {
+			if !sliceContains([]string{"move", "copy", "merge", "duplicate"}, *&operation) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, preflight(r.Context(), requestUser(*&r), *&operation, *&source, *&p, operation == "merge"))
+			return
+		}
+		if operation == "merge" {
+			// Merge into a directory, existing or not
+			policy := r.Header.Get("conflict-policy")
+			if policy == "" {
+				policy = mergeSkip
+			}
+			if !validMergePolicy(*&policy) || isUnderPrefix(filepath.ToSlash(*&p), filepath.ToSlash(*&source)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if policy == mergeOverwrite {
+				snapshotBefore("merge")
+			}
+			report, err := mergeDir(r.Context(), *&source, *&p, *&policy)
+			if os.IsNotExist(*&err) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err == os.ErrInvalid {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if err != nil {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			w.Write(j)
+			writeJSON(w, http.StatusOK, *&report)
 			return
 		}
-	case "PUT":
-		// Copy, Move of an existing directory
-		source := r.Header.Get("sourceURI")
-		if exist(p) {
+		if exist(p) && !(operation == "move" && caseOnlyRename(*&source, *&p)) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		operation := r.Header.Get("operation")
 		if operation == "move" {
 			err := moveDir(*&source, *&p)
-			if err == os.ErrNotExist {
+			if os.IsNotExist(*&err) {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
 				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			moveMetadata(*&source, *&p)
+		} else if operation == "duplicate" {
+			// Duplicate a whole project under another name
+			if strings.ContainsRune(*&source, filepath.Separator) || strings.ContainsRune(*&p, filepath.Separator) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			d, err := duplicateProject(r.Context(), *&source, *&p)
+			if os.IsNotExist(*&err) {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			} else if err != nil {
@@ -602,17 +1412,32 @@ func dirHandler(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			writeJSON(w, http.StatusCreated, *&d)
+			return
 		} else if operation == "copy" {
-			err := copyDir(*&source, *&p)
-			if err == os.ErrNotExist {
+			report := newCopyReport()
+			err := copyDirReporting(r.Context(), *&source, *&p, *&report)
+			if os.IsNotExist(*&err) {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusNotFound)
 				return
-			} else if err != nil {
+			} else if err != nil && len(report.Copied) == 0 {
 				log.Println(*&err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
+			} else if err != nil {
+				// Interrupted halfway
+				report.failed(*&source, *&err)
+			}
+			if len(report.Failed) > 0 {
+				for _, f := range report.Failed {
+					log.Println("Could not copy", f.Uri+":", f.Error)
+				}
+				writeCopyReport(w, *&r, *&report, *&p)
+				return
 			}
+			copyMetadata(*&source, *&p)
+			recordCreation(*&p)
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -632,16 +1457,39 @@ func getDataHandler(w http.ResponseWriter, r *http.Request) {
 
 // Get the cloud status JSON
 func getStatusHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Cache-Control", "no-cache")
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, sourceURI, overwrite-destination, check-existence-only, recursive, return-type, operation, delete-source, file-filters, if-modified-since, get-file-info")
-	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, DELETE, PUT")
-	w.Header().Add("Access-Control-Allow-Origin", "*/*")
-	w.Header().Add("Access-Control-Max-Age", "86400")
-	cloudStatus := map[string]string{
-		"name":        APP_NAME,
-		"version":     APP_VERSION,
-		"server-root": drivePrefix + projectsDir,
-		"status":      "running",
+	writeCORSHeaders(w)
+	cloudStatus := map[string]interface{}{
+		"name":         APP_NAME,
+		"version":      APP_VERSION,
+		"server-root":  rootUri(*&r),
+		"status":       "running",
+		"alerts":       usageWarnings(*&r),
+		"api-version":  apiVersion(*&r),
+		"api-versions": apiVersions,
+		// For clients computing revisions themselves
+		"revision-hash": revisionHashFlag,
+	}
+	// Refreshed in the background
+	for k, v := range cachedRuntimeStatus() {
+		cloudStatus[k] = v
+	}
+	if warmUpFlag {
+		cloudStatus["warm-up"] = warmUp.report()
+	}
+	if selfTestFlag {
+		cloudStatus["self-test"] = selfTest.report()
+	}
+	if mirrorDir != "" {
+		cloudStatus["mirror"] = mirrorHealth.report()
+	}
+	if fsTimeoutFlag > 0 {
+		cloudStatus["filesystem"] = watchdogReport()
+	}
+	if networkRootFlag {
+		cloudStatus["metadata-cache"] = metadataCacheReport()
+	}
+	if handoff != nil {
+		cloudStatus["restarts"] = handoff.Restarts
 	}
 	j, err := json.MarshalIndent(*&cloudStatus, "", "	")
 	if err != nil {
@@ -656,44 +1504,592 @@ func init() {
 	flag.BoolVar(&versionFlag, "v", false, "Print the version number.")
 	flag.StringVar(&interfaceFlag, "i", "localhost", "Listening interface.")
 	flag.StringVar(&portFlag, "p", "58080", "Listening port.")
+	flag.StringVar(&portConflictFlag, "on-port-conflict", "fail", "When the port is taken: fail, reuse the instance holding it, or take the next free port.")
+	flag.StringVar(&unixSocketFlag, "unix-socket", "", "Unix socket to listen on instead of TCP.")
+	flag.StringVar(&basePathFlag, "base-path", "", "Path prefix all the routes are served under, such as /cloud.")
 	flag.StringVar(&rootFlag, "r", ".", "Root directory.")
+	flag.StringVar(&googleFontsKeyFlag, "google-fonts-key", "", "Google Fonts API key.")
+	flag.StringVar(&chromeFlag, "chrome", "", "Chromium executable used to render previews.")
+	flag.StringVar(&ffmpegFlag, "ffmpeg", "", "ffmpeg executable used to transcode audio and video.")
+	flag.StringVar(&gitFlag, "git", "", "git executable used to import projects from repositories.")
+	flag.StringVar(&configFlag, "config", "", "Configuration file.")
+	flag.StringVar(&profileFlag, "profile", "", "Named profile of the configuration file to run with.")
+	flag.StringVar(&tokenFlag, "token", "", "Access token of the owner, granting every permission.")
+	flag.StringVar(&sessionSecretFlag, "session-secret", "", "Key signing session cookies and URLs, random if empty so that restarts end sessions.")
+	flag.DurationVar(&sessionLifetimeFlag, "session-lifetime", 12*time.Hour, "Time before session cookies expire.")
+	flag.StringVar(&allowIPsFlag, "allow-ips", "", "Comma separated CIDR blocks allowed to connect, everyone if empty.")
+	flag.BoolVar(&insecureFlag, "insecure", false, "Allow listening on non-loopback interfaces without authentication.")
+	flag.BoolVar(&tenantsFlag, "tenants", false, "Give every user but the owner a directory of their own as root.")
+	flag.StringVar(&tenantQuotaFlag, "tenant-quota", "", "Space each tenant may use unless configured otherwise, such as 1G.")
+	flag.Float64Var(&quotaWarningFlag, "quota-warning", 0.9, "Share of their quota past which the writes of tenants carry a warning.")
+	flag.StringVar(&diskWarningFlag, "disk-warning", "", "Free disk space under which writes carry a warning, such as 1G.")
+	flag.StringVar(&diskReserveFlag, "disk-reserve", "", "Free disk space large uploads must leave, such as 1G, or they are refused.")
+	flag.BoolVar(&preallocateFlag, "preallocate", false, "Reserve the space of large files before writing them, where the filesystem allows it.")
+	flag.BoolVar(&inboxFlag, "inbox", false, "Let anyone send files, kept in quarantine until moderated.")
+	flag.StringVar(&inboxMaxSizeFlag, "inbox-max-size", "20M", "Largest file the inbox accepts.")
+	flag.StringVar(&inboxCapacityFlag, "inbox-capacity", "1G", "Space files waiting in the inbox may take.")
+	flag.StringVar(&inboxTypesFlag, "inbox-types", ".png,.jpg,.jpeg,.gif,.webp,.svg,.pdf,.psd,.sketch,.ase,.ttf,.otf,.woff,.woff2,.mp4,.webm,.mp3,.zip", "Comma separated extensions of the files the inbox accepts.")
+	flag.DurationVar(&headerTimeoutFlag, "header-timeout", 10*time.Second, "Maximum duration for reading request headers.")
+	flag.DurationVar(&readTimeoutFlag, "read-timeout", 10*time.Minute, "Maximum duration for reading a whole request, 0 for none.")
+	flag.DurationVar(&writeTimeoutFlag, "write-timeout", 10*time.Minute, "Maximum duration for writing a response, 0 for none.")
+	flag.DurationVar(&opTimeoutFlag, "op-timeout", 5*time.Minute, "Deadline of each operation, 0 for none.")
+	flag.BoolVar(&checkUpdateFlag, "check-update", false, "Check for a newer release and exit.")
+	flag.BoolVar(&diagnoseFlag, "diagnose", false, "Check the configuration and environment, print a report and exit.")
+	flag.StringVar(&updateUrlFlag, "update-url", "", "URL of the release manifest used for updates.")
+	flag.StringVar(&updateKeyFlag, "update-key", "", "Base64 Ed25519 public key release binaries are signed with.")
+	flag.StringVar(&assetsDirFlag, "assets", "", "Directory overriding the embedded templates, UI and MIME types.")
+	flag.StringVar(&extractAssetsFlag, "extract-assets", "", "Write the embedded assets into a directory and exit.")
+	flag.BoolVar(&licenseFlag, "license", false, "Print the license and exit.")
+	flag.DurationVar(&autosaveFlag, "autosave", 2*time.Minute, "Interval between autosave shadow copies, 0 to disable.")
+	flag.DurationVar(&watchIntervalFlag, "watch-interval", 2*time.Second, "Interval between scans for changes, 0 to disable.")
+	flag.StringVar(&maxBandwidthFlag, "max-bandwidth", "", "Bytes per second allowed to copies, publishing and other bulk transfers, such as 10M.")
+	flag.StringVar(&backgroundPriorityFlag, "background-priority", "normal", "IO priority of the watcher and autosave: high, normal or low.")
+	flag.IntVar(&ioParallelismFlag, "io-parallelism", runtime.NumCPU(), "Goroutines used by recursive listings and scans.")
+	flag.DurationVar(&debounceFlag, "debounce", 500*time.Millisecond, "Quiet period a path needs before its changes are notified, 0 to disable.")
+	flag.StringVar(&backendFlag, "backend", "disk", "Storage backend of the projects: disk or memory.")
+	flag.StringVar(&overlayFlag, "overlay", "", "Read-only base directory, ZIP archive, or embedded: directory of assets such as embedded:templates, layered under the projects directory.")
+	flag.StringVar(&libraryFlag, "library", "", "Comma separated read-only asset library directories.")
+	flag.StringVar(&seedFlag, "seed", "", "ZIP archive extracted into the projects directory at startup.")
+	flag.StringVar(&logFormatFlag, "log-format", "text", "Format of the log: text on the standard error, or json on the standard output.")
+	flag.StringVar(&logLevelFlag, "log-level", "info", "Level of detail of the logs: error, warn, info, debug or trace.")
+	flag.StringVar(&logModulesFlag, "log-modules", "", "Comma separated modules whose details are logged, among fs, http, proxy and watch, all if empty.")
+	flag.StringVar(&captureDirFlag, "capture-dir", "", "Directory where to record requests and responses, for debugging.")
+	flag.IntVar(&captureBodyLimitFlag, "capture-body-limit", 64*1024, "Bytes of each body kept by the capture.")
+	flag.StringVar(&replayFlag, "replay", "", "Capture file whose responses to serve instead of the cloud, for testing editors.")
+	flag.IntVar(&compatFlag, "compat", 1, "Editor quirks to smooth over: 0 for none, 1 for value formats, 2 for legacy headers too.")
+	flag.DurationVar(&chaosLatencyFlag, "chaos-latency", 0, "Random delay up to which requests are held, for testing editors.")
+	flag.Float64Var(&chaosErrorRateFlag, "chaos-error-rate", 0, "Share of requests failing with a server error, for testing editors.")
+	flag.Float64Var(&chaosPartialRateFlag, "chaos-partial-rate", 0, "Share of responses cut off by dropping the connection, for testing editors.")
+	flag.StringVar(&snapshotsFlag, "snapshots", "", "Filesystem taking snapshots of the projects before risky operations: auto, btrfs, zfs or apfs, none if empty.")
+	flag.IntVar(&snapshotsKeepFlag, "snapshots-keep", 10, "Automatic snapshots kept, the oldest being deleted first.")
+	flag.BoolVar(&clipboardFlag, "clipboard", false, "Let users with full rights read and write the clipboard of the host.")
+	flag.DurationVar(&notifyFlag, "notify", 0, "Notify the desktop of jobs and publications lasting at least this long, 0 to disable.")
+	flag.BoolVar(&profilingFlag, "profiling", false, "Serve the pprof profiles and expvar variables under /debug/ to the owner.")
+	flag.StringVar(&maxMemoryFlag, "max-memory", "", "Memory to stay under by collecting harder and dropping caches, such as 512M.")
+	flag.BoolVar(&warmUpFlag, "warm-up", false, "Walk the projects in the background at startup, so that the first listings are fast.")
+	flag.BoolVar(&selfTestFlag, "self-test", false, "Create, list, read, move and delete files through the API once listening, reporting problems in the log and status.")
+	flag.StringVar(&mirrorFlag, "mirror", "", "Directory to keep a copy of the projects in, such as on an external drive.")
+	flag.DurationVar(&idleTimeoutFlag, "idle-timeout", 0, "Exit after this long without requests, 0 to never.")
+	flag.StringVar(&fileModeFlag, "file-mode", "0644", "Permissions given to files when repairing them.")
+	flag.StringVar(&dirModeFlag, "dir-mode", "0755", "Permissions given to directories when repairing them.")
+	flag.StringVar(&portableNamesFlag, "portable-names", portableOff, "Names Windows does not accept, when creating files and directories: off, reject or sanitize.")
+	flag.BoolVar(&browseZipsFlag, "browse-zips", false, "List the ZIP archives of the projects as read-only directories.")
+	flag.BoolVar(&longPathsFlag, "long-paths", false, `Use \\?\ prefixed paths on Windows, allowing paths past MAX_PATH when long paths are not enabled system-wide.`)
+	flag.BoolVar(&verifyWritesFlag, "verify-writes", false, "Read every file written back, failing writes which did not store what they should have.")
+	flag.StringVar(&revisionHashFlag, "revision-hash", "sha256", "Hash of the revisions telling whether files changed: sha256, blake3 or the faster non-cryptographic xxhash.")
+	flag.StringVar(&verifyHashFlag, "verify-hash", "sha256", "Cryptographic hash checking copies with -verify-writes: sha256 or blake3.")
+	flag.BoolVar(&requireSigningFlag, "require-signing", false, "Refuse tokens and passwords sent in cleartext from other machines, which then have to sign their requests.")
+	flag.BoolVar(&networkRootFlag, "network-root", false, "Cache file details and retry failed calls, for roots on network shares.")
+	flag.DurationVar(&metadataTTLFlag, "metadata-ttl", 30*time.Second, "Time file details are cached for with -network-root.")
+	flag.DurationVar(&fsTimeoutFlag, "fs-timeout", 0, "Deadline of filesystem calls, such as 30s for roots on network shares, 0 for none.")
+	flag.BoolVar(&openFlag, "open", false, "Open the default browser once listening, signed in as the owner.")
+	flag.StringVar(&openRouteFlag, "open-route", uiPath, "Route -open browses, such as / for the preview of the projects.")
 }
 
 func main() {
-	flag.Parse()
+	err := applyEnvironment()
+	if err != nil {
+		log.Println(*&err)
+		os.Exit(1)
+	}
+	runCommand(os.Args[1:])
+}
+
+// Starts the cloud.
+func serveCommand(args []string) error {
+	err := flag.CommandLine.Parse(*&args)
+	if err != nil {
+		return err
+	}
+
+	err = applyProfile()
+	if err != nil {
+		return err
+	}
+
+	switch logFormatFlag {
+	case "text":
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return errors.New("unknown log format: " + logFormatFlag)
+	}
+	log.SetOutput(redactingWriter{log.Writer()})
+
+	err = parseLogLevel(*&logLevelFlag, *&logModulesFlag)
+	if err != nil {
+		return err
+	}
 
 	if versionFlag {
 		log.Println("Version:", APP_VERSION)
-		return
+		return nil
+	}
+
+	if licenseFlag {
+		printLicense()
+		return nil
 	}
 
-	root := filepath.Clean((rootFlag + "/" + projectsDir))
+	if extractAssetsFlag != "" {
+		return extractAssets(*&extractAssetsFlag)
+	}
+
+	if checkUpdateFlag {
+		printUpdateCheck()
+		return nil
+	}
+
+	if diagnoseFlag {
+		if !diagnose() {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	applyStagedUpdate()
+
+	if configFlag != "" {
+		err := loadConfig(*&configFlag)
+		if err != nil {
+			return err
+		}
+		if oidcEnabled() {
+			err = checkOIDC()
+			if err != nil {
+				return err
+			}
+		}
+		err = checkAuth()
+		if err != nil {
+			return err
+		}
+		err = checkSchedule()
+		if err != nil {
+			return err
+		}
+		err = checkRetention()
+		if err != nil {
+			return err
+		}
+		err = checkConnectors()
+		if err != nil {
+			return err
+		}
+		err = checkDevices()
+		if err != nil {
+			return err
+		}
+		err = checkUploads()
+		if err != nil {
+			return err
+		}
+		err = checkRedaction()
+		if err != nil {
+			return err
+		}
+		err = checkTextPolicies()
+		if err != nil {
+			return err
+		}
+		err = checkCaching()
+		if err != nil {
+			return err
+		}
+		err = checkHosts()
+		if err != nil {
+			return err
+		}
+	}
 
-	err := createDir(*&root)
+	if assetsDirFlag != "" {
+		abs, err := filepath.Abs(*&assetsDirFlag)
+		if err != nil {
+			return err
+		}
+		assetsDirFlag = abs
+	}
+	registerMimeTypes()
+
+	basePathFlag = normalizeBasePath(*&basePathFlag)
+
+	takeHandoff()
+	initSessions()
+
+	if chaosEnabled() {
+		logWarn("Chaos flags are set, the cloud will be unreliable on purpose")
+	}
+
+	if captureDirFlag != "" {
+		err = openCapture(*&captureDirFlag)
+		if err != nil {
+			return err
+		}
+		logWarn("Capturing the traffic in", captureDirFlag+", bodies included")
+	}
+
+	listener, err := listen()
+	if err == errInstanceRunning {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if replayFlag != "" {
+		return serveReplay(*&listener, *&replayFlag)
+	}
+
+	allowedNets, err = parseAllowedIPs(*&allowIPsFlag)
 	if err != nil {
-		log.Println(*&err)
-		return
+		return err
 	}
 
-	err = os.Chdir(*&root)
-	currentDir, err := os.Getwd()
+	libraries, err = parseLibraries(*&libraryFlag)
 	if err != nil {
-		log.Println(*&err)
-		return
+		return err
 	}
 
-	log.Println("Starting " + APP_NAME + " " + APP_VERSION + " on " + interfaceFlag + ":" + portFlag + " in " + currentDir)
-	log.Println("pacien.net/projects/ninja-go-local-cloud")
+	if ioParallelismFlag < 1 {
+		ioParallelismFlag = 1
+	}
+	// The calling goroutine always takes part
+	ioSlots = make(chan struct{}, ioParallelismFlag-1)
 
-	http.HandleFunc(filePath, fileHandler)
-	http.HandleFunc(dirPath, dirHandler)
-	http.HandleFunc(webPath, getDataHandler)
-	http.HandleFunc(statusPath, getStatusHandler)
-	http.Handle("/", http.FileServer(http.Dir(".")))
+	backgroundContext, err = withPriority(backgroundContext, *&backgroundPriorityFlag)
+	if err != nil {
+		return err
+	}
+
+	if tenantsFlag {
+		err = checkTenants()
+		if err != nil {
+			return err
+		}
+	}
+
+	if diskWarningFlag != "" {
+		diskWarning, err = parseByteSize(*&diskWarningFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	if diskReserveFlag != "" {
+		diskReserve, err = parseByteSize(*&diskReserveFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	if inboxFlag {
+		err = checkInbox()
+		if err != nil {
+			return err
+		}
+	}
+
+	if maxMemoryFlag != "" {
+		limit, err := parseByteSize(*&maxMemoryFlag)
+		if err != nil {
+			return err
+		}
+		startMemoryLimit(*&limit)
+	}
 
-	err = http.ListenAndServe(interfaceFlag+":"+portFlag, nil)
+	_, _, err = permissionModes()
+	if err != nil {
+		return err
+	}
+	err = checkPortableNames()
+	if err != nil {
+		return err
+	}
+	err = checkHashes()
+	if err != nil {
+		return err
+	}
+
+	if maxBandwidthFlag != "" {
+		rate, err := parseByteSize(*&maxBandwidthFlag)
+		if err != nil {
+			return err
+		}
+		bandwidthLimiter = newRateLimiter(*&rate)
+	}
+
+	if mirrorFlag != "" {
+		err = checkMirror()
+		if err != nil {
+			return err
+		}
+	}
+
+	currentDir, err := openProjects()
+	if err != nil {
+		return err
+	}
+
+	if backendFlag == "disk" {
+		release, err := acquireLock(listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if seedFlag != "" {
+		err = seedFromZip(*&seedFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	logInfo("Starting " + APP_NAME + " " + APP_VERSION + " on " + listener.Addr().String() + " in " + currentDir)
+	logInfo("pacien.net/projects/ninja-go-local-cloud")
+
+	metadata, err = openStore(metadataFile)
+	if err != nil {
+		return err
+	}
+	startAccessStats()
+
+	recoverIntents()
+	pruneExports()
+
+	if snapshotsFlag != "" {
+		err = initSnapshots(*&currentDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if autosaveFlag > 0 {
+		startAutosave(*&autosaveFlag)
+	}
+
+	err = loadJournal()
+	if err != nil {
+		return err
+	}
+
+	if debounceFlag > 0 {
+		startDebouncer(*&debounceFlag)
+	}
+
+	if networkRootFlag && watchIntervalFlag > 0 && watchIntervalFlag < networkWatchInterval && !flagSet("watch-interval") {
+		watchIntervalFlag = networkWatchInterval
+	}
+
+	if watchIntervalFlag > 0 {
+		startWatcher(*&watchIntervalFlag)
+		startUsageTracking()
+	}
+
+	if mirrorDir != "" {
+		if watchIntervalFlag <= 0 {
+			logWarn("The mirror is only updated hourly without the watcher, which is disabled")
+		}
+		startMirror()
+	}
+
+	if warmUpFlag {
+		startWarmUp()
+	}
+
+	if len(cloudConfig.Webhooks) > 0 || len(cloudConfig.Bridges) > 0 {
+		if watchIntervalFlag <= 0 {
+			logWarn("Webhooks and event bridges need the watcher, which is disabled")
+		}
+	}
+
+	if len(cloudConfig.Webhooks) > 0 {
+		startWebhooks(cloudConfig.Webhooks)
+	}
+
+	if len(cloudConfig.Bridges) > 0 {
+		err = startBridges(cloudConfig.Bridges)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cloudConfig.Schedule) > 0 {
+		startScheduler()
+	}
+
+	if len(cloudConfig.Retention) > 0 {
+		startRetention()
+	}
+
+	startStatusRefresh()
+
+	if idleTimeoutFlag > 0 {
+		startIdleShutdown(*&idleTimeoutFlag)
+	}
+
+	if base, ok := localBaseUrl(*&listener); ok {
+		announceUrls(*&base)
+		if selfTestFlag {
+			startSelfTest(*&base)
+		}
+	} else {
+		if openFlag {
+			logWarn("Not opening a browser, the cloud does not listen on TCP")
+		}
+		if selfTestFlag {
+			logWarn("Not running the self-test, the cloud does not listen on TCP")
+		}
+	}
+
+	cloudListener = listener
+	watchRestartSignals()
+	err = serve(*&listener, cloudHandler())
+	if err != nil {
+		return err
+	}
+	if restartRequested() {
+		return restartInPlace()
+	}
+	flushState()
+	return nil
+}
+
+// Sets up the storage backend, and for the disk one moves into the projects
+// directory, returning where the projects are.
+func openProjects() (currentDir string, err error) {
+	newBackend, ok := backends[backendFlag]
+	if !ok {
+		return "", errors.New("unknown storage backend: " + backendFlag)
+	}
+	fsys = newBackend()
+	if logging(levelTrace, "fs") {
+		fsys = tracedStorage{fsys}
+	}
+	if fsTimeoutFlag > 0 {
+		fsys = watchedStorage{fsys}
+	}
+	if networkRootFlag {
+		fsys = networkStorage{fsys}
+	}
+	if overlayFlag != "" {
+		base, err := readOnlyBase(*&overlayFlag)
+		if err != nil {
+			return "", err
+		}
+		fsys = &overlayStorage{base, fsys}
+	}
+	if browseZipsFlag {
+		fsys = zipStorage{fsys}
+	}
+	fsys = encryptedStorage{fsys}
+
+	currentDir = backendFlag
+	if backendFlag == "disk" {
+		root := filepath.Clean((rootFlag + "/" + projectsDir))
+
+		err = createDir(*&root)
+		if err != nil {
+			return
+		}
+
+		var tokens string
+		tokens, err = filepath.Abs(filepath.Join(rootFlag, connectorTokensFile))
+		if err != nil {
+			return
+		}
+		setConnectorTokensPath(*&tokens)
+
+		err = os.Chdir(*&root)
+		if err != nil {
+			return
+		}
+		currentDir, err = os.Getwd()
+	}
+	return
+}
+
+// Sets the handlers to work on a storage given as is, without the layers
+// openProjects adds, such as the memory backend benchmarks and tests run
+// against.
+func useStorage(s storage) (err error) {
+	fsys = s
+	setConnectorTokensPath("")
+	metadata, err = openStore(metadataFile)
 	if err != nil {
-		log.Println(*&err)
 		return
 	}
+	initSessions()
+	if ioParallelismFlag < 1 {
+		ioParallelismFlag = 1
+	}
+	ioSlots = make(chan struct{}, ioParallelismFlag-1)
+	return
+}
+
+// Registers the routes of the cloud on the default mux, once, returning
+// them wrapped into the middlewares. Subsystems have to be set up first.
+func cloudHandler() http.Handler {
+	http.Handle(filePath, accessMiddleware(http.HandlerFunc(fileHandler), fileLocation))
+	http.HandleFunc(dirPath, dirHandler)
+	http.HandleFunc(webPath, getDataHandler)
+	http.HandleFunc(statusPath, getStatusHandler)
+	http.HandleFunc(fontsPath, fontsHandler)
+	http.HandleFunc(optimizePath, optimizeHandler)
+	http.HandleFunc(publishPath, publishHandler)
+	http.HandleFunc(packPath, packHandler)
+	http.HandleFunc(minifyPath, minifyHandler)
+	http.HandleFunc(lintPath, lintHandler)
+	http.HandleFunc(renderPath, renderHandler)
+	http.HandleFunc(settingsPath, settingsHandler)
+	http.HandleFunc(draftsPath, draftsHandler)
+	http.HandleFunc(autosavePath, autosaveHandler)
+	http.HandleFunc(presencePath, presenceHandler)
+	http.HandleFunc(updatePath, updateHandler)
+	http.HandleFunc(cachePath, cacheHandler)
+	http.HandleFunc(watcherPath, watcherHandler)
+	http.HandleFunc(restartPath, restartHandler)
+	http.HandleFunc(syncConflictsPath, syncConflictsHandler)
+	http.HandleFunc(templatesPath, templatesHandler)
+	http.HandleFunc(libraryPath, libraryHandler)
+	http.HandleFunc(checkPath, checkHandler)
+	http.HandleFunc(inspectPath, inspectHandler)
+	http.HandleFunc(palettePath, paletteHandler)
+	http.HandleFunc(transcodePath, transcodeHandler)
+	http.HandleFunc(jobsPath, jobsHandler)
+	http.HandleFunc(authPath, authHandler)
+	http.HandleFunc(sharesPath, sharesHandler)
+	http.Handle(sharedPath, accessMiddleware(cachingMiddleware(deviceMiddleware(http.HandlerFunc(sharedHandler), sharedLocation), sharedLocation), sharedLocation))
+	http.HandleFunc(inboxPath, inboxHandler)
+	http.HandleFunc(signPath, signHandler)
+	http.HandleFunc(searchPath, searchHandler)
+	http.HandleFunc(blocksPath, blocksHandler)
+	http.HandleFunc(snapshotsPath, snapshotsHandler)
+	http.HandleFunc(versionsPath, versionsHandler)
+	http.HandleFunc(schedulePath, scheduleHandler)
+	http.HandleFunc(retentionPath, retentionHandler)
+	http.HandleFunc(archivesPath, archivesHandler)
+	http.HandleFunc(clonePath, cloneHandler)
+	http.HandleFunc(connectorsPath, connectorsHandler)
+	http.HandleFunc(clipboardPath, clipboardHandler)
+	http.HandleFunc(desktopPath, desktopHandler)
+	http.HandleFunc(pairPath, pairHandler)
+	http.HandleFunc(statsPath, statsHandler)
+	http.HandleFunc(statPath, statHandler)
+	http.HandleFunc(tailPath, tailHandler)
+	http.HandleFunc(encryptionPath, encryptionHandler)
+	http.HandleFunc(trashPath, trashHandler)
+	http.HandleFunc(keysPath, keysHandler)
+	http.HandleFunc(permissionsPath, permissionsHandler)
+	http.HandleFunc(namesPath, namesHandler)
+	http.HandleFunc(rewritePath, rewriteHandler)
+	http.HandleFunc(savePagePath, savePageHandler)
+	http.HandleFunc(exportPath, exportHandler)
+	http.HandleFunc(exportsPath, exportsHandler)
+	http.HandleFunc(eventsPath, eventsHandler)
+	http.HandleFunc(eventsPollPath, eventsPollHandler)
+	http.Handle(uiPath, uiHandler())
+	http.Handle("/", accessMiddleware(cachingMiddleware(deviceMiddleware(http.FileServer(visibleFiles{storageFiles{}}), staticLocation), staticLocation), staticLocation))
+
+	return chainMiddlewares(http.DefaultServeMux)
 }
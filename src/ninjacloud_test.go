@@ -0,0 +1,515 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//////// TEST CLOUD
+
+func TestMain(m *testing.M) {
+	// Failures are logged by the handlers as they answer them
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// The routes are registered once on the default mux, while each test gets
+// a fresh memory backend.
+var testRoutes struct {
+	sync.Once
+	handler http.Handler
+}
+
+func newTestCloud(t *testing.T) http.Handler {
+	t.Helper()
+	return newTestCloudOver(t, newMemStorage())
+}
+
+func newTestCloudOver(t *testing.T, s storage) http.Handler {
+	t.Helper()
+	cloudConfig = config{}
+	err := useStorage(*&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoutes.Do(func() {
+		testRoutes.handler = cloudHandler()
+	})
+	return testRoutes.handler
+}
+
+type testRequest struct {
+	method  string
+	uri     string
+	headers map[string]string
+	body    string
+}
+
+func serveTest(h http.Handler, req testRequest) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(req.method, req.uri, strings.NewReader(req.body))
+	for k, v := range req.headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Runs requests in order, checking the status of each.
+func expectStatuses(t *testing.T, h http.Handler, steps []struct {
+	req    testRequest
+	status int
+}) {
+	t.Helper()
+	for _, s := range steps {
+		w := serveTest(h, s.req)
+		if w.Code != s.status {
+			t.Errorf("%s %s %v: got %d, want %d", s.req.method, s.req.uri, s.req.headers, w.Code, s.status)
+		}
+	}
+}
+
+func mustExist(t *testing.T, p string, expected bool) {
+	t.Helper()
+	if exist(*&p) != expected {
+		t.Errorf("%s: exists %v, want %v", p, !expected, expected)
+	}
+}
+
+func mustContain(t *testing.T, p string, expected string) {
+	t.Helper()
+	content, err := readFile(*&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("%s: got %q, want %q", p, content, expected)
+	}
+}
+
+type step = struct {
+	req    testRequest
+	status int
+}
+
+//////// FILES API
+
+func TestFileCreateReadUpdate(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	expectStatuses(t, h, []step{
+		{testRequest{"POST", "/file/Ninja/p/a.txt", nil, "one"}, http.StatusCreated},
+		// Creating again fails rather than overwriting
+		{testRequest{"POST", "/file/Ninja/p/a.txt", nil, "two"}, http.StatusBadRequest},
+		{testRequest{"PUT", "/file/Ninja/p/a.txt", nil, "three"}, http.StatusNoContent},
+		// Updating needs the file to exist
+		{testRequest{"PUT", "/file/Ninja/p/missing.txt", nil, "x"}, http.StatusNotFound},
+		{testRequest{"GET", "/file/Ninja/p/missing.txt", map[string]string{"check-existence-only": "true"}, ""}, http.StatusNotFound},
+		{testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{"check-existence-only": "true"}, ""}, http.StatusNoContent},
+	})
+	mustContain(t, "p/a.txt", "three")
+
+	w := serveTest(h, testRequest{"GET", "/file/Ninja/p/a.txt", nil, ""})
+	if w.Code != http.StatusOK || w.Body.String() != "three" {
+		t.Fatalf("GET: got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("revision") != contentRevision([]byte("three")) {
+		t.Errorf("GET: revision %q", w.Header().Get("revision"))
+	}
+}
+
+func TestFileReserve(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	reserve := map[string]string{"reserve": "true"}
+	expectStatuses(t, h, []step{
+		{testRequest{"POST", "/file/Ninja/p/new.html", reserve, ""}, http.StatusCreated},
+		{testRequest{"POST", "/file/Ninja/p/new.html", reserve, ""}, http.StatusConflict},
+	})
+	mustContain(t, "p/new.html", "")
+}
+
+func TestFileInfoAndModifiedSince(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("12345"))
+
+	w := serveTest(h, testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{"get-file-info": "true"}, ""})
+	var info map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("get-file-info: %d %v", w.Code, err)
+	}
+	if info["size"] != "5" || info["modifiedDate"] == "" || info["creationDate"] == "" {
+		t.Errorf("get-file-info: %v", info)
+	}
+	w = serveTest(h, testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{"get-file-info": "false", "If-modified-since": "none"}, ""})
+	if w.Body.String() != "12345" {
+		t.Errorf("headers turned off: got %q", w.Body.String())
+	}
+	expectStatuses(t, h, []step{
+		// Dates in milliseconds: the file changed after the epoch...
+		{testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{"If-modified-since": "1"}, ""}, http.StatusNotModified},
+		// ...but not after the far future
+		{testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{"If-modified-since": "99999999999999"}, ""}, http.StatusOK},
+	})
+}
+
+func TestFileExcerpt(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("one\ntwo\nthree\n"))
+	for header, expected := range map[string]string{
+		"preview-bytes": "one",
+		"preview-lines": "one\ntwo\nthree\n",
+		"tail-bytes":    "ee\n",
+		"tail-lines":    "three\n",
+	} {
+		value := "3"
+		if header == "tail-lines" {
+			value = "1"
+		}
+		w := serveTest(h, testRequest{"GET", "/file/Ninja/p/a.txt", map[string]string{header: value}, ""})
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%s: %d %q, want %q", header, w.Code, w.Body.String(), expected)
+		}
+	}
+}
+
+func TestFileCopyMove(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("a"))
+	saveFile("p/b.txt", []byte("b"))
+	source := map[string]string{"sourceURI": "Z:/Ninja/p/a.txt"}
+	overwrite := map[string]string{"sourceURI": "Z:/Ninja/p/a.txt", "overwrite-destination": "true"}
+	move := map[string]string{"sourceURI": "Z:/Ninja/p/c.txt", "delete-source": "true"}
+	expectStatuses(t, h, []step{
+		{testRequest{"PUT", "/file/Ninja/p/c.txt", source, ""}, http.StatusNoContent},
+		// Copies never replace a file unless asked to
+		{testRequest{"PUT", "/file/Ninja/p/b.txt", source, ""}, http.StatusInternalServerError},
+		{testRequest{"PUT", "/file/Ninja/p/b.txt", overwrite, ""}, http.StatusNoContent},
+		{testRequest{"PUT", "/file/Ninja/p/d.txt", move, ""}, http.StatusNoContent},
+		{testRequest{"PUT", "/file/Ninja/p/e.txt", map[string]string{"sourceURI": "Z:/Ninja/p/none.txt"}, ""}, http.StatusNotFound},
+		{testRequest{"PUT", "/file/Ninja/p/e.txt", map[string]string{"sourceURI": "Z:/Ninja/p/none.txt", "delete-source": "true"}, ""}, http.StatusNotFound},
+		{testRequest{"PUT", "/file/Ninja/p/e.txt", map[string]string{"sourceURI": "Z:/Ninja/../x"}, ""}, http.StatusForbidden},
+	})
+	mustContain(t, "p/a.txt", "a")
+	mustContain(t, "p/b.txt", "a")
+	mustContain(t, "p/d.txt", "a")
+	mustExist(t, "p/c.txt", false)
+}
+
+func TestFileValidateOnly(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("a"))
+	w := serveTest(h, testRequest{"PUT", "/file/Ninja/p/b.txt", map[string]string{"sourceURI": "Z:/Ninja/p/a.txt", "validate-only": "true"}, ""})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "{") {
+		t.Errorf("validate-only: %d %q", w.Code, w.Body.String())
+	}
+	// Nothing is copied
+	mustExist(t, "p/b.txt", false)
+}
+
+func TestFileDelete(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("a"))
+	saveFile("p/b.txt", []byte("b"))
+	expectStatuses(t, h, []step{
+		{testRequest{"DELETE", "/file/Ninja/p/a.txt", nil, ""}, http.StatusNoContent},
+		{testRequest{"DELETE", "/file/Ninja/p/a.txt", nil, ""}, http.StatusNotFound},
+	})
+	mustExist(t, "p/a.txt", false)
+
+	w := serveTest(h, testRequest{"DELETE", "/file/Ninja/p/b.txt", map[string]string{"trash": "true"}, ""})
+	var trashed map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &trashed); err != nil || w.Code != http.StatusOK || trashed["trashId"] == "" {
+		t.Errorf("trash: %d %q", w.Code, w.Body.String())
+	}
+	mustExist(t, "p/b.txt", false)
+}
+
+func TestFilePatch(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("one\ntwo\n"))
+	diff := "@@ -1,2 +1,2 @@\n one\n-two\n+three\n"
+	patch := map[string]string{"Content-Type": "text/x-diff"}
+
+	w := serveTest(h, testRequest{"PATCH", "/file/Ninja/p/a.txt", patch, diff})
+	if w.Code != http.StatusNoContent || w.Header().Get("revision") != contentRevision([]byte("one\nthree\n")) {
+		t.Fatalf("PATCH: %d %q", w.Code, w.Header().Get("revision"))
+	}
+	mustContain(t, "p/a.txt", "one\nthree\n")
+
+	// The same diff no longer applies, and the file moved on from the base
+	stale := map[string]string{"Content-Type": "text/x-diff", "base-revision": "outdated"}
+	expectStatuses(t, h, []step{
+		{testRequest{"PATCH", "/file/Ninja/p/a.txt", stale, diff}, http.StatusConflict},
+		{testRequest{"PATCH", "/file/Ninja/p/a.txt", map[string]string{"Content-Type": "text/plain"}, diff}, http.StatusUnsupportedMediaType},
+		{testRequest{"PATCH", "/file/Ninja/p/missing.txt", patch, diff}, http.StatusNotFound},
+	})
+}
+
+//////// DIRECTORY API
+
+func listing(t *testing.T, h http.Handler, uri string, headers map[string]string) (e element) {
+	t.Helper()
+	w := serveTest(h, testRequest{"GET", uri, headers, ""})
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s %v: %d", uri, headers, w.Code)
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func childNames(e element) (names []string) {
+	for _, c := range e.Children {
+		names = append(names, c.Name)
+	}
+	return
+}
+
+func TestDirCreateList(t *testing.T) {
+	h := newTestCloud(t)
+	expectStatuses(t, h, []step{
+		{testRequest{"POST", "/directory/Ninja/p", nil, ""}, http.StatusCreated},
+		{testRequest{"POST", "/directory/Ninja/p/sub", nil, ""}, http.StatusCreated},
+		{testRequest{"GET", "/directory/Ninja/p", map[string]string{"check-existence-only": "true"}, ""}, http.StatusNoContent},
+		{testRequest{"GET", "/directory/Ninja/none", map[string]string{"check-existence-only": "true"}, ""}, http.StatusNotFound},
+		{testRequest{"GET", "/directory/Ninja/none", nil, ""}, http.StatusNotFound},
+		{testRequest{"GET", "/directory/Ninja/p", map[string]string{"If-modified-since": "1"}, ""}, http.StatusNotModified},
+		{testRequest{"GET", "/directory/Ninja/p", map[string]string{"If-modified-since": "99999999999999"}, ""}, http.StatusOK},
+		{testRequest{"GET", "/directory/Ninja/p", map[string]string{"fields": "nonsense"}, ""}, http.StatusBadRequest},
+		{testRequest{"GET", "/directory/Ninja/p", map[string]string{"changes-since": "x"}, ""}, http.StatusBadRequest},
+	})
+	saveFile("p/a.html", []byte("<p>"))
+	saveFile("p/b.css", []byte("p{}"))
+	saveFile("p/sub/c.html", []byte("<p>"))
+
+	root := listing(t, h, "/directory/", nil)
+	if names := childNames(root); len(names) != 1 || names[0] != projectsDir {
+		t.Errorf("drive: %v", names)
+	}
+	all := listing(t, h, "/directory/Ninja/p", nil)
+	if names := childNames(all); strings.Join(names, ",") != "a.html,b.css,sub" {
+		t.Errorf("all: %v", names)
+	}
+	files := listing(t, h, "/directory/Ninja/p", map[string]string{"return-type": "files"})
+	if names := childNames(files); strings.Join(names, ",") != "a.html,b.css" {
+		t.Errorf("files: %v", names)
+	}
+	dirs := listing(t, h, "/directory/Ninja/p", map[string]string{"return-type": "directories"})
+	if names := childNames(dirs); strings.Join(names, ",") != "sub" {
+		t.Errorf("directories: %v", names)
+	}
+	html := listing(t, h, "/directory/Ninja/p", map[string]string{"file-filters": "html;htm", "return-type": "files"})
+	if names := childNames(html); strings.Join(names, ",") != "a.html" {
+		t.Errorf("filtered: %v", names)
+	}
+	recursive := listing(t, h, "/directory/Ninja/p", map[string]string{"recursive": "true"})
+	for _, c := range recursive.Children {
+		if c.Name == "sub" && (len(c.Children) != 1 || c.Children[0].Name != "c.html") {
+			t.Errorf("recursive: %v", c.Children)
+		}
+	}
+}
+
+func TestDirFieldsAndChanges(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.html", []byte("<p>"))
+
+	w := serveTest(h, testRequest{"GET", "/directory/Ninja/p", map[string]string{"fields": "name,children"}, ""})
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "modifiedDate") || !strings.Contains(w.Body.String(), "a.html") {
+		t.Errorf("fields: %d %q", w.Code, w.Body.String())
+	}
+
+	cursor := journal.latest()
+	journal.append("created", "file", "p/a.html")
+	w = serveTest(h, testRequest{"GET", "/directory/Ninja/p", map[string]string{"changes-since": strconv.FormatInt(*&cursor, 10)}, ""})
+	var changes deltaListing
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("changes-since: %d %v", w.Code, err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Name != "a.html" {
+		t.Errorf("changes-since: %q", w.Body.String())
+	}
+}
+
+func TestDirIncludeTrashed(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.html", []byte("<p>"))
+	_, err := moveToTrash("p/a.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed := listing(t, h, "/directory/Ninja/p", map[string]string{"include-trashed": "true"})
+	if len(trashed.Children) != 1 || !trashed.Children[0].Deleted || trashed.Children[0].TrashId == "" {
+		t.Errorf("include-trashed: %+v", trashed.Children)
+	}
+	if plain := listing(t, h, "/directory/Ninja/p", nil); len(plain.Children) != 0 {
+		t.Errorf("without include-trashed: %+v", plain.Children)
+	}
+}
+
+func TestDirCopyMoveDuplicate(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p/sub")
+	saveFile("p/sub/a.txt", []byte("a"))
+	expectStatuses(t, h, []step{
+		{testRequest{"PUT", "/directory/Ninja/q", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "copy"}, ""}, http.StatusNoContent},
+		// Never into an existing directory
+		{testRequest{"PUT", "/directory/Ninja/q", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "copy"}, ""}, http.StatusBadRequest},
+		{testRequest{"PUT", "/directory/Ninja/r", map[string]string{"sourceURI": "Z:/Ninja/q", "operation": "move"}, ""}, http.StatusNoContent},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "rename"}, ""}, http.StatusBadRequest},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "nonsense", "validate-only": "true"}, ""}, http.StatusBadRequest},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "copy", "validate-only": "true"}, ""}, http.StatusOK},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/../x", "operation": "copy"}, ""}, http.StatusForbidden},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/none", "operation": "copy"}, ""}, http.StatusNotFound},
+		{testRequest{"PUT", "/directory/Ninja/s", map[string]string{"sourceURI": "Z:/Ninja/none", "operation": "move"}, ""}, http.StatusNotFound},
+		{testRequest{"PUT", "/directory/Ninja/t", map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "duplicate"}, ""}, http.StatusCreated},
+	})
+	mustContain(t, "p/sub/a.txt", "a")
+	mustContain(t, "r/sub/a.txt", "a")
+	mustContain(t, "t/sub/a.txt", "a")
+	mustExist(t, "q", false)
+	mustExist(t, "s", false)
+}
+
+func TestDirMerge(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	createDir("q")
+	saveFile("p/a.txt", []byte("new"))
+	saveFile("p/b.txt", []byte("b"))
+	saveFile("q/a.txt", []byte("old"))
+	merge := func(policy string) map[string]string {
+		return map[string]string{"sourceURI": "Z:/Ninja/p", "operation": "merge", "conflict-policy": policy}
+	}
+	expectStatuses(t, h, []step{
+		{testRequest{"PUT", "/directory/Ninja/q", merge("nonsense"), ""}, http.StatusBadRequest},
+		// Not into itself
+		{testRequest{"PUT", "/directory/Ninja/p/in", merge(""), ""}, http.StatusBadRequest},
+		{testRequest{"PUT", "/directory/Ninja/q", merge(""), ""}, http.StatusOK},
+	})
+	mustContain(t, "q/a.txt", "old")
+	mustContain(t, "q/b.txt", "b")
+	expectStatuses(t, h, []step{
+		{testRequest{"PUT", "/directory/Ninja/q", merge(mergeOverwrite), ""}, http.StatusOK},
+	})
+	mustContain(t, "q/a.txt", "new")
+}
+
+func TestDirDelete(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p/sub")
+	createDir("q")
+	saveFile("p/sub/a.txt", []byte("a"))
+	expectStatuses(t, h, []step{
+		{testRequest{"DELETE", "/directory/Ninja/p", nil, ""}, http.StatusNoContent},
+		{testRequest{"DELETE", "/directory/Ninja/p", nil, ""}, http.StatusNotFound},
+		{testRequest{"DELETE", "/directory/Ninja/q", map[string]string{"trash": "true"}, ""}, http.StatusOK},
+	})
+	mustExist(t, "p", false)
+	mustExist(t, "q", false)
+}
+
+//////// INTERNAL FILES
+
+func TestInternalFilesHidden(t *testing.T) {
+	h := newTestCloud(t)
+	metadata.put(sharesBucket, "secret", "share-token")
+	err := metadata.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createDir("p/" + trashDir)
+	saveFile("p/"+trashDir+"/x", []byte("share-token"))
+	saveFile("p/a.html", []byte("<p>"))
+
+	hidden := []testRequest{
+		{"GET", "/file/Ninja/" + metadataFile, nil, ""},
+		{"GET", "/file/" + metadataFile, nil, ""},
+		{"GET", "/file/Ninja/p/" + trashDir + "/x", nil, ""},
+		{"PUT", "/file/Ninja/" + metadataFile, nil, "{}"},
+		{"POST", "/file/Ninja/p/" + hiddenPrefix + "new", nil, "{}"},
+		{"DELETE", "/file/Ninja/" + metadataFile, nil, ""},
+		{"GET", "/directory/Ninja/p/" + trashDir, nil, ""},
+		{"DELETE", "/directory/Ninja/p/" + trashDir, nil, ""},
+		{"GET", "/" + metadataFile, nil, ""},
+		{"GET", "/p/" + trashDir + "/x", nil, ""},
+	}
+	check := func(headers map[string]string) {
+		for _, req := range hidden {
+			req.headers = headers
+			w := serveTest(h, req)
+			if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "share-token") {
+				t.Errorf("%s %s: %d %q", req.method, req.uri, w.Code, w.Body.String())
+			}
+		}
+		// Nor copied out, nor listed
+		copied := map[string]string{"sourceURI": "Z:/Ninja/" + metadataFile}
+		for k, v := range headers {
+			copied[k] = v
+		}
+		if w := serveTest(h, testRequest{"PUT", "/file/Ninja/p/copy.json", copied, ""}); w.Code != http.StatusForbidden {
+			t.Errorf("copy: %d", w.Code)
+		}
+		for _, uri := range []string{"/", "/p/", "/directory/Ninja/p"} {
+			w := serveTest(h, testRequest{"GET", uri, headers, ""})
+			if w.Code != http.StatusOK || strings.Contains(w.Body.String(), hiddenPrefix) {
+				t.Errorf("GET %s: %d %q", uri, w.Code, w.Body.String())
+			}
+		}
+		if w := serveTest(h, testRequest{"GET", "/tail?path=Ninja/" + metadataFile, headers, ""}); w.Code == http.StatusOK {
+			t.Errorf("tail: %d", w.Code)
+		}
+	}
+	check(nil)
+	// Served from the storage backend rather than the working directory
+	if w := serveTest(h, testRequest{"GET", "/p/a.html", nil, ""}); w.Code != http.StatusOK || w.Body.String() != "<p>" {
+		t.Errorf("GET /p/a.html: %d %q", w.Code, w.Body.String())
+	}
+
+	// Behind the ACL, which checks paths first
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	check(map[string]string{"Authorization": "Bearer owner-token"})
+
+	mustExist(t, metadataFile, true)
+	mustExist(t, "p/"+hiddenPrefix+"new", false)
+	mustExist(t, "p/copy.json", false)
+}
@@ -0,0 +1,67 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+//////// DESKTOP NOTIFICATIONS
+
+// Tells the user sitting at the host when long jobs and publications end,
+// instead of having them watch a progress dialog. Only those lasting at
+// least the given duration are notified, none when it is zero.
+
+// Notifies of the end of an operation started at the given time, in the
+// background, failing quietly when the host has no notifications.
+func notifyCompletion(kind string, source string, started time.Time, err error) {
+	if notifyFlag <= 0 || time.Since(started) < notifyFlag {
+		return
+	}
+	title := strings.ToUpper(kind[:1]) + kind[1:]
+	message := "Done"
+	if source != "" {
+		title += " of " + source
+	}
+	if err != nil {
+		title += " failed"
+		message = err.Error()
+	}
+	go func() {
+		err := sendNotification(*&title, *&message, err != nil)
+		if err != nil {
+			logDebug("", "notification failed:", *&err)
+		}
+	}()
+}
+
+func notifyJob(j job, started time.Time) {
+	var err error
+	switch j.State {
+	case jobCanceled:
+		// The user knows, having canceled it
+		return
+	case jobFailed:
+		err = errors.New(j.Error)
+	}
+	notifyCompletion(j.Kind, j.Source, *&started, *&err)
+}
@@ -0,0 +1,32 @@
+//go:build !darwin && !windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+// Through notify-send, which speaks the freedesktop notifications protocol.
+func sendNotification(title string, message string, failed bool) (err error) {
+	urgency := "normal"
+	if failed {
+		urgency = "critical"
+	}
+	_, err = runTool("notify-send", "--app-name="+APP_NAME, "--urgency="+urgency, *&title, *&message)
+	return
+}
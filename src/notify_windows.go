@@ -0,0 +1,37 @@
+//go:build windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+// Through a toast, shown on behalf of PowerShell since applications have to
+// be registered to show their own.
+const powerShellAppId = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+func sendNotification(title string, message string, failed bool) (err error) {
+	script := "[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null; " +
+		"$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02); " +
+		"$x = $t.GetElementsByTagName('text'); " +
+		"$x.Item(0).AppendChild($t.CreateTextNode(" + powerShellString(*&title) + ")) > $null; " +
+		"$x.Item(1).AppendChild($t.CreateTextNode(" + powerShellString(*&message) + ")) > $null; " +
+		"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + powerShellString(powerShellAppId) + ").Show([Windows.UI.Notifications.ToastNotification]::new($t))"
+	_, err = runTool("powershell", "-NoProfile", "-NonInteractive", "-Command", *&script)
+	return
+}
@@ -0,0 +1,531 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// OPENID CONNECT
+
+// Logs users in through an OpenID Connect provider such as Google or
+// Keycloak, then gives them a session cookie as /auth/login does. The ACL
+// may grant rights to the groups the provider puts in its ID tokens, which
+// are checked against the signing keys the provider publishes. The provider
+// is only reached over TLS, unless it runs on this machine.
+
+const oidcStateCookie = "ninja_oidc"
+const oidcStateLifetime = 10 * time.Minute
+const oidcTimeout = 10 * time.Second
+
+// Least time between two fetches of the provider keys, which are fetched
+// again when a token is signed with an unknown one
+const oidcKeysInterval = time.Minute
+
+// Users' groups as last reported by the provider, one per line
+const groupsBucket = "oidc-groups"
+
+type oidcConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// Defaults to the callback of this server as seen by the browser
+	RedirectUrl string   `json:"redirectUrl"`
+	Scopes      []string `json:"scopes"`
+	// Claims naming the user and listing their groups
+	UserClaim   string `json:"userClaim"`
+	GroupsClaim string `json:"groupsClaim"`
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Signing key of a provider, as a JSON Web Key
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// Elliptic curve keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var oidcClient = &http.Client{Timeout: oidcTimeout}
+
+var oidcDiscovery = struct {
+	sync.Mutex
+	provider    *oidcProvider
+	keys        []jsonWebKey
+	keysFetched time.Time
+}{}
+
+func oidcEnabled() bool {
+	return cloudConfig.OIDC != nil
+}
+
+// Fills in the defaults of the provider settings.
+func checkOIDC() (err error) {
+	c := cloudConfig.OIDC
+	if c.Issuer == "" || c.ClientId == "" {
+		return errors.New("OpenID Connect needs an issuer and a client id")
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if !secureEndpoint(c.Issuer) {
+		return errors.New("OpenID Connect issuer must be reached over https")
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	if c.UserClaim == "" {
+		c.UserClaim = "email"
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	return
+}
+
+// Endpoints of the provider, looked up once it first answers.
+func discoverProvider() (p *oidcProvider, err error) {
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+	if oidcDiscovery.provider != nil {
+		return oidcDiscovery.provider, nil
+	}
+	issuer := cloudConfig.OIDC.Issuer
+	resp, err := oidcClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OpenID Connect discovery failed: " + resp.Status)
+	}
+	p = &oidcProvider{}
+	err = json.NewDecoder(resp.Body).Decode(*&p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer || p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JwksUri == "" {
+		return nil, errors.New("invalid OpenID Connect discovery document of " + issuer)
+	}
+	if !secureEndpoint(p.AuthorizationEndpoint) || !secureEndpoint(p.TokenEndpoint) || !secureEndpoint(p.JwksUri) {
+		return nil, errors.New("OpenID Connect endpoints of " + issuer + " must be reached over https")
+	}
+	oidcDiscovery.provider = p
+	return
+}
+
+// Whether an endpoint is reached over TLS, or stays on this machine.
+func secureEndpoint(endpoint string) bool {
+	u, err := url.Parse(*&endpoint)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return u.Scheme == "http" && (u.Hostname() == "localhost" || ip != nil && ip.IsLoopback())
+}
+
+// Key of the provider with the given identifier, fetching the published
+// keys again when it is unknown.
+func providerKey(p *oidcProvider, kid string, kty string) (key jsonWebKey, err error) {
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+	find := func() bool {
+		for _, k := range oidcDiscovery.keys {
+			if k.Kid == kid && k.Kty == kty {
+				key = k
+				return true
+			}
+		}
+		return false
+	}
+	if find() {
+		return
+	}
+	if time.Since(oidcDiscovery.keysFetched) < oidcKeysInterval {
+		return key, errors.New("ID token signed with an unknown key")
+	}
+	oidcDiscovery.keysFetched = time.Now()
+	resp, err := oidcClient.Get(p.JwksUri)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return key, errors.New("OpenID Connect keys request failed: " + resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return
+	}
+	oidcDiscovery.keys = set.Keys
+	if !find() {
+		return key, errors.New("ID token signed with an unknown key")
+	}
+	return
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*&s, "="))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(*&b), nil
+}
+
+// Checks the signature of an ID token against the keys of the provider,
+// returning its claims.
+func verifyIDToken(p *oidcProvider, token string) (claims map[string]interface{}, err error) {
+	parts := strings.Split(*&token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid ID token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(*&header, &h)
+	if err != nil {
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch h.Alg {
+	case "RS256":
+		var k jsonWebKey
+		k, err = providerKey(*&p, h.Kid, "RSA")
+		if err != nil {
+			return
+		}
+		n, nerr := decodeBigInt(k.N)
+		e, eerr := decodeBigInt(k.E)
+		if nerr != nil || eerr != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA key of the provider")
+		}
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if rsa.VerifyPKCS1v15(*&pub, crypto.SHA256, digest[:], *&signature) != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case "ES256":
+		var k jsonWebKey
+		k, err = providerKey(*&p, h.Kid, "EC")
+		if err != nil {
+			return
+		}
+		x, xerr := decodeBigInt(k.X)
+		y, yerr := decodeBigInt(k.Y)
+		if k.Crv != "P-256" || xerr != nil || yerr != nil || len(signature) != 64 {
+			return nil, errors.New("invalid ID token signature")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(*&pub, digest[:], *&r, *&s) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, errors.New("ID token signed with an unsupported algorithm: " + h.Alg)
+	}
+	body, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(*&body, &claims)
+	return
+}
+
+func oidcRedirectUrl(r *http.Request) string {
+	if cloudConfig.OIDC.RedirectUrl != "" {
+		return cloudConfig.OIDC.RedirectUrl
+	}
+	return externalUrl(*&r, authPath+"oidc/callback")
+}
+
+// Only pages of this server may be returned to after logging in.
+func safeReturnPath(p string) string {
+	if !strings.HasPrefix(*&p, "/") || strings.HasPrefix(*&p, "//") || strings.HasPrefix(*&p, `/\`) {
+		return basePathFlag + "/"
+	}
+	return p
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(*&b)
+	return base64.RawURLEncoding.EncodeToString(*&b)
+}
+
+// Sends the browser to the provider, remembering in a signed cookie what
+// to expect when it comes back.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p, err := discoverProvider()
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	state, nonce := randomString(16), randomString(16)
+	returnTo := safeReturnPath(r.URL.Query().Get("return"))
+	payload := state + "." + nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(returnTo))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    payload + "." + signSession(*&payload),
+		Path:     basePathFlag + authPath + "oidc/",
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(*&r) == "https",
+		// Sent along the redirection coming back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	c := cloudConfig.OIDC
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {c.ClientId},
+		"redirect_uri":  {oidcRedirectUrl(*&r)},
+		"scope":         {strings.Join(c.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	target := p.AuthorizationEndpoint
+	if strings.Contains(*&target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, *&target, http.StatusFound)
+}
+
+func readOIDCState(r *http.Request) (state string, nonce string, returnTo string, ok bool) {
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !secureEquals(signSession(c.Value[:i]), c.Value[i+1:]) {
+		return
+	}
+	parts := strings.Split(c.Value[:i], ".")
+	if len(parts) != 3 {
+		return
+	}
+	ret, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	return parts[0], parts[1], string(*&ret), true
+}
+
+// Trades an authorization code for the claims of the user's ID token.
+func redeemCode(r *http.Request, code string) (claims map[string]interface{}, err error) {
+	p, err := discoverProvider()
+	if err != nil {
+		return
+	}
+	c := cloudConfig.OIDC
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {oidcRedirectUrl(*&r)},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientId), url.QueryEscape(c.ClientSecret))
+	resp, err := oidcClient.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OpenID Connect token request failed: " + resp.Status)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return
+	}
+	// Signed by the provider, its claims are then checked against this login
+	return verifyIDToken(*&p, tokens.IdToken)
+}
+
+func audienceContains(aud interface{}, clientId string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientId
+	case []interface{}:
+		for _, e := range a {
+			if s, ok := e.(string); ok && s == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkClaims(claims map[string]interface{}, nonce string) (err error) {
+	c := cloudConfig.OIDC
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != c.Issuer {
+		return errors.New("ID token from another issuer")
+	}
+	if !audienceContains(claims["aud"], c.ClientId) {
+		return errors.New("ID token for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() > int64(exp) {
+		return errors.New("expired ID token")
+	}
+	if n, _ := claims["nonce"].(string); !secureEquals(*&n, *&nonce) {
+		return errors.New("ID token of another login")
+	}
+	// Some providers let anyone claim an address
+	if c.UserClaim == "email" && !emailVerified(claims["email_verified"]) {
+		return errors.New("ID token with an unverified email address")
+	}
+	return
+}
+
+// Whether the email_verified claim holds, some providers sending it as a
+// string.
+func emailVerified(v interface{}) bool {
+	switch verified := v.(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+func claimStrings(v interface{}) (values []string) {
+	switch c := v.(type) {
+	case string:
+		values = []string{c}
+	case []interface{}:
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return
+}
+
+// Names the provider may not use, not to impersonate configured users.
+func reservedUser(name string) bool {
+	if name == ownerUser {
+		return true
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Completes a login when the provider sends the browser back.
+func finishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce, returnTo, ok := readOIDCState(*&r)
+	q := r.URL.Query()
+	if !ok || !secureEquals(q.Get("state"), *&state) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: basePathFlag + authPath + "oidc/", MaxAge: -1})
+	if e := q.Get("error"); e != "" {
+		log.Println("OpenID Connect login refused:", *&e, q.Get("error_description"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims, err := redeemCode(*&r, q.Get("code"))
+	if err == nil {
+		err = checkClaims(*&claims, *&nonce)
+	}
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	c := cloudConfig.OIDC
+	user, _ := claims[c.UserClaim].(string)
+	if user == "" || strings.Contains(*&user, "\n") || reservedUser(*&user) {
+		log.Println("OpenID Connect login refused for user", *&user)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	metadata.put(groupsBucket, *&user, strings.Join(claimStrings(claims[c.GroupsClaim]), "\n"))
+	expires := time.Now().Add(sessionLifetimeFlag).Truncate(time.Second)
+	setSessionCookie(w, r, newSession(*&user, *&expires), *&expires)
+	http.Redirect(w, r, *&returnTo, http.StatusFound)
+}
+
+// Groups a user belongs to, from the configuration or the provider.
+func userGroups(user string) (groups []string) {
+	for _, u := range cloudConfig.Users {
+		if u.Name == user {
+			groups = append(groups, u.Groups...)
+		}
+	}
+	if oidcEnabled() {
+		if g, ok := metadata.get(groupsBucket, *&user); ok && g != "" {
+			groups = append(groups, strings.Split(*&g, "\n")...)
+		}
+	}
+	return
+}
@@ -0,0 +1,286 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//////// OVERLAY STORAGE
+
+// Layers a read-only base directory, such as a shared asset library, under
+// the projects. Reads fall through to the base, writes always go to the
+// upper layer, and base files deleted through the cloud are hidden by
+// whiteouts recorded in the metadata store. Whiteouts stay in place when
+// something new is created at the same path, so that the base entries do
+// not reappear under it.
+
+const whiteoutBucket = "whiteout"
+
+type overlayStorage struct {
+	lower storage
+	upper storage
+}
+
+func isWhiteout(name string) bool {
+	if metadata == nil {
+		return false
+	}
+	for p := metadataKey(*&name); p != "."; p = filepath.ToSlash(filepath.Dir(*&p)) {
+		if _, ok := metadata.get(whiteoutBucket, *&p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *overlayStorage) inLower(name string) bool {
+	if isWhiteout(*&name) {
+		return false
+	}
+	_, err := o.lower.stat(*&name)
+	return err == nil
+}
+
+func (o *overlayStorage) inUpper(name string) bool {
+	_, err := o.upper.stat(*&name)
+	return err == nil
+}
+
+// Hides the base entries of a path from now on.
+func (o *overlayStorage) hide(name string) error {
+	if !o.inLower(*&name) {
+		return nil
+	}
+	if metadata == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	metadata.put(whiteoutBucket, metadataKey(*&name), "")
+	return nil
+}
+
+// Copies the parent directories of a path into the upper layer.
+func (o *overlayStorage) copyUpParent(name string) error {
+	parent := filepath.Dir(*&name)
+	if o.inUpper(*&parent) {
+		return nil
+	}
+	info, err := o.stat(*&parent)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: parent, Err: errNotDir}
+	}
+	return o.upper.mkdirAll(*&parent, 0777)
+}
+
+// Copies a base entry and, for directories, everything below it into the
+// upper layer.
+func (o *overlayStorage) copyUp(name string) error {
+	info, err := o.stat(*&name)
+	if err != nil {
+		return err
+	}
+	err = o.copyUpParent(*&name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = o.upper.mkdirAll(*&name, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		entries, err := o.readDir(*&name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			err = o.copyUp(filepath.Join(*&name, e.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if o.inUpper(*&name) {
+		return nil
+	}
+	src, err := o.lower.open(*&name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := o.upper.create(*&name, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(*&dst, *&src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (o *overlayStorage) stat(name string) (os.FileInfo, error) {
+	info, err := o.upper.stat(*&name)
+	if err == nil || !os.IsNotExist(*&err) || isWhiteout(*&name) {
+		return info, err
+	}
+	return o.lower.stat(*&name)
+}
+
+func (o *overlayStorage) readDir(name string) (list []os.FileInfo, err error) {
+	upper, err := o.upper.readDir(*&name)
+	if err != nil && !os.IsNotExist(*&err) {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, e := range upper {
+		seen[e.Name()] = true
+		list = append(*&list, *&e)
+	}
+	if o.inLower(*&name) {
+		lower, lerr := o.lower.readDir(*&name)
+		if lerr != nil {
+			return nil, lerr
+		}
+		for _, e := range lower {
+			if !seen[e.Name()] && !isWhiteout(filepath.Join(*&name, e.Name())) {
+				list = append(*&list, *&e)
+			}
+		}
+	} else if err != nil {
+		return
+	}
+	sort.Slice(*&list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (o *overlayStorage) open(name string) (io.ReadCloser, error) {
+	if o.inUpper(*&name) || !o.inLower(*&name) {
+		return o.upper.open(*&name)
+	}
+	return o.lower.open(*&name)
+}
+
+func (o *overlayStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	err := o.copyUpParent(*&name)
+	if err != nil {
+		return nil, err
+	}
+	return o.upper.create(*&name, *&perm)
+}
+
+func (o *overlayStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if _, err := o.stat(*&name); err == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	err := o.copyUpParent(*&name)
+	if err != nil {
+		return nil, err
+	}
+	return o.upper.createNew(*&name, *&perm)
+}
+
+func (o *overlayStorage) mkdirAll(name string, perm os.FileMode) error {
+	info, err := o.stat(*&name)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	for p := filepath.Dir(*&name); p != "." && p != "/"; p = filepath.Dir(*&p) {
+		if info, err := o.stat(*&p); err == nil {
+			if !info.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+			}
+			break
+		}
+	}
+	return o.upper.mkdirAll(*&name, *&perm)
+}
+
+func (o *overlayStorage) remove(name string) error {
+	info, err := o.stat(*&name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(*&name)
+		if err != nil {
+			return err
+		}
+		if len(*&entries) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	if o.inUpper(*&name) {
+		err = o.upper.remove(*&name)
+		if err != nil {
+			return err
+		}
+	}
+	return o.hide(*&name)
+}
+
+func (o *overlayStorage) removeAll(name string) error {
+	err := o.upper.removeAll(*&name)
+	if err != nil {
+		return err
+	}
+	return o.hide(*&name)
+}
+
+func (o *overlayStorage) rename(source string, dest string) error {
+	if o.inLower(*&source) {
+		err := o.copyUp(*&source)
+		if err != nil {
+			return err
+		}
+	}
+	err := o.copyUpParent(*&dest)
+	if err != nil {
+		return err
+	}
+	if o.inLower(*&dest) {
+		info, err := o.stat(*&dest)
+		if err == nil && info.IsDir() {
+			err = o.copyUp(*&dest)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = o.upper.rename(*&source, *&dest)
+	if err != nil {
+		return err
+	}
+	return o.hide(*&source)
+}
+
+func (o *overlayStorage) chmod(name string, mode os.FileMode) error {
+	err := o.copyUp(*&name)
+	if err != nil {
+		return err
+	}
+	return o.upper.chmod(*&name, *&mode)
+}
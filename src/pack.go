@@ -0,0 +1,288 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////// ASSET PACKING
+
+type packRequest struct {
+	Mode       string   `json:"mode"`
+	Images     []string `json:"images"`
+	Output     string   `json:"output"`
+	Stylesheet string   `json:"stylesheet"`
+}
+
+type spriteEntry struct {
+	Uri    string `json:"uri"`
+	Class  string `json:"class"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+var spriteClassRegexp = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+// Relative URL from a stylesheet to an asset, as written in CSS.
+func cssRelativeUrl(stylesheet string, asset string) (u string, err error) {
+	u, err = filepath.Rel(filepath.Dir(*&stylesheet), *&asset)
+	u = filepath.ToSlash(*&u)
+	return
+}
+
+//// Sprite sheets
+
+// CSS classes of the images, after their names, those sharing one being
+// told apart by a numeric suffix in the order they are given.
+func spriteClasses(images []string) (classes []string) {
+	used := make(map[string]bool)
+	for _, p := range images {
+		name := strings.TrimSuffix(filepath.Base(*&p), filepath.Ext(*&p))
+		base := "sprite-" + spriteClassRegexp.ReplaceAllString(*&name, "-")
+		class := base
+		for n := 2; used[class]; n++ {
+			class = base + "-" + strconv.Itoa(*&n)
+		}
+		used[class] = true
+		classes = append(*&classes, *&class)
+	}
+	return
+}
+
+// Lays the images out on shelves of roughly square total area, tallest
+// first, and writes the sheet along with one CSS class per image.
+func packSprite(images []string, output string, stylesheet string) (entries []spriteEntry, err error) {
+	type sprite struct {
+		path  string
+		class string
+		img   image.Image
+	}
+	var sprites []sprite
+	area := 0
+	classes := spriteClasses(*&images)
+	for i, p := range images {
+		f, err := fsys.open(*&p)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(*&f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		sprites = append(*&sprites, sprite{p, classes[i], img})
+		area += img.Bounds().Dx() * img.Bounds().Dy()
+	}
+	sort.SliceStable(*&sprites, func(i, j int) bool {
+		return sprites[i].img.Bounds().Dy() > sprites[j].img.Bounds().Dy()
+	})
+	maxWidth := 0
+	for _, s := range sprites {
+		if s.img.Bounds().Dx() > maxWidth {
+			maxWidth = s.img.Bounds().Dx()
+		}
+	}
+	shelfWidth := maxWidth
+	for shelfWidth*shelfWidth < area {
+		shelfWidth += maxWidth
+	}
+	x, y, shelfHeight, width := 0, 0, 0, 0
+	for _, s := range sprites {
+		b := s.img.Bounds()
+		if x+b.Dx() > shelfWidth {
+			x, y, shelfHeight = 0, y+shelfHeight, 0
+		}
+		entries = append(*&entries, spriteEntry{pathToUri(s.path), s.class, x, y, b.Dx(), b.Dy()})
+		x += b.Dx()
+		if x > width {
+			width = x
+		}
+		if b.Dy() > shelfHeight {
+			shelfHeight = b.Dy()
+		}
+	}
+	sheet := image.NewNRGBA(image.Rect(0, 0, width, y+shelfHeight))
+	for i, s := range sprites {
+		e := entries[i]
+		draw.Draw(*&sheet, image.Rect(e.X, e.Y, e.X+e.Width, e.Y+e.Height), s.img, s.img.Bounds().Min, draw.Src)
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, *&sheet)
+	if err != nil {
+		return
+	}
+	err = createDir(filepath.Dir(*&output))
+	if err != nil {
+		return
+	}
+	err = saveFile(*&output, buf.Bytes())
+	if err != nil {
+		return
+	}
+	u, err := cssRelativeUrl(*&stylesheet, *&output)
+	if err != nil {
+		return
+	}
+	var css bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&css, ".%s {\n", e.Class)
+		fmt.Fprintf(&css, "\tbackground: url('%s') no-repeat %dpx %dpx;\n", u, -e.X, -e.Y)
+		fmt.Fprintf(&css, "\twidth: %dpx;\n", e.Width)
+		fmt.Fprintf(&css, "\theight: %dpx;\n", e.Height)
+		fmt.Fprintf(&css, "}\n\n")
+	}
+	err = saveFile(*&stylesheet, css.Bytes())
+	return
+}
+
+//// Data URIs
+
+var cssUrlRegexp = regexp.MustCompile(`url\(\s*['"]?([^'")]+)['"]?\s*\)`)
+
+// Replaces the references to the given images in a stylesheet by data URIs.
+func inlineDataUris(images []string, stylesheet string) (inlined []string, err error) {
+	css, err := readFile(*&stylesheet)
+	if err != nil {
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, p := range images {
+		wanted[filepath.Clean(*&p)] = true
+	}
+	dir := filepath.Dir(*&stylesheet)
+	var failed error
+	css = cssUrlRegexp.ReplaceAllFunc(*&css, func(m []byte) []byte {
+		ref := string(cssUrlRegexp.FindSubmatch(*&m)[1])
+		if strings.Contains(*&ref, ":") {
+			return m
+		}
+		p := filepath.Join(*&dir, filepath.FromSlash(*&ref))
+		if !wanted[p] {
+			return m
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			failed = err
+			return m
+		}
+		mimeType := mime.TypeByExtension(filepath.Ext(*&p))
+		inlined = append(*&inlined, pathToUri(*&p))
+		return []byte("url('data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(*&content) + "')")
+	})
+	if failed != nil {
+		return nil, failed
+	}
+	err = saveFile(*&stylesheet, *&css)
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Asset packing API
+
+// Pack images into a sprite sheet or inline them into a stylesheet
+func packHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req packRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Images) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var images []string
+	for _, uri := range req.Images {
+		p, ok := bodyPath(*&r, *&uri, opRead)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !exist(*&p) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		images = append(*&images, *&p)
+	}
+	if req.Stylesheet == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	stylesheet, ok := bodyPath(*&r, req.Stylesheet, opWrite)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch req.Mode {
+	case "sprite":
+		if req.Output == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		output, ok := bodyPath(*&r, req.Output, opWrite)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		entries, err := packSprite(*&images, *&output, *&stylesheet)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&entries)
+	case "datauri":
+		if !exist(*&stylesheet) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		inlined, err := inlineDataUris(*&images, *&stylesheet)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&inlined)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
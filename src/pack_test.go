@@ -0,0 +1,65 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPackAuthorized(t *testing.T) {
+	h := newTestCloud(t)
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	createDir("p")
+	createDir("secret")
+	saveFile("p/logo.png", buf.Bytes())
+	saveFile("secret/s.png", buf.Bytes())
+	saveFile("p/style.css", []byte(".a { background: url('../secret/s.png') }"))
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	cloudConfig.Users = []configUser{{Name: "bob", Password: "bob-password"}}
+	cloudConfig.ACL = []aclRule{{User: "bob", Prefix: "Z:/Ninja/p", Allow: []string{opRead, opWrite}}}
+
+	// The URIs of the body are checked as well as the one of the URL
+	bob := basicHeader("bob", "bob-password")
+	expectStatuses(t, h, []step{
+		{testRequest{"POST", "/pack/Ninja/p", bob, `{"mode": "datauri", "images": ["Z:/Ninja/secret/s.png"], "stylesheet": "Z:/Ninja/p/style.css"}`}, http.StatusForbidden},
+		{testRequest{"POST", "/pack/Ninja/p", bob, `{"mode": "sprite", "images": ["Z:/Ninja/p/logo.png"], "output": "Z:/Ninja/secret/sheet.png", "stylesheet": "Z:/Ninja/p/sprites.css"}`}, http.StatusForbidden},
+		{testRequest{"POST", "/pack/Ninja/p", bob, `{"mode": "sprite", "images": ["Z:/Ninja/p/logo.png"], "output": "Z:/Ninja/p/sheet.png", "stylesheet": "Z:/Ninja/secret/sprites.css"}`}, http.StatusForbidden},
+		{testRequest{"POST", "/fonts/Ninja/p", bob, `{"provider": "google", "family": "Roboto", "destination": "Z:/Ninja/secret"}`}, http.StatusForbidden},
+		{testRequest{"POST", "/pack/Ninja/p", bob, `{"mode": "sprite", "images": ["Z:/Ninja/p/logo.png"], "output": "Z:/Ninja/p/sheet.png", "stylesheet": "Z:/Ninja/p/sprites.css"}`}, http.StatusOK},
+	})
+	mustContain(t, "p/style.css", ".a { background: url('../secret/s.png') }")
+	mustExist(t, "secret/sheet.png", false)
+	mustExist(t, "secret/sprites.css", false)
+}
+
+func TestSpriteClasses(t *testing.T) {
+	classes := spriteClasses([]string{"a/logo.png", "b/logo.png", "c/logo.gif", "d/logo-2.png", "e/my icon.png"})
+	expected := []string{"sprite-logo", "sprite-logo-2", "sprite-logo-3", "sprite-logo-2-2", "sprite-my-icon"}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("got %v, want %v", classes, expected)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+//////// DEVICE PAIRING
+
+// Opens a composition on a phone by scanning a QR code, for testing it on
+// a real device. The code holds a short-lived read share of the directory
+// of the composition, at an address of the host reachable from the local
+// network.
+
+const defaultPairLifetime = 15 * time.Minute
+const maxPairLifetime = 24 * time.Hour
+const pairModuleSize = 8
+
+var errNotOnNetwork = errors.New("the cloud only listens on loopback, start it with -i set to a network interface")
+
+// Base URL of the cloud for other devices of the local network: the one the
+// request came through if it is not a loopback one, or one of the addresses
+// of the listening interface.
+func lanBaseUrl(r *http.Request) (u string, err error) {
+	host := requestHost(*&r)
+	if h, _, err := net.SplitHostPort(*&host); err == nil {
+		host = h
+	}
+	if !isLoopbackInterface(*&host) {
+		return externalUrl(*&r, ""), nil
+	}
+	if unixSocketFlag != "" {
+		return "", errNotOnNetwork
+	}
+	ip := net.ParseIP(interfaceFlag)
+	switch {
+	case interfaceFlag != "" && ip == nil:
+		// Host name of the interface
+		if isLoopbackInterface(interfaceFlag) {
+			return "", errNotOnNetwork
+		}
+		host = interfaceFlag
+	case ip != nil && !ip.IsUnspecified():
+		if ip.IsLoopback() {
+			return "", errNotOnNetwork
+		}
+		host = ip.String()
+	default:
+		host, err = lanAddress()
+		if err != nil {
+			return
+		}
+	}
+	return requestScheme(*&r) + "://" + net.JoinHostPort(*&host, portFlag) + basePathFlag, nil
+}
+
+// First IPv4 address of the host which is neither loopback nor link-local,
+// what phones on the same network can most likely reach.
+func lanAddress() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := n.IP.To4()
+		if ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("no network address to reach the cloud from other devices")
+}
+
+//////// REQUEST HANDLERS
+
+//// Pairing API
+
+// Share a composition with a phone through a QR code of its preview URL
+func pairHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[pairPathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	lifetime := defaultPairLifetime
+	if l := r.URL.Query().Get("lifetime"); l != "" {
+		lifetime, err = time.ParseDuration(*&l)
+		if err != nil || lifetime <= 0 || lifetime > maxPairLifetime {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	base, err := lanBaseUrl(*&r)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// The directory of a file is shared, for its assets to load
+	dir, name := p, ""
+	if !info.IsDir() {
+		dir, name = filepath.Dir(*&p), filepath.Base(*&p)
+	}
+	s, err := saveShare(requestUser(*&r), *&dir, shareRead, *&lifetime, *&base)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u := s.Url + (&url.URL{Path: *&name}).EscapedPath()
+	q, err := encodeQR([]byte(*&u))
+	if err != nil {
+		metadata.delete(sharesBucket, s.Id)
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	var image bytes.Buffer
+	err = png.Encode(&image, q.image(pairModuleSize))
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", *&u)
+	if r.URL.Query().Get("format") == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(image.Bytes())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"url":     u,
+		"token":   s.Token,
+		"expires": s.Expires,
+		"qr":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(image.Bytes()),
+	})
+}
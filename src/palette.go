@@ -0,0 +1,175 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////// PALETTE EXTRACTION
+
+// Dominant colors of an image, for the color picker swatches: median cut
+// seeds a few rounds of k-means, run on a sample of the opaque pixels.
+
+const defaultPaletteSize = 8
+const maxPaletteSize = 32
+const paletteSamples = 1 << 16
+const paletteIterations = 10
+
+type paletteColor struct {
+	Hex   string  `json:"hex"`
+	Red   uint8   `json:"red"`
+	Green uint8   `json:"green"`
+	Blue  uint8   `json:"blue"`
+	Share float64 `json:"share"`
+}
+
+func decodeImage(p string, content []byte) (img image.Image, err error) {
+	switch strings.ToLower(filepath.Ext(*&p)) {
+	case ".tif", ".tiff":
+		return decodeTIFF(bytes.NewReader(*&content))
+	}
+	img, _, err = image.Decode(bytes.NewReader(*&content))
+	return
+}
+
+// Opaque pixels of the image, taken on a grid coarse enough to keep their
+// number around the sample size, as a single row image.
+func samplePixels(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	step := int(math.Ceil(math.Sqrt(float64(b.Dx()*b.Dy()) / paletteSamples)))
+	if step < 1 {
+		step = 1
+	}
+	var pixels []uint8
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= 128 {
+				pixels = append(*&pixels, c.R, c.G, c.B, 255)
+			}
+		}
+	}
+	sample := image.NewNRGBA(image.Rect(0, 0, len(pixels)/4, 1))
+	copy(sample.Pix, *&pixels)
+	return sample
+}
+
+func extractPalette(img image.Image, size int) (palette []paletteColor) {
+	sample := samplePixels(*&img)
+	n := len(sample.Pix) / 4
+	if n == 0 {
+		return []paletteColor{}
+	}
+	seeds := medianCut(*&sample, *&size)
+	centers := make([][3]float64, len(seeds))
+	for i, s := range seeds {
+		c := s.(color.NRGBA)
+		centers[i] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	}
+	counts := make([]int, len(centers))
+	for it := 0; it < paletteIterations; it++ {
+		sums := make([][3]float64, len(centers))
+		counts = make([]int, len(centers))
+		for i := 0; i < n; i++ {
+			px := sample.Pix[i*4 : i*4+3]
+			best, bestDist := 0, math.MaxFloat64
+			for j, c := range centers {
+				dr, dg, db := float64(px[0])-c[0], float64(px[1])-c[1], float64(px[2])-c[2]
+				if d := dr*dr + dg*dg + db*db; d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			sums[best][0] += float64(px[0])
+			sums[best][1] += float64(px[1])
+			sums[best][2] += float64(px[2])
+			counts[best]++
+		}
+		for j := range centers {
+			if counts[j] > 0 {
+				for k := 0; k < 3; k++ {
+					centers[j][k] = sums[j][k] / float64(counts[j])
+				}
+			}
+		}
+	}
+	for j, c := range centers {
+		if counts[j] == 0 {
+			continue
+		}
+		r, g, b := uint8(math.Round(c[0])), uint8(math.Round(c[1])), uint8(math.Round(c[2]))
+		palette = append(*&palette, paletteColor{
+			Hex:   hexColor(c[0]/255, c[1]/255, c[2]/255),
+			Red:   r,
+			Green: g,
+			Blue:  b,
+			Share: math.Round(float64(counts[j])/float64(n)*1000) / 1000,
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Share > palette[j].Share })
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Palette API
+
+// Extract the dominant colors of an image
+func paletteHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[palettePathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("colors"))
+	if err != nil || size <= 0 || size > maxPaletteSize {
+		size = defaultPaletteSize
+	}
+	content, err := readFile(*&p)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	img, err := decodeImage(*&p, *&content)
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	writeJSON(w, http.StatusOK, extractPalette(*&img, *&size))
+}
@@ -0,0 +1,116 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//////// PARALLEL IO
+
+// Recursive operations spread over a bounded number of goroutines, which
+// pays off on SSDs able to serve many requests at once.
+
+// Set from -io-parallelism at startup.
+var ioSlots chan struct{}
+
+// Runs fn in a new goroutine if a slot is free, in the current one
+// otherwise, so that nested calls can never wait on each other.
+func goParallel(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	select {
+	case ioSlots <- struct{}{}:
+		go func() {
+			defer func() { <-ioSlots }()
+			defer wg.Done()
+			fn()
+		}()
+	default:
+		defer wg.Done()
+		fn()
+	}
+}
+
+// Calls fn for 0 to n-1 in parallel, returning the first error.
+func forEachParallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, *&n)
+	for i := 0; i < n; i++ {
+		i := i
+		goParallel(&wg, func() { errs[i] = fn(*&i) })
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn for everything under root, root excluded, reading directories
+// in parallel. fn may be called from several goroutines at once, and may
+// return filepath.SkipDir to leave a directory out.
+func parallelWalk(ctx context.Context, root string, fn func(p string, info os.FileInfo) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failure error
+	fail := func(err error) {
+		mutex.Lock()
+		if failure == nil {
+			failure = err
+		}
+		mutex.Unlock()
+	}
+	var visit func(dir string)
+	visit = func(dir string) {
+		entries, err := fsys.readDir(*&dir)
+		if err != nil {
+			if dir == root || !os.IsNotExist(*&err) {
+				fail(*&err)
+			}
+			// Otherwise removed while walking
+			return
+		}
+		for _, e := range entries {
+			if err := ioPause(*&ctx); err != nil {
+				fail(*&err)
+				return
+			}
+			p := filepath.Join(*&dir, e.Name())
+			err := fn(*&p, *&e)
+			if err == filepath.SkipDir {
+				continue
+			} else if err != nil {
+				fail(*&err)
+				return
+			}
+			if e.IsDir() {
+				goParallel(&wg, func() { visit(*&p) })
+			}
+		}
+	}
+	visit(*&root)
+	wg.Wait()
+	return failure
+}
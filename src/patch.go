@@ -0,0 +1,523 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//////// PATCHING
+
+var errPatchConflict = errors.New("patch does not apply to the current revision")
+var errPatchFormat = errors.New("unsupported patch format")
+
+// Identifies the content of a file, used as the base revision of patches.
+func contentRevision(content []byte) string {
+	h := revisionHash()
+	h.Write(*&content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type patcher func(content []byte, patch []byte) (patched []byte, err error)
+
+var patchers = map[string]patcher{
+	"text/x-diff":                 applyUnifiedDiff,
+	"text/x-patch":                applyUnifiedDiff,
+	"application/json-patch+json": applyJSONPatch,
+}
+
+// Applies a patch made against the base revision. When the file changed in
+// the meantime the patch is merged if it still applies, or refused with
+// errPatchConflict and the current revision otherwise.
+func patchFile(p string, contentType string, base string, patch []byte) (revision string, err error) {
+	mediaType, _, _ := mime.ParseMediaType(*&contentType)
+	apply, ok := patchers[mediaType]
+	if !ok {
+		return "", errPatchFormat
+	}
+	content, err := readFile(*&p)
+	if err != nil {
+		return
+	}
+	current := contentRevision(*&content)
+	patched, err := apply(*&content, *&patch)
+	if err != nil {
+		if base != "" && base != current {
+			return current, errPatchConflict
+		}
+		return
+	}
+	err = saveFile(*&p, *&patched)
+	if err != nil {
+		return
+	}
+	revision = contentRevision(*&patched)
+	return
+}
+
+//// Unified diffs
+
+var hunkHeaderRegexp = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,\d+)? @@`)
+
+type diffHunk struct {
+	oldStart int
+	oldLines []string
+	newLines []string
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(*&s, "\n")
+	if len(*&lines) > 0 && lines[len(*&lines)-1] == "" {
+		lines = lines[:len(*&lines)-1]
+	}
+	return lines
+}
+
+func parseUnifiedDiff(patch string) (hunks []diffHunk, err error) {
+	var h *diffHunk
+	// Line lists the last patch line was appended to, for "\ No newline"
+	var last []*[]string
+	for _, line := range strings.Split(*&patch, "\n") {
+		if m := hunkHeaderRegexp.FindStringSubmatch(*&line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			if m[2] != "0" {
+				start--
+			}
+			hunks = append(*&hunks, diffHunk{oldStart: start})
+			h = &hunks[len(*&hunks)-1]
+			continue
+		}
+		if h == nil || line == "" {
+			// File headers and trailing newline
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			h.oldLines = append(h.oldLines, line[1:]+"\n")
+			h.newLines = append(h.newLines, line[1:]+"\n")
+			last = []*[]string{&h.oldLines, &h.newLines}
+		case '-':
+			h.oldLines = append(h.oldLines, line[1:]+"\n")
+			last = []*[]string{&h.oldLines}
+		case '+':
+			h.newLines = append(h.newLines, line[1:]+"\n")
+			last = []*[]string{&h.newLines}
+		case '\\':
+			for _, l := range last {
+				(*l)[len(*l)-1] = strings.TrimSuffix((*l)[len(*l)-1], "\n")
+			}
+		default:
+			return nil, fmt.Errorf("invalid diff line %q", line)
+		}
+	}
+	if len(*&hunks) == 0 {
+		err = errors.New("empty diff")
+	}
+	return
+}
+
+func linesMatch(lines []string, at int, want []string) bool {
+	if at < 0 || at+len(*&want) > len(*&lines) {
+		return false
+	}
+	for i, l := range want {
+		if lines[at+i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// Looks for the lines of a hunk around their expected position.
+func findLines(lines []string, want []string, expected int) int {
+	for d := 0; d <= len(*&lines); d++ {
+		if linesMatch(*&lines, expected-d, *&want) {
+			return expected - d
+		}
+		if linesMatch(*&lines, expected+d, *&want) {
+			return expected + d
+		}
+	}
+	return -1
+}
+
+func applyUnifiedDiff(content []byte, patch []byte) (patched []byte, err error) {
+	hunks, err := parseUnifiedDiff(string(*&patch))
+	if err != nil {
+		return
+	}
+	lines := splitLines(string(*&content))
+	offset := 0
+	for _, h := range hunks {
+		expected := h.oldStart + offset
+		pos := findLines(*&lines, h.oldLines, *&expected)
+		if pos < 0 {
+			return nil, fmt.Errorf("hunk at line %d does not apply", h.oldStart+1)
+		}
+		result := append([]string{}, lines[:pos]...)
+		result = append(*&result, h.newLines...)
+		lines = append(*&result, lines[pos+len(h.oldLines):]...)
+		offset += pos - expected + len(h.newLines) - len(h.oldLines)
+	}
+	patched = []byte(strings.Join(*&lines, ""))
+	return
+}
+
+// Cells of the table comparing the lines two files do not have in common
+// past which they are not diffed
+const maxDiffCells = 1 << 22
+
+const diffContext = 3
+
+type diffLine struct {
+	kind byte
+	line string
+}
+
+// Unified diff turning a into b, unless they differ over too many lines.
+func unifiedDiff(a []byte, b []byte, nameA string, nameB string) (diff string, ok bool) {
+	x, y := splitLines(string(*&a)), splitLines(string(*&b))
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	if (len(mx)+1)*(len(my)+1) > maxDiffCells {
+		return "", false
+	}
+	// Length of the longest common subsequence of mx[i:] and my[j:]
+	w := len(my) + 1
+	lcs := make([]int32, (len(mx)+1)*w)
+	for i := len(mx) - 1; i >= 0; i-- {
+		for j := len(my) - 1; j >= 0; j-- {
+			switch {
+			case mx[i] == my[j]:
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			default:
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	var lines []diffLine
+	for _, l := range x[:pre] {
+		lines = append(*&lines, diffLine{' ', l})
+	}
+	for i, j := 0, 0; i < len(mx) || j < len(my); {
+		switch {
+		case i < len(mx) && j < len(my) && mx[i] == my[j]:
+			lines = append(*&lines, diffLine{' ', mx[i]})
+			i, j = i+1, j+1
+		case i < len(mx) && (j == len(my) || lcs[(i+1)*w+j] >= lcs[i*w+j+1]):
+			lines = append(*&lines, diffLine{'-', mx[i]})
+			i++
+		default:
+			lines = append(*&lines, diffLine{'+', my[j]})
+			j++
+		}
+	}
+	for _, l := range x[len(x)-suf:] {
+		lines = append(*&lines, diffLine{' ', l})
+	}
+	return formatHunks(*&lines, *&nameA, *&nameB), true
+}
+
+// Start and length of the lines of a hunk, starting after the line before
+// them when there are none.
+func hunkRange(before int, count int) string {
+	if count > 0 {
+		before++
+	}
+	return strconv.Itoa(*&before) + "," + strconv.Itoa(*&count)
+}
+
+// Groups the changed lines into hunks with their context.
+func formatHunks(lines []diffLine, nameA string, nameB string) string {
+	var out strings.Builder
+	out.WriteString("--- " + nameA + "\n+++ " + nameB + "\n")
+	// Lines of a and b before the current one
+	before := func(k int) (a int, b int) {
+		for _, l := range lines[:k] {
+			if l.kind != '+' {
+				a++
+			}
+			if l.kind != '-' {
+				b++
+			}
+		}
+		return
+	}
+	for k := 0; k < len(lines); {
+		for k < len(lines) && lines[k].kind == ' ' {
+			k++
+		}
+		if k == len(lines) {
+			break
+		}
+		start, last := k-diffContext, k
+		if start < 0 {
+			start = 0
+		}
+		for end := k; end < len(lines) && end-last <= 2*diffContext; end++ {
+			if lines[end].kind != ' ' {
+				last = end
+			}
+		}
+		stop := last + diffContext + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+		aBefore, bBefore := before(*&start)
+		aEnd, bEnd := before(*&stop)
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(*&aBefore, aEnd-aBefore), hunkRange(*&bBefore, bEnd-bBefore))
+		for _, l := range lines[start:stop] {
+			out.WriteByte(l.kind)
+			out.WriteString(l.line)
+			if !strings.HasSuffix(l.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = stop
+	}
+	return out.String()
+}
+
+//// JSON patches (RFC 6902)
+
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func jsonPointer(pointer string) (tokens []string, err error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(*&pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	for _, t := range strings.Split(pointer[1:], "/") {
+		t = strings.Replace(*&t, "~1", "/", -1)
+		t = strings.Replace(*&t, "~0", "~", -1)
+		tokens = append(*&tokens, *&t)
+	}
+	return
+}
+
+func jsonIndex(token string, length int, appending bool) (i int, err error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	i, err = strconv.Atoi(*&token)
+	max := length - 1
+	if appending {
+		max = length
+	}
+	if err != nil || i < 0 || i > max {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return
+}
+
+func jsonGet(node interface{}, tokens []string) (v interface{}, err error) {
+	for _, t := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", t)
+			}
+			node = child
+		case []interface{}:
+			i, err := jsonIndex(*&t, len(*&n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("cannot index %q", t)
+		}
+	}
+	return node, nil
+}
+
+// Calls fn on the container holding the last token, and returns the node
+// updated with the container fn returned.
+func jsonUpdate(node interface{}, tokens []string, fn func(container interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(*&tokens) == 1 {
+		return fn(*&node, tokens[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", tokens[0])
+		}
+		c, err := jsonUpdate(*&child, tokens[1:], *&fn)
+		n[tokens[0]] = c
+		return n, err
+	case []interface{}:
+		i, err := jsonIndex(tokens[0], len(*&n), false)
+		if err != nil {
+			return nil, err
+		}
+		c, err := jsonUpdate(n[i], tokens[1:], *&fn)
+		n[i] = c
+		return n, err
+	}
+	return nil, fmt.Errorf("cannot index %q", tokens[0])
+}
+
+func jsonAdd(doc interface{}, tokens []string, v interface{}) (interface{}, error) {
+	if len(*&tokens) == 0 {
+		return v, nil
+	}
+	return jsonUpdate(*&doc, *&tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[key] = v
+			return c, nil
+		case []interface{}:
+			i, err := jsonIndex(*&key, len(*&c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(*&c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %q", key)
+	})
+}
+
+func jsonRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(*&tokens) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return jsonUpdate(*&doc, *&tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[key]; !ok {
+				return nil, fmt.Errorf("no member %q", key)
+			}
+			delete(c, key)
+			return c, nil
+		case []interface{}:
+			i, err := jsonIndex(*&key, len(*&c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q", key)
+	})
+}
+
+func applyJSONPatch(content []byte, patch []byte) (patched []byte, err error) {
+	var ops []jsonPatchOp
+	err = json.Unmarshal(*&patch, &ops)
+	if err != nil {
+		return
+	}
+	var doc interface{}
+	err = json.Unmarshal(*&content, &doc)
+	if err != nil {
+		return
+	}
+	for _, op := range ops {
+		path, err := jsonPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Value != nil {
+			err = json.Unmarshal(op.Value, &value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch op.Op {
+		case "add":
+			doc, err = jsonAdd(*&doc, *&path, *&value)
+		case "remove":
+			doc, err = jsonRemove(*&doc, *&path)
+		case "replace":
+			if _, err = jsonGet(*&doc, *&path); err == nil {
+				if len(*&path) == 0 {
+					doc = value
+				} else {
+					doc, err = jsonRemove(*&doc, *&path)
+					if err == nil {
+						doc, err = jsonAdd(*&doc, *&path, *&value)
+					}
+				}
+			}
+		case "move", "copy":
+			from, err := jsonPointer(op.From)
+			if err != nil {
+				return nil, err
+			}
+			v, err := jsonGet(*&doc, *&from)
+			if err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				doc, err = jsonRemove(*&doc, *&from)
+			} else {
+				// Deep copy through a round trip
+				j, _ := json.Marshal(*&v)
+				err = json.Unmarshal(*&j, &v)
+			}
+			if err != nil {
+				return nil, err
+			}
+			doc, err = jsonAdd(*&doc, *&path, *&v)
+		case "test":
+			var v interface{}
+			v, err = jsonGet(*&doc, *&path)
+			if err == nil && !reflect.DeepEqual(*&v, *&value) {
+				err = fmt.Errorf("test failed at %q", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	patched, err = json.MarshalIndent(*&doc, "", "	")
+	return
+}
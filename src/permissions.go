@@ -0,0 +1,166 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//////// PERMISSION REPAIR
+
+// Gives every file and directory of a tree the modes set by -file-mode and
+// -dir-mode, fixing the permissions left by copies from other systems such
+// as NTFS drives. Directories are fixed before being listed, so that they
+// can be entered, and symbolic links are left alone. Trees of more than
+// bigRepairEntries entries are repaired by a background job.
+
+const bigRepairEntries = 1000
+
+type permissionReport struct {
+	Uri         string `json:"uri"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+	Changed     int    `json:"changed"`
+}
+
+func parseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(*&s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("invalid mode " + s + ", expected octal permissions such as 0644")
+	}
+	return os.FileMode(*&m), nil
+}
+
+func permissionModes() (file os.FileMode, dir os.FileMode, err error) {
+	file, err = parseMode(*&fileModeFlag)
+	if err != nil {
+		return
+	}
+	dir, err = parseMode(*&dirModeFlag)
+	return
+}
+
+// Applies the modes to a tree, reporting the progress among total entries
+// when known.
+func repairPermissions(ctx context.Context, j *job, root string, total int) (report permissionReport, err error) {
+	report.Uri = pathToUri(*&root)
+	fileMode, dirMode, err := permissionModes()
+	if err != nil {
+		return
+	}
+	var repair func(p string, info os.FileInfo) error
+	repair = func(p string, info os.FileInfo) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := fileMode
+		if info.IsDir() {
+			mode = dirMode
+			report.Directories++
+		} else {
+			report.Files++
+		}
+		if info.Mode().Perm() != mode {
+			if err := fsys.chmod(*&p, *&mode); err != nil {
+				return err
+			}
+			report.Changed++
+		}
+		if done := report.Files + report.Directories; j != nil && total > 0 && done%100 == 0 {
+			j.setProgress(float64(*&done) / float64(*&total))
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		entries, err := fsys.readDir(*&p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := repair(filepath.Join(*&p, e.Name()), *&e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	info, err := fsys.stat(*&root)
+	if err != nil {
+		return
+	}
+	err = repair(*&root, *&info)
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Permissions API
+
+// Repair the permissions of a file or directory tree
+func permissionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[permissionsPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	n, err := countEntries(r.Context(), *&p, bigRepairEntries)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n <= bigRepairEntries {
+		report, err := repairPermissions(r.Context(), nil, *&p, 0)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&report)
+		return
+	}
+	j := startJob(*&r, "permissions", pathToUri(*&p), func(ctx context.Context, j *job) (string, error) {
+		j.setState(jobRunning)
+		total, err := countEntries(*&ctx, *&p, 0)
+		if err != nil {
+			return "", err
+		}
+		report, err := repairPermissions(*&ctx, *&j, *&p, *&total)
+		return report.Uri, err
+	})
+	w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+	writeJSON(w, http.StatusAccepted, *&j)
+}
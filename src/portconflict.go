@@ -0,0 +1,220 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//////// PORT CONFLICTS
+
+// When its port is taken, the cloud finds out whether another instance
+// holds it, which it may leave in charge, or else moves on to a free port
+// if asked to, and otherwise tells which process is in the way.
+
+// Ports tried after the requested one
+const portSearchRange = 20
+
+var errInstanceRunning = errors.New("another instance is already serving")
+
+func isAddrInUse(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(*&err, &errno) {
+		return false
+	}
+	// WSAEADDRINUSE on Windows
+	return errno == syscall.EADDRINUSE || runtime.GOOS == "windows" && errno == 10048
+}
+
+// Status of the cloud listening at an address, if it is one.
+func probeInstance(addr string) (status map[string]interface{}, ok bool) {
+	req, err := http.NewRequest("GET", "http://"+addr+basePathFlag+statusPath, nil)
+	if err != nil {
+		return
+	}
+	if t := ownerToken(); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(*&req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err == nil && status["name"] == APP_NAME
+}
+
+func listenTCP(host string, port string) (l net.Listener, err error) {
+	l, err = net.Listen("tcp", net.JoinHostPort(*&host, *&port))
+	if err == nil || !isAddrInUse(*&err) {
+		return
+	}
+	local := host
+	if ip := net.ParseIP(*&host); host == "" || ip != nil && ip.IsUnspecified() {
+		local = "localhost"
+	}
+	status, instance := probeInstance(net.JoinHostPort(*&local, *&port))
+	switch portConflictFlag {
+	case "fail":
+	case "reuse":
+		if instance {
+			logInfo("Leaving the", APP_NAME, status["version"], "instance already on port", port, "in charge")
+			announceUrls("http://" + net.JoinHostPort(*&local, *&port) + basePathFlag)
+			return nil, errInstanceRunning
+		}
+	case "next":
+		n, err := strconv.Atoi(*&port)
+		if err != nil {
+			return nil, err
+		}
+		for p := n + 1; p <= n+portSearchRange; p++ {
+			l, err = net.Listen("tcp", net.JoinHostPort(*&host, strconv.Itoa(*&p)))
+			if err == nil {
+				logWarn("Port", port, "is taken, listening on", p, "instead")
+				return l, nil
+			}
+			if !isAddrInUse(*&err) {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("unknown port conflict policy: " + portConflictFlag)
+	}
+	if instance {
+		return nil, fmt.Errorf("port %s is used by another instance of %s %v, reach it at http://%s%s, stop it, or choose another port with -p or -on-port-conflict next",
+			port, APP_NAME, status["version"], net.JoinHostPort(*&local, *&port), basePathFlag)
+	}
+	holder := portHolder(*&port)
+	if holder == "" {
+		holder = "another program"
+	}
+	return nil, fmt.Errorf("port %s is used by %s, stop it or choose another port with -p or -on-port-conflict next", port, holder)
+}
+
+//// Port holders
+
+// Describes the process listening on a TCP port, as far as the system
+// tells, or returns an empty string.
+func portHolder(port string) string {
+	switch runtime.GOOS {
+	case "linux":
+		return procPortHolder(*&port)
+	case "windows":
+		return netstatPortHolder(*&port)
+	}
+	return lsofPortHolder(*&port)
+}
+
+func describeProcess(pid string, name string) string {
+	if name == "" {
+		return "process " + pid
+	}
+	return name + " (process " + pid + ")"
+}
+
+// Finds the inode of the listening socket in the tables of the kernel,
+// then the process with a descriptor on it.
+func procPortHolder(port string) string {
+	n, err := strconv.Atoi(*&port)
+	if err != nil {
+		return ""
+	}
+	suffix := fmt.Sprintf(":%04X", n)
+	inode := ""
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		content, err := ioutil.ReadFile(*&table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(*&content), "\n") {
+			fields := strings.Fields(*&line)
+			// Sockets in the LISTEN state
+			if len(fields) > 9 && strings.HasSuffix(fields[1], *&suffix) && fields[3] == "0A" {
+				inode = fields[9]
+			}
+		}
+	}
+	if inode == "" {
+		return ""
+	}
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		if link, err := os.Readlink(*&fd); err == nil && link == target {
+			pid := strings.Split(*&fd, "/")[2]
+			name, _ := ioutil.ReadFile("/proc/" + pid + "/comm")
+			return describeProcess(*&pid, strings.TrimSpace(string(*&name)))
+		}
+	}
+	return "a process of another user"
+}
+
+func lsofPortHolder(port string) string {
+	out, err := runTool("lsof", "-nP", "-iTCP:"+port, "-sTCP:LISTEN", "-Fpc")
+	if err != nil {
+		return ""
+	}
+	var pid, name string
+	for _, line := range strings.Split(*&out, "\n") {
+		switch {
+		case strings.HasPrefix(*&line, "p") && pid == "":
+			pid = line[1:]
+		case strings.HasPrefix(*&line, "c") && name == "":
+			name = line[1:]
+		}
+	}
+	if pid == "" {
+		return ""
+	}
+	return describeProcess(*&pid, *&name)
+}
+
+func netstatPortHolder(port string) string {
+	out, err := runTool("netstat", "-ano", "-p", "TCP")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(*&out, "\n") {
+		fields := strings.Fields(*&line)
+		if len(fields) == 5 && strings.HasSuffix(fields[1], ":"+port) && fields[3] == "LISTENING" {
+			pid := fields[4]
+			name, _ := runTool("tasklist", "/FI", "PID eq "+pid, "/FO", "CSV", "/NH")
+			name = strings.Trim(strings.Split(*&name, ",")[0], "\"")
+			if !strings.HasSuffix(strings.ToLower(*&name), ".exe") {
+				name = ""
+			}
+			return describeProcess(*&pid, *&name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+//////// COPY AND MOVE PREFLIGHT
+
+// Copies and moves asked to be validated only are checked without being
+// run, so that editors can warn before a long operation fails midway: the
+// source must exist, the destination be free unless overwritten or merged
+// into, its directory writable, and the disk have room for what is copied.
+// Moves are renames needing no room.
+
+type preflightReport struct {
+	Ok          bool   `json:"ok"`
+	Operation   string `json:"operation"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Files       int    `json:"files"`
+	Bytes       int64  `json:"bytes"`
+	// Space left on the disk, -1 if unknown
+	Free     int64              `json:"free"`
+	Problems []preflightProblem `json:"problems"`
+}
+
+type preflightProblem struct {
+	Code string `json:"code"`
+	Uri  string `json:"uri"`
+}
+
+func (report *preflightReport) problem(code string, p string) {
+	report.Problems = append(report.Problems, preflightProblem{code, pathToUri(*&p)})
+}
+
+// Whether files can be created in a directory, as far as its mode tells.
+func writableDir(p string) bool {
+	info, err := fsys.stat(*&p)
+	return err == nil && info.IsDir() && info.Mode().Perm()&0200 != 0
+}
+
+// Checks a copy or move, either of a file or a directory, the destination
+// being allowed to exist when it is overwritten or merged into.
+func preflight(ctx context.Context, user string, operation string, source string, dest string, replacing bool) (report preflightReport) {
+	report = preflightReport{
+		Operation:   operation,
+		Source:      pathToUri(*&source),
+		Destination: pathToUri(*&dest),
+		Free:        -1,
+		Problems:    []preflightProblem{},
+	}
+	info, err := fsys.stat(*&source)
+	if err != nil {
+		report.problem("source-missing", *&source)
+		return
+	}
+	if info.IsDir() && isUnderPrefix(filepath.ToSlash(*&dest), filepath.ToSlash(*&source)) {
+		report.problem("destination-inside-source", *&dest)
+	}
+	if !replacing && exist(*&dest) {
+		report.problem("destination-exists", *&dest)
+	}
+	if parent := filepath.Dir(*&dest); !exist(*&parent) {
+		report.problem("destination-parent-missing", *&parent)
+	} else if !writableDir(*&parent) {
+		report.problem("destination-read-only", *&parent)
+	}
+	if operation == "move" && !writableDir(filepath.Dir(*&source)) {
+		report.problem("source-read-only", filepath.Dir(*&source))
+	}
+	// Moves within a project are renames, which locked projects allow
+	if operation != "move" || encryptionProject(*&source) != encryptionProject(*&dest) {
+		for _, p := range []string{source, dest} {
+			if projectLocked(*&p) {
+				report.problem("project-locked", *&p)
+			}
+		}
+	}
+	if !info.IsDir() {
+		if refusal := refuseUpload(*&dest, "", nil); refusal != nil {
+			report.problem("type-not-allowed", *&dest)
+		}
+	}
+	err = walk(*&source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.problem("source-unreadable", *&p)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if rel, err := filepath.Rel(*&source, *&p); err == nil {
+			target := filepath.Join(*&dest, *&rel)
+			if _, tooLong := pathTooLong(*&target); tooLong {
+				report.problem("path-too-long", *&target)
+			}
+		}
+		if !info.IsDir() {
+			report.Files++
+			report.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if backendFlag == "disk" {
+		if free, err := diskFree("."); err == nil {
+			report.Free = free
+			if operation != "move" && report.Bytes > free {
+				report.problem("insufficient-space", *&dest)
+			}
+		}
+	}
+	if dir, ok := tenantDir(*&user); ok && operation != "move" && isUnderPrefix(filepath.ToSlash(*&dest), filepath.ToSlash(*&dir)) {
+		if quota := tenantQuota(*&user); quota > 0 {
+			used, err := tenantUsed(*&user, *&dir)
+			if err == nil && used+report.Bytes > quota {
+				report.problem("quota-exceeded", *&dest)
+			}
+		}
+	}
+	report.Ok = len(report.Problems) == 0
+	return
+}
@@ -0,0 +1,167 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//////// PRESENCE
+
+// Clients missing heartbeats for this long are considered gone.
+const presenceTimeout = 60 * time.Second
+
+type presenceClient struct {
+	user  string
+	conn  *wsConn
+	files map[string]bool
+}
+
+type presenceMessage struct {
+	Type  string              `json:"type"`
+	Uri   string              `json:"uri,omitempty"`
+	Files map[string][]string `json:"files"`
+}
+
+var presenceMutex sync.Mutex
+var presenceClients = make(map[*presenceClient]bool)
+
+// Returns who has which file open.
+func presenceSnapshot() map[string][]string {
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	files := make(map[string][]string)
+	for c := range presenceClients {
+		for uri := range c.files {
+			if !sliceContains(files[uri], c.user) {
+				files[uri] = append(files[uri], c.user)
+			}
+		}
+	}
+	for _, users := range files {
+		sort.Strings(*&users)
+	}
+	return files
+}
+
+func presenceBroadcast() {
+	j, err := json.Marshal(presenceMessage{Type: "presence", Files: presenceSnapshot()})
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	presenceMutex.Lock()
+	clients := make([]*presenceClient, 0, len(presenceClients))
+	for c := range presenceClients {
+		clients = append(*&clients, *&c)
+	}
+	presenceMutex.Unlock()
+	for _, c := range clients {
+		err := c.conn.writeMessage(wsText, *&j)
+		if err != nil {
+			c.conn.close()
+		}
+	}
+}
+
+func presenceSession(c *presenceClient) {
+	defer func() {
+		presenceMutex.Lock()
+		delete(presenceClients, *&c)
+		presenceMutex.Unlock()
+		c.conn.close()
+		presenceBroadcast()
+	}()
+	presenceMutex.Lock()
+	presenceClients[c] = true
+	presenceMutex.Unlock()
+	presenceBroadcast()
+
+	for {
+		c.conn.setReadTimeout(presenceTimeout)
+		opcode, message, err := c.conn.readMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsText {
+			continue
+		}
+		var m presenceMessage
+		if json.Unmarshal(*&message, &m) != nil {
+			continue
+		}
+		switch m.Type {
+		case "open":
+			presenceMutex.Lock()
+			c.files[m.Uri] = true
+			presenceMutex.Unlock()
+			presenceBroadcast()
+		case "close":
+			presenceMutex.Lock()
+			delete(c.files, m.Uri)
+			presenceMutex.Unlock()
+			presenceBroadcast()
+		case "heartbeat":
+			// Only resets the read timeout
+		}
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Presence API
+
+// Join the presence channel (WebSocket), or look up who has files open
+func presenceHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Header.Get("Upgrade") == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		files := presenceSnapshot()
+		if uri := r.URL.Query().Get("uri"); uri != "" {
+			users := files[uri]
+			if users == nil {
+				users = []string{}
+			}
+			writeJSON(w, http.StatusOK, *&users)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&files)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	go presenceSession(&presenceClient{user, conn, make(map[string]bool)})
+}
@@ -0,0 +1,132 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////// PREVIEWS
+
+// Converters turning files the browser cannot display as they are into
+// something it can, looked up by extension.
+
+type previewConverter struct {
+	contentType string
+	convert     func(ctx context.Context, content []byte) ([]byte, error)
+}
+
+var errPreviewUnavailable = errors.New("preview converter unavailable")
+
+var previewConverters = map[string]previewConverter{
+	".md":       {"text/html; charset=utf-8", previewMarkdown},
+	".markdown": {"text/html; charset=utf-8", previewMarkdown},
+	".svg":      {"image/png", previewSVG},
+	".tif":      {"image/png", previewTIFF},
+	".tiff":     {"image/png", previewTIFF},
+}
+
+func previewMarkdown(ctx context.Context, content []byte) (out []byte, err error) {
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n</head>\n<body>\n")
+	b.Write(markdownToHTML(*&content))
+	b.WriteString("</body>\n</html>\n")
+	out = b.Bytes()
+	return
+}
+
+// Rasterized by headless Chrome, from a temporary copy so that it works
+// whatever the storage backend.
+func previewSVG(ctx context.Context, content []byte) (out []byte, err error) {
+	chrome, ok := findChrome()
+	if !ok {
+		return nil, errPreviewUnavailable
+	}
+	tmp, err := ioutil.TempDir("", "ninja-preview")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(*&tmp)
+	p := filepath.Join(*&tmp, "preview.svg")
+	err = ioutil.WriteFile(*&p, *&content, 0644)
+	if err != nil {
+		return
+	}
+	pageUrl := url.URL{Scheme: "file", Path: filepath.ToSlash(*&p)}
+	return renderPage(*&ctx, *&chrome, pageUrl.String(), defaultRenderWidth, defaultRenderWidth*3/4)
+}
+
+func previewTIFF(ctx context.Context, content []byte) (out []byte, err error) {
+	img, err := decodeTIFF(bytes.NewReader(*&content))
+	if err != nil {
+		return
+	}
+	var b bytes.Buffer
+	err = png.Encode(&b, *&img)
+	out = b.Bytes()
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Files API
+
+// Convert a file for display, or refuse if no converter handles its type
+func servePreview(w http.ResponseWriter, r *http.Request, p string) {
+	converter, ok := previewConverters[strings.ToLower(filepath.Ext(*&p))]
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	content, err := readFile(*&p)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	out, err := converter.convert(r.Context(), *&content)
+	if err == errPreviewUnavailable {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == errUnsupportedTIFF {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", converter.contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(*&out)
+}
@@ -0,0 +1,129 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//////// IO PRIORITIES
+
+// Heavy operations such as copies, publishing or the watcher's scans can
+// run with a lower priority, bounding how many of them touch the disk at
+// once and pausing between batches of files, so that the editor stays
+// responsive on slow disks.
+
+const priorityContextKey = contextKey("priority")
+
+var errPriority = errors.New("unknown priority, expected high, normal or low")
+
+type ioPriority struct {
+	// Operations of this priority running at once, unbounded if nil
+	slots chan struct{}
+	// Pause taken after each batch of files
+	batch int64
+	pause time.Duration
+}
+
+var ioPriorities = map[string]*ioPriority{
+	"high":   {nil, 0, 0},
+	"normal": {make(chan struct{}, 4), 256, 10 * time.Millisecond},
+	"low":    {make(chan struct{}, 1), 32, 100 * time.Millisecond},
+}
+
+// Context of the work done in the background by the cloud itself.
+var backgroundContext = context.Background()
+
+type ioJob struct {
+	priority *ioPriority
+	files    int64
+}
+
+func withPriority(ctx context.Context, name string) (context.Context, error) {
+	p, ok := ioPriorities[name]
+	if !ok {
+		return ctx, errPriority
+	}
+	return context.WithValue(*&ctx, priorityContextKey, &ioJob{priority: p}), nil
+}
+
+// Waits for a slot of the priority of the context.
+func acquireIO(ctx context.Context) (release func(), err error) {
+	job, ok := ctx.Value(priorityContextKey).(*ioJob)
+	if !ok || job.priority.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case job.priority.slots <- struct{}{}:
+		return func() { <-job.priority.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Called for each file processed by a long operation, pausing between
+// batches according to its priority. Also fails once the context is done.
+func ioPause(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	job, ok := ctx.Value(priorityContextKey).(*ioJob)
+	if !ok || job.priority.batch == 0 || atomic.AddInt64(&job.files, 1)%job.priority.batch != 0 {
+		return nil
+	}
+	timer := time.NewTimer(job.priority.pause)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//////// MIDDLEWARES
+
+// Runs requests with the priority given by their priority header.
+func priorityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get("priority")
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, err := withPriority(r.Context(), *&name)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		release, err := acquireIO(*&ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r.WithContext(*&ctx))
+	})
+}
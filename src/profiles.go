@@ -0,0 +1,139 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+)
+
+//////// PROFILES
+
+// Named configurations in the configuration file, selected with -profile,
+// for those running the cloud in several environments:
+//
+//	"profiles": {
+//		"work": {"flags": {"root": "/srv/work", "port": "8080"}, "auth": ["token"]},
+//		"demo": {"flags": {"root": "/tmp/demo", "read-only": "true"}}
+//	}
+//
+// The flags of a profile give values to those neither on the command line
+// nor in the environment. The other fields replace those of the file, maps
+// being merged.
+
+type configProfile struct {
+	Flags map[string]string `json:"flags"`
+}
+
+// Flags a profile cannot set.
+var profileReservedFlags = []string{"config", "profile"}
+
+func profileNames(profiles map[string]json.RawMessage) (names []string) {
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Reads the profile of the given name from the configuration file.
+func readProfile(p string, name string) (raw json.RawMessage, err error) {
+	f, err := os.Open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var c struct {
+		Profiles map[string]json.RawMessage `json:"profiles"`
+	}
+	err = json.NewDecoder(*&f).Decode(&c)
+	if err != nil {
+		return
+	}
+	raw, ok := c.Profiles[name]
+	if !ok {
+		names := profileNames(c.Profiles)
+		if len(names) == 0 {
+			return nil, errors.New("no profiles in " + p)
+		}
+		return nil, errors.New("unknown profile " + name + ", " + p + " has " + strings.Join(names, ", "))
+	}
+	return
+}
+
+// Looks up a flag by its name, long names of short flags included.
+func lookupFlag(name string) *flag.Flag {
+	for short, long := range envFlagNames {
+		if long == name {
+			name = short
+		}
+	}
+	return flag.Lookup(*&name)
+}
+
+// Gives the flags of the selected profile their values, before the
+// configuration is loaded.
+func applyProfile() (err error) {
+	if profileFlag == "" {
+		return
+	}
+	if configFlag == "" {
+		return errors.New("-profile needs a configuration file given with -config")
+	}
+	raw, err := readProfile(configFlag, profileFlag)
+	if err != nil {
+		return
+	}
+	var profile configProfile
+	err = json.Unmarshal(*&raw, &profile)
+	if err != nil {
+		return errors.New("invalid profile " + profileFlag + ": " + err.Error())
+	}
+	for name, value := range profile.Flags {
+		f := lookupFlag(*&name)
+		if f == nil || sliceContains(profileReservedFlags, f.Name) {
+			return errors.New("profile " + profileFlag + " sets an unknown flag: " + name)
+		}
+		if flagSet(f.Name) {
+			continue
+		}
+		err = f.Value.Set(*&value)
+		if err != nil {
+			return errors.New("profile " + profileFlag + " gives an invalid value to " + name + ": " + err.Error())
+		}
+	}
+	return
+}
+
+// Lays the fields of the selected profile over the loaded configuration.
+func overlayProfile(p string) (err error) {
+	if profileFlag == "" {
+		return
+	}
+	raw, err := readProfile(*&p, profileFlag)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(*&raw, &cloudConfig)
+}
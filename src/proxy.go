@@ -0,0 +1,129 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+//////// REVERSE PROXIES
+
+// Behind a reverse proxy, the cloud may be mounted under a base path, and
+// learns about the client from the X-Forwarded headers. Those are only
+// believed when the connection comes from the proxy, expected on the same
+// machine: over loopback or a Unix socket.
+
+func normalizeBasePath(p string) string {
+	p = strings.TrimRight(*&p, "/")
+	if p != "" && !strings.HasPrefix(*&p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	if isUnixRequest(*&r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(*&host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Address of the client, the last one the proxies added which is not
+// itself a local proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(*&r) {
+		if r.Header.Get("X-Forwarded-For") != "" {
+			logDebug("proxy", "ignoring X-Forwarded-For from untrusted peer", *&host)
+		}
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !ip.IsLoopback() {
+			break
+		}
+	}
+	logTrace("proxy", "client of", r.RemoteAddr, "is", *&host)
+	return host
+}
+
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && fromTrustedProxy(*&r) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(*&proto, ",")[0]))
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func requestHost(r *http.Request) string {
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" && fromTrustedProxy(*&r) {
+		return strings.TrimSpace(strings.Split(*&host, ",")[0])
+	}
+	return r.Host
+}
+
+// Absolute URL of a route of the cloud, as seen by the client.
+func externalUrl(r *http.Request, route string) string {
+	u := requestScheme(*&r) + "://" + requestHost(*&r) + basePathFlag + route
+	logTrace("proxy", "external URL", *&u)
+	return u
+}
+
+//////// MIDDLEWARES
+
+// Serves the routes under the base path only, as if they were at the root.
+func basePathMiddleware(next http.Handler) http.Handler {
+	if basePathFlag == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != basePathFlag && !strings.HasPrefix(r.URL.Path, basePathFlag+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.WithContext(r.Context())
+		u := *r.URL
+		u.Path = strings.TrimPrefix(r.URL.Path, basePathFlag)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		r2.URL = &u
+		next.ServeHTTP(w, *&r2)
+	})
+}
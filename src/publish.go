@@ -0,0 +1,198 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//////// PUBLISHING
+
+// Published output is written into this directory inside the project.
+const publishDir = "dist"
+
+type publishOptions struct {
+	Images optimizeOptions
+}
+
+type publishStep struct {
+	name string
+	run  func(ctx context.Context, dir string, opts publishOptions) (reports []assetReport, err error)
+}
+
+// Steps run in this order over the published copy of a project.
+var publishSteps = []publishStep{
+	{"sanitize-svg", func(ctx context.Context, dir string, opts publishOptions) ([]assetReport, error) {
+		return sanitizeSVGTree(*&ctx, *&dir)
+	}},
+	{"optimize-images", func(ctx context.Context, dir string, opts publishOptions) ([]assetReport, error) {
+		return optimizeImages(*&ctx, *&dir, opts.Images)
+	}},
+	{"minify", func(ctx context.Context, dir string, opts publishOptions) ([]assetReport, error) {
+		return minifyTree(*&ctx, *&dir, true)
+	}},
+}
+
+type publishReport struct {
+	Destination string         `json:"destination"`
+	Assets      []assetReport  `json:"assets"`
+	Saved       int            `json:"saved"`
+	Pushed      *gitPushReport `json:"pushed,omitempty"`
+}
+
+func isPublishExcluded(name string) bool {
+	return name == publishDir || strings.HasPrefix(*&name, hiddenPrefix)
+}
+
+// Copies a project into its publish directory, leaving out previous
+// publications and the cloud's own hidden directories.
+func copyForPublish(ctx context.Context, source string, dest string) (err error) {
+	err = removeDir(*&dest)
+	if err != nil {
+		return
+	}
+	return walk(*&source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*&source, *&p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isPublishExcluded(strings.Split(filepath.ToSlash(*&rel), "/")[0]) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(*&dest, *&rel)
+		if info.IsDir() {
+			return fsys.mkdirAll(*&target, info.Mode())
+		}
+		return copyFile(*&ctx, *&p, *&target)
+	})
+}
+
+func publish(ctx context.Context, project string, steps []string, opts publishOptions) (report publishReport, err error) {
+	dest := filepath.Join(*&project, publishDir)
+	report.Destination = pathToUri(*&dest)
+	i, err := beginIntent(intentPublish, *&project, *&dest, "", "")
+	if err != nil {
+		return
+	}
+	defer i.end()
+	err = copyForPublish(*&ctx, *&project, *&dest)
+	if err != nil {
+		return
+	}
+	for _, step := range publishSteps {
+		if len(*&steps) > 0 && !sliceContains(*&steps, step.name) {
+			continue
+		}
+		reports, err := step.run(*&ctx, *&dest, *&opts)
+		if err != nil {
+			return report, err
+		}
+		for _, a := range reports {
+			report.Saved += a.Saved
+		}
+		report.Assets = append(report.Assets, reports...)
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Publish API
+
+// Publish a project into its dist directory through the publish pipeline
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[publishPathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !exist(*&p) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var steps []string
+	if h := r.Header.Get("publish-steps"); h != "" {
+		steps = strings.Split(*&h, ",")
+	}
+	// Also pushed to a Git remote with the git target
+	var git string
+	var target gitPublishTarget
+	switch r.Header.Get("publish-target") {
+	case "", "dist":
+	case "git":
+		git, ok = findGit()
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		var err error
+		target, err = loadGitPublishTarget(*&p)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var opts publishOptions
+	opts.Images = optimizeOptionsFromRequest(r)
+	snapshotBefore("publish")
+	started := time.Now()
+	report, err := publish(r.Context(), *&p, *&steps, *&opts)
+	if err != nil {
+		notifyCompletion("publish", pathToUri(*&p), *&started, *&err)
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if git != "" {
+		pushed, err := pushToGit(r.Context(), *&git, filepath.Join(*&p, publishDir), *&target, publishMessage(*&p))
+		if err != nil {
+			notifyCompletion("publish", pathToUri(*&p), *&started, *&err)
+			log.Println(*&err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		report.Pushed = &pushed
+	}
+	notifyCompletion("publish", pathToUri(*&p), *&started, nil)
+	writeJSON(w, http.StatusOK, *&report)
+}
@@ -0,0 +1,185 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//////// GIT PUBLISHING
+
+// Publication target committing the published output to a branch of a Git
+// remote, such as the gh-pages branch GitHub Pages serves. The remote and
+// branch are read from the "publishGit" entry of the project settings.
+
+const defaultPublishBranch = "gh-pages"
+
+type gitPublishTarget struct {
+	Remote string `json:"remote"`
+	Branch string `json:"branch"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+}
+
+type gitPushReport struct {
+	Remote    string `json:"remote"`
+	Branch    string `json:"branch"`
+	Commit    string `json:"commit,omitempty"`
+	Unchanged bool   `json:"unchanged"`
+}
+
+var errNoPublishTarget = errors.New("no valid publishGit entry in the project settings")
+
+func loadGitPublishTarget(project string) (t gitPublishTarget, err error) {
+	settings, err := readSettings(*&project)
+	if err != nil {
+		return
+	}
+	var s struct {
+		PublishGit *gitPublishTarget `json:"publishGit"`
+	}
+	err = json.Unmarshal(*&settings, &s)
+	if err != nil || s.PublishGit == nil || !validGitUrl(s.PublishGit.Remote) || strings.HasPrefix(s.PublishGit.Branch, "-") {
+		return t, errNoPublishTarget
+	}
+	t = *s.PublishGit
+	if t.Branch == "" {
+		t.Branch = defaultPublishBranch
+	}
+	if t.Name == "" {
+		t.Name = APP_NAME
+	}
+	if t.Email == "" {
+		t.Email = "ninja@localhost"
+	}
+	return
+}
+
+// Remote without the credentials it may embed, for reports and logs.
+func redactRemote(remote string) string {
+	u, err := url.Parse(*&remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+	u.User = nil
+	return u.String()
+}
+
+func runGit(ctx context.Context, git string, dir string, args ...string) (out string, err error) {
+	o, err := gitCommand(*&ctx, *&git, *&dir, args...).CombinedOutput()
+	out = strings.TrimSpace(string(*&o))
+	if err != nil {
+		err = fmt.Errorf("git %s: %v: %s", args[0], err, out)
+	}
+	return
+}
+
+// Commits the content of a directory on top of the branch of the remote,
+// its previous files being replaced, and pushes it. Nothing is pushed when
+// the content didn't change.
+func pushToGit(ctx context.Context, git string, dir string, t gitPublishTarget, message string) (report gitPushReport, err error) {
+	report = gitPushReport{Remote: redactRemote(t.Remote), Branch: t.Branch}
+	tmp, err := ioutil.TempDir("", "ninja-publish")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(*&tmp)
+	err = walk(*&dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*&dir, *&p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(*&tmp, *&rel)
+		if info.IsDir() {
+			return os.MkdirAll(*&target, 0777)
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(*&target, *&content, 0666)
+	})
+	if err != nil {
+		return
+	}
+	// Served as is by GitHub Pages, without Jekyll ignoring some files
+	err = ioutil.WriteFile(filepath.Join(*&tmp, ".nojekyll"), nil, 0666)
+	if err != nil {
+		return
+	}
+
+	steps := [][]string{
+		{"init", "-q"},
+		{"symbolic-ref", "HEAD", "refs/heads/" + t.Branch},
+	}
+	for _, args := range steps {
+		_, err = runGit(*&ctx, *&git, *&tmp, args...)
+		if err != nil {
+			return
+		}
+	}
+	// Builds on the published history when the branch already exists
+	_, ferr := runGit(*&ctx, *&git, *&tmp, "fetch", "-q", "--depth", "1", "--", t.Remote, "refs/heads/"+t.Branch)
+	if ferr == nil {
+		_, err = runGit(*&ctx, *&git, *&tmp, "reset", "-q", "FETCH_HEAD")
+		if err != nil {
+			return
+		}
+	}
+	_, err = runGit(*&ctx, *&git, *&tmp, "add", "-A")
+	if err != nil {
+		return
+	}
+	if ferr == nil {
+		if _, derr := runGit(*&ctx, *&git, *&tmp, "diff", "--cached", "--quiet"); derr == nil {
+			report.Unchanged = true
+			return
+		}
+	}
+	_, err = runGit(*&ctx, *&git, *&tmp, "-c", "user.name="+t.Name, "-c", "user.email="+t.Email, "commit", "-q", "-m", *&message)
+	if err != nil {
+		return
+	}
+	report.Commit, err = runGit(*&ctx, *&git, *&tmp, "rev-parse", "HEAD")
+	if err != nil {
+		return
+	}
+	_, err = runGit(*&ctx, *&git, *&tmp, "push", "-q", "--", t.Remote, "HEAD:refs/heads/"+t.Branch)
+	if err != nil {
+		err = errors.New(strings.Replace(err.Error(), t.Remote, report.Remote, -1))
+	}
+	return
+}
+
+func publishMessage(project string) string {
+	return "Publish " + filepath.Base(*&project) + " on " + time.Now().Format(time.RFC1123)
+}
@@ -0,0 +1,482 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+//////// QR CODES
+
+// Small QR code encoder, enough for the URLs shown to phones: byte mode at
+// the medium error correction level, up to version 10 (213 bytes).
+
+var errQRTooLong = errors.New("too much data for a QR code")
+
+type qrVersion struct {
+	// Error correction codewords of each block
+	ecLength int
+	// Data codewords of each block
+	blocks []int
+	// Centers of the alignment patterns, on both axes
+	alignments []int
+}
+
+// Medium error correction level, by version from 1
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	reserved [][]bool
+}
+
+func (v qrVersion) dataLength() (n int) {
+	for _, b := range v.blocks {
+		n += b
+	}
+	return
+}
+
+// Encodes data in the smallest version holding it.
+func encodeQR(data []byte) (q *qrCode, err error) {
+	for i, v := range qrVersions {
+		version := i + 1
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(*&data) > 8*v.dataLength() {
+			continue
+		}
+		codewords := qrCodewords(*&data, *&v, *&countBits)
+		q = newQRCode(*&version, *&v)
+		q.placeData(*&codewords)
+		q.applyBestMask(*&version)
+		return
+	}
+	return nil, errQRTooLong
+}
+
+//// Codewords
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, value>>uint(i)&1 == 1)
+	}
+}
+
+// Data in byte mode, padded, split into blocks followed by their error
+// correction, interleaved.
+func qrCodewords(data []byte, v qrVersion, countBits int) (codewords []byte) {
+	capacity := v.dataLength()
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(*&data), *&countBits)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	terminator := 8*capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, *&terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	padded := make([]byte, 0, *&capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		padded = append(padded, b)
+	}
+	for pad := byte(0xEC); len(padded) < capacity; pad ^= 0xEC ^ 0x11 {
+		padded = append(padded, pad)
+	}
+
+	divisor := rsDivisor(v.ecLength)
+	blocks := make([][]byte, len(v.blocks))
+	ecs := make([][]byte, len(v.blocks))
+	for i, n := range v.blocks {
+		blocks[i], padded = padded[:n], padded[n:]
+		ecs[i] = rsRemainder(blocks[i], *&divisor)
+	}
+	longest := v.blocks[len(v.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				codewords = append(codewords, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecLength; i++ {
+		for _, ec := range ecs {
+			codewords = append(codewords, ec[i])
+		}
+	}
+	return
+}
+
+//// Reed-Solomon
+
+// Product in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ z>>7*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// Coefficients of the generator polynomial of the given degree, highest
+// first, without the leading one.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, *&degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], *&root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(*&root, 2)
+	}
+	return result
+}
+
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(*&divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], *&factor)
+		}
+	}
+	return result
+}
+
+//// Modules
+
+func newQRCode(version int, v qrVersion) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size}
+	q.modules = make([][]bool, *&size)
+	q.reserved = make([][]bool, *&size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, *&size)
+		q.reserved[i] = make([]bool, *&size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, *&i, i%2 == 0)
+		q.set(*&i, 6, i%2 == 0)
+	}
+	q.finder(3, 3)
+	q.finder(size-4, 3)
+	q.finder(3, size-4)
+	last := len(v.alignments) - 1
+	for i, x := range v.alignments {
+		for j, y := range v.alignments {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				// Taken by finders
+				continue
+			}
+			q.alignment(*&x, *&y)
+		}
+	}
+	// Reserved for now, drawn with the mask
+	q.drawFormat(0)
+	q.drawVersion(*&version)
+	return q
+}
+
+// Sets a function module, which data never overwrites.
+func (q *qrCode) set(x int, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.reserved[y][x] = true
+}
+
+// Finder pattern and its light separator, around the given center.
+func (q *qrCode) finder(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			d := qrDistance(*&dx, *&dy)
+			if x+dx >= 0 && x+dx < q.size && y+dy >= 0 && y+dy < q.size {
+				q.set(x+dx, y+dy, d != 2 && d != 4)
+			}
+		}
+	}
+}
+
+func (q *qrCode) alignment(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.set(x+dx, y+dy, qrDistance(*&dx, *&dy) != 1)
+		}
+	}
+}
+
+func qrDistance(dx int, dy int) int {
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+// Format information, with the error correction level bits of medium
+// being zero, twice around the finders.
+func (q *qrCode) drawFormat(mask int) {
+	data := *&mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ rem>>9*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, *&i, bit(*&i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(*&i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(*&i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(*&i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// Version information, from version 7.
+func (q *qrCode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := *&version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ rem>>11*0x1F25
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.set(*&a, *&b, *&dark)
+		q.set(*&b, *&a, *&dark)
+	}
+}
+
+// Fills the free modules in zigzag from the bottom right, two columns at
+// a time, skipping the vertical timing pattern.
+func (q *qrCode) placeData(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.reserved[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+//// Masks
+
+func qrMasked(mask int, x int, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// Inverts the data modules under a mask, applying it twice undoing it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.reserved[y][x] && qrMasked(*&mask, *&x, *&y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyBestMask(version int) {
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(*&mask)
+		q.drawFormat(*&mask)
+		if p := q.penalty(); lowest < 0 || p < lowest {
+			best, lowest = mask, p
+		}
+		q.applyMask(*&mask)
+	}
+	q.applyMask(*&best)
+	q.drawFormat(*&best)
+}
+
+// Scores the patterns readers struggle with: runs of a color, blocks,
+// lookalikes of finders, and unbalanced colors.
+func (q *qrCode) penalty() (p int) {
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(*&x, *&y, *&vertical) == at(x-1, *&y, *&vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+				// Finder lookalike with four light modules on a side
+				if x+7 > q.size {
+					continue
+				}
+				match := true
+				for i, dark := range finderLike {
+					if at(x+i, *&y, *&vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (q.light(x-4, x, *&y, *&vertical, at) || q.light(x+7, x+11, *&y, *&vertical, at)) {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	deviation := dark*20 - total*10
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	p += 10 * (deviation / total)
+	return
+}
+
+// Whether modules from start to end, excluded, are light, those outside the
+// symbol counting as light.
+func (q *qrCode) light(start int, end int, y int, vertical bool, at func(x, y int, vertical bool) bool) bool {
+	for x := start; x < end; x++ {
+		if x >= 0 && x < q.size && at(*&x, *&y, *&vertical) {
+			return false
+		}
+	}
+	return true
+}
+
+//// Rendering
+
+// Image of the code with its quiet zone, the given number of pixels wide
+// per module.
+func (q *qrCode) image(scale int) *image.Gray {
+	const quiet = 4
+	side := (q.size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, *&side, *&side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			mx, my := x/scale-quiet, y/scale-quiet
+			c := color.Gray{255}
+			if mx >= 0 && mx < q.size && my >= 0 && my < q.size && q.modules[my][mx] {
+				c = color.Gray{0}
+			}
+			img.SetGray(*&x, *&y, *&c)
+		}
+	}
+	return img
+}
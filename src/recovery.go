@@ -0,0 +1,81 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+//////// REQUEST IDENTIFIERS
+
+const requestIdContextKey = contextKey("request-id")
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(*&b)
+	return hex.EncodeToString(*&b)
+}
+
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdContextKey).(string)
+	return id
+}
+
+//////// MIDDLEWARES
+
+// Tags every request with an identifier, reusing the one set by a proxy.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(*&id) > 64 {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", *&id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdContextKey, *&id)))
+	})
+}
+
+// Turns a panicking handler into a logged stack trace and a JSON 500.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			incrementMetric("panics")
+			log.Printf("panic serving %s %s to %s [%s]: %v\n%s", r.Method, r.URL.Path, clientIP(*&r), requestId(*&r), v, debug.Stack())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error":     "internal server error",
+				"message":   errorMessage(*&r, "internal-server-error"),
+				"requestId": requestId(*&r),
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+//////// SECRETS REDACTION
+
+// Logs and captures are kept free of credentials, so that they can be
+// attached to bug reports: credential headers, secret query parameters and
+// JSON fields, bearer tokens, the secrets of the configuration wherever
+// they appear, and what matches the patterns of its "redact" entry.
+
+const redacted = "(redacted)"
+
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+var builtinRedactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`([?&](?:token|signature|passphrase|password|secret|code)=)[^&#\s"]*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)("(?:password|passphrase|token|secret|clientSecret|client_secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + redacted + `"`},
+	{regexp.MustCompile(`(?i)\b(Bearer|Basic) [A-Za-z0-9._~+/=-]+`), "${1} " + redacted},
+}
+
+var redactPatterns []*regexp.Regexp
+
+func checkRedaction() (err error) {
+	redactPatterns = nil
+	for _, p := range cloudConfig.Redact {
+		re, err := regexp.Compile(*&p)
+		if err != nil {
+			return err
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+	return
+}
+
+// Secrets of the configuration, masked wherever they appear.
+func configuredSecrets() (secrets []string) {
+	secrets = []string{tokenFlag, sessionSecretFlag}
+	for _, u := range cloudConfig.Users {
+		secrets = append(secrets, u.Token, u.Password)
+	}
+	if cloudConfig.OIDC != nil {
+		secrets = append(secrets, cloudConfig.OIDC.ClientSecret)
+	}
+	for _, c := range cloudConfig.Connectors {
+		secrets = append(secrets, c.ClientSecret)
+	}
+	for _, h := range cloudConfig.Webhooks {
+		secrets = append(secrets, h.Secret)
+	}
+	return
+}
+
+func redactText(s string) string {
+	for _, r := range builtinRedactions {
+		s = r.pattern.ReplaceAllString(*&s, r.replacement)
+	}
+	for _, re := range redactPatterns {
+		s = re.ReplaceAllLiteralString(*&s, redacted)
+	}
+	for _, secret := range configuredSecrets() {
+		// Too short to be told apart from anything else
+		if len(secret) >= 4 {
+			s = strings.ReplaceAll(*&s, *&secret, redacted)
+		}
+	}
+	return s
+}
+
+func redactHeaders(h http.Header) map[string][]string {
+	headers := make(map[string][]string, len(h))
+	for name, values := range h {
+		if sliceContains(redactedHeaders, *&name) {
+			headers[name] = []string{redacted}
+			continue
+		}
+		headers[name] = make([]string, len(values))
+		for i, v := range values {
+			headers[name][i] = redactText(*&v)
+		}
+	}
+	return headers
+}
+
+// Masks secrets out of the log lines on their way out.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (n int, err error) {
+	_, err = r.w.Write([]byte(redactText(string(*&p))))
+	return len(p), err
+}
@@ -0,0 +1,170 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//////// RENDERING
+
+const defaultRenderWidth = 1024
+const maxRenderWidth = 4096
+const renderTimeout = 30 * time.Second
+
+// Lifetime of the signed URLs of the pages rendered
+const renderLifetime = renderTimeout + 10*time.Second
+
+var chromeCandidates = []string{
+	"chromium",
+	"chromium-browser",
+	"google-chrome",
+	"google-chrome-stable",
+	"chrome",
+	"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+	"/Applications/Chromium.app/Contents/MacOS/Chromium",
+	`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+	`C:\Program Files (x86)\Google\Chrome\Application\chrome.exe`,
+}
+
+// Looks for a Chromium-based browser able to run headless, the -chrome flag
+// taking precedence over the usual install locations.
+func findChrome() (p string, ok bool) {
+	candidates := chromeCandidates
+	if chromeFlag != "" {
+		candidates = []string{chromeFlag}
+	}
+	for _, c := range candidates {
+		p, err := exec.LookPath(*&c)
+		if err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func renderPage(ctx context.Context, chrome string, pageUrl string, width int, height int) (png []byte, err error) {
+	tmp, err := ioutil.TempDir("", "ninja-render")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(*&tmp)
+	out := filepath.Join(*&tmp, "render.png")
+	ctx, cancel := context.WithTimeout(*&ctx, renderTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(*&ctx, *&chrome,
+		"--headless",
+		"--disable-gpu",
+		"--hide-scrollbars",
+		"--user-data-dir="+filepath.Join(*&tmp, "profile"),
+		"--screenshot="+out,
+		"--window-size="+strconv.Itoa(*&width)+","+strconv.Itoa(*&height),
+		pageUrl)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Println(string(*&output))
+		return
+	}
+	png, err = ioutil.ReadFile(*&out)
+	return
+}
+
+// URL of a page for the headless browser, on the address the request came
+// in on rather than on the host it names, and signed for the user.
+func localPageUrl(r *http.Request, p string) (u string, ok bool) {
+	a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok || a.Network() != "tcp" {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return "", false
+	}
+	if ip := net.ParseIP(*&host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	u = "http://" + net.JoinHostPort(*&host, *&port) + basePathFlag +
+		(&url.URL{Path: "/" + filepath.ToSlash(*&p)}).EscapedPath() +
+		"?" + signedPageQuery(requestUser(*&r), *&p, renderLifetime)
+	return u, true
+}
+
+//////// REQUEST HANDLERS
+
+//// Render API
+
+// Render a project page to a PNG thumbnail
+func renderHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	chrome, ok := findChrome()
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	p, ok := requestPath(*&r)
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !exist(*&p) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	width, err := strconv.Atoi(r.URL.Query().Get("width"))
+	if err != nil || width <= 0 || width > maxRenderWidth {
+		width = defaultRenderWidth
+	}
+	height, err := strconv.Atoi(r.URL.Query().Get("height"))
+	if err != nil || height <= 0 || height > maxRenderWidth {
+		height = width * 3 / 4
+	}
+	pageUrl, ok := localPageUrl(*&r, *&p)
+	if !ok {
+		logWarn("Not rendering", *&p+", the cloud does not listen on TCP")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	png, err := renderPage(r.Context(), *&chrome, *&pageUrl, *&width, *&height)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(*&png)
+}
@@ -0,0 +1,73 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRenderedPageSigned(t *testing.T) {
+	h := newTestCloud(t)
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	createDir("p")
+	saveFile("p/page.html", []byte(`<link rel="stylesheet" href="style.css">`))
+	saveFile("p/style.css", []byte("body {}"))
+	createDir("q")
+	saveFile("q/other.css", []byte("body {}"))
+
+	// The page is reached on the listener, whatever host the client named
+	r := httptest.NewRequest("GET", "/render?path=Z:/Ninja/p/page.html", nil)
+	r.Host = "attacker.example"
+	local := &net.TCPAddr{IP: net.IPv4zero, Port: 58123}
+	r = withUser(r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, net.Addr(local))), ownerUser)
+	pageUrl, ok := localPageUrl(r, "p/page.html")
+	if !ok || !strings.HasPrefix(pageUrl, "http://127.0.0.1:58123/p/page.html?") {
+		t.Fatalf("page URL: %q", pageUrl)
+	}
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := u.RequestURI()
+	referer := map[string]string{"Referer": pageUrl}
+	tampered := strings.Replace(page, "signer=owner", "signer=someone", 1)
+	expectStatuses(t, h, []step{
+		{testRequest{"GET", page, nil, ""}, http.StatusOK},
+		{testRequest{"GET", "/p/style.css", referer, ""}, http.StatusOK},
+		{testRequest{"GET", "/q/other.css", referer, ""}, http.StatusUnauthorized},
+		{testRequest{"GET", "/p/style.css", nil, ""}, http.StatusUnauthorized},
+		{testRequest{"GET", tampered, nil, ""}, http.StatusUnauthorized},
+		{testRequest{"PUT", page, nil, "x"}, http.StatusUnauthorized},
+		// Signed for static reads only
+		{testRequest{"GET", "/file/Ninja/p/style.css?" + u.RawQuery, nil, ""}, http.StatusUnauthorized},
+	})
+
+	unix := withUser(r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, net.Addr(&net.UnixAddr{Name: "/tmp/ninja.sock", Net: "unix"}))), ownerUser)
+	if u, ok := localPageUrl(unix, "p/page.html"); ok {
+		t.Errorf("page URL over a unix socket: %q", u)
+	}
+}
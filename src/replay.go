@@ -0,0 +1,155 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+//////// REPLAY
+
+// Serves the responses of a capture instead of the cloud, so that editor
+// tests run against its exact behavior without any project on disk.
+// Requests are matched by method, URL and body, falling back to method and
+// URL. Identical requests get the recorded responses in order, then the
+// last one again, until POST /replay/reset rewinds them.
+
+const replayResetPath = "/replay/reset"
+
+type replayer struct {
+	mutex   sync.Mutex
+	entries map[string][]captureEntry
+	served  map[string]int
+}
+
+func replayKey(method string, url string) string {
+	return method + " " + url
+}
+
+func loadReplay(p string) (rp *replayer, err error) {
+	f, err := os.Open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rp = &replayer{entries: make(map[string][]captureEntry), served: make(map[string]int)}
+	scanner := bufio.NewScanner(*&f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e captureEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, err
+		}
+		key := replayKey(e.Request.Method, e.Request.Url)
+		rp.entries[key] = append(rp.entries[key], e)
+	}
+	return rp, scanner.Err()
+}
+
+func decodeCapturedBody(b capturedBody) []byte {
+	if b.Encoding == "base64" {
+		content, _ := base64.StdEncoding.DecodeString(b.Body)
+		return content
+	}
+	return []byte(b.Body)
+}
+
+// Picks the next recorded response to a request.
+func (rp *replayer) next(r *http.Request, body []byte) (e captureEntry, ok bool) {
+	// Captured with their secrets masked
+	key := replayKey(r.Method, redactText(r.URL.RequestURI()))
+	text := string(*&body)
+	if utf8.Valid(*&body) {
+		text = redactText(*&text)
+	}
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	var candidates []captureEntry
+	for _, c := range rp.entries[key] {
+		if !c.Request.Truncated && string(decodeCapturedBody(c.Request.capturedBody)) == text {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(*&candidates) > 0 {
+		key += "\n" + string(*&body)
+	} else {
+		candidates = rp.entries[key]
+	}
+	if len(*&candidates) == 0 {
+		return
+	}
+	i := rp.served[key]
+	if i >= len(*&candidates) {
+		i = len(*&candidates) - 1
+	}
+	rp.served[key] = i + 1
+	return candidates[i], true
+}
+
+func (rp *replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == replayResetPath {
+		rp.mutex.Lock()
+		rp.served = make(map[string]int)
+		rp.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e, ok := rp.next(*&r, *&body)
+	if !ok {
+		logWarn("No recorded response to", r.Method, r.URL.RequestURI())
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no recorded response"})
+		return
+	}
+	if e.Response.Truncated {
+		logWarn("Replaying the truncated response to", r.Method, r.URL.RequestURI())
+	}
+	for name, values := range e.Response.Headers {
+		if name == "Content-Length" || sliceContains(redactedHeaders, *&name) {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(e.Response.Status)
+	w.Write(decodeCapturedBody(e.Response.capturedBody))
+}
+
+// Serves a capture on a listener until the cloud is stopped.
+func serveReplay(l net.Listener, p string) (err error) {
+	rp, err := loadReplay(*&p)
+	if err != nil {
+		return
+	}
+	logInfo("Replaying", p, "on", l.Addr().String())
+	return serve(*&l, requestIdMiddleware(logMiddleware(*&rp)))
+}
@@ -0,0 +1,196 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SIGNED REQUESTS
+
+// Alternative to sending tokens in cleartext over a local network where
+// TLS is not an option: clients sign each request with their token, which
+// never leaves them. The Authorization header then reads
+// "Ninja-HMAC <user>:<signature>", the signature being the base64 HMAC
+// SHA-256 keyed with the token of the method, the path and query, the
+// x-ninja-date header (Unix seconds), the x-ninja-nonce header, the
+// x-ninja-content-sha256 header and the operation headers, one per line.
+// Requests are refused outside of a short window around their date, and
+// when their nonce was already seen within it. The content header is the
+// hex SHA-256 digest of the body, required of requests having one: the body
+// is checked against it as it is read, reading it failing at its end when
+// it was altered. The operation headers, which decide what a request does
+// beside its target, come last in the order of signedHeaders, each as its
+// lowercase name, a colon and its trimmed value as sent, empty when it is
+// absent. Signed requests may not use the legacy names of these headers.
+
+const signedRequestScheme = "Ninja-HMAC"
+const signedRequestWindow = 5 * time.Minute
+const contentDigestHeader = "x-ninja-content-sha256"
+
+// Headers turning a copy into a move, or choosing what it overwrites
+var signedHeaders = []string{"sourceURI", "destination", "delete-source", "operation", "overwrite-destination", "recursive", "trash", "conflict-policy"}
+
+var errBodyDigest = errors.New("request body does not match its signed digest")
+
+var seenNonces = struct {
+	sync.Mutex
+	expiries map[string]time.Time
+}{expiries: make(map[string]time.Time)}
+
+// Remembers a nonce for the window, telling whether it is new.
+func freshNonce(nonce string) bool {
+	now := time.Now()
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+	for n, expires := range seenNonces.expiries {
+		if now.After(*&expires) {
+			delete(seenNonces.expiries, *&n)
+		}
+	}
+	if _, seen := seenNonces.expiries[nonce]; seen {
+		return false
+	}
+	seenNonces.expiries[nonce] = now.Add(2 * signedRequestWindow)
+	return true
+}
+
+// Token of a user, the secret signing their requests.
+func userToken(user string) string {
+	if user == ownerUser {
+		return tokenFlag
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Name == user {
+			return u.Token
+		}
+	}
+	return ""
+}
+
+func requestSignature(token string, r *http.Request) string {
+	target := r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	signed := r.Method + "\n" + target + "\n" + r.Header.Get("x-ninja-date") + "\n" + r.Header.Get("x-ninja-nonce") + "\n" + r.Header.Get(contentDigestHeader)
+	sent := sentHeaders(*&r)
+	for _, h := range signedHeaders {
+		signed += "\n" + strings.ToLower(*&h) + ":" + strings.TrimSpace(sent.Get(*&h))
+	}
+	mac := hmac.New(sha256.New, []byte(*&token))
+	mac.Write([]byte(*&signed))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// User who signed a request, when the token scheme is in use.
+func signedRequestUser(r *http.Request) (user string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(*&auth, signedRequestScheme+" ") {
+		return
+	}
+	active := false
+	for _, p := range activeAuth() {
+		_, isToken := p.(tokenAuth)
+		active = active || isToken
+	}
+	parts := strings.SplitN(strings.TrimPrefix(*&auth, signedRequestScheme+" "), ":", 2)
+	nonce := r.Header.Get("x-ninja-nonce")
+	if !active || len(parts) != 2 || nonce == "" {
+		return
+	}
+	user, signature := parts[0], parts[1]
+	for legacy := range legacyHeaders {
+		if sentHeaders(*&r).Get(*&legacy) != "" {
+			return
+		}
+	}
+	digest := strings.ToLower(r.Header.Get(contentDigestHeader))
+	hasBody := r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody
+	if hasBody && digest == "" {
+		return
+	}
+	unix, err := strconv.ParseInt(r.Header.Get("x-ninja-date"), 10, 64)
+	if err != nil {
+		return
+	}
+	if skew := time.Since(time.Unix(*&unix, 0)); skew > signedRequestWindow || skew < -signedRequestWindow {
+		return "", false
+	}
+	token := userToken(*&user)
+	if token == "" || !secureEquals(requestSignature(*&token, *&r), *&signature) {
+		return "", false
+	}
+	// Checked last, so that forged requests do not use up nonces
+	if !freshNonce(user + ":" + nonce) {
+		return "", false
+	}
+	if hasBody {
+		r.Body = &digestedBody{r.Body, sha256.New(), *&digest, r.ContentLength}
+	}
+	return user, true
+}
+
+// Body checked against its signed digest once read to the end, or to its
+// announced length for readers which stop there, such as JSON decoders.
+type digestedBody struct {
+	io.ReadCloser
+	hash      hash.Hash
+	digest    string
+	remaining int64
+}
+
+func (b *digestedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(*&p)
+	b.hash.Write(p[:n])
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+		if b.remaining == 0 && err == nil {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF && !secureEquals(hex.EncodeToString(b.hash.Sum(nil)), b.digest) {
+		err = errBodyDigest
+	}
+	return
+}
+
+// Whether a request carries a token or password readable by the machines
+// between the client and the cloud.
+func cleartextCredentials(r *http.Request) bool {
+	c := requestCredentials(*&r)
+	if c.Token == "" && c.Password == "" || requestScheme(*&r) == "https" || isUnixRequest(*&r) {
+		return false
+	}
+	ip := net.ParseIP(clientIP(*&r))
+	return ip == nil || !ip.IsLoopback()
+}
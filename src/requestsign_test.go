@@ -0,0 +1,121 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Request signed as a client would, the body digest given as is.
+func signedTestRequest(method string, target string, body string, nonce string, digest string) *http.Request {
+	r := httptest.NewRequest(*&method, *&target, strings.NewReader(*&body))
+	r.Header.Set("x-ninja-date", strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set("x-ninja-nonce", *&nonce)
+	if digest != "" {
+		r.Header.Set(contentDigestHeader, *&digest)
+	}
+	r.Header.Set("Authorization", signedRequestScheme+" "+ownerUser+":"+requestSignature("owner-token", *&r))
+	return r
+}
+
+func bodyDigest(body string) string {
+	sum := sha256.Sum256([]byte(*&body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSignedRequests(t *testing.T) {
+	h := newTestCloud(t)
+	tokenFlag = "owner-token"
+	defer func() { tokenFlag = "" }()
+	createDir("p")
+
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := serve(signedTestRequest("GET", "/directory/Ninja/p/", "", "n1", "")); code != http.StatusOK {
+		t.Errorf("signed: %d", code)
+	}
+	if code := serve(signedTestRequest("GET", "/directory/Ninja/p/", "", "n1", "")); code != http.StatusUnauthorized {
+		t.Errorf("replayed: %d", code)
+	}
+	if code := serve(signedTestRequest("POST", "/file/Ninja/p/a.txt", "content", "n2", bodyDigest("content"))); code != http.StatusCreated {
+		t.Errorf("signed body: %d", code)
+	}
+	if code := serve(signedTestRequest("POST", "/file/Ninja/p/b.txt", "content", "n3", "")); code != http.StatusUnauthorized {
+		t.Errorf("body without digest: %d", code)
+	}
+
+	// A body swapped under a valid signature fails to be read
+	r := signedTestRequest("PUT", "/file/Ninja/p/a.txt", "signed", "n4", bodyDigest("signed"))
+	r.Body = httptest.NewRequest("PUT", "/", strings.NewReader("forged")).Body
+	if code := serve(r); code < 400 {
+		t.Errorf("forged body: %d", code)
+	}
+	r = signedTestRequest("PUT", "/file/Ninja/p/a.txt", "signed", "n5", bodyDigest("signed"))
+	r.Header.Set(contentDigestHeader, bodyDigest("forged"))
+	r.Body = httptest.NewRequest("PUT", "/", strings.NewReader("forged")).Body
+	if code := serve(r); code != http.StatusUnauthorized {
+		t.Errorf("forged digest: %d", code)
+	}
+	if content, _ := readFile("p/a.txt"); string(content) != "content" {
+		t.Errorf("written: %q", content)
+	}
+
+	// Operation headers are signed: a copy cannot be turned into a move
+	sign := func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", signedRequestScheme+" "+ownerUser+":"+requestSignature("owner-token", *&r))
+		return r
+	}
+	r = signedTestRequest("PUT", "/file/Ninja/p/c.txt", "", "n6", "")
+	r.Header.Set("sourceURI", "Z:/Ninja/p/a.txt")
+	r = sign(r)
+	r.Header.Set("delete-source", "true")
+	if code := serve(r); code != http.StatusUnauthorized {
+		t.Errorf("forged move: %d", code)
+	}
+	r = signedTestRequest("PUT", "/file/Ninja/p/c.txt", "", "n7", "")
+	r.Header.Set("sourceURI", "Z:/Ninja/p/a.txt")
+	r = sign(r)
+	r.Header.Set("sourceURI", "Z:/Ninja/p/b.txt")
+	if code := serve(r); code != http.StatusUnauthorized {
+		t.Errorf("forged source: %d", code)
+	}
+	r = signedTestRequest("PUT", "/file/Ninja/p/c.txt", "", "n9", "")
+	r.Header.Set("Source-Uri", "Z:/Ninja/p/b.txt")
+	if code := serve(sign(r)); code != http.StatusUnauthorized {
+		t.Errorf("legacy source: %d", code)
+	}
+	r = signedTestRequest("PUT", "/file/Ninja/p/c.txt", "", "n8", "")
+	r.Header.Set("sourceURI", "Z:/Ninja/p/a.txt")
+	if code := serve(sign(r)); code >= 400 {
+		t.Errorf("signed copy: %d", code)
+	}
+	mustExist(t, "p/a.txt", true)
+	mustContain(t, "p/c.txt", "content")
+}
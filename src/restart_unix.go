@@ -0,0 +1,74 @@
+//go:build !windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+const inheritsSockets = true
+
+// Asks for a soft restart, as it does servers upgrading in place
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// Replaces the current process by a new instance of the executable.
+func restartProcess(exe string) error {
+	return syscall.Exec(*&exe, os.Args, os.Environ())
+}
+
+// Duplicates the socket of a listener, which stays open once the listener
+// is closed.
+func handOverListener(l net.Listener) (f *os.File, err error) {
+	if u, ok := l.(*net.UnixListener); ok {
+		// The new instance listens on the same socket file
+		u.SetUnlinkOnClose(false)
+	}
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("the listener cannot be handed over")
+	}
+	return fl.File()
+}
+
+// Lets the new instance of the executable inherit an open file, returning
+// its descriptor.
+func inheritFile(f *os.File) (fd int, err error) {
+	c, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	cerr := c.Control(func(d uintptr) {
+		fd = int(*&d)
+		// Duplicates are closed on exec by default
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, *&d, syscall.F_SETFD, 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return
+}
@@ -0,0 +1,56 @@
+//go:build windows
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+)
+
+const inheritsSockets = false
+
+var restartSignals []os.Signal
+
+// Windows cannot replace a running process: start the new executable with
+// the same arguments and exit.
+func restartProcess(exe string) error {
+	cmd := exec.Command(*&exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// Sockets are not inherited: the new instance listens again once this one
+// has stopped listening.
+func handOverListener(l net.Listener) (*os.File, error) {
+	return nil, nil
+}
+
+func inheritFile(f *os.File) (int, error) {
+	return 0, errors.New("files cannot be inherited on Windows")
+}
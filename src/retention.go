@@ -0,0 +1,237 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//////// RETENTION
+
+// Limits on what the revision stores keep, so that the hidden directories
+// they write to don't grow without bound. Revisions are pruned hourly, and
+// by the gc scheduled task.
+
+const retentionInterval = time.Hour
+
+type retentionPolicy struct {
+	// Age past which revisions are pruned, such as 720h
+	MaxAge string `json:"maxAge"`
+	// Space the whole store may take, the oldest revisions going first
+	MaxSize string `json:"maxSize"`
+	// Revisions kept per document
+	MaxVersions int `json:"maxVersions"`
+
+	maxAge  time.Duration
+	maxSize int64
+}
+
+type prunedRevision struct {
+	Store  string `json:"store"`
+	Uri    string `json:"uri"`
+	Id     string `json:"id"`
+	Size   string `json:"size"`
+	Reason string `json:"reason"`
+
+	doc  string
+	size int64
+}
+
+var retentionStores = map[string]*revisionStore{
+	"autosave": &autosaves,
+	"drafts":   &drafts,
+}
+
+func checkRetention() (err error) {
+	for name, policy := range cloudConfig.Retention {
+		store, ok := retentionStores[name]
+		if !ok {
+			return fmt.Errorf("retention: unknown store %q", name)
+		}
+		if policy.MaxAge != "" {
+			policy.maxAge, err = time.ParseDuration(policy.MaxAge)
+			if err != nil {
+				return fmt.Errorf("retention of %s: %v", name, err)
+			}
+		}
+		if policy.MaxSize != "" {
+			policy.maxSize, err = parseByteSize(policy.MaxSize)
+			if err != nil {
+				return fmt.Errorf("retention of %s: %v", name, err)
+			}
+		}
+		if policy.MaxVersions > 0 {
+			// Also enforced as revisions are saved
+			store.max = policy.MaxVersions
+		}
+	}
+	return
+}
+
+// Revisions of a store its policy would prune, by number per document,
+// then by age, then the oldest ones while the store is too large.
+func prunableRevisions(name string, policy *retentionPolicy) (pruned []prunedRevision, err error) {
+	store := retentionStores[name]
+	docs, err := store.documents()
+	if err != nil {
+		return
+	}
+	var kept []prunedRevision
+	var total int64
+	for _, uri := range docs {
+		doc, ok := uriToPath(*&uri)
+		if !ok {
+			continue
+		}
+		revisions, err := store.list(*&doc)
+		if err != nil {
+			return nil, err
+		}
+		// Listed from the most recent
+		for i, r := range revisions {
+			size, _ := strconv.ParseInt(r.Size, 10, 64)
+			p := prunedRevision{Store: name, Uri: r.Uri, Id: r.Id, Size: r.Size, doc: doc, size: size}
+			switch {
+			case policy.MaxVersions > 0 && i >= policy.MaxVersions:
+				p.Reason = "versions"
+			case policy.maxAge > 0 && time.Since(parseMilliseconds(r.Id)) > policy.maxAge:
+				p.Reason = "age"
+			default:
+				kept = append(kept, p)
+				total += size
+				continue
+			}
+			pruned = append(pruned, p)
+		}
+	}
+	if policy.maxSize > 0 && total > policy.maxSize {
+		sort.Slice(kept, func(i, j int) bool {
+			a, _ := strconv.ParseInt(kept[i].Id, 10, 64)
+			b, _ := strconv.ParseInt(kept[j].Id, 10, 64)
+			return a < b
+		})
+		for _, p := range kept {
+			if total <= policy.maxSize {
+				break
+			}
+			p.Reason = "size"
+			pruned = append(pruned, p)
+			total -= p.size
+		}
+	}
+	return
+}
+
+func retentionPreview() (pruned []prunedRevision, err error) {
+	pruned = []prunedRevision{}
+	for name, policy := range cloudConfig.Retention {
+		p, err := prunableRevisions(*&name, *&policy)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, p...)
+	}
+	return
+}
+
+// Applies the policies, removing the directories of the documents left
+// without revisions.
+func pruneRevisions(ctx context.Context) (count int, err error) {
+	pruned, err := retentionPreview()
+	if err != nil {
+		return
+	}
+	for _, p := range pruned {
+		err = ioPause(*&ctx)
+		if err != nil {
+			return
+		}
+		store := retentionStores[p.Store]
+		f, ok := store.file(p.doc, p.Id)
+		if !ok {
+			continue
+		}
+		err = removeFile(*&f)
+		if err != nil {
+			return
+		}
+		count++
+		if left, err := store.list(p.doc); err == nil && len(*&left) == 0 {
+			store.discard(p.doc)
+		}
+	}
+	return
+}
+
+func startRetention() {
+	go func() {
+		for range time.Tick(retentionInterval) {
+			count, err := pruneRevisions(backgroundContext)
+			if err != nil {
+				logWarn("Pruning revisions failed:", err)
+			} else if count > 0 {
+				logInfo("Pruned", count, "revisions")
+			}
+		}
+	}()
+}
+
+//////// REQUEST HANDLERS
+
+//// Retention API
+
+// Preview what the retention policies would prune, or prune it now
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if !isModerator(*&r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		pruned, err := retentionPreview()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		var size int64
+		for _, p := range pruned {
+			size += p.size
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"revisions": pruned, "size": formatByteSize(*&size)})
+		return
+	case "POST":
+		j := startJob(r, "retention", "", func(ctx context.Context, j *job) (string, error) {
+			j.setState(jobRunning)
+			count, err := pruneRevisions(*&ctx)
+			return strconv.Itoa(*&count) + " revisions pruned", err
+		})
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *&j)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,146 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//////// REVISION STORES
+
+// Successive states of documents, stored as <dir>/<document path>/<timestamp>
+// and capped to the max most recent ones per document.
+type revisionStore struct {
+	dir string
+	max int
+}
+
+type revision struct {
+	Id   string `json:"id"`
+	Uri  string `json:"uri"`
+	Date string `json:"date"`
+	Size string `json:"size"`
+}
+
+func (s revisionStore) documentDir(doc string) string {
+	return filepath.Join(s.dir, *&doc)
+}
+
+func (s revisionStore) list(doc string) (revisions []revision, err error) {
+	entries, err := fsys.readDir(s.documentDir(*&doc))
+	if os.IsNotExist(*&err) {
+		return []revision{}, nil
+	} else if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		revisions = append(*&revisions, revision{e.Name(), pathToUri(*&doc), e.Name(), strconv.FormatInt(e.Size(), 10)})
+	}
+	// Most recent first
+	sort.Slice(*&revisions, func(i, j int) bool {
+		a, _ := strconv.ParseInt(revisions[i].Id, 10, 64)
+		b, _ := strconv.ParseInt(revisions[j].Id, 10, 64)
+		return a > b
+	})
+	return
+}
+
+// Lists the documents having at least one revision.
+func (s revisionStore) documents() (docs []string, err error) {
+	docs = []string{}
+	err = walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(*&err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		doc, err := filepath.Rel(s.dir, filepath.Dir(*&p))
+		if err != nil {
+			return err
+		}
+		if len(*&docs) == 0 || docs[len(*&docs)-1] != pathToUri(*&doc) {
+			docs = append(*&docs, pathToUri(*&doc))
+		}
+		return nil
+	})
+	return
+}
+
+func (s revisionStore) save(doc string, content []byte) (r revision, err error) {
+	dir := s.documentDir(*&doc)
+	err = createDir(*&dir)
+	if err != nil {
+		return
+	}
+	id := strconv.FormatInt(time.Now().UnixNano()/1000000, 10)
+	err = saveFile(filepath.Join(*&dir, *&id), *&content)
+	if err != nil {
+		return
+	}
+	r = revision{id, pathToUri(*&doc), id, strconv.Itoa(len(*&content))}
+	revisions, err := s.list(*&doc)
+	if err != nil {
+		return
+	}
+	for i := s.max; i < len(*&revisions); i++ {
+		err = removeFile(filepath.Join(*&dir, revisions[i].Id))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s revisionStore) file(doc string, id string) (p string, ok bool) {
+	if _, err := strconv.ParseInt(*&id, 10, 64); err != nil {
+		return "", false
+	}
+	p = filepath.Join(s.documentDir(*&doc), *&id)
+	return p, exist(*&p)
+}
+
+// Writes a revision back over its document.
+func (s revisionStore) restore(doc string, id string) (err error) {
+	f, ok := s.file(*&doc, *&id)
+	if !ok {
+		return os.ErrNotExist
+	}
+	content, err := readFile(*&f)
+	if err != nil {
+		return
+	}
+	err = saveFile(*&doc, *&content)
+	return
+}
+
+func (s revisionStore) discard(doc string) (err error) {
+	err = removeDir(s.documentDir(*&doc))
+	return
+}
@@ -0,0 +1,180 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//////// URL REWRITING
+
+// Rewrites the asset references of an HTML document or a stylesheet either
+// to absolute URLs of the files served by the cloud, which documents open
+// in the editor use, or to URLs relative to the document, which work once
+// it is published or exported. References to anything else are kept.
+
+const (
+	rewriteRelative = "relative"
+	rewriteAbsolute = "absolute"
+)
+
+// Path of a file served by this cloud an absolute URL refers to.
+func cloudReference(r *http.Request, ref string) (p string, ok bool) {
+	u, err := url.Parse(*&ref)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+	host, port, _ := net.SplitHostPort(u.Host)
+	ownHost, ownPort, _ := net.SplitHostPort(requestHost(*&r))
+	local := func(h string) bool {
+		ip := net.ParseIP(*&h)
+		return h == "localhost" || ip != nil && ip.IsLoopback()
+	}
+	if u.Host != requestHost(*&r) && !(port == ownPort && local(*&host) && local(*&ownHost)) {
+		return
+	}
+	rest := u.Path
+	if basePathFlag != "" {
+		if !strings.HasPrefix(*&rest, basePathFlag+"/") {
+			return
+		}
+		rest = strings.TrimPrefix(*&rest, basePathFlag)
+	}
+	rest = strings.TrimPrefix(*&rest, strings.TrimSuffix(filePath, "/"))
+	p, ok = uriToPath(*&rest)
+	return p, ok && p != "."
+}
+
+// Suffix of a reference after its path.
+func referenceSuffix(u *url.URL) (suffix string) {
+	if u.RawQuery != "" {
+		suffix += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		suffix += "#" + u.Fragment
+	}
+	return
+}
+
+// Rewritten form of a reference from a document in dir, if it changes.
+func rewriteReference(r *http.Request, dir string, ref string, to string) (rewritten string, ok bool) {
+	ref = strings.TrimSpace(*&ref)
+	if to == rewriteRelative {
+		p, found := cloudReference(*&r, *&ref)
+		if !found {
+			return
+		}
+		rel, err := filepath.Rel(*&dir, *&p)
+		if err != nil {
+			return
+		}
+		u, _ := url.Parse(*&ref)
+		return (&url.URL{Path: filepath.ToSlash(*&rel)}).String() + referenceSuffix(*&u), true
+	}
+	p, found := resolveReference(*&dir, *&ref)
+	if !found {
+		return
+	}
+	u, _ := url.Parse(*&ref)
+	return externalUrl(*&r, "/"+strings.TrimPrefix(pathToUri(*&p), drivePrefix)) + referenceSuffix(*&u), true
+}
+
+// Rewrites the references of a document at p, returning how many changed.
+func rewriteReferences(r *http.Request, p string, content []byte, to string) ([]byte, int) {
+	dir := filepath.Dir(*&p)
+	count := 0
+	replace := func(m []byte, ref string) []byte {
+		rewritten, ok := rewriteReference(*&r, *&dir, *&ref, *&to)
+		if !ok {
+			return m
+		}
+		count++
+		return bytes.Replace(*&m, []byte(*&ref), []byte(*&rewritten), 1)
+	}
+	ext := strings.ToLower(filepath.Ext(*&p))
+	if ext == ".html" || ext == ".htm" {
+		content = htmlTagRegexp.ReplaceAllFunc(*&content, func(tag []byte) []byte {
+			return htmlAttrRegexp.ReplaceAllFunc(*&tag, func(a []byte) []byte {
+				m := htmlAttrRegexp.FindSubmatch(*&a)
+				name := strings.ToLower(string(m[1]))
+				if name != "src" && name != "href" && name != "poster" || len(m[2]) == 0 {
+					return a
+				}
+				return replace(*&a, strings.Trim(string(m[2]), `"'`))
+			})
+		})
+	}
+	content = cssUrlRegexp.ReplaceAllFunc(*&content, func(m []byte) []byte {
+		return replace(*&m, string(cssUrlRegexp.FindSubmatch(*&m)[1]))
+	})
+	return content, count
+}
+
+//////// REQUEST HANDLERS
+
+//// Rewriting API
+
+// Rewrite the asset URLs of a document, the one posted or else the one
+// stored, to the form given by the "to" parameter
+func rewriteHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[rewritePathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	to := r.URL.Query().Get("to")
+	ext := strings.ToLower(filepath.Ext(*&p))
+	if to != rewriteRelative && to != rewriteAbsolute || ext != ".html" && ext != ".htm" && ext != ".css" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	content, err := ioutil.ReadAll(*&r.Body)
+	if err == nil && len(*&content) == 0 {
+		content, err = readFile(*&p)
+	}
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	content, count := rewriteReferences(*&r, *&p, *&content, *&to)
+	w.Header().Set("Content-Type", mime.TypeByExtension(*&ext))
+	w.Header().Set("rewritten", strconv.Itoa(*&count))
+	w.WriteHeader(http.StatusOK)
+	w.Write(*&content)
+}
@@ -0,0 +1,308 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//////// PAGE SAVING
+
+// Saves a complete web page into a project: the document, the images,
+// scripts, stylesheets and fonts it references, and those the stylesheets
+// reference in turn. The assets are stored in a directory next to the page
+// and the references rewritten to point to them, while links to other
+// pages are made absolute so that they keep working.
+
+const savePageAssets = "assets"
+const savePageMaxAssets = 500
+
+var errNotWebPage = errors.New("not an http or https URL")
+
+type pageSaver struct {
+	dir    string
+	queue  []*url.URL
+	names  map[string]string // Absolute URL of each asset to its name
+	styles map[string][]byte // Stylesheets, written once their assets are
+	sheets map[string]bool   // Names of the assets known to be stylesheets
+	saved  map[string]bool   // Names of the assets fetched
+	failed int
+}
+
+// Whether a reference from a tag is an asset to save rather than a link.
+func pageAsset(tag string, attr string, rel string) bool {
+	switch tag {
+	case "a", "area", "form", "base":
+		return false
+	case "link":
+		rel = strings.ToLower(*&rel)
+		return strings.Contains(*&rel, "stylesheet") || strings.Contains(*&rel, "icon")
+	}
+	return attr == "src" || attr == "href" || attr == "poster"
+}
+
+// Absolute form of a reference, unless it is data or in-document.
+func resolveWebReference(base *url.URL, ref string) (u *url.URL, ok bool) {
+	ref = strings.TrimSpace(*&ref)
+	if ref == "" || strings.HasPrefix(*&ref, "#") {
+		return
+	}
+	u, err := base.Parse(*&ref)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, false
+	}
+	return u, true
+}
+
+// Asset URL without its fragment, which the server never sees.
+func assetKey(u *url.URL) string {
+	v := *u
+	v.Fragment = ""
+	return v.String()
+}
+
+// Name, unique within the assets directory, an asset is stored under.
+func (s *pageSaver) assetName(u *url.URL, sheet bool) string {
+	name := sanitizeName(path.Base(u.Path))
+	if name == "" || name == "." || name == "/" || name == "_" {
+		name = "asset"
+	}
+	if sheet && !strings.EqualFold(path.Ext(*&name), ".css") {
+		name += ".css"
+	}
+	taken := func(n string) bool {
+		for _, used := range s.names {
+			if strings.EqualFold(*&used, *&n) {
+				return true
+			}
+		}
+		return exist(filepath.Join(s.dir, *&n))
+	}
+	ext := path.Ext(*&name)
+	base := strings.TrimSuffix(*&name, *&ext)
+	for i := 2; taken(*&name); i++ {
+		name = fmt.Sprintf("%s-%d%s", *&base, *&i, *&ext)
+	}
+	return name
+}
+
+// Queues an asset, once and while under the limit, returning the
+// reference to it from the assets directory if it was fetched.
+func (s *pageSaver) add(u *url.URL, sheet bool) (ref string, ok bool) {
+	key := assetKey(*&u)
+	name, found := s.names[key]
+	if !found && len(s.names) < savePageMaxAssets {
+		name = s.assetName(*&u, *&sheet)
+		s.names[key] = name
+		s.sheets[name] = sheet || strings.EqualFold(path.Ext(*&name), ".css")
+		s.queue = append(s.queue, *&u)
+	}
+	if !s.saved[name] {
+		return
+	}
+	return (&url.URL{Path: name, Fragment: u.Fragment}).String(), true
+}
+
+// Rewrites the url() references of a stylesheet, queueing their targets.
+func (s *pageSaver) rewriteStyle(base *url.URL, content []byte, prefix string) []byte {
+	return cssUrlRegexp.ReplaceAllFunc(*&content, func(m []byte) []byte {
+		ref := string(cssUrlRegexp.FindSubmatch(*&m)[1])
+		u, ok := resolveWebReference(*&base, *&ref)
+		if !ok {
+			return m
+		}
+		local, ok := s.add(*&u, false)
+		if !ok {
+			return []byte(strings.Replace(string(*&m), *&ref, u.String(), 1))
+		}
+		return []byte(strings.Replace(string(*&m), *&ref, prefix+local, 1))
+	})
+}
+
+// Rewrites the references of an HTML page, queueing the assets.
+func (s *pageSaver) rewritePage(base *url.URL, content []byte) []byte {
+	prefix := savePageAssets + "/"
+	content = htmlTagRegexp.ReplaceAllFunc(*&content, func(tag []byte) []byte {
+		m := htmlTagRegexp.FindSubmatch(*&tag)
+		name := strings.ToLower(string(m[2]))
+		rel := ""
+		for _, a := range htmlAttrRegexp.FindAllSubmatch(m[3], -1) {
+			if strings.ToLower(string(a[1])) == "rel" {
+				rel = strings.Trim(string(a[2]), `"'`)
+			}
+		}
+		attrs := htmlAttrRegexp.ReplaceAllFunc(m[3], func(a []byte) []byte {
+			am := htmlAttrRegexp.FindSubmatch(*&a)
+			attr := strings.ToLower(string(am[1]))
+			if attr != "src" && attr != "href" && attr != "poster" || len(am[2]) == 0 {
+				return a
+			}
+			ref := strings.Trim(string(am[2]), `"'`)
+			u, ok := resolveWebReference(*&base, *&ref)
+			if !ok {
+				return a
+			}
+			target := u.String()
+			if pageAsset(*&name, *&attr, *&rel) {
+				sheet := name == "link" && strings.Contains(strings.ToLower(*&rel), "stylesheet")
+				if local, ok := s.add(*&u, *&sheet); ok {
+					target = prefix + local
+				}
+			}
+			return []byte(strings.Replace(string(*&a), *&ref, *&target, 1))
+		})
+		return []byte(strings.Replace(string(*&tag), string(m[3]), string(*&attrs), 1))
+	})
+	// Inline styles and style blocks
+	return s.rewriteStyle(*&base, *&content, *&prefix)
+}
+
+// Fetches the queued assets, following the references of stylesheets.
+func (s *pageSaver) fetchAssets(ctx context.Context, j *job) (err error) {
+	for i := 0; i < len(s.queue); i++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		u := s.queue[i]
+		name := s.names[assetKey(*&u)]
+		content, err := httpGet(*&ctx, assetKey(*&u))
+		if err != nil {
+			logWarn("Saving", assetKey(*&u), "failed:", err)
+			s.failed++
+			continue
+		}
+		s.saved[name] = true
+		if s.sheets[name] {
+			// Queues the assets of the stylesheet
+			s.rewriteStyle(*&u, *&content, "")
+			s.styles[*&name] = content
+		} else if err = saveFile(filepath.Join(s.dir, *&name), *&content); err != nil {
+			return err
+		}
+		j.setProgress(float64(i+1) / float64(len(s.queue)+1))
+	}
+	for _, u := range s.queue {
+		name := s.names[assetKey(*&u)]
+		if content, ok := s.styles[name]; ok {
+			if err = saveFile(filepath.Join(s.dir, *&name), s.rewriteStyle(*&u, *&content, "")); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Saves the page at a URL as the file p, its assets next to it.
+func savePage(ctx context.Context, j *job, page string, p string) (err error) {
+	base, err := url.Parse(*&page)
+	if err != nil {
+		return
+	}
+	content, err := httpGet(*&ctx, *&page)
+	if err != nil {
+		return
+	}
+	s := &pageSaver{
+		dir:    filepath.Join(filepath.Dir(*&p), savePageAssets),
+		names:  make(map[string]string),
+		styles: make(map[string][]byte),
+		sheets: make(map[string]bool),
+		saved:  make(map[string]bool),
+	}
+	// Queues the assets, then rewrites the references to those fetched
+	s.rewritePage(*&base, *&content)
+	if len(s.queue) > 0 {
+		if err = createDir(s.dir); err != nil {
+			return
+		}
+		if err = s.fetchAssets(*&ctx, *&j); err != nil {
+			return
+		}
+	}
+	content = s.rewritePage(*&base, *&content)
+	if s.failed > 0 {
+		logWarn(*&s.failed, "assets of", *&page, "could not be saved")
+	}
+	return writeFile(*&p, *&content, false)
+}
+
+// Name of the file a page is saved as, from its URL unless given.
+func savedPageName(u *url.URL, name string) string {
+	if name == "" {
+		name = path.Base(u.Path)
+		if ext := strings.ToLower(path.Ext(*&name)); ext != ".html" && ext != ".htm" {
+			name = "index.html"
+		}
+	}
+	return sanitizeName(*&name)
+}
+
+//////// REQUEST HANDLERS
+
+//// Page Saving API
+
+// Save the page at the "url" parameter with its assets into a directory,
+// in the background
+func savePageHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dir, ok := uriToPath(r.URL.Path[savePagePathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	page := r.URL.Query().Get("url")
+	u, err := url.Parse(*&page)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		log.Println(errNotWebPage, *&page)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if fi, err := fsys.stat(*&dir); os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil || !fi.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p := filepath.Join(*&dir, savedPageName(*&u, r.URL.Query().Get("name")))
+	if exist(*&p) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	j := startJob(*&r, "save-page", *&page, func(ctx context.Context, j *job) (string, error) {
+		j.setState(jobRunning)
+		return pathToUri(*&p), savePage(*&ctx, *&j, *&page, *&p)
+	})
+	w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+	writeJSON(w, http.StatusAccepted, *&j)
+}
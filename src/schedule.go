@@ -0,0 +1,526 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SCHEDULED TASKS
+
+// Maintenance tasks run as background jobs of the owner at the times given
+// by the cron expressions of the configuration, or on demand.
+
+const backupsDir = hiddenPrefix + "backups"
+const defaultBackupsKept = 7
+
+type scheduledTask struct {
+	Name string `json:"name"`
+	Task string `json:"task"`
+	Cron string `json:"cron"`
+	// Archives the backup task keeps
+	Keep int `json:"keep"`
+
+	schedule cronSchedule
+}
+
+type scheduleEntry struct {
+	Name    string `json:"name"`
+	Task    string `json:"task"`
+	Cron    string `json:"cron"`
+	Next    string `json:"next,omitempty"`
+	LastRun string `json:"lastRun,omitempty"`
+	LastJob string `json:"lastJob,omitempty"`
+}
+
+var scheduledTasks = map[string]func(ctx context.Context, j *job, t scheduledTask) (string, error){
+	"backup":   backupTask,
+	"snapshot": snapshotTask,
+	"gc":       gcTask,
+	"reindex":  reindexTask,
+}
+
+// Last job started for each scheduled task.
+var scheduleRuns = struct {
+	sync.Mutex
+	jobs  map[string]string
+	times map[string]time.Time
+}{jobs: make(map[string]string), times: make(map[string]time.Time)}
+
+func checkSchedule() (err error) {
+	names := make(map[string]bool)
+	for i := range cloudConfig.Schedule {
+		t := &cloudConfig.Schedule[i]
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("scheduled task %d needs a unique name", i)
+		}
+		names[t.Name] = true
+		if _, ok := scheduledTasks[t.Task]; !ok {
+			return fmt.Errorf("scheduled task %s: unknown task %q", t.Name, t.Task)
+		}
+		t.schedule, err = parseCron(t.Cron)
+		if err != nil {
+			return fmt.Errorf("scheduled task %s: %v", t.Name, err)
+		}
+	}
+	return
+}
+
+func findScheduledTask(name string) (t scheduledTask, ok bool) {
+	for _, t := range cloudConfig.Schedule {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return
+}
+
+// Starts a task unless its previous run is still going on.
+func runScheduledTask(t scheduledTask) (j job, err error) {
+	scheduleRuns.Lock()
+	defer scheduleRuns.Unlock()
+	if last, ok := jobs.get(scheduleRuns.jobs[t.Name]); ok && (last.State == jobQueued || last.State == jobRunning) {
+		return last, errors.New("previous run of " + t.Name + " still running")
+	}
+	run := scheduledTasks[t.Task]
+	j = startUserJob(ownerUser, "schedule", t.Name, func(ctx context.Context, j *job) (string, error) {
+		return run(*&ctx, *&j, *&t)
+	})
+	scheduleRuns.jobs[t.Name] = j.Id
+	scheduleRuns.times[t.Name] = time.Now()
+	return
+}
+
+// Wakes up at the start of every minute to run the tasks due.
+func startScheduler() {
+	go func() {
+		for {
+			now := time.Now()
+			minute := now.Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(minute.Sub(*&now))
+			for _, t := range cloudConfig.Schedule {
+				if !t.schedule.matches(*&minute) {
+					continue
+				}
+				j, err := runScheduledTask(*&t)
+				if err != nil {
+					logWarn(*&err)
+					continue
+				}
+				logInfo("Started scheduled task", t.Name, "as job", j.Id)
+			}
+		}
+	}()
+}
+
+func scheduleEntries() (list []scheduleEntry) {
+	scheduleRuns.Lock()
+	defer scheduleRuns.Unlock()
+	list = []scheduleEntry{}
+	for _, t := range cloudConfig.Schedule {
+		e := scheduleEntry{Name: t.Name, Task: t.Task, Cron: t.Cron, LastJob: scheduleRuns.jobs[t.Name]}
+		if next, ok := t.schedule.next(time.Now()); ok {
+			e.Next = milliseconds(*&next)
+		}
+		if last, ok := scheduleRuns.times[t.Name]; ok {
+			e.LastRun = milliseconds(*&last)
+		}
+		list = append(list, e)
+	}
+	return
+}
+
+//// Tasks
+
+// Archives the projects, keeping the most recent archives only.
+func backupTask(ctx context.Context, j *job, t scheduledTask) (result string, err error) {
+	j.setState(jobRunning)
+	var files []string
+	err = walk(".", func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !storedInArchives(*&info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	err = createDir(backupsDir)
+	if err != nil {
+		return
+	}
+	name := filepath.Join(backupsDir, t.Name+"-"+time.Now().Format("20060102-150405")+".zip")
+	f, err := fsys.create(*&name, 0666)
+	if err != nil {
+		return
+	}
+	zw := zip.NewWriter(*&f)
+	for i, p := range files {
+		err = ioPause(*&ctx)
+		if err != nil {
+			break
+		}
+		err = addToZip(*&zw, *&p)
+		if err != nil {
+			break
+		}
+		j.setProgress(float64(i+1) / float64(len(*&files)))
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeFile(*&name)
+		return
+	}
+	err = pruneBackups(t.Name, *&t.Keep)
+	return pathToUri(*&name), err
+}
+
+// Whether a file goes into backups and archives: internal files are left
+// out, but for the encryption parameters of projects.
+func storedInArchives(info os.FileInfo) bool {
+	return !strings.HasPrefix(info.Name(), hiddenPrefix) || !info.IsDir() && info.Name() == encryptionFile
+}
+
+// Adds a file as it is stored, so that the files of encrypted projects stay
+// sealed in backups and archives.
+func addToZip(zw *zip.Writer, p string) (err error) {
+	info, err := rawStorage().stat(*&p)
+	if err != nil {
+		return
+	}
+	h, err := zip.FileInfoHeader(*&info)
+	if err != nil {
+		return
+	}
+	h.Name = filepath.ToSlash(*&p)
+	h.Method = zip.Deflate
+	w, err := zw.CreateHeader(*&h)
+	if err != nil {
+		return
+	}
+	f, err := rawStorage().open(*&p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = io.Copy(*&w, *&f)
+	return
+}
+
+func pruneBackups(task string, keep int) (err error) {
+	if keep <= 0 {
+		keep = defaultBackupsKept
+	}
+	entries, err := fsys.readDir(backupsDir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), task+"-") && strings.HasSuffix(e.Name(), ".zip") {
+			names = append(names, e.Name())
+		}
+	}
+	// Named after their time, the oldest come first
+	sort.Strings(names)
+	for len(names) > keep {
+		err = removeFile(filepath.Join(backupsDir, names[0]))
+		if err != nil {
+			return
+		}
+		names = names[1:]
+	}
+	return
+}
+
+func snapshotTask(ctx context.Context, j *job, t scheduledTask) (result string, err error) {
+	if snapshots == nil {
+		return "", errors.New("snapshots are disabled")
+	}
+	j.setState(jobRunning)
+	s, err := takeSnapshot("", "scheduled", true)
+	return s.Name, err
+}
+
+// Discards the autosaves and drafts of deleted documents, the revisions
+// past their retention, and the expired shares.
+func gcTask(ctx context.Context, j *job, t scheduledTask) (result string, err error) {
+	j.setState(jobRunning)
+	discarded := 0
+	for _, store := range []revisionStore{autosaves, drafts} {
+		docs, err := store.documents()
+		if err != nil {
+			return "", err
+		}
+		for _, doc := range docs {
+			err = ioPause(*&ctx)
+			if err != nil {
+				return "", err
+			}
+			p, ok := uriToPath(*&doc)
+			if !ok || exist(*&p) {
+				continue
+			}
+			err = store.discard(*&p)
+			if err != nil {
+				return "", err
+			}
+			discarded++
+		}
+	}
+	pruned, err := pruneRevisions(*&ctx)
+	if err != nil {
+		return
+	}
+	// Loading shares forgets the expired ones
+	listShares(ownerUser)
+	return fmt.Sprintf("%d documents discarded, %d revisions pruned", discarded, pruned), nil
+}
+
+// Forgets the metadata of missing files, and computes the revisions of
+// large files ahead of their first download.
+func reindexTask(ctx context.Context, j *job, t scheduledTask) (result string, err error) {
+	j.setState(jobRunning)
+	forgotten := 0
+	for _, b := range pathBuckets {
+		for _, key := range metadata.keys(*&b, ".") {
+			if !exist(filepath.FromSlash(*&key)) {
+				metadata.delete(*&b, *&key)
+				forgotten++
+			}
+		}
+	}
+	err = walk(".", func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		err = ioPause(*&ctx)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Size() > streamThreshold {
+			_, err = fileRevision(*&p, *&info)
+		}
+		return err
+	})
+	return strconv.Itoa(*&forgotten) + " stale entries forgotten", err
+}
+
+//// Cron expressions
+
+// Minute, hour, day of month, month and day of week, as sets of values.
+type cronSchedule struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(expr string) (c cronSchedule, err error) {
+	if s, ok := cronShortcuts[strings.TrimSpace(*&expr)]; ok {
+		expr = s
+	}
+	fields := strings.Fields(*&expr)
+	if len(*&fields) != 5 {
+		return c, fmt.Errorf("cron expression %q needs 5 fields", expr)
+	}
+	bits := []*uint64{&c.minutes, &c.hours, &c.days, &c.months, &c.weekdays}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	for i, f := range fields {
+		*bits[i], err = parseCronField(*&f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return c, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return
+}
+
+// Parses lists of values, ranges and steps, such as 1-5 or */15.
+func parseCronField(field string, min int, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(*&field, ",") {
+		step := 1
+		if i := strings.Index(*&part, "/"); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err1, err2 error
+			if i := strings.Index(*&part, "-"); i >= 0 {
+				lo, err1 = strconv.Atoi(part[:i])
+				hi, err2 = strconv.Atoi(part[i+1:])
+			} else {
+				lo, err1 = strconv.Atoi(*&part)
+				if step == 1 {
+					hi = lo
+				}
+			}
+			if err1 != nil || err2 != nil || lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(*&v)
+		}
+	}
+	return
+}
+
+// Like cron, restricted days of month and of week match either of them.
+func (c cronSchedule) dayMatches(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	return c.minutes&(1<<uint(t.Minute())) != 0 && c.hours&(1<<uint(t.Hour())) != 0 &&
+		c.months&(1<<uint(t.Month())) != 0 && c.dayMatches(*&t)
+}
+
+// First time matching after the given one, skipping whole months, days
+// and hours which don't, looking a few years ahead at most.
+func (c cronSchedule) next(after time.Time) (t time.Time, ok bool) {
+	t = after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(*&limit) {
+		y, m, d := t.Date()
+		switch {
+		case c.months&(1<<uint(*&m)) == 0:
+			t = time.Date(*&y, m+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(*&t):
+			t = time.Date(*&y, *&m, d+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(*&y, *&m, *&d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return t, false
+}
+
+//////// REQUEST HANDLERS
+
+//// Schedule API
+
+// List the scheduled tasks with their next run, or run one now
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if !isModerator(*&r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := r.URL.Path[schedulePathLen:]
+	if name == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, scheduleEntries())
+		return
+	}
+	t, ok := findScheduledTask(*&name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		for _, e := range scheduleEntries() {
+			if e.Name == name {
+				writeJSON(w, http.StatusOK, *&e)
+				return
+			}
+		}
+	case "POST":
+		// Run the task now, as a job
+		j, err := runScheduledTask(*&t)
+		if err != nil {
+			log.Println(*&err)
+			writeJSON(w, http.StatusConflict, *&j)
+			return
+		}
+		w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+		writeJSON(w, http.StatusAccepted, *&j)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,284 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//////// CONTENT SEARCH
+
+// Finds the lines of text files matching a literal string or a regular
+// expression, with the lines around them, like grep does.
+
+const searchMaxFileSize = 4 << 20
+const searchMaxContext = 10
+const searchMaxResults = 1000
+
+var errSearchDone = errors.New("search done")
+
+type searchQuery struct {
+	pattern *regexp.Regexp
+	before  int
+	after   int
+}
+
+type searchHit struct {
+	Uri    string   `json:"uri"`
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// Reads a query from the parameters of a request: q, regex, case, before
+// and after.
+func parseSearchQuery(r *http.Request) (q searchQuery, err error) {
+	v := r.URL.Query()
+	expr := v.Get("q")
+	if expr == "" {
+		return q, errors.New("empty query")
+	}
+	if v.Get("regex") != "true" {
+		expr = regexp.QuoteMeta(*&expr)
+	}
+	if v.Get("case") != "true" {
+		expr = "(?i)" + expr
+	}
+	q.pattern, err = regexp.Compile(*&expr)
+	if err != nil {
+		return
+	}
+	for name, n := range map[string]*int{"before": &q.before, "after": &q.after} {
+		if s := v.Get(name); s != "" {
+			*n, err = strconv.Atoi(*&s)
+			if err != nil || *n < 0 || *n > searchMaxContext {
+				return q, errors.New("invalid " + name + " context")
+			}
+		}
+	}
+	return
+}
+
+// Lines of a file, unless it looks binary.
+func textLines(content []byte) (lines []string, ok bool) {
+	head := content
+	if len(*&head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(*&head, 0) >= 0 {
+		return nil, false
+	}
+	return strings.Split(strings.Replace(string(*&content), "\r\n", "\n", -1), "\n"), true
+}
+
+// Searches the text files under a path, handing hits to emit until it
+// returns false.
+func searchTree(ctx context.Context, root string, q searchQuery, emit func(searchHit) bool) error {
+	err := walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || info.Size() > searchMaxFileSize {
+			return nil
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			return nil
+		}
+		lines, ok := textLines(*&content)
+		if !ok {
+			return nil
+		}
+		for i, line := range lines {
+			loc := q.pattern.FindStringIndex(*&line)
+			if loc == nil {
+				continue
+			}
+			hit := searchHit{Uri: pathToUri(filepath.ToSlash(*&p)), Line: i + 1, Column: loc[0] + 1, Text: line}
+			if q.before > 0 {
+				hit.Before = lines[maxInt(0, i-q.before):i]
+			}
+			if q.after > 0 {
+				hit.After = lines[i+1 : minInt(len(*&lines), i+1+q.after)]
+			}
+			if !emit(*&hit) {
+				return errSearchDone
+			}
+		}
+		return nil
+	})
+	if err == errSearchDone {
+		return nil
+	}
+	return err
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//// Streaming
+
+// Hits may also be sent as they are found, as JSON lines or server-sent
+// events, so that clients show them at once. The search stops when the
+// client goes away.
+
+const searchMaxStreamed = 100000
+
+func searchStreamFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case r.URL.Query().Get("stream") == "ndjson" || strings.Contains(*&accept, "application/x-ndjson"):
+		return "ndjson"
+	case r.URL.Query().Get("stream") == "sse" || strings.Contains(*&accept, "text/event-stream"):
+		return "sse"
+	}
+	return ""
+}
+
+func streamSearch(w http.ResponseWriter, r *http.Request, p string, q searchQuery, limit int, format string) {
+	rc := http.NewResponseController(w)
+	send := func(event string, v interface{}) bool {
+		j, err := json.Marshal(*&v)
+		if err != nil {
+			return false
+		}
+		if format == "sse" {
+			_, err = w.Write([]byte("event: " + event + "\ndata: " + string(*&j) + "\n\n"))
+		} else {
+			_, err = w.Write(append(*&j, '\n'))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+	if format == "sse" {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	count, truncated, gone := 0, false, false
+	err := searchTree(r.Context(), *&p, *&q, func(hit searchHit) bool {
+		if count == limit {
+			truncated = true
+			return false
+		}
+		count++
+		gone = !send("hit", *&hit)
+		return !gone
+	})
+	if gone || r.Context().Err() != nil {
+		return
+	}
+	done := map[string]interface{}{"done": true, "count": count, "truncated": truncated}
+	if err != nil {
+		done["error"] = err.Error()
+	}
+	send("done", *&done)
+}
+
+//////// REQUEST HANDLERS
+
+//// Search API
+
+// Search the content of the files under a path
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[searchPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !exist(*&p) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q, err := parseSearchQuery(*&r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	limit := searchMaxResults
+	if m := r.URL.Query().Get("max-results"); m != "" {
+		limit, err = strconv.Atoi(*&m)
+		if err != nil || limit < 1 || limit > searchMaxStreamed {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if format := searchStreamFormat(*&r); format != "" {
+		streamSearch(w, r, *&p, *&q, *&limit, *&format)
+		return
+	}
+	if limit > searchMaxResults {
+		limit = searchMaxResults
+	}
+	hits := []searchHit{}
+	truncated := false
+	err = searchTree(r.Context(), *&p, *&q, func(hit searchHit) bool {
+		if len(*&hits) == limit {
+			truncated = true
+			return false
+		}
+		hits = append(*&hits, *&hit)
+		return true
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"hits": hits, "truncated": truncated})
+}
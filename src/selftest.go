@@ -0,0 +1,172 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SELF-TEST
+
+// With -self-test the cloud runs a create, list, read, move and delete
+// cycle against itself in a directory of its own once listening, through
+// every middleware as the editor would, so that permission or path mapping
+// problems show up in the log and the status before anyone trips over them.
+
+const selfTestTimeout = 30 * time.Second
+
+type selfTestStatus struct {
+	mutex    sync.Mutex
+	started  time.Time
+	finished time.Time
+	// Name of the step which failed, and why
+	failed  string
+	problem string
+}
+
+var selfTest selfTestStatus
+
+func (s *selfTestStatus) report() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started.IsZero() {
+		return map[string]interface{}{"state": "skipped"}
+	}
+	report := map[string]interface{}{"started": milliseconds(s.started)}
+	switch {
+	case s.finished.IsZero():
+		report["state"] = "running"
+	case s.failed != "":
+		report["state"] = "failed"
+		report["step"] = s.failed
+		report["error"] = s.problem
+	default:
+		report["state"] = "passed"
+	}
+	if !s.finished.IsZero() {
+		report["finished"] = milliseconds(s.finished)
+	}
+	return report
+}
+
+func (s *selfTestStatus) done(step string, problem string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.finished = time.Now()
+	s.failed = step
+	s.problem = problem
+}
+
+type selfTestStep struct {
+	name    string
+	method  string
+	path    string
+	headers map[string]string
+	body    string
+	status  int
+	// Text the body contains, if any
+	contains string
+}
+
+func selfTestSteps(dir string) []selfTestStep {
+	return []selfTestStep{
+		{"create directory", "POST", dirPath + dir, nil, "", http.StatusCreated, ""},
+		{"create file", "POST", filePath + dir + "/a.txt", nil, "ninja", http.StatusCreated, ""},
+		{"list directory", "GET", dirPath + dir, nil, "", http.StatusOK, "a.txt"},
+		{"read file", "GET", filePath + dir + "/a.txt", nil, "", http.StatusOK, "ninja"},
+		{"move file", "PUT", filePath + dir + "/b.txt", map[string]string{"sourceURI": drivePrefix + dir + "/a.txt", "delete-source": "true"}, "", http.StatusNoContent, ""},
+		{"read moved file", "GET", filePath + dir + "/b.txt", nil, "", http.StatusOK, "ninja"},
+		{"delete file", "DELETE", filePath + dir + "/b.txt", nil, "", http.StatusNoContent, ""},
+		{"delete directory", "DELETE", dirPath + dir, nil, "", http.StatusNoContent, ""},
+	}
+}
+
+// Runs a step, telling what went wrong if anything did.
+func runSelfTestStep(client *http.Client, base string, token string, s selfTestStep) string {
+	req, err := http.NewRequest(s.method, base+s.path, strings.NewReader(s.body))
+	if err != nil {
+		return err.Error()
+	}
+	for k, v := range s.headers {
+		req.Header.Set(*&k, *&v)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(*&req)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error()
+	}
+	if resp.StatusCode != s.status {
+		problem := "expected status " + strconv.Itoa(s.status) + ", got " + strconv.Itoa(resp.StatusCode)
+		if len(body) > 0 && len(body) < 200 {
+			problem += ": " + strings.TrimSpace(string(*&body))
+		}
+		return problem
+	}
+	if s.contains != "" && !strings.Contains(string(*&body), s.contains) {
+		return "response lacks " + strconv.Quote(s.contains)
+	}
+	return ""
+}
+
+// Runs the cycle in the background against the cloud at the given base URL.
+func startSelfTest(base string) {
+	selfTest.mutex.Lock()
+	selfTest.started = time.Now()
+	selfTest.mutex.Unlock()
+	go func() {
+		client := &http.Client{Timeout: selfTestTimeout}
+		token := ownerToken()
+		if token == "" && authEnabled() {
+			// Owners without a token sign in otherwise, a key stands in
+			k := issueKey(ownerUser, "self-test", []string{scopeRead, scopeWrite})
+			defer metadata.delete(keysBucket, k.Id)
+			token = k.Key
+		}
+		dir := "ninja-self-test-" + randomString(6)
+		steps := selfTestSteps(*&dir)
+		for i, s := range steps {
+			problem := runSelfTestStep(*&client, *&base, *&token, *&s)
+			if problem == "" {
+				continue
+			}
+			logWarn("Self-test failed to "+s.name+":", problem)
+			// Leaves nothing behind once the directory exists
+			if i > 0 {
+				runSelfTestStep(*&client, *&base, *&token, steps[len(steps)-1])
+			}
+			selfTest.done(s.name, *&problem)
+			return
+		}
+		selfTest.done("", "")
+		logInfo("Self-test passed")
+	}()
+}
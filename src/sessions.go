@@ -0,0 +1,231 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SESSIONS
+
+// Browsers log in once and get a session cookie instead of carrying a
+// token in every URL. Cookies hold the user and expiry, signed with a key
+// from -session-secret, or drawn at startup so that restarts log out,
+// except soft ones.
+
+const sessionCookie = "ninja_session"
+
+var sessionKey []byte
+
+// Ended sessions not expired yet, by signature
+var revokedSessions = struct {
+	sync.Mutex
+	expiries map[string]time.Time
+}{expiries: make(map[string]time.Time)}
+
+type sessionInfo struct {
+	User    string `json:"user"`
+	Expires string `json:"expires"`
+	Root    string `json:"root"`
+}
+
+func initSessions() {
+	if sessionSecretFlag != "" {
+		sessionKey = []byte(sessionSecretFlag)
+		return
+	}
+	// Kept over soft restarts
+	if handoff != nil && len(handoff.SessionKey) > 0 {
+		sessionKey = handoff.SessionKey
+		return
+	}
+	sessionKey = make([]byte, 32)
+	rand.Read(sessionKey)
+}
+
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(*&payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newSession(user string, expires time.Time) string {
+	nonce := make([]byte, 12)
+	rand.Read(*&nonce)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." +
+		strconv.FormatInt(expires.Unix(), 10) + "." +
+		base64.RawURLEncoding.EncodeToString(*&nonce)
+	return payload + "." + signSession(*&payload)
+}
+
+// Checks a session cookie, returning its user, expiry and signature.
+func parseSession(value string) (user string, expires time.Time, signature string, ok bool) {
+	i := strings.LastIndex(*&value, ".")
+	if i < 0 {
+		return
+	}
+	payload, signature := value[:i], value[i+1:]
+	if !secureEquals(signSession(*&payload), *&signature) {
+		return
+	}
+	parts := strings.Split(*&payload, ".")
+	if len(parts) != 3 {
+		return
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+	expires = time.Unix(*&unix, 0)
+	if time.Now().After(*&expires) {
+		return
+	}
+	revokedSessions.Lock()
+	_, revoked := revokedSessions.expiries[signature]
+	revokedSessions.Unlock()
+	return string(*&name), expires, signature, !revoked
+}
+
+func sessionUser(r *http.Request) (user string, ok bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return
+	}
+	user, _, _, ok = parseSession(c.Value)
+	return
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     basePathFlag + "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   requestScheme(*&r) == "https",
+		// Never sent along requests made by other sites
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func revokeSession(signature string, expires time.Time) {
+	revokedSessions.Lock()
+	defer revokedSessions.Unlock()
+	for s, e := range revokedSessions.expiries {
+		if time.Now().After(e) {
+			delete(revokedSessions.expiries, *&s)
+		}
+	}
+	revokedSessions.expiries[signature] = expires
+}
+
+//////// REQUEST HANDLERS
+
+//// Authentication API
+
+// Log in, log out, or describe the current session
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	switch r.URL.Path[authPathLen:] {
+	case "oidc":
+		if !oidcEnabled() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		startOIDCLogin(w, r)
+		return
+	case "oidc/callback":
+		if !oidcEnabled() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		finishOIDCLogin(w, r)
+		return
+	case "login":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// Credentials as JSON, or as usual for scripts
+		var c credentials
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			err := json.NewDecoder(r.Body).Decode(&c)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		} else {
+			c = requestCredentials(*&r)
+		}
+		user, ok := checkCredentials(*&c)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		expires := time.Now().Add(sessionLifetimeFlag).Truncate(time.Second)
+		setSessionCookie(w, r, newSession(*&user, *&expires), *&expires)
+		writeJSON(w, http.StatusOK, sessionInfo{*&user, milliseconds(*&expires), rootUri(withUser(*&r, *&user))})
+		return
+	case "logout":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if _, expires, signature, ok := parseSession(c.Value); ok {
+				revokeSession(*&signature, *&expires)
+			}
+		}
+		setSessionCookie(w, r, "", time.Unix(0, 0))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "session":
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c, err := r.Cookie(sessionCookie)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user, expires, _, ok := parseSession(c.Value)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, sessionInfo{*&user, milliseconds(*&expires), rootUri(withUser(*&r, *&user))})
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,106 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+//////// PROJECT SETTINGS
+
+// Kept in the metadata store, keyed by project path so that preferences
+// follow projects when they are moved or copied.
+const settingsBucket = "settings"
+
+// Name of the file settings were stored in before the metadata store.
+const settingsFile = hiddenPrefix + "settings.json"
+
+func readSettings(project string) (settings []byte, err error) {
+	s, ok := metadata.get(settingsBucket, metadataKey(*&project))
+	if !ok {
+		return []byte("{}"), nil
+	}
+	settings = []byte(*&s)
+	return
+}
+
+func writeSettings(project string, settings []byte) (err error) {
+	if !json.Valid(*&settings) {
+		return os.ErrInvalid
+	}
+	metadata.put(settingsBucket, metadataKey(*&project), string(*&settings))
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Settings API
+
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	p, ok := uriToPath(r.URL.Path[settingsPathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		// Read the settings of a project
+		settings, err := readSettings(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(*&settings)
+		return
+	case "PUT":
+		// Replace the settings of a project
+		settings, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = writeSettings(*&p, *&settings)
+		if err == os.ErrInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
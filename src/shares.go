@@ -0,0 +1,340 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// SHARE LINKS
+
+// Links giving anyone holding them read access to a file or directory, or
+// the right to upload new files into a directory, until they expire. They
+// act on behalf of their creator, so losing access also ends their shares.
+// Only a digest of their token is kept, which identifies them.
+
+const sharesBucket = "shares"
+const defaultShareLifetime = 7 * 24 * time.Hour
+
+const (
+	shareRead   = "read"
+	shareUpload = "upload"
+)
+
+type share struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	Mode    string `json:"mode"`
+	Creator string `json:"creator"`
+	Created string `json:"created"`
+	Expires string `json:"expires"`
+	// Only returned when created
+	Token string `json:"token,omitempty"`
+	Url   string `json:"url,omitempty"`
+
+	expires time.Time
+}
+
+// Share a link token stands for.
+func loadShare(token string) (s share, ok bool) {
+	return loadShareById(keyDigest(*&token))
+}
+
+func loadShareById(id string) (s share, ok bool) {
+	v, ok := metadata.get(sharesBucket, *&id)
+	if !ok || json.Unmarshal([]byte(*&v), &s) != nil {
+		return s, false
+	}
+	s.Id = id
+	s.expires = parseMilliseconds(s.Expires)
+	if time.Now().After(s.expires) {
+		metadata.delete(sharesBucket, *&id)
+		return s, false
+	}
+	return s, true
+}
+
+func parseMilliseconds(ms string) time.Time {
+	n, _ := strconv.ParseInt(*&ms, 10, 64)
+	return time.Unix(0, n*int64(time.Millisecond))
+}
+
+// Shares of a user, or all of them for the owner.
+func listShares(user string) (list []share) {
+	list = []share{}
+	for _, id := range metadata.keys(sharesBucket, ".") {
+		s, ok := loadShareById(*&id)
+		if ok && (user == ownerUser || s.Creator == user) {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// Operation a share needs its creator to be allowed.
+func shareOperation(mode string) string {
+	if mode == shareUpload {
+		return opWrite
+	}
+	return opRead
+}
+
+func createShare(r *http.Request) (s share, status int) {
+	var params struct {
+		Path     string `json:"path"`
+		Mode     string `json:"mode"`
+		Lifetime string `json:"lifetime"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		return s, http.StatusBadRequest
+	}
+	if params.Mode == "" {
+		params.Mode = shareRead
+	}
+	lifetime := defaultShareLifetime
+	if params.Lifetime != "" {
+		lifetime, err = time.ParseDuration(params.Lifetime)
+		if err != nil || lifetime <= 0 {
+			return s, http.StatusBadRequest
+		}
+	}
+	p, ok := uriToPath(params.Path)
+	if !ok || params.Mode != shareRead && params.Mode != shareUpload {
+		return s, http.StatusBadRequest
+	}
+	info, err := properties(*&p)
+	if err != nil {
+		return s, http.StatusNotFound
+	}
+	if params.Mode == shareUpload && !info.IsDir() {
+		return s, http.StatusBadRequest
+	}
+	user := requestUser(*&r)
+	if authEnabled() && !allowed(*&user, *&p, shareOperation(params.Mode)) {
+		return s, http.StatusForbidden
+	}
+	s, err = saveShare(*&user, *&p, params.Mode, *&lifetime, externalUrl(*&r, ""))
+	if err != nil {
+		log.Println(*&err)
+		return s, http.StatusInternalServerError
+	}
+	return s, http.StatusCreated
+}
+
+// Records a new share, whose link starts with the given base URL.
+func saveShare(user string, p string, mode string, lifetime time.Duration, base string) (s share, err error) {
+	now := time.Now()
+	token := randomString(24)
+	s = share{
+		Id:      keyDigest(*&token),
+		Path:    pathToUri(*&p),
+		Mode:    mode,
+		Creator: user,
+		Created: milliseconds(*&now),
+		Expires: milliseconds(now.Add(*&lifetime)),
+	}
+	j, err := json.Marshal(*&s)
+	if err != nil {
+		return
+	}
+	s.expires = now.Add(*&lifetime)
+	metadata.put(sharesBucket, s.Id, string(*&j))
+	s.Token = token
+	s.Url = base + sharedPath + token + "/"
+	return
+}
+
+// Shares used to be recorded under their token.
+func hashShareTokens(s *kvStore) error {
+	b := s.data[sharesBucket]
+	for token, v := range b {
+		var sh share
+		if json.Unmarshal([]byte(*&v), &sh) != nil || sh.Token == "" {
+			continue
+		}
+		sh.Token, sh.Url = "", ""
+		j, err := json.Marshal(*&sh)
+		if err != nil {
+			return err
+		}
+		delete(*&b, *&token)
+		b[keyDigest(*&token)] = string(*&j)
+	}
+	return nil
+}
+
+// Keeps anonymous uploads within the quota of the share creator.
+func shareQuotaExceeded(creator string, size int64) bool {
+	dir, ok := tenantDir(*&creator)
+	if !ok {
+		return false
+	}
+	quota := tenantQuota(*&creator)
+	if quota <= 0 {
+		return false
+	}
+	defer forgetTenantUsage(*&creator)
+	used, err := tenantUsed(*&creator, *&dir)
+	return err != nil || used+size > quota
+}
+
+//////// REQUEST HANDLERS
+
+//// Shares API
+
+// List, create or revoke the share links of the user
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	token := r.URL.Path[sharesPathLen:]
+	switch {
+	case r.Method == "GET" && token == "":
+		writeJSON(w, http.StatusOK, listShares(requestUser(*&r)))
+		return
+	case r.Method == "POST" && token == "":
+		s, status := createShare(*&r)
+		if status != http.StatusCreated {
+			w.WriteHeader(*&status)
+			return
+		}
+		w.Header().Set("Location", s.Url)
+		writeJSON(w, *&status, *&s)
+		return
+	case r.Method == "DELETE" && token != "":
+		// By identifier, or by the token of the link
+		s, ok := loadShareById(*&token)
+		if !ok {
+			s, ok = loadShare(*&token)
+		}
+		user := requestUser(*&r)
+		if !ok || user != ownerUser && s.Creator != user {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		metadata.delete(sharesBucket, s.Id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+//// Shared content
+
+// Read what a link shares, or upload into it
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	rest := r.URL.Path[sharedPathLen:]
+	token, name := rest, ""
+	if i := strings.Index(*&rest, "/"); i >= 0 {
+		token, name = rest[:i], rest[i+1:]
+	}
+	s, ok := loadShare(*&token)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	root, ok := uriToPath(s.Path)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, ok := uriToPath(s.Path + "/" + name)
+	if !ok || !isUnderPrefix(*&p, *&root) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if authEnabled() && !allowed(s.Creator, *&p, shareOperation(s.Mode)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if s.Mode != shareRead {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		info, err := properties(*&p)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if info.IsDir() {
+			list, err := listDir(r.Context(), *&p, false, nil, "", nil)
+			if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, *&list)
+			return
+		}
+		if r.URL.Query().Get("preview") == "true" {
+			servePreview(w, r, *&p)
+			return
+		}
+		err = serveLargeFile(w, r, *&p, *&info)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	case "POST":
+		// New files only, straight into the shared directory
+		if s.Mode != shareUpload {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if name == "" || strings.Contains(*&name, "/") || strings.HasPrefix(*&name, hiddenPrefix) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if shareQuotaExceeded(s.Creator, int64(len(*&content))) {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		err = writeFile(*&p, *&content, false)
+		if err == os.ErrExist {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordCreation(*&p)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,81 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShareTokensNotStored(t *testing.T) {
+	h := newTestCloud(t)
+	createDir("p")
+	saveFile("p/a.txt", []byte("a"))
+
+	w := serveTest(h, testRequest{"POST", "/shares/", nil, `{"path": "Z:/Ninja/p"}`})
+	var created share
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %v", w.Code, err)
+	}
+	if created.Token == "" || !strings.Contains(created.Url, created.Token) {
+		t.Fatalf("create: %+v", created)
+	}
+	for _, id := range metadata.keys(sharesBucket, ".") {
+		v, _ := metadata.get(sharesBucket, *&id)
+		if strings.Contains(id+v, created.Token) {
+			t.Errorf("token stored: %s %s", id, v)
+		}
+	}
+
+	if w := serveTest(h, testRequest{"GET", "/shared/" + created.Token + "/a.txt", nil, ""}); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("shared: %d %q", w.Code, w.Body.String())
+	}
+	// The identifier is no credential
+	if w := serveTest(h, testRequest{"GET", "/shared/" + created.Id + "/a.txt", nil, ""}); w.Code != http.StatusNotFound {
+		t.Errorf("shared by id: %d", w.Code)
+	}
+
+	w = serveTest(h, testRequest{"GET", "/shares/", nil, ""})
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Token) || !strings.Contains(w.Body.String(), created.Id) {
+		t.Errorf("list: %d %q", w.Code, w.Body.String())
+	}
+	if w := serveTest(h, testRequest{"DELETE", "/shares/" + created.Id, nil, ""}); w.Code != http.StatusNoContent {
+		t.Errorf("revoke: %d", w.Code)
+	}
+	if w := serveTest(h, testRequest{"GET", "/shared/" + created.Token + "/a.txt", nil, ""}); w.Code != http.StatusNotFound {
+		t.Errorf("revoked: %d", w.Code)
+	}
+}
+
+func TestShareTokensMigrated(t *testing.T) {
+	s := &kvStore{data: map[string]map[string]string{
+		sharesBucket: {"plain": `{"token":"plain","path":"Z:/Ninja/p","mode":"read","url":"http://x/shared/plain/"}`},
+	}}
+	err := hashShareTokens(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := s.data[sharesBucket][keyDigest("plain")]
+	if !ok || len(s.data[sharesBucket]) != 1 || strings.Contains(*&v, "plain") {
+		t.Errorf("migrated: %v", s.data[sharesBucket])
+	}
+}
@@ -0,0 +1,174 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// SIGNED URLS
+
+// File URLs carrying their own proof of access, for pages which reference
+// assets without being able to send cookies or tokens. They are signed on
+// behalf of a user, for one file and until they expire.
+
+const defaultSignedLifetime = time.Hour
+const maxSignedLifetime = 7 * 24 * time.Hour
+
+func urlSignature(user string, p string, expires string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("GET\n" + user + "\n" + p + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Signs the Files API URL reading a file.
+func signedFileUrl(r *http.Request, user string, p string, lifetime time.Duration) (u string, expires time.Time) {
+	expires = time.Now().Add(*&lifetime).Truncate(time.Second)
+	e := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{
+		"signer":    {user},
+		"expires":   {e},
+		"signature": {urlSignature(*&user, *&p, *&e)},
+	}
+	u = externalUrl(*&r, filePath+strings.TrimPrefix(pathToUri(*&p), drivePrefix)) + "?" + q.Encode()
+	return
+}
+
+// User on behalf of whom a file read was signed.
+func signedUser(r *http.Request) (user string, ok bool) {
+	q := r.URL.Query()
+	signature := q.Get("signature")
+	if signature == "" || r.Method != "GET" && r.Method != "HEAD" || !strings.HasPrefix(r.URL.Path, filePath) {
+		return
+	}
+	unix, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[filePathLen:])
+	if !ok {
+		return
+	}
+	user = q.Get("signer")
+	if !secureEquals(urlSignature(*&user, *&p, q.Get("expires")), *&signature) {
+		return "", false
+	}
+	return
+}
+
+//// Rendered pages
+
+// Pages given to the headless browser are signed for the directory holding
+// them, so that the files they load from there are let in too: those carry
+// no signature of their own, but refer to the signed page.
+
+func renderSignature(user string, scope string, expires string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("RENDER\n" + user + "\n" + scope + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Signs the static URL of a page for the files of its directory.
+func signedPageQuery(user string, p string, lifetime time.Duration) string {
+	e := strconv.FormatInt(time.Now().Add(*&lifetime).Unix(), 10)
+	scope := metadataKey(filepath.Dir(*&p))
+	q := url.Values{
+		"signer":           {user},
+		"expires":          {e},
+		"scope":            {scope},
+		"render-signature": {renderSignature(*&user, *&scope, *&e)},
+	}
+	return q.Encode()
+}
+
+// User on behalf of whom a page was rendered, for the static reads of the
+// page and of the files it loads.
+func renderUser(r *http.Request) (user string, ok bool) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return
+	}
+	if _, pattern := http.DefaultServeMux.Handler(*&r); pattern != "/" {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("render-signature") == "" {
+		referer, err := url.Parse(r.Referer())
+		if err != nil {
+			return
+		}
+		q = referer.Query()
+	}
+	signature := q.Get("render-signature")
+	unix, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if signature == "" || err != nil || time.Now().Unix() > unix {
+		return
+	}
+	p, ok := requestPath(*&r)
+	scope := q.Get("scope")
+	if !ok || !isUnderPrefix(*&p, *&scope) {
+		return "", false
+	}
+	user = q.Get("signer")
+	if !secureEquals(renderSignature(*&user, *&scope, q.Get("expires")), *&signature) {
+		return "", false
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Signing API
+
+// Sign a URL reading a file, valid for the "lifetime" parameter
+func signHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[signPathLen:])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if info, err := properties(*&p); err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	lifetime := defaultSignedLifetime
+	if l := r.URL.Query().Get("lifetime"); l != "" {
+		var err error
+		lifetime, err = time.ParseDuration(*&l)
+		if err != nil || lifetime <= 0 || lifetime > maxSignedLifetime {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	u, expires := signedFileUrl(*&r, requestUser(*&r), *&p, *&lifetime)
+	writeJSON(w, http.StatusOK, map[string]string{"url": u, "expires": milliseconds(*&expires)})
+}
@@ -0,0 +1,539 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SNAPSHOTS
+
+// Restore points of the projects directory taken by the filesystem itself,
+// instantly and without copying, on btrfs, ZFS and APFS. They are taken on
+// demand, and automatically before operations which are hard to undo.
+
+const snapshotsBucket = "snapshots"
+
+var snapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+var apfsSnapshotRegexp = regexp.MustCompile(`\d{4}-\d{2}-\d{2}-\d{6}`)
+
+var errSnapshotExists = errors.New("snapshot already exists")
+
+type snapshot struct {
+	Name    string `json:"name"`
+	Created string `json:"created"`
+	Reason  string `json:"reason,omitempty"`
+	Auto    bool   `json:"auto"`
+	Ref     string `json:"ref"`
+}
+
+// Ways of a filesystem to take, read and discard snapshots, read through
+// a directory released once done.
+type snapshotDriver struct {
+	create  func(name string) (ref string, err error)
+	mount   func(ref string) (dir string, release func(), err error)
+	destroy func(ref string) error
+}
+
+var snapshotDrivers = map[string]func(dir string, mountpoint string) (snapshotDriver, error){
+	"btrfs": btrfsSnapshots,
+	"zfs":   zfsSnapshots,
+	"apfs":  apfsSnapshots,
+}
+
+var snapshots *snapshotDriver
+var snapshotMutex sync.Mutex
+
+func runTool(name string, args ...string) (out string, err error) {
+	o, err := exec.Command(*&name, args...).CombinedOutput()
+	out = strings.TrimSpace(string(*&o))
+	if err != nil {
+		err = fmt.Errorf("%s: %v: %s", name, err, out)
+	}
+	return
+}
+
+func noRelease() {}
+
+//// Drivers
+
+// Read-only snapshots of the subvolume holding the projects, kept next to
+// it, which has to be one.
+func btrfsSnapshots(dir string, mountpoint string) (d snapshotDriver, err error) {
+	_, err = runTool("btrfs", "subvolume", "show", *&dir)
+	if err != nil {
+		return d, fmt.Errorf("projects directory is not a btrfs subvolume: %v", err)
+	}
+	store := filepath.Join(filepath.Dir(*&dir), hiddenPrefix+"snapshots")
+	err = os.MkdirAll(*&store, 0777)
+	d.create = func(name string) (string, error) {
+		ref := filepath.Join(*&store, *&name)
+		_, err := runTool("btrfs", "subvolume", "snapshot", "-r", dir, ref)
+		return ref, err
+	}
+	d.mount = func(ref string) (string, func(), error) {
+		return ref, noRelease, nil
+	}
+	d.destroy = func(ref string) error {
+		_, err := runTool("btrfs", "subvolume", "delete", *&ref)
+		return err
+	}
+	return
+}
+
+// Snapshots of the dataset holding the projects, read through its hidden
+// .zfs directory.
+func zfsSnapshots(dir string, mountpoint string) (d snapshotDriver, err error) {
+	dataset, err := runTool("zfs", "list", "-H", "-o", "name", *&dir)
+	if err != nil {
+		return
+	}
+	mountpoint, err = runTool("zfs", "get", "-H", "-o", "value", "mountpoint", *&dataset)
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(*&mountpoint, *&dir)
+	if err != nil {
+		return
+	}
+	d.create = func(name string) (string, error) {
+		ref := dataset + "@ninja-" + name
+		_, err := runTool("zfs", "snapshot", *&ref)
+		return ref, err
+	}
+	d.mount = func(ref string) (string, func(), error) {
+		name := ref[strings.LastIndex(*&ref, "@")+1:]
+		return filepath.Join(*&mountpoint, ".zfs", "snapshot", *&name, *&rel), noRelease, nil
+	}
+	d.destroy = func(ref string) error {
+		_, err := runTool("zfs", "destroy", *&ref)
+		return err
+	}
+	return
+}
+
+// Local Time Machine snapshots of the volume holding the projects, named
+// by their date, mounted read-only to be read.
+func apfsSnapshots(dir string, mountpoint string) (d snapshotDriver, err error) {
+	if mountpoint == "" {
+		return d, errors.New("mount point of the projects directory unknown")
+	}
+	rel, err := filepath.Rel(*&mountpoint, *&dir)
+	if err != nil {
+		return
+	}
+	d.create = func(name string) (string, error) {
+		out, err := runTool("tmutil", "localsnapshot", mountpoint)
+		if err != nil {
+			return "", err
+		}
+		ref := apfsSnapshotRegexp.FindString(*&out)
+		if ref == "" {
+			return "", fmt.Errorf("tmutil: unexpected output: %s", out)
+		}
+		return ref, nil
+	}
+	d.mount = func(ref string) (string, func(), error) {
+		tmp, err := ioutil.TempDir("", "ninja-snapshot")
+		if err != nil {
+			return "", nil, err
+		}
+		_, err = runTool("mount_apfs", "-o", "rdonly", "-s", "com.apple.TimeMachine."+ref+".local", mountpoint, tmp)
+		if err != nil {
+			os.Remove(*&tmp)
+			return "", nil, err
+		}
+		release := func() {
+			_, err := runTool("umount", *&tmp)
+			if err != nil {
+				log.Println(*&err)
+			}
+			os.Remove(*&tmp)
+		}
+		return filepath.Join(*&tmp, *&rel), release, nil
+	}
+	d.destroy = func(ref string) error {
+		_, err := runTool("tmutil", "deletelocalsnapshots", *&ref)
+		return err
+	}
+	return
+}
+
+// Picks the driver of the filesystem holding the projects directory, or
+// the one named by the flag.
+func initSnapshots(dir string) (err error) {
+	if backendFlag != "disk" || overlayFlag != "" {
+		return errors.New("snapshots need the disk backend without overlay")
+	}
+	fstype, mountpoint, err := fsType(*&dir)
+	if err != nil {
+		return
+	}
+	name := snapshotsFlag
+	if name == "auto" {
+		name = fstype
+	}
+	driver, ok := snapshotDrivers[name]
+	if !ok {
+		return fmt.Errorf("no snapshots on the filesystem of %s (%s)", dir, fstype)
+	}
+	d, err := driver(*&dir, *&mountpoint)
+	if err != nil {
+		return
+	}
+	snapshots = &d
+	logInfo("Snapshots taken by", name)
+	return
+}
+
+//// Restore points
+
+func loadSnapshot(name string) (s snapshot, ok bool) {
+	v, ok := metadata.get(snapshotsBucket, *&name)
+	if !ok || json.Unmarshal([]byte(*&v), &s) != nil {
+		return s, false
+	}
+	return s, true
+}
+
+// Snapshots from the oldest to the most recent.
+func listSnapshots() (list []snapshot) {
+	list = []snapshot{}
+	for _, name := range metadata.keys(snapshotsBucket, ".") {
+		if s, ok := loadSnapshot(*&name); ok {
+			list = append(list, s)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return parseMilliseconds(list[i].Created).Before(parseMilliseconds(list[j].Created))
+	})
+	return
+}
+
+// Takes a snapshot, named after its time and reason when not named, and
+// prunes the oldest automatic ones beyond the number to keep.
+func takeSnapshot(name string, reason string, auto bool) (s snapshot, err error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	now := time.Now()
+	if name == "" {
+		name = now.Format("20060102-150405")
+		if reason != "" {
+			name = reason + "-" + name
+		}
+		for i := 2; ; i++ {
+			if _, exists := loadSnapshot(*&name); !exists {
+				break
+			}
+			name = strings.TrimSuffix(*&name, "-"+strconv.Itoa(i-1)) + "-" + strconv.Itoa(*&i)
+		}
+	}
+	if !snapshotNameRegexp.MatchString(*&name) {
+		return s, os.ErrInvalid
+	}
+	if _, exists := loadSnapshot(*&name); exists {
+		return s, errSnapshotExists
+	}
+	ref, err := snapshots.create(*&name)
+	if err != nil {
+		return
+	}
+	s = snapshot{Name: name, Created: milliseconds(*&now), Reason: reason, Auto: auto, Ref: ref}
+	j, err := json.Marshal(*&s)
+	if err != nil {
+		return
+	}
+	metadata.put(snapshotsBucket, *&name, string(*&j))
+	if auto {
+		pruneSnapshots()
+	}
+	return
+}
+
+func pruneSnapshots() {
+	var autos []snapshot
+	for _, s := range listSnapshots() {
+		if s.Auto {
+			autos = append(autos, s)
+		}
+	}
+	for len(autos) > snapshotsKeepFlag {
+		err := snapshots.destroy(autos[0].Ref)
+		if err != nil {
+			log.Println(*&err)
+			return
+		}
+		metadata.delete(snapshotsBucket, autos[0].Name)
+		autos = autos[1:]
+	}
+}
+
+func deleteSnapshot(name string) (err error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	s, ok := loadSnapshot(*&name)
+	if !ok {
+		return os.ErrNotExist
+	}
+	err = snapshots.destroy(s.Ref)
+	if err != nil {
+		return
+	}
+	metadata.delete(snapshotsBucket, *&name)
+	return
+}
+
+// Takes a restore point before a risky operation, which goes on anyway
+// when it can't be taken.
+func snapshotBefore(reason string) {
+	if snapshots == nil {
+		return
+	}
+	s, err := takeSnapshot("", *&reason, true)
+	if err != nil {
+		logWarn("Snapshot before", reason, "failed:", err)
+		return
+	}
+	logDebug("fs", "Took snapshot", s.Name)
+}
+
+// Puts a path back in the state it had in a snapshot, after taking one of
+// its current state. Files the cloud keeps for itself are left alone.
+func restoreSnapshot(ctx context.Context, s snapshot, p string) (undo snapshot, err error) {
+	dir, release, err := snapshots.mount(s.Ref)
+	if err != nil {
+		return
+	}
+	defer release()
+	source := filepath.Join(*&dir, *&p)
+	if _, err = os.Stat(*&source); err != nil {
+		return
+	}
+	undo, err = takeSnapshot("", "restore", true)
+	if err != nil {
+		return
+	}
+	err = clearTree(*&p)
+	if err != nil {
+		return
+	}
+	err = filepath.Walk(*&source, func(sp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		err = ioPause(*&ctx)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*&source, *&sp)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(*&p, *&rel)
+		if info.IsDir() {
+			return createDir(*&dest)
+		}
+		return copyIntoStorage(*&sp, *&dest)
+	})
+	return
+}
+
+// Copies a file of the local filesystem through the storage backend.
+func copyIntoStorage(source string, dest string) (err error) {
+	sf, err := os.Open(*&source)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	df, err := fsys.create(*&dest, 0777)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(*&df, *&sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// Removes a file, or the content of a directory but the hidden files of
+// the cloud.
+func clearTree(p string) (err error) {
+	info, err := fsys.stat(*&p)
+	if os.IsNotExist(*&err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return removeFile(*&p)
+	}
+	entries, err := fsys.readDir(*&p)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), hiddenPrefix) {
+			continue
+		}
+		if e.IsDir() {
+			err = clearTree(filepath.Join(*&p, e.Name()))
+			if err == nil {
+				err = fsys.remove(filepath.Join(*&p, e.Name()))
+			}
+		} else {
+			err = removeFile(filepath.Join(*&p, e.Name()))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Snapshots API
+
+// List, take, delete and restore snapshots of the projects
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if snapshots == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := r.URL.Path[snapshotsPathLen:]
+	if name == "" {
+		if !isModerator(*&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, listSnapshots())
+			return
+		case "POST":
+			// Take a snapshot, optionally named and described
+			var req struct {
+				Name   string `json:"name"`
+				Reason string `json:"reason"`
+			}
+			if r.ContentLength != 0 {
+				err := json.NewDecoder(*&r.Body).Decode(&req)
+				if err != nil && err != io.EOF {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			s, err := takeSnapshot(req.Name, req.Reason, false)
+			if err == os.ErrInvalid {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if err == errSnapshotExists {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, *&s)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := loadSnapshot(*&name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !isModerator(*&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&s)
+		return
+	case "DELETE":
+		if !isModerator(*&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		err := deleteSnapshot(*&name)
+		if err == os.ErrNotExist {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "POST":
+		// Restore the projects, or the path given as parameter
+		p, ok := requestPath(*&r)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if authEnabled() && !allowed(requestUser(*&r), *&p, opWrite) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		undo, err := restoreSnapshot(r.Context(), *&s, *&p)
+		if os.IsNotExist(*&err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"restored": s.Name, "path": pathToUri(*&p), "undo": undo.Name})
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,344 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// SOFT RESTART
+
+// The cloud restarts in place to apply a new configuration or a staged
+// update without ending the editing sessions. The requests in progress are
+// completed, then the new instance takes over the listening socket, so that
+// connections made meanwhile wait instead of being refused, the session
+// key, so that browsers stay logged in, and the background jobs, which are
+// given time to finish and whose results stay available. Jobs still running
+// after that are not resumed: they are handed over as interrupted, and
+// listed by the restart report, for clients to start them again.
+
+// Time given to the running jobs to finish before they are canceled
+const restartJobsTimeout = time.Minute
+
+// Environment variable locating the state handed over by the previous
+// instance, in a file only readable by the user
+const handoffEnv = "NINJA_HANDOFF"
+
+const handoffPrefix = "ninja-handoff-"
+
+var errRestartPending = errors.New("a restart is already pending")
+
+type handoffJob struct {
+	job
+	User         string    `json:"user"`
+	FinishedTime time.Time `json:"finished-time"`
+}
+
+type handoffState struct {
+	// Inherited descriptor of the listening socket, -1 if none
+	ListenerFd      int                  `json:"listener-fd"`
+	SessionKey      []byte               `json:"session-key"`
+	RevokedSessions map[string]time.Time `json:"revoked-sessions"`
+	Jobs            []handoffJob         `json:"jobs"`
+	NextJob         int                  `json:"next-job"`
+	Restarts        int                  `json:"restarts"`
+	Started         string               `json:"started"`
+	// Jobs the restart interrupted
+	Interrupted []string `json:"interrupted"`
+}
+
+// What was handed over at startup, nil if the cloud was not restarted
+var handoff *handoffState
+
+// Listener of the cloud, handed over on restart
+var cloudListener net.Listener
+
+var restart struct {
+	sync.Mutex
+	pending bool
+	reason  string
+	// Duplicate of the listening socket, nil if it cannot be inherited
+	listener *os.File
+}
+
+// Stops serving to restart in place, serveCommand doing it once the
+// requests in progress are completed.
+func requestRestart(reason string) (err error) {
+	restart.Lock()
+	defer restart.Unlock()
+	if restart.pending {
+		return errRestartPending
+	}
+	if cloudListener == nil {
+		return errors.New("the cloud is not serving yet")
+	}
+	f, err := handOverListener(cloudListener)
+	if err != nil {
+		return
+	}
+	restart.pending, restart.reason, restart.listener = true, reason, f
+	requestStop(*&reason)
+	return nil
+}
+
+func restartRequested() bool {
+	restart.Lock()
+	defer restart.Unlock()
+	return restart.pending
+}
+
+func watchRestartSignals() {
+	if len(restartSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, restartSignals...)
+	go func() {
+		for s := range signals {
+			err := requestRestart("Received " + s.String())
+			if err != nil {
+				log.Println(*&err)
+			}
+		}
+	}()
+}
+
+// Hands the state over to a new instance of the executable, which replaces
+// this one. Only returns on failure.
+func restartInPlace() (err error) {
+	logInfo("Waiting for the background jobs before restarting")
+	interrupted := jobs.drain(restartJobsTimeout)
+	flushState()
+
+	state := handoffState{ListenerFd: -1, SessionKey: sessionKey, Started: milliseconds(processStart)}
+	if handoff != nil {
+		state.Restarts = handoff.Restarts
+		state.Started = handoff.Started
+	}
+	state.Restarts++
+	revokedSessions.Lock()
+	state.RevokedSessions = revokedSessions.expiries
+	revokedSessions.Unlock()
+	state.Jobs, state.NextJob = jobs.handOver()
+	state.Interrupted = interruptedJobs(state.Jobs, *&interrupted)
+	restart.Lock()
+	f := restart.listener
+	restart.Unlock()
+	if f != nil {
+		state.ListenerFd, err = inheritFile(*&f)
+		if err != nil {
+			return
+		}
+	}
+
+	content, err := json.Marshal(*&state)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile("", handoffPrefix+"*.json")
+	if err != nil {
+		return
+	}
+	err = writeAndClose(*&tmp, *&content)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Setenv(handoffEnv, tmp.Name())
+	// The descriptors of socket activation are not the ones handed over
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	logInfo("Restarting in place")
+	err = restartProcess(*&exe)
+	os.Remove(tmp.Name())
+	return
+}
+
+// Reads the state handed over by the previous instance, if restarted.
+func takeHandoff() {
+	p := os.Getenv(handoffEnv)
+	if p == "" {
+		return
+	}
+	os.Unsetenv(handoffEnv)
+	// Never remove anything else named by the environment
+	if !strings.HasPrefix(filepath.Base(*&p), handoffPrefix) {
+		logWarn("Ignoring", handoffEnv, "not naming a handed over state")
+		return
+	}
+	defer os.Remove(*&p)
+	content, err := ioutil.ReadFile(*&p)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	var state handoffState
+	err = json.Unmarshal(*&content, &state)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	handoff = &state
+	revokedSessions.Lock()
+	for s, e := range state.RevokedSessions {
+		revokedSessions.expiries[s] = e
+	}
+	revokedSessions.Unlock()
+	jobs.takeOver(state.Jobs, state.NextJob)
+	logInfo("Restarted in place,", len(state.Jobs), "jobs taken over")
+}
+
+// The listening socket handed over by the previous instance, if any.
+func handedOverListener() (l net.Listener, ok bool, err error) {
+	if handoff == nil || handoff.ListenerFd < 0 {
+		return nil, false, nil
+	}
+	f := os.NewFile(uintptr(handoff.ListenerFd), "handed-over-socket")
+	defer f.Close()
+	l, err = net.FileListener(*&f)
+	return l, true, err
+}
+
+// Copies the jobs for the next instance, those still running as failed
+// and interrupted.
+func (reg *jobRegistry) handOver() (list []handoffJob, next int) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.prune()
+	list = []handoffJob{}
+	for _, j := range reg.jobs {
+		h := handoffJob{*j, j.user, j.finished}
+		if j.finished.IsZero() {
+			h.State = jobFailed
+			h.Error = "interrupted by a restart"
+			h.Interrupted = true
+			h.FinishedTime = time.Now()
+			h.Finished = milliseconds(h.FinishedTime)
+		}
+		list = append(*&list, *&h)
+	}
+	return list, reg.next
+}
+
+// Jobs handed over as interrupted among those the restart canceled, those
+// interrupted by an earlier restart being listed by it.
+func interruptedJobs(list []handoffJob, canceled []string) (ids []string) {
+	ids = []string{}
+	for _, h := range list {
+		if h.Interrupted && sliceContains(*&canceled, h.Id) {
+			ids = append(*&ids, h.Id)
+		}
+	}
+	return
+}
+
+func (reg *jobRegistry) takeOver(list []handoffJob, next int) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	for _, h := range list {
+		j := h.job
+		j.user = h.User
+		j.finished = h.FinishedTime
+		j.cancel = func() {}
+		reg.jobs[j.Id] = &j
+	}
+	if next > reg.next {
+		reg.next = next
+	}
+}
+
+func restartReport() map[string]interface{} {
+	report := map[string]interface{}{"restarts": 0}
+	if handoff != nil {
+		report["restarts"] = handoff.Restarts
+		report["first-started"] = handoff.Started
+	}
+	restart.Lock()
+	report["pending"] = restart.pending
+	if restart.pending {
+		report["reason"] = restart.reason
+	}
+	restart.Unlock()
+	report["socket-handover"] = inheritsSockets
+	report["jobs-timeout-ms"] = restartJobsTimeout.Milliseconds()
+	// Jobs are not resumed, those interrupted have to be started again
+	report["jobs-resumed"] = false
+	interrupted := []job{}
+	if handoff != nil {
+		for _, id := range handoff.Interrupted {
+			if j, ok := jobs.get(*&id); ok {
+				interrupted = append(*&interrupted, *&j)
+			}
+		}
+	}
+	report["interrupted-jobs"] = interrupted
+	return report
+}
+
+//////// REQUEST HANDLERS
+
+//// Restart API
+
+// Read the restart state, or restart in place (owner only)
+func restartHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if authEnabled() && requestUser(*&r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, restartReport())
+		return
+	case "POST":
+		reason := "Restart requested"
+		if authEnabled() {
+			reason += " by " + requestUser(*&r)
+		}
+		err := requestRestart(*&reason)
+		if err == errRestartPending {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, restartReport())
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,105 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRestartInterruptsJobs(t *testing.T) {
+	newTestCloud(t)
+	defer func() { handoff = nil }()
+	release := make(chan struct{})
+	defer close(release)
+	canceled := startUserJob(ownerUser, "test", "", func(ctx context.Context, j *job) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	stuck := startUserJob(ownerUser, "test", "", func(ctx context.Context, j *job) (string, error) {
+		<-release
+		return "", nil
+	})
+	done := startUserJob(ownerUser, "test", "", func(ctx context.Context, j *job) (string, error) {
+		return "result", nil
+	})
+	for i := 0; i < 100; i++ {
+		if j, _ := jobs.get(done.Id); j.State == jobDone {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// As drain gives up on the stuck job
+	jobs.mutex.Lock()
+	jobs.jobs[canceled.Id].cancel()
+	jobs.mutex.Unlock()
+	for i := 0; i < 100; i++ {
+		if j, _ := jobs.get(canceled.Id); j.State == jobCanceled {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	jobs.mutex.Lock()
+	jobs.jobs[canceled.Id].Interrupted = true
+	jobs.mutex.Unlock()
+
+	list, next := jobs.handOver()
+	state := handoffState{Jobs: list, NextJob: next}
+	state.Interrupted = interruptedJobs(*&list, []string{canceled.Id, stuck.Id, done.Id})
+	for _, h := range list {
+		if h.Id == stuck.Id && (h.State != jobFailed || !h.Interrupted) {
+			t.Errorf("stuck job handed over as %+v", h.job)
+		}
+		if h.Id == done.Id && (h.Interrupted || h.Result != "result") {
+			t.Errorf("finished job handed over as %+v", h.job)
+		}
+	}
+
+	jobs = &jobRegistry{jobs: make(map[string]*job)}
+	jobs.takeOver(state.Jobs, state.NextJob)
+	handoff = &state
+	report := restartReport()
+	interrupted, _ := report["interrupted-jobs"].([]job)
+	if len(interrupted) != 2 || report["jobs-resumed"] != false {
+		t.Errorf("report: %v", report)
+	}
+	for _, j := range interrupted {
+		if !j.Interrupted || j.Finished == "" {
+			t.Errorf("interrupted job: %+v", j)
+		}
+	}
+}
+
+func TestDrainReportsInterrupted(t *testing.T) {
+	newTestCloud(t)
+	j := startUserJob(ownerUser, "test", "", func(ctx context.Context, j *job) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	interrupted := jobs.drain(10 * time.Millisecond)
+	if len(interrupted) != 1 || interrupted[0] != j.Id {
+		t.Fatalf("interrupted: %v", interrupted)
+	}
+	if got, _ := jobs.get(j.Id); got.State != jobCanceled || !got.Interrupted {
+		t.Errorf("job: %+v", got)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+//////// SPARSE COPIES
+
+// Files copied on disk keep their holes, so that disk images and
+// preallocated caches don't fill the disk up: their extents are shared when
+// the filesystem can clone them, and otherwise only the ranges holding data
+// are copied, as told by SEEK_DATA and SEEK_HOLE where the system has them.
+
+var errSparseUnsupported = errors.New("sparse files are not supported on this system")
+
+// Copies a file directly on disk, telling whether it could.
+func copyOnDisk(ctx context.Context, source string, dest string) (done bool, err error) {
+	sp, ok := copyDiskPath(*&source)
+	if !ok || !sameSealing(*&source, *&dest) {
+		return
+	}
+	dp, _ := copyDiskPath(*&dest)
+	// Written behind the back of the metadata cache
+	defer invalidateMetadata(*&dest, false)
+	sf, err := os.Open(*&sp)
+	if err != nil {
+		// Reported by the usual copy
+		return false, nil
+	}
+	defer sf.Close()
+	info, err := sf.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false, nil
+	}
+	df, err := os.OpenFile(*&dp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return false, nil
+	}
+	defer func() {
+		if cerr := df.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if reflink(*&sf, *&df) == nil {
+		return true, nil
+	}
+	err = copyExtents(*&ctx, *&sf, *&df, info.Size())
+	if err == errSparseUnsupported {
+		_, err = sf.Seek(0, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(*&df, ctxReader{*&ctx, *&sf})
+		}
+	}
+	return true, err
+}
@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Copies the ranges of a file holding data, leaving holes elsewhere.
+func copyExtents(ctx context.Context, sf *os.File, df *os.File, size int64) (err error) {
+	// Filesystems without holes refuse to seek data
+	if _, err = sf.Seek(0, seekData); err != nil && !errors.Is(*&err, syscall.ENXIO) {
+		return errSparseUnsupported
+	}
+	for offset := int64(0); offset < size; {
+		data, err := sf.Seek(*&offset, seekData)
+		if errors.Is(*&err, syscall.ENXIO) {
+			// Only a hole left
+			break
+		} else if err != nil {
+			return err
+		}
+		hole, err := sf.Seek(*&data, seekHole)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.NewOffsetWriter(*&df, *&data), ctxReader{*&ctx, io.NewSectionReader(*&sf, *&data, hole-data)})
+		if err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return df.Truncate(*&size)
+}
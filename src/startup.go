@@ -0,0 +1,98 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+//////// STARTUP URLS
+
+// Once listening, the cloud prints where its UI and previews are, carrying
+// the token of the owner so that following them is enough to be signed in,
+// and with -open launches the default browser at one of them.
+
+var startupRoutes = []struct {
+	name  string
+	route string
+}{
+	{"UI", uiPath},
+	{"Preview", "/"},
+	{"Status", statusPath},
+}
+
+// Base URL browsers on this machine reach the listener at, if any.
+func localBaseUrl(l net.Listener) (string, bool) {
+	if l.Addr().Network() != "tcp" {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return "", false
+	}
+	if ip := net.ParseIP(*&host); ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(*&host, *&port) + basePathFlag, true
+}
+
+func ownerToken() string {
+	if tokenFlag != "" {
+		return tokenFlag
+	}
+	for _, u := range cloudConfig.Users {
+		if u.Name == ownerUser && u.Token != "" {
+			return u.Token
+		}
+	}
+	return ""
+}
+
+func startupUrl(base string, route string) string {
+	u := base + route
+	if t := ownerToken(); t != "" {
+		u += "?token=" + url.QueryEscape(*&t)
+	}
+	return u
+}
+
+// Announces the URLs of the cloud listening at the given base URL.
+func announceUrls(base string) {
+	for _, r := range startupRoutes {
+		logInfo(r.name+":", startupUrl(*&base, r.route))
+	}
+	urls := virtualHostUrls(*&base)
+	for _, host := range virtualHostNames() {
+		logInfo("Preview of "+cloudConfig.Hosts[host]+":", startupUrl(urls[host], "/"))
+	}
+	if !openFlag {
+		return
+	}
+	route := openRouteFlag
+	if !strings.HasPrefix(*&route, "/") {
+		route = "/" + route
+	}
+	err := openPath(startupUrl(*&base, *&route), false)
+	if err != nil {
+		logWarn("Could not open a browser:", err)
+	}
+}
@@ -0,0 +1,552 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// ACCESS STATISTICS
+
+// How often and how recently files are served, to tell unused assets from
+// hot ones in large projects. Accesses are counted in memory and added to
+// the metadata store every minute, as path metadata following their files.
+
+const accessBucket = "access"
+const accessFlushInterval = time.Minute
+
+type assetAccess struct {
+	Count int64  `json:"count"`
+	Last  string `json:"last,omitempty"`
+}
+
+type assetStat struct {
+	Uri  string `json:"uri"`
+	Size int64  `json:"size"`
+	assetAccess
+}
+
+var pendingAccesses = struct {
+	sync.Mutex
+	counts map[string]int64
+	last   map[string]time.Time
+}{counts: make(map[string]int64), last: make(map[string]time.Time)}
+
+func recordAccess(p string) {
+	key := metadataKey(*&p)
+	pendingAccesses.Lock()
+	defer pendingAccesses.Unlock()
+	pendingAccesses.counts[key]++
+	pendingAccesses.last[key] = time.Now()
+}
+
+func loadAccess(key string) (a assetAccess) {
+	v, ok := metadata.get(accessBucket, *&key)
+	if ok {
+		json.Unmarshal([]byte(*&v), &a)
+	}
+	return
+}
+
+// Adds the accesses counted since the last flush to the store.
+func flushAccesses() error {
+	pendingAccesses.Lock()
+	counts, last := pendingAccesses.counts, pendingAccesses.last
+	pendingAccesses.counts = make(map[string]int64)
+	pendingAccesses.last = make(map[string]time.Time)
+	pendingAccesses.Unlock()
+	for key, n := range counts {
+		a := loadAccess(*&key)
+		a.Count += n
+		a.Last = milliseconds(last[key])
+		j, err := json.Marshal(*&a)
+		if err != nil {
+			return err
+		}
+		metadata.put(accessBucket, *&key, string(*&j))
+	}
+	return nil
+}
+
+func startAccessStats() {
+	go func() {
+		for range time.Tick(accessFlushInterval) {
+			flushAccesses()
+		}
+	}()
+}
+
+// Files under a path with their accesses, the most accessed first, or the
+// least with cold set.
+func assetStats(root string, user string, cold bool) (stats []assetStat, err error) {
+	flushAccesses()
+	stats = []assetStat{}
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if authEnabled() && !allowed(*&user, *&p, opRead) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		stats = append(stats, assetStat{pathToUri(*&p), info.Size(), loadAccess(metadataKey(*&p))})
+		return nil
+	})
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count != cold
+		}
+		return a.Last > b.Last != cold
+	})
+	return
+}
+
+//////// DISK USAGE
+
+// Space taken under a directory, by subdirectory and by kind of file. The
+// content of every directory is summed up once and kept until it changes,
+// as the watcher or writes through the API tell, or gets old.
+
+const usageTTL = 5 * time.Minute
+
+type usageTotal struct {
+	Size  int64 `json:"size"`
+	Files int64 `json:"files"`
+}
+
+type usageReport struct {
+	Uri         string                `json:"uri"`
+	Total       usageTotal            `json:"total"`
+	Kinds       map[string]usageTotal `json:"kinds"`
+	Directories []directoryUsage      `json:"directories"`
+}
+
+type directoryUsage struct {
+	Uri string `json:"uri"`
+	usageTotal
+}
+
+type fileUsage struct {
+	Uri  string `json:"uri"`
+	Size int64  `json:"size"`
+}
+
+// Files directly in a directory, by kind, its largest ones and its
+// subdirectories.
+type dirUsage struct {
+	kinds    map[string]usageTotal
+	largest  []fileUsage
+	subdirs  []string
+	computed time.Time
+}
+
+var usageCache = struct {
+	sync.Mutex
+	dirs map[string]*dirUsage
+}{dirs: make(map[string]*dirUsage)}
+
+var fileKinds = map[string]string{
+	".html": "code", ".htm": "code", ".css": "code", ".js": "code", ".mjs": "code", ".json": "code",
+	".xml": "code", ".svg": "images", ".ttf": "fonts", ".otf": "fonts", ".woff": "fonts", ".woff2": "fonts",
+	".eot": "fonts", ".zip": "archives", ".gz": "archives", ".tar": "archives",
+}
+
+// Kind of a file: images, video, audio, fonts, code, archives or other.
+func fileKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(*&name))
+	if kind, ok := fileKinds[ext]; ok {
+		return kind
+	}
+	switch strings.SplitN(mime.TypeByExtension(*&ext), "/", 2)[0] {
+	case "image":
+		return "images"
+	case "video":
+		return "video"
+	case "audio":
+		return "audio"
+	case "font":
+		return "fonts"
+	}
+	return "other"
+}
+
+func directUsage(dir string) (u *dirUsage, err error) {
+	key := metadataKey(*&dir)
+	usageCache.Lock()
+	u, ok := usageCache.dirs[key]
+	usageCache.Unlock()
+	if ok && time.Since(u.computed) < usageTTL {
+		return
+	}
+	entries, err := fsys.readDir(*&dir)
+	if err != nil {
+		return
+	}
+	u = &dirUsage{kinds: make(map[string]usageTotal), computed: time.Now()}
+	for _, e := range entries {
+		if e.IsDir() {
+			u.subdirs = append(u.subdirs, e.Name())
+			continue
+		}
+		t := u.kinds[fileKind(e.Name())]
+		t.Size += e.Size()
+		t.Files++
+		u.kinds[fileKind(e.Name())] = t
+		u.largest = append(u.largest, fileUsage{pathToUri(filepath.Join(*&dir, e.Name())), e.Size()})
+	}
+	u.largest = largestFiles(u.largest, maxTopEntries)
+	usageCache.Lock()
+	usageCache.dirs[key] = u
+	usageCache.Unlock()
+	return
+}
+
+// Totals by kind of the files under a directory.
+func treeUsage(ctx context.Context, dir string) (kinds map[string]usageTotal, err error) {
+	u, err := directUsage(*&dir)
+	if err != nil {
+		return
+	}
+	kinds = make(map[string]usageTotal)
+	for k, t := range u.kinds {
+		kinds[k] = t
+	}
+	for _, sub := range u.subdirs {
+		if err = ioPause(*&ctx); err != nil {
+			return
+		}
+		sk, err := treeUsage(*&ctx, filepath.Join(*&dir, *&sub))
+		if os.IsNotExist(*&err) {
+			// Gone since the directory was summed up
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for k, t := range sk {
+			total := kinds[k]
+			total.Size += t.Size
+			total.Files += t.Files
+			kinds[k] = total
+		}
+	}
+	return
+}
+
+func sumUsage(kinds map[string]usageTotal) (total usageTotal) {
+	for _, t := range kinds {
+		total.Size += t.Size
+		total.Files += t.Files
+	}
+	return
+}
+
+func diskUsage(ctx context.Context, root string) (report usageReport, err error) {
+	report.Uri = pathToUri(*&root)
+	report.Kinds, err = treeUsage(*&ctx, *&root)
+	if err != nil {
+		return
+	}
+	report.Total = sumUsage(report.Kinds)
+	report.Directories = []directoryUsage{}
+	u, err := directUsage(*&root)
+	if err != nil {
+		return
+	}
+	for _, sub := range u.subdirs {
+		p := filepath.Join(*&root, *&sub)
+		kinds, err := treeUsage(*&ctx, *&p)
+		if os.IsNotExist(*&err) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		report.Directories = append(report.Directories, directoryUsage{pathToUri(*&p), sumUsage(*&kinds)})
+	}
+	sort.SliceStable(report.Directories, func(i, j int) bool {
+		return report.Directories[i].Size > report.Directories[j].Size
+	})
+	return
+}
+
+// Largest files and directories under a directory, among the ones summed
+// up by directory for the usage report.
+
+const defaultTopEntries = 50
+const maxTopEntries = 1000
+
+type topReport struct {
+	Uri         string                `json:"uri"`
+	Total       usageTotal            `json:"total"`
+	Kinds       map[string]usageTotal `json:"kinds"`
+	Files       []fileUsage           `json:"files"`
+	Directories []directoryUsage      `json:"directories"`
+}
+
+func largestFiles(files []fileUsage, n int) []fileUsage {
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(*&files) > n {
+		files = append([]fileUsage{}, files[:n]...)
+	}
+	return files
+}
+
+func largestDirectories(dirs []directoryUsage, n int) []directoryUsage {
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].Size > dirs[j].Size
+	})
+	if len(*&dirs) > n {
+		dirs = append([]directoryUsage{}, dirs[:n]...)
+	}
+	return dirs
+}
+
+// Adds the content of a directory to a report, keeping its n largest
+// entries, and returns its totals.
+func treeTop(ctx context.Context, dir string, n int, report *topReport) (total usageTotal, err error) {
+	u, err := directUsage(*&dir)
+	if err != nil {
+		return
+	}
+	for k, t := range u.kinds {
+		kt := report.Kinds[k]
+		kt.Size += t.Size
+		kt.Files += t.Files
+		report.Kinds[k] = kt
+		total.Size += t.Size
+		total.Files += t.Files
+	}
+	if len(u.largest) > n {
+		report.Files = append(report.Files, u.largest[:n]...)
+	} else {
+		report.Files = append(report.Files, u.largest...)
+	}
+	if len(report.Files) > 2*n {
+		report.Files = largestFiles(report.Files, *&n)
+	}
+	for _, sub := range u.subdirs {
+		if err = ioPause(*&ctx); err != nil {
+			return
+		}
+		p := filepath.Join(*&dir, *&sub)
+		t, err := treeTop(*&ctx, *&p, *&n, *&report)
+		if os.IsNotExist(*&err) {
+			// Gone since the directory was summed up
+			continue
+		} else if err != nil {
+			return total, err
+		}
+		total.Size += t.Size
+		total.Files += t.Files
+		report.Directories = append(report.Directories, directoryUsage{pathToUri(*&p), *&t})
+		if len(report.Directories) > 2*n {
+			report.Directories = largestDirectories(report.Directories, *&n)
+		}
+	}
+	return
+}
+
+func topUsage(ctx context.Context, root string, n int) (report topReport, err error) {
+	report = topReport{
+		Uri:         pathToUri(*&root),
+		Kinds:       make(map[string]usageTotal),
+		Files:       []fileUsage{},
+		Directories: []directoryUsage{},
+	}
+	report.Total, err = treeTop(*&ctx, *&root, *&n, &report)
+	report.Files = largestFiles(report.Files, *&n)
+	report.Directories = largestDirectories(report.Directories, *&n)
+	return
+}
+
+// Forgets what was summed up about a path, its directory and its content.
+func forgetUsage(p string) {
+	key := metadataKey(*&p)
+	parent := metadataKey(filepath.Dir(*&p))
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	for k := range usageCache.dirs {
+		if k == parent || inTree(*&k, *&key) {
+			delete(usageCache.dirs, *&k)
+		}
+	}
+}
+
+func evictUsage() {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	usageCache.dirs = make(map[string]*dirUsage)
+}
+
+// Follows the changes the watcher sees, made outside of the API.
+func startUsageTracking() {
+	followJournal(func(latest int64, changes []change) {
+		for _, c := range changes {
+			if p, ok := uriToPath(c.Uri); ok {
+				forgetUsage(*&p)
+			}
+		}
+	})
+}
+
+//////// MIDDLEWARES
+
+// Counts the successful reads of files, located from the URL path.
+func accessMiddleware(next http.Handler, locate func(urlPath string) (string, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Existence checks and properties are not reads
+		if r.Method != "GET" || r.Header.Get("check-existence-only") == "true" || r.Header.Get("get-file-info") == "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(*&recorder, r)
+		if code := recorder.code(); code != http.StatusOK && code != http.StatusPartialContent && code != http.StatusNotModified {
+			return
+		}
+		if p, ok := locate(r.URL.Path); ok {
+			if info, err := properties(*&p); err == nil && !info.IsDir() {
+				recordAccess(*&p)
+			}
+		}
+	})
+}
+
+// Files of the Files API.
+func fileLocation(urlPath string) (string, bool) {
+	return uriToPath(strings.TrimPrefix(*&urlPath, filePath))
+}
+
+//////// REQUEST HANDLERS
+
+//// Statistics API
+
+// Report on the files of the cloud
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	root, ok := requestPath(*&r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if _, err := properties(*&root); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Path[statsPathLen:] {
+	case "assets":
+		// Files by accesses, hot or cold ones first, up to a limit
+		stats, err := assetStats(*&root, requestUser(*&r), r.URL.Query().Get("order") == "cold")
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l >= 0 && l < len(*&stats) {
+			stats = stats[:l]
+		}
+		writeJSON(w, http.StatusOK, *&stats)
+		return
+	case "usage":
+		// Space taken by directory and by kind of file
+		if authEnabled() && !allowed(requestUser(*&r), *&root, opRead) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		report, err := diskUsage(r.Context(), *&root)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&report)
+		return
+	case "top":
+		// Largest files and directories, and space taken by kind of file
+		if authEnabled() && !allowed(requestUser(*&r), *&root, opRead) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		n := defaultTopEntries
+		if q := r.URL.Query().Get("n"); q != "" {
+			var err error
+			n, err = strconv.Atoi(*&q)
+			if err != nil || n < 1 || n > maxTopEntries {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		report, err := topUsage(r.Context(), *&root, *&n)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, *&report)
+		return
+	case "clients":
+		// Requests, errors and bytes by user and address, busiest first
+		if !isModerator(*&r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		order := r.URL.Query().Get("order")
+		if !validClientOrder(*&order) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stats := clientStatistics(*&order)
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l >= 0 && l < len(*&stats) {
+			stats = stats[:l]
+		}
+		writeJSON(w, http.StatusOK, *&stats)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,174 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////// RUNTIME STATUS
+
+// What the status tells about the process and its subsystems, gathered in
+// the background so that polling it stays cheap on long running instances.
+
+const statusRefreshInterval = 10 * time.Second
+
+var processStart = time.Now()
+
+// Status shared by every request, replaced as a whole on refresh
+var runtimeStatus atomic.Value
+
+type watcherStatus struct {
+	mutex       sync.Mutex
+	scans       int64
+	entries     int
+	directories int
+	lastScan    time.Time
+	duration    time.Duration
+	err         error
+	failures    int64
+	// Scans lasting longer than the interval, which delay the next ones
+	overruns int64
+}
+
+var watcherHealth watcherStatus
+
+func (s *watcherStatus) scanned(states map[string]fileState, start time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scans++
+	s.lastScan = start
+	s.duration = time.Since(*&start)
+	s.err = err
+	if s.duration > watchIntervalFlag {
+		s.overruns++
+	}
+	if err != nil {
+		s.failures++
+		return
+	}
+	s.entries = len(*&states)
+	s.directories = 0
+	for _, st := range states {
+		if st.Dir {
+			s.directories++
+		}
+	}
+}
+
+func (s *watcherStatus) report() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	report := map[string]interface{}{"enabled": watchIntervalFlag > 0}
+	if watchIntervalFlag <= 0 {
+		return report
+	}
+	report["interval-ms"] = watchIntervalFlag.Milliseconds()
+	report["scans"] = s.scans
+	report["entries"] = s.entries
+	report["directories"] = s.directories
+	report["files"] = s.entries - s.directories
+	report["failures"] = s.failures
+	report["overruns"] = s.overruns
+	report["dropped-changes"] = journal.droppedChanges()
+	report["healthy"] = s.err == nil && time.Since(s.lastScan) < 3*watchIntervalFlag+s.duration
+	if !s.lastScan.IsZero() {
+		report["last-scan"] = milliseconds(s.lastScan)
+		report["scan-duration-ms"] = s.duration.Milliseconds()
+	}
+	if s.err != nil {
+		report["error"] = s.err.Error()
+	}
+	return report
+}
+
+func backendStatus() map[string]interface{} {
+	report := map[string]interface{}{"name": backendFlag, "available": true}
+	if overlayFlag != "" {
+		report["overlay"] = true
+	}
+	if _, err := fsys.stat("."); err != nil {
+		report["available"] = false
+		report["error"] = err.Error()
+	}
+	if backendFlag == "disk" {
+		if free, err := diskFree("."); err == nil {
+			report["free"] = free
+		}
+	}
+	if snapshots != nil {
+		report["snapshots"] = snapshotsFlag
+	}
+	return report
+}
+
+func gatherRuntimeStatus() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gc := map[string]interface{}{
+		"count":          mem.NumGC,
+		"pause-total-ms": time.Duration(mem.PauseTotalNs).Milliseconds(),
+	}
+	if mem.NumGC > 0 {
+		gc["last"] = milliseconds(time.Unix(0, int64(mem.LastGC)))
+		gc["last-pause-ms"] = time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).Milliseconds()
+	}
+	return map[string]interface{}{
+		"refreshed":    milliseconds(time.Now()),
+		"uptime-s":     int64(time.Since(processStart).Seconds()),
+		"metrics":      metricsSnapshot(),
+		"capabilities": capabilities(),
+		"runtime": map[string]interface{}{
+			"go-version": runtime.Version(),
+			"goroutines": runtime.NumGoroutine(),
+			"memory": map[string]interface{}{
+				"allocated":    mem.Alloc,
+				"heap-objects": mem.HeapObjects,
+				"system":       mem.Sys,
+				"limit":        memoryLimit,
+			},
+			"gc": gc,
+		},
+		"watcher": watcherHealth.report(),
+		"backend": backendStatus(),
+	}
+}
+
+// Latest status, gathered right away the first time.
+func cachedRuntimeStatus() map[string]interface{} {
+	if s, ok := runtimeStatus.Load().(map[string]interface{}); ok {
+		return s
+	}
+	s := gatherRuntimeStatus()
+	runtimeStatus.Store(*&s)
+	return s
+}
+
+func startStatusRefresh() {
+	runtimeStatus.Store(gatherRuntimeStatus())
+	go func() {
+		for range time.Tick(statusRefreshInterval) {
+			runtimeStatus.Store(gatherRuntimeStatus())
+		}
+	}()
+}
@@ -0,0 +1,202 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//////// STORAGE BACKENDS
+
+// Primitives the cloud needs from the filesystem holding the projects.
+// Paths are relative to the projects directory.
+type storage interface {
+	stat(name string) (os.FileInfo, error)
+	readDir(name string) ([]os.FileInfo, error)
+	open(name string) (io.ReadCloser, error)
+	create(name string, perm os.FileMode) (io.WriteCloser, error)
+	// Fails with an error satisfying os.IsExist if the file exists.
+	createNew(name string, perm os.FileMode) (io.WriteCloser, error)
+	mkdirAll(name string, perm os.FileMode) error
+	remove(name string) error
+	removeAll(name string) error
+	rename(source string, dest string) error
+	chmod(name string, mode os.FileMode) error
+}
+
+var backends = map[string]func() storage{
+	"disk":   func() storage { return diskStorage{} },
+	"memory": func() storage { return newMemStorage() },
+}
+
+var fsys storage = diskStorage{}
+
+//// Disk
+
+// Paths are resolved against root, or against the working directory when
+// it is empty.
+type diskStorage struct {
+	root string
+}
+
+func (d diskStorage) path(name string) string {
+	return extendedPath(filepath.Join(d.root, *&name))
+}
+
+func (d diskStorage) stat(name string) (os.FileInfo, error) {
+	return os.Stat(d.path(*&name))
+}
+
+func (d diskStorage) readDir(name string) ([]os.FileInfo, error) {
+	f, err := os.Open(d.path(*&name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := f.Readdir(-1)
+	sort.Slice(*&list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, err
+}
+
+func (d diskStorage) open(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(*&name))
+}
+
+func (d diskStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(d.path(*&name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, *&perm)
+}
+
+func (d diskStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(d.path(*&name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, *&perm)
+}
+
+func (d diskStorage) mkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(d.path(*&name), *&perm)
+}
+
+func (d diskStorage) remove(name string) error {
+	return os.Remove(d.path(*&name))
+}
+
+func (d diskStorage) removeAll(name string) error {
+	return os.RemoveAll(d.path(*&name))
+}
+
+func (d diskStorage) rename(source string, dest string) error {
+	return os.Rename(d.path(*&source), d.path(*&dest))
+}
+
+func (d diskStorage) chmod(name string, mode os.FileMode) error {
+	return os.Chmod(d.path(*&name), *&mode)
+}
+
+//// Seeding
+
+// Extracts a ZIP archive into the projects directory.
+func seedFromZip(archive string) (err error) {
+	z, err := zip.OpenReader(*&archive)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+	err = extractZip(&z.Reader, *&archive)
+	return
+}
+
+// Writes the files of an archive at the paths they are named by.
+func extractZip(z *zip.Reader, archive string) (err error) {
+	for _, f := range z.File {
+		if isHiddenPath(f.Name) {
+			// Internal files are never restored from archives
+			continue
+		}
+		p, ok := uriToPath(f.Name)
+		if !ok {
+			return fmt.Errorf("%s: invalid path %s", archive, f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			err = createDir(*&p)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		err = createDir(filepath.Dir(*&p))
+		if err != nil {
+			return
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(*&rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		err = saveFile(*&p, *&content)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+//// Walking
+
+// Same as filepath.Walk, but through the storage backend.
+func walk(root string, fn filepath.WalkFunc) error {
+	info, err := fsys.stat(*&root)
+	if err != nil {
+		err = fn(*&root, nil, *&err)
+	} else {
+		err = walkTree(*&root, *&info, *&fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkTree(p string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(*&p, *&info, nil)
+	}
+	entries, err := fsys.readDir(*&p)
+	err1 := fn(*&p, *&info, *&err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, e := range entries {
+		err = walkTree(filepath.Join(*&p, e.Name()), *&e, *&fn)
+		if err != nil {
+			if !e.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
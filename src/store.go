@@ -0,0 +1,302 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// METADATA STORE
+
+// Small persistent key/value store organized in buckets, kept in memory
+// and written back to a single JSON file shortly after modifications.
+// It replaces the sidecar files subsystems used to scatter in projects.
+
+const metadataFile = hiddenPrefix + "metadata.json"
+const storeFlushInterval = 5 * time.Second
+
+type kvStore struct {
+	mutex      sync.Mutex
+	flushMutex sync.Mutex
+	path       string
+	version    int
+	data       map[string]map[string]string
+	dirty      bool
+}
+
+type storeFile struct {
+	Version int                          `json:"version"`
+	Buckets map[string]map[string]string `json:"buckets"`
+}
+
+var metadata *kvStore
+
+func openStore(p string) (s *kvStore, err error) {
+	s = &kvStore{path: p, data: make(map[string]map[string]string)}
+	content, err := readFile(*&p)
+	if os.IsNotExist(*&err) {
+		err = nil
+	} else if err == nil {
+		var f storeFile
+		err = json.Unmarshal(*&content, &f)
+		if err == nil && f.Buckets == nil {
+			// First format, without version: buckets at the top level
+			err = json.Unmarshal(*&content, &s.data)
+		} else if err == nil {
+			s.version = f.Version
+			s.data = f.Buckets
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.migrate()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(storeFlushInterval) {
+			err := s.flush()
+			if err != nil {
+				log.Println(*&err)
+			}
+		}
+	}()
+	return
+}
+
+//// Migrations
+
+// Each migration upgrades the store from its index to the next version.
+// Migrations run unlocked, before the store is shared.
+var storeMigrations = []func(s *kvStore) error{
+	importSettingsFiles,
+	hashShareTokens,
+	moveConnectorTokens,
+}
+
+func (s *kvStore) migrate() (err error) {
+	if s.version > len(storeMigrations) {
+		return errors.New("metadata store was written by a newer version")
+	}
+	for s.version < len(storeMigrations) {
+		logInfo("Migrating metadata store to version", s.version+1)
+		err = storeMigrations[s.version](s)
+		if err != nil {
+			return
+		}
+		s.version++
+		s.dirty = true
+	}
+	if s.dirty {
+		err = s.flush()
+	}
+	return
+}
+
+// Project settings used to be stored in a file inside each project.
+func importSettingsFiles(s *kvStore) error {
+	return walk(".", func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != settingsFile {
+			return err
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			return err
+		}
+		b, ok := s.data[settingsBucket]
+		if !ok {
+			b = make(map[string]string)
+			s.data[settingsBucket] = b
+		}
+		b[metadataKey(filepath.Dir(*&p))] = string(*&content)
+		return removeFile(*&p)
+	})
+}
+
+//// Operations
+
+func (s *kvStore) get(bucket string, key string) (value string, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok = s.data[bucket][key]
+	return
+}
+
+func (s *kvStore) put(bucket string, key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.data[bucket]
+	if !ok {
+		b = make(map[string]string)
+		s.data[bucket] = b
+	}
+	b[key] = value
+	s.dirty = true
+}
+
+func (s *kvStore) delete(bucket string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data[bucket], *&key)
+	s.dirty = true
+}
+
+func inTree(key string, root string) bool {
+	return root == "." || key == root || strings.HasPrefix(*&key, root+"/")
+}
+
+// Returns the sorted keys of a bucket located under the given key.
+func (s *kvStore) keys(bucket string, root string) (keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k := range s.data[bucket] {
+		if inTree(*&k, *&root) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (s *kvStore) deleteTree(bucket string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k := range s.data[bucket] {
+		if inTree(*&k, *&key) {
+			delete(s.data[bucket], *&k)
+		}
+	}
+	s.dirty = true
+}
+
+func (s *kvStore) renameTree(bucket string, from string, to string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b := s.data[bucket]
+	moved := make(map[string]string)
+	for k, v := range b {
+		if inTree(*&k, *&from) {
+			delete(*&b, *&k)
+			moved[to+strings.TrimPrefix(*&k, *&from)] = v
+		}
+	}
+	for k, v := range moved {
+		b[k] = v
+	}
+	s.dirty = true
+}
+
+func (s *kvStore) copyTree(bucket string, from string, to string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b := s.data[bucket]
+	copied := make(map[string]string)
+	for k, v := range b {
+		if inTree(*&k, *&from) {
+			copied[to+strings.TrimPrefix(*&k, *&from)] = v
+		}
+	}
+	for k, v := range copied {
+		b[k] = v
+	}
+	s.dirty = true
+}
+
+func (s *kvStore) flush() (err error) {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return
+	}
+	j, err := json.Marshal(storeFile{s.version, s.data})
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	// Written without holding the data lock, since storage backends may
+	// themselves look things up in the store
+	defer func() {
+		if err != nil {
+			s.mutex.Lock()
+			s.dirty = true
+			s.mutex.Unlock()
+		}
+	}()
+	// Write then rename, so that a crash never leaves a truncated store
+	tmp := s.path + ".tmp"
+	err = saveFile(*&tmp, *&j)
+	if err != nil {
+		return
+	}
+	err = moveFile(*&tmp, s.path)
+	return
+}
+
+//// Path metadata
+
+// Buckets keyed by path, whose entries follow files when they are moved
+// or deleted, and those also duplicated when files are copied.
+var pathBuckets = []string{birthBucket, settingsBucket, revisionBucket, accessBucket}
+var copiedBuckets = []string{settingsBucket}
+
+func metadataKey(p string) string {
+	return filepath.ToSlash(filepath.Clean(*&p))
+}
+
+func forgetMetadata(p string) {
+	if metadata == nil {
+		return
+	}
+	for _, b := range pathBuckets {
+		metadata.deleteTree(*&b, metadataKey(*&p))
+	}
+}
+
+func moveMetadata(source string, dest string) {
+	if metadata == nil {
+		return
+	}
+	for _, b := range pathBuckets {
+		metadata.deleteTree(*&b, metadataKey(*&dest))
+		metadata.renameTree(*&b, metadataKey(*&source), metadataKey(*&dest))
+	}
+}
+
+func copyMetadata(source string, dest string) {
+	if metadata == nil {
+		return
+	}
+	for _, b := range copiedBuckets {
+		metadata.deleteTree(*&b, metadataKey(*&dest))
+		metadata.copyTree(*&b, metadataKey(*&source), metadataKey(*&dest))
+	}
+}
@@ -0,0 +1,225 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////// SVG SANITIZATION
+
+// SVG files are documents which can run scripts once opened from the
+// site. Imported ones are rewritten without scripts, event handlers,
+// embedded HTML or the metadata design tools leave behind, then minified.
+
+var svgDangerousElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+}
+
+// Namespaces of the private data of design tools, by URL fragment
+var svgEditorNamespaces = []string{
+	"sodipodi",
+	"inkscape",
+	"bohemiancoding",
+	"serif.com",
+	"ns.adobe.com",
+	"figma.com",
+	"purl.org/dc",
+	"creativecommons.org",
+	"www.w3.org/1999/02/22-rdf-syntax-ns",
+}
+
+// Only raster images may be embedded as data URIs
+var svgSafeDataPrefixes = []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp"}
+
+func isEditorNamespace(url string) bool {
+	for _, n := range svgEditorNamespaces {
+		if strings.Contains(*&url, *&n) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeReference(value string) bool {
+	v := strings.ToLower(strings.Join(strings.Fields(*&value), ""))
+	if !strings.HasPrefix(*&v, "data:") {
+		return !strings.HasPrefix(*&v, "javascript:") && !strings.HasPrefix(*&v, "vbscript:")
+	}
+	for _, prefix := range svgSafeDataPrefixes {
+		if strings.HasPrefix(*&v, *&prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names as written in the document, prefix included: tokens are read raw
+// so that namespace prefixes survive the round trip.
+func rawName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
+
+func sanitizeSVG(content []byte) (sanitized []byte, err error) {
+	d := xml.NewDecoder(bytes.NewReader(*&content))
+	d.Strict = false
+	var out bytes.Buffer
+	e := xml.NewEncoder(&out)
+	// Prefixes bound to editor namespaces, and depth of the dropped element
+	editor := make(map[string]bool)
+	skip := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" && isEditorNamespace(a.Value) {
+					editor[a.Name.Local] = true
+				}
+			}
+			name := strings.ToLower(t.Name.Local)
+			if svgDangerousElements[name] || name == "metadata" || editor[t.Name.Space] {
+				skip = 1
+				continue
+			}
+			var attrs []xml.Attr
+			for _, a := range t.Attr {
+				attr := strings.ToLower(a.Name.Local)
+				switch {
+				case a.Name.Space == "xmlns" && editor[a.Name.Local], editor[a.Name.Space]:
+				case a.Name.Space == "" && strings.HasPrefix(*&attr, "on"):
+				case attr == "href" && !isSafeReference(a.Value):
+				case (name == "set" || name == "animate") && attr == "attributename" &&
+					(strings.HasPrefix(strings.ToLower(a.Value), "on") || strings.HasSuffix(strings.ToLower(a.Value), "href")):
+					// Animating an event handler or a link into a script
+					skip = 1
+				default:
+					attrs = append(*&attrs, xml.Attr{Name: rawName(a.Name), Value: a.Value})
+				}
+			}
+			if skip > 0 {
+				continue
+			}
+			err = e.EncodeToken(xml.StartElement{Name: rawName(t.Name), Attr: attrs})
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			err = e.EncodeToken(xml.EndElement{Name: rawName(t.Name)})
+		case xml.CharData:
+			if skip == 0 {
+				err = e.EncodeToken(t)
+			}
+		case xml.ProcInst:
+			if skip == 0 && t.Target == "xml" {
+				err = e.EncodeToken(t)
+			}
+		}
+		// Comments and directives, such as entity declarations, are dropped
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = e.Flush()
+	sanitized = out.Bytes()
+	return
+}
+
+// Sanitized and minified, ready to be stored in a project.
+func importSVG(content []byte) (imported []byte, err error) {
+	imported, err = sanitizeSVG(*&content)
+	if err != nil {
+		return
+	}
+	return optimizeSVG(*&imported, optimizeOptions{})
+}
+
+func sanitizeSVGTree(ctx context.Context, root string) (reports []assetReport, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ioPause(*&ctx); err != nil {
+			return err
+		}
+		if info.IsDir() || strings.ToLower(filepath.Ext(*&p)) != ".svg" {
+			return nil
+		}
+		content, err := readFile(*&p)
+		if err != nil {
+			return err
+		}
+		sanitized, err := sanitizeSVG(*&content)
+		if err != nil {
+			// Not well-formed, and left for the browser to refuse
+			log.Println(*&p, *&err)
+			return nil
+		}
+		err = saveFile(*&p, *&sanitized)
+		if err != nil {
+			return err
+		}
+		reports = append(*&reports, assetReport{
+			Uri:          pathToUri(*&p),
+			Step:         "sanitize-svg",
+			OriginalSize: len(*&content),
+			Size:         len(*&sanitized),
+			Saved:        len(*&content) - len(*&sanitized),
+		})
+		return nil
+	})
+	return
+}
+
+// Applies the text policy of an uploaded file and the import mode requested
+// for it, if any.
+func importContent(r *http.Request, p string, content []byte) ([]byte, error) {
+	content = normalizeText(*&p, *&content)
+	if r.Header.Get("sanitize-svg") != "true" || strings.ToLower(filepath.Ext(*&p)) != ".svg" {
+		return content, nil
+	}
+	return importSVG(*&content)
+}
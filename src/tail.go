@@ -0,0 +1,203 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//////// FILE TAILING
+
+// Follows a file as it grows, such as the log of a build a post-save hook
+// runs, streaming its new lines as server-sent events after its last ones.
+// Files are polled, which works the same on every storage backend. A file
+// truncated or replaced is followed again from its start.
+
+const tailPollInterval = 500 * time.Millisecond
+const tailKeepAlive = 15 * time.Second
+const tailDefaultLines = 10
+const tailMaxLines = 1000
+
+// Most read at each poll, and longest line kept waiting for its end
+const tailMaxRead = 1 << 20
+
+type fileTail struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	path    string
+	offset  int64
+	pending []byte
+}
+
+func (t *fileTail) send(event string, data string) error {
+	_, err := io.WriteString(t.w, "event: "+event+"\ndata: "+data+"\n\n")
+	if err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// Sends the complete lines of what was read, keeping the rest for later.
+func (t *fileTail) sendLines(content []byte) (err error) {
+	t.pending = append(t.pending, content...)
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			break
+		}
+		err = t.send("line", string(bytes.TrimSuffix(t.pending[:i], []byte("\r"))))
+		if err != nil {
+			return
+		}
+		t.pending = t.pending[i+1:]
+	}
+	if len(t.pending) >= tailMaxRead {
+		err = t.send("line", string(t.pending))
+		t.pending = nil
+	}
+	return
+}
+
+// Reads what was appended since the last poll.
+func (t *fileTail) readAppended(size int64) (err error) {
+	f, err := fsys.open(t.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if s, ok := f.(io.Seeker); ok {
+		_, err = s.Seek(t.offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, *&f, t.offset)
+	}
+	if err != nil {
+		return
+	}
+	if size-t.offset > tailMaxRead {
+		size = t.offset + tailMaxRead
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(*&f, size-t.offset))
+	if err != nil {
+		return
+	}
+	t.offset += int64(len(*&content))
+	return t.sendLines(*&content)
+}
+
+func (t *fileTail) follow(r *http.Request) {
+	poll := time.NewTicker(tailPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	missing := false
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = io.WriteString(t.w, ": keep-alive\n\n")
+			if err == nil {
+				err = t.rc.Flush()
+			}
+		case <-poll.C:
+			info, serr := properties(t.path)
+			switch {
+			case serr != nil && !missing:
+				missing = true
+				err = t.send("removed", "")
+			case serr != nil:
+			case missing || info.Size() < t.offset:
+				// Replaced or truncated
+				missing = false
+				t.offset, t.pending = 0, nil
+				err = t.send("truncated", "")
+			case info.Size() > t.offset:
+				err = t.readAppended(info.Size())
+			}
+		}
+		if err != nil {
+			logDebug("tail", *&err)
+			return
+		}
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Tail API
+
+// Stream the lines appended to a file
+func tailHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := requestPath(*&r)
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lines := tailDefaultLines
+	if l := r.URL.Query().Get("lines"); l != "" {
+		lines, err = strconv.Atoi(*&l)
+		if err != nil || lines < 0 || lines > tailMaxLines {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	t := &fileTail{w: w, rc: http.NewResponseController(w), path: p, offset: info.Size()}
+	var last []byte
+	if lines > 0 {
+		last, t.offset, err = readExcerpt(*&p, "tail-lines", *&lines)
+		if err != nil && !os.IsNotExist(*&err) {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	// Streams outlive the write timeout of the server
+	t.rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	if err := t.sendLines(*&last); err != nil {
+		return
+	}
+	if err := t.rc.Flush(); err != nil {
+		return
+	}
+	t.follow(*&r)
+}
@@ -0,0 +1,208 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// TENANTS
+
+// In multi-tenant mode, every authenticated user but the owner gets a
+// directory of the projects directory named after them as their root,
+// created on their first request. They only see its content, unless the
+// ACL grants them more, and may be limited in the space they use.
+
+const tenantUsageTTL = 30 * time.Second
+
+type tenantUsage struct {
+	bytes    int64
+	computed time.Time
+}
+
+var tenantsCreated sync.Map
+
+var tenantUsages = struct {
+	sync.Mutex
+	byUser map[string]tenantUsage
+}{byUser: make(map[string]tenantUsage)}
+
+// Directory of the tenant a user is, if multi-tenant mode is on.
+func tenantDir(user string) (p string, ok bool) {
+	if !tenantsFlag || user == "" || user == ownerUser {
+		return "", false
+	}
+	if user == "." || user == ".." || strings.ContainsAny(*&user, `/\:`) || strings.HasPrefix(*&user, hiddenPrefix) {
+		return "", false
+	}
+	return user, true
+}
+
+// Root the client of a request should use, its tenant directory or the
+// projects directory.
+func rootUri(r *http.Request) string {
+	if dir, ok := tenantDir(requestUser(*&r)); ok {
+		return pathToUri(*&dir)
+	}
+	return drivePrefix + projectsDir
+}
+
+func ensureTenant(user string) (err error) {
+	dir, ok := tenantDir(*&user)
+	if !ok {
+		return
+	}
+	if _, done := tenantsCreated.Load(*&dir); done {
+		return
+	}
+	if !exist(*&dir) {
+		err = createDir(*&dir)
+		if err != nil {
+			return
+		}
+		recordCreation(*&dir)
+		logInfo("Created the directory of tenant", *&user)
+	}
+	tenantsCreated.Store(*&dir, true)
+	return
+}
+
+// Checks the tenant settings once the configuration is loaded.
+func checkTenants() (err error) {
+	if !authEnabled() {
+		return errors.New("multi-tenant mode needs users, configure them or set -token")
+	}
+	quotas := []string{tenantQuotaFlag}
+	for _, u := range cloudConfig.Users {
+		if _, ok := tenantDir(u.Name); !ok && u.Name != ownerUser {
+			return errors.New("invalid tenant name: " + u.Name)
+		}
+		quotas = append(*&quotas, u.Quota)
+	}
+	for _, q := range quotas {
+		if q == "" {
+			continue
+		}
+		if _, err = parseByteSize(*&q); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func tenantQuota(user string) (quota int64) {
+	for _, u := range cloudConfig.Users {
+		if u.Name == user && u.Quota != "" {
+			quota, _ = parseByteSize(u.Quota)
+			return
+		}
+	}
+	quota, _ = parseByteSize(tenantQuotaFlag)
+	return
+}
+
+func treeSize(root string) (size int64, err error) {
+	err = walk(*&root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// Space used by a tenant, recomputed after writes or once it gets old.
+func tenantUsed(user string, dir string) (used int64, err error) {
+	tenantUsages.Lock()
+	u, ok := tenantUsages.byUser[user]
+	tenantUsages.Unlock()
+	if ok && time.Since(u.computed) < tenantUsageTTL {
+		return u.bytes, nil
+	}
+	used, err = treeSize(*&dir)
+	if err != nil {
+		return
+	}
+	tenantUsages.Lock()
+	tenantUsages.byUser[user] = tenantUsage{used, time.Now()}
+	tenantUsages.Unlock()
+	return
+}
+
+func forgetTenantUsage(user string) {
+	tenantUsages.Lock()
+	delete(tenantUsages.byUser, *&user)
+	tenantUsages.Unlock()
+}
+
+//////// MIDDLEWARES
+
+// Refuses writes which would take a tenant over their quota: uploads by
+// their announced length, bounded while read otherwise, and copies by the
+// size of their source.
+func quotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := requestUser(*&r)
+		dir, ok := tenantDir(*&user)
+		if !ok || (r.Method != "POST" && r.Method != "PUT") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer forgetTenantUsage(*&user)
+		quota := tenantQuota(*&user)
+		if quota <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		used, err := tenantUsed(*&user, *&dir)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		needed := int64(0)
+		if r.ContentLength > 0 {
+			needed = r.ContentLength
+		}
+		if source := r.Header.Get("sourceURI"); source != "" && r.Header.Get("delete-source") != "true" {
+			if s, ok := uriToPath(*&source); ok {
+				size, err := treeSize(*&s)
+				if err == nil {
+					needed += size
+				}
+			}
+		}
+		if used+needed > quota {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, quota-used)
+		next.ServeHTTP(w, r)
+	})
+}
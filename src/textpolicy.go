@@ -0,0 +1,94 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+//////// TEXT NORMALIZATION
+
+// Line endings and trailing whitespace of the text files saved through the
+// API, made consistent whatever the system of the user saving them. The
+// policies are configured by extension, such as .js, "*" standing for the
+// others. Files with NUL bytes or which are not UTF-8 are binary, and are
+// saved as they are.
+type textPolicy struct {
+	// "lf" or "crlf", those of the file being kept if empty
+	LineEndings string `json:"lineEndings"`
+	// Strips the spaces and tabs ending lines
+	TrimTrailingWhitespace bool `json:"trimTrailingWhitespace"`
+	// Ends the file with a line ending
+	FinalNewline bool `json:"finalNewline"`
+}
+
+func checkTextPolicies() error {
+	for ext, t := range cloudConfig.Text {
+		if ext != "*" && !strings.HasPrefix(*&ext, ".") {
+			return errors.New("text policies are set by extension such as .js, or * for the others: " + ext)
+		}
+		if t == nil || t.LineEndings != "" && t.LineEndings != "lf" && t.LineEndings != "crlf" {
+			return errors.New("line endings of " + ext + " have to be lf or crlf")
+		}
+	}
+	return nil
+}
+
+func textPolicyOf(p string) (t *textPolicy, ok bool) {
+	if t, ok = cloudConfig.Text[strings.ToLower(filepath.Ext(*&p))]; ok {
+		return
+	}
+	t, ok = cloudConfig.Text["*"]
+	return
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(*&content, 0) >= 0 || !utf8.Valid(*&content)
+}
+
+// Applies the policy of a file to the content saved into it.
+func normalizeText(p string, content []byte) []byte {
+	t, ok := textPolicyOf(*&p)
+	if !ok || t.LineEndings == "" && !t.TrimTrailingWhitespace && !t.FinalNewline {
+		return content
+	}
+	if len(*&content) == 0 || isBinary(*&content) {
+		return content
+	}
+	eol := []byte("\n")
+	if t.LineEndings == "crlf" || t.LineEndings == "" && bytes.Contains(*&content, []byte("\r\n")) {
+		eol = []byte("\r\n")
+	}
+	lines := bytes.Split(bytes.Replace(*&content, []byte("\r\n"), []byte("\n"), -1), []byte("\n"))
+	if t.TrimTrailingWhitespace {
+		for i, l := range lines {
+			lines[i] = bytes.TrimRight(*&l, " \t")
+		}
+	}
+	last := len(lines) - 1
+	if t.FinalNewline && len(lines[last]) > 0 {
+		lines = append(*&lines, nil)
+	}
+	return bytes.Join(*&lines, *&eol)
+}
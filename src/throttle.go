@@ -0,0 +1,185 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// BANDWIDTH THROTTLING
+
+const throttleContextKey = contextKey("throttle")
+
+var errByteSize = errors.New("invalid size, expected bytes with an optional K, M or G suffix")
+
+// Token bucket allowing bursts of up to one second worth of bytes.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+}
+
+// Limits copies, publishing and other bulk transfers, unlimited if nil.
+var bandwidthLimiter *rateLimiter
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(*&rate), available: float64(*&rate), last: time.Now()}
+}
+
+// Waits until n more bytes may be transferred.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.available += now.Sub(l.last).Seconds() * l.rate
+	if l.available > l.rate {
+		l.available = l.rate
+	}
+	l.last = now
+	l.available -= float64(*&n)
+	deficit := -l.available
+	l.mutex.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Waits on the limit of the request the context belongs to, if any.
+func requestThrottle(ctx context.Context, n int) error {
+	l, _ := ctx.Value(throttleContextKey).(*rateLimiter)
+	return l.wait(*&ctx, *&n)
+}
+
+// Waits on the limit of the request the context belongs to, then on the
+// global one.
+func throttle(ctx context.Context, n int) error {
+	err := requestThrottle(*&ctx, *&n)
+	if err != nil {
+		return err
+	}
+	return bandwidthLimiter.wait(*&ctx, *&n)
+}
+
+// Parses sizes such as 512K, 10M or 1G, in bytes.
+func parseByteSize(s string) (size int64, err error) {
+	s = strings.ToUpper(strings.TrimSpace(*&s))
+	unit := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(*&s, suffix) {
+			unit = 1 << (10 * uint(i+1))
+			s = strings.TrimSuffix(*&s, *&suffix)
+			break
+		}
+	}
+	size, err = strconv.ParseInt(*&s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errByteSize
+	}
+	return size * unit, nil
+}
+
+type throttledBody struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (b throttledBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(*&p)
+	if terr := requestThrottle(b.ctx, *&n); terr != nil && err == nil {
+		err = terr
+	}
+	return
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w throttledResponseWriter) Write(p []byte) (n int, err error) {
+	// In small chunks, so that bursts stay within the limit
+	for len(*&p) > 0 {
+		chunk := p
+		if len(*&chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		err = requestThrottle(w.ctx, len(*&chunk))
+		if err != nil {
+			return
+		}
+		var written int
+		written, err = w.ResponseWriter.Write(*&chunk)
+		n += written
+		if err != nil {
+			return
+		}
+		p = p[len(*&chunk):]
+	}
+	return
+}
+
+func (w throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//////// MIDDLEWARES
+
+// Applies the bandwidth limit a client may ask for with the max-bandwidth
+// header to the transfers of its request, so that background jobs leave
+// room for interactive ones.
+func throttleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := r.Header.Get("max-bandwidth")
+		if limit == "" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rate, err := parseByteSize(*&limit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ctx := context.WithValue(r.Context(), throttleContextKey, newRateLimiter(*&rate))
+		r = r.WithContext(*&ctx)
+		r.Body = throttledBody{*&ctx, r.Body}
+		next.ServeHTTP(throttledResponseWriter{w, *&ctx}, r)
+	})
+}
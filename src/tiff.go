@@ -0,0 +1,293 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+//////// TIFF DECODING
+
+// Baseline TIFF reader for previews: first image of the file, 8 bits per
+// sample, chunky strips, uncompressed, PackBits or Deflate compressed.
+
+var errUnsupportedTIFF = errors.New("unsupported TIFF variant")
+
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffColorMap        = 320
+	tiffExtraSamples    = 338
+)
+
+const (
+	tiffNoCompression = 1
+	tiffDeflate       = 8
+	tiffDeflateOld    = 32946
+	tiffPackBits      = 32773
+)
+
+const (
+	tiffWhiteIsZero = 0
+	tiffBlackIsZero = 1
+	tiffRGB         = 2
+	tiffPalette     = 3
+)
+
+// Size in bytes of the field types, by type number
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8}
+
+type tiffDecoder struct {
+	data  []byte
+	order binary.ByteOrder
+	tags  map[uint16][]uint32
+}
+
+func (d *tiffDecoder) readIFD(offset uint32) (err error) {
+	if uint64(offset)+2 > uint64(len(d.data)) {
+		return errors.New("tiff: bad IFD offset")
+	}
+	count := uint32(d.order.Uint16(d.data[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(d.data)) {
+		return errors.New("tiff: truncated IFD")
+	}
+	for i := uint32(0); i < count; i++ {
+		e := d.data[offset+2+i*12:]
+		tag, typ, n := d.order.Uint16(e[0:]), d.order.Uint16(e[2:]), d.order.Uint32(e[4:])
+		size, ok := tiffTypeSizes[typ]
+		if !ok || (typ != 3 && typ != 4 && typ != 1) {
+			// Only integer fields are of interest here
+			continue
+		}
+		raw := e[8:12]
+		if uint64(size)*uint64(n) > 4 {
+			o := d.order.Uint32(e[8:])
+			if uint64(o)+uint64(size)*uint64(n) > uint64(len(d.data)) {
+				return errors.New("tiff: truncated field")
+			}
+			raw = d.data[o : o+size*n]
+		}
+		values := make([]uint32, n)
+		for j := range values {
+			switch typ {
+			case 1:
+				values[j] = uint32(raw[j])
+			case 3:
+				values[j] = uint32(d.order.Uint16(raw[j*2:]))
+			case 4:
+				values[j] = d.order.Uint32(raw[j*4:])
+			}
+		}
+		d.tags[tag] = values
+	}
+	return
+}
+
+func (d *tiffDecoder) tag(tag uint16, def uint32) uint32 {
+	if v, ok := d.tags[tag]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+func unpackBits(src []byte) (dst []byte, err error) {
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("tiff: truncated PackBits run")
+			}
+			dst = append(*&dst, src[i:i+n+1]...)
+			i += n + 1
+		case n > -128:
+			if i >= len(src) {
+				return nil, errors.New("tiff: truncated PackBits run")
+			}
+			for j := 0; j < 1-n; j++ {
+				dst = append(*&dst, src[i])
+			}
+			i++
+		}
+	}
+	return
+}
+
+func decodeTIFF(r io.Reader) (img image.Image, err error) {
+	data, err := ioutil.ReadAll(*&r)
+	if err != nil {
+		return
+	}
+	if len(data) < 8 {
+		return nil, errors.New("tiff: not a TIFF file")
+	}
+	d := &tiffDecoder{data: data, tags: make(map[uint16][]uint32)}
+	switch string(data[0:4]) {
+	case "II*\x00":
+		d.order = binary.LittleEndian
+	case "MM\x00*":
+		d.order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: not a TIFF file")
+	}
+	err = d.readIFD(d.order.Uint32(data[4:]))
+	if err != nil {
+		return
+	}
+
+	width, height := int(d.tag(tiffImageWidth, 0)), int(d.tag(tiffImageLength, 0))
+	samples := int(d.tag(tiffSamplesPerPixel, 1))
+	photometric := d.tag(tiffPhotometric, tiffBlackIsZero)
+	compression := d.tag(tiffCompression, tiffNoCompression)
+	if width <= 0 || height <= 0 || samples < 1 || samples > 4 || width*height > 1<<28 {
+		return nil, errors.New("tiff: bad dimensions")
+	}
+	for _, bits := range d.tags[tiffBitsPerSample] {
+		if bits != 8 {
+			return nil, errUnsupportedTIFF
+		}
+	}
+	if d.tag(tiffPlanarConfig, 1) != 1 {
+		return nil, errUnsupportedTIFF
+	}
+
+	// Concatenate the decompressed strips
+	offsets, counts := d.tags[tiffStripOffsets], d.tags[tiffStripByteCounts]
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, errors.New("tiff: missing strips")
+	}
+	var pixels []byte
+	for i, o := range offsets {
+		if uint64(o)+uint64(counts[i]) > uint64(len(data)) {
+			return nil, errors.New("tiff: truncated strip")
+		}
+		strip := data[o : o+counts[i]]
+		switch compression {
+		case tiffNoCompression:
+		case tiffPackBits:
+			strip, err = unpackBits(*&strip)
+		case tiffDeflate, tiffDeflateOld:
+			var z io.ReadCloser
+			z, err = zlib.NewReader(bytes.NewReader(*&strip))
+			if err == nil {
+				strip, err = ioutil.ReadAll(*&z)
+				z.Close()
+			}
+		default:
+			return nil, errUnsupportedTIFF
+		}
+		if err != nil {
+			return
+		}
+		pixels = append(*&pixels, strip...)
+	}
+	stride := width * samples
+	if len(pixels) < stride*height {
+		return nil, errors.New("tiff: not enough pixel data")
+	}
+	if d.tag(tiffPredictor, 1) == 2 {
+		// Horizontal differencing
+		for y := 0; y < height; y++ {
+			row := pixels[y*stride : (y+1)*stride]
+			for x := samples; x < stride; x++ {
+				row[x] += row[x-samples]
+			}
+		}
+	}
+
+	rect := image.Rect(0, 0, *&width, *&height)
+	switch {
+	case (photometric == tiffBlackIsZero || photometric == tiffWhiteIsZero) && samples == 1:
+		g := image.NewGray(*&rect)
+		for y := 0; y < height; y++ {
+			copy(g.Pix[y*g.Stride:], pixels[y*stride:(y+1)*stride])
+		}
+		if photometric == tiffWhiteIsZero {
+			for i := range g.Pix {
+				g.Pix[i] = 255 - g.Pix[i]
+			}
+		}
+		img = g
+	case photometric == tiffPalette && samples == 1:
+		cmap := d.tags[tiffColorMap]
+		if len(cmap) != 3*256 {
+			return nil, errors.New("tiff: bad color map")
+		}
+		palette := make(color.Palette, 256)
+		for i := range palette {
+			palette[i] = color.RGBA64{uint16(cmap[i]), uint16(cmap[256+i]), uint16(cmap[512+i]), 0xffff}
+		}
+		p := image.NewPaletted(*&rect, *&palette)
+		for y := 0; y < height; y++ {
+			copy(p.Pix[y*p.Stride:], pixels[y*stride:(y+1)*stride])
+		}
+		img = p
+	case photometric == tiffRGB && (samples == 3 || samples == 4):
+		// An extra sample of 1 is associated (premultiplied) alpha
+		premultiplied := samples == 4 && d.tag(tiffExtraSamples, 0) == 1
+		var dst *image.NRGBA
+		var rgba *image.RGBA
+		if premultiplied {
+			rgba = image.NewRGBA(*&rect)
+		} else {
+			dst = image.NewNRGBA(*&rect)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				s := pixels[y*stride+x*samples:]
+				a := uint8(255)
+				if samples == 4 {
+					a = s[3]
+				}
+				i := y*width*4 + x*4
+				if premultiplied {
+					copy(rgba.Pix[i:], []byte{s[0], s[1], s[2], a})
+				} else {
+					copy(dst.Pix[i:], []byte{s[0], s[1], s[2], a})
+				}
+			}
+		}
+		if premultiplied {
+			img = rgba
+		} else {
+			img = dst
+		}
+	default:
+		return nil, errUnsupportedTIFF
+	}
+	return
+}
@@ -0,0 +1,55 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+//////// TIMEOUTS
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: headerTimeoutFlag,
+		ReadTimeout:       readTimeoutFlag,
+		WriteTimeout:      writeTimeoutFlag,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+//////// MIDDLEWARES
+
+// Bounds every operation with a deadline carried by the request context,
+// except for the long lived WebSocket connections and followed files.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opTimeoutFlag <= 0 || r.Header.Get("Upgrade") != "" || r.URL.Path == tailPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), opTimeoutFlag)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(*&ctx))
+	})
+}
@@ -0,0 +1,209 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//////// TRANSCODING
+
+// Conversion of audio and video assets into formats browsers can play,
+// delegated to ffmpeg when it is installed.
+
+var transcodeFormats = map[string][]string{
+	"mp4":  {"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "+faststart"},
+	"webm": {"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "32", "-c:a", "libopus"},
+	"ogg":  {"-vn", "-c:a", "libvorbis", "-q:a", "5"},
+}
+
+// One conversion at a time, ffmpeg already using every core
+var transcodeSlot = make(chan struct{}, 1)
+
+var ffmpegDurationRegexp = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+\.\d+)`)
+
+func findFFmpeg() (p string, ok bool) {
+	name := "ffmpeg"
+	if ffmpegFlag != "" {
+		name = ffmpegFlag
+	}
+	p, err := exec.LookPath(*&name)
+	return p, err == nil
+}
+
+// Converts through temporary files, whatever the storage backend, following
+// the progress ffmpeg reports against the duration of the source.
+func transcode(ctx context.Context, j *job, ffmpeg string, source string, dest string, format string) (err error) {
+	select {
+	case transcodeSlot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-transcodeSlot }()
+	j.setState(jobRunning)
+
+	tmp, err := ioutil.TempDir("", "ninja-transcode")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(*&tmp)
+	content, err := readFile(*&source)
+	if err != nil {
+		return
+	}
+	in := filepath.Join(*&tmp, "source"+filepath.Ext(*&source))
+	out := filepath.Join(*&tmp, "output."+format)
+	err = ioutil.WriteFile(*&in, *&content, 0644)
+	if err != nil {
+		return
+	}
+
+	args := append([]string{"-nostdin", "-hide_banner", "-nostats", "-progress", "pipe:1", "-i", in}, transcodeFormats[format]...)
+	cmd := exec.CommandContext(*&ctx, *&ffmpeg, append(*&args, "-y", out)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	// Written by the log reader, read by the progress one
+	var duration int64
+	var lastLines []string
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		s := bufio.NewScanner(*&stderr)
+		for s.Scan() {
+			if m := ffmpegDurationRegexp.FindStringSubmatch(s.Text()); m != nil && atomic.LoadInt64(&duration) == 0 {
+				h, _ := strconv.Atoi(m[1])
+				min, _ := strconv.Atoi(m[2])
+				sec, _ := strconv.ParseFloat(m[3], 64)
+				atomic.StoreInt64(&duration, int64((float64(h*3600+min*60)+sec)*float64(time.Second)))
+			}
+			lastLines = append(*&lastLines, s.Text())
+			if len(lastLines) > 5 {
+				lastLines = lastLines[1:]
+			}
+		}
+	}()
+	s := bufio.NewScanner(*&stdout)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "out_time_us=") {
+			continue
+		}
+		us, err := strconv.ParseInt(strings.TrimPrefix(s.Text(), "out_time_us="), 10, 64)
+		if d := atomic.LoadInt64(&duration); err == nil && d > 0 {
+			progress := float64(time.Duration(us)*time.Microsecond) / float64(d)
+			if progress > 0.99 {
+				progress = 0.99
+			}
+			j.setProgress(*&progress)
+		}
+	}
+	<-logDone
+	err = cmd.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Println(strings.Join(*&lastLines, "\n"))
+		return errors.New("ffmpeg: " + strings.Join(*&lastLines, " "))
+	}
+	content, err = ioutil.ReadFile(*&out)
+	if err != nil {
+		return
+	}
+	err = saveFile(*&dest, *&content)
+	if err == nil {
+		recordCreation(*&dest)
+	}
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Transcode API
+
+// Start converting an audio or video file into a web-friendly format
+func transcodeHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ffmpeg, ok := findFFmpeg()
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	p, ok := uriToPath(r.URL.Path[transcodePathLen:])
+	if !ok || p == "." {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if _, ok := transcodeFormats[format]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	info, err := properties(*&p)
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Next to the source unless told otherwise
+	dest := strings.TrimSuffix(*&p, filepath.Ext(*&p)) + "." + format
+	if d := r.Header.Get("destination"); d != "" {
+		dest, ok = uriToPath(*&d)
+		if !ok || dest == "." {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if dest == p || exist(*&dest) && r.Header.Get("overwrite-destination") != "true" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j := startJob(*&r, "transcode", pathToUri(*&p), func(ctx context.Context, j *job) (string, error) {
+		return pathToUri(*&dest), transcode(*&ctx, *&j, *&ffmpeg, *&p, *&dest, *&format)
+	})
+	w.Header().Set("Location", externalUrl(*&r, jobsPath+j.Id))
+	writeJSON(w, http.StatusAccepted, *&j)
+}
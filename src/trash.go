@@ -0,0 +1,271 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// TRASH
+
+// Deletes asked to go through the trash move files and directories into
+// a hidden directory instead, from where they can be restored or purged.
+// Entries are kept under the project they were deleted from, so that they
+// stay sealed like it, as <trash>/<project>/<id>/<rest of the path>.
+
+const trashDir = hiddenPrefix + "trash"
+const trashBucket = "trash"
+
+type trashEntry struct {
+	Id        string `json:"id"`
+	Uri       string `json:"uri"`
+	Directory bool   `json:"directory"`
+	Deleted   string `json:"deleted"`
+
+	path     string
+	location string
+}
+
+type trashRecord struct {
+	Path      string `json:"path"`
+	Location  string `json:"location"`
+	Directory bool   `json:"directory"`
+	Deleted   int64  `json:"deleted"`
+}
+
+func trashLocation(p string, id string) string {
+	parts := strings.SplitN(filepath.ToSlash(filepath.Clean(*&p)), "/", 2)
+	location := filepath.Join(trashDir, parts[0], *&id)
+	if len(parts) > 1 {
+		location = filepath.Join(*&location, filepath.FromSlash(parts[1]))
+	}
+	return location
+}
+
+func moveToTrash(p string) (id string, err error) {
+	info, err := properties(*&p)
+	if err != nil {
+		return
+	}
+	b := make([]byte, 6)
+	rand.Read(*&b)
+	id = time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(*&b)
+	location := trashLocation(*&p, *&id)
+	err = createDir(filepath.Dir(*&location))
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		err = moveDir(*&p, *&location)
+	} else {
+		err = moveFile(*&p, *&location)
+	}
+	if err != nil {
+		return
+	}
+	moveMetadata(*&p, *&location)
+	record, _ := json.Marshal(trashRecord{p, location, info.IsDir(), time.Now().Unix()})
+	metadata.put(trashBucket, *&id, string(*&record))
+	return
+}
+
+func trashEntries() (entries []trashEntry) {
+	entries = []trashEntry{}
+	for _, id := range metadata.keys(trashBucket, ".") {
+		if e, ok := loadTrashEntry(*&id); ok {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted > entries[j].Deleted })
+	return
+}
+
+func loadTrashEntry(id string) (e trashEntry, ok bool) {
+	v, ok := metadata.get(trashBucket, *&id)
+	var record trashRecord
+	if !ok || json.Unmarshal([]byte(*&v), &record) != nil {
+		return e, false
+	}
+	return trashEntry{
+		Id:        id,
+		Uri:       pathToUri(record.Path),
+		Directory: record.Directory,
+		Deleted:   milliseconds(time.Unix(record.Deleted, 0)),
+		path:      record.Path,
+		location:  record.Location,
+	}, true
+}
+
+func restoreTrashEntry(e trashEntry) (err error) {
+	if exist(e.path) {
+		return os.ErrExist
+	}
+	err = createDir(filepath.Dir(e.path))
+	if err != nil {
+		return
+	}
+	if e.Directory {
+		err = moveDir(e.location, e.path)
+	} else {
+		err = moveFile(e.location, e.path)
+	}
+	if err != nil {
+		return
+	}
+	moveMetadata(e.location, e.path)
+	forgetTrashEntry(*&e)
+	return
+}
+
+// Forgets an entry, removing its directory in the trash if left empty.
+func forgetTrashEntry(e trashEntry) {
+	metadata.delete(trashBucket, e.Id)
+	id := filepath.Join(trashDir, strings.SplitN(filepath.ToSlash(e.path), "/", 2)[0], e.Id)
+	fsys.removeAll(*&id)
+	forgetMetadata(e.location)
+}
+
+//// Listings
+
+// Element of an entry of the trash, where it was deleted from.
+func trashedElement(t trashEntry) (e element) {
+	e = element{Type: "file", Name: filepath.Base(t.path), Uri: t.Uri, Writable: "false", Deleted: true, DeletedDate: t.Deleted, TrashId: t.Id}
+	if t.Directory {
+		e.Type = "directory"
+	}
+	if info, err := fsys.stat(t.location); err == nil {
+		e.ModifiedDate = milliseconds(info.ModTime())
+		e.Size = strconv.FormatInt(info.Size(), 10)
+	}
+	return
+}
+
+// Listed directory of a URI, within a recursive listing.
+func listedDirectory(e *element, uri string) *element {
+	if e.Uri == uri {
+		return e
+	}
+	for i := range e.Children {
+		c := &e.Children[i]
+		if c.Type == "directory" && !c.Deleted && (c.Uri == uri || strings.HasPrefix(*&uri, c.Uri+"/")) {
+			return listedDirectory(*&c, *&uri)
+		}
+	}
+	return nil
+}
+
+// Adds the entries of the trash deleted from a listed directory, or from
+// anywhere under it for recursive listings, next to what is left there.
+func listTrashed(dir *element, p string, recursive bool, filter []string, returnType string) {
+	for _, t := range trashEntries() {
+		parent := filepath.Dir(t.path)
+		if parent != p && !(recursive && isUnderPrefix(*&parent, *&p)) {
+			continue
+		}
+		if t.Directory && returnType == "files" || !t.Directory && returnType == "directories" {
+			continue
+		}
+		if ext := strings.TrimPrefix(filepath.Ext(t.path), "."); !t.Directory && cap(*&filter) != 1 && !sliceContains(*&filter, *&ext) {
+			continue
+		}
+		d := dir
+		if parent != p {
+			// Not listed when deleted along with its directory
+			d = listedDirectory(*&dir, pathToUri(*&parent))
+		}
+		if d != nil {
+			d.Children = append(d.Children, trashedElement(*&t))
+		}
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Trash API
+
+// List the trash, restore an entry, purge one or empty the trash
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	// Entries come from anywhere, so only the owner sees them
+	if authEnabled() && requestUser(*&r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id := r.URL.Path[trashPathLen:]
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, trashEntries())
+			return
+		case "DELETE":
+			// Empty the trash
+			if !exist(trashDir) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			j, err := deleteTree(*&r, trashDir, func() {
+				for _, e := range trashEntries() {
+					metadata.delete(trashBucket, e.Id)
+					forgetMetadata(e.location)
+				}
+			})
+			writeDeleteOutcome(w, r, *&j, *&err)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := loadTrashEntry(*&id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		// Restore an entry where it was deleted from
+		err := restoreTrashEntry(*&e)
+		if err == os.ErrExist {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "DELETE":
+		// Purge an entry
+		j, err := deleteTree(*&r, e.location, func() { forgetTrashEntry(*&e) })
+		writeDeleteOutcome(w, r, *&j, *&err)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,247 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//////// SELF UPDATE
+
+// Verified binaries are staged next to the executable and swapped in on the
+// next start. Each binary of the manifest is signed with the release key
+// over a payload binding it to its version and platform: the lines
+// "ninja-release", the version, the platform (as in "linux-amd64") and the
+// lowercase hex SHA-256 digest of the binary. Releases which are not newer
+// than the running one are refused, whatever the manifest says.
+const updateSuffix = ".new"
+const previousSuffix = ".old"
+
+var errNoUpdateSource = errors.New("no update URL or public key configured")
+var errUpdateSignature = errors.New("release binary signature mismatch")
+var errUpdateDowngrade = errors.New("release is not newer than the running version")
+
+type releaseBinary struct {
+	Url       string `json:"url"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+type releaseManifest struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]releaseBinary `json:"binaries"`
+}
+
+type updateStatus struct {
+	Current   string `json:"current"`
+	Latest    string `json:"latest"`
+	Available bool   `json:"available"`
+	Staged    bool   `json:"staged"`
+}
+
+func platform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// Compares dotted version numbers, returning a positive number if a > b.
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(*&a, "."), strings.Split(*&b, ".")
+	for i := 0; i < len(*&as) || i < len(*&bs); i++ {
+		var x, y int
+		if i < len(*&as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(*&bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+func fetchReleaseManifest(ctx context.Context) (m releaseManifest, err error) {
+	if updateUrlFlag == "" || updateKeyFlag == "" {
+		err = errNoUpdateSource
+		return
+	}
+	err = httpGetJSON(*&ctx, updateUrlFlag, &m)
+	return
+}
+
+func checkUpdate(ctx context.Context) (status updateStatus, m releaseManifest, err error) {
+	status.Current = APP_VERSION
+	exe, err := os.Executable()
+	if err == nil {
+		_, err = os.Stat(exe + updateSuffix)
+		status.Staged = err == nil
+	}
+	m, err = fetchReleaseManifest(*&ctx)
+	if err != nil {
+		return
+	}
+	_, ok := m.Binaries[platform()]
+	status.Latest = m.Version
+	status.Available = ok && compareVersions(m.Version, APP_VERSION) > 0
+	return
+}
+
+// Payload signed for a binary of a release.
+func releasePayload(version string, platform string, sha string) []byte {
+	return []byte("ninja-release\n" + version + "\n" + platform + "\n" + strings.ToLower(*&sha))
+}
+
+func verifyRelease(binary []byte, version string, platform string, release releaseBinary) error {
+	if compareVersions(*&version, APP_VERSION) <= 0 {
+		return errUpdateDowngrade
+	}
+	sum := sha256.Sum256(*&binary)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), release.Sha256) {
+		return errUpdateSignature
+	}
+	key, err := base64.StdEncoding.DecodeString(updateKeyFlag)
+	if err != nil || len(*&key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid update public key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(*&key), releasePayload(*&version, *&platform, hex.EncodeToString(sum[:])), *&signature) {
+		return errUpdateSignature
+	}
+	return nil
+}
+
+// Downloads, verifies and stages the latest release for the next start.
+func stageUpdate(ctx context.Context) (status updateStatus, err error) {
+	status, m, err := checkUpdate(*&ctx)
+	if err != nil || !status.Available {
+		return
+	}
+	release := m.Binaries[platform()]
+	binary, err := httpGet(*&ctx, release.Url)
+	if err != nil {
+		return
+	}
+	err = verifyRelease(*&binary, m.Version, platform(), *&release)
+	if err != nil {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(exe+updateSuffix, *&binary, 0755)
+	if err != nil {
+		return
+	}
+	status.Staged = true
+	return
+}
+
+// Swaps in a staged release, if any, and restarts into it.
+func applyStagedUpdate() {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(exe + updateSuffix); err != nil {
+		return
+	}
+	os.Remove(exe + previousSuffix)
+	err = os.Rename(*&exe, exe+previousSuffix)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	err = os.Rename(exe+updateSuffix, *&exe)
+	if err != nil {
+		log.Println(*&err)
+		os.Rename(exe+previousSuffix, *&exe)
+		return
+	}
+	log.Println("Applied staged update, restarting")
+	err = restartProcess(*&exe)
+	if err != nil {
+		log.Println(*&err)
+	}
+}
+
+func printUpdateCheck() {
+	status, _, err := checkUpdate(context.Background())
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	if status.Available {
+		log.Println("Version", status.Latest, "is available (current:", status.Current+")")
+	} else {
+		log.Println("Version", status.Current, "is up to date")
+	}
+}
+
+//////// REQUEST HANDLERS
+
+//// Update API
+
+// Check for (GET) or stage (POST) an update, restricted to the owner
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if requestUser(r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var status updateStatus
+	var err error
+	switch r.Method {
+	case "GET":
+		status, _, err = checkUpdate(r.Context())
+	case "POST":
+		status, err = stageUpdate(r.Context())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err == errNoUpdateSource {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == errUpdateSignature {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, *&status)
+}
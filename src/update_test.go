@@ -0,0 +1,67 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyRelease(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateKeyFlag = base64.StdEncoding.EncodeToString(public)
+	defer func() { updateKeyFlag = "" }()
+
+	binary := []byte("binary")
+	sum := sha256.Sum256(binary)
+	sha := hex.EncodeToString(sum[:])
+	release := func(version string, platform string) releaseBinary {
+		signature := ed25519.Sign(private, releasePayload(version, platform, sha))
+		return releaseBinary{Sha256: sha, Signature: base64.StdEncoding.EncodeToString(signature)}
+	}
+
+	if err := verifyRelease(binary, "9.0", "linux-amd64", release("9.0", "linux-amd64")); err != nil {
+		t.Errorf("signed release: %v", err)
+	}
+	// The version and platform are signed along with the binary
+	if err := verifyRelease(binary, "99.0", "linux-amd64", release("9.0", "linux-amd64")); err != errUpdateSignature {
+		t.Errorf("raised version: %v", err)
+	}
+	if err := verifyRelease(binary, "9.0", "linux-amd64", release("9.0", "windows-amd64")); err != errUpdateSignature {
+		t.Errorf("other platform: %v", err)
+	}
+	if err := verifyRelease([]byte("other"), "9.0", "linux-amd64", release("9.0", "linux-amd64")); err != errUpdateSignature {
+		t.Errorf("other binary: %v", err)
+	}
+	// Even signed, older releases are refused
+	if err := verifyRelease(binary, "0.0.1", "linux-amd64", release("0.0.1", "linux-amd64")); err != errUpdateDowngrade {
+		t.Errorf("downgrade: %v", err)
+	}
+	if err := verifyRelease(binary, APP_VERSION, "linux-amd64", release(APP_VERSION, "linux-amd64")); err != errUpdateDowngrade {
+		t.Errorf("same version: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//////// UPLOAD PROGRESS
+
+// Uploads sent with an upload-id header report how much of them the cloud
+// received on the WebSocket events channel of their user, so that the
+// editor can show accurate progress bars for large files. Progress is sent
+// at most every uploadProgressInterval, then once more with the status of
+// the response when the upload is over.
+
+const uploadProgressInterval = 250 * time.Millisecond
+const maxUploadIdLength = 128
+
+type uploadProgress struct {
+	Type     string `json:"type"`
+	UploadId string `json:"uploadId"`
+	Uri      string `json:"uri"`
+	Received int64  `json:"received"`
+	// Size announced by the request, if any
+	Total   int64   `json:"total,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Done    bool    `json:"done"`
+	Status  int     `json:"status,omitempty"`
+
+	user string
+}
+
+// Events session following the uploads of a user.
+type uploadWatcher struct {
+	user string
+	ch   chan uploadProgress
+}
+
+var uploadWatchers = struct {
+	mutex    sync.Mutex
+	watchers map[*uploadWatcher]bool
+}{watchers: make(map[*uploadWatcher]bool)}
+
+func watchUploads(user string) *uploadWatcher {
+	w := &uploadWatcher{user, make(chan uploadProgress, 64)}
+	uploadWatchers.mutex.Lock()
+	defer uploadWatchers.mutex.Unlock()
+	uploadWatchers.watchers[w] = true
+	return w
+}
+
+func (w *uploadWatcher) stop() {
+	uploadWatchers.mutex.Lock()
+	defer uploadWatchers.mutex.Unlock()
+	delete(uploadWatchers.watchers, w)
+}
+
+// Sends progress to the sessions of its user, skipping those which lag.
+func publishUploadProgress(p uploadProgress) {
+	p.Type = "upload-progress"
+	if p.Total > 0 {
+		p.Percent = float64(p.Received) * 100 / float64(p.Total)
+	}
+	uploadWatchers.mutex.Lock()
+	defer uploadWatchers.mutex.Unlock()
+	for w := range uploadWatchers.watchers {
+		if authEnabled() && w.user != p.user {
+			continue
+		}
+		select {
+		case w.ch <- p:
+		default:
+		}
+	}
+}
+
+// Body reporting the progress of its reading.
+type progressBody struct {
+	io.ReadCloser
+	progress uploadProgress
+	last     time.Time
+}
+
+func (b *progressBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(*&p)
+	b.progress.Received += int64(n)
+	if n > 0 && time.Since(b.last) >= uploadProgressInterval {
+		b.last = time.Now()
+		publishUploadProgress(b.progress)
+	}
+	return
+}
+
+//////// MIDDLEWARES
+
+func uploadProgressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("upload-id")
+		if id == "" || len(id) > maxUploadIdLength || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		uri := r.URL.Path
+		if p, ok := requestPath(*&r); ok {
+			uri = pathToUri(*&p)
+		}
+		body := &progressBody{ReadCloser: r.Body, last: time.Now()}
+		body.progress = uploadProgress{UploadId: id, Uri: uri, user: requestUser(*&r)}
+		if r.ContentLength > 0 {
+			body.progress.Total = r.ContentLength
+		}
+		r.Body = body
+		publishUploadProgress(body.progress)
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			body.progress.Done = true
+			body.progress.Status = recorder.code()
+			publishUploadProgress(body.progress)
+		}()
+		next.ServeHTTP(*&recorder, r)
+	})
+}
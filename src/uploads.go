@@ -0,0 +1,161 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+//////// UPLOAD RESTRICTIONS
+
+// Files users may save, by extension such as .png or MIME type such as
+// image/*. MIME types are those recognized from the content, implied by the
+// extension and declared by the request, any of them matching.
+type uploadPolicy struct {
+	// Accepted types, everything if empty
+	Allow []string `json:"allow"`
+	// Refused types, taking precedence
+	Deny []string `json:"deny"`
+}
+
+// Refused when several people share the cloud and nothing is configured,
+// so that it does not serve programs to its users.
+var sharedUploadPolicy = uploadPolicy{Deny: []string{
+	".exe", ".com", ".scr", ".msi", ".dll", ".bat", ".cmd", ".ps1", ".vbs",
+	".sh", ".bash", ".command", ".app", ".jar", ".apk",
+	"application/x-msdownload", "application/x-executable",
+	"application/x-mach-binary", "application/x-sh",
+}}
+
+type uploadRefusal struct {
+	Error string `json:"error"`
+	// Either "denied" or "not-allowed"
+	Reason    string `json:"reason"`
+	Uri       string `json:"uri"`
+	Extension string `json:"extension,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+// Whether the users of the cloud may not trust each other.
+func sharedDeployment() bool {
+	return tenantsFlag || len(cloudConfig.Users) > 1 || oidcEnabled()
+}
+
+func activeUploadPolicy() *uploadPolicy {
+	if cloudConfig.Uploads != nil {
+		return cloudConfig.Uploads
+	}
+	if sharedDeployment() {
+		return &sharedUploadPolicy
+	}
+	return nil
+}
+
+func checkUploads() error {
+	if cloudConfig.Uploads == nil {
+		return nil
+	}
+	for _, list := range [][]string{cloudConfig.Uploads.Allow, cloudConfig.Uploads.Deny} {
+		for i, t := range list {
+			if !strings.HasPrefix(*&t, ".") && !strings.Contains(*&t, "/") {
+				return errors.New("upload type " + t + " is neither an extension nor a MIME type")
+			}
+			list[i] = strings.ToLower(*&t)
+		}
+	}
+	return nil
+}
+
+// Recognizes programs from their first bytes.
+func executableType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(*&content, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(*&content, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(*&content, []byte{0xcf, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(*&content, []byte{0xce, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(*&content, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(*&content, []byte("#!")):
+		return "application/x-sh"
+	}
+	return ""
+}
+
+func matchesUploadType(pattern string, ext string, types []string) bool {
+	if strings.HasPrefix(*&pattern, ".") {
+		return pattern == ext
+	}
+	for _, t := range types {
+		if pattern == t || strings.HasSuffix(*&pattern, "/*") && strings.HasPrefix(*&t, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells why a file may not be saved under a path, given the declared
+// content type and the content if known, or nil.
+func refuseUpload(p string, contentType string, content []byte) *uploadRefusal {
+	policy := activeUploadPolicy()
+	if policy == nil {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(*&p))
+	var types []string
+	for _, t := range []string{executableType(*&content), mime.TypeByExtension(*&ext), contentType} {
+		if t, _, err := mime.ParseMediaType(*&t); err == nil {
+			types = append(types, t)
+		}
+	}
+	refusal := &uploadRefusal{Error: "type-not-allowed", Uri: pathToUri(*&p), Extension: ext}
+	for _, d := range policy.Deny {
+		if matchesUploadType(*&d, *&ext, *&types) {
+			refusal.Reason = "denied"
+			if !strings.HasPrefix(*&d, ".") {
+				refusal.Type = d
+			}
+			return refusal
+		}
+	}
+	if len(policy.Allow) == 0 {
+		return nil
+	}
+	for _, a := range policy.Allow {
+		if matchesUploadType(*&a, *&ext, *&types) {
+			return nil
+		}
+	}
+	refusal.Reason = "not-allowed"
+	if len(types) > 0 {
+		refusal.Type = types[0]
+	}
+	return refusal
+}
+
+func writeUploadRefusal(w http.ResponseWriter, refusal *uploadRefusal) {
+	writeJSON(w, http.StatusUnsupportedMediaType, *&refusal)
+}
@@ -0,0 +1,97 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+//////// USAGE WARNINGS
+
+// Writes keep succeeding while space runs low, but their responses warn
+// about it so that the editor can tell users before writes start failing.
+
+var diskWarning int64
+
+// Warnings about the space left to the user of a request.
+func usageWarnings(r *http.Request) (warnings []string) {
+	warnings = []string{}
+	user := requestUser(*&r)
+	if dir, ok := tenantDir(*&user); ok {
+		if quota := tenantQuota(*&user); quota > 0 {
+			used, err := tenantUsed(*&user, *&dir)
+			if err != nil {
+				log.Println(*&err)
+			} else if float64(used) >= quotaWarningFlag*float64(quota) {
+				warnings = append(warnings, strconv.Itoa(int(100*used/quota))+"% of the quota used")
+			}
+		}
+	}
+	if diskWarning > 0 {
+		free, err := diskFree(".")
+		if err != nil {
+			log.Println(*&err)
+		} else if free < diskWarning {
+			warnings = append(warnings, "only "+formatByteSize(*&free)+" left on disk")
+		}
+	}
+	return
+}
+
+func formatByteSize(size int64) string {
+	for _, unit := range []string{"G", "M", "K"} {
+		if s, _ := parseByteSize("1" + unit); size >= s {
+			return strconv.FormatFloat(float64(size)/float64(s), 'f', 1, 64) + unit
+		}
+	}
+	return strconv.FormatInt(*&size, 10)
+}
+
+//////// MIDDLEWARES
+
+func usageWarningMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+			for _, warning := range usageWarnings(*&r) {
+				w.Header().Add("Warning", `199 ninja "`+warning+`"`)
+			}
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			// The breakdown of the space taken no longer holds
+			defer forgetRequestUsage(*&r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func forgetRequestUsage(r *http.Request) {
+	if p, ok := requestPath(*&r); ok {
+		forgetUsage(*&p)
+	}
+	for _, h := range []string{"sourceURI", "destination"} {
+		if uri := r.Header.Get(*&h); uri != "" {
+			if p, ok := uriToPath(*&uri); ok {
+				forgetUsage(*&p)
+			}
+		}
+	}
+}
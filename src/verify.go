@@ -0,0 +1,79 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+//////// WRITE VERIFICATION
+
+// With -verify-writes, for storage which may lose or corrupt data silently
+// such as flaky USB drives or network shares, every file written is synced
+// where possible then read back, and the write only succeeds if it holds
+// what was written. Saves through the API then return the revision stored.
+
+var errWriteMismatch = errors.New("file read back differs from what was written")
+
+type syncer interface {
+	Sync() error
+}
+
+func verifyWrite(path string, content []byte) error {
+	stored, err := readFile(*&path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(*&stored, *&content) {
+		logWarn("Write verification failed for", *&path)
+		return errWriteMismatch
+	}
+	return nil
+}
+
+func fileSum(ctx context.Context, path string) (sum []byte, err error) {
+	f, err := fsys.open(*&path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := verifyHash()
+	_, err = io.Copy(*&h, ctxReader{*&ctx, *&f})
+	return h.Sum(nil), err
+}
+
+func verifyCopy(ctx context.Context, source string, dest string) error {
+	expected, err := fileSum(*&ctx, *&source)
+	if err != nil {
+		return err
+	}
+	stored, err := fileSum(*&ctx, *&dest)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(*&stored, *&expected) {
+		logWarn("Write verification failed for", *&dest)
+		return errWriteMismatch
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////// VERSIONS
+
+// The projects as they were when a snapshot was taken, browsed read-only
+// under /versions/<version>/, the version being the name of a snapshot or
+// a date, in milliseconds or RFC 3339, standing for the latest snapshot
+// taken by then. Directories are listed and files read as through the
+// Directory and Files APIs.
+
+// Fields known from the snapshot alone, creation dates and directory
+// metadata being looked up in the current tree.
+var versionFields = listingFields{"type": true, "name": true, "uri": true, "modifiedDate": true, "size": true}
+
+type version struct {
+	Name    string `json:"name"`
+	Created string `json:"created"`
+	Reason  string `json:"reason,omitempty"`
+	Uri     string `json:"uri"`
+}
+
+// Snapshot of a version.
+func versionSnapshot(v string) (s snapshot, ok bool) {
+	if s, ok = loadSnapshot(*&v); ok {
+		return
+	}
+	var at time.Time
+	if ms, err := strconv.ParseInt(*&v, 10, 64); err == nil {
+		at = time.Unix(0, ms*int64(time.Millisecond))
+	} else if t, err := time.Parse(time.RFC3339, *&v); err == nil {
+		at = t
+	} else {
+		return
+	}
+	for _, c := range listSnapshots() {
+		if parseMilliseconds(c.Created).After(*&at) {
+			break
+		}
+		s, ok = c, true
+	}
+	return
+}
+
+func versionHref(v string) func(uri string, dir bool) string {
+	return func(uri string, dir bool) string {
+		return basePathFlag + versionsPath + v + "/" + strings.TrimPrefix(*&uri, drivePrefix)
+	}
+}
+
+// Storage reading a mounted snapshot, decrypting the files of encrypted
+// projects with the key they are unlocked with.
+func snapshotStorage(dir string) storage {
+	return encryptedStorage{fsStorage{os.DirFS(*&dir)}}
+}
+
+//////// REQUEST HANDLERS
+
+//// Versions API
+
+// List the versions, or browse the projects as they were in one of them
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if snapshots == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rest := r.URL.Path[versionsPathLen:]
+	if rest == "" {
+		versions := []version{}
+		for _, s := range listSnapshots() {
+			versions = append(versions, version{s.Name, s.Created, s.Reason, basePathFlag + versionsPath + s.Name + "/" + projectsDir})
+		}
+		writeJSON(w, http.StatusOK, *&versions)
+		return
+	}
+	v, uri := rest, projectsDir
+	if i := strings.Index(*&rest, "/"); i >= 0 {
+		v, uri = rest[:i], rest[i+1:]
+	}
+	s, ok := versionSnapshot(*&v)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, ok := uriToPath(*&uri)
+	if !ok || strings.HasPrefix(*&p, hiddenPrefix) || strings.Contains(filepath.ToSlash(*&p), "/"+hiddenPrefix) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if authEnabled() && !allowed(requestUser(*&r), *&p, opRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	dir, release, err := snapshots.mount(s.Ref)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	versioned := snapshotStorage(*&dir)
+	info, err := versioned.stat(*&p)
+	if os.IsNotExist(*&err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("x-ninja-version", s.Name)
+	if !info.IsDir() {
+		if projectLocked(*&p) {
+			writeProjectLocked(w, *&r, *&p)
+			return
+		}
+		f, err := versioned.open(*&p)
+		if err != nil {
+			log.Println(*&err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		if ct := mime.TypeByExtension(filepath.Ext(*&p)); ct != "" {
+			w.Header().Set("Content-Type", *&ct)
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		_, err = io.Copy(w, *&f)
+		if err != nil {
+			logDebug("http", *&err)
+		}
+		return
+	}
+	entries, err := versioned.readDir(*&p)
+	if err != nil {
+		log.Println(*&err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e := element{
+		Type:         "directory",
+		Name:         info.Name(),
+		Uri:          pathToUri(*&p),
+		ModifiedDate: milliseconds(info.ModTime()),
+		Size:         strconv.FormatInt(info.Size(), 10),
+		Writable:     "false",
+		Children:     []element{},
+	}
+	if p == "." {
+		e.Name = projectsDir
+	}
+	for _, c := range entries {
+		if strings.HasPrefix(c.Name(), hiddenPrefix) {
+			continue
+		}
+		kind := "file"
+		if c.IsDir() {
+			kind = "directory"
+		}
+		child := newElement(*&kind, e.Uri, filepath.Join(*&p, c.Name()), *&c, versionFields)
+		child.Writable = "false"
+		e.Children = append(e.Children, *&child)
+	}
+	if wantsHTML(*&r) {
+		renderListingLinked(w, *&r, *&p, *&e, versionHref(*&v))
+		return
+	}
+	err = writeListing(w, &e, nil, apiVersion(*&r), requestDateFormat(*&r))
+	if err != nil {
+		logDebug("listing", *&err)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////// VIRTUAL HOSTS
+
+// Previews of several compositions side by side, each at the root of a
+// host name of its own such as project1.localhost, so that their root
+// relative URLs work as they will once published. Every request to such a
+// host is served from the directory it maps to, the API being left to the
+// main host name.
+
+func checkHosts() error {
+	for host, uri := range cloudConfig.Hosts {
+		if host == "" || host != strings.ToLower(*&host) || strings.Contains(*&host, ":") {
+			return errors.New("virtual hosts are lower case host names without port: " + host)
+		}
+		if p, ok := uriToPath(*&uri); !ok || p == "" || p == "." {
+			return errors.New("virtual host " + host + " has to map to a directory of the projects: " + uri)
+		}
+	}
+	return nil
+}
+
+// Directory a request is served from, by its host name.
+func virtualHostDir(r *http.Request) (p string, ok bool) {
+	if len(cloudConfig.Hosts) == 0 {
+		return
+	}
+	host := requestHost(*&r)
+	if h, _, err := net.SplitHostPort(*&host); err == nil {
+		host = h
+	}
+	uri, ok := cloudConfig.Hosts[strings.ToLower(strings.TrimSuffix(*&host, "."))]
+	if !ok {
+		return
+	}
+	return uriToPath(*&uri)
+}
+
+// Base URLs of the virtual hosts, on the port of the given base URL.
+func virtualHostUrls(base string) (urls map[string]string) {
+	urls = make(map[string]string)
+	u, err := url.Parse(*&base)
+	if err != nil {
+		return
+	}
+	for host := range cloudConfig.Hosts {
+		v := *u
+		v.Host = host
+		if port := u.Port(); port != "" {
+			v.Host = net.JoinHostPort(*&host, *&port)
+		}
+		v.Path = ""
+		urls[host] = v.String()
+	}
+	return
+}
+
+func virtualHostNames() (names []string) {
+	for host := range cloudConfig.Hosts {
+		names = append(*&names, *&host)
+	}
+	sort.Strings(*&names)
+	return
+}
+
+//////// MIDDLEWARES
+
+// Serves the requests to virtual hosts from their directory, as the static
+// file server would under the main host.
+func virtualHostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir, ok := virtualHostDir(*&r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.WithContext(r.Context())
+		u := *r.URL
+		u.Path = basePathFlag + "/" + filepath.ToSlash(*&dir) + r.URL.Path
+		u.RawPath = ""
+		r2.URL = &u
+		next.ServeHTTP(w, *&r2)
+	})
+}
@@ -0,0 +1,103 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////// WARM-UP
+
+// With -warm-up the tree is walked in the background at startup, recording
+// the creation times listings need and the disk usage of every directory,
+// and reading the directories into the caches of the system, so that the
+// first listing of a huge project is not the slowest request of the day.
+// The status reports its progress.
+
+type warmUpStatus struct {
+	mutex    sync.Mutex
+	started  time.Time
+	finished time.Time
+	// Entries the last scan of the watcher found, to estimate progress
+	expected int
+	err      error
+}
+
+var warmUp warmUpStatus
+var warmedEntries int64
+
+func startWarmUp() {
+	warmUp.mutex.Lock()
+	warmUp.started = time.Now()
+	warmUp.expected = len(journal.lastScan())
+	warmUp.mutex.Unlock()
+	go func() {
+		err := parallelWalk(backgroundContext, ".", func(p string, info os.FileInfo) error {
+			if strings.HasPrefix(info.Name(), hiddenPrefix) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			creationTime(*&p, *&info)
+			atomic.AddInt64(&warmedEntries, 1)
+			return nil
+		})
+		if err == nil {
+			_, err = diskUsage(backgroundContext, ".")
+		}
+		if err != nil {
+			log.Println(*&err)
+		}
+		warmUp.mutex.Lock()
+		defer warmUp.mutex.Unlock()
+		warmUp.finished = time.Now()
+		warmUp.err = err
+		logInfo("Warmed up", atomic.LoadInt64(&warmedEntries), "entries in", warmUp.finished.Sub(warmUp.started).Round(time.Millisecond))
+	}()
+}
+
+func (s *warmUpStatus) report() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := atomic.LoadInt64(&warmedEntries)
+	report := map[string]interface{}{
+		"started": milliseconds(s.started),
+		"entries": entries,
+		"done":    !s.finished.IsZero(),
+	}
+	switch {
+	case !s.finished.IsZero():
+		report["duration-ms"] = s.finished.Sub(s.started).Milliseconds()
+	case s.expected > 0:
+		report["progress"] = math.Min(float64(*&entries)/float64(s.expected), 0.99)
+	}
+	if s.err != nil {
+		report["error"] = s.err.Error()
+	}
+	return report
+}
@@ -0,0 +1,270 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//////// FILESYSTEM WATCHDOG
+
+// Roots on network shares may hang on any call. With -fs-timeout, every
+// storage operation, and every read or write of a file, gives up after the
+// deadline and fails as not responding, the call being left to finish in
+// the background. Until the stuck calls return, the filesystem is reported
+// as not responding by the status, and requests are answered with 503
+// right away instead of piling up more stuck calls.
+
+var errFsNotResponding = errors.New("filesystem not responding")
+
+// Stuck calls past which new ones fail without being tried
+const maxStuckCalls = 64
+
+var watchdog = struct {
+	sync.Mutex
+	stuck    int
+	since    time.Time
+	timeouts int64
+}{}
+
+func fsResponding() bool {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	return watchdog.stuck == 0
+}
+
+func watchdogReport() map[string]interface{} {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	report := map[string]interface{}{
+		"timeout-ms": fsTimeoutFlag.Milliseconds(),
+		"responding": watchdog.stuck == 0,
+		"timeouts":   watchdog.timeouts,
+	}
+	if watchdog.stuck > 0 {
+		report["stuck-calls"] = watchdog.stuck
+		report["since"] = milliseconds(watchdog.since)
+	}
+	return report
+}
+
+// Runs a call with the deadline, counting it as stuck while it overruns.
+// The call hands its result back rather than setting variables of the
+// caller, which a call left behind would otherwise write to concurrently,
+// and what it opens too late is closed once it returns.
+func withDeadline(op string, name string, call func() (interface{}, error)) (interface{}, error) {
+	watchdog.Lock()
+	if watchdog.stuck >= maxStuckCalls {
+		watchdog.Unlock()
+		return nil, &os.PathError{Op: op, Path: name, Err: errFsNotResponding}
+	}
+	watchdog.Unlock()
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := call()
+		done <- result{v, err}
+	}()
+	timer := time.NewTimer(fsTimeoutFlag)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+	}
+	watchdog.Lock()
+	if watchdog.stuck == 0 {
+		watchdog.since = time.Now()
+		logWarn("Filesystem not responding:", op, name)
+	}
+	watchdog.stuck++
+	watchdog.timeouts++
+	watchdog.Unlock()
+	go func() {
+		r := <-done
+		if c, ok := r.value.(io.Closer); ok && r.err == nil {
+			c.Close()
+		}
+		watchdog.Lock()
+		defer watchdog.Unlock()
+		watchdog.stuck--
+		if watchdog.stuck == 0 {
+			logInfo("Filesystem responding again after", time.Since(watchdog.since).Round(100*time.Millisecond))
+		}
+	}()
+	return nil, &os.PathError{Op: op, Path: name, Err: errFsNotResponding}
+}
+
+// Runs a call returning nothing but an error with the deadline.
+func withDeadlineErr(op string, name string, call func() error) error {
+	_, err := withDeadline(*&op, *&name, func() (interface{}, error) { return nil, call() })
+	return err
+}
+
+// Runs a call made on disk behind the back of the storage layers, with the
+// deadline when there is one.
+func onDisk(op string, name string, call func() (interface{}, error)) (interface{}, error) {
+	if fsTimeoutFlag <= 0 {
+		return call()
+	}
+	return withDeadline(*&op, *&name, *&call)
+}
+
+//// Storage
+
+type watchedStorage struct {
+	storage
+}
+
+func (s watchedStorage) stat(name string) (info os.FileInfo, err error) {
+	v, err := withDeadline("stat", *&name, func() (interface{}, error) { return s.storage.stat(*&name) })
+	info, _ = v.(os.FileInfo)
+	return
+}
+
+func (s watchedStorage) readDir(name string) (list []os.FileInfo, err error) {
+	v, err := withDeadline("readdir", *&name, func() (interface{}, error) { return s.storage.readDir(*&name) })
+	list, _ = v.([]os.FileInfo)
+	return
+}
+
+func (s watchedStorage) open(name string) (r io.ReadCloser, err error) {
+	v, err := withDeadline("open", *&name, func() (interface{}, error) { return s.storage.open(*&name) })
+	if err == nil {
+		r = watchedFile{name, v.(io.ReadCloser), nil}
+	}
+	return
+}
+
+func (s watchedStorage) create(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	v, err := withDeadline("create", *&name, func() (interface{}, error) { return s.storage.create(*&name, *&perm) })
+	if err == nil {
+		w = watchedFile{name, nil, v.(io.WriteCloser)}
+	}
+	return
+}
+
+func (s watchedStorage) createNew(name string, perm os.FileMode) (w io.WriteCloser, err error) {
+	v, err := withDeadline("create", *&name, func() (interface{}, error) { return s.storage.createNew(*&name, *&perm) })
+	if err == nil {
+		w = watchedFile{name, nil, v.(io.WriteCloser)}
+	}
+	return
+}
+
+func (s watchedStorage) mkdirAll(name string, perm os.FileMode) error {
+	return withDeadlineErr("mkdir", *&name, func() error { return s.storage.mkdirAll(*&name, *&perm) })
+}
+
+func (s watchedStorage) remove(name string) error {
+	return withDeadlineErr("remove", *&name, func() error { return s.storage.remove(*&name) })
+}
+
+func (s watchedStorage) removeAll(name string) error {
+	return withDeadlineErr("remove", *&name, func() error { return s.storage.removeAll(*&name) })
+}
+
+func (s watchedStorage) rename(source string, dest string) error {
+	return withDeadlineErr("rename", *&source, func() error { return s.storage.rename(*&source, *&dest) })
+}
+
+func (s watchedStorage) chmod(name string, mode os.FileMode) error {
+	return withDeadlineErr("chmod", *&name, func() error { return s.storage.chmod(*&name, *&mode) })
+}
+
+// File being read or written, one of both set.
+type watchedFile struct {
+	name string
+	r    io.ReadCloser
+	w    io.WriteCloser
+}
+
+// Reads into a buffer of its own, which a read left behind may still fill
+// after the caller moved on, and copies what was read in time.
+func (f watchedFile) Read(p []byte) (n int, err error) {
+	buf := make([]byte, len(p))
+	v, err := withDeadline("read", f.name, func() (interface{}, error) { return f.r.Read(*&buf) })
+	if read, ok := v.(int); ok {
+		n = copy(*&p, buf[:read])
+	}
+	return
+}
+
+// Writes from a copy, which the caller may not change under a write left
+// behind.
+func (f watchedFile) Write(p []byte) (n int, err error) {
+	buf := append([]byte(nil), p...)
+	v, err := withDeadline("write", f.name, func() (interface{}, error) { return f.w.Write(*&buf) })
+	n, _ = v.(int)
+	return
+}
+
+func (f watchedFile) Close() error {
+	return withDeadlineErr("close", f.name, func() error {
+		if f.r != nil {
+			return f.r.Close()
+		}
+		return f.w.Close()
+	})
+}
+
+//////// MIDDLEWARES
+
+// Answers right away while the filesystem hangs, and tells requests which
+// ran into it apart from other failures.
+func watchdogMiddleware(next http.Handler) http.Handler {
+	if fsTimeoutFlag <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fsResponding() && r.URL.Path != statusPath {
+			w.Header().Set("Retry-After", "10")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"error":   "filesystem-not-responding",
+				"message": errorMessage(*&r, "filesystem-not-responding"),
+			})
+			return
+		}
+		next.ServeHTTP(watchdogWriter{w}, r)
+	})
+}
+
+type watchdogWriter struct {
+	http.ResponseWriter
+}
+
+func (w watchdogWriter) WriteHeader(status int) {
+	if status == http.StatusInternalServerError && !fsResponding() {
+		status = http.StatusServiceUnavailable
+	}
+	w.ResponseWriter.WriteHeader(*&status)
+}
+
+func (w watchdogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,130 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// Reader hanging until released, then filling the buffer it was given.
+type hangingReader struct {
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (r hangingReader) Read(p []byte) (int, error) {
+	<-r.release
+	defer close(r.done)
+	return copy(p, "late"), nil
+}
+
+func (r hangingReader) Close() error {
+	return nil
+}
+
+func TestWatchedReadTimeout(t *testing.T) {
+	fsTimeoutFlag = 10 * time.Millisecond
+	defer func() { fsTimeoutFlag = 0 }()
+	r := hangingReader{make(chan struct{}), make(chan struct{})}
+	f := watchedFile{"hanging", r, nil}
+
+	p := []byte("....")
+	n, err := f.Read(p)
+	if n != 0 || !errors.Is(err, errFsNotResponding) {
+		t.Fatalf("read: %d %v", n, err)
+	}
+	if fsResponding() {
+		t.Error("responding with a stuck call")
+	}
+	close(r.release)
+	<-r.done
+	for i := 0; i < 100 && !fsResponding(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !bytes.Equal(p, []byte("....")) {
+		t.Errorf("buffer written after the timeout: %q", p)
+	}
+	if !fsResponding() {
+		t.Error("still stuck")
+	}
+}
+
+func TestWatchedReadInTime(t *testing.T) {
+	fsTimeoutFlag = time.Second
+	defer func() { fsTimeoutFlag = 0 }()
+	s := watchedStorage{newMemStorage()}
+	newTestCloudOver(t, s)
+	err := createDir("p")
+	if err == nil {
+		err = saveFile("p/a.txt", []byte("content"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := readFile("p/a.txt")
+	if err != nil || string(content) != "content" {
+		t.Errorf("read: %q %v", content, err)
+	}
+	if _, err := s.stat("p/missing"); err == nil {
+		t.Error("stat of a missing file")
+	}
+}
+
+func TestDiskCopiesWatched(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(*&wd)
+	fsTimeoutFlag = time.Second
+	defer func() { fsTimeoutFlag = 0 }()
+	newTestCloudOver(t, watchedStorage{diskStorage{}})
+	err = saveFile("a.txt", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies go through the watched storage rather than behind it
+	if p, ok := copyDiskPath("a.txt"); ok {
+		t.Errorf("direct copy to %s under the watchdog", p)
+	}
+	if done, err := copyOnDisk(context.Background(), "a.txt", "b.txt"); done || err != nil {
+		t.Errorf("copied on disk: %v %v", done, err)
+	}
+	shared, err := cloneFile("a.txt", "c.txt", 0666)
+	if shared || err != nil {
+		t.Errorf("clone: %v %v", shared, err)
+	}
+	if content, err := readFile("c.txt"); err != nil || string(content) != "content" {
+		t.Errorf("cloned: %q %v", content, err)
+	}
+	if _, err := freeSpace("a.txt"); err != nil {
+		t.Errorf("free space: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// WATCHER
+
+// Periodically scans the projects to notice changes, whether made through
+// the cloud or by other programs, and records them in the journal.
+
+type fileState struct {
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func scanTree(ctx context.Context, root string) (states map[string]fileState, err error) {
+	release, err := acquireIO(*&ctx)
+	if err != nil {
+		return
+	}
+	defer release()
+	states = make(map[string]fileState)
+	var mutex sync.Mutex
+	err = parallelWalk(*&ctx, *&root, func(p string, info os.FileInfo) error {
+		if strings.HasPrefix(info.Name(), hiddenPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mutex.Lock()
+		states[p] = fileState{info.IsDir(), info.Size(), info.ModTime()}
+		mutex.Unlock()
+		return nil
+	})
+	return
+}
+
+func stateType(s fileState) string {
+	if s.Dir {
+		return "directory"
+	}
+	return "file"
+}
+
+// Records the differences between two scans.
+func journalDifferences(before map[string]fileState, after map[string]fileState) (changed bool) {
+	var paths []string
+	for p := range before {
+		paths = append(*&paths, *&p)
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			paths = append(*&paths, *&p)
+		}
+	}
+	sort.Strings(*&paths)
+	for _, p := range paths {
+		b, existed := before[p]
+		a, exists := after[p]
+		switch {
+		case existed && !exists:
+			changeDebouncer.record("removed", stateType(*&b), *&p)
+		case !existed && exists:
+			changeDebouncer.record("created", stateType(*&a), *&p)
+		case a.Dir != b.Dir:
+			changeDebouncer.record("removed", stateType(*&b), *&p)
+			changeDebouncer.record("created", stateType(*&a), *&p)
+		case !a.Dir && (a.Size != b.Size || !a.ModTime.Equal(b.ModTime)):
+			changeDebouncer.record("modified", "file", *&p)
+		default:
+			continue
+		}
+		changed = true
+	}
+	return
+}
+
+var errWatcherStopped = errors.New("the watcher is not running")
+
+type treeWatcher struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	// Last scan, shared with the journal and never modified
+	states map[string]fileState
+	// Closed to stop the periodic scans
+	stop chan struct{}
+	// Held while scanning, so that changes are not journaled twice
+	scanning sync.Mutex
+}
+
+var watcher treeWatcher
+
+// Changes made while the cloud was not running are found by comparing the
+// first scan with the last one of the previous run.
+func startWatcher(interval time.Duration) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.interval = interval
+	watcher.start()
+}
+
+// Called with the watcher locked.
+func (w *treeWatcher) start() {
+	w.states = journal.lastScan()
+	w.scan()
+	w.stop = make(chan struct{})
+	go w.loop(w.stop, w.interval)
+}
+
+func (w *treeWatcher) loop(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(*&interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.scan()
+		}
+	}
+}
+
+// Scans the whole tree, journaling what changed since the last scan.
+func (w *treeWatcher) scan() {
+	w.scanning.Lock()
+	defer w.scanning.Unlock()
+	start := time.Now()
+	current, err := scanTree(backgroundContext, ".")
+	watcherHealth.scanned(*&current, *&start, *&err)
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	changed := w.states == nil || journalDifferences(w.states, *&current)
+	if changed {
+		journal.setLastScan(*&current)
+	}
+	logTrace("watch", "scanned", len(*&current), "entries in", time.Since(*&start).Round(time.Microsecond))
+	if changed {
+		logDebug("watch", "changes found in the tree")
+	}
+	w.states = current
+}
+
+// Scans a subtree right away, for changes the periodic scans would only
+// find later, or missed.
+func (w *treeWatcher) rescan(root string) (changed bool, err error) {
+	w.scanning.Lock()
+	defer w.scanning.Unlock()
+	if w.states == nil {
+		return false, errWatcherStopped
+	}
+	after, err := scanTree(backgroundContext, *&root)
+	if err != nil {
+		return
+	}
+	if info, err := fsys.stat(*&root); err == nil && root != "." {
+		after[root] = fileState{info.IsDir(), info.Size(), info.ModTime()}
+	}
+	before := make(map[string]fileState)
+	current := make(map[string]fileState, len(w.states))
+	for p, s := range w.states {
+		if isUnderPrefix(filepath.ToSlash(*&p), filepath.ToSlash(*&root)) {
+			before[p] = s
+		} else {
+			current[p] = s
+		}
+	}
+	for p, s := range after {
+		current[p] = s
+	}
+	changed = journalDifferences(*&before, *&after)
+	if changed {
+		journal.setLastScan(*&current)
+	}
+	w.states = current
+	return
+}
+
+// Starts over from a full scan, the periodic scans being restarted.
+func (w *treeWatcher) restart() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stop == nil {
+		return errWatcherStopped
+	}
+	close(w.stop)
+	logInfo("Restarting the watcher")
+	w.start()
+	return nil
+}
+
+// Problems which may have the watcher miss changes or report them late.
+func watcherWarnings() (warnings []string) {
+	warnings = []string{}
+	watcherHealth.mutex.Lock()
+	duration, err, overruns := watcherHealth.duration, watcherHealth.err, watcherHealth.overruns
+	watcherHealth.mutex.Unlock()
+	if err != nil {
+		warnings = append(warnings, "the last scan failed: "+err.Error())
+	}
+	if overruns > 0 {
+		warnings = append(warnings, "scans took longer than -watch-interval "+strconv.FormatInt(*&overruns, 10)+" times, the last one "+duration.Round(time.Millisecond).String())
+	}
+	if dropped := journal.droppedChanges(); dropped > 0 {
+		warnings = append(warnings, strconv.FormatInt(*&dropped, 10)+" changes were dropped from the journal, clients behind have to rescan")
+	}
+	return
+}
+
+func watcherReport() (report map[string]interface{}) {
+	report = watcherHealth.report()
+	// Scans instead of system notifications, no watch limits apply
+	report["method"] = "polling"
+	report["warnings"] = watcherWarnings()
+	return
+}
+
+//////// REQUEST HANDLERS
+
+//// Watcher API
+
+// Read the state of the watcher, rescan a subtree or restart it
+func watcherHandler(w http.ResponseWriter, r *http.Request) {
+	writeCORSHeaders(w)
+	if authEnabled() && requestUser(*&r) != ownerUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, watcherReport())
+		return
+	case "POST":
+		switch r.URL.Query().Get("action") {
+		case "rescan":
+			p, ok := requestPath(*&r)
+			if !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			started := time.Now()
+			changed, err := watcher.rescan(*&p)
+			if err == errWatcherStopped {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if os.IsNotExist(*&err) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"uri":         pathToUri(*&p),
+				"changed":     changed,
+				"duration-ms": time.Since(*&started).Milliseconds(),
+			})
+			return
+		case "restart":
+			err := watcher.restart()
+			if err == errWatcherStopped {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Println(*&err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, watcherReport())
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
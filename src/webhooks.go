@@ -0,0 +1,127 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+//////// WEBHOOKS
+
+// Changes from the journal are posted as JSON to the URLs configured for
+// them, such as a build service to trigger whenever a site is published.
+
+const webhookTimeout = 10 * time.Second
+const webhookAttempts = 3
+const webhookRetryDelay = 5 * time.Second
+
+type webhook struct {
+	eventFilter
+	Url string `json:"url"`
+	// Key of the HMAC-SHA256 signature of the body, sent as X-Ninja-Signature
+	Secret string `json:"secret"`
+}
+
+type webhookPayload struct {
+	Cursor  int64    `json:"cursor"`
+	Changes []change `json:"changes"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+func (h *webhook) post(body []byte) (err error) {
+	req, err := http.NewRequest("POST", h.Url, bytes.NewReader(*&body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", APP_NAME+"/"+APP_VERSION)
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(*&body)
+		req.Header.Set("X-Ninja-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(*&req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("POST %s: %s", h.Url, resp.Status)
+	}
+	return
+}
+
+func (h *webhook) deliver(cursor int64, changes []change) {
+	var selected []change
+	for _, c := range changes {
+		if h.matches(*&c) {
+			selected = append(*&selected, *&c)
+		}
+	}
+	if len(*&selected) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{*&cursor, *&selected})
+	if err != nil {
+		log.Println(*&err)
+		return
+	}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = h.post(*&body)
+		if err == nil {
+			return
+		}
+		log.Println("Webhook delivery failed:", *&err)
+		time.Sleep(webhookRetryDelay * time.Duration(*&attempt))
+	}
+}
+
+// Each hook gets its own goroutine, so that a slow endpoint does not hold
+// the others back.
+func startWebhooks(hooks []webhook) {
+	queues := make([]chan webhookPayload, len(hooks))
+	for i := range hooks {
+		h := &hooks[i]
+		queues[i] = make(chan webhookPayload, 64)
+		go func(queue chan webhookPayload) {
+			for p := range queue {
+				h.deliver(p.Cursor, p.Changes)
+			}
+		}(queues[i])
+	}
+	followJournal(func(latest int64, changes []change) {
+		for _, q := range queues {
+			select {
+			case q <- webhookPayload{*&latest, *&changes}:
+			default:
+				log.Println("Webhook queue full, dropping changes up to", *&latest)
+			}
+		}
+	})
+}
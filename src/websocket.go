@@ -0,0 +1,208 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// WEBSOCKETS
+
+// Minimal RFC 6455 server side implementation, enough for the JSON
+// messages exchanged with the editor.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const wsMaxMessage = 1 << 20
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var errWsHandshake = errors.New("not a websocket handshake")
+var errWsTooLarge = errors.New("websocket message too large")
+
+type wsConn struct {
+	conn  net.Conn
+	rw    *bufio.ReadWriter
+	mutex sync.Mutex
+}
+
+func headerContains(h http.Header, name string, value string) bool {
+	for _, v := range strings.Split(h.Get(*&name), ",") {
+		if strings.EqualFold(strings.TrimSpace(*&v), *&value) {
+			return true
+		}
+	}
+	return false
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (c *wsConn, err error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, errWsHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errWsHandshake
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(c.rw, head[:])
+	if err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return
+	}
+	if length > wsMaxMessage {
+		err = errWsTooLarge
+		return
+	}
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(c.rw, mask[:])
+		if err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.rw, *&payload)
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Reads the next data message, answering pings and reassembling fragments.
+func (c *wsConn) readMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			err = c.writeMessage(wsPong, *&payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeMessage(wsClose, nil)
+			return 0, nil, io.EOF
+		case wsContinuation:
+		default:
+			opcode = op
+		}
+		message = append(*&message, payload...)
+		if len(*&message) > wsMaxMessage {
+			return 0, nil, errWsTooLarge
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) writeMessage(opcode byte, payload []byte) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	head := []byte{0x80 | opcode}
+	switch l := len(*&payload); {
+	case l < 126:
+		head = append(*&head, byte(l))
+	case l <= 0xFFFF:
+		head = append(*&head, 126, byte(l>>8), byte(l))
+	default:
+		head = append(*&head, 127)
+		head = binary.BigEndian.AppendUint64(*&head, uint64(l))
+	}
+	_, err = c.rw.Write(*&head)
+	if err != nil {
+		return
+	}
+	_, err = c.rw.Write(*&payload)
+	if err != nil {
+		return
+	}
+	err = c.rw.Flush()
+	return
+}
+
+func (c *wsConn) setReadTimeout(d time.Duration) {
+	c.conn.SetReadDeadline(time.Now().Add(*&d))
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,139 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+//////// XXHASH
+
+// 64 bits xxHash, a non-cryptographic hash several times faster than
+// SHA-256, enough to tell files apart when nobody crafts collisions.
+// Sums are big endian, as printed by xxhsum.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+func newXXHash64() hash.Hash64 {
+	h := &xxHash64{}
+	h.Reset()
+	return h
+}
+
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(*&acc, 31) * xxPrime1
+}
+
+func xxMergeRound(acc uint64, v uint64) uint64 {
+	acc ^= xxRound(0, *&v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (h *xxHash64) Reset() {
+	// Wrapping around, which constants can't
+	p1 := xxPrime1
+	h.v = [4]uint64{p1 + xxPrime2, xxPrime2, 0, -p1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxHash64) Size() int      { return 8 }
+func (h *xxHash64) BlockSize() int { return 32 }
+
+func (h *xxHash64) stripe(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(b[i*8:]))
+	}
+}
+
+func (h *xxHash64) Write(p []byte) (n int, err error) {
+	n = len(p)
+	h.total += uint64(n)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], *&p)
+		h.n += c
+		p = p[c:]
+		if h.n < len(h.buf) {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for len(p) >= 32 {
+		h.stripe(p[:32])
+		p = p[32:]
+	}
+	h.n = copy(h.buf[:], *&p)
+	return
+}
+
+func (h *xxHash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxMergeRound(*&acc, *&v)
+		}
+	} else {
+		acc = xxPrime5
+	}
+	acc += h.total
+	b := h.buf[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(*&b))
+		acc = bits.RotateLeft64(*&acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(*&b)) * xxPrime1
+		acc = bits.RotateLeft64(*&acc, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		acc ^= uint64(*&c) * xxPrime5
+		acc = bits.RotateLeft64(*&acc, 11) * xxPrime1
+	}
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func (h *xxHash64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(*&b, h.Sum64())
+}
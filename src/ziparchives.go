@@ -0,0 +1,243 @@
+/*
+
+	This file is part of Ninja Go Local Cloud (https://pacien.net/projects/ninja-go-local-cloud).
+
+	Ninja Go Local Cloud is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	Ninja Go Local Cloud is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Ninja Go Local Cloud. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////// BROWSABLE ZIP ARCHIVES
+
+// With -browse-zips, the ZIP archives of the projects can be listed as
+// directories and their entries read without extracting them, so that
+// downloaded asset packs can be looked through before being imported.
+// Archives themselves stay files, which read and download as before, and
+// their entries are read-only. Archives the backend cannot read at random
+// are read into memory, up to maxZipInMemory.
+
+const maxZipInMemory = 64 << 20
+const maxOpenZips = 16
+
+var errZipTooLarge = errors.New("archive too large to be browsed")
+
+type browsedZip struct {
+	modTime time.Time
+	size    int64
+	reader  *zip.Reader
+	closer  io.Closer
+}
+
+var openZips = struct {
+	sync.Mutex
+	archives map[string]*browsedZip
+}{archives: make(map[string]*browsedZip)}
+
+type zipStorage struct {
+	storage
+}
+
+// Entry of an archive, the directories it only implies dated like it.
+type zipEntryInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (i zipEntryInfo) ModTime() time.Time {
+	if t := i.FileInfo.ModTime(); !t.IsZero() {
+		return t
+	}
+	return i.modTime
+}
+
+// Reader of the archive at name, opened again when it changed.
+func (s zipStorage) archive(name string, info os.FileInfo) (z *browsedZip, ok bool) {
+	openZips.Lock()
+	defer openZips.Unlock()
+	if z, ok = openZips.archives[name]; ok && z.modTime.Equal(info.ModTime()) && z.size == info.Size() {
+		return
+	}
+	if ok {
+		z.closer.Close()
+		delete(openZips.archives, *&name)
+	}
+	z = &browsedZip{modTime: info.ModTime(), size: info.Size()}
+	f, err := s.storage.open(*&name)
+	if err != nil {
+		logDebug("fs", "not browsing", *&name, *&err)
+		return nil, false
+	}
+	z.closer = f
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		// Read into memory, as long as it is small enough
+		var content []byte
+		if info.Size() > maxZipInMemory {
+			err = errZipTooLarge
+		} else {
+			content, err = ioutil.ReadAll(*&f)
+		}
+		ra = bytes.NewReader(*&content)
+	}
+	if err == nil {
+		z.reader, err = zip.NewReader(*&ra, info.Size())
+	}
+	if err != nil {
+		logDebug("fs", "not browsing", *&name, *&err)
+		f.Close()
+		return nil, false
+	}
+	if len(openZips.archives) >= maxOpenZips {
+		for n, other := range openZips.archives {
+			other.closer.Close()
+			delete(openZips.archives, *&n)
+			break
+		}
+	}
+	openZips.archives[name] = z
+	return z, true
+}
+
+// Splits a path going through an archive into the archive and the path of
+// the entry within, "." for the archive itself.
+func (s zipStorage) split(name string) (z *browsedZip, entry string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(*&name)), "/")
+	for i, part := range parts {
+		if !strings.EqualFold(filepath.Ext(*&part), ".zip") {
+			continue
+		}
+		archive := filepath.Join(parts[:i+1]...)
+		info, err := s.storage.stat(*&archive)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		if z, ok = s.archive(*&archive, *&info); !ok {
+			return
+		}
+		return z, strings.Join(parts[i+1:], "/"), true
+	}
+	return
+}
+
+// Whether a path is below an archive, for the calls changing it, which
+// does not need to open the archive.
+func (s zipStorage) inArchive(name string) bool {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(*&name)), "/")
+	for i, part := range parts[:len(parts)-1] {
+		if !strings.EqualFold(filepath.Ext(*&part), ".zip") {
+			continue
+		}
+		info, err := s.storage.stat(filepath.Join(parts[:i+1]...))
+		return err == nil && info.Mode().IsRegular()
+	}
+	return false
+}
+
+func (s zipStorage) stat(name string) (os.FileInfo, error) {
+	z, entry, ok := s.split(*&name)
+	if !ok || entry == "" {
+		return s.storage.stat(*&name)
+	}
+	info, err := fsStorage{z.reader}.stat(*&entry)
+	if err != nil {
+		return nil, err
+	}
+	return zipEntryInfo{info, z.modTime}, nil
+}
+
+func (s zipStorage) readDir(name string) ([]os.FileInfo, error) {
+	z, entry, ok := s.split(*&name)
+	if !ok {
+		return s.storage.readDir(*&name)
+	}
+	if entry == "" {
+		entry = "."
+	}
+	list, err := fsStorage{z.reader}.readDir(*&entry)
+	for i := range list {
+		list[i] = zipEntryInfo{list[i], z.modTime}
+	}
+	return list, err
+}
+
+func (s zipStorage) open(name string) (io.ReadCloser, error) {
+	z, entry, ok := s.split(*&name)
+	if !ok || entry == "" {
+		return s.storage.open(*&name)
+	}
+	return fsStorage{z.reader}.open(*&entry)
+}
+
+func (s zipStorage) create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if s.inArchive(*&name) {
+		return nil, readOnlyError("open", *&name)
+	}
+	return s.storage.create(*&name, *&perm)
+}
+
+func (s zipStorage) createNew(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if s.inArchive(*&name) {
+		return nil, readOnlyError("open", *&name)
+	}
+	return s.storage.createNew(*&name, *&perm)
+}
+
+func (s zipStorage) mkdirAll(name string, perm os.FileMode) error {
+	if s.inArchive(*&name) {
+		return readOnlyError("mkdir", *&name)
+	}
+	return s.storage.mkdirAll(*&name, *&perm)
+}
+
+func (s zipStorage) remove(name string) error {
+	if s.inArchive(*&name) {
+		return readOnlyError("remove", *&name)
+	}
+	return s.storage.remove(*&name)
+}
+
+func (s zipStorage) removeAll(name string) error {
+	if s.inArchive(*&name) {
+		return readOnlyError("remove", *&name)
+	}
+	return s.storage.removeAll(*&name)
+}
+
+func (s zipStorage) rename(source string, dest string) error {
+	if s.inArchive(*&source) || s.inArchive(*&dest) {
+		return &os.LinkError{Op: "rename", Old: source, New: dest, Err: os.ErrPermission}
+	}
+	return s.storage.rename(*&source, *&dest)
+}
+
+func (s zipStorage) chmod(name string, mode os.FileMode) error {
+	if s.inArchive(*&name) {
+		return readOnlyError("chmod", *&name)
+	}
+	return s.storage.chmod(*&name, *&mode)
+}